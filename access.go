@@ -0,0 +1,177 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Access statistics record when each answered question was last asked and roughly
+// how often, so zone owners can find records nobody queries any more. One in
+// --access-sample answered queries is recorded, and at most maxAccessEntries
+// questions are tracked. They are kept across restarts with --cache-file.
+const maxAccessEntries = 100000
+
+type accessKey struct {
+	zone  string
+	name  string
+	qtype uint16
+}
+
+type accessEntry struct {
+	count int64 // estimated, sampled count times the sample rate
+	last  time.Time
+}
+
+type accessStats struct {
+	every   uint64 // sample rate
+	seen    uint64
+	mu      sync.Mutex
+	since   time.Time // when tracking started
+	entries map[accessKey]*accessEntry
+}
+
+func newAccessStats(every int) *accessStats {
+	return &accessStats{every: uint64(every), since: time.Now(), entries: map[accessKey]*accessEntry{}}
+}
+
+// record counts an answered question, if it is sampled. It is nil-safe.
+func (a *accessStats) record(c *config, zone, name string, qtype uint16) {
+	if a == nil || atomic.AddUint64(&a.seen, 1)%a.every != 0 {
+		return
+	}
+	k := accessKey{zone, strings.ToLower(name), qtype}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, ok := a.entries[k]
+	if !ok {
+		if len(a.entries) >= maxAccessEntries {
+			c.stats.Incr("access.dropped", 1)
+			return
+		}
+		e = &accessEntry{}
+		a.entries[k] = e
+	}
+	e.count += int64(a.every)
+	e.last = time.Now()
+}
+
+// staleRecord is an RRset that hasn't been queried recently, for the admin API
+type staleRecord struct {
+	Zone  string `json:"zone"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Count int64  `json:"count"`
+	Last  string `json:"last_queried"` // empty if never queried
+}
+
+type byRecord []staleRecord
+
+func (p byRecord) Len() int      { return len(p) }
+func (p byRecord) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byRecord) Less(i, j int) bool {
+	if p[i].Zone != p[j].Zone {
+		return p[i].Zone < p[j].Zone
+	}
+	if p[i].Name != p[j].Name {
+		return p[i].Name < p[j].Name
+	}
+	return p[i].Type < p[j].Type
+}
+
+// staleRecords reports the RRsets of every zone not queried since cutoff. An RRset
+// counts as queried by a question for its type, an ANY question, or for a CNAME, any
+// question at its name.
+func (c *config) staleRecords(cutoff time.Time) []staleRecord {
+	if c.reloads != nil {
+		c.reloads.run.Lock()
+		defer c.reloads.run.Unlock()
+	}
+	a := c.access
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	byName := map[accessKey][]*accessEntry{} // with qtype 0 for every question at a name
+	for k, e := range a.entries {
+		byName[k] = append(byName[k], e)
+		atName := k
+		atName.qtype = 0
+		byName[atName] = append(byName[atName], e)
+	}
+	report := []staleRecord{}
+	for _, z := range c.zones {
+		seen := map[accessKey]bool{}
+		for _, rr := range z.rrs {
+			h := rr.Header()
+			k := accessKey{z.name, strings.ToLower(h.Name), h.Rrtype}
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			entries := append([]*accessEntry{}, byName[k]...)
+			entries = append(entries, byName[accessKey{k.zone, k.name, dns.TypeANY}]...)
+			if h.Rrtype == dns.TypeCNAME {
+				entries = byName[accessKey{k.zone, k.name, 0}]
+			}
+			s := staleRecord{Zone: z.name, Name: h.Name, Type: dns.Type(h.Rrtype).String()}
+			var last time.Time
+			for _, e := range entries {
+				s.Count += e.count
+				if e.last.After(last) {
+					last = e.last
+				}
+			}
+			if last.After(cutoff) {
+				continue
+			}
+			if !last.IsZero() {
+				s.Last = last.Format(time.RFC3339)
+			}
+			report = append(report, s)
+		}
+	}
+	sort.Sort(byRecord(report))
+	return report
+}
+
+// savedAccess is an access statistics entry in the --cache-file
+type savedAccess struct {
+	Zone  string    `json:"zone"`
+	Name  string    `json:"name"`
+	Type  uint16    `json:"type"`
+	Count int64     `json:"count"`
+	Last  time.Time `json:"last"`
+}
+
+func (a *accessStats) save() ([]savedAccess, time.Time) {
+	if a == nil {
+		return nil, time.Time{}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	saved := []savedAccess{}
+	for k, e := range a.entries {
+		saved = append(saved, savedAccess{k.zone, k.name, k.qtype, e.count, e.last})
+	}
+	return saved, a.since
+}
+
+func (a *accessStats) restore(saved []savedAccess, since time.Time) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !since.IsZero() && since.Before(a.since) {
+		a.since = since
+	}
+	for _, s := range saved {
+		if len(a.entries) >= maxAccessEntries {
+			return
+		}
+		a.entries[accessKey{s.Zone, s.Name, s.Type}] = &accessEntry{s.Count, s.Last}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAccessStats(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, access: newAccessStats(1)}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	testQuery(&c, "abc.com", "abc.com.", dns.TypeMX)
+	testQuery(&c, "abc.com", "www.abc.com.", dns.TypeA)  // answered by the CNAME
+	testQuery(&c, "abc.com", "nope.abc.com.", dns.TypeA) // not answered, not tracked
+	testQuery(&c, "abc.com", "abc.com.", dns.TypeAAAA)   // no answer either
+	if len(c.access.entries) != 2 {
+		t.Errorf("Expected two answered questions to be tracked, got %v", c.access.entries)
+	}
+
+	stale := map[string]staleRecord{}
+	for _, s := range c.staleRecords(time.Now().Add(-time.Hour)) {
+		stale[s.Name+" "+s.Type] = s
+	}
+	for _, want := range []string{"abc.com. SOA", "abc.com. NS", "abc.com. A"} {
+		if _, ok := stale[want]; !ok {
+			t.Errorf("Expected %s in the stale records, got %v", want, stale)
+		}
+	}
+	for _, fresh := range []string{"abc.com. MX", "www.abc.com. CNAME"} {
+		if _, ok := stale[fresh]; ok {
+			t.Errorf("Expected %s not to be stale", fresh)
+		}
+	}
+	if len(c.staleRecords(time.Now().Add(time.Hour))) != len(stale)+2 {
+		t.Errorf("Expected every record to be stale with a future cutoff")
+	}
+
+	saved, since := c.access.save()
+	restarted := newAccessStats(1)
+	restarted.restore(saved, since)
+	if len(restarted.entries) != 2 || !restarted.since.Equal(since) {
+		t.Errorf("Expected access statistics to be restored, got %v since %s", restarted.entries, restarted.since)
+	}
+
+	sampled := newAccessStats(2)
+	for i := 0; i < 3; i++ {
+		sampled.record(&c, "abc.com", "abc.com.", dns.TypeMX)
+	}
+	if e := sampled.entries[accessKey{"abc.com", "abc.com.", dns.TypeMX}]; e == nil || e.count != 2 {
+		t.Errorf("Expected one sampled query counted twice, got %v", e)
+	}
+
+	w := httptest.NewRecorder()
+	c.apiHandler(nil).ServeHTTP(w, httptest.NewRequest("GET", "/access/stale?days=30", nil))
+	report := struct {
+		Since   string        `json:"tracking_since"`
+		Records []staleRecord `json:"records"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || w.Code != http.StatusOK || len(report.Records) != len(stale) {
+		t.Errorf("GET /access/stale: want: %d with %d records, got: %d %s", http.StatusOK, len(stale), w.Code, w.Body.String())
+	}
+	c.access = nil
+	w = httptest.NewRecorder()
+	c.apiHandler(nil).ServeHTTP(w, httptest.NewRequest("GET", "/access/stale", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected the report to be unavailable when disabled, got %d", w.Code)
+	}
+}
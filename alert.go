@@ -0,0 +1,185 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// For deployments without a metrics stack, --alert-hooks are told directly about
+// critical conditions:
+//
+//   - zoneload: zones failed to parse or load on a reload
+//   - backend: the bucket has been unreachable for longer than --alert-after
+//   - listener: the UDP or TCP listener failed and is being restarted (see
+//     watchdog.go), or another listener failed, just before neddns exits
+//   - signing: a zone's DNSSEC keys are bad, it couldn't be signed or it failed a
+//     --sign-audit self-check
+//   - probe: a --self-probe address stopped answering over UDP, TCP or the --probe-api
+//
+// A hook is an incoming webhook URL, such as Slack's or Teams', which gets
+// {"text": ...} with a few more fields, or pagerduty://<routing key> for a
+// PagerDuty Events API v2 trigger. The same alert is sent at most once per
+// alertRepeat, so a zone that keeps failing doesn't page every reload.
+const (
+	alertRepeat   = time.Hour
+	pagerDutyHook = "pagerduty://"
+	alertBackend  = "backend"
+	alertListener = "listener"
+	alertZoneLoad = "zoneload"
+	alertSigning  = "signing"
+	alertProbe    = "probe"
+	alertNS       = "delegation"
+	alertSeverity = "critical"
+)
+
+var pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+type alerter struct {
+	hooks []*secret
+	after time.Duration // how long the backend may be unreachable before alerting
+	host  string
+
+	mu          sync.Mutex
+	sent        map[string]time.Time
+	failingFrom time.Time // first backend failure since it last worked
+}
+
+// checkAlertHook checks a hook is a webhook URL or a PagerDuty routing key
+func checkAlertHook(hook string) error {
+	if strings.HasPrefix(hook, pagerDutyHook) {
+		if len(hook) == len(pagerDutyHook) {
+			return fmt.Errorf("pagerduty:// needs a routing key")
+		}
+		return nil
+	}
+	return checkWebhook(hook)
+}
+
+func newAlerter(hooks []*secret, after time.Duration) *alerter {
+	host, _ := os.Hostname()
+	return &alerter{hooks: hooks, after: after, host: host, sent: map[string]time.Time{}}
+}
+
+// alertPayload is what webhook hooks get
+type alertPayload struct {
+	Text  string `json:"text"`
+	Kind  string `json:"kind"`
+	Host  string `json:"host"`
+	Error string `json:"error"`
+	Time  string `json:"time"`
+}
+
+// alert sends msg about kind to every hook in the background, unless an alert about
+// the same kind and subject was sent within alertRepeat. It is nil-safe.
+func (a *alerter) alert(c *config, kind, subject, msg string) {
+	if a.due(kind, subject, time.Now()) {
+		for _, hook := range a.hooks {
+			go a.send(c, hook.get(), kind, msg)
+		}
+	}
+}
+
+// alertNow is alert for a process about to exit, waiting for the hooks.
+func (a *alerter) alertNow(c *config, kind, subject, msg string) {
+	if !a.due(kind, subject, time.Now()) {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, hook := range a.hooks {
+		wg.Add(1)
+		go func(hook string) {
+			defer wg.Done()
+			a.send(c, hook, kind, msg)
+		}(hook.get())
+	}
+	wg.Wait()
+}
+
+// due reports whether an alert should be sent, recording it if so
+func (a *alerter) due(kind, subject string, now time.Time) bool {
+	if a == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := kind + " " + subject
+	if last, ok := a.sent[key]; ok && now.Sub(last) < alertRepeat {
+		return false
+	}
+	for k, last := range a.sent {
+		if now.Sub(last) >= alertRepeat {
+			delete(a.sent, k)
+		}
+	}
+	a.sent[key] = now
+	return true
+}
+
+func (a *alerter) send(c *config, hook, kind, msg string) error {
+	text := fmt.Sprintf("neddns %s: %s: %s", a.host, kind, msg)
+	var body []byte
+	var err error
+	if strings.HasPrefix(hook, pagerDutyHook) {
+		body, err = json.Marshal(map[string]interface{}{
+			"routing_key":  strings.TrimPrefix(hook, pagerDutyHook),
+			"event_action": "trigger",
+			"dedup_key":    "neddns-" + a.host + "-" + kind,
+			"payload": map[string]string{
+				"summary":   text,
+				"source":    a.host,
+				"severity":  alertSeverity,
+				"component": "neddns",
+				"class":     kind,
+			},
+		})
+		hook = pagerDutyURL
+	} else {
+		body, err = json.Marshal(alertPayload{Text: text, Kind: kind, Host: a.host, Error: msg, Time: time.Now().UTC().Format(time.RFC3339)})
+	}
+	if err != nil {
+		return err
+	}
+	return c.postJSON(hook, body, "alert")
+}
+
+// backendFailed notes a failed fetch from the bucket, alerting once it has been
+// failing for longer than --alert-after.
+func (a *alerter) backendFailed(c *config, err error, now time.Time) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	if a.failingFrom.IsZero() {
+		a.failingFrom = now
+	}
+	failing := now.Sub(a.failingFrom)
+	a.mu.Unlock()
+	if failing > a.after {
+		a.alert(c, alertBackend, "bucket", fmt.Sprintf("bucket unreachable for %s: %s", failing/time.Second*time.Second, err.Error()))
+	}
+}
+
+// backendWorked notes a successful fetch from the bucket.
+func (a *alerter) backendWorked() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.failingFrom = time.Time{}
+	a.mu.Unlock()
+}
+
+// listenerFailed alerts that a listener failed and exits.
+func (c *config) listenerFailed(listener string, err error) {
+	if c.handoff.isDraining() { // we closed it, see drain
+		return
+	}
+	c.alerts.alertNow(c, alertListener, listener, fmt.Sprintf("%s listener failed: %s", listener, err.Error()))
+	log.Fatalf("Failed to set %s listener %s\n", listener, err.Error())
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/quipo/statsd"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlertHooks(t *testing.T) {
+	posts := make(chan map[string]interface{}, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Bad alert body: %s", err.Error())
+		}
+		body["path"] = r.URL.Path
+		posts <- body
+	}))
+	defer hook.Close()
+	saved := pagerDutyURL
+	pagerDutyURL = hook.URL + "/pagerduty"
+	defer func() { pagerDutyURL = saved }()
+
+	c := config{stats: statsd.NoopClient{}, update: time.Minute, reloads: &reloadStatus{}, clockSkew: time.Minute} // fetching the zone again
+	c.alerts = newAlerter([]*secret{{value: hook.URL + "/slack"}, {value: "pagerduty://routingkey"}}, 10*time.Minute)
+	getter := testGetter{testZones: map[string]testZone{
+		"abc.com": testZone{LastModified: time.Now(), Contents: "abc.com. IN A not-an-address\n"},
+	}}
+	c.reloadZones(getter)
+	got := map[string]map[string]interface{}{}
+	for i := 0; i < 2; i++ {
+		select {
+		case p := <-posts:
+			got[p["path"].(string)] = p
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected alerts on both hooks, got %v", got)
+		}
+	}
+	if p := got["/slack"]; p["kind"] != alertZoneLoad || !strings.Contains(p["text"].(string), "abc.com") {
+		t.Errorf("Unexpected webhook alert: %v", p)
+	}
+	if p := got["/pagerduty"]; p["routing_key"] != "routingkey" || p["event_action"] != "trigger" {
+		t.Errorf("Unexpected PagerDuty alert: %v", p)
+	}
+	c.reloadZones(getter) // the same failure again isn't sent again
+	select {
+	case p := <-posts:
+		t.Errorf("Expected a repeated alert to be held back, got %v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	now := time.Now()
+	c.alerts.backendFailed(&c, fmt.Errorf("timeout"), now)
+	c.alerts.backendFailed(&c, fmt.Errorf("timeout"), now.Add(5*time.Minute))
+	c.alerts.backendWorked()
+	c.alerts.backendFailed(&c, fmt.Errorf("timeout"), now.Add(20*time.Minute)) // working again reset the clock
+	select {
+	case p := <-posts:
+		t.Errorf("Expected no backend alert before --alert-after, got %v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.alerts.backendFailed(&c, fmt.Errorf("timeout"), now.Add(31*time.Minute))
+	for i := 0; i < 2; i++ {
+		select {
+		case p := <-posts:
+			if text, _ := p["text"].(string); p["path"] == "/slack" && !strings.Contains(text, "bucket unreachable for 11m0s") {
+				t.Errorf("Unexpected backend alert: %v", p)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected a backend alert past --alert-after")
+		}
+	}
+
+	for hook, ok := range map[string]bool{"https://hooks.slack.com/services/x": true, "pagerduty://key": true, "pagerduty://": false, "mailto:ops@example.com": false} {
+		if err := checkAlertHook(hook); (err == nil) != ok {
+			t.Errorf("checkAlertHook(%q): expected ok=%v, got %v", hook, ok, err)
+		}
+	}
+	var nilAlerts *alerter
+	nilAlerts.alert(&c, alertZoneLoad, "x", "x") // nil-safe
+}
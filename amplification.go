@@ -0,0 +1,105 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+)
+
+// amplificationTypes are the query types attackers favor for reflection, as they
+// tend to get the largest answers.
+var amplificationTypes = []uint16{dns.TypeANY, dns.TypeTXT, dns.TypeDNSKEY}
+
+// amplification is the worst case response to request size ratio for a question
+type amplification struct {
+	Zone     string
+	Name     string
+	Type     string
+	Request  int // bytes, for a query with an EDNS0 buffer size of 4096 as attackers send
+	Response int // bytes, as the reply is packed
+	Ratio    float64
+}
+
+type byRatio []amplification
+
+func (p byRatio) Len() int      { return len(p) }
+func (p byRatio) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byRatio) Less(i, j int) bool {
+	if p[i].Ratio != p[j].Ratio {
+		return p[i].Ratio > p[j].Ratio
+	}
+	if p[i].Name != p[j].Name {
+		return p[i].Name < p[j].Name
+	}
+	return p[i].Type < p[j].Type
+}
+
+// amplificationAudit sizes the reply to every amplificationTypes question for every
+// name in the loaded zones, largest ratio first. Questions with no answer are left
+// out, as their replies are about the size of the query.
+func (c *config) amplificationAudit() []amplification {
+	report := []amplification{}
+	for _, z := range c.zones {
+		names := map[string]bool{}
+		for _, rr := range z.rrs {
+			names[rr.Header().Name] = true
+		}
+		for name := range names {
+			for _, qtype := range amplificationTypes {
+				req := new(dns.Msg)
+				req.SetQuestion(name, qtype)
+				req.SetEdns0(4096, false)
+				q, err := req.Pack()
+				if err != nil {
+					continue
+				}
+				rrs, _, _ := z.answer(c, req.Question[0])
+				if len(rrs) == 0 {
+					continue
+				}
+				m := new(dns.Msg)
+				m.SetReply(req)
+				m.Authoritative = true
+				m.Answer = rrs
+				z.authority(m, false)
+				r, err := m.Pack()
+				if err != nil {
+					continue
+				}
+				report = append(report, amplification{
+					Zone:     z.name,
+					Name:     name,
+					Type:     dns.Type(qtype).String(),
+					Request:  len(q),
+					Response: len(r),
+					Ratio:    float64(len(r)) / float64(len(q)),
+				})
+			}
+		}
+	}
+	sort.Sort(byRatio(report))
+	return report
+}
+
+// auditAmplification implements the audit-amplification command, printing the top
+// offenders.
+func (c *config) auditAmplification(getter zoneGetter, top int) ([]amplification, error) {
+	z, err := c.getZones(getter)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.loadZones(z); err != nil {
+		return nil, err
+	}
+	report := c.amplificationAudit()
+	if len(report) > top {
+		report = report[:top]
+	}
+	fmt.Printf("%-6s %8s %8s  %s\n", "RATIO", "REQUEST", "RESPONSE", "QUESTION")
+	for _, a := range report {
+		fmt.Printf("%6.1f %8d %8d  %s %s\n", a.Ratio, a.Request, a.Response, strings.TrimSuffix(a.Name, "."), a.Type)
+	}
+	return report, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/quipo/statsd"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAmplificationAudit(t *testing.T) {
+	big := "big IN TXT \"" + strings.Repeat("x", 250) + "\" \"" + strings.Repeat("y", 250) + "\"\n"
+	zone := strings.Replace(abcZone, "www\t\tIN\tCNAME\tabc.com.", "www\t\tIN\tA\t127.0.0.3", 1) // a CNAME answers every type
+	getter := testGetter{testZones: map[string]testZone{
+		"abc.com": {Contents: zone + big, LastModified: time.Now()},
+	}}
+	c := config{stats: statsd.NoopClient{}}
+	report, err := c.auditAmplification(getter, 3)
+	if err != nil {
+		t.Fatalf("auditAmplification failed: %s", err.Error())
+	}
+	if len(report) != 3 {
+		t.Fatalf("Expected the top 3 questions, got %v", report)
+	}
+	first := report[0]
+	if first.Name != "big.abc.com." || first.Response <= 500 || first.Ratio <= 10 {
+		t.Errorf("Expected the big TXT to be the worst offender, got %+v", first)
+	}
+	if report[1].Ratio > first.Ratio || report[2].Ratio > report[1].Ratio {
+		t.Errorf("Expected the largest ratios first, got %+v", report)
+	}
+	for _, a := range c.amplificationAudit() {
+		if a.Name == "www.abc.com." && a.Type == "TXT" {
+			t.Errorf("Expected questions without answers to be left out, got %+v", a)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"github.com/miekg/dns"
+	"strings"
+	"sync"
+)
+
+// A name with hundreds of records, such as a big pool of addresses or a generated
+// chain of TXT records, makes answers too big for UDP, which resolvers fetch again
+// over TCP only to use a few records. --max-answers, or a zone policy's
+// "max_answers", caps the records of each RRset in an answer, and each query gets
+// the next page of the set, so over many queries every record is handed out about
+// as often. The capped answer is complete as far as the client is concerned: TC
+// isn't set, as asking again over TCP would get the same page. DNSSEC clients get
+// the whole set, as its signature covers every record, and so do zone transfers.
+type answerPages struct {
+	mu     sync.Mutex
+	starts map[hotKey]int // the first record of the next page of each capped RRset
+}
+
+// next returns the first record of the next page of limit records of the RRset k,
+// which has size records; a nil one always starts at the first record
+func (p *answerPages) next(k hotKey, size, limit int) int {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.starts == nil {
+		p.starts = map[hotKey]int{}
+	}
+	start := p.starts[k] % size // the set may have shrunk
+	p.starts[k] = (start + limit) % size
+	return start
+}
+
+// answerLimit returns the most records of an RRset zone z answers with, 0 for all
+func (c *config) answerLimit(z *zone) int {
+	if z.policy != nil && z.policy.MaxAnswers > 0 {
+		return z.policy.MaxAnswers
+	}
+	return c.maxAnswers
+}
+
+// limitAnswers cuts each RRset in rrs, an answer of zone z, down to the next page of
+// the zone's answer limit, keeping the order of the records
+func (c *config) limitAnswers(z *zone, rrs []dns.RR) []dns.RR {
+	limit := c.answerLimit(z)
+	if limit == 0 || len(rrs) <= limit {
+		return rrs
+	}
+	sizes := rrsetSizes(rrs)
+	starts := map[hotKey]int{}
+	seen := map[hotKey]int{}
+	limited := []dns.RR{}
+	for _, rr := range rrs {
+		k := hotKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		size := sizes[k]
+		if size <= limit {
+			limited = append(limited, rr)
+			continue
+		}
+		start, ok := starts[k]
+		if !ok {
+			start = z.pages.next(k, size, limit)
+			starts[k] = start
+			c.stats.Incr("query.limited", 1)
+		}
+		i := seen[k]
+		seen[k]++
+		if (i-start+size)%size < limit {
+			limited = append(limited, rr)
+		}
+	}
+	return limited
+}
+
+// overLimit reports whether rrs has an RRset the zone's answer limit would cut
+func (c *config) overLimit(z *zone, rrs []dns.RR) bool {
+	limit := c.answerLimit(z)
+	if limit == 0 {
+		return false
+	}
+	for _, size := range rrsetSizes(rrs) {
+		if size > limit {
+			return true
+		}
+	}
+	return false
+}
+
+// rrsetSizes counts the records of each RRset in rrs
+func rrsetSizes(rrs []dns.RR) map[hotKey]int {
+	sizes := map[hotKey]int{}
+	for _, rr := range rrs {
+		sizes[hotKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}]++
+	}
+	return sizes
+}
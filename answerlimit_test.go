@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"testing"
+)
+
+func TestAnswerLimit(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}}
+	zone := abcZone
+	for i := 1; i <= 10; i++ {
+		zone += fmt.Sprintf("pool	IN	A	10.0.0.%d\n", i)
+	}
+	if err := c.loadZones(map[string]string{"abc.com": zone, "abc.com.policy": `{"max_answers": 4}`}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	seen := map[string]int{}
+	for i := 0; i < 5; i++ {
+		m := testQuery(&c, "abc.com", "pool.abc.com.", dns.TypeA)
+		if len(m.Answer) != 4 || m.Truncated {
+			t.Fatalf("Expected 4 of the 10 records without TC, got %v", m)
+		}
+		for _, rr := range m.Answer {
+			seen[rr.(*dns.A).A.String()]++
+		}
+	}
+	if len(seen) != 10 || seen["10.0.0.1"] != 2 || seen["10.0.0.10"] != 2 {
+		t.Errorf("Expected every record handed out twice over 5 queries, got %v", seen)
+	}
+	if m := testQuery(&c, "abc.com", "abc.com.", dns.TypeNS); len(m.Answer) != 2 {
+		t.Errorf("Expected sets under the limit answered whole, got %v", m.Answer)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("pool.abc.com.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	w := &testWriter{}
+	c.zones["abc.com"].zoneHandler(&c, w, req)
+	if len(w.msg.Answer) != 10 {
+		t.Errorf("Expected DNSSEC clients to get the whole set, got %d records", len(w.msg.Answer))
+	}
+
+	if p, err := parsePolicy("abc.com", `{"max_answers": -1}`); err == nil {
+		t.Errorf("Expected a negative max_answers to fail, got %v", p)
+	}
+}
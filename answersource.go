@@ -0,0 +1,85 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// With --answer-source, a query from --admin-cidrs carrying the private EDNS option
+// answerSourceCode (with any data) gets the option back in the reply, telling which
+// zone version and code path produced the answer, e.g.
+//
+//	zone=abc.com serial=2014121700 source=abc.com path=flattened
+//
+// Paths are exact, hot (a precomputed answer would have been served), flattened,
+// rewrite, maintenance, redirect, forward, referral and empty; view=<name> is added
+// for views.
+// Ask for it with dig +ednsopt=65001 from an admin network.
+const answerSourceCode = dns.EDNS0LOCALSTART
+
+// answerSourceRequested reports whether the reply to req should be tagged.
+func (c *config) answerSourceRequested(w dns.ResponseWriter, req *dns.Msg) bool {
+	if !c.answerSource {
+		return false
+	}
+	opt := req.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == answerSourceCode {
+			return c.isAdmin(w)
+		}
+	}
+	return false
+}
+
+// answerPath names the code path that built an answer from its debug strings.
+func answerPath(rrs []dns.RR, answers []string, hot bool) string {
+	if len(rrs) == 0 {
+		return "empty"
+	}
+	for _, marker := range []struct{ prefix, path string }{
+		{"(FLAT)", "flattened"},
+		{"(MAINTENANCE)", "maintenance"},
+		{"(REDIRECT)", "redirect"},
+		{"(REWRITE", "rewrite"},
+	} {
+		for _, a := range answers {
+			if strings.HasPrefix(a, marker.prefix) {
+				return marker.path
+			}
+		}
+	}
+	if hot {
+		return "hot"
+	}
+	return "exact"
+}
+
+// tagAnswerSource adds the answer source option to a reply.
+func (z *zone) tagAnswerSource(req, m *dns.Msg, path string) {
+	tag := fmt.Sprintf("zone=%s serial=%d source=%s path=%s", z.name, z.serial(), z.source, path)
+	if len(z.view) > 0 {
+		tag += " view=" + z.view
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		opt.SetUDPSize(req.IsEdns0().UDPSize())
+		m.Extra = append(m.Extra, opt)
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: answerSourceCode, Data: []byte(tag)})
+}
+
+// serial returns the serial of the zone's SOA, or 0 without one.
+func (z *zone) serial() uint32 {
+	for _, rr := range z.rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial
+		}
+	}
+	return 0
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"testing"
+)
+
+func TestAnswerSource(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, hotSize: 1, answerSource: true}
+	c.adminNets, _ = parseCIDRs("127.0.0.0/8")
+	if err := c.loadZones(map[string]string{"abc.com": abcZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	tagged := func(qtype uint16, ask bool) string {
+		req := new(dns.Msg)
+		req.SetQuestion("abc.com.", qtype)
+		req.SetEdns0(1232, false)
+		if ask {
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: answerSourceCode})
+		}
+		w := &testWriter{}
+		c.zones["abc.com"].zoneHandler(&c, w, req)
+		if w.msg == nil {
+			return "(raw)"
+		}
+		if opt := w.msg.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == answerSourceCode {
+					return string(l.Data)
+				}
+			}
+		}
+		return ""
+	}
+	if tag := tagged(dns.TypeMX, true); tag != "zone=abc.com serial=2014121700 source=abc.com path=exact" {
+		t.Errorf("Unexpected answer source tag: %q", tag)
+	}
+	if tag := tagged(dns.TypeAAAA, true); tag != "zone=abc.com serial=2014121700 source=abc.com path=empty" {
+		t.Errorf("Unexpected answer source tag: %q", tag)
+	}
+	tagged(dns.TypeMX, false) // tagged queries aren't counted for the hot cache
+	c.zones["abc.com"].hot.refresh(&c)
+	if tag := tagged(dns.TypeMX, true); tag != "zone=abc.com serial=2014121700 source=abc.com path=hot" {
+		t.Errorf("Expected a hot answer to be built and tagged, got %q", tag)
+	}
+	if tag := tagged(dns.TypeMX, false); tag != "(raw)" {
+		t.Errorf("Expected an untagged query to be answered from the hot cache, got %q", tag)
+	}
+	c.adminNets, _ = parseCIDRs("10.0.0.0/8")
+	if tag := tagged(dns.TypeAAAA, true); tag != "" {
+		t.Errorf("Expected no tag outside the admin networks, got %q", tag)
+	}
+}
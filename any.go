@@ -0,0 +1,66 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// ANY queries are mostly sent to amplify reflection attacks, and resolvers no
+// longer rely on them, so RFC 8482 lets an authoritative server answer them with
+// less than every record at the name. --any sets how, and a zone policy's "hinfo" or
+// "rrset" qtypes action for ANY overrides it for the zone:
+//
+//   - full: every record, as before
+//   - hinfo: a synthesized HINFO record, CPU "RFC8482" (section 4.2)
+//   - rrset: one of the name's RRsets (section 4.1)
+//
+// Either way a name with a CNAME answers with the CNAME, and a name without records
+// gets its usual NXDOMAIN or NODATA, so the answer still tells what exists.
+const anyTTL = 3600
+
+var anyModes = map[string]bool{"full": true, "hinfo": true, "rrset": true}
+
+// anyMode returns how zone z answers ANY queries
+func (c *config) anyMode(z *zone) string {
+	if r := z.policy.qtypeRule(dns.TypeANY); r != nil && (r.Action == "hinfo" || r.Action == "rrset") {
+		return r.Action
+	}
+	if len(c.anyAnswers) == 0 {
+		return "full"
+	}
+	return c.anyAnswers
+}
+
+// minimalANY cuts rrs, the full answer to an ANY query q, down as mode says
+func (c *config) minimalANY(mode string, q dns.Question, rrs []dns.RR) []dns.RR {
+	if mode == "full" || len(rrs) == 0 {
+		return rrs
+	}
+	var first dns.RR
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+		case dns.TypeCNAME:
+			first = rr
+		default:
+			if first == nil {
+				first = rr
+			}
+		}
+	}
+	if first == nil {
+		return rrs
+	}
+	c.stats.Incr("query.any."+mode, 1)
+	if mode == "hinfo" && first.Header().Rrtype != dns.TypeCNAME {
+		return []dns.RR{&dns.HINFO{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: anyTTL}, Cpu: "RFC8482"}}
+	}
+	set := []dns.RR{}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == first.Header().Rrtype && strings.EqualFold(rr.Header().Name, first.Header().Name) {
+			set = append(set, rr)
+		}
+	}
+	return set
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"testing"
+)
+
+func TestMinimalANY(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, anyAnswers: "hinfo"}
+	policy := `{"qtypes": [{"type": "ANY", "action": "rrset"}]}`
+	if err := c.loadZones(map[string]string{"abc.com": abcZone, "def.com": defZone, "def.com.policy": policy}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	m := testQuery(&c, "abc.com", "abc.com.", dns.TypeANY)
+	if len(m.Answer) != 1 {
+		t.Fatalf("Expected a single HINFO, got %v", m.Answer)
+	}
+	if hinfo, ok := m.Answer[0].(*dns.HINFO); !ok || hinfo.Cpu != "RFC8482" || hinfo.Hdr.Name != "abc.com." {
+		t.Errorf("Expected the RFC 8482 HINFO, got %v", m.Answer[0])
+	}
+	if m := testQuery(&c, "abc.com", "www.abc.com.", dns.TypeANY); len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Errorf("Expected the CNAME for a name with one, got %v", m.Answer)
+	}
+	if m := testQuery(&c, "abc.com", "nothere.abc.com.", dns.TypeANY); len(m.Answer) != 0 || m.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected NXDOMAIN for a missing name, got %v", m)
+	}
+
+	m = testQuery(&c, "def.com", "def.com.", dns.TypeANY)
+	if len(m.Answer) == 0 {
+		t.Fatalf("Expected one RRset, got nothing")
+	}
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype != m.Answer[0].Header().Rrtype {
+			t.Errorf("Expected one RRset from the zone's rrset policy, got %v", m.Answer)
+		}
+	}
+	if _, err := parsePolicy("abc.com", `{"qtypes": [{"type": "TXT", "action": "hinfo"}]}`); err == nil {
+		t.Errorf("Expected hinfo refused for types other than ANY")
+	}
+}
@@ -0,0 +1,227 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The admin HTTP API is enabled with --api=<host:port>. Unless --api-token is set it
+// has no authentication of its own, so bind it to localhost or a management network.
+func (c *config) startAPI(doUpdate chan bool) {
+	handler := c.apiHandler(doUpdate)
+	l, err := c.bindTCP(c.apiAddr)
+	if err != nil {
+		log.Fatalf("Failed to start admin API on %s: %s", c.apiAddr, err.Error())
+	}
+	go func() {
+		err := http.Serve(l, handler)
+		if err != nil && !c.handoff.isDraining() {
+			log.Fatalf("Failed admin API on %s: %s", c.apiAddr, err.Error())
+		}
+	}()
+	log.Printf("Admin API listening on %s", c.apiAddr)
+}
+
+func (c *config) apiHandler(doUpdate chan bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) { // POST is the same as SIGHUP
+		switch r.Method {
+		case "GET":
+			writeJSON(w, http.StatusOK, c.reloads.status())
+		case "POST":
+			if c.triggerReload(doUpdate) {
+				writeJSON(w, http.StatusAccepted, map[string]string{"status": "reload queued"})
+			} else {
+				writeJSON(w, http.StatusAccepted, map[string]string{"status": "reload already pending"})
+			}
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use GET or POST"})
+		}
+	})
+	mux.HandleFunc("/zones", func(w http.ResponseWriter, r *http.Request) { // generate zones
+		if r.Method != "POST" {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use POST"})
+			return
+		}
+		if c.backend == nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no zone backend"})
+			return
+		}
+		params, err := readZoneParams(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		zones, err := c.generateZones(params)
+		if err == nil {
+			err = c.storeZones(c.backend, params, zones, true)
+		}
+		if e, ok := err.(errZoneExists); ok {
+			err = recordError{http.StatusConflict, e.Error()}
+		}
+		if err != nil {
+			writeRecordError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"zones": zones})
+	})
+	mux.HandleFunc("/zones/", func(w http.ResponseWriter, r *http.Request) {
+		if n := strings.Trim(strings.TrimPrefix(r.URL.Path, "/zones/"), "/"); len(n) > 0 && !strings.Contains(n, "/") {
+			c.zoneStatusHandler(w, r, n) // the served serial, see push.go
+			return
+		}
+		c.recordsHandler(w, r) // record API, see records.go
+	})
+	mux.HandleFunc("/presets", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, recordPresets)
+	})
+	mux.HandleFunc("/caa", func(w http.ResponseWriter, r *http.Request) { // issuance audit
+		writeJSON(w, http.StatusOK, c.caaAudit())
+	})
+	mux.HandleFunc("/staging", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, c.stagingList())
+	})
+	mux.HandleFunc("/staging/", func(w http.ResponseWriter, r *http.Request) { // /staging/<zone>[/verify|/promote]
+		name, action := path.Split(strings.TrimPrefix(r.URL.Path, "/staging/"))
+		if len(name) == 0 {
+			name, action = action, ""
+		}
+		name = strings.TrimSuffix(name, "/")
+		switch {
+		case action == "" && r.Method == "DELETE":
+			if !c.discardZone(name) {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "zone " + name + " has no staged version"})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"status": "discarded"})
+		case action == "verify" && r.Method == "POST":
+			queries := []stagedQuery{}
+			body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+			if err == nil && len(bytes.TrimSpace(body)) > 0 {
+				err = json.Unmarshal(body, &queries)
+			}
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON: " + err.Error()})
+				return
+			}
+			result, err := c.verifyStaged(name, queries)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, result)
+		case action == "promote" && r.Method == "POST":
+			if err := c.promoteZone(name); err != nil {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"status": "promoted"})
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use DELETE /staging/<zone>, or POST /staging/<zone>/verify or /promote"})
+		}
+	})
+	mux.HandleFunc("/access/stale", func(w http.ResponseWriter, r *http.Request) { // records not queried in ?days=
+		if c.access == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "access statistics are disabled with --access-sample=0"})
+			return
+		}
+		days := 90
+		if arg := r.URL.Query().Get("days"); len(arg) > 0 {
+			var err error
+			if days, err = strconv.Atoi(arg); err != nil || days < 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "days must be a number"})
+				return
+			}
+		}
+		c.access.mu.Lock()
+		since := c.access.since
+		c.access.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"tracking_since": since.Format(time.RFC3339),
+			"records":        c.staleRecords(time.Now().AddDate(0, 0, -days)),
+		})
+	})
+	mux.HandleFunc("/shadow", func(w http.ResponseWriter, r *http.Request) { // shadow read comparisons
+		writeJSON(w, http.StatusOK, c.shadow.report())
+	})
+	mux.HandleFunc("/probes", func(w http.ResponseWriter, r *http.Request) { // self-probe results
+		writeJSON(w, http.StatusOK, c.probe.report())
+	})
+	mux.HandleFunc("/delegations", func(w http.ResponseWriter, r *http.Request) { // see lame.go
+		writeJSON(w, http.StatusOK, c.delegations.report())
+	})
+	mux.HandleFunc("/secondaries", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, c.secondaries.report())
+	})
+	mux.HandleFunc("/dnssec", func(w http.ResponseWriter, r *http.Request) { // signing audit
+		if c.signAudit == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "the signing audit is disabled, enable it with --sign-audit"})
+			return
+		}
+		writeJSON(w, http.StatusOK, c.signAudit.report())
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) { // listener health, see watchdog.go
+		status := http.StatusOK
+		if !c.listeners.ready() {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, map[string]interface{}{"listeners": c.listeners.report()})
+	})
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, c.buildInfo())
+	})
+	if c.apiToken == nil {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(c.apiToken.get())) != 1 {
+			c.stats.Incr("api.unauthorized", 1)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or wrong bearer token"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Warning: admin API response failed: %s", err.Error())
+	}
+}
+
+// readZoneParams accepts a single zone or a list of zones for bulk onboarding.
+func readZoneParams(r *http.Request) ([]zoneParams, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	params := []zoneParams{}
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(body, &params)
+	} else {
+		p := zoneParams{}
+		err = json.Unmarshal(body, &p)
+		params = append(params, p)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON: %s", err.Error())
+	}
+	if len(params) == 0 {
+		return nil, fmt.Errorf("no zones given")
+	}
+	return params, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/quipo/statsd"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIReload(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, reloads: &reloadStatus{}}
+	doUpdate := make(chan bool, 1)
+	handler := c.apiHandler(doUpdate)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/reload", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT /reload: want: %d, got: %d", http.StatusMethodNotAllowed, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/reload", nil))
+	if w.Code != http.StatusAccepted {
+		t.Errorf("POST /reload: want: %d, got: %d", http.StatusAccepted, w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/reload", nil))
+	if !strings.Contains(w.Body.String(), "already pending") {
+		t.Errorf("Expected a second POST /reload to coalesce, got %s", w.Body.String())
+	}
+	select {
+	case <-doUpdate:
+	default:
+		t.Errorf("POST /reload did not trigger an update")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/reload", nil))
+	status := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("GET /reload: want: %d with JSON, got: %d %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if status["in_progress"] != false || status["coalesced"] != float64(1) {
+		t.Errorf("GET /reload: unexpected status %v", status)
+	}
+}
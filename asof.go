@@ -0,0 +1,157 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// With --as-of, neddns serves the bucket as it was at a past time, to reconstruct
+// what was served during an incident. The bucket must have versioning enabled: each
+// key is served at its latest version at or before the time, and keys deleted by
+// then, or not yet created, are left out. Everything else works as usual from those
+// versions, but the bucket is never written, so the record API, POST /zones and
+// ZSK rollover are unavailable. Reloads list the versions again and so keep serving
+// the same state. Listing versions needs s3:ListBucketVersions and fetching them
+// s3:GetObjectVersion.
+const asOfLayout = time.RFC3339
+
+// parseAsOf parses an --as-of time, in RFC 3339 format, which can't be in the future
+func parseAsOf(arg string, now time.Time) (time.Time, error) {
+	t, err := time.Parse(asOfLayout, arg)
+	if err != nil {
+		return t, fmt.Errorf("invalid --as-of %q: use a time like 2015-06-01T14:32:00Z", arg)
+	}
+	if t.After(now) {
+		return t, fmt.Errorf("invalid --as-of %q: it is in the future", arg)
+	}
+	return t, nil
+}
+
+// objectVersion is one version of a key in a versioned bucket, or a delete marker
+type objectVersion struct {
+	key          string
+	id           string
+	lastModified time.Time
+	deleted      bool
+}
+
+// versionsAsOf returns the version of each key current at t, leaving out keys
+// deleted or not yet created then
+func versionsAsOf(versions []objectVersion, t time.Time) map[string]objectVersion {
+	current := map[string]objectVersion{}
+	for _, v := range versions {
+		if v.lastModified.After(t) {
+			continue
+		}
+		if cur, ok := current[v.key]; !ok || v.lastModified.After(cur.lastModified) {
+			current[v.key] = v
+		}
+	}
+	for k, v := range current {
+		if v.deleted {
+			delete(current, k)
+		}
+	}
+	return current
+}
+
+// versionStore is a bucket with the versions of its keys
+type versionStore interface {
+	ListVersions() ([]objectVersion, error)
+	GetZoneVersion(key, version string) (io.ReadCloser, error)
+}
+
+// asOfGetter implements the zoneStore interface over the versions of a bucket
+// current at a past time, refusing writes
+type asOfGetter struct {
+	versions versionStore
+	asOf     time.Time
+	mu       sync.Mutex
+	ids      map[string]string // version IDs by key, from the last ListZones
+}
+
+func newAsOfGetter(s versionStore, asOf time.Time) *asOfGetter {
+	return &asOfGetter{versions: s, asOf: asOf, ids: map[string]string{}}
+}
+
+func (g *asOfGetter) ListZones() ([]zoneFile, error) {
+	zones := []zoneFile{}
+	versions, err := g.versions.ListVersions()
+	if err != nil {
+		return zones, err
+	}
+	current := versionsAsOf(versions, g.asOf)
+	if len(current) == 0 {
+		return zones, fmt.Errorf("No zones found as of %s", g.asOf.Format(asOfLayout))
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.ids = map[string]string{}
+	for k, v := range current {
+		g.ids[k] = v.id
+		zones = append(zones, zoneFile{Key: k, LastModified: v.lastModified, ETag: v.id}) // a version ID names contents as well
+	}
+	sort.Sort(byZoneFileKey(zones))
+	return zones, nil
+}
+
+func (g *asOfGetter) GetZone(key string) (io.ReadCloser, error) {
+	g.mu.Lock()
+	id, ok := g.ids[key]
+	g.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%s didn't exist as of %s", key, g.asOf.Format(asOfLayout))
+	}
+	return g.versions.GetZoneVersion(key, id)
+}
+
+func (g *asOfGetter) PutZone(key string, contents string) error {
+	return fmt.Errorf("not writing %s: serving the bucket as of %s", key, g.asOf.Format(asOfLayout))
+}
+
+// CheckBucket checks the bucket for preflight
+func (g *asOfGetter) CheckBucket() error {
+	if checker, ok := g.versions.(bucketChecker); ok {
+		return checker.CheckBucket()
+	}
+	return nil
+}
+
+type byZoneFileKey []zoneFile
+
+func (p byZoneFileKey) Len() int           { return len(p) }
+func (p byZoneFileKey) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byZoneFileKey) Less(i, j int) bool { return p[i].Key < p[j].Key }
+
+// ListVersions lists every version and delete marker under the prefix
+func (s s3getter) ListVersions() ([]objectVersion, error) {
+	versions := []objectVersion{}
+	connection := s3.New(&aws.Config{Region: aws.String(s.region)})
+	q := s3.ListObjectVersionsInput{
+		Bucket:    aws.String(s.bucket),
+		Delimiter: aws.String("/"),
+		Prefix:    aws.String(s.prefix),
+	}
+	for {
+		resp, err := connection.ListObjectVersions(&q)
+		if err != nil {
+			return versions, err
+		}
+		for _, v := range resp.Versions {
+			versions = append(versions, objectVersion{key: *v.Key, id: *v.VersionId, lastModified: *v.LastModified})
+		}
+		for _, m := range resp.DeleteMarkers {
+			versions = append(versions, objectVersion{key: *m.Key, id: *m.VersionId, lastModified: *m.LastModified, deleted: true})
+		}
+		if resp.IsTruncated == nil || !*resp.IsTruncated {
+			return versions, nil
+		}
+		q.KeyMarker, q.VersionIdMarker = resp.NextKeyMarker, resp.NextVersionIdMarker
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testVersions is a versioned bucket, with the contents of each version by ID
+type testVersions struct {
+	versions []objectVersion
+	contents map[string]string
+}
+
+func (s testVersions) ListVersions() ([]objectVersion, error) { return s.versions, nil }
+
+func (s testVersions) GetZoneVersion(key, version string) (io.ReadCloser, error) {
+	if text, ok := s.contents[version]; ok {
+		return ioutil.NopCloser(strings.NewReader(text)), nil
+	}
+	return nil, fmt.Errorf("no version %s of %s", version, key)
+}
+
+func TestAsOf(t *testing.T) {
+	at := func(hhmm string) time.Time {
+		t, _ := time.Parse(time.RFC3339, "2015-06-01T"+hhmm+":00Z")
+		return t
+	}
+	bucket := testVersions{
+		versions: []objectVersion{
+			{key: "abc.com", id: "v1", lastModified: at("14:00")},
+			{key: "abc.com", id: "v3", lastModified: at("14:40")},
+			{key: "abc.com", id: "v2", lastModified: at("14:30")},
+			{key: "def.com", id: "d1", lastModified: at("13:00")},
+			{key: "def.com", id: "d2", lastModified: at("14:10"), deleted: true},
+			{key: "new.com", id: "n1", lastModified: at("15:00")},
+		},
+		contents: map[string]string{
+			"v1": abcZone,
+			"v2": strings.Replace(abcZone, "2014121700", "2014121701", 1) + "incident IN A 10.0.0.1\n",
+			"v3": strings.Replace(abcZone, "2014121700", "2014121702", 1),
+			"d1": strings.Replace(abcZone, "abc.com", "def.com", -1),
+		},
+	}
+
+	if current := versionsAsOf(bucket.versions, at("14:32")); len(current) != 1 || current["abc.com"].id != "v2" {
+		t.Errorf("Expected only abc.com at v2 as of 14:32, got %v", current)
+	}
+	if current := versionsAsOf(bucket.versions, at("14:05")); len(current) != 2 || current["def.com"].id != "d1" {
+		t.Errorf("Expected def.com before it was deleted, got %v", current)
+	}
+	if current := versionsAsOf(bucket.versions, at("12:00")); len(current) != 0 {
+		t.Errorf("Expected nothing before the first version, got %v", current)
+	}
+
+	c := config{stats: statsd.NoopClient{}}
+	getter := newAsOfGetter(bucket, at("14:32"))
+	zones, err := c.getZones(getter)
+	if err != nil {
+		t.Fatalf("getZones failed: %s", err.Error())
+	}
+	if err := c.loadZones(zones); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if len(c.zones) != 1 || c.zones["abc.com"].serial() != 2014121701 {
+		t.Errorf("Expected the zone as it was at 14:32, got %v", c.zones)
+	}
+	if m := testQuery(&c, "abc.com", "incident.abc.com.", dns.TypeA); len(m.Answer) != 1 {
+		t.Errorf("Expected the record served at 14:32, got %v", m)
+	}
+	if err := getter.PutZone("abc.com", abcZone); err == nil {
+		t.Errorf("Expected writes to be refused")
+	}
+	if _, err := newAsOfGetter(bucket, at("12:00")).ListZones(); err == nil {
+		t.Errorf("Expected an error with no zones as of the time")
+	}
+
+	now := at("16:00")
+	if _, err := parseAsOf("2015-06-01T14:32:00Z", now); err != nil {
+		t.Errorf("parseAsOf failed: %s", err.Error())
+	}
+	for _, bad := range []string{"14:32", "2015-06-01 14:32", "2015-06-01T17:00:00Z"} {
+		if _, err := parseAsOf(bad, now); err == nil {
+			t.Errorf("Expected an error for --as-of %s", bad)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// version, gitCommit and buildDate are set at link time by make (see the Makefile):
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.gitCommit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Anything not set that way is filled in from the build info the go command embeds,
+// so a plain go build or go install of a module still identifies itself.
+var (
+	version   = "dev"
+	gitCommit = "unknown"
+	buildDate = "unknown"
+)
+
+func init() {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		version, gitCommit, buildDate = embeddedBuildInfo(bi, version, gitCommit, buildDate)
+	}
+}
+
+// embeddedBuildInfo fills in the version, commit and build date not set at link time
+func embeddedBuildInfo(bi *debug.BuildInfo, v, commit, date string) (string, string, string) {
+	if v == "dev" && len(bi.Main.Version) > 0 && bi.Main.Version != "(devel)" {
+		v = strings.TrimPrefix(bi.Main.Version, "v")
+	}
+	settings := map[string]string{}
+	for _, s := range bi.Settings {
+		settings[s.Key] = s.Value
+	}
+	if rev := settings["vcs.revision"]; commit == "unknown" && len(rev) > 0 {
+		if len(rev) > 7 {
+			rev = rev[:7] // like git rev-parse --short
+		}
+		if settings["vcs.modified"] == "true" {
+			rev += "-dirty"
+		}
+		commit = rev
+	}
+	if t := settings["vcs.time"]; date == "unknown" && len(t) > 0 {
+		date = t // the commit time, the closest we have to a build date
+	}
+	return v, commit, date
+}
+
+// versionString is printed by --version
+func versionString() string {
+	return fmt.Sprintf("neddns %s (commit %s, built %s, %s %s/%s)", version, gitCommit, buildDate, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// buildInfo is reported by the version TXT record, CHAOS queries and the admin API
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+	Started   string `json:"started"`
+	Uptime    int64  `json:"uptime_secs"`
+	Zones     int    `json:"zones"`
+}
+
+func (c *config) buildInfo() buildInfo {
+	if c.reloads != nil { // registerZone writes c.zones on reloads
+		c.reloads.run.Lock()
+		defer c.reloads.run.Unlock()
+	}
+	return buildInfo{
+		Version:   version,
+		Commit:    gitCommit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Started:   c.startTime.Format(time.RFC3339),
+		Uptime:    int64(time.Since(c.startTime) / time.Second),
+		Zones:     len(c.zones),
+	}
+}
+
+// txt returns the build info as TXT strings, the version first as it always was
+func (b buildInfo) txt() []string {
+	return []string{
+		"v" + b.Version,
+		"commit=" + b.Commit,
+		"built=" + b.BuildDate,
+		"go=" + b.GoVersion,
+		fmt.Sprintf("uptime=%ds", b.Uptime),
+		fmt.Sprintf("zones=%d", b.Zones),
+	}
+}
+
+// chaosHandler answers version.bind and version.server CH TXT queries, as BIND
+// and NSD do, when --chaos is set.
+func (c *config) chaosHandler(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	if len(req.Question) != 1 {
+		w.WriteMsg(m)
+		return
+	}
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+	if q.Qclass == dns.ClassCHAOS && q.Qtype == dns.TypeTXT && (name == "version.bind." || name == "version.server.") {
+		m.Authoritative = true
+		b := c.buildInfo()
+		txt := fmt.Sprintf("NedDNS v%s (%s)", b.Version, b.Commit)
+		m.Answer = []dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0}, Txt: []string{txt}}}
+		c.stats.Incr("query.chaos", 1)
+	} else {
+		m.SetRcode(req, dns.RcodeRefused)
+	}
+	w.WriteMsg(m)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"net/http/httptest"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildInfo(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, startTime: time.Now().Add(-time.Minute), chaosOn: true}
+	c.registerZone(&zone{name: "abc.com"})
+	b := c.buildInfo()
+	if b.Version != version || b.Zones != 1 || b.Uptime < 60 {
+		t.Errorf("Unexpected build info %+v", b)
+	}
+	if txt := b.txt(); txt[0] != "v"+version {
+		t.Errorf("Expected version first in TXT, got %v", txt)
+	}
+
+	c.registerVersionHandler()
+	req := new(dns.Msg)
+	req.SetQuestion(".", dns.TypeTXT)
+	w := &testWriter{}
+	dns.DefaultServeMux.ServeDNS(w, req)
+	if len(w.msg.Answer) != 1 || !strings.Contains(w.msg.Answer[0].String(), "zones=1") {
+		t.Errorf("Expected build info in the version TXT, got %v", w.msg.Answer)
+	}
+
+	req.SetQuestion("jkl.com.", dns.TypeA)
+	w = &testWriter{}
+	dns.DefaultServeMux.ServeDNS(w, req)
+	if w.msg.Rcode != dns.RcodeRefused || w.msg.Authoritative {
+		t.Errorf("Expected REFUSED for a name outside the served zones, got %v", w.msg)
+	}
+	c.outsideFail = true
+	w = &testWriter{}
+	dns.DefaultServeMux.ServeDNS(w, req)
+	if w.msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected SERVFAIL with --outside-zones=SERVFAIL, got %s", dns.RcodeToString[w.msg.Rcode])
+	}
+	c.outsideFail = false
+
+	req.SetQuestion("VERSION.bind.", dns.TypeTXT)
+	req.Question[0].Qclass = dns.ClassCHAOS
+	w = &testWriter{}
+	dns.DefaultServeMux.ServeDNS(w, req)
+	if len(w.msg.Answer) != 1 || w.msg.Answer[0].Header().Class != dns.ClassCHAOS || !strings.Contains(w.msg.Answer[0].String(), version) {
+		t.Errorf("Expected a CH TXT version answer, got %v", w.msg)
+	}
+	req.Question[0].Qclass = dns.ClassINET
+	w = &testWriter{}
+	dns.DefaultServeMux.ServeDNS(w, req)
+	if w.msg.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected IN class version.bind to be refused, got %s", dns.RcodeToString[w.msg.Rcode])
+	}
+
+	rec := httptest.NewRecorder()
+	c.apiHandler(nil).ServeHTTP(rec, httptest.NewRequest("GET", "/version", nil))
+	got := buildInfo{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || got.Version != version || got.GoVersion == "" {
+		t.Errorf("GET /version: unexpected response %s", rec.Body.String())
+	}
+}
+
+func TestEmbeddedBuildInfo(t *testing.T) {
+	bi := &debug.BuildInfo{Main: debug.Module{Version: "v1.2.0"}, Settings: []debug.BuildSetting{
+		{Key: "vcs.revision", Value: "0123456789abcdef"},
+		{Key: "vcs.time", Value: "2015-11-15T01:00:00Z"},
+		{Key: "vcs.modified", Value: "true"},
+	}}
+	v, commit, date := embeddedBuildInfo(bi, "dev", "unknown", "unknown")
+	if v != "1.2.0" || commit != "0123456-dirty" || date != "2015-11-15T01:00:00Z" {
+		t.Errorf("Expected the embedded build info, got %s %s %s", v, commit, date)
+	}
+	v, commit, date = embeddedBuildInfo(bi, "1.3.0", "fedcba9", "2015-12-01T00:00:00Z")
+	if v != "1.3.0" || commit != "fedcba9" || date != "2015-12-01T00:00:00Z" {
+		t.Errorf("Expected link time values to win, got %s %s %s", v, commit, date)
+	}
+	bi.Main.Version = "(devel)"
+	if v, _, _ := embeddedBuildInfo(bi, "dev", "unknown", "unknown"); v != "dev" {
+		t.Errorf("Expected a devel build to stay dev, got %s", v)
+	}
+	if s := versionString(); !strings.HasPrefix(s, "neddns "+version+" (commit "+gitCommit) {
+		t.Errorf("Unexpected --version output %s", s)
+	}
+}
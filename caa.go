@@ -0,0 +1,131 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+)
+
+// caaStatus describes the CAA policy of a zone for the issuance audit
+type caaStatus struct {
+	Zone     string   `json:"zone"`
+	Records  []string `json:"records"`  // CAA records at the apex, as flags tag "value"
+	Injected bool     `json:"injected"` // the records are the --default-caa policy
+}
+
+type byZone []caaStatus
+
+func (p byZone) Len() int           { return len(p) }
+func (p byZone) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byZone) Less(i, j int) bool { return p[i].Zone < p[j].Zone }
+
+// parseDefaultCAA reads --default-caa, a comma separated list of CA domains allowed
+// to issue, or tag=value entries for other properties (issuewild=;, iodef=mailto:...).
+func parseDefaultCAA(list string) ([]*dns.CAA, error) {
+	records := []*dns.CAA{}
+	for _, entry := range splitList(list) {
+		tag, value := "issue", entry
+		if f := strings.SplitN(entry, "=", 2); len(f) == 2 {
+			tag, value = strings.ToLower(f[0]), f[1]
+		}
+		if tag != "issue" && tag != "issuewild" && tag != "iodef" {
+			return nil, fmt.Errorf("invalid --default-caa %q: tag must be issue, issuewild or iodef", entry)
+		}
+		if strings.ContainsAny(value, "\" \t") {
+			return nil, fmt.Errorf("invalid --default-caa %q: value can't contain quotes or spaces", entry)
+		}
+		records = append(records, &dns.CAA{Tag: tag, Value: value})
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("invalid --default-caa: no entries")
+	}
+	return records, nil
+}
+
+// injectCAA adds the default CAA policy at the apex of a zone without one. Zones
+// with an apex CNAME are left alone, as CAA there would be CNAME and other data.
+func (c *config) injectCAA(z *zone) {
+	if len(c.defaultCAA) == 0 {
+		return
+	}
+	apex := dns.Fqdn(z.name)
+	var ttl uint32 = 3600
+	for _, rr := range z.rrs {
+		h := rr.Header()
+		if h.Name != apex {
+			continue
+		}
+		switch h.Rrtype {
+		case dns.TypeCAA, dns.TypeCNAME:
+			return
+		case dns.TypeSOA:
+			ttl = h.Ttl
+		}
+	}
+	rrs := make([]dns.RR, len(z.rrs), len(z.rrs)+len(c.defaultCAA))
+	copy(rrs, z.rrs)
+	for _, d := range c.defaultCAA {
+		rrs = append(rrs, &dns.CAA{Hdr: dns.RR_Header{Name: apex, Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: ttl}, Flag: d.Flag, Tag: d.Tag, Value: d.Value})
+	}
+	z.rrs = rrs
+	z.caaInjected = true
+	c.debug(fmt.Sprintf("Injected default CAA policy for zone %s", z.name))
+}
+
+// caaAudit reports the apex CAA records of every served zone, zones without any first.
+func (c *config) caaAudit() []caaStatus {
+	if c.reloads != nil {
+		c.reloads.run.Lock()
+		defer c.reloads.run.Unlock()
+	}
+	report := []caaStatus{}
+	for _, z := range c.zones {
+		s := caaStatus{Zone: z.name, Records: []string{}, Injected: z.caaInjected}
+		for _, rr := range z.rrs {
+			if caa, ok := rr.(*dns.CAA); ok && caa.Hdr.Name == dns.Fqdn(z.name) {
+				s.Records = append(s.Records, fmt.Sprintf("%d %s \"%s\"", caa.Flag, caa.Tag, caa.Value))
+			}
+		}
+		report = append(report, s)
+	}
+	sort.Sort(byZone(report))
+	missing := []caaStatus{}
+	rest := []caaStatus{}
+	for _, s := range report {
+		if len(s.Records) == 0 {
+			missing = append(missing, s)
+		} else {
+			rest = append(rest, s)
+		}
+	}
+	return append(missing, rest...)
+}
+
+// caaReport implements the caa-report command, returning the number of zones
+// without a CAA policy of their own.
+func (c *config) caaReport(getter zoneGetter) (int, error) {
+	z, err := c.getZones(getter)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.loadZones(z); err != nil {
+		return 0, err
+	}
+	missing := 0
+	for _, s := range c.caaAudit() {
+		switch {
+		case len(s.Records) == 0:
+			fmt.Printf("%s: MISSING\n", s.Zone)
+			missing++
+		case s.Injected:
+			fmt.Printf("%s: DEFAULT %s\n", s.Zone, strings.Join(s.Records, ", "))
+			missing++
+		default:
+			fmt.Printf("%s: %s\n", s.Zone, strings.Join(s.Records, ", "))
+		}
+	}
+	fmt.Printf("%d of %d zones have no CAA records\n", missing, len(c.zones))
+	return missing, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"testing"
+)
+
+func TestParseDefaultCAA(t *testing.T) {
+	records, err := parseDefaultCAA("letsencrypt.org, issuewild=;,iodef=mailto:security@abc.com")
+	if err != nil || len(records) != 3 {
+		t.Fatalf("parseDefaultCAA failed: %v %v", records, err)
+	}
+	if records[0].Tag != "issue" || records[0].Value != "letsencrypt.org" || records[1].Tag != "issuewild" || records[2].Value != "mailto:security@abc.com" {
+		t.Errorf("Unexpected CAA records: %v %v %v", records[0], records[1], records[2])
+	}
+	for _, bad := range []string{"", "color=blue", "letsencrypt.org\""} {
+		if _, err := parseDefaultCAA(bad); err == nil {
+			t.Errorf("parseDefaultCAA accepted %q", bad)
+		}
+	}
+}
+
+func TestDefaultCAA(t *testing.T) {
+	c := &config{stats: statsd.NoopClient{}}
+	c.defaultCAA, _ = parseDefaultCAA("letsencrypt.org")
+	err := c.loadZones(map[string]string{
+		"nocaa.com": "@ 600 IN SOA ns admin 1 10800 1200 864000 600\n@ 600 IN A 10.0.0.1\n",
+		"caa.com":   "@ 600 IN SOA ns admin 1 10800 1200 864000 600\n@ 600 IN CAA 0 issue \"digicert.com\"\n",
+		"flat.com":  "@ 600 IN CNAME lb.other.net.\n",
+	})
+	if err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	m := testQuery(c, "nocaa.com", "nocaa.com.", dns.TypeCAA)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.CAA).Value != "letsencrypt.org" || m.Answer[0].Header().Ttl != 600 {
+		t.Errorf("Expected the default CAA policy, got %v", m.Answer)
+	}
+	m = testQuery(c, "caa.com", "caa.com.", dns.TypeCAA)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.CAA).Value != "digicert.com" {
+		t.Errorf("Expected the zone's own CAA policy, got %v", m.Answer)
+	}
+
+	report := c.caaAudit()
+	if len(report) != 3 || report[0].Zone != "flat.com" || len(report[0].Records) != 0 {
+		t.Fatalf("Expected zones missing CAA first, got %v", report)
+	}
+	if report[1].Zone != "caa.com" || report[1].Injected || report[2].Zone != "nocaa.com" || !report[2].Injected {
+		t.Errorf("Unexpected CAA report: %v", report)
+	}
+	if report[2].Records[0] != `0 issue "letsencrypt.org"` {
+		t.Errorf("Unexpected CAA record format: %s", report[2].Records[0])
+	}
+}
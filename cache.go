@@ -0,0 +1,234 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Flattened root CNAME targets are cached for their upstream TTL, up to the TTL we
+// serve them with. With --cache-file the flatten cache, the hot query list and the
+// access statistics are saved on shutdown and restored at startup, so a restart doesn't send a burst of
+// lookups to the resolver. Hot answers are repacked from the freshly loaded zones
+// rather than saved, so they can't serve records that changed while we were down.
+// Secondary zones are saved whole, with their timers, see secondary.go.
+const flatTTL = 300
+
+type flatEntry struct {
+	A       []net.IP  `json:"a"`
+	Expires time.Time `json:"expires"`
+}
+
+// flatCache holds resolved flattening targets; a nil cache caches nothing
+type flatCache struct {
+	mu      sync.Mutex
+	entries map[string]flatEntry
+	flights map[string]*flatFlight
+}
+
+// flatFlight is a resolver lookup for a flattening target that concurrent cache
+// misses for the same target wait on, rather than each asking the resolver, so a
+// cold cache under load doesn't stampede it
+type flatFlight struct {
+	done   chan struct{}
+	record *dns.Msg
+	err    error
+}
+
+// resolve runs lookup for target, or waits for the one already in flight, and
+// returns its reply, which callers share and mustn't change, and whether it was
+// another caller's
+func (f *flatCache) resolve(target string, lookup func() (*dns.Msg, error)) (*dns.Msg, bool, error) {
+	if f == nil {
+		record, err := lookup()
+		return record, false, err
+	}
+	key := dns.Fqdn(target)
+	f.mu.Lock()
+	if flight, ok := f.flights[key]; ok {
+		f.mu.Unlock()
+		<-flight.done
+		return flight.record, true, flight.err
+	}
+	if f.flights == nil {
+		f.flights = map[string]*flatFlight{}
+	}
+	flight := &flatFlight{done: make(chan struct{})}
+	f.flights[key] = flight
+	f.mu.Unlock()
+	flight.record, flight.err = lookup()
+	f.mu.Lock()
+	delete(f.flights, key)
+	f.mu.Unlock()
+	close(flight.done)
+	return flight.record, false, flight.err
+}
+
+func (f *flatCache) get(target string, now time.Time) ([]net.IP, bool) {
+	if f == nil {
+		return nil, false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.entries[dns.Fqdn(target)]
+	if !ok || !now.Before(e.Expires) {
+		return nil, false
+	}
+	return e.A, true
+}
+
+func (f *flatCache) put(target string, a []net.IP, expires time.Time) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.entries == nil {
+		f.entries = map[string]flatEntry{}
+	}
+	f.entries[dns.Fqdn(target)] = flatEntry{A: a, Expires: expires}
+}
+
+// unexpired returns a copy of the entries still valid at now
+func (f *flatCache) unexpired(now time.Time) map[string]flatEntry {
+	out := map[string]flatEntry{}
+	if f == nil {
+		return out
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for k, e := range f.entries {
+		if now.Before(e.Expires) {
+			out[k] = e
+		}
+	}
+	return out
+}
+
+type savedQuery struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+// warmState is the --cache-file contents
+type warmState struct {
+	Saved     time.Time                 `json:"saved"`
+	Flatten   map[string]flatEntry      `json:"flatten"`
+	Hot       map[string][]savedQuery   `json:"hot"` // by zone name
+	Access    []savedAccess             `json:"access"`
+	Since     time.Time                 `json:"access_since"`
+	Secondary map[string]savedSecondary `json:"secondary"` // by zone name
+}
+
+// openCache opens --cache-file and restores its contents into the loaded zones. The
+// file stays open so it can be saved after a chroot or sandbox forbids opening it.
+func (c *config) openCache() error {
+	f, err := os.OpenFile(c.cacheFile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	c.cacheFd = f
+	var state warmState
+	if err := json.NewDecoder(f).Decode(&state); err != nil {
+		if fi, serr := f.Stat(); serr == nil && fi.Size() > 0 {
+			log.Printf("Warning: ignoring unreadable cache file %s: %s", c.cacheFile, err.Error())
+		}
+		return nil
+	}
+	flat, hot, secondary := c.restoreCache(state, time.Now())
+	log.Printf("Restored %d flattened names, %d hot answers and %d secondary zones saved %s ago", flat, hot, secondary, time.Since(state.Saved).Round(time.Second))
+	return nil
+}
+
+// restoreCache loads unexpired flatten entries, the unexpired secondary zones and
+// the saved hot queries of zones we still serve, returning how many of each were
+// restored.
+func (c *config) restoreCache(state warmState, now time.Time) (int, int, int) {
+	secondary := c.restoreSecondaries(state.Secondary, now) // before their hot queries
+	flat := 0
+	for target, e := range state.Flatten {
+		if now.Before(e.Expires) {
+			c.flat.put(target, e.A, e.Expires)
+			flat++
+		}
+	}
+	hot := 0
+	for name, queries := range state.Hot {
+		z, ok := c.zones[name]
+		if !ok || z.hot == nil {
+			continue
+		}
+		keys := []hotKey{}
+		for _, q := range queries {
+			keys = append(keys, hotKey{q.Name, q.Type})
+			if len(keys) == z.hot.size {
+				break
+			}
+		}
+		packed := z.packAnswers(c, keys)
+		z.hot.packed.Store(packed)
+		hot += len(packed)
+	}
+	c.access.restore(state.Access, state.Since)
+	c.stats.Incr("cache.restored.flatten", int64(flat))
+	c.stats.Incr("cache.restored.hot", int64(hot))
+	c.stats.Incr("cache.restored.secondary", int64(secondary))
+	return flat, hot, secondary
+}
+
+// collectCache collects the caches worth keeping across a restart
+func (c *config) collectCache(now time.Time) warmState {
+	if c.reloads != nil {
+		c.reloads.run.Lock()
+		defer c.reloads.run.Unlock()
+	}
+	state := warmState{Saved: now, Flatten: c.flat.unexpired(now), Hot: map[string][]savedQuery{}}
+	state.Access, state.Since = c.access.save()
+	state.Secondary = c.secondaries.save()
+	for name, z := range c.zones {
+		if z.hot == nil {
+			continue
+		}
+		packed := z.hot.packed.Load().(map[hotKey][]byte)
+		if len(packed) == 0 {
+			continue
+		}
+		queries := []savedQuery{}
+		for k := range packed {
+			queries = append(queries, savedQuery{k.name, k.qtype})
+		}
+		state.Hot[name] = queries
+	}
+	return state
+}
+
+// saveCache writes the caches to --cache-file, if set, for the next start.
+func (c *config) saveCache() {
+	if c.cacheFd == nil {
+		return
+	}
+	state := c.collectCache(time.Now())
+	b, err := json.Marshal(state)
+	if err == nil {
+		if err = c.cacheFd.Truncate(0); err == nil {
+			if _, err = c.cacheFd.WriteAt(b, 0); err == nil {
+				err = c.cacheFd.Sync()
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: could not save cache file %s: %s", c.cacheFile, err.Error())
+		return
+	}
+	hot := 0
+	for _, queries := range state.Hot {
+		hot += len(queries)
+	}
+	c.debug(fmt.Sprintf("Saved %d flattened names and %d hot queries to %s", len(state.Flatten), hot, c.cacheFile))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlatCache(t *testing.T) {
+	now := time.Now()
+	var nilCache *flatCache
+	nilCache.put("def.com", []net.IP{net.ParseIP("127.0.0.2")}, now.Add(time.Minute))
+	if _, ok := nilCache.get("def.com", now); ok {
+		t.Errorf("Expected a nil cache to cache nothing")
+	}
+
+	f := &flatCache{}
+	f.put("def.com", []net.IP{net.ParseIP("127.0.0.2")}, now.Add(time.Minute))
+	if a, ok := f.get("def.com.", now); !ok || len(a) != 1 || !a[0].Equal(net.ParseIP("127.0.0.2")) {
+		t.Errorf("Expected a cached address, got %v %v", a, ok)
+	}
+	if _, ok := f.get("def.com.", now.Add(time.Minute)); ok {
+		t.Errorf("Expected the entry to expire")
+	}
+	if len(f.unexpired(now.Add(2*time.Minute))) != 0 {
+		t.Errorf("Expected expired entries not to be saved")
+	}
+
+	c := &config{stats: statsd.NoopClient{}, flat: f}
+	flat, err := c.flattenCNAME(&dns.CNAME{Hdr: dns.RR_Header{Name: "flat.com."}, Target: "def.com."})
+	if err != nil || len(flat) != 1 || flat[0].(*dns.A).A.String() != "127.0.0.2" || flat[0].Header().Name != "flat.com." {
+		t.Errorf("Expected flattening from the cache without a resolver, got %v %v", flat, err)
+	}
+}
+
+func TestFlatCacheResolve(t *testing.T) {
+	f := &flatCache{}
+	release := make(chan struct{})
+	var lookups, shared int32
+	lookup := func() (*dns.Msg, error) {
+		atomic.AddInt32(&lookups, 1)
+		<-release
+		return new(dns.Msg), nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok, err := f.resolve("def.com", lookup); err == nil && ok {
+				atomic.AddInt32(&shared, 1)
+			}
+		}()
+	}
+	for atomic.LoadInt32(&lookups) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond) // let the rest join the lookup in flight
+	close(release)
+	wg.Wait()
+	if lookups != 1 || shared != 9 {
+		t.Errorf("Expected one lookup shared by the rest, got %d lookups and %d shared", lookups, shared)
+	}
+	if _, ok, _ := f.resolve("def.com", lookup); ok || lookups != 2 {
+		t.Errorf("Expected a new lookup once the last one finished")
+	}
+}
+
+func TestWarmCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "neddns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.json")
+
+	c := config{stats: statsd.NoopClient{}, hotSize: 10, cacheFile: path, flat: &flatCache{}}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if err := c.openCache(); err != nil {
+		t.Fatalf("openCache failed: %s", err.Error())
+	}
+	z := c.zones["abc.com"]
+	z.hot.packed.Store(z.packAnswers(&c, []hotKey{{"abc.com.", dns.TypeMX}}))
+	c.flat.put("def.com.", []net.IP{net.ParseIP("127.0.0.2")}, time.Now().Add(time.Minute))
+	c.flat.put("old.com.", []net.IP{net.ParseIP("127.0.0.3")}, time.Now().Add(-time.Minute))
+	c.saveCache()
+	c.cacheFd.Close()
+
+	restarted := config{stats: statsd.NoopClient{}, hotSize: 10, cacheFile: path, flat: &flatCache{}}
+	if err := restarted.loadZones(map[string]string{"abc.com": abcZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if err := restarted.openCache(); err != nil {
+		t.Fatalf("openCache failed: %s", err.Error())
+	}
+	defer restarted.cacheFd.Close()
+	if w := hotQuery(&restarted, "abc.com", "abc.com.", dns.TypeMX, 1, false); w.raw == nil {
+		t.Errorf("Expected abc.com MX to be hot after a restart")
+	}
+	if _, ok := restarted.flat.get("def.com.", time.Now()); !ok {
+		t.Errorf("Expected def.com to be restored to the flatten cache")
+	}
+	if _, ok := restarted.flat.get("old.com.", time.Now()); ok {
+		t.Errorf("Expected expired old.com not to be restored")
+	}
+
+	ioutil.WriteFile(path, []byte("not json"), 0644)
+	broken := config{stats: statsd.NoopClient{}, cacheFile: path}
+	if err := broken.openCache(); err != nil {
+		t.Errorf("Expected an unreadable cache file to be ignored, got %s", err.Error())
+	}
+	broken.cacheFd.Close()
+
+	if paths := (&config{cacheFile: path}).writablePaths(); len(paths) != 1 {
+		t.Errorf("Expected --cache-file to be refused with --readonly, got %v", paths)
+	}
+}
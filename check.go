@@ -0,0 +1,197 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// zoneProblem is a single finding from checkZone or an external zone checker
+type zoneProblem struct {
+	severity string // "error" or "warning"
+	name     string
+	msg      string
+}
+
+func (p zoneProblem) String() string {
+	return fmt.Sprintf("%s: %s: %s", p.severity, p.name, p.msg)
+}
+
+type byName []zoneProblem
+
+func (p byName) Len() int           { return len(p) }
+func (p byName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byName) Less(i, j int) bool { return p[i].name < p[j].name }
+
+// externalCheckers are run against our normalized zone when installed, so a zone
+// we accept is known to load on BIND, NSD and Knot secondaries as well.
+var externalCheckers = []struct {
+	cmd  string
+	args func(origin, file string) []string
+}{
+	{"named-checkzone", func(origin, file string) []string { return []string{origin, file} }},
+	{"kzonecheck", func(origin, file string) []string { return []string{"-o", origin, file} }},
+}
+
+// checkZones validates local zone files, printing problems to stdout.
+// Zones are named after their file name, just like bucket keys.
+func (c *config) checkZones() bool {
+	ok := true
+	for _, file := range c.zoneFiles {
+		name := filepath.Base(file)
+		problems := []zoneProblem{}
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			problems = append(problems, zoneProblem{"error", name, err.Error()})
+		} else if strings.HasSuffix(name, policySuffix) {
+			if err := checkPolicyLayer(strings.TrimSuffix(name, policySuffix), string(b)); err != nil {
+				problems = append(problems, zoneProblem{"error", name, err.Error()})
+			}
+		} else if rrs, err := parseZoneFile(name, string(b)); err != nil {
+			problems = append(problems, zoneProblem{"error", name, err.Error()})
+		} else {
+			problems = append(problems, checkZone(name, rrs)...)
+			problems = append(problems, checkEmailAuth(name, rrs, c.resolverLookup)...)
+			problems = append(problems, externalCheck(name, rrs)...)
+		}
+		sort.Stable(byName(problems))
+		for _, p := range problems {
+			fmt.Printf("%s: %s\n", file, p)
+			if p.severity == "error" {
+				ok = false
+			}
+		}
+		if len(problems) == 0 {
+			fmt.Printf("%s: OK\n", file)
+		}
+	}
+	return ok
+}
+
+// checkZone applies the same structural checks as named-checkzone to a parsed zone.
+func checkZone(name string, rrs []dns.RR) []zoneProblem {
+	problems := []zoneProblem{}
+	origin := dns.Fqdn(strings.ToLower(name))
+	types := map[string]map[uint16][]dns.RR{}
+	delegations := map[string]bool{}
+	seen := map[string]bool{}
+	for _, rr := range rrs {
+		h := rr.Header()
+		owner := strings.ToLower(h.Name)
+		if !dns.IsSubDomain(origin, owner) {
+			problems = append(problems, zoneProblem{"error", owner, "record is outside zone " + origin})
+			continue
+		}
+		txt := strings.ToLower(rr.String())
+		if seen[txt] {
+			problems = append(problems, zoneProblem{"warning", owner, "duplicate record " + rr.String()})
+			continue
+		}
+		seen[txt] = true
+		if types[owner] == nil {
+			types[owner] = map[uint16][]dns.RR{}
+		}
+		types[owner][h.Rrtype] = append(types[owner][h.Rrtype], rr)
+		if h.Rrtype == dns.TypeNS && owner != origin {
+			delegations[owner] = true
+		}
+	}
+
+	problems = append(problems, checkNames(rrs)...)
+
+	apex := types[origin]
+	if len(apex[dns.TypeSOA]) != 1 {
+		problems = append(problems, zoneProblem{"error", origin, fmt.Sprintf("zone must have exactly one SOA (found %d)", len(apex[dns.TypeSOA]))})
+	}
+	if len(apex[dns.TypeNS]) < 1 {
+		problems = append(problems, zoneProblem{"error", origin, "zone has no NS records"})
+	}
+
+	for owner, rrsets := range types {
+		if cnames := rrsets[dns.TypeCNAME]; len(cnames) > 0 {
+			if len(cnames) > 1 {
+				problems = append(problems, zoneProblem{"error", owner, "multiple CNAME records"})
+			}
+			for t := range rrsets {
+				if t != dns.TypeCNAME && t != dns.TypeRRSIG && t != dns.TypeNSEC {
+					problems = append(problems, zoneProblem{"error", owner, "CNAME and other data (" + dns.Type(t).String() + ")"})
+				}
+			}
+		}
+		for t, rrset := range rrsets {
+			for _, rr := range rrset[1:] {
+				if rr.Header().Ttl != rrset[0].Header().Ttl {
+					problems = append(problems, zoneProblem{"warning", owner, "TTL mismatch in " + dns.Type(t).String() + " RRset"})
+					break
+				}
+			}
+		}
+		for d := range delegations {
+			if owner != d && dns.IsSubDomain(d, owner) {
+				for t := range rrsets {
+					if t != dns.TypeA && t != dns.TypeAAAA {
+						problems = append(problems, zoneProblem{"warning", owner, "record below delegation " + d + " is occluded"})
+						break
+					}
+				}
+			}
+		}
+	}
+
+	targets := map[string]string{} // in-zone target -> referring type
+	for _, rrsets := range types {
+		for _, rr := range rrsets[dns.TypeNS] {
+			targets[strings.ToLower(rr.(*dns.NS).Ns)] = "NS"
+		}
+		for _, rr := range rrsets[dns.TypeMX] {
+			targets[strings.ToLower(rr.(*dns.MX).Mx)] = "MX"
+		}
+	}
+	for target, t := range targets {
+		if !dns.IsSubDomain(origin, target) {
+			continue
+		}
+		rrsets := types[target]
+		if len(rrsets[dns.TypeCNAME]) > 0 {
+			problems = append(problems, zoneProblem{"error", target, t + " target is a CNAME (illegal)"})
+		} else if len(rrsets[dns.TypeA]) < 1 && len(rrsets[dns.TypeAAAA]) < 1 {
+			problems = append(problems, zoneProblem{"error", target, t + " target has no address records (A or AAAA)"})
+		}
+	}
+	return problems
+}
+
+// externalCheck runs any installed external zone checkers over our normalized zone.
+func externalCheck(name string, rrs []dns.RR) []zoneProblem {
+	problems := []zoneProblem{}
+	var b bytes.Buffer
+	for _, rr := range rrs {
+		b.WriteString(rr.String() + "\n")
+	}
+	for _, checker := range externalCheckers {
+		path, err := exec.LookPath(checker.cmd)
+		if err != nil {
+			continue
+		}
+		f, err := ioutil.TempFile("", "neddns-check")
+		if err != nil {
+			return append(problems, zoneProblem{"error", name, err.Error()})
+		}
+		f.WriteString(b.String())
+		f.Close()
+		out, err := exec.Command(path, checker.args(dns.Fqdn(name), f.Name())...).CombinedOutput()
+		os.Remove(f.Name())
+		if err != nil {
+			msg := strings.Replace(strings.TrimSpace(string(out)), f.Name(), name, -1)
+			problems = append(problems, zoneProblem{"error", name, checker.cmd + " rejected zone: " + msg})
+		}
+	}
+	return problems
+}
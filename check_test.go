@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var goodZone = `$TTL    300
+$ORIGIN good.com.
+@		IN	SOA	nsa admin ( 2014121700 10800 1200 864000 7200 )
+		IN	NS	nsa
+		IN	NS	ns.other.net.
+		IN	MX	10 mail
+nsa		IN	A	127.0.0.4
+mail		IN	A	127.0.0.5
+www		IN	CNAME	@
+sub		IN	NS	ns.sub
+ns.sub		IN	A	127.0.0.6
+`
+
+var badZone = `$TTL    300
+$ORIGIN bad.com.
+@		IN	NS	nsa
+		IN	MX	10 mail
+mail		IN	CNAME	www
+www		IN	CNAME	@
+www		IN	A	127.0.0.7
+www		600	IN	A	127.0.0.8
+other.com.	IN	A	127.0.0.9
+sub		IN	NS	ns.other.net.
+txt.sub		IN	TXT	"hidden"
+`
+
+func checkMessages(problems []zoneProblem) string {
+	msgs := []string{}
+	for _, p := range problems {
+		msgs = append(msgs, p.String())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func TestCheckZone(t *testing.T) {
+	rrs, err := parseZoneFile("good.com", goodZone)
+	if err != nil {
+		t.Fatalf("parseZoneFile failed: %s", err.Error())
+	}
+	if problems := checkZone("good.com", rrs); len(problems) != 0 {
+		t.Errorf("checkZone found problems in a good zone:\n%s", checkMessages(problems))
+	}
+
+	rrs, err = parseZoneFile("bad.com", badZone)
+	if err != nil {
+		t.Fatalf("parseZoneFile failed: %s", err.Error())
+	}
+	msgs := checkMessages(checkZone("bad.com", rrs))
+	for _, want := range []string{
+		"exactly one SOA",
+		"nsa.bad.com.: NS target has no address records",
+		"mail.bad.com.: MX target is a CNAME",
+		"www.bad.com.: CNAME and other data",
+		"TTL mismatch in A RRset",
+		"outside zone",
+		"below delegation sub.bad.com.",
+	} {
+		if !strings.Contains(msgs, want) {
+			t.Errorf("checkZone missed problem: want: %s, got:\n%s", want, msgs)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+)
+
+// chroot confines the process to c.chrootDir. CA certificates are loaded first
+// since the chroot usually lacks them, and the files still needed inside it are
+// checked so a broken chroot is reported at startup rather than at the next update.
+func (c *config) chroot() error {
+	if _, err := x509.SystemCertPool(); err != nil {
+		log.Printf("Warning: could not load CA certificates before chroot: %s", err.Error())
+	}
+	if err := syscall.Chroot(c.chrootDir); err != nil {
+		return fmt.Errorf("chroot %s: %s", c.chrootDir, err.Error())
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	if _, err := os.Stat("/etc/resolv.conf"); err != nil {
+		log.Printf("Warning: %s/etc/resolv.conf is missing, S3 and resolver host names will not resolve", c.chrootDir)
+	}
+	c.debug(fmt.Sprintf("Chrooted to %s", c.chrootDir))
+	return nil
+}
@@ -0,0 +1,10 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+)
+
+func (c *config) chroot() error {
+	return fmt.Errorf("--chroot is not supported on Windows")
+}
@@ -0,0 +1,124 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clients are classified by their query pattern over each --classify window, to tell
+// attack and probe traffic from resolver load:
+//
+//   - scanner: mostly unanswered questions for many different names, like random
+//     label floods and zone walking
+//   - monitor: the same one or two questions over and over, like health checks
+//   - stub: mostly recursion desired queries, from stub resolvers and forwarders
+//     rather than recursive resolvers
+//   - resolver: everything else with enough queries to judge
+//   - light: too few queries in the window to judge
+//
+// The clients.<class> gauges count clients and clients.queries.<class> their
+// queries, for each window.
+const (
+	maxClassifiedClients = 50000
+	classifyMinQueries   = 20
+	maxTrackedQuestions  = 64 // distinct questions remembered per client, enough to judge
+)
+
+type clientStats struct {
+	queries    int
+	unanswered int
+	recursive  int
+	questions  map[hotKey]bool
+}
+
+type clientClassifier struct {
+	every   time.Duration
+	mu      sync.Mutex
+	clients map[string]*clientStats
+}
+
+func newClientClassifier(every time.Duration) *clientClassifier {
+	return &clientClassifier{every: every, clients: map[string]*clientStats{}}
+}
+
+// observe records a query from w. It is nil-safe.
+func (cc *clientClassifier) observe(c *config, w dns.ResponseWriter, req *dns.Msg, answered bool) {
+	if cc == nil {
+		return
+	}
+	ip := remoteIP(w)
+	if ip == nil {
+		return
+	}
+	q := req.Question[0]
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	s, ok := cc.clients[string(ip)]
+	if !ok {
+		if len(cc.clients) >= maxClassifiedClients {
+			c.stats.Incr("clients.overflow", 1)
+			return
+		}
+		s = &clientStats{questions: map[hotKey]bool{}}
+		cc.clients[string(ip)] = s
+	}
+	s.queries++
+	if !answered {
+		s.unanswered++
+	}
+	if req.RecursionDesired {
+		s.recursive++
+	}
+	if len(s.questions) < maxTrackedQuestions {
+		s.questions[hotKey{strings.ToLower(q.Name), q.Qtype}] = true
+	}
+}
+
+// classify names the class of a client from its window's statistics
+func (s *clientStats) classify() string {
+	switch {
+	case s.queries < classifyMinQueries:
+		return "light"
+	case s.unanswered*2 >= s.queries && len(s.questions) >= classifyMinQueries:
+		return "scanner"
+	case len(s.questions) <= 2:
+		return "monitor"
+	case s.recursive*2 > s.queries:
+		return "stub"
+	}
+	return "resolver"
+}
+
+var clientClasses = []string{"scanner", "monitor", "stub", "resolver", "light"}
+
+// rotate classifies the clients of the window that just ended, starting a new one.
+// It returns the clients and queries by class.
+func (cc *clientClassifier) rotate() (map[string]int, map[string]int) {
+	cc.mu.Lock()
+	clients := cc.clients
+	cc.clients = map[string]*clientStats{}
+	cc.mu.Unlock()
+	counts, queries := map[string]int{}, map[string]int{}
+	for _, s := range clients {
+		class := s.classify()
+		counts[class]++
+		queries[class] += s.queries
+	}
+	return counts, queries
+}
+
+// classifyClients sends the classification of each window until the process exits.
+func (c *config) classifyClients() {
+	for range time.Tick(c.clients.every) {
+		counts, queries := c.clients.rotate()
+		for _, class := range clientClasses {
+			c.stats.Gauge("clients."+class, int64(counts[class]))
+			c.stats.Gauge("clients.queries."+class, int64(queries[class]))
+		}
+		c.debug(fmt.Sprintf("Client classes: %v, queries: %v", counts, queries))
+	}
+}
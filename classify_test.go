@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"testing"
+	"time"
+)
+
+func TestClientClassification(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, clients: newClientClassifier(time.Minute)}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	for i := 0; i < 30; i++ {
+		testQuery(&c, "abc.com", fmt.Sprintf("r%d.abc.com.", i), dns.TypeA) // random labels
+	}
+	counts, queries := c.clients.rotate()
+	if counts["scanner"] != 1 || queries["scanner"] != 30 {
+		t.Errorf("Expected a scanner, got %v %v", counts, queries)
+	}
+	if counts, _ := c.clients.rotate(); len(counts) != 0 {
+		t.Errorf("Expected a new window after rotating, got %v", counts)
+	}
+
+	questions := func(n int) map[hotKey]bool {
+		q := map[hotKey]bool{}
+		for i := 0; i < n; i++ {
+			q[hotKey{fmt.Sprintf("n%d.abc.com.", i), dns.TypeA}] = true
+		}
+		return q
+	}
+	for _, tc := range []struct {
+		stats clientStats
+		want  string
+	}{
+		{clientStats{queries: 5, questions: questions(5)}, "light"},
+		{clientStats{queries: 100, questions: questions(1)}, "monitor"},
+		{clientStats{queries: 100, recursive: 80, questions: questions(30)}, "stub"},
+		{clientStats{queries: 100, unanswered: 10, questions: questions(40)}, "resolver"},
+		{clientStats{queries: 100, unanswered: 90, questions: questions(64)}, "scanner"},
+	} {
+		if got := tc.stats.classify(); got != tc.want {
+			t.Errorf("classify(%+v): want: %s, got: %s", tc.stats, tc.want, got)
+		}
+	}
+}
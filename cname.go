@@ -0,0 +1,62 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// A query for a name with a CNAME is answered with the CNAME whatever type it asks
+// for, and when the CNAME's target is in the zone too its records follow in the same
+// answer, chain and all (RFC 1034 section 3.6.2), so clients don't have to ask again.
+// Targets outside the zone, below a delegation point or missing are left to the
+// resolver, as are CNAMEs at the apex, which are flattened instead. A chain that
+// loops or runs longer than maxCNAMEChain is cut short.
+const maxCNAMEChain = 8
+
+// cnameApplies reports whether a CNAME answers queries for qtype: every type but the
+// DNSSEC records that live beside it
+func cnameApplies(qtype uint16) bool {
+	switch qtype {
+	case dns.TypeCNAME, dns.TypeRRSIG, dns.TypeNSEC:
+		return false
+	}
+	return true
+}
+
+// followCNAMEs adds the records of in-zone CNAME targets to rrs, an answer for q
+func (z *zone) followCNAMEs(c *config, q dns.Question, rrs []dns.RR, answers []string, cacheable bool) ([]dns.RR, []string, bool) {
+	if q.Qtype == dns.TypeANY || !cnameApplies(q.Qtype) {
+		return rrs, answers, cacheable
+	}
+	apex := dns.Fqdn(strings.ToLower(z.name))
+	name := strings.ToLower(q.Name)
+	seen := map[string]bool{name: true}
+	last := rrs
+	for {
+		next := dns.Question{Qtype: q.Qtype, Qclass: q.Qclass}
+		for _, rr := range last {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				next.Name = cname.Target
+			}
+		}
+		target := strings.ToLower(next.Name)
+		if len(target) == 0 || !dns.IsSubDomain(apex, target) || !z.nameExists(next.Name) || z.delegationFor(next) != "" {
+			break
+		}
+		if seen[target] || len(seen) > maxCNAMEChain {
+			c.stats.Incr("query.cname.loop", 1)
+			c.debug(fmt.Sprintf("CNAME chain from %s loops or is too long at %s", q.Name, target))
+			break
+		}
+		seen[target] = true
+		found, nextAnswers, ok := z.lookup(c, next)
+		c.stats.Incr("query.cname.followed", 1)
+		rrs = append(rrs, found...)
+		answers = append(answers, nextAnswers...)
+		cacheable = cacheable && ok
+		name, last = target, found
+	}
+	return rrs, answers, cacheable
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"testing"
+)
+
+func TestCNAMEChain(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}}
+	zone := abcZone + `www6	IN	AAAA	2001:db8::1
+chain	IN	CNAME	www.abc.com.
+v6	IN	CNAME	www6.abc.com.
+away	IN	CNAME	www.example.net.
+dangling	IN	CNAME	nothere.abc.com.
+loop1	IN	CNAME	loop2.abc.com.
+loop2	IN	CNAME	loop1.abc.com.
+`
+	if err := c.loadZones(map[string]string{"abc.com": zone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+
+	m := testQuery(&c, "abc.com", "chain.abc.com.", dns.TypeA)
+	if len(m.Answer) != 3 || m.Answer[0].(*dns.CNAME).Target != "www.abc.com." || m.Answer[1].(*dns.CNAME).Target != "abc.com." || m.Answer[2].(*dns.A).A.String() != "127.0.0.1" {
+		t.Errorf("Expected the chain followed to the apex address, got %v", m.Answer)
+	}
+	if m := testQuery(&c, "abc.com", "v6.abc.com.", dns.TypeAAAA); len(m.Answer) != 2 || m.Answer[1].(*dns.AAAA).AAAA.String() != "2001:db8::1" {
+		t.Errorf("Expected the CNAME and its target's AAAA, got %v", m.Answer)
+	}
+	if m := testQuery(&c, "abc.com", "www.abc.com.", dns.TypeMX); len(m.Answer) != 2 || m.Answer[1].Header().Rrtype != dns.TypeMX {
+		t.Errorf("Expected the CNAME to answer other types too, got %v", m.Answer)
+	}
+	if m := testQuery(&c, "abc.com", "www.abc.com.", dns.TypeCNAME); len(m.Answer) != 1 {
+		t.Errorf("Expected only the CNAME for a CNAME query, got %v", m.Answer)
+	}
+	for _, name := range []string{"away.abc.com.", "dangling.abc.com."} {
+		if m := testQuery(&c, "abc.com", name, dns.TypeA); len(m.Answer) != 1 || m.Rcode != dns.RcodeSuccess {
+			t.Errorf("Expected just the CNAME for %s, left to the resolver, got %v", name, m)
+		}
+	}
+	if m := testQuery(&c, "abc.com", "loop1.abc.com.", dns.TypeA); len(m.Answer) != 2 {
+		t.Errorf("Expected a looping chain cut short, got %v", m.Answer)
+	}
+	if m := testQuery(&c, "abc.com", "abc.com.", dns.TypeAAAA); len(m.Answer) != 0 {
+		t.Errorf("Expected NODATA at the apex, got %v", m.Answer)
+	}
+}
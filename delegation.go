@@ -0,0 +1,221 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+)
+
+// delegationOnly keeps only what a parent zone used purely for delegations should
+// serve: the apex SOA, NS and DNSSEC records, NS and DS records at delegation
+// points, and glue addresses for nameservers. It returns the kept records and the
+// dropped ones, so data accidentally left in the zone file never leaks out.
+func delegationOnly(name string, rrs []dns.RR) ([]dns.RR, []dns.RR) {
+	apex := dns.Fqdn(strings.ToLower(name))
+	cuts := map[string]bool{}
+	nameservers := map[string]bool{}
+	for _, rr := range rrs {
+		if ns, ok := rr.(*dns.NS); ok {
+			if owner := strings.ToLower(ns.Hdr.Name); owner != apex {
+				cuts[owner] = true
+			}
+			nameservers[strings.ToLower(ns.Ns)] = true
+		}
+	}
+	below := func(owner string) bool {
+		for cut := range cuts {
+			if dns.IsSubDomain(cut, owner) {
+				return true
+			}
+		}
+		return false
+	}
+	kept, dropped := []dns.RR{}, []dns.RR{}
+	for _, rr := range rrs {
+		h := rr.Header()
+		owner := strings.ToLower(h.Name)
+		keep := false
+		switch h.Rrtype {
+		case dns.TypeSOA, dns.TypeDNSKEY, dns.TypeNSEC3PARAM, dns.TypeCDS, dns.TypeCDNSKEY:
+			keep = owner == apex
+		case dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			keep = true
+		case dns.TypeDS:
+			keep = cuts[owner]
+		case dns.TypeA, dns.TypeAAAA:
+			keep = nameservers[owner] || below(owner)
+		}
+		if keep {
+			kept = append(kept, rr)
+		} else {
+			dropped = append(dropped, rr)
+		}
+	}
+	return kept, dropped
+}
+
+// delegationFor returns the delegation point a query for q is referred to, the
+// one closest to the apex at or above q.Name, or "" when the zone answers it. The
+// parent answers for the DS records at a delegation point, and zones with the
+// answer_glue policy answer every name from their own records, as they used to.
+func (z *zone) delegationFor(q dns.Question) string {
+	if z.policy != nil && z.policy.AnswerGlue {
+		return ""
+	}
+	cuts := delegationPoints(dns.Fqdn(z.name), z.rrs)
+	if len(cuts) == 0 {
+		return ""
+	}
+	labels := dns.SplitDomainName(strings.ToLower(q.Name))
+	for i := len(labels) - 1; i >= 0; i-- {
+		name := dns.Fqdn(strings.Join(labels[i:], "."))
+		if cuts[name] && (i > 0 || q.Qtype != dns.TypeDS) {
+			return name
+		}
+	}
+	return ""
+}
+
+// referral makes m a referral to the nameservers of the delegation at cut: the NS
+// records go in the authority section without the AA bit, with their addresses
+// from the zone in the additional section. With do, the DS records of the
+// delegation and their signatures are added, or the NSEC record proving it has
+// none; NSEC3 zones refer without the proof.
+func (z *zone) referral(m *dns.Msg, cut string, do bool) {
+	m.Authoritative = false
+	m.Answer = []dns.RR{}
+	ns, ds := []dns.RR{}, []dns.RR{}
+	for _, rr := range z.rrs {
+		if !strings.EqualFold(rr.Header().Name, cut) {
+			continue
+		}
+		switch rr.Header().Rrtype {
+		case dns.TypeNS:
+			ns = append(ns, rr)
+		case dns.TypeDS:
+			ds = append(ds, rr)
+		}
+	}
+	m.Ns = append(m.Ns, ns...)
+	if do {
+		proof := hotKey{cut, dns.TypeDS}
+		if len(ds) == 0 {
+			if nsec := z.nsecAt(cut); nsec != nil {
+				ds, proof = []dns.RR{nsec}, hotKey{cut, dns.TypeNSEC}
+			}
+		}
+		m.Ns = append(m.Ns, ds...)
+		if s, ok := z.sigs[proof]; ok && len(ds) > 0 {
+			m.Ns = append(m.Ns, s.sigs...)
+		}
+	}
+	m.Extra = append(m.Extra, z.additionalAddresses(ns, false)...)
+}
+
+// nsecAt returns the NSEC record owned by name, if the zone has one
+func (z *zone) nsecAt(name string) *dns.NSEC {
+	for _, nsec := range z.nsecs {
+		if strings.EqualFold(nsec.Hdr.Name, name) {
+			return nsec
+		}
+	}
+	return nil
+}
+
+// authority fills in the authority and additional sections of m the way other
+// authoritative servers do: a positive answer carries the zone's apex NS records in
+// the authority section, unless they are the answer, and the addresses the zone has
+// for in-zone nameservers, mail servers and SRV targets go in the additional
+// section, leaving out those already answered (see additionalAddresses). With do,
+// all of them come with their signatures.
+func (z *zone) authority(m *dns.Msg, do bool) {
+	apex := strings.ToLower(dns.Fqdn(z.name))
+	answered := map[hotKey]bool{}
+	for _, rr := range m.Answer {
+		answered[hotKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}] = true
+	}
+	if len(m.Answer) > 0 && !answered[hotKey{apex, dns.TypeNS}] {
+		ns := []dns.RR{}
+		for _, rr := range z.rrs {
+			if rr.Header().Rrtype == dns.TypeNS && strings.EqualFold(rr.Header().Name, apex) {
+				ns = append(ns, rr)
+			}
+		}
+		m.Ns = append(m.Ns, ns...)
+		if s, ok := z.sigs[hotKey{apex, dns.TypeNS}]; ok && do && len(ns) > 0 {
+			m.Ns = append(m.Ns, s.sigs...)
+		}
+	}
+	pointers := append(append([]dns.RR{}, m.Answer...), m.Ns...)
+	for _, rr := range z.additionalAddresses(pointers, do) {
+		k := hotKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			k.qtype = sig.TypeCovered
+		}
+		if !answered[k] {
+			m.Extra = append(m.Extra, rr)
+		}
+	}
+}
+
+// additionalAddresses returns the A and AAAA records the zone has for the names
+// the records in rrs point at, for the additional section: the targets of NS
+// records, glue included, and of MX and SRV records the zone answers for, so mail
+// servers and SRV clients don't need another round trip. Targets outside the zone
+// are left to the resolver. With do, addresses the zone is authoritative for come
+// with their signatures; glue below a delegation point is never signed.
+func (z *zone) additionalAddresses(rrs []dns.RR, do bool) []dns.RR {
+	apex := dns.Fqdn(z.name)
+	targets := map[string]bool{}
+	for _, rr := range rrs {
+		target, answered := "", true
+		switch rr := rr.(type) {
+		case *dns.NS:
+			target, answered = rr.Ns, false
+		case *dns.MX:
+			target = rr.Mx
+		case *dns.SRV:
+			target = rr.Target
+		}
+		target = strings.ToLower(target)
+		if len(target) == 0 || !dns.IsSubDomain(apex, target) {
+			continue
+		}
+		if answered && z.delegationFor(dns.Question{Name: target, Qtype: dns.TypeA}) != "" {
+			continue // glue is only for finding nameservers
+		}
+		targets[target] = true
+	}
+	extra := []dns.RR{}
+	if len(targets) == 0 {
+		return extra
+	}
+	signed := map[hotKey]bool{}
+	for _, rr := range z.rrs {
+		h := rr.Header()
+		if (h.Rrtype != dns.TypeA && h.Rrtype != dns.TypeAAAA) || !targets[strings.ToLower(h.Name)] {
+			continue
+		}
+		extra = append(extra, rr)
+		signed[hotKey{strings.ToLower(h.Name), h.Rrtype}] = true
+	}
+	if do {
+		for _, k := range sortedHotKeys(signed) {
+			if s, ok := z.sigs[k]; ok {
+				extra = append(extra, s.sigs...)
+			}
+		}
+	}
+	return extra
+}
+
+// sortedHotKeys returns the keys of set in canonical order
+func sortedHotKeys(set map[hotKey]bool) []hotKey {
+	keys := []hotKey{}
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Sort(byHotKey(keys))
+	return keys
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"testing"
+)
+
+var parentZone = `$ORIGIN parent.com.
+@		300	IN	SOA	ns1 admin 1 10800 1200 864000 300
+@		300	IN	NS	ns1
+@		300	IN	MX	10 mail
+ns1		300	IN	A	10.0.0.1
+www		300	IN	A	10.0.0.2
+child		300	IN	NS	ns.child
+child		300	IN	DS	60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118
+ns.child	300	IN	A	10.0.0.3
+other		300	IN	NS	ns.other.net.
+`
+
+func TestDelegationOnly(t *testing.T) {
+	c := &config{stats: statsd.NoopClient{}}
+	err := c.loadZones(map[string]string{
+		"parent.com":        parentZone,
+		"parent.com.policy": `{"delegation_only": true}`,
+	})
+	if err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	for _, q := range []struct {
+		name    string
+		qtype   uint16
+		answers int
+	}{
+		{"parent.com.", dns.TypeSOA, 1},
+		{"parent.com.", dns.TypeNS, 1},
+		{"parent.com.", dns.TypeMX, 0},
+		{"ns1.parent.com.", dns.TypeA, 1},
+		{"www.parent.com.", dns.TypeA, 0},
+		{"child.parent.com.", dns.TypeNS, 0}, // referred, see TestReferral
+		{"child.parent.com.", dns.TypeDS, 1},
+		{"ns.child.parent.com.", dns.TypeA, 0},
+		{"other.parent.com.", dns.TypeNS, 0},
+	} {
+		if m := testQuery(c, "parent.com", q.name, q.qtype); len(m.Answer) != q.answers {
+			t.Errorf("%s %s: want %d answers, got %v", q.name, dns.Type(q.qtype), q.answers, m.Answer)
+		}
+	}
+
+	// turning the policy off serves the dropped records again without a zone reload
+	if err := c.loadZones(map[string]string{"parent.com.policy": `{}`}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if m := testQuery(c, "parent.com", "www.parent.com.", dns.TypeA); len(m.Answer) != 1 {
+		t.Errorf("Expected www served after the policy change, got %v", m.Answer)
+	}
+}
+
+func TestReferral(t *testing.T) {
+	c := &config{stats: statsd.NoopClient{}}
+	zones := testSignedZones(t)
+	zones["parent.com"] = parentZone + "ns2.child 300 IN AAAA 2001:db8::3\n"
+	if err := c.loadZones(zones); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+
+	// the apex NS answer carries the addresses of the zone's own nameservers
+	m := testQuery(c, "parent.com", "parent.com.", dns.TypeNS)
+	if !m.Authoritative || len(m.Answer) != 1 || len(m.Extra) != 1 || m.Extra[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Errorf("Expected the NS answer with the nameserver address, got %v", m)
+	}
+	// in-bailiwick nameservers above any delegation are answered authoritatively,
+	// without repeating their address in the additional section
+	if m := testQuery(c, "parent.com", "ns1.parent.com.", dns.TypeA); !m.Authoritative || len(m.Answer) != 1 || len(m.Ns) != 1 || len(m.Extra) != 0 {
+		t.Errorf("Expected an authoritative answer for ns1, got %v", m)
+	}
+	// other answers carry the apex NS records and their addresses
+	m = testQuery(c, "parent.com", "www.parent.com.", dns.TypeA)
+	if len(m.Answer) != 1 || len(m.Ns) != 1 || m.Ns[0].(*dns.NS).Ns != "ns1.parent.com." || len(m.Extra) != 1 || m.Extra[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Errorf("Expected the apex NS in the authority section with its address, got %v", m)
+	}
+	if m := testQuery(c, "parent.com", "nothere.parent.com.", dns.TypeA); countType(m.Ns, dns.TypeNS) != 0 || len(m.Extra) != 0 {
+		t.Errorf("Expected no NS records with a negative answer, got %v", m)
+	}
+
+	for _, name := range []string{"child.parent.com.", "ns.child.parent.com.", "deep.ns.child.parent.com.", "CHILD.parent.com."} {
+		m := testQuery(c, "parent.com", name, dns.TypeA)
+		if m.Authoritative || len(m.Answer) != 0 || len(m.Ns) != 1 || m.Ns[0].(*dns.NS).Ns != "ns.child.parent.com." {
+			t.Errorf("%s: expected a referral to the child, got %v", name, m)
+			continue
+		}
+		if len(m.Extra) != 1 || m.Extra[0].(*dns.A).A.String() != "10.0.0.3" {
+			t.Errorf("%s: expected the glue in the additional section, got %v", name, m.Extra)
+		}
+	}
+	if m := testQuery(c, "parent.com", "other.parent.com.", dns.TypeNS); m.Authoritative || len(m.Ns) != 1 || len(m.Extra) != 0 {
+		t.Errorf("Expected a referral without glue for an out-of-zone nameserver, got %v", m)
+	}
+	if m := testQuery(c, "parent.com", "child.parent.com.", dns.TypeDS); !m.Authoritative || len(m.Answer) != 1 {
+		t.Errorf("Expected the parent to answer for DS, got %v", m)
+	}
+	// the glue address is only served in referrals, whatever the query type
+	if m := testQuery(c, "parent.com", "ns2.child.parent.com.", dns.TypeAAAA); m.Authoritative || len(m.Answer) != 0 {
+		t.Errorf("Expected glue-only names to be referred, got %v", m)
+	}
+
+	// signed: the referral proves the delegation is insecure, and glue isn't signed
+	m = testDOQuery(c, "abc.com", "ns.sub.abc.com.", dns.TypeA)
+	if m.Authoritative || len(m.Answer) != 0 || len(m.Ns) != 3 || m.Ns[1].Header().Rrtype != dns.TypeNSEC || m.Ns[2].Header().Rrtype != dns.TypeRRSIG {
+		t.Errorf("Expected a referral with the NSEC proving no DS, got %v", m)
+	}
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			t.Errorf("Expected unsigned glue, got %v", m.Extra)
+		}
+	}
+	m = testDOQuery(c, "abc.com", "abc.com.", dns.TypeNS)
+	if !m.Authoritative || len(m.Extra) != 1 { // the OPT record; nsa and nsb have no addresses
+		t.Errorf("Expected no addresses for the apex nameservers, got %v", m.Extra)
+	}
+	m = testDOQuery(c, "abc.com", "abc.com.", dns.TypeMX)
+	if countType(m.Ns, dns.TypeNS) != 2 || countType(m.Ns, dns.TypeRRSIG) != 1 {
+		t.Errorf("Expected the signed apex NS records in the authority section, got %v", m.Ns)
+	}
+	verifyRRs(t, m.Ns, withoutType(testDOQuery(c, "abc.com", "abc.com.", dns.TypeDNSKEY).Answer, dns.TypeRRSIG))
+
+	// answer_glue answers from the glue as before
+	if err := c.loadZones(map[string]string{"parent.com.policy": `{"answer_glue": true}`}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if m := testQuery(c, "parent.com", "ns.child.parent.com.", dns.TypeA); !m.Authoritative || len(m.Answer) != 1 || countType(m.Ns, dns.TypeNS) != 1 || m.Ns[0].(*dns.NS).Ns != "ns1.parent.com." {
+		t.Errorf("Expected the glue to be answered with answer_glue, got %v", m)
+	}
+}
+
+func TestAdditionalAddresses(t *testing.T) {
+	c := &config{stats: statsd.NoopClient{}}
+	zone := parentZone + `mail	300	IN	A	10.0.0.25
+mail	300	IN	AAAA	2001:db8::25
+_sip._tcp	300	IN	SRV	10 5 5060 sip
+_sip._tcp	300	IN	SRV	20 5 5060 sip.example.net.
+sip	300	IN	A	10.0.0.50
+_ldap._tcp	300	IN	SRV	10 5 389 ns.child
+backup	300	IN	MX	20 ns.child
+`
+	if err := c.loadZones(map[string]string{"parent.com": zone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	m := testQuery(c, "parent.com", "parent.com.", dns.TypeMX)
+	if len(m.Answer) != 1 || countType(m.Extra, dns.TypeA) != 2 || countType(m.Extra, dns.TypeAAAA) != 1 {
+		t.Errorf("Expected the mail server's addresses with the nameserver's, got %v", m)
+	}
+	m = testQuery(c, "parent.com", "_sip._tcp.parent.com.", dns.TypeSRV)
+	if len(m.Answer) != 2 || countType(m.Extra, dns.TypeA) != 2 || m.Extra[1].(*dns.A).A.String() != "10.0.0.50" {
+		t.Errorf("Expected the in-zone SRV target's address, got %v", m)
+	}
+	// glue below a delegation point is only for finding the child's nameservers
+	for _, q := range []dns.Question{{Name: "_ldap._tcp.parent.com.", Qtype: dns.TypeSRV}, {Name: "backup.parent.com.", Qtype: dns.TypeMX}} {
+		if m := testQuery(c, "parent.com", q.Name, q.Qtype); len(m.Answer) != 1 || len(m.Extra) != 1 || m.Extra[0].(*dns.A).A.String() != "10.0.0.1" {
+			t.Errorf("Expected no glue for %s, got %v", q.Name, m)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// A DNAME record redirects a whole subtree (RFC 6672): queries for names below its
+// owner are answered with the DNAME and a CNAME synthesized from it, the query name
+// with the owner swapped for the DNAME's target, so resolvers that don't understand
+// DNAME still follow it. The CNAME gets the DNAME's TTL and, like any other, is
+// followed when its target is in the zone. A name that would grow past 255 bytes
+// gets YXDOMAIN with the DNAME alone. The DNAME's owner itself answers as usual,
+// and names below it are occluded, which zones are warned about as they load.
+
+// dnameFor returns the DNAME owned by the closest strict ancestor of name in the
+// zone, or nil
+func (z *zone) dnameFor(name string) *dns.DNAME {
+	apex := dns.Fqdn(strings.ToLower(z.name))
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for i := 1; i < len(labels); i++ {
+		owner := dns.Fqdn(strings.Join(labels[i:], "."))
+		if !dns.IsSubDomain(apex, owner) {
+			break
+		}
+		for _, rr := range z.rrs {
+			if dname, ok := rr.(*dns.DNAME); ok && strings.EqualFold(dname.Hdr.Name, owner) {
+				return dname
+			}
+		}
+	}
+	return nil
+}
+
+// dnameAnswer answers q with the DNAME above its name and the CNAME synthesized
+// from it, returning false when no DNAME applies
+func (z *zone) dnameAnswer(c *config, q dns.Question) ([]dns.RR, []string, bool) {
+	dname := z.dnameFor(q.Name)
+	if dname == nil {
+		return nil, nil, false
+	}
+	c.stats.Incr("query.dname", 1)
+	rrs := []dns.RR{dname}
+	answers := []string{"(DNAME)" + dname.String()}
+	prefix := q.Name[:len(q.Name)-len(dname.Hdr.Name)]
+	target := prefix + dns.Fqdn(dname.Target)
+	if dname.Target == "." {
+		target = prefix
+	}
+	if _, ok := dns.IsDomainName(target); !ok || len(target) > 254 {
+		c.stats.Incr("query.dname.toolong", 1)
+		c.debug(fmt.Sprintf("DNAME %s makes %s too long", dname.Hdr.Name, q.Name))
+		return rrs, answers, true
+	}
+	cname := &dns.CNAME{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: dname.Hdr.Ttl}, Target: target}
+	return append(rrs, cname), append(answers, "(SYNTHESIZED)"+cname.String()), true
+}
+
+// dnameOverflow makes m, an answer, YXDOMAIN if it holds a DNAME that couldn't be
+// applied to its question, and returns whether it did
+func dnameOverflow(m *dns.Msg) bool {
+	if len(m.Question) != 1 || len(m.Answer) != 1 {
+		return false
+	}
+	dname, ok := m.Answer[0].(*dns.DNAME)
+	if !ok || strings.EqualFold(dname.Hdr.Name, m.Question[0].Name) {
+		return false
+	}
+	m.Rcode = dns.RcodeYXDomain
+	return true
+}
+
+// checkDNAMEs finds names occluded by a DNAME above them, and DNAMEs sharing their
+// owner with a CNAME
+func checkDNAMEs(rrs []dns.RR) []zoneProblem {
+	problems := []zoneProblem{}
+	owners := map[string]bool{}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeDNAME {
+			owners[strings.ToLower(rr.Header().Name)] = true
+		}
+	}
+	if len(owners) == 0 {
+		return problems
+	}
+	seen := map[string]bool{}
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		if rr.Header().Rrtype == dns.TypeCNAME && owners[name] {
+			problems = append(problems, zoneProblem{"error", rr.Header().Name, "name has both a CNAME and a DNAME"})
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		for owner := range owners {
+			if owner != name && dns.IsSubDomain(owner, name) {
+				problems = append(problems, zoneProblem{"warning", rr.Header().Name, fmt.Sprintf("name is below the DNAME at %s and is never answered", owner)})
+				break
+			}
+		}
+	}
+	return problems
+}
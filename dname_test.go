@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"strings"
+	"testing"
+)
+
+func TestDNAME(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}}
+	zone := abcZone + `old	300	IN	DNAME	new.abc.com.
+away	IN	DNAME	example.net.
+www.new	IN	A	10.0.0.1
+`
+	if err := c.loadZones(map[string]string{"abc.com": zone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+
+	m := testQuery(&c, "abc.com", "www.old.abc.com.", dns.TypeA)
+	if len(m.Answer) != 3 || m.Answer[0].Header().Rrtype != dns.TypeDNAME || m.Answer[2].(*dns.A).A.String() != "10.0.0.1" {
+		t.Fatalf("Expected the DNAME, a CNAME and the target's address, got %v", m.Answer)
+	}
+	if cname := m.Answer[1].(*dns.CNAME); cname.Hdr.Name != "www.old.abc.com." || cname.Target != "www.new.abc.com." || cname.Hdr.Ttl != 300 {
+		t.Errorf("Expected a CNAME synthesized with the DNAME's TTL, got %v", cname)
+	}
+	if m := testQuery(&c, "abc.com", "a.b.away.abc.com.", dns.TypeAAAA); len(m.Answer) != 2 || m.Answer[1].(*dns.CNAME).Target != "a.b.example.net." || m.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected an out-of-zone CNAME left to the resolver, got %v", m)
+	}
+	if m := testQuery(&c, "abc.com", "old.abc.com.", dns.TypeA); len(m.Answer) != 0 || m.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected NODATA at the DNAME's owner, got %v", m)
+	}
+	if m := testQuery(&c, "abc.com", "old.abc.com.", dns.TypeDNAME); len(m.Answer) != 1 {
+		t.Errorf("Expected the DNAME at its owner, got %v", m.Answer)
+	}
+
+	long := strings.Repeat(strings.Repeat("a", 60)+".", 3) + "away.abc.com."
+	if err := c.loadZones(map[string]string{"abc.com": abcZone + "away IN DNAME " + strings.Repeat("b", 60) + ".example.net.\n"}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if m := testQuery(&c, "abc.com", long, dns.TypeA); m.Rcode != dns.RcodeYXDomain || len(m.Answer) != 1 {
+		t.Errorf("Expected YXDOMAIN for a name grown too long, got %v", m)
+	}
+}
+
+func TestCheckDNAMEs(t *testing.T) {
+	rrs := []dns.RR{}
+	for _, s := range []string{"old.abc.com. IN DNAME new.abc.com.", "www.old.abc.com. IN A 10.0.0.1", "old.abc.com. IN MX 10 mail.abc.com."} {
+		rr, _ := dns.NewRR(s)
+		rrs = append(rrs, rr)
+	}
+	if p := checkDNAMEs(rrs); len(p) != 1 || p[0].severity != "warning" || p[0].name != "www.old.abc.com." {
+		t.Errorf("Expected a warning for the occluded name, got %v", p)
+	}
+	cname, _ := dns.NewRR("old.abc.com. IN CNAME www.abc.com.")
+	if p := checkDNAMEs(append(rrs, cname)); len(p) != 2 || p[1].severity != "error" {
+		t.Errorf("Expected an error for a CNAME beside the DNAME, got %v", p)
+	}
+}
@@ -0,0 +1,695 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Zones are signed in memory when their DNSSEC keys are in the bucket next to them,
+// as the files dnssec-keygen writes, renamed by role:
+//
+//	abc.com.ksk.key, abc.com.ksk.private   key signing key (flags 257)
+//	abc.com.zsk.key, abc.com.zsk.private   zone signing key (flags 256)
+//
+// A zone with only one of the pairs signs everything with it. Signing replaces any
+// DNSKEY, CDS, CDNSKEY, RRSIG and NSEC records in the zone file: the DNSKEYs are
+// published at the apex along with the CDS and CDNSKEY of the KSK, for parents that
+// automate DS updates (RFC 7344), those sets are signed with the KSK and every other
+// authoritative RRset with the ZSK, and an NSEC chain is added. ZSKs rolled over by
+// --zsk-rollover are named by key tag and listed in the zone's key state, see
+// rollover.go. Delegation NS records and glue are not
+// signed. Signatures are valid for sigValidity and the zone is signed again once they
+// have less than sigRefresh left. Answers that aren't in the zone file, such as
+// flattened root CNAMEs and policy rewrites, are signed with the ZSK as they are
+// served. A zone policy can ask for NSEC3 instead of NSEC, see nsec3Config.
+// Zones without keys are served with the DNSSEC records in their zone
+// file, if they were signed before they were uploaded. Signatures, and NSEC records
+// proving empty answers, are only sent to clients that set the DO bit.
+const (
+	sigValidity   = 14 * 24 * time.Hour
+	sigRefresh    = 7 * 24 * time.Hour
+	sigBackdate   = time.Hour // inception before now, for clients with slow clocks
+	dnssecUDPSize = 4096
+)
+
+var dnssecKeySuffixes = []string{".ksk.key", ".ksk.private", ".zsk.key", ".zsk.private", keyStateSuffix}
+
+// rolledKeyFile matches the files of ZSKs generated by --zsk-rollover
+var rolledKeyFile = regexp.MustCompile(`\.zsk-[0-9]+\.(key|private)$`)
+
+// dnssecTypes are the records signing generates, replacing any in the zone file
+var dnssecTypes = map[uint16]bool{dns.TypeDNSKEY: true, dns.TypeCDS: true, dns.TypeCDNSKEY: true, dns.TypeRRSIG: true, dns.TypeNSEC: true, dns.TypeNSEC3: true, dns.TypeNSEC3PARAM: true}
+
+// kskTypes are the apex RRsets signed with the KSK rather than the ZSK
+var kskTypes = map[uint16]bool{dns.TypeDNSKEY: true, dns.TypeCDS: true, dns.TypeCDNSKEY: true}
+
+type dnssecKey struct {
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+}
+
+type zoneKeys struct {
+	ksk       *dnssecKey
+	zsk       *dnssecKey
+	published []*dnssecKey // in the DNSKEY set without signing, for a rollover
+}
+
+// signedRRset is the signature of an RRset, with the RRset's contents so answers
+// that differ from the zone file can be told apart
+type signedRRset struct {
+	contents string
+	sigs     []dns.RR
+}
+
+// loadKeys removes DNSSEC key files from zones, storing the keys on the config. It
+// returns the zones whose keys changed and the zones with bad keys.
+func (c *config) loadKeys(zones map[string]string) ([]string, []string) {
+	if c.keyFiles == nil {
+		c.keyFiles = map[string]string{}
+	}
+	if c.dnssecKeys == nil {
+		c.dnssecKeys = map[string]*zoneKeys{}
+	}
+	updated := map[string]bool{}
+	for key, contents := range zones {
+		for _, suffix := range dnssecKeySuffixes {
+			if strings.HasSuffix(key, suffix) {
+				delete(zones, key)
+				c.keyFiles[key] = contents
+				updated[strings.TrimSuffix(key, suffix)] = true
+			}
+		}
+		if loc := rolledKeyFile.FindStringIndex(key); loc != nil {
+			delete(zones, key)
+			c.keyFiles[key] = contents
+			updated[key[:loc[0]]] = true
+		}
+	}
+	changed, failed := []string{}, []string{}
+	for n := range updated {
+		keys, err := parseZoneKeys(n, c.keyFiles)
+		if err != nil {
+			log.Print(err)
+			c.stats.Incr("dnssec.keys.error", 1)
+			c.alerts.alert(c, alertSigning, n, err.Error())
+			failed = append(failed, n)
+			continue
+		}
+		if keys == nil {
+			continue // the rest of the pair is still to come
+		}
+		c.dnssecKeys[n] = keys
+		c.debug(fmt.Sprintf("Loaded DNSSEC keys for zone %s", n))
+		if _, ok := zones[n]; !ok {
+			changed = append(changed, n)
+		}
+	}
+	sort.Strings(changed)
+	return changed, failed
+}
+
+// parseZoneKeys reads the key pairs of zone n from files, returning nil if it has
+// no complete pair yet. The zone's key state, if any, picks the ZSK and the keys
+// published for a rollover.
+func parseZoneKeys(n string, files map[string]string) (*zoneKeys, error) {
+	keys := &zoneKeys{}
+	for _, role := range []string{"ksk", "zsk"} {
+		pub, hasPub := files[n+"."+role+".key"]
+		priv, hasPriv := files[n+"."+role+".private"]
+		if !hasPub || !hasPriv {
+			continue
+		}
+		k, err := parseKeyPair(n, role, pub, priv)
+		if err != nil {
+			return nil, fmt.Errorf("Error in DNSSEC %s for zone %s: %s", role, n, err.Error())
+		}
+		if role == "ksk" {
+			keys.ksk = k
+		} else {
+			keys.zsk = k
+		}
+	}
+	if keys.ksk == nil && keys.zsk == nil {
+		return nil, nil
+	}
+	if keys.ksk == nil {
+		keys.ksk = keys.zsk
+	}
+	if keys.zsk == nil {
+		keys.zsk = keys.ksk
+	}
+	contents, ok := files[n+keyStateSuffix]
+	if !ok {
+		return keys, nil
+	}
+	var state keyState
+	if err := json.Unmarshal([]byte(contents), &state); err != nil {
+		return nil, fmt.Errorf("Error in DNSSEC key state for zone %s: %s", n, err.Error())
+	}
+	loaded := map[string]*dnssecKey{n + ".ksk": keys.ksk, n + ".zsk": keys.zsk}
+	load := func(base string) (*dnssecKey, error) {
+		if k, ok := loaded[base]; ok {
+			return k, nil
+		}
+		pub, hasPub := files[base+".key"]
+		priv, hasPriv := files[base+".private"]
+		if !hasPub || !hasPriv {
+			return nil, fmt.Errorf("Error in DNSSEC key state for zone %s: no key pair %s", n, base)
+		}
+		k, err := parseKeyPair(n, strings.TrimPrefix(base, n+"."), pub, priv)
+		if err != nil {
+			return nil, fmt.Errorf("Error in DNSSEC key %s for zone %s: %s", base, n, err.Error())
+		}
+		loaded[base] = k
+		return k, nil
+	}
+	if len(state.ZSK) > 0 {
+		k, err := load(state.ZSK)
+		if err != nil {
+			return nil, err
+		}
+		keys.zsk = k
+	}
+	for _, base := range []string{state.Next, state.Retired} {
+		if len(base) == 0 {
+			continue
+		}
+		k, err := load(base)
+		if err != nil {
+			return nil, err
+		}
+		if k != keys.ksk && k != keys.zsk {
+			keys.published = append(keys.published, k)
+		}
+	}
+	return keys, nil
+}
+
+// parseKeyPair reads a dnssec-keygen .key and .private file, checking they match
+func parseKeyPair(n, role, pub, priv string) (*dnssecKey, error) {
+	var dnskey *dns.DNSKEY
+	for _, line := range strings.Split(pub, "\n") {
+		if line = strings.TrimSpace(line); len(line) == 0 || strings.HasPrefix(line, ";") {
+			continue
+		}
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			return nil, err
+		}
+		if k, ok := rr.(*dns.DNSKEY); ok {
+			dnskey = k
+			break
+		}
+	}
+	if dnskey == nil {
+		return nil, fmt.Errorf("no DNSKEY record in the .key file")
+	}
+	if !strings.EqualFold(dnskey.Hdr.Name, dns.Fqdn(n)) {
+		return nil, fmt.Errorf("DNSKEY is for %s", dnskey.Hdr.Name)
+	}
+	if role == "ksk" && dnskey.Flags&dns.SEP == 0 {
+		return nil, fmt.Errorf("key signing key must have flags 257")
+	}
+	private, err := dnskey.ReadPrivateKey(strings.NewReader(priv), n+"."+role+".private")
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key")
+	}
+	k := &dnssecKey{dnskey: dnskey, signer: signer}
+	now := time.Now()
+	test := []dns.RR{dnskey}
+	sig, err := k.sign(test, now, now.Add(time.Hour), dns.Fqdn(n))
+	if err != nil {
+		return nil, err
+	}
+	if err := sig.Verify(dnskey, test); err != nil {
+		return nil, fmt.Errorf("private key doesn't match the DNSKEY")
+	}
+	return k, nil
+}
+
+// sign signs an RRset
+func (k *dnssecKey) sign(rrset []dns.RR, inception, expiration time.Time, signer string) (*dns.RRSIG, error) {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Algorithm:  k.dnskey.Algorithm,
+		KeyTag:     k.dnskey.KeyTag(),
+		SignerName: signer,
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+	return sig, sig.Sign(k.signer, rrset)
+}
+
+// rrsetContents identifies the records of an RRset, in any order
+func rrsetContents(rrset []dns.RR) string {
+	s := make([]string, len(rrset))
+	for i, rr := range rrset {
+		owner := rr.Header().Name // as the zone or the query cased it
+		s[i] = strings.ToLower(owner) + strings.TrimPrefix(rr.String(), owner)
+	}
+	sort.Strings(s)
+	return strings.Join(s, "\n")
+}
+
+// signZone signs z with its keys, if it has any. It is called by applyPolicy, so
+// every change to a zone's records is signed. Zones without keys keep any
+// signatures in their zone file, for zones signed before they were uploaded.
+func (c *config) signZone(z *zone) {
+	z.keys, z.sigs, z.sigExpires, z.nsecs, z.nsec3s = nil, nil, time.Time{}, nil, nil
+	keys := c.dnssecKeys[z.name]
+	if keys == nil {
+		z.sigs = presignedSigs(z.rrs)
+		z.nsecs, z.nsec3s = denialChains(z.rrs)
+		return
+	}
+	rrs, sigs, expires, err := keys.signRRs(z.name, z.rrs, z.policy.nsec3(), time.Now())
+	if err != nil {
+		z.rrs = stripDNSSEC(z.rrs)
+		log.Printf("Error signing zone %s, serving it unsigned: %s", z.name, err.Error())
+		c.stats.Incr("dnssec.sign.error", 1)
+		c.alerts.alert(c, alertSigning, z.name, err.Error())
+		return
+	}
+	z.rrs, z.keys, z.sigs, z.sigExpires = rrs, keys, sigs, expires
+	z.nsecs, z.nsec3s = denialChains(rrs)
+	c.stats.Incr("dnssec.signed", 1)
+	c.debug(fmt.Sprintf("Signed zone %s, %d RRsets", z.name, len(sigs)))
+	c.auditSigned(z)
+}
+
+// presignedSigs indexes the RRSIGs in a zone file by the RRset they cover. RRsets
+// changed as they are served, such as by --ns-map, no longer match their
+// signatures, so theirs aren't served.
+func presignedSigs(rrs []dns.RR) map[hotKey]signedRRset {
+	sets := map[hotKey][]dns.RR{}
+	sigs := map[hotKey][]dns.RR{}
+	for _, rr := range rrs {
+		h := rr.Header()
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			k := hotKey{strings.ToLower(h.Name), sig.TypeCovered}
+			sigs[k] = append(sigs[k], sig)
+			continue
+		}
+		k := hotKey{strings.ToLower(h.Name), h.Rrtype}
+		sets[k] = append(sets[k], rr)
+	}
+	if len(sigs) == 0 {
+		return nil
+	}
+	signed := map[hotKey]signedRRset{}
+	for k, s := range sigs {
+		if set, ok := sets[k]; ok {
+			signed[k] = signedRRset{contents: rrsetContents(set), sigs: s}
+		}
+	}
+	return signed
+}
+
+// denialChains returns the NSEC records of a zone in canonical order, and its NSEC3
+// records in hash order
+func denialChains(rrs []dns.RR) ([]*dns.NSEC, []*dns.NSEC3) {
+	nsecs, nsec3s := []*dns.NSEC{}, []*dns.NSEC3{}
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+	sort.Sort(byNSECOwner(nsecs))
+	sort.Sort(byNSEC3Hash(nsec3s))
+	return nsecs, nsec3s
+}
+
+// signRRs returns the records of zone n with DNSKEYs, NSECs, or NSEC3s with nsec3,
+// and signatures, and the signatures by RRset.
+func (keys *zoneKeys) signRRs(n string, in []dns.RR, nsec3 *nsec3Config, now time.Time) ([]dns.RR, map[hotKey]signedRRset, time.Time, error) {
+	apex := dns.Fqdn(n)
+	inception, expiration := now.Add(-sigBackdate), now.Add(sigValidity)
+	rrs := []dns.RR{}
+	var soa *dns.SOA
+	for _, rr := range in {
+		if dnssecTypes[rr.Header().Rrtype] {
+			continue
+		}
+		if s, ok := rr.(*dns.SOA); ok && strings.EqualFold(s.Hdr.Name, apex) {
+			soa = s
+		}
+		rrs = append(rrs, rr)
+	}
+	if soa == nil {
+		return nil, nil, time.Time{}, fmt.Errorf("zone has no SOA record")
+	}
+	published := map[*dnssecKey]bool{}
+	for _, k := range append([]*dnssecKey{keys.ksk, keys.zsk}, keys.published...) {
+		if published[k] {
+			continue
+		}
+		published[k] = true
+		dnskey := *k.dnskey
+		dnskey.Hdr.Name, dnskey.Hdr.Ttl = apex, soa.Hdr.Ttl
+		rrs = append(rrs, &dnskey)
+	}
+	ksk := *keys.ksk.dnskey
+	ksk.Hdr.Name, ksk.Hdr.Ttl = apex, soa.Hdr.Ttl
+	rrs = append(rrs, ksk.ToCDNSKEY(), ksk.ToDS(dns.SHA256).ToCDS())
+	if nsec3 != nil {
+		rrs = append(rrs, nsec3Param(apex, nsec3))
+	}
+	cuts := delegationPoints(apex, rrs)
+	sets := map[hotKey][]dns.RR{}
+	order := []hotKey{}
+	names := map[string]map[uint16]bool{}
+	for _, rr := range rrs {
+		h := rr.Header()
+		if !authoritative(h.Name, cuts) {
+			continue // glue
+		}
+		k := hotKey{h.Name, h.Rrtype}
+		if _, ok := sets[k]; !ok {
+			order = append(order, k)
+		}
+		sets[k] = append(sets[k], rr)
+		if names[h.Name] == nil {
+			names[h.Name] = map[uint16]bool{}
+		}
+		names[h.Name][h.Rrtype] = true
+	}
+	denial := []dns.RR{}
+	if nsec3 != nil {
+		for _, rr := range nsec3Chain(apex, names, cuts, nsec3, soa.Minttl) {
+			denial = append(denial, rr)
+		}
+	} else {
+		for _, rr := range nsecChain(apex, names, soa.Minttl) {
+			denial = append(denial, rr)
+		}
+	}
+	for _, rr := range denial {
+		k := hotKey{rr.Header().Name, rr.Header().Rrtype}
+		rrs = append(rrs, rr)
+		sets[k] = []dns.RR{rr}
+		order = append(order, k)
+	}
+	signed := map[hotKey]signedRRset{}
+	for _, k := range order {
+		set := sets[k]
+		if k.qtype == dns.TypeNS && cuts[strings.ToLower(k.name)] {
+			continue // delegations are signed by the child
+		}
+		key := keys.zsk
+		if kskTypes[k.qtype] {
+			key = keys.ksk
+		}
+		sig, err := key.sign(set, inception, expiration, apex)
+		if err != nil {
+			return nil, nil, time.Time{}, fmt.Errorf("%s %s: %s", k.name, dns.Type(k.qtype).String(), err.Error())
+		}
+		rrs = append(rrs, sig)
+		signed[hotKey{strings.ToLower(k.name), k.qtype}] = signedRRset{contents: rrsetContents(set), sigs: []dns.RR{sig}}
+	}
+	return rrs, signed, expiration, nil
+}
+
+// delegationPoints returns the lower cased names below apex with NS records
+func delegationPoints(apex string, rrs []dns.RR) map[string]bool {
+	cuts := map[string]bool{}
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeNS && !strings.EqualFold(h.Name, apex) {
+			cuts[strings.ToLower(h.Name)] = true
+		}
+	}
+	return cuts
+}
+
+// authoritative reports whether name is not below a delegation point
+func authoritative(name string, cuts map[string]bool) bool {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for i := 1; i < len(labels); i++ {
+		if cuts[dns.Fqdn(strings.Join(labels[i:], "."))] {
+			return false
+		}
+	}
+	return true
+}
+
+// nsecChain links the names of a zone in canonical order (RFC 4034 section 6.1)
+func nsecChain(apex string, names map[string]map[uint16]bool, ttl uint32) []*dns.NSEC {
+	sorted := []string{}
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Sort(byCanonicalName(sorted))
+	chain := []*dns.NSEC{}
+	for i, name := range sorted {
+		next := sorted[(i+1)%len(sorted)]
+		types := []uint16{dns.TypeRRSIG, dns.TypeNSEC}
+		for t := range names[name] {
+			types = append(types, t)
+		}
+		sort.Sort(byType(types))
+		chain = append(chain, &dns.NSEC{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+			NextDomain: next, TypeBitMap: types})
+	}
+	return chain
+}
+
+type byType []uint16
+
+func (t byType) Len() int           { return len(t) }
+func (t byType) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t byType) Less(i, j int) bool { return t[i] < t[j] }
+
+// byCanonicalName sorts names in canonical order (RFC 4034 section 6.1)
+type byCanonicalName []string
+
+func (s byCanonicalName) Len() int           { return len(s) }
+func (s byCanonicalName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byCanonicalName) Less(i, j int) bool { return canonicalLess(s[i], s[j]) }
+
+type byNSECOwner []*dns.NSEC
+
+func (s byNSECOwner) Len() int           { return len(s) }
+func (s byNSECOwner) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byNSECOwner) Less(i, j int) bool { return canonicalLess(s[i].Hdr.Name, s[j].Hdr.Name) }
+
+// canonicalLess reports whether name x sorts before y, comparing their labels from
+// the right, case-insensitively
+func canonicalLess(x, y string) bool {
+	a, b := dns.SplitDomainName(strings.ToLower(x)), dns.SplitDomainName(strings.ToLower(y))
+	for i, j := len(a)-1, len(b)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if a[i] != b[j] {
+			return a[i] < b[j]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// dnssecOK reports whether req asked for DNSSEC records
+func dnssecOK(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// addSignatures adds the signatures of each RRset in m.Answer, signing RRsets that
+// aren't in the zone file as they are, and marks m as DNSSEC aware. Zones signed
+// before they were uploaded can't sign such RRsets, so they are sent unsigned.
+func (z *zone) addSignatures(c *config, m *dns.Msg) {
+	m.SetEdns0(dnssecUDPSize, true)
+	if z.keys == nil && z.sigs == nil {
+		return
+	}
+	if len(m.Question) == 0 || m.Question[0].Qtype != dns.TypeRRSIG {
+		m.Answer = withoutType(m.Answer, dns.TypeRRSIG) // ANY answers include the zone file's
+	}
+	sets := map[hotKey][]dns.RR{}
+	order := []hotKey{}
+	for _, rr := range m.Answer {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		k := hotKey{strings.ToLower(h.Name), h.Rrtype}
+		if _, ok := sets[k]; !ok {
+			order = append(order, k)
+		}
+		sets[k] = append(sets[k], rr)
+	}
+	now := time.Now()
+	for _, k := range order {
+		if s, ok := z.sigs[k]; ok && s.contents == rrsetContents(sets[k]) {
+			sigs := s.sigs
+			if owner := sets[k][0].Header().Name; len(sigs) > 0 && sigs[0].Header().Name != owner {
+				sigs = renamed(sigs, owner) // in the query's case
+			}
+			m.Answer = append(m.Answer, sigs...)
+			continue
+		}
+		if sigs, ok := z.wildcardSigs(k.name, k.qtype, sets[k]); ok {
+			m.Answer = append(m.Answer, sigs...)
+			for _, rr := range z.wildcardProof(k.name) {
+				m.Ns = append(m.Ns, rr)
+				m.Ns = append(m.Ns, z.sigs[hotKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}].sigs...)
+			}
+			continue
+		}
+		if z.keys == nil {
+			c.stats.Incr("dnssec.unsigned", 1)
+			continue
+		}
+		sig, err := z.keys.zsk.sign(sets[k], now.Add(-sigBackdate), now.Add(sigValidity), dns.Fqdn(z.name))
+		if err != nil {
+			c.stats.Incr("dnssec.sign.error", 1)
+			c.signAudit.used(z.name, z.keys, z.keys.zsk, 0, 0, 1, now)
+			continue
+		}
+		c.stats.Incr("dnssec.online", 1)
+		c.signAudit.used(z.name, z.keys, z.keys.zsk, 0, 1, 0, now)
+		m.Answer = append(m.Answer, sig)
+	}
+}
+
+// addDenial proves an empty answer with the zone's NSEC or NSEC3 records, along
+// with the SOA and all signatures. Zones without either are left alone.
+func (z *zone) addDenial(c *config, m *dns.Msg) {
+	if (len(z.nsecs) == 0 && len(z.nsec3s) == 0) || len(m.Answer) > 0 || len(m.Question) != 1 {
+		return
+	}
+	name := m.Question[0].Name
+	exists := z.hasName(name)
+	var proof []dns.RR
+	if len(z.nsec3s) > 0 {
+		proof = z.nsec3Proof(name, exists)
+	} else {
+		proof = z.nsecProof(name, exists)
+	}
+	if m.Rcode == dns.RcodeNameError { // see negative; the same records prove a wildcard lacks the type
+		c.stats.Incr("query.dnssec.nxdomain", 1)
+	} else {
+		c.stats.Incr("query.dnssec.nodata", 1)
+	}
+	if len(m.Ns) == 0 {
+		m.Ns = z.negativeSOA()
+	}
+	if len(m.Ns) > 0 {
+		m.Ns = append(m.Ns, z.sigs[hotKey{strings.ToLower(dns.Fqdn(z.name)), dns.TypeSOA}].sigs...)
+	}
+	for _, rr := range proof {
+		m.Ns = append(m.Ns, rr)
+		m.Ns = append(m.Ns, z.sigs[hotKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}].sigs...)
+	}
+}
+
+// nsecProof returns the NSEC records proving an empty answer for name (RFC 4035
+// section 3.1.3): the NSEC of the name, or of the name before it for an empty
+// non-terminal, shows the type doesn't exist, and for a name that doesn't exist
+// the NSECs covering the name and the wildcard that could have matched it.
+func (z *zone) nsecProof(name string, exists bool) []dns.RR {
+	nsec := z.coveringNSEC(name)
+	proof := []dns.RR{nsec}
+	if wild := z.coveringNSEC("*." + z.closestEncloser(name)); !exists && wild != nsec {
+		proof = append(proof, wild)
+	}
+	return proof
+}
+
+// coveringNSEC returns the NSEC of name, or the one before it in canonical order
+func (z *zone) coveringNSEC(name string) *dns.NSEC {
+	i := sort.Search(len(z.nsecs), func(i int) bool { return canonicalLess(name, z.nsecs[i].Hdr.Name) })
+	if i == 0 {
+		return z.nsecs[len(z.nsecs)-1]
+	}
+	return z.nsecs[i-1]
+}
+
+// closestEncloser returns the longest existing name that name is below
+func (z *zone) closestEncloser(name string) string {
+	for _, i := range dns.Split(name) {
+		if i > 0 && z.hasName(name[i:]) {
+			return name[i:]
+		}
+	}
+	return dns.Fqdn(z.name)
+}
+
+// withoutType returns rrs without the records of type t
+func withoutType(rrs []dns.RR, t uint16) []dns.RR {
+	out := rrs[:0:0]
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != t {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// stripDNSSEC removes DNSSEC records from answers for clients that didn't ask for them
+func stripDNSSEC(rrs []dns.RR) []dns.RR {
+	out := rrs[:0:0]
+	for _, rr := range rrs {
+		if t := rr.Header().Rrtype; t != dns.TypeRRSIG && t != dns.TypeNSEC && t != dns.TypeNSEC3 {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// refreshSignatures signs zones again before their signatures expire, until the
+// process exits.
+func (c *config) refreshSignatures() {
+	for range time.Tick(time.Hour) {
+		c.resignExpiring(time.Now())
+	}
+}
+
+// resignExpiring signs zones whose signatures expire within sigRefresh again
+func (c *config) resignExpiring(now time.Time) int {
+	if c.reloads != nil {
+		c.reloads.run.Lock()
+		defer c.reloads.run.Unlock()
+	}
+	resigned := 0
+	for _, z := range c.zones {
+		if z.keys == nil || z.sigExpires.Sub(now) > sigRefresh {
+			continue
+		}
+		updated := *z
+		c.registerZone(&updated)
+		resigned++
+	}
+	if c.views != nil {
+		c.views.mu.RLock()
+		views := []*zone{}
+		for _, byView := range c.views.zones {
+			for _, z := range byView {
+				if z.keys != nil && z.sigExpires.Sub(now) <= sigRefresh {
+					views = append(views, z)
+				}
+			}
+		}
+		c.views.mu.RUnlock()
+		for _, z := range views {
+			updated := *z
+			c.putView(&updated)
+			resigned++
+		}
+	}
+	if resigned > 0 {
+		log.Printf("Signed %d zones again before their signatures expire", resigned)
+	}
+	return resigned
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKeyFiles generates a key pair for zone n as dnssec-keygen would write it
+func testKeyFiles(t *testing.T, n string, flags uint16) (string, string) {
+	k := &dns.DNSKEY{Hdr: dns.RR_Header{Name: dns.Fqdn(n), Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags: flags, Protocol: 3, Algorithm: dns.ECDSAP256SHA256}
+	priv, err := k.Generate(256)
+	if err != nil {
+		t.Fatalf("Generate failed: %s", err.Error())
+	}
+	return "; This is a key-signing key\n" + k.String() + "\n", k.PrivateKeyString(priv)
+}
+
+// testSignedZones returns abc.com with a KSK and ZSK
+func testSignedZones(t *testing.T) map[string]string {
+	kskPub, kskPriv := testKeyFiles(t, "abc.com", 257)
+	zskPub, zskPriv := testKeyFiles(t, "abc.com", 256)
+	return map[string]string{
+		"abc.com":             abcZone + "sub IN NS ns.sub.abc.com.\nns.sub IN A 10.1.1.1\n",
+		"abc.com.ksk.key":     kskPub,
+		"abc.com.ksk.private": kskPriv,
+		"abc.com.zsk.key":     zskPub,
+		"abc.com.zsk.private": zskPriv,
+	}
+}
+
+// testDOQuery is testQuery with the DO bit set
+func testDOQuery(c *config, n string, name string, qtype uint16) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(4096, true)
+	w := &testWriter{}
+	c.zones[n].zoneHandler(c, w, req)
+	return w.msg
+}
+
+// verifyAnswer checks every RRset in m.Answer has a valid signature from one of keys
+func verifyAnswer(t *testing.T, m *dns.Msg, keys []dns.RR) {
+	verifyRRs(t, m.Answer, keys)
+}
+
+// verifyRRs checks every RRset in rrs has a valid signature from one of keys
+func verifyRRs(t *testing.T, rrs []dns.RR, keys []dns.RR) {
+	sets := map[hotKey][]dns.RR{}
+	sigs := map[hotKey]*dns.RRSIG{}
+	for _, rr := range rrs {
+		k := hotKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			k.qtype = sig.TypeCovered
+			if sigs[k] != nil {
+				t.Errorf("More than one signature for %s %s in %v", k.name, dns.Type(k.qtype).String(), rrs)
+			}
+			sigs[k] = sig
+		} else {
+			sets[k] = append(sets[k], rr)
+		}
+	}
+	for k, set := range sets {
+		sig := sigs[k]
+		if sig == nil {
+			t.Errorf("No signature for %s %s in %v", k.name, dns.Type(k.qtype).String(), rrs)
+			continue
+		}
+		verified := false
+		for _, key := range keys {
+			if key.(*dns.DNSKEY).KeyTag() == sig.KeyTag && sig.Verify(key.(*dns.DNSKEY), set) == nil {
+				verified = sig.ValidityPeriod(time.Now())
+			}
+		}
+		if !verified {
+			t.Errorf("Signature for %s %s doesn't verify: %v", k.name, dns.Type(k.qtype).String(), rrs)
+		}
+	}
+}
+
+// countType counts the records of type t in rrs
+func countType(rrs []dns.RR, t uint16) int {
+	n := 0
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == t {
+			n++
+		}
+	}
+	return n
+}
+
+func TestOnlineSigning(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, hotSize: 10}
+	if err := c.loadZones(testSignedZones(t)); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	keys := testDOQuery(&c, "abc.com", "abc.com.", dns.TypeDNSKEY)
+	dnskeys := []dns.RR{}
+	for _, rr := range keys.Answer {
+		if rr.Header().Rrtype == dns.TypeDNSKEY {
+			dnskeys = append(dnskeys, rr)
+		}
+	}
+	if len(dnskeys) != 2 {
+		t.Fatalf("Expected a KSK and a ZSK, got %v", keys)
+	}
+	verifyAnswer(t, keys, dnskeys)
+	if keys.IsEdns0() == nil || !keys.IsEdns0().Do() {
+		t.Errorf("Expected the DO bit in the reply, got %v", keys)
+	}
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeSOA, dns.TypeNS, dns.TypeMX} {
+		verifyAnswer(t, testDOQuery(&c, "abc.com", "abc.com.", qtype), dnskeys)
+	}
+	verifyAnswer(t, testDOQuery(&c, "abc.com", "abc.com.", dns.TypeNSEC), dnskeys)
+
+	// without DO there are no signatures, even for ANY
+	if m := testQuery(&c, "abc.com", "abc.com.", dns.TypeA); len(m.Answer) != 1 {
+		t.Errorf("Expected no signatures without DO, got %v", m)
+	}
+	for _, rr := range testQuery(&c, "abc.com", "abc.com.", dns.TypeANY).Answer {
+		if rr.Header().Rrtype == dns.TypeRRSIG || rr.Header().Rrtype == dns.TypeNSEC {
+			t.Errorf("Expected no DNSSEC records in ANY without DO, got %v", rr)
+		}
+	}
+
+	// delegations and glue aren't signed
+	for _, rr := range c.zones["abc.com"].rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok && (sig.Hdr.Name == "ns.sub.abc.com." || (sig.Hdr.Name == "sub.abc.com." && sig.TypeCovered == dns.TypeNS)) {
+			t.Errorf("Expected no signature for glue or delegation NS, got %v", sig)
+		}
+	}
+
+	// empty answers are proven with NSEC records
+	nx := testDOQuery(&c, "abc.com", "zzz.abc.com.", dns.TypeA)
+	if nx.Rcode != dns.RcodeNameError || countType(nx.Ns, dns.TypeSOA) != 1 || countType(nx.Ns, dns.TypeNSEC) != 2 {
+		t.Errorf("Expected NXDOMAIN with the SOA, and NSECs covering the name and wildcard, got %v", nx)
+	}
+	verifyRRs(t, nx.Ns, dnskeys)
+	nodata := testDOQuery(&c, "abc.com", "abc.com.", dns.TypeAAAA)
+	if nodata.Rcode != dns.RcodeSuccess || countType(nodata.Ns, dns.TypeNSEC) != 1 || nodata.Ns[len(nodata.Ns)-2].Header().Name != "abc.com." {
+		t.Errorf("Expected NODATA with the NSEC of abc.com, got %v", nodata)
+	}
+	verifyRRs(t, nodata.Ns, dnskeys)
+	if m := testQuery(&c, "abc.com", "zzz.abc.com.", dns.TypeA); countType(m.Ns, dns.TypeNSEC) != 0 || countType(m.Ns, dns.TypeRRSIG) != 0 {
+		t.Errorf("Expected no NSEC records without DO, got %v", m)
+	}
+
+	// answers that aren't in the zone file are signed as they are served
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "abc.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: []byte{10, 2, 2, 2}}}
+	c.zones["abc.com"].addSignatures(&c, m)
+	verifyAnswer(t, m, dnskeys)
+
+	// signing again keeps a single set of DNSSEC records
+	before := len(c.zones["abc.com"].rrs)
+	c.zones["abc.com"].sigExpires = time.Now()
+	if n := c.resignExpiring(time.Now()); n != 1 || len(c.zones["abc.com"].rrs) != before {
+		t.Errorf("Expected abc.com signed again with %d records, got %d zones and %d records", before, n, len(c.zones["abc.com"].rrs))
+	}
+	if n := c.resignExpiring(time.Now()); n != 0 {
+		t.Errorf("Expected fresh signatures to be kept, got %d zones signed again", n)
+	}
+}
+
+func TestDNSSECKeyErrors(t *testing.T) {
+	pub, priv := testKeyFiles(t, "abc.com", 256)
+	otherPub, _ := testKeyFiles(t, "abc.com", 256)
+	kskPub, kskPriv := testKeyFiles(t, "def.com", 257)
+	for name, files := range map[string]map[string]string{
+		"ZSK as KSK":       {"abc.com.ksk.key": pub, "abc.com.ksk.private": priv},
+		"mismatched pair":  {"abc.com.zsk.key": otherPub, "abc.com.zsk.private": priv},
+		"other zone's key": {"abc.com.ksk.key": kskPub, "abc.com.ksk.private": kskPriv},
+		"no DNSKEY":        {"abc.com.zsk.key": "; empty\n", "abc.com.zsk.private": priv},
+	} {
+		if _, err := parseZoneKeys("abc.com", files); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	keys, err := parseZoneKeys("abc.com", map[string]string{"abc.com.zsk.key": pub, "abc.com.zsk.private": priv})
+	if err != nil || keys == nil || keys.ksk != keys.zsk {
+		t.Errorf("Expected a single key to sign everything, got %v %v", keys, err)
+	}
+	if keys, err := parseZoneKeys("abc.com", map[string]string{"abc.com.zsk.key": pub}); keys != nil || err != nil {
+		t.Errorf("Expected no keys for half a pair, got %v %v", keys, err)
+	}
+
+	c := config{stats: statsd.NoopClient{}}
+	err = c.loadZones(map[string]string{"abc.com": abcZone, "abc.com.zsk.key": otherPub, "abc.com.zsk.private": priv})
+	if err == nil {
+		t.Errorf("Expected loadZones to report bad keys")
+	}
+	if m := testDOQuery(&c, "abc.com", "abc.com.", dns.TypeA); len(m.Answer) != 1 {
+		t.Errorf("Expected abc.com served unsigned with bad keys, got %v", m)
+	}
+}
+
+func TestCanonicalOrder(t *testing.T) {
+	names := []string{"z.example.", "example.", "*.z.example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.", "zABC.a.EXAMPLE."}
+	want := []string{"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.", "zABC.a.EXAMPLE.", "z.example.", "*.z.example."}
+	sort.Sort(byCanonicalName(names))
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("Expected canonical order %v, got %v", want, names)
+			break
+		}
+	}
+}
+
+func TestPresignedZone(t *testing.T) {
+	pub, priv := testKeyFiles(t, "abc.com", 257)
+	keys, err := parseZoneKeys("abc.com", map[string]string{"abc.com.ksk.key": pub, "abc.com.ksk.private": priv})
+	if err != nil {
+		t.Fatalf("parseZoneKeys failed: %s", err.Error())
+	}
+	rrs, err := parseZoneFile("abc.com", abcZone)
+	if err != nil {
+		t.Fatalf("parseZoneFile failed: %s", err.Error())
+	}
+	signed, _, _, err := keys.signRRs("abc.com", rrs, nil, time.Now())
+	if err != nil {
+		t.Fatalf("signRRs failed: %s", err.Error())
+	}
+	zoneFile := ""
+	dnskeys := []dns.RR{}
+	for _, rr := range signed {
+		zoneFile += rr.String() + "\n"
+		if rr.Header().Rrtype == dns.TypeDNSKEY {
+			dnskeys = append(dnskeys, rr)
+		}
+	}
+
+	c := config{stats: statsd.NoopClient{}, hotSize: 10}
+	if err := c.loadZones(map[string]string{"abc.com": zoneFile}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeSOA, dns.TypeNS, dns.TypeMX, dns.TypeDNSKEY} {
+		m := testDOQuery(&c, "abc.com", "abc.com.", qtype)
+		if countType(m.Answer, dns.TypeRRSIG) != 1 {
+			t.Errorf("Expected the zone file's signature for %s, got %v", dns.Type(qtype).String(), m)
+		}
+		verifyAnswer(t, m, dnskeys)
+	}
+	all := testDOQuery(&c, "abc.com", "abc.com.", dns.TypeANY)
+	verifyAnswer(t, all, dnskeys) // and each signature once
+	nx := testDOQuery(&c, "abc.com", "nope.abc.com.", dns.TypeA)
+	if nx.Rcode != dns.RcodeNameError || countType(nx.Ns, dns.TypeNSEC) != 1 {
+		t.Errorf("Expected NXDOMAIN with the NSEC covering the name and wildcard, got %v", nx)
+	}
+	verifyRRs(t, nx.Ns, dnskeys)
+	if m := testQuery(&c, "abc.com", "abc.com.", dns.TypeA); len(m.Answer) != 1 {
+		t.Errorf("Expected no signatures without DO, got %v", m)
+	}
+
+	// an RRset changed as it is served no longer matches its signature
+	m := new(dns.Msg)
+	m.SetQuestion("abc.com.", dns.TypeA)
+	m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "abc.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: []byte{10, 2, 2, 2}}}
+	c.zones["abc.com"].addSignatures(&c, m)
+	if countType(m.Answer, dns.TypeRRSIG) != 0 {
+		t.Errorf("Expected no signature for a changed RRset, got %v", m)
+	}
+}
+
+// nsec3Covers reports whether rr matches or covers the hash of name
+func nsec3Covers(rr *dns.NSEC3, name string) (bool, bool) {
+	h := dns.HashName(name, rr.Hash, rr.Iterations, rr.Salt)
+	owner := nsec3Hash(rr)
+	if owner == h {
+		return true, false
+	}
+	if owner < rr.NextDomain {
+		return false, owner < h && h < rr.NextDomain
+	}
+	return false, owner < h || h < rr.NextDomain // the last NSEC3 wraps around
+}
+
+func TestNSEC3(t *testing.T) {
+	zones := testSignedZones(t)
+	zones["abc.com"] += "a.b IN A 10.1.1.2\n"
+	zones["abc.com.policy"] = `{"nsec3": {"iterations": 1, "salt": "ab12"}}`
+	c := config{stats: statsd.NoopClient{}}
+	if err := c.loadZones(zones); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	z := c.zones["abc.com"]
+	if len(z.nsecs) != 0 || len(z.nsec3s) != 5 { // abc.com, sub, www, a.b and the empty non-terminal b
+		t.Fatalf("Expected an NSEC3 chain of 5 names and no NSECs, got %v", z.nsec3s)
+	}
+	dnskeys := withoutType(testDOQuery(&c, "abc.com", "abc.com.", dns.TypeDNSKEY).Answer, dns.TypeRRSIG)
+	param := testDOQuery(&c, "abc.com", "abc.com.", dns.TypeNSEC3PARAM)
+	if countType(param.Answer, dns.TypeNSEC3PARAM) != 1 {
+		t.Errorf("Expected an NSEC3PARAM at the apex, got %v", param)
+	}
+	verifyAnswer(t, param, dnskeys)
+
+	nx := testDOQuery(&c, "abc.com", "x.zzz.abc.com.", dns.TypeA)
+	if nx.Rcode != dns.RcodeNameError || countType(nx.Ns, dns.TypeNSEC) != 0 {
+		t.Errorf("Expected NXDOMAIN without NSECs, got %v", nx)
+	}
+	verifyRRs(t, nx.Ns, dnskeys)
+	matched, nextCloser, wildcard := false, false, false
+	for _, rr := range nx.Ns {
+		if nsec3, ok := rr.(*dns.NSEC3); ok {
+			if match, _ := nsec3Covers(nsec3, "abc.com."); match {
+				matched = true
+			}
+			if _, cover := nsec3Covers(nsec3, "zzz.abc.com."); cover {
+				nextCloser = true
+			}
+			if _, cover := nsec3Covers(nsec3, "*.abc.com."); cover {
+				wildcard = true
+			}
+		}
+	}
+	if !matched || !nextCloser || !wildcard {
+		t.Errorf("Expected a closest encloser proof (match %v, next closer %v, wildcard %v), got %v", matched, nextCloser, wildcard, nx)
+	}
+
+	for _, name := range []string{"abc.com.", "b.abc.com."} {
+		nodata := testDOQuery(&c, "abc.com", name, dns.TypeAAAA)
+		verifyRRs(t, nodata.Ns, dnskeys)
+		found := false
+		for _, rr := range nodata.Ns {
+			if nsec3, ok := rr.(*dns.NSEC3); ok {
+				found, _ = nsec3Covers(nsec3, name)
+			}
+		}
+		if nodata.Rcode != dns.RcodeSuccess || !found {
+			t.Errorf("Expected NODATA with the NSEC3 matching %s, got %v", name, nodata)
+		}
+	}
+
+	for _, policy := range []string{`{"nsec3": {"iterations": 500}}`, `{"nsec3": {"salt": "xyz"}}`} {
+		if _, err := parsePolicy("abc.com", policy); err == nil {
+			t.Errorf("Expected an error for policy %s", policy)
+		}
+	}
+}
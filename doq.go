@@ -0,0 +1,94 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+//go:build doq
+// +build doq
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"net"
+)
+
+// DNS over QUIC (RFC 9250) is experimental, and only built with -tags doq as it
+// needs quic-go. Each query arrives on its own stream, framed like TCP, so streams
+// are answered by serveConn with the same handlers, limits and metrics as TCP and DoT.
+const doqSupported = true
+
+// DoQ error codes, RFC 9250 section 4.3
+const (
+	doqNoError       = 0x0
+	doqProtocolError = 0x2
+)
+
+// quicStream adapts a QUIC stream to the net.Conn serveConn expects
+type quicStream struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (s quicStream) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s quicStream) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+// serveDoQ accepts DoQ connections on l until it is closed
+func (c *config) serveDoQ(l *quic.Listener, h dns.Handler) error {
+	if c.tcp == nil {
+		c.tcp = &tcpConns{}
+	}
+	for {
+		conn, err := l.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		ip := conn.RemoteAddr().(*net.UDPAddr).IP.String()
+		if _, limit := c.tcp.acquire(ip, c.tcpMax, c.tcpPerIP); len(limit) > 0 {
+			c.stats.Incr(limit, 1)
+			conn.CloseWithError(doqNoError, "")
+			continue
+		}
+		c.stats.Incr("doq.connections", 1)
+		go func() {
+			defer c.tcp.release(ip)
+			c.serveQUICConn(conn, h)
+		}()
+	}
+}
+
+// serveQUICConn answers the queries on each stream of conn until the client closes it
+// or sends a query with a message ID other than 0, which RFC 9250 forbids.
+func (c *config) serveQUICConn(conn *quic.Conn, h dns.Handler) {
+	checked := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if req.Id != 0 {
+			c.stats.Incr("doq.protocolerror", 1)
+			conn.CloseWithError(doqProtocolError, "message ID must be 0")
+			return
+		}
+		h.ServeDNS(w, req)
+	})
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			serveConn(quicStream{stream, conn}, checked, c.tcpIdle, c.tsigSecrets())
+		}()
+	}
+}
+
+// listenDoQ starts the DoQ listener, failing like listenTCP.
+func (c *config) listenDoQ() {
+	cfg := c.dot.Clone()
+	cfg.NextProtos = []string{"doq"}
+	cfg.MinVersion = tls.VersionTLS13 // QUIC needs TLS 1.3
+	l, err := quic.ListenAddr(c.doqAddr, cfg, &quic.Config{MaxIdleTimeout: c.tcpIdle})
+	if err != nil {
+		c.listenerFailed("DoQ", err)
+	}
+	if err := c.serveDoQ(l, dns.DefaultServeMux); err != nil {
+		c.listenerFailed("DoQ", err)
+	}
+}
@@ -0,0 +1,15 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+//go:build !doq
+// +build !doq
+
+package main
+
+import (
+	"log"
+)
+
+const doqSupported = false
+
+func (c *config) listenDoQ() {
+	log.Fatal("--doq needs a build with -tags doq")
+}
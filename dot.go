@@ -0,0 +1,104 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// DNS over TLS (RFC 7858) is served with --dot, on the same accept loop and limits
+// as TCP. The listener negotiates the ALPN protocol "dot", refuses TLS versions
+// below --dot-min-tls, and resumes sessions with tickets. Tickets are encrypted with
+// a random key unless --dot-ticket-key is set, which lets every server of a fleet
+// resume each other's sessions. With --dot-client-ca the listener is private: only
+// clients presenting a certificate signed by that CA, such as other data centers,
+// can connect.
+const dotHandshakeTimeout = 5 * time.Second
+
+// dotOptions are the --dot-* options
+type dotOptions struct {
+	cert, key  string
+	minVersion string
+	clientCA   string
+	ticketKey  string // secret or reference
+}
+
+var tlsVersions = map[string]uint16{"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+// dotConfig builds the TLS configuration for the DoT listener.
+func (c *config) dotConfig(o dotOptions) (*tls.Config, error) {
+	if len(o.cert) == 0 || len(o.key) == 0 {
+		return nil, fmt.Errorf("invalid --dot or --doq: --dot-cert and --dot-key are required")
+	}
+	cert, err := tls.LoadX509KeyPair(o.cert, o.key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --dot-cert or --dot-key: %s", err.Error())
+	}
+	min, ok := tlsVersions[o.minVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid --dot-min-tls %q: must be 1.2 or 1.3", o.minVersion)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   min,
+		NextProtos:   []string{"dot"},
+	}
+	if len(o.clientCA) > 0 {
+		pem, err := ioutil.ReadFile(o.clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --dot-client-ca: %s", err.Error())
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid --dot-client-ca: no certificates in %s", o.clientCA)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if len(o.ticketKey) > 0 {
+		key := o.ticketKey
+		if isSecretRef(key) {
+			if key, err = c.resolveSecret(key); err != nil {
+				return nil, fmt.Errorf("Error resolving secret %s: %s", o.ticketKey, err.Error())
+			}
+		}
+		cfg.SetSessionTicketKeys([][32]byte{sha256.Sum256([]byte(key))})
+	}
+	return cfg, nil
+}
+
+// serveDoT accepts DoT connections on l until it is closed
+func (c *config) serveDoT(l *net.TCPListener, h dns.Handler, cfg *tls.Config) error {
+	return c.acceptStream(l, h, func(conn net.Conn) (net.Conn, error) {
+		tc := tls.Server(conn, cfg)
+		tc.SetDeadline(time.Now().Add(dotHandshakeTimeout))
+		if err := tc.Handshake(); err != nil {
+			c.stats.Incr("dot.handshake.error", 1)
+			c.debug(fmt.Sprintf("DoT handshake with %s failed: %s", conn.RemoteAddr().String(), err.Error()))
+			return nil, err
+		}
+		tc.SetDeadline(time.Time{})
+		c.stats.Incr("dot.connections", 1)
+		if tc.ConnectionState().DidResume {
+			c.stats.Incr("dot.resumed", 1)
+		}
+		return tc, nil
+	})
+}
+
+// listenDoT starts the DoT listener, failing like listenTCP.
+func (c *config) listenDoT() {
+	l, err := c.bindTCP(c.dotAddr)
+	if err != nil {
+		c.listenerFailed("DoT", err)
+		return
+	}
+	if err := c.serveDoT(l, dns.DefaultServeMux, c.dot); err != nil {
+		c.listenerFailed("DoT", err)
+	}
+}
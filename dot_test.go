@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate and key for 127.0.0.1 to dir,
+// returning their paths and the certificate.
+func writeTestCert(t *testing.T, dir, name string) (string, string, *x509.Certificate) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certPath, keyPath := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certPath, keyPath, cert
+}
+
+func TestDoT(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "neddns-dot")
+	defer os.RemoveAll(dir)
+	certPath, keyPath, cert := writeTestCert(t, dir, "server")
+	clientCert, clientKey, _ := writeTestCert(t, dir, "client")
+
+	c := config{stats: statsd.NoopClient{}, tcpMax: 10, tcpPerIP: 10, tcpIdle: time.Second}
+	if _, err := c.dotConfig(dotOptions{cert: certPath, key: keyPath, minVersion: "1.1"}); err == nil {
+		t.Errorf("Expected --dot-min-tls 1.1 to be refused")
+	}
+	if _, err := c.dotConfig(dotOptions{minVersion: "1.2"}); err == nil {
+		t.Errorf("Expected --dot without a certificate to be refused")
+	}
+	mux := dns.NewServeMux()
+	mux.HandleFunc("abc.com.", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+	listen := func(o dotOptions) string {
+		cfg, err := c.dotConfig(o)
+		if err != nil {
+			t.Fatalf("dotConfig: %s", err.Error())
+		}
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go c.serveDoT(l, mux, cfg)
+		return l.Addr().String()
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	query := func(addr string, cfg *tls.Config) (tls.ConnectionState, error) {
+		tc, err := tls.Dial("tcp", addr, cfg)
+		if err != nil {
+			return tls.ConnectionState{}, err
+		}
+		defer tc.Close()
+		req := new(dns.Msg)
+		req.SetQuestion("abc.com.", dns.TypeA)
+		b, _ := req.Pack()
+		if _, err := tc.Write(append([]byte{byte(len(b) >> 8), byte(len(b))}, b...)); err != nil {
+			return tls.ConnectionState{}, err
+		}
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(tc, length); err != nil {
+			return tls.ConnectionState{}, err
+		}
+		if _, err := io.ReadFull(tc, make([]byte, int(length[0])<<8|int(length[1]))); err != nil {
+			return tls.ConnectionState{}, err
+		}
+		return tc.ConnectionState(), nil
+	}
+
+	addr := listen(dotOptions{cert: certPath, key: keyPath, minVersion: "1.2", ticketKey: "fleet secret"})
+	client := &tls.Config{RootCAs: roots, NextProtos: []string{"dot"}, ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+	state, err := query(addr, client)
+	if err != nil || state.NegotiatedProtocol != "dot" {
+		t.Fatalf("DoT query failed: %v %v", state.NegotiatedProtocol, err)
+	}
+	if state, err = query(addr, client); err != nil || !state.DidResume {
+		t.Errorf("Expected the second connection to resume the session: %v %v", state.DidResume, err)
+	}
+	if _, err := query(addr, &tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS12}); err != nil {
+		t.Errorf("Expected TLS 1.2 to be accepted by default: %v", err)
+	}
+
+	addr = listen(dotOptions{cert: certPath, key: keyPath, minVersion: "1.3"})
+	if _, err := query(addr, &tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Errorf("Expected TLS 1.2 to be refused with --dot-min-tls=1.3")
+	}
+
+	addr = listen(dotOptions{cert: certPath, key: keyPath, minVersion: "1.2", clientCA: clientCert})
+	if _, err := query(addr, &tls.Config{RootCAs: roots}); err == nil {
+		t.Errorf("Expected a client without a certificate to be refused")
+	}
+	pair, _ := tls.LoadX509KeyPair(clientCert, clientKey)
+	if _, err := query(addr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{pair}}); err != nil {
+		t.Errorf("Expected a client with a certificate from --dot-client-ca to be accepted: %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"github.com/miekg/dns"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A client that doesn't get our reply in time asks again, with the same ID for the
+// same name. Such retries are the first sign of replies getting slow or lost on the
+// way, well before clients give up, so with --dup-window every query is checked
+// against those seen in that many milliseconds: one from the same client address
+// with the same ID and name is counted by query.duplicate, and the time since the
+// first is timed by query.duplicate.delay, about the client's timeout. With
+// --dup-log=n, one duplicate in n is logged. Monitoring probes aren't checked.
+//
+// Queries are remembered in two generations of one window each, the older dropped
+// as a new one starts, so memory stays at two windows of queries.
+type dupKey struct {
+	client string
+	id     uint16
+	name   string
+}
+
+type dupDetector struct {
+	window  time.Duration
+	logOne  int // log one duplicate in this many, 0 for none
+	mu      sync.Mutex
+	current map[dupKey]time.Time
+	last    map[dupKey]time.Time // the previous window's
+	started time.Time            // of the current window
+	dups    int
+}
+
+func newDupDetector(window time.Duration, logOne int) *dupDetector {
+	return &dupDetector{window: window, logOne: logOne, current: map[dupKey]time.Time{}, last: map[dupKey]time.Time{}}
+}
+
+// observe checks the query req from w for a duplicate at now, reporting whether it
+// was one. It is nil-safe.
+func (d *dupDetector) observe(c *config, w dns.ResponseWriter, req *dns.Msg, now time.Time) bool {
+	if d == nil || len(req.Question) == 0 {
+		return false
+	}
+	ip := remoteIP(w)
+	if ip == nil {
+		return false
+	}
+	k := dupKey{string(ip), req.Id, strings.ToLower(req.Question[0].Name)}
+	d.mu.Lock()
+	if now.Sub(d.started) >= d.window {
+		d.last, d.current = d.current, map[dupKey]time.Time{}
+		if now.Sub(d.started) >= 2*d.window { // nothing in the last window is recent
+			d.last = map[dupKey]time.Time{}
+		}
+		d.started = now
+	}
+	first, seen := d.current[k]
+	if !seen {
+		first, seen = d.last[k]
+	}
+	if !seen || now.Sub(first) > d.window {
+		d.current[k] = now
+		d.mu.Unlock()
+		return false
+	}
+	d.dups++
+	logIt := d.logOne > 0 && d.dups%d.logOne == 0
+	d.mu.Unlock()
+	delay := now.Sub(first)
+	c.stats.Incr("query.duplicate", 1)
+	c.stats.Timing("query.duplicate.delay", int64(delay/time.Millisecond))
+	if logIt {
+		q := req.Question[0]
+		log.Printf("Duplicate query [%s] id %d %s[%s] %s after the first", w.RemoteAddr().String(), req.Id, q.Name, dns.Type(q.Qtype).String(), delay/time.Millisecond*time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+func TestDuplicateQueries(t *testing.T) {
+	stats := &countingStats{counts: map[string]int64{}}
+	c := config{stats: stats, dups: newDupDetector(time.Second, 1)}
+	query := func(id uint16, name string, at time.Duration) bool {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		req.Id = id
+		return c.dups.observe(&c, &testWriter{}, req, time.Unix(1000, 0).Add(at))
+	}
+	for i, tc := range []struct {
+		id   uint16
+		name string
+		at   time.Duration
+		want bool
+	}{
+		{1, "www.abc.com.", 0, false},
+		{1, "www.abc.com.", 800 * time.Millisecond, true},
+		{2, "www.abc.com.", 900 * time.Millisecond, false}, // another query
+		{1, "abc.com.", 900 * time.Millisecond, false},
+		{1, "WWW.abc.com.", 1200 * time.Millisecond, false}, // over a second after the first
+		{2, "www.abc.com.", 1500 * time.Millisecond, true},  // from the previous window
+		{2, "www.abc.com.", 5 * time.Second, false},
+	} {
+		if got := query(tc.id, tc.name, tc.at); got != tc.want {
+			t.Errorf("Query %d (id %d %s at %s): expected duplicate %v, got %v", i, tc.id, tc.name, tc.at, tc.want, got)
+		}
+	}
+	if n := stats.get("query.duplicate"); n != 2 {
+		t.Errorf("Expected 2 duplicates counted, got %d", n)
+	}
+	if c.monitorConfig().dups != nil {
+		t.Errorf("Expected monitoring probes not checked for duplicates")
+	}
+	c.dups = nil
+	if query(1, "www.abc.com.", 0) {
+		t.Errorf("Expected no duplicates without --dup-window")
+	}
+}
@@ -0,0 +1,72 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net"
+)
+
+// Public resolvers serve clients from all over, so their address says little about
+// where a client is. With --ecs, neddns reads the EDNS Client Subnet option (RFC
+// 7871) they send and uses the client's subnet in place of the resolver's address
+// for --geoip and for views whose rule allows it with "ecs": true. Views without it
+// match only the resolver's own address, so a view that grants access, such as an
+// internal one, can't be reached by sending a made-up subnet.
+//
+// Replies to a query with the option carry it back with the scope prefix the
+// answer depends on, so resolvers know which clients they may give it to from
+// their cache: the query's source prefix when an "ecs" view rule was consulted,
+// and 0, any client, otherwise.
+const (
+	ecsIPv4 = 1
+	ecsIPv6 = 2
+)
+
+// clientSubnet returns the reply's copy of the client subnet option of req, with a
+// scope of 0, or nil without --ecs or a usable option
+func (c *config) clientSubnet(req *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := req.IsEdns0()
+	if !c.ecs || opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		s, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+		if (s.Family == ecsIPv4 && s.SourceNetmask <= 32) || (s.Family == ecsIPv6 && s.SourceNetmask <= 128) {
+			return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: s.Family, SourceNetmask: s.SourceNetmask, Address: s.Address}
+		}
+	}
+	return nil
+}
+
+// subnetIP returns the client address to use for ecs, or ip, the address the
+// query came from, if the client didn't give a subnet
+func subnetIP(ecs *dns.EDNS0_SUBNET, ip net.IP) net.IP {
+	if ecs == nil || ecs.SourceNetmask == 0 { // a source prefix of 0 asks us not to use it
+		return ip
+	}
+	return ecs.Address
+}
+
+// clientIP returns the address of the client of a query, from its client subnet
+// with --ecs
+func (c *config) clientIP(w dns.ResponseWriter, req *dns.Msg) net.IP {
+	return subnetIP(c.clientSubnet(req), remoteIP(w))
+}
+
+// echoSubnet puts the client subnet option ecs in reply m, replacing any other
+func echoSubnet(m *dns.Msg, ecs *dns.EDNS0_SUBNET) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := []dns.EDNS0{}
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+	opt.Option = append(options, ecs)
+}
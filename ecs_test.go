@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestClientSubnet(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, udpSize: 1232, ecs: true}
+	policy := `{"views": [{"name": "cdn", "cidrs": ["198.51.100.0/24"], "ecs": true}, {"name": "internal", "cidrs": ["10.0.0.0/8"]}]}`
+	if err := c.loadZones(map[string]string{
+		"abc.com":          abcZone,
+		"abc.com.policy":   policy,
+		"abc.com@cdn":      strings.Replace(abcZone, "127.0.0.1", "198.51.100.80", 1),
+		"abc.com@internal": strings.Replace(abcZone, "127.0.0.1", "10.0.0.1", 1),
+		"def.com":          defZone,
+	}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	query := func(name, subnet string, prefix uint8) (string, *dns.EDNS0_SUBNET) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		req.SetEdns0(1232, false)
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: ecsIPv4, SourceNetmask: prefix, Address: net.ParseIP(subnet).To4()})
+		w := &testWriter{}
+		dns.DefaultServeMux.ServeDNS(w, req)
+		var echoed *dns.EDNS0_SUBNET
+		if opt := w.msg.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if s, ok := o.(*dns.EDNS0_SUBNET); ok {
+					echoed = s
+				}
+			}
+		}
+		if len(w.msg.Answer) == 0 {
+			return "", echoed
+		}
+		return w.msg.Answer[0].(*dns.A).A.String(), echoed
+	}
+
+	if a, ecs := query("abc.com.", "198.51.100.0", 24); a != "198.51.100.80" || ecs == nil || ecs.SourceScope != 24 || ecs.SourceNetmask != 24 {
+		t.Errorf("Expected the cdn view for the client subnet with scope 24, got %s %v", a, ecs)
+	}
+	if a, ecs := query("abc.com.", "10.1.2.0", 24); a != "127.0.0.1" || ecs == nil || ecs.SourceScope != 24 {
+		t.Errorf("Expected a view without ecs not to match the client subnet, got %s %v", a, ecs)
+	}
+	if a, _ := query("abc.com.", "198.51.100.0", 0); a != "127.0.0.1" {
+		t.Errorf("Expected a source prefix of 0 to leave the subnet unused, got %s", a)
+	}
+	if _, ecs := query("def.com.", "198.51.100.0", 24); ecs == nil || ecs.SourceScope != 0 {
+		t.Errorf("Expected scope 0 for an answer that doesn't depend on the client, got %v", ecs)
+	}
+
+	c.ecs = false
+	if a, ecs := query("abc.com.", "198.51.100.0", 24); a != "127.0.0.1" || ecs != nil {
+		t.Errorf("Expected the client subnet ignored without --ecs, got %s %v", a, ecs)
+	}
+}
@@ -0,0 +1,106 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"sync/atomic"
+)
+
+// A bare REFUSED or SERVFAIL leaves whoever runs dig guessing. Replies to EDNS
+// queries that fail or fall short carry an Extended DNS Error option (RFC 8914)
+// with an info code and a short reason:
+//
+//   - Not Authoritative (20): names outside the served zones, transfers of names
+//     that aren't a zone apex
+//   - Prohibited (18): private-use zones from public clients, qtype and transfer
+//     policies that refuse the query, and rate limited queries
+//   - Not Supported (21): qtypes a policy answers NOTIMP, AXFR over UDP
+//   - DNSSEC Bogus (6): a root CNAME target whose signed answer the resolver
+//     didn't validate, with --flatten-dnssec
+//   - Network Error (23) and No Reachable Authority (22): flattening and forwarding
+//     lookups that failed
+//   - Stale Answer (3) and Stale NXDOMAIN Answer (19): answers from a zone that
+//     hasn't been refreshed from the bucket for --stale seconds
+//   - Invalid Data (24): a zone that can't be transferred, having no SOA
+//   - Other (0): queries shed under load
+//
+// Each is counted by ede.<code>. Clients without EDNS get the bare rcode as before.
+const (
+	edeOption               = 15 // the EDNS0 option code
+	edeOther                = 0
+	edeStaleAnswer          = 3
+	edeDNSSECBogus          = 6
+	edeProhibited           = 18
+	edeStaleNXDomain        = 19
+	edeNotAuthoritative     = 20
+	edeNotSupported         = 21
+	edeNoReachableAuthority = 22
+	edeNetworkError         = 23
+	edeInvalidData          = 24
+	flattenFailed           = "(FLAT FAILED " // answer trace of a failed flattening, see flattenEDE
+)
+
+// edeError is an error that an extended DNS error code explains
+type edeError struct {
+	code uint16
+	msg  string
+}
+
+func (e *edeError) Error() string { return e.msg }
+
+// extendedError adds an Extended DNS Error with code and text to m, the reply to
+// req, if req has EDNS, giving m our OPT record if it has none yet
+func (c *config) extendedError(req, m *dns.Msg, code uint16, text string) {
+	query := req.IsEdns0()
+	if c.udpSize == 0 || query == nil {
+		return
+	}
+	c.setOPT(m, query.Do())
+	data := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(data, code)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: edeOption, Data: append(data, text...)})
+	c.stats.Incr(fmt.Sprintf("ede.%d", code), 1)
+}
+
+// flattenFailure returns the answer trace entry of a flattening that failed with
+// err
+func flattenFailure(err error) string {
+	code := uint16(edeOther)
+	if e, ok := err.(*edeError); ok {
+		code = e.code
+	}
+	return fmt.Sprintf("%s%d) %s", flattenFailed, code, err.Error())
+}
+
+// flattenEDE returns the extended error code of a failed flattening in answers,
+// an answer's trace, reporting whether one failed
+func flattenEDE(answers []string) (uint16, bool) {
+	for _, a := range answers {
+		if strings.HasPrefix(a, flattenFailed) {
+			var code uint16
+			fmt.Sscanf(a[len(flattenFailed):], "%d)", &code)
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+// isStale reports whether the zone hasn't been refreshed for --stale seconds, as
+// checkStale last found
+func (z *zone) isStale() bool {
+	return atomic.LoadInt32(&z.stale) == 1
+}
+
+// staleEDE adds the stale answer extended error to m, the reply to req from a
+// stale zone
+func (c *config) staleEDE(req, m *dns.Msg) {
+	if m.Rcode == dns.RcodeNameError {
+		c.extendedError(req, m, edeStaleNXDomain, "zone not refreshed recently")
+		return
+	}
+	c.extendedError(req, m, edeStaleAnswer, "zone not refreshed recently")
+}
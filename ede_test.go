@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// testEDE returns the info code and text of the extended DNS error in m, or -1
+func testEDE(m *dns.Msg) (int, string) {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == edeOption && len(l.Data) >= 2 {
+				return int(binary.BigEndian.Uint16(l.Data)), string(l.Data[2:])
+			}
+		}
+	}
+	return -1, ""
+}
+
+func TestExtendedErrors(t *testing.T) {
+	started := make(chan bool)
+	resolver := &dns.Server{Addr: "127.0.0.1:25371", Net: "udp", NotifyStartedFunc: func() { started <- true }}
+	resolver.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) { // signed, never validated
+		name := req.Question[0].Name
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("10.8.8.8")},
+			&dns.RRSIG{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 60}, TypeCovered: dns.TypeA, Algorithm: dns.RSASHA256, SignerName: "def.com.", Signature: "AAAA"})
+		w.WriteMsg(m)
+	})
+	go resolver.ListenAndServe()
+	<-started
+	defer resolver.Shutdown()
+
+	c := config{stats: statsd.NoopClient{}, udpSize: 1232, resolver: "127.0.0.1:25371", flattenDNSSEC: true}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone, "flat.com": flatZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	c.registerVersionHandler()
+	query := func(name string, edns bool) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		if edns {
+			req.SetEdns0(4096, false)
+		}
+		w := &testWriter{}
+		dns.DefaultServeMux.ServeDNS(w, req)
+		return w.msg
+	}
+
+	if m := query("jkl.com.", true); m.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected REFUSED outside the served zones, got %v", m)
+	} else if code, text := testEDE(m); code != edeNotAuthoritative || len(text) == 0 {
+		t.Errorf("Expected Not Authoritative with a reason, got %d %q", code, text)
+	}
+	if m := query("jkl.com.", false); m.IsEdns0() != nil {
+		t.Errorf("Expected no OPT record without EDNS, got %v", m.Extra)
+	}
+	if code, text := testEDE(query("flat.com.", true)); code != edeDNSSECBogus || !strings.Contains(text, "flattening") {
+		t.Errorf("Expected DNSSEC Bogus for an unvalidated flattening target, got %d %q", code, text)
+	}
+	if code, _ := testEDE(query("abc.com.", true)); code != -1 {
+		t.Errorf("Expected no extended error on an answer, got %d", code)
+	}
+
+	atomic.StoreInt32(&c.zones["abc.com"].stale, 1)
+	if m := query("abc.com.", true); len(m.Answer) != 1 {
+		t.Errorf("Expected a stale zone still answered, got %v", m)
+	} else if code, _ := testEDE(m); code != edeStaleAnswer {
+		t.Errorf("Expected Stale Answer, got %d", code)
+	}
+	if code, _ := testEDE(query("nothere.abc.com.", true)); code != edeStaleNXDomain {
+		t.Errorf("Expected Stale NXDOMAIN Answer, got %d", code)
+	}
+}
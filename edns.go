@@ -0,0 +1,180 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+// neddns speaks EDNS0 (RFC 6891). A reply to a query with an OPT record has one
+// too, advertising --udp-size as the largest UDP message we take, with the query's
+// DO bit. Replies over UDP fit the payload size the client advertised, capped at
+// --udp-size, or 512 bytes for clients without EDNS. One that doesn't fit loses
+// its additional records first, which resolvers can do without, and then its
+// authority section and the answer RRsets that don't fit, keeping those before
+// them whole, with the TC bit set so the client retries over TCP. Replies over TCP
+// are fit to the 64KB a message can have, rather than failing to pack. Queries
+// with an EDNS version other than 0 get BADVERS.
+const (
+	ednsVersion     = 0
+	rcodeBadVersion = 16
+	optSize         = 11 // an OPT record without options
+	tsigReserve     = 64 // the MAC of a TSIG record, as big as hmac-sha512 makes
+)
+
+// ednsWriter fits replies to the client's EDNS0 payload size
+type ednsWriter struct {
+	dns.ResponseWriter
+	c      *config
+	query  *dns.OPT // the query's, nil without EDNS
+	limit  int      // the largest reply
+	subnet *dns.EDNS0_SUBNET
+}
+
+// ednsWriter wraps w to fit replies to req and echo its client subnet ecs, if any
+// (see ecs.go), or returns w without --udp-size
+func (c *config) ednsWriter(w dns.ResponseWriter, req *dns.Msg, ecs *dns.EDNS0_SUBNET) dns.ResponseWriter {
+	if c.udpSize == 0 {
+		return w
+	}
+	limit := c.replyLimit(w, req)
+	if limit == 0 {
+		limit = dns.MaxMsgSize
+	}
+	return &ednsWriter{ResponseWriter: w, c: c, query: req.IsEdns0(), limit: limit, subnet: ecs}
+}
+
+// replyLimit returns the largest reply to req we may send over UDP, or 0 if w is a
+// stream
+func (c *config) replyLimit(w dns.ResponseWriter, req *dns.Msg) int {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); !ok {
+		return 0
+	}
+	limit := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > limit {
+		limit = int(opt.UDPSize())
+	}
+	if c.udpSize > 0 && limit > c.udpSize {
+		limit = c.udpSize
+	}
+	return limit
+}
+
+func (w *ednsWriter) WriteMsg(m *dns.Msg) error {
+	if w.query != nil {
+		w.c.setOPT(m, w.query.Do())
+	}
+	if w.subnet != nil {
+		echoSubnet(m, w.subnet)
+	}
+	w.c.fitReply(m, w.limit)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// Write sends a packed reply, unpacking it first if the client subnet has to be
+// echoed in it
+func (w *ednsWriter) Write(b []byte) (int, error) {
+	if w.subnet == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.WriteMsg(m)
+}
+
+// setOPT gives reply m our OPT record, before its TSIG if it has one
+func (c *config) setOPT(m *dns.Msg, do bool) {
+	if opt := m.IsEdns0(); opt != nil {
+		opt.SetUDPSize(uint16(c.udpSize))
+		return
+	}
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(uint16(c.udpSize))
+	if do {
+		opt.SetDo()
+	}
+	if t := m.IsTsig(); t != nil {
+		m.Extra = append(m.Extra[:len(m.Extra)-1:len(m.Extra)-1], opt, t)
+		return
+	}
+	m.Extra = append(m.Extra, opt)
+}
+
+// fitReply cuts m down to limit bytes, dropping additional records and then, if
+// that isn't enough, the authority section and the answer RRsets that don't fit,
+// with TC set
+func (c *config) fitReply(m *dns.Msg, limit int) {
+	if m.IsTsig() != nil {
+		limit -= tsigReserve // the MAC is added as the reply is packed
+	}
+	if m.Len() <= limit {
+		return
+	}
+	kept := []dns.RR{}
+	for _, rr := range m.Extra {
+		if t := rr.Header().Rrtype; t == dns.TypeOPT || t == dns.TypeTSIG {
+			kept = append(kept, rr)
+		}
+	}
+	m.Extra = kept
+	if m.Len() <= limit {
+		c.stats.Incr("edns.trimmed", 1)
+		return
+	}
+	answer := m.Answer
+	m.Answer, m.Ns = []dns.RR{}, nil
+	m.Truncated = true
+	for len(answer) > 0 { // whole RRsets only, a partial one would look complete
+		n := 1
+		for n < len(answer) && sameRRset(answer[n], answer[0]) {
+			n++
+		}
+		m.Answer = append(m.Answer, answer[:n]...)
+		if m.Len() > limit {
+			m.Answer = m.Answer[:len(m.Answer)-n]
+			break
+		}
+		answer = answer[n:]
+	}
+	c.stats.Incr("query.truncated", 1)
+}
+
+// sameRRset reports whether a and b belong to the same RRset
+func sameRRset(a, b dns.RR) bool {
+	return a.Header().Rrtype == b.Header().Rrtype && strings.EqualFold(a.Header().Name, b.Header().Name)
+}
+
+// badVersion answers BADVERS to a query with an EDNS version we don't speak,
+// reporting whether it did
+func (c *config) badVersion(w dns.ResponseWriter, req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	if c.udpSize == 0 || opt == nil || opt.Version() == ednsVersion {
+		return false
+	}
+	c.stats.Incr("edns.badvers", 1)
+	m := new(dns.Msg)
+	m.SetReply(req)
+	c.setOPT(m, opt.Do())
+	b, err := m.Pack()
+	if err != nil {
+		c.stats.Incr("query.error", 1)
+		return true
+	}
+	// the upper 8 bits of the 12 bit rcode are in the OPT record's TTL, which the
+	// dns package doesn't set the same way in every version
+	b[len(b)-optSize+5] = rcodeBadVersion >> 4
+	b[3] = b[3]&0xf0 | rcodeBadVersion&0x0f
+	w.Write(b)
+	return true
+}
+
+// appendOPT adds our OPT record to b, a packed reply without one, for a query with
+// EDNS
+func (c *config) appendOPT(b []byte) []byte {
+	binary.BigEndian.PutUint16(b[10:], binary.BigEndian.Uint16(b[10:])+1) // ARCOUNT
+	return append(b, 0, byte(dns.TypeOPT>>8), byte(dns.TypeOPT), byte(c.udpSize>>8), byte(c.udpSize), 0, 0, 0, 0, 0, 0)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"testing"
+)
+
+func TestEDNS(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, udpSize: 1232}
+	zone := abcZone + "alias	IN	CNAME	big.abc.com.\n"
+	for i := 0; i < 15; i++ {
+		zone += fmt.Sprintf("big	IN	TXT	\"record number %d of a set too big for 512 bytes\"\n", i)
+	}
+	if err := c.loadZones(map[string]string{"abc.com": zone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	query := func(name string, size uint16) *testWriter {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeTXT)
+		if size > 0 {
+			req.SetEdns0(size, false)
+		}
+		w := &testWriter{}
+		dns.DefaultServeMux.ServeDNS(w, req)
+		return w
+	}
+
+	m := query("abc.com.", 4096).msg
+	if opt := m.IsEdns0(); opt == nil || opt.UDPSize() != 1232 || opt.Do() {
+		t.Errorf("Expected our OPT record in the reply, got %v", m.Extra)
+	}
+	if m := query("abc.com.", 0).msg; m.IsEdns0() != nil {
+		t.Errorf("Expected no OPT record without EDNS, got %v", m.Extra)
+	}
+	if m := query("big.abc.com.", 0).msg; !m.Truncated || len(m.Answer) != 0 {
+		t.Errorf("Expected a truncated reply over 512 bytes, got %d answers", len(m.Answer))
+	}
+	if m := query("alias.abc.com.", 0).msg; !m.Truncated || len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != dns.TypeCNAME || m.Len() > 512 {
+		t.Errorf("Expected the CNAME kept whole and the TXT set cut, got %v", m.Answer)
+	}
+	if m := query("big.abc.com.", 4096).msg; m.Truncated || len(m.Answer) != 15 || m.Len() > 1232 {
+		t.Errorf("Expected the whole set within --udp-size, got %d answers in %d bytes", len(m.Answer), m.Len())
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("abc.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	req.IsEdns0().SetVersion(1)
+	w := &testWriter{}
+	dns.DefaultServeMux.ServeDNS(w, req)
+	if len(w.raw) < 12+optSize || w.raw[3]&0x0f != 0 || w.raw[len(w.raw)-optSize+5] != 1 {
+		t.Errorf("Expected BADVERS for EDNS version 1, got %v", w.raw)
+	}
+}
@@ -0,0 +1,317 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// txtLookup returns the TXT records at a name, each record's strings joined
+type txtLookup func(name string) ([]string, error)
+
+// spfLookupLimit is the RFC 7208 limit on DNS lookups while evaluating SPF
+const spfLookupLimit = 10
+
+// checkEmailAuth lints the SPF, DMARC and DKIM records in a zone. SPF includes are
+// followed through lookup to count DNS lookups against the limit of 10.
+func checkEmailAuth(name string, rrs []dns.RR, lookup txtLookup) []zoneProblem {
+	problems := []zoneProblem{}
+	txts := map[string][]string{}
+	owners := []string{}
+	for _, rr := range rrs {
+		switch r := rr.(type) {
+		case *dns.TXT:
+			owner := strings.ToLower(r.Hdr.Name)
+			if _, ok := txts[owner]; !ok {
+				owners = append(owners, owner)
+			}
+			txts[owner] = append(txts[owner], strings.Join(r.Txt, ""))
+		case *dns.SPF:
+			problems = append(problems, zoneProblem{"warning", strings.ToLower(r.Hdr.Name), "SPF record type is obsolete (RFC 7208), publish SPF as TXT"})
+		}
+	}
+	inZone := func(n string) ([]string, error) { // prefer our own records
+		if t, ok := txts[strings.ToLower(dns.Fqdn(n))]; ok {
+			return t, nil
+		}
+		return lookup(n)
+	}
+	for _, owner := range owners {
+		spf, dmarc := 0, 0
+		for _, t := range txts[owner] {
+			lower := strings.ToLower(t)
+			switch {
+			case lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 "):
+				spf++
+				problems = append(problems, checkSPF(owner, t, inZone)...)
+			case strings.HasPrefix(owner, "_dmarc."):
+				dmarc++
+				problems = append(problems, checkDMARC(owner, t)...)
+			case strings.Contains(owner, "._domainkey."):
+				problems = append(problems, checkDKIM(owner, t)...)
+			}
+		}
+		if spf > 1 {
+			problems = append(problems, zoneProblem{"error", owner, fmt.Sprintf("%d SPF records, receivers treat this as a permanent error", spf)})
+		}
+		if dmarc > 1 {
+			problems = append(problems, zoneProblem{"error", owner, fmt.Sprintf("%d DMARC records, receivers ignore all of them", dmarc)})
+		}
+	}
+	return problems
+}
+
+// checkSPF validates SPF syntax and counts DNS lookups through includes and redirects
+func checkSPF(owner, record string, lookup txtLookup) []zoneProblem {
+	problems := []zoneProblem{}
+	add := func(severity, msg string) {
+		problems = append(problems, zoneProblem{severity, owner, msg})
+	}
+	terms := strings.Fields(record)[1:]
+	hasAll, hasRedirect := false, false
+	for i, term := range terms {
+		mech := strings.ToLower(strings.TrimLeft(term, "+-~?"))
+		switch {
+		case mech == "all":
+			hasAll = true
+			if strings.HasPrefix(term, "+") || term == "all" {
+				add("error", "SPF "+term+" allows any server to send mail for the domain")
+			}
+			if i != len(terms)-1 {
+				add("warning", "SPF terms after "+term+" are ignored")
+			}
+		case mech == "ptr" || strings.HasPrefix(mech, "ptr:"):
+			add("warning", "SPF ptr mechanism is deprecated (RFC 7208) and slow")
+		case strings.HasPrefix(mech, "ip4:"), strings.HasPrefix(mech, "ip6:"):
+			addr := mech[4:]
+			if !strings.Contains(addr, "/") {
+				if net.ParseIP(addr) == nil {
+					add("error", "SPF "+term+" is not a valid address")
+				}
+			} else if _, _, err := net.ParseCIDR(addr); err != nil {
+				add("error", "SPF "+term+" is not a valid network")
+			}
+		case strings.HasPrefix(mech, "redirect="):
+			hasRedirect = true
+		case mech == "a", mech == "mx", strings.HasPrefix(mech, "a:"), strings.HasPrefix(mech, "a/"),
+			strings.HasPrefix(mech, "mx:"), strings.HasPrefix(mech, "mx/"),
+			strings.HasPrefix(mech, "include:"), strings.HasPrefix(mech, "exists:"), strings.HasPrefix(mech, "exp="):
+		default:
+			add("error", "unknown SPF term "+term)
+		}
+	}
+	if !hasAll && !hasRedirect {
+		add("warning", "SPF record has no all mechanism, so unlisted senders get a neutral result")
+	}
+	count, notes := spfLookups(record, lookup, map[string]bool{}, 0)
+	if count > spfLookupLimit {
+		add("error", fmt.Sprintf("SPF needs %d DNS lookups, more than the limit of %d, so receivers fail it", count, spfLookupLimit))
+	}
+	for _, n := range notes {
+		add("warning", n)
+	}
+	return problems
+}
+
+// spfLookups counts the DNS lookups an SPF record causes, following includes and
+// redirects. Names that can't be looked up are noted, as the count may be low.
+func spfLookups(record string, lookup txtLookup, seen map[string]bool, depth int) (int, []string) {
+	count := 0
+	notes := []string{}
+	for _, term := range strings.Fields(record)[1:] {
+		mech := strings.ToLower(strings.TrimLeft(term, "+-~?"))
+		var target string
+		switch {
+		case strings.HasPrefix(mech, "include:"):
+			target = mech[len("include:"):]
+		case strings.HasPrefix(mech, "redirect="):
+			target = mech[len("redirect="):]
+		case mech == "a", mech == "mx", mech == "ptr", strings.HasPrefix(mech, "a:"), strings.HasPrefix(mech, "a/"),
+			strings.HasPrefix(mech, "mx:"), strings.HasPrefix(mech, "mx/"), strings.HasPrefix(mech, "ptr:"), strings.HasPrefix(mech, "exists:"):
+			count++
+			continue
+		default:
+			continue
+		}
+		count++
+		if seen[target] || depth > spfLookupLimit || strings.Contains(target, "%{") {
+			continue // loops are reported by the count, macros can't be expanded here
+		}
+		seen[target] = true
+		txts, err := lookup(target)
+		if err != nil {
+			notes = append(notes, fmt.Sprintf("could not look up SPF include %s (%s), the lookup count may be low", target, err.Error()))
+			continue
+		}
+		for _, t := range txts {
+			if strings.HasPrefix(strings.ToLower(t), "v=spf1") {
+				n, more := spfLookups(t, lookup, seen, depth+1)
+				count += n
+				notes = append(notes, more...)
+			}
+		}
+	}
+	return count, notes
+}
+
+var dmarcTags = map[string]func(string) bool{
+	"p":     func(v string) bool { return v == "none" || v == "quarantine" || v == "reject" },
+	"sp":    func(v string) bool { return v == "none" || v == "quarantine" || v == "reject" },
+	"adkim": func(v string) bool { return v == "r" || v == "s" },
+	"aspf":  func(v string) bool { return v == "r" || v == "s" },
+	"pct": func(v string) bool {
+		n, err := strconv.Atoi(v)
+		return err == nil && n >= 0 && n <= 100
+	},
+	"ri": func(v string) bool {
+		_, err := strconv.ParseUint(v, 10, 32)
+		return err == nil
+	},
+	"fo": func(v string) bool {
+		for _, f := range strings.Split(v, ":") {
+			if f != "0" && f != "1" && f != "d" && f != "s" {
+				return false
+			}
+		}
+		return true
+	},
+	"rf":  func(v string) bool { return v == "afrf" },
+	"rua": validDMARCURIs,
+	"ruf": validDMARCURIs,
+}
+
+func validDMARCURIs(v string) bool {
+	for _, uri := range strings.Split(v, ",") {
+		if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(uri)), "mailto:") || !strings.Contains(uri, "@") {
+			return false
+		}
+	}
+	return true
+}
+
+// checkDMARC validates DMARC tags (RFC 7489)
+func checkDMARC(owner, record string) []zoneProblem {
+	problems := []zoneProblem{}
+	add := func(severity, msg string) {
+		problems = append(problems, zoneProblem{severity, owner, msg})
+	}
+	tags, order, ok := parseTags(record)
+	if !ok {
+		return append(problems, zoneProblem{"error", owner, "malformed DMARC record, tags must be tag=value separated by ;"})
+	}
+	if order[0] != "v" || tags["v"] != "DMARC1" {
+		add("error", "DMARC record must start with v=DMARC1")
+	}
+	if len(order) < 2 || order[1] != "p" {
+		add("error", "DMARC p tag must come right after v=DMARC1")
+	}
+	for _, t := range order[1:] {
+		valid, known := dmarcTags[t]
+		switch {
+		case !known:
+			add("warning", "unknown DMARC tag "+t)
+		case !valid(tags[t]):
+			add("error", fmt.Sprintf("invalid DMARC %s=%s", t, tags[t]))
+		}
+	}
+	return problems
+}
+
+// checkDKIM validates a DKIM key record (RFC 6376), including the key length
+func checkDKIM(owner, record string) []zoneProblem {
+	tags, order, ok := parseTags(record)
+	if !ok {
+		return []zoneProblem{{"error", owner, "malformed DKIM record, tags must be tag=value separated by ;"}}
+	}
+	if _, ok := tags["v"]; ok && (order[0] != "v" || tags["v"] != "DKIM1") {
+		return []zoneProblem{{"error", owner, "DKIM v tag must be first and DKIM1"}}
+	}
+	p, ok := tags["p"]
+	if !ok {
+		return []zoneProblem{{"error", owner, "DKIM record has no p (public key) tag"}}
+	}
+	if len(p) == 0 {
+		return []zoneProblem{{"warning", owner, "DKIM key is revoked (empty p tag)"}}
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.Replace(p, " ", "", -1))
+	if err != nil {
+		return []zoneProblem{{"error", owner, "DKIM public key is not valid base64"}}
+	}
+	switch k := tags["k"]; k {
+	case "", "rsa":
+		pub, err := x509.ParsePKIXPublicKey(key)
+		if err != nil {
+			if rsaPub, perr := x509.ParsePKCS1PublicKey(key); perr == nil {
+				pub = rsaPub
+			} else {
+				return []zoneProblem{{"error", owner, "DKIM public key is not a valid RSA key"}}
+			}
+		}
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return []zoneProblem{{"error", owner, "DKIM public key is not an RSA key"}}
+		}
+		switch bits := rsaPub.N.BitLen(); {
+		case bits < 1024:
+			return []zoneProblem{{"error", owner, fmt.Sprintf("DKIM key is %d bits, receivers reject keys under 1024 bits", bits)}}
+		case bits < 2048:
+			return []zoneProblem{{"warning", owner, fmt.Sprintf("DKIM key is %d bits, 2048 is recommended", bits)}}
+		}
+	case "ed25519":
+		if len(key) != 32 {
+			return []zoneProblem{{"error", owner, "DKIM ed25519 key must be 32 bytes"}}
+		}
+	default:
+		return []zoneProblem{{"error", owner, "unknown DKIM key type " + k}}
+	}
+	return nil
+}
+
+// parseTags splits a tag=value; list as used by DKIM and DMARC
+func parseTags(record string) (map[string]string, []string, bool) {
+	tags := map[string]string{}
+	order := []string{}
+	for _, f := range strings.Split(record, ";") {
+		f = strings.TrimSpace(f)
+		if len(f) == 0 {
+			continue
+		}
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return nil, nil, false
+		}
+		k := strings.ToLower(strings.TrimSpace(kv[0]))
+		tags[k] = strings.TrimSpace(kv[1])
+		order = append(order, k)
+	}
+	return tags, order, len(order) > 0
+}
+
+// resolverLookup looks up TXT records through the configured resolver
+func (c *config) resolverLookup(name string) ([]string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+	m.RecursionDesired = true
+	d := &dns.Client{DialTimeout: 2 * time.Second, ReadTimeout: 2 * time.Second}
+	r, _, err := d.Exchange(m, c.resolver)
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("%s", dns.RcodeToString[r.Rcode])
+	}
+	txts := []string{}
+	for _, rr := range r.Answer {
+		if t, ok := rr.(*dns.TXT); ok {
+			txts = append(txts, strings.Join(t.Txt, ""))
+		}
+	}
+	return txts, nil
+}
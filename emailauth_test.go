@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// dkimKey returns a base64 public key of the given size; only its length matters
+func dkimKey(t *testing.T, bits int) string {
+	n := new(big.Int).Lsh(big.NewInt(1), uint(bits-1))
+	der, err := x509.MarshalPKIXPublicKey(&rsa.PublicKey{N: n.Add(n, big.NewInt(1)), E: 65537})
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey failed: %s", err.Error())
+	}
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+func TestCheckEmailAuth(t *testing.T) {
+	good := fmt.Sprintf(`$ORIGIN mail.com.
+@ 300 IN SOA ns admin 1 10800 1200 864000 300
+@ 300 IN NS ns.other.net.
+@ 300 IN TXT "v=spf1 ip4:10.0.0.0/24 include:_spf.mail.com include:_spf.google.com -all"
+_spf 300 IN TXT "v=spf1 a mx -all"
+_dmarc 300 IN TXT "v=DMARC1; p=quarantine; pct=50; rua=mailto:dmarc@mail.com; fo=1:d"
+s1._domainkey 300 IN TXT "v=DKIM1; k=rsa; p=%s"
+old._domainkey 300 IN TXT "v=DKIM1; p="
+`, txtData(dkimKey(t, 2048)))
+	rrs, err := parseZoneFile("mail.com", good)
+	if err != nil {
+		t.Fatalf("parseZoneFile failed: %s", err.Error())
+	}
+	lookups := []string{}
+	lookup := func(name string) ([]string, error) {
+		lookups = append(lookups, name)
+		return []string{"v=spf1 include:_netblocks.google.com ~all"}, nil
+	}
+	msgs := checkMessages(checkEmailAuth("mail.com", rrs, lookup))
+	if msgs != "warning: old._domainkey.mail.com.: DKIM key is revoked (empty p tag)" {
+		t.Errorf("Expected only the revoked key warning, got:\n%s", msgs)
+	}
+	if strings.Join(lookups, " ") != "_spf.google.com _netblocks.google.com" {
+		t.Errorf("Expected external includes looked up and in-zone ones not, got %v", lookups)
+	}
+
+	bad := fmt.Sprintf(`$ORIGIN bad.com.
+@ 300 IN TXT "v=spf1 include:a.bad.com +all"
+@ 300 IN TXT "v=spf1 ip4:10.0.0.300 bogus:x -all"
+a 300 IN TXT "v=spf1 a mx include:b.bad.com include:missing.example"
+b 300 IN TXT "v=spf1 a mx ptr exists:x.bad.com a:c.bad.com mx:d.bad.com ~all"
+_dmarc 300 IN TXT "p=reject; v=DMARC1; pct=150; rua=dmarc@bad.com; color=blue"
+weak._domainkey 300 IN TXT "v=DKIM1; p=%s"
+small._domainkey 300 IN TXT "v=DKIM1; p=%s"
+junk._domainkey 300 IN TXT "v=DKIM1; p=!!!"
+`, dkimKey(t, 1024), dkimKey(t, 512))
+	rrs, err = parseZoneFile("bad.com", bad)
+	if err != nil {
+		t.Fatalf("parseZoneFile failed: %s", err.Error())
+	}
+	lookup = func(name string) ([]string, error) { return nil, fmt.Errorf("SERVFAIL") }
+	msgs = checkMessages(checkEmailAuth("bad.com", rrs, lookup))
+	for _, want := range []string{
+		"error: bad.com.: 2 SPF records",
+		"error: bad.com.: SPF +all allows any server",
+		"error: bad.com.: SPF ip4:10.0.0.300 is not a valid address",
+		"error: bad.com.: unknown SPF term bogus:x",
+		"error: bad.com.: SPF needs 11 DNS lookups",
+		"warning: bad.com.: could not look up SPF include missing.example (SERVFAIL)",
+		"warning: b.bad.com.: SPF ptr mechanism is deprecated",
+		"warning: a.bad.com.: SPF record has no all mechanism",
+		"error: _dmarc.bad.com.: DMARC record must start with v=DMARC1",
+		"error: _dmarc.bad.com.: invalid DMARC pct=150",
+		"error: _dmarc.bad.com.: invalid DMARC rua=dmarc@bad.com",
+		"warning: _dmarc.bad.com.: unknown DMARC tag color",
+		"warning: weak._domainkey.bad.com.: DKIM key is 1024 bits, 2048 is recommended",
+		"error: small._domainkey.bad.com.: DKIM key is 512 bits",
+		"error: junk._domainkey.bad.com.: DKIM public key is not valid base64",
+	} {
+		if !strings.Contains(msgs, want) {
+			t.Errorf("Expected %q in problems:\n%s", want, msgs)
+		}
+	}
+}
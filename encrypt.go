@@ -0,0 +1,167 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Zones can be stored encrypted, for compliance regimes that forbid plaintext zone
+// data in shared object storage. An encrypted zone object is an envelope of three
+// lines: a header, the zone's AES-256-GCM data key encrypted under a KMS key, and
+// the nonce followed by the sealed zone file, both base64 encoded:
+//
+//	neddns-encrypted-zone v1
+//	<KMS ciphertext blob of the data key>
+//	<12 byte nonce and the sealed zone file>
+//
+// neddns recognizes the header as it fetches zones and decrypts them in memory,
+// unwrapping the data key with KMS Decrypt using the -K/-S credentials in --region,
+// so the zone file is never written anywhere in plaintext. The data key and the
+// sealed file are bound to the zone's name, so an envelope copied to another zone's
+// object doesn't load. Unwrapped data keys are cached by their ciphertext, so an
+// unchanged key costs one KMS call per process. neddns encrypt-zone writes the
+// envelope for a zone file, and other tools can produce the same format.
+const (
+	encryptedZoneHeader = "neddns-encrypted-zone v1"
+	dataKeySize         = 32
+)
+
+// dataKeyCache holds unwrapped data keys by their KMS ciphertext; a nil cache
+// caches nothing
+type dataKeyCache struct {
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+func (d *dataKeyCache) get(wrapped []byte) ([]byte, bool) {
+	if d == nil {
+		return nil, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key, ok := d.keys[string(wrapped)]
+	return key, ok
+}
+
+func (d *dataKeyCache) put(wrapped, key []byte) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.keys == nil {
+		d.keys = map[string][]byte{}
+	}
+	d.keys[string(wrapped)] = key
+}
+
+// isEncryptedZone reports whether a zone object is an encrypted envelope
+func isEncryptedZone(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(encryptedZoneHeader+"\n"))
+}
+
+// decryptZone opens the encrypted envelope of zone n
+func (c *config) decryptZone(n string, b []byte) (string, error) {
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 3 {
+		return "", fmt.Errorf("Error decrypting zone %s: envelope has %d lines, not 3", n, len(lines))
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil {
+		return "", fmt.Errorf("Error decrypting zone %s: bad data key: %s", n, err.Error())
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[2]))
+	if err != nil {
+		return "", fmt.Errorf("Error decrypting zone %s: bad contents: %s", n, err.Error())
+	}
+	key, ok := c.dataKeys.get(wrapped)
+	if !ok {
+		var resp struct{ Plaintext []byte }
+		in := map[string]interface{}{"CiphertextBlob": wrapped, "EncryptionContext": map[string]string{"zone": n}}
+		if err := c.callAWS("kms", "TrentService.Decrypt", in, &resp); err != nil {
+			c.stats.Incr("zones.decrypt.error", 1)
+			return "", fmt.Errorf("Error decrypting zone %s: %s", n, err.Error())
+		}
+		key = resp.Plaintext
+		c.dataKeys.put(wrapped, key)
+	}
+	gcm, err := zoneCipher(key)
+	if err != nil {
+		return "", fmt.Errorf("Error decrypting zone %s: %s", n, err.Error())
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("Error decrypting zone %s: contents too short", n)
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(n))
+	if err != nil {
+		c.stats.Incr("zones.decrypt.error", 1)
+		return "", fmt.Errorf("Error decrypting zone %s: %s", n, err.Error())
+	}
+	c.stats.Incr("zones.decrypted", 1)
+	return string(plain), nil
+}
+
+// encryptZone seals contents, the file of zone n, under a new data key from kmsKey
+func (c *config) encryptZone(n, contents, kmsKey string) (string, error) {
+	var resp struct{ CiphertextBlob, Plaintext []byte }
+	in := map[string]interface{}{"KeyId": kmsKey, "KeySpec": "AES_256", "EncryptionContext": map[string]string{"zone": n}}
+	if err := c.callAWS("kms", "TrentService.GenerateDataKey", in, &resp); err != nil {
+		return "", fmt.Errorf("Error creating a data key for zone %s: %s", n, err.Error())
+	}
+	gcm, err := zoneCipher(resp.Plaintext)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(contents), []byte(n))
+	return encryptedZoneHeader + "\n" + base64.StdEncoding.EncodeToString(resp.CiphertextBlob) + "\n" + base64.StdEncoding.EncodeToString(sealed) + "\n", nil
+}
+
+// encryptZoneFiles writes the encrypted envelope of each zone file beside it, as
+// <file>.enc, to upload in its place. Zones are named after their file name, just
+// like bucket keys.
+func (c *config) encryptZoneFiles(files []string, kmsKey string) error {
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(file)
+		if _, err := parseZoneFile(name, string(b)); err != nil {
+			return err
+		}
+		envelope, err := c.encryptZone(name, string(b), kmsKey)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(file+".enc", []byte(envelope), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("%s: encrypted zone %s to %s.enc\n", file, name, file)
+	}
+	return nil
+}
+
+func zoneCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("data key is %d bytes, not %d", len(key), dataKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/quipo/statsd"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncryptedZone(t *testing.T) {
+	dataKey := bytes.Repeat([]byte{7}, dataKeySize)
+	decrypts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			KeyId             string
+			CiphertextBlob    []byte
+			EncryptionContext map[string]string
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.GenerateDataKey":
+			if in.KeyId == "alias/zones" {
+				json.NewEncoder(w).Encode(map[string][]byte{"CiphertextBlob": []byte("wrapped:" + in.EncryptionContext["zone"]), "Plaintext": dataKey})
+				return
+			}
+		case "TrentService.Decrypt":
+			decrypts++
+			if string(in.CiphertextBlob) == "wrapped:"+in.EncryptionContext["zone"] {
+				json.NewEncoder(w).Encode(map[string][]byte{"Plaintext": dataKey})
+				return
+			}
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type": "InvalidCiphertextException"}`))
+	}))
+	defer srv.Close()
+	c := config{stats: statsd.NoopClient{}, region: "us-east-1", awsKeyId: "AKID", awsSecret: "secret", awsEndpoint: srv.URL, dataKeys: &dataKeyCache{}}
+
+	envelope, err := c.encryptZone("abc.com", abcZone, "alias/zones")
+	if err != nil {
+		t.Fatalf("encryptZone failed: %s", err.Error())
+	}
+	if !isEncryptedZone([]byte(envelope)) || strings.Contains(envelope, "nsa.abc.com") {
+		t.Fatalf("Expected an envelope without the plaintext, got %s", envelope)
+	}
+	getter := testGetter{testZones: map[string]testZone{
+		"abc.com": testZone{LastModified: time.Now(), Contents: envelope},
+		"def.com": testZone{LastModified: time.Now(), Contents: defZone},
+	}}
+	zones, err := c.getZones(getter)
+	if err != nil || zones["abc.com"] != abcZone || zones["def.com"] != defZone {
+		t.Fatalf("Expected the encrypted zone decrypted beside the plaintext one, got %v %v", zones, err)
+	}
+	if _, err := c.decryptZone("abc.com", []byte(envelope)); err != nil || decrypts != 1 {
+		t.Errorf("Expected the data key cached, got %d KMS calls %v", decrypts, err)
+	}
+
+	if _, err := c.decryptZone("def.com", []byte(envelope)); err == nil {
+		t.Errorf("Expected an envelope copied to another zone to fail")
+	}
+	lines := strings.Split(envelope, "\n")
+	lines[2] = "AAAA" + lines[2][4:]
+	if _, err := c.decryptZone("abc.com", []byte(strings.Join(lines, "\n"))); err == nil {
+		t.Errorf("Expected a tampered envelope to fail")
+	}
+}
@@ -0,0 +1,46 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+)
+
+// With --flatten-dnssec, root CNAME targets are looked up with the DO and AD bits set,
+// and a signed answer is only flattened if the resolver validated it (set AD), so a
+// spoofed or bogus answer for a signed target zone is never served as our own apex
+// address. Answers from unsigned zones, which carry no RRSIGs, are still flattened.
+// The resolver must be a validating one; a resolver that strips RRSIGs makes every
+// target look unsigned, and one that doesn't validate makes every signed target fail.
+const flattenEDNSSize = 4096
+
+// flattenQuery builds the resolver query for a flattening target
+func (c *config) flattenQuery(target string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(target, dns.TypeA)
+	m.RecursionDesired = true
+	if c.flattenDNSSEC {
+		m.SetEdns0(flattenEDNSSize, true)
+		m.AuthenticatedData = true
+	}
+	return m
+}
+
+// checkFlattenDNSSEC returns an error if r is signed but wasn't validated.
+func (c *config) checkFlattenDNSSEC(target string, r *dns.Msg) error {
+	if !c.flattenDNSSEC {
+		return nil
+	}
+	if r.AuthenticatedData {
+		c.stats.Incr("flatten.dnssec.secure", 1)
+		return nil
+	}
+	for _, rr := range r.Answer {
+		if _, ok := rr.(*dns.RRSIG); ok {
+			c.stats.Incr("flatten.dnssec.refused", 1)
+			return &edeError{edeDNSSECBogus, fmt.Sprintf("Error flattening %s: signed answer was not validated by the resolver", target)}
+		}
+	}
+	c.stats.Incr("flatten.dnssec.insecure", 1)
+	return nil
+}
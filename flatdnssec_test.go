@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"net"
+	"testing"
+)
+
+func TestFlattenDNSSEC(t *testing.T) {
+	started := make(chan bool)
+	resolver := &dns.Server{Addr: "127.0.0.1:25356", Net: "udp", NotifyStartedFunc: func() { started <- true }}
+	resolver.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if len(req.Question) != 1 {
+			return
+		}
+		name := req.Question[0].Name
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("10.8.8.8")})
+		if name != "unsigned.example." && req.IsEdns0() != nil && req.IsEdns0().Do() {
+			m.Answer = append(m.Answer, &dns.RRSIG{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 60},
+				TypeCovered: dns.TypeA, Algorithm: dns.RSASHA256, SignerName: "example.", Signature: "AAAA"})
+			m.AuthenticatedData = name == "valid.example."
+		}
+		w.WriteMsg(m)
+	})
+	go resolver.ListenAndServe()
+	<-started
+	defer resolver.Shutdown()
+
+	for _, tc := range []struct {
+		target string
+		dnssec bool
+		want   int
+	}{
+		{"valid.example.", true, 1},
+		{"unsigned.example.", true, 1},
+		{"bogus.example.", true, 0},
+		{"bogus.example.", false, 1},
+	} {
+		c := config{stats: statsd.NoopClient{}, resolver: "127.0.0.1:25356", flattenDNSSEC: tc.dnssec}
+		cname := &dns.CNAME{Hdr: dns.RR_Header{Name: "abc.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: tc.target}
+		flat, err := c.flattenCNAME(cname)
+		if len(flat) != tc.want {
+			t.Errorf("Flattening %s with --flatten-dnssec=%v: expected %d answers, got %v %v", tc.target, tc.dnssec, tc.want, flat, err)
+		}
+		if tc.want == 0 && err == nil {
+			t.Errorf("Expected an error flattening %s", tc.target)
+		}
+	}
+
+	c := config{stats: statsd.NoopClient{}, flattenDNSSEC: true}
+	if m := c.flattenQuery("abc.com."); m.IsEdns0() == nil || !m.IsEdns0().Do() || !m.AuthenticatedData {
+		t.Errorf("Expected DO and AD on flattening queries, got %v", m)
+	}
+}
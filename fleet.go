@@ -0,0 +1,274 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fleetTimeout = 2 * time.Second
+	fleetWorkers = 8 // queries in flight per server
+)
+
+// fleetZone is a zone that is missing from a server or served with a different
+// serial than the bucket's
+type fleetZone struct {
+	Zone    string
+	Server  string
+	Serial  uint32 // 0 when missing
+	Problem string
+}
+
+// fleetDivergence is a question the servers answer differently
+type fleetDivergence struct {
+	Zone    string
+	Name    string
+	Type    string
+	Answers map[string]string // by server
+}
+
+type byFleetZone []fleetZone
+
+func (p byFleetZone) Len() int      { return len(p) }
+func (p byFleetZone) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byFleetZone) Less(i, j int) bool {
+	if p[i].Zone != p[j].Zone {
+		return p[i].Zone < p[j].Zone
+	}
+	return p[i].Server < p[j].Server
+}
+
+// fleetServer adds the default port to a server address without one
+func fleetServer(s string) string {
+	if _, _, err := net.SplitHostPort(s); err == nil {
+		return s
+	}
+	return net.JoinHostPort(strings.Trim(s, "[]"), "53")
+}
+
+// fleetQuestions lists every RRset of z as a question, in name order. Signatures
+// are left out, as online signing makes them differ between servers.
+func fleetQuestions(z *zone) []dns.Question {
+	seen := map[hotKey]bool{}
+	qs := []dns.Question{}
+	for _, rr := range z.rrs {
+		h := rr.Header()
+		k := hotKey{strings.ToLower(h.Name), h.Rrtype}
+		if h.Rrtype == dns.TypeRRSIG || seen[k] {
+			continue
+		}
+		seen[k] = true
+		qs = append(qs, dns.Question{Name: k.name, Qtype: k.qtype, Qclass: dns.ClassINET})
+	}
+	sort.Sort(byDNSQuestion(qs))
+	return qs
+}
+
+type byDNSQuestion []dns.Question
+
+func (p byDNSQuestion) Len() int      { return len(p) }
+func (p byDNSQuestion) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byDNSQuestion) Less(i, j int) bool {
+	if p[i].Name != p[j].Name {
+		return p[i].Name < p[j].Name
+	}
+	return p[i].Qtype < p[j].Qtype
+}
+
+// fleetQuery asks server q, over TCP when the UDP reply is truncated
+func fleetQuery(server string, q dns.Question) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(q.Name, q.Qtype)
+	d := &dns.Client{DialTimeout: fleetTimeout, ReadTimeout: fleetTimeout}
+	r, _, err := d.Exchange(req, server)
+	if err == nil && r.Truncated {
+		d.Net = "tcp"
+		r, _, err = d.Exchange(req, server)
+	}
+	return r, err
+}
+
+// fleetAnswer describes a reply so replies can be compared. TTLs are left out, as
+// they count down in caches such as flattening's, and records are sorted, as
+// answers can be rotated.
+func fleetAnswer(r *dns.Msg, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return dns.RcodeToString[r.Rcode]
+	}
+	rrs := []string{}
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		rrs = append(rrs, strings.Replace(rr.String(), "\t", " ", -1))
+	}
+	if len(rrs) == 0 {
+		return "no records"
+	}
+	sort.Strings(rrs)
+	return strings.Join(rrs, "; ")
+}
+
+// fleetPool calls f for 0 to n-1, fleetWorkers at a time
+func fleetPool(n int, f func(i int)) {
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < fleetWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// fleetCheck asks every server for every RRset in the bucket's zones. It returns the
+// zones a server is missing or serves with another serial than the bucket's, and
+// the questions the servers that have the zone answer differently.
+func (c *config) fleetCheck(getter zoneGetter, servers []string) ([]fleetZone, []fleetDivergence, error) {
+	z, err := c.getZones(getter)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := c.loadZones(z); err != nil {
+		return nil, nil, err
+	}
+	names := []string{}
+	for n := range c.zones {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	qs := []dns.Question{}
+	zoneOf := []string{}
+	for _, n := range names {
+		for _, q := range fleetQuestions(c.zones[n]) {
+			qs = append(qs, q)
+			zoneOf = append(zoneOf, n)
+		}
+	}
+	problems := []fleetZone{}
+	missing := map[string]bool{} // zone + " " + server
+	var mu sync.Mutex
+	for _, s := range servers {
+		fleetPool(len(names), func(i int) {
+			n := names[i]
+			want := c.zones[n].serial()
+			soa, err := fleetSOA(s, n)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				missing[n+" "+s] = true
+				problems = append(problems, fleetZone{Zone: n, Server: s, Problem: "missing: " + err.Error()})
+			case soa.Serial < want:
+				problems = append(problems, fleetZone{Zone: n, Server: s, Serial: soa.Serial, Problem: fmt.Sprintf("behind the bucket's serial %d", want)})
+			case soa.Serial > want:
+				problems = append(problems, fleetZone{Zone: n, Server: s, Serial: soa.Serial, Problem: fmt.Sprintf("ahead of the bucket's serial %d", want)})
+			}
+		})
+	}
+	sort.Sort(byFleetZone(problems))
+
+	// questions are only sent for zones the server has, as missing zones may time out
+	answers := map[string][]string{}
+	for _, s := range servers {
+		asked := []dns.Question{}
+		for i, q := range qs {
+			if !missing[zoneOf[i]+" "+s] {
+				asked = append(asked, q)
+			}
+		}
+		c.debug(fmt.Sprintf("Asking %s %d questions", s, len(asked)))
+		replies := make([]string, len(asked))
+		fleetPool(len(asked), func(i int) { replies[i] = fleetAnswer(fleetQuery(s, asked[i])) })
+		for i := range qs {
+			if !missing[zoneOf[i]+" "+s] {
+				answers[s] = append(answers[s], replies[0])
+				replies = replies[1:]
+			} else {
+				answers[s] = append(answers[s], "")
+			}
+		}
+	}
+
+	diverged := []fleetDivergence{}
+	for i, q := range qs {
+		byServer := map[string]string{}
+		distinct := map[string]bool{}
+		for _, s := range servers {
+			if missing[zoneOf[i]+" "+s] {
+				continue
+			}
+			byServer[s] = answers[s][i]
+			distinct[answers[s][i]] = true
+		}
+		if len(distinct) > 1 {
+			diverged = append(diverged, fleetDivergence{Zone: zoneOf[i], Name: q.Name, Type: dns.Type(q.Qtype).String(), Answers: byServer})
+		}
+	}
+	return problems, diverged, nil
+}
+
+// fleetSOA asks server for the SOA of zone n, returning an error unless it answers
+// for the zone authoritatively
+func fleetSOA(server, n string) (*dns.SOA, error) {
+	r, err := fleetQuery(server, dns.Question{Name: dns.Fqdn(n), Qtype: dns.TypeSOA, Qclass: dns.ClassINET})
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("%s", dns.RcodeToString[r.Rcode])
+	}
+	if !r.Authoritative {
+		return nil, fmt.Errorf("not authoritative")
+	}
+	for _, rr := range r.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa, nil
+		}
+	}
+	return nil, fmt.Errorf("no SOA record")
+}
+
+// fleetCheckCommand implements the fleet-check command, printing what differs. It
+// returns the number of problems found.
+func (c *config) fleetCheckCommand(getter zoneGetter, servers []string) (int, error) {
+	problems, diverged, err := c.fleetCheck(getter, servers)
+	if err != nil {
+		return 0, err
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%-24s %-30s %10s  %s\n", "SERVER", "ZONE", "SERIAL", "PROBLEM")
+		for _, p := range problems {
+			fmt.Printf("%-24s %-30s %10d  %s\n", p.Server, p.Zone, p.Serial, p.Problem)
+		}
+	}
+	for _, d := range diverged {
+		fmt.Printf("%s %s\n", strings.TrimSuffix(d.Name, "."), d.Type)
+		for _, s := range servers {
+			if a, ok := d.Answers[s]; ok {
+				fmt.Printf("  %-24s %s\n", s, a)
+			}
+		}
+	}
+	fmt.Printf("%d zones on %d servers: %d missing or stale, %d answers differ\n", len(c.zones), len(servers), len(problems), len(diverged))
+	return len(problems) + len(diverged), nil
+}
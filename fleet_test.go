@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFleetServer serves zones like a neddns instance on addr until the test ends
+func testFleetServer(t *testing.T, addr string, zones map[string]string) *dns.Server {
+	c := &config{stats: statsd.NoopClient{}}
+	if err := c.loadZones(zones); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	mux := dns.NewServeMux()
+	for n, z := range c.zones {
+		z := z
+		mux.HandleFunc(dns.Fqdn(n), func(w dns.ResponseWriter, req *dns.Msg) { z.zoneHandler(c, w, req) })
+	}
+	started := make(chan bool)
+	server := &dns.Server{Addr: addr, Net: "udp", Handler: mux, NotifyStartedFunc: func() { started <- true }}
+	go server.ListenAndServe()
+	<-started
+	return server
+}
+
+func TestFleetCheck(t *testing.T) {
+	newABC := strings.Replace(strings.Replace(abcZone, "2014121700", "2014121701", 1), "127.0.0.1", "127.0.0.9", 1)
+	current := testFleetServer(t, "127.0.0.1:25358", map[string]string{"abc.com": newABC, "def.com": defZone})
+	defer current.Shutdown()
+	stale := testFleetServer(t, "127.0.0.1:25359", map[string]string{"abc.com": abcZone})
+	defer stale.Shutdown()
+
+	getter := testGetter{testZones: map[string]testZone{
+		"abc.com": {Contents: newABC, LastModified: time.Now()},
+		"def.com": {Contents: defZone, LastModified: time.Now()},
+	}}
+	c := config{stats: statsd.NoopClient{}}
+	servers := []string{fleetServer("127.0.0.1:25358"), fleetServer("127.0.0.1:25359")}
+	problems, diverged, err := c.fleetCheck(getter, servers)
+	if err != nil {
+		t.Fatalf("fleetCheck failed: %s", err.Error())
+	}
+	if len(problems) != 2 {
+		t.Fatalf("Expected abc.com behind and def.com missing on the stale server, got %+v", problems)
+	}
+	if p := problems[0]; p.Zone != "abc.com" || p.Server != "127.0.0.1:25359" || p.Serial != 2014121700 || !strings.Contains(p.Problem, "behind") {
+		t.Errorf("Expected abc.com behind, got %+v", p)
+	}
+	if p := problems[1]; p.Zone != "def.com" || p.Server != "127.0.0.1:25359" || !strings.Contains(p.Problem, "missing") {
+		t.Errorf("Expected def.com missing, got %+v", p)
+	}
+	found := map[string]bool{}
+	for _, d := range diverged {
+		found[d.Name+" "+d.Type] = true
+		if d.Zone == "def.com" {
+			t.Errorf("Expected answers of missing zones not to be compared, got %+v", d)
+		}
+	}
+	if !found["abc.com. A"] || !found["abc.com. SOA"] || found["abc.com. MX"] || found["abc.com. NS"] {
+		t.Errorf("Expected the A and SOA answers to differ, got %+v", diverged)
+	}
+
+	if s := fleetServer("10.0.0.1"); s != "10.0.0.1:53" {
+		t.Errorf("Expected the default port, got %s", s)
+	}
+	if s := fleetServer("::1"); s != "[::1]:53" {
+		t.Errorf("Expected the default port on an IPv6 address, got %s", s)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"testing"
+)
+
+// The fuzz targets run their seeds with go test; fuzz with e.g.
+//
+//	go test -run XXX -fuzz FuzzQuery -fuzztime 5m
+
+var fuzzZone = `$ORIGIN fuzz.com.
+@	300	IN	SOA	ns.fuzz.com. admin.fuzz.com. ( 1 10800 1200 864000 300 )
+@	300	IN	NS	ns.fuzz.com.
+@	300	IN	MX	10 mail.fuzz.com.
+@	300	IN	TXT	"v=spf1 -all"
+ns	300	IN	A	10.0.0.1
+www	300	IN	CNAME	fuzz.com.
+new	300	IN	TYPE65400	\# 2 0102
+`
+
+func FuzzQuery(f *testing.F) {
+	c := &config{stats: statsd.NoopClient{}}
+	if err := c.loadZones(map[string]string{"fuzz.com": fuzzZone}); err != nil {
+		f.Fatalf("loadZones failed: %s", err.Error())
+	}
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{{"fuzz.com.", dns.TypeSOA}, {"www.fuzz.com.", dns.TypeA}, {"fuzz.com.", dns.TypeANY}, {"new.fuzz.com.", 65400}} {
+		m := new(dns.Msg)
+		m.SetQuestion(q.name, q.qtype)
+		m.SetEdns0(4096, true)
+		b, _ := m.Pack()
+		f.Add(b)
+	}
+	// a question name that is a compression pointer to itself
+	f.Add([]byte{0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xc0, 12, 0, 1, 0, 1})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		req := new(dns.Msg)
+		if checkQuery(data) != nil {
+			return
+		}
+		if err := req.Unpack(data); err != nil {
+			return
+		}
+		w := &testWriter{}
+		dns.DefaultServeMux.ServeDNS(w, req)
+		if w.msg != nil {
+			if _, err := w.msg.Pack(); err != nil {
+				t.Errorf("Failed to pack answer %s: %s", w.msg, err.Error())
+			}
+		}
+		if len(req.Question) == 1 && len(req.Answer)+len(req.Ns)+len(req.Extra) == 0 && !req.Response {
+			if b, err := req.Pack(); err == nil && len(b) <= maxQuerySize {
+				if err := checkQuery(b); err != nil {
+					t.Errorf("checkQuery rejected a well formed query %s: %s", req, err.Error())
+				}
+			}
+		}
+	})
+}
+
+func FuzzParseZone(f *testing.F) {
+	for _, z := range []string{goodZone, badZone, genericZone, fuzzZone} {
+		f.Add(z)
+	}
+	noLookup := func(name string) ([]string, error) { return nil, fmt.Errorf("no lookups while fuzzing") }
+	f.Fuzz(func(t *testing.T, contents string) {
+		rrs, _, err := parseZone("fuzz.com", contents)
+		if err != nil {
+			return
+		}
+		checkZone("fuzz.com", rrs)
+		checkEmailAuth("fuzz.com", rrs, noLookup)
+		z := &zone{name: "fuzz.com", rrs: rrs}
+		for _, rr := range rrs {
+			z.answer(&config{stats: statsd.NoopClient{}}, dns.Question{Name: rr.Header().Name, Qtype: rr.Header().Rrtype, Qclass: dns.ClassINET})
+		}
+	})
+}
@@ -0,0 +1,227 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// zoneStore is a backend we can both read and write zones in
+type zoneStore interface {
+	zoneGetter
+	zonePutter
+}
+
+// zoneParams describes a zone to generate for onboarding a domain, from the
+// generate command or POST /zones on the admin API.
+type zoneParams struct {
+	Domain    string         `json:"domain"`
+	IPs       []string       `json:"ips"` // served for the apex, with www as a CNAME to it unless a preset sets www
+	MX        string         `json:"mx"`  // an mxPresets name, default none
+	NS        []string       `json:"ns"`  // defaults to --ns
+	TTL       uint32         `json:"ttl"`
+	Presets   []presetParams `json:"presets"`
+	Overwrite bool           `json:"overwrite"`
+}
+
+// mxPresets are the MX records for common mail providers, by name
+var mxPresets = map[string]func(domain string) []string{
+	"none": func(domain string) []string { return nil },
+	"google": func(domain string) []string {
+		return []string{"1 aspmx.l.google.com.", "5 alt1.aspmx.l.google.com.", "5 alt2.aspmx.l.google.com.",
+			"10 alt3.aspmx.l.google.com.", "10 alt4.aspmx.l.google.com."}
+	},
+	"microsoft": func(domain string) []string {
+		return []string{"0 " + strings.Replace(strings.TrimSuffix(domain, "."), ".", "-", -1) + ".mail.protection.outlook.com."}
+	},
+}
+
+type generatedZone struct {
+	Name     string `json:"name"`
+	Key      string `json:"key"`
+	Records  int    `json:"records"`
+	contents string
+}
+
+// generateZone renders a zone file for p, one absolute record per line.
+func generateZone(p zoneParams, defaultNS []string) (generatedZone, error) {
+	g := generatedZone{}
+	domain := dns.Fqdn(strings.ToLower(strings.TrimSpace(p.Domain)))
+	if _, ok := dns.IsDomainName(domain); !ok || strings.ContainsAny(domain, " \t") || dns.CountLabel(domain) < 2 {
+		return g, fmt.Errorf("invalid domain %q", p.Domain)
+	}
+	presets, spf, err := applyPresets(domain, p.Presets)
+	if err != nil {
+		return g, err
+	}
+	provides := map[string]bool{} // owner and type set by presets
+	for _, r := range presets {
+		provides[r[0]+" "+r[1]] = true
+	}
+	apexAddrs := provides[domain+" A"] || provides[domain+" AAAA"]
+	if len(p.IPs) < 1 && !apexAddrs {
+		return g, fmt.Errorf("%s: at least one IP address is required", domain)
+	}
+	if len(p.IPs) > 0 && apexAddrs {
+		return g, fmt.Errorf("%s: ips conflict with the apex addresses of a preset", domain)
+	}
+	ns := p.NS
+	if len(ns) == 0 {
+		ns = defaultNS
+	}
+	if len(ns) < 1 {
+		return g, fmt.Errorf("%s: no nameservers given and --ns is not set", domain)
+	}
+	preset := p.MX
+	if len(preset) == 0 {
+		preset = "none"
+	}
+	mx, ok := mxPresets[preset]
+	if !ok {
+		return g, fmt.Errorf("%s: unknown mx preset %q", domain, p.MX)
+	}
+	if preset != "none" && provides[domain+" MX"] {
+		return g, fmt.Errorf("%s: mx preset %s conflicts with the MX records of a preset", domain, preset)
+	}
+	ttl := p.TTL
+	if ttl == 0 {
+		ttl = 300
+	}
+
+	lines := []string{fmt.Sprintf("%s %d IN SOA %s hostmaster.%s %s01 10800 1200 864000 %d",
+		domain, ttl, dns.Fqdn(ns[0]), domain, time.Now().UTC().Format("20060102"), ttl)}
+	for _, n := range ns {
+		lines = append(lines, fmt.Sprintf("%s %d IN NS %s", domain, ttl, dns.Fqdn(n)))
+	}
+	for _, s := range p.IPs {
+		ip := net.ParseIP(s)
+		switch {
+		case ip == nil:
+			return g, fmt.Errorf("%s: invalid IP address %q", domain, s)
+		case ip.To4() != nil:
+			lines = append(lines, fmt.Sprintf("%s %d IN A %s", domain, ttl, ip))
+		default:
+			lines = append(lines, fmt.Sprintf("%s %d IN AAAA %s", domain, ttl, ip))
+		}
+	}
+	if len(p.IPs) > 0 && !provides["www."+domain+" CNAME"] {
+		lines = append(lines, fmt.Sprintf("www.%s %d IN CNAME %s", domain, ttl, domain))
+	}
+	for _, m := range mx(domain) {
+		lines = append(lines, fmt.Sprintf("%s %d IN MX %s", domain, ttl, m))
+	}
+	for _, r := range presets {
+		lines = append(lines, fmt.Sprintf("%s %d IN %s %s", r[0], ttl, r[1], r[2]))
+	}
+	if len(spf) > 0 {
+		lines = append(lines, fmt.Sprintf("%s %d IN TXT %s", domain, ttl, txtData("v=spf1 "+strings.Join(spf, " ")+" ~all")))
+	}
+
+	name := strings.TrimSuffix(domain, ".")
+	rrs, err := parseZoneFile(name, strings.Join(lines, "\n")+"\n")
+	if err != nil {
+		return g, err
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "; zone %s generated by neddns\n", name)
+	for _, rr := range rrs {
+		b.WriteString(rr.String() + "\n")
+	}
+	return generatedZone{Name: name, Records: len(rrs), contents: b.String()}, nil
+}
+
+// errZoneExists is returned by storeZones when a zone would be overwritten
+type errZoneExists struct {
+	name string
+}
+
+func (e errZoneExists) Error() string {
+	return fmt.Sprintf("zone %s already exists, set overwrite to replace it", e.name)
+}
+
+// generateZones builds zones for every params entry, failing before anything is
+// written if any of them is invalid or fails the zone checks, with the index of
+// each one that does.
+func (c *config) generateZones(params []zoneParams) ([]generatedZone, error) {
+	zones := []generatedZone{}
+	invalid := validationError{}
+	for i, p := range params {
+		g, err := generateZone(p, c.nameservers)
+		if err != nil {
+			invalid.errors = append(invalid.errors, fieldError{Index: fieldIndex(i), Reason: err.Error()})
+			continue
+		}
+		for _, problem := range validateZone(g.Name, g.contents, nil) {
+			invalid.errors = append(invalid.errors, fieldError{Index: fieldIndex(i), Name: problem.name, Reason: problem.msg})
+		}
+		g.Key = c.prefix + g.Name
+		zones = append(zones, g)
+	}
+	if len(invalid.errors) > 0 {
+		return nil, invalid
+	}
+	return zones, nil
+}
+
+// storeZones uploads generated zones, refusing to replace existing objects unless
+// asked to. With load set the zones are served immediately rather than on the next
+// update.
+func (c *config) storeZones(store zoneStore, params []zoneParams, zones []generatedZone, load bool) error {
+	if c.reloads != nil { // keep the update loop from reloading underneath us
+		c.reloads.run.Lock()
+		defer c.reloads.run.Unlock()
+	}
+	for i, g := range zones {
+		if params[i].Overwrite {
+			continue
+		}
+		if r, err := store.GetZone(g.Key); err == nil {
+			r.Close()
+			return errZoneExists{g.Name}
+		}
+	}
+	loaded := map[string]string{}
+	keys := []string{}
+	for _, g := range zones {
+		if err := store.PutZone(g.Key, g.contents); err != nil {
+			return fmt.Errorf("Error uploading zone %s: %s", g.Name, err.Error())
+		}
+		log.Printf("Stored zone %s at %s (%d records)", g.Name, g.Key, g.Records)
+		loaded[g.Name] = g.contents
+		keys = append(keys, g.Key)
+	}
+	if !load {
+		return nil
+	}
+	if err := c.loadZones(loaded); err != nil {
+		return err
+	}
+	c.markSynced(keys, time.Now())
+	c.stats.Incr("zones.generated", int64(len(zones)))
+	return nil
+}
+
+// generateCommand implements the generate command.
+func (c *config) generateCommand(store zoneStore) error {
+	params := []zoneParams{c.genParams}
+	zones, err := c.generateZones(params)
+	if err != nil {
+		return err
+	}
+	if c.dryRun {
+		for _, g := range zones {
+			fmt.Printf("; would upload to %s\n%s", g.Key, g.contents)
+		}
+		return nil
+	}
+	if err := c.storeZones(store, params, zones, false); err != nil {
+		return err
+	}
+	log.Printf("Running servers will load it on their next update, or POST /reload to load it now")
+	return nil
+}
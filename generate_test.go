@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStore is an in-memory zoneStore
+type testStore struct {
+	zones map[string]string
+}
+
+func (s testStore) ListZones() ([]zoneFile, error) {
+	zones := []zoneFile{}
+	for key := range s.zones {
+		zones = append(zones, zoneFile{Key: key, LastModified: time.Now()})
+	}
+	return zones, nil
+}
+
+func (s testStore) GetZone(key string) (io.ReadCloser, error) {
+	contents, ok := s.zones[key]
+	if !ok {
+		return nil, fmt.Errorf("NoSuchKey: %s", key)
+	}
+	return ioutil.NopCloser(strings.NewReader(contents)), nil
+}
+
+func (s testStore) PutZone(key string, contents string) error {
+	s.zones[key] = contents
+	return nil
+}
+
+func TestGenerateZone(t *testing.T) {
+	g, err := generateZone(zoneParams{Domain: "Example.co.uk", IPs: []string{"10.0.0.1", "2001:db8::1"}, MX: "microsoft"}, []string{"ns1.host.net", "ns2.host.net."})
+	if err != nil {
+		t.Fatalf("generateZone failed: %s", err.Error())
+	}
+	if g.Name != "example.co.uk" || g.Records != 7 {
+		t.Errorf("Expected 7 records for example.co.uk, got %d for %s", g.Records, g.Name)
+	}
+	rrs, err := parseZoneFile(g.Name, g.contents)
+	if err != nil {
+		t.Fatalf("generated zone does not parse: %s", err.Error())
+	}
+	for _, p := range checkZone(g.Name, rrs) {
+		t.Errorf("generated zone has problem: %s", p)
+	}
+	if !strings.Contains(g.contents, "example-co-uk.mail.protection.outlook.com.") {
+		t.Errorf("Expected the microsoft MX preset, got:\n%s", g.contents)
+	}
+
+	for _, p := range []zoneParams{
+		{Domain: "not a domain", IPs: []string{"10.0.0.1"}},
+		{Domain: "com", IPs: []string{"10.0.0.1"}},
+		{Domain: "abc.com"},
+		{Domain: "abc.com", IPs: []string{"10.0.0.256"}},
+		{Domain: "abc.com", IPs: []string{"10.0.0.1"}, MX: "aol"},
+	} {
+		if _, err := generateZone(p, []string{"ns1.host.net"}); err == nil {
+			t.Errorf("generateZone accepted %+v", p)
+		}
+	}
+	if _, err := generateZone(zoneParams{Domain: "abc.com", IPs: []string{"10.0.0.1"}}, nil); err == nil {
+		t.Errorf("generateZone accepted a zone without nameservers")
+	}
+}
+
+func TestAPIZones(t *testing.T) {
+	store := testStore{zones: map[string]string{"zones/abc.com": abcZone}}
+	c := config{stats: statsd.NoopClient{}, prefix: "zones/", nameservers: []string{"ns1.host.net"}, backend: store}
+	handler := c.apiHandler(nil)
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/zones", strings.NewReader(body)))
+		return w
+	}
+
+	w := post(`[{"domain": "new1.com", "ips": ["10.0.0.1"], "mx": "google"}, {"domain": "new2.com", "ips": ["10.0.0.2"]}]`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /zones: want: %d, got: %d %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if _, ok := store.zones["zones/new2.com"]; !ok {
+		t.Errorf("Expected new2.com to be uploaded")
+	}
+	m := testQuery(&c, "new1.com", "new1.com.", dns.TypeMX)
+	if m == nil || len(m.Answer) != 5 {
+		t.Errorf("Expected new1.com to be served immediately with 5 MX records, got %v", m)
+	}
+
+	if w := post(`{"domain": "abc.com", "ips": ["10.0.0.1"]}`); w.Code != http.StatusConflict {
+		t.Errorf("POST /zones existing zone: want: %d, got: %d", http.StatusConflict, w.Code)
+	}
+	if w := post(`{"domain": "abc.com", "ips": ["10.0.0.9"], "overwrite": true}`); w.Code != http.StatusCreated {
+		t.Errorf("POST /zones with overwrite: want: %d, got: %d", http.StatusCreated, w.Code)
+	}
+	w = post(`[{"domain": "ok.com", "ips": ["10.0.0.1"]}, {"domain": "bad.com"}]`)
+	var resp struct{ Errors []fieldError }
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusBadRequest || len(resp.Errors) != 1 || resp.Errors[0].Index == nil || *resp.Errors[0].Index != 1 {
+		t.Errorf("POST /zones invalid zone: want: %d with the zone's index, got: %d %s", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+	if _, ok := store.zones["zones/ok.com"]; ok {
+		t.Errorf("Expected nothing to be uploaded when any zone is invalid")
+	}
+	if w := post(`{"domain":`); w.Code != http.StatusBadRequest {
+		t.Errorf("POST /zones bad JSON: want: %d, got: %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -0,0 +1,284 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"strings"
+	"sync"
+)
+
+// With --geoip pointing at a MaxMind DB file with countries, such as GeoLite2-Country
+// or GeoLite2-City, queries are also counted by client country and continent as
+// query.country.<code> and query.continent.<code>, to see where traffic comes from
+// and check that anycast routes clients to the nearest site. Clients that aren't in
+// the database are counted as XX. The reader below handles just enough of the
+// MaxMind DB format (https://maxmind.github.io/MaxMind-DB/) for these lookups.
+const (
+	maxGeoCache  = 10000 // client addresses remembered, the cache is cleared when full
+	geoUnknown   = "XX"
+	mmdbMetadata = "\xab\xcd\xefMaxMind.com"
+)
+
+type geoLocation struct {
+	country   string
+	continent string
+}
+
+type geoIP struct {
+	db        []byte
+	nodeCount uint
+	recordLen uint // bits
+	ipVersion uint
+	data      []byte // data section
+	ipv4Start uint   // node for ::/96 in an IPv6 tree
+
+	mu    sync.Mutex
+	cache map[string]geoLocation
+}
+
+// openGeoIP reads a MaxMind DB file into memory.
+func openGeoIP(path string) (*geoIP, error) {
+	db, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --geoip: %s", err.Error())
+	}
+	g, err := parseGeoIP(db)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --geoip %s: %s", path, err.Error())
+	}
+	return g, nil
+}
+
+func parseGeoIP(db []byte) (*geoIP, error) {
+	i := bytes.LastIndex(db, []byte(mmdbMetadata))
+	if i < 0 {
+		return nil, fmt.Errorf("not a MaxMind DB file")
+	}
+	meta := db[i+len(mmdbMetadata):]
+	v, _, err := decodeMMDB(meta, 0)
+	if err != nil {
+		return nil, fmt.Errorf("bad metadata: %s", err.Error())
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("bad metadata")
+	}
+	g := &geoIP{db: db, cache: map[string]geoLocation{}}
+	g.nodeCount, _ = m["node_count"].(uint)
+	g.recordLen, _ = m["record_size"].(uint)
+	g.ipVersion, _ = m["ip_version"].(uint)
+	if g.recordLen != 24 && g.recordLen != 28 && g.recordLen != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", g.recordLen)
+	}
+	treeSize := g.nodeCount * g.recordLen / 4
+	if treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("search tree is larger than the file")
+	}
+	g.data = db[treeSize+16 : i]
+	if g.ipVersion == 6 {
+		node := uint(0)
+		for b := 0; b < 96 && node < g.nodeCount; b++ {
+			node = g.record(node, 0)
+		}
+		g.ipv4Start = node
+	}
+	return g, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a search tree node
+func (g *geoIP) record(node, bit uint) uint {
+	b := g.db[node*g.recordLen/4:]
+	switch g.recordLen {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	return uint(binary.BigEndian.Uint32(b[bit*4:]))
+}
+
+// lookup returns the country and continent codes for ip.
+func (g *geoIP) lookup(ip net.IP) geoLocation {
+	loc := geoLocation{geoUnknown, geoUnknown}
+	node := uint(0)
+	bits := ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		bits = ip4
+		node = g.ipv4Start
+	} else if g.ipVersion == 4 {
+		return loc
+	}
+	for i := 0; i < len(bits)*8 && node < g.nodeCount; i++ {
+		node = g.record(node, uint(bits[i/8]>>(7-uint(i%8)))&1)
+	}
+	if node <= g.nodeCount {
+		return loc
+	}
+	v, _, err := decodeMMDB(g.data, node-g.nodeCount-16)
+	if err != nil {
+		return loc
+	}
+	m, _ := v.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := m[key].(map[string]interface{}); ok {
+			if code, ok := country["iso_code"].(string); ok {
+				loc.country = code
+				break
+			}
+		}
+	}
+	if continent, ok := m["continent"].(map[string]interface{}); ok {
+		if code, ok := continent["code"].(string); ok {
+			loc.continent = code
+		}
+	}
+	return loc
+}
+
+// count counts a query by the country and continent of the client's address ip. It
+// is nil-safe.
+func (g *geoIP) count(c *config, ip net.IP) {
+	if g == nil || ip == nil {
+		return
+	}
+	g.mu.Lock()
+	loc, ok := g.cache[string(ip)]
+	g.mu.Unlock()
+	if !ok {
+		loc = g.lookup(ip)
+		g.mu.Lock()
+		if len(g.cache) >= maxGeoCache {
+			g.cache = map[string]geoLocation{}
+		}
+		g.cache[string(ip)] = loc
+		g.mu.Unlock()
+	}
+	c.stats.Incr("query.country."+strings.ToLower(loc.country), 1)
+	c.stats.Incr("query.continent."+strings.ToLower(loc.continent), 1)
+}
+
+// decodeMMDB decodes the data field at off in a data section, returning it and the
+// offset after it. Maps decode to map[string]interface{}, arrays to []interface{},
+// unsigned integers to uint.
+func decodeMMDB(data []byte, off uint) (interface{}, uint, error) {
+	if off >= uint(len(data)) {
+		return nil, 0, fmt.Errorf("offset %d is outside the data section", off)
+	}
+	ctrl := data[off]
+	off++
+	kind := uint(ctrl >> 5)
+	if kind == 1 { // pointer
+		ss, vvv := uint(ctrl>>3)&3, uint(ctrl&7)
+		if off+ss+1 > uint(len(data)) {
+			return nil, 0, fmt.Errorf("truncated pointer")
+		}
+		b := data[off : off+ss+1]
+		var p uint
+		switch ss {
+		case 0:
+			p = vvv<<8 | uint(b[0])
+		case 1:
+			p = (vvv<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 2:
+			p = (vvv<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		case 3:
+			p = uint(binary.BigEndian.Uint32(b))
+		}
+		v, _, err := decodeMMDB(data, p)
+		return v, off + ss + 1, err
+	}
+	if kind == 0 { // extended
+		if off >= uint(len(data)) {
+			return nil, 0, fmt.Errorf("truncated type")
+		}
+		kind = 7 + uint(data[off])
+		off++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(data)) {
+			return nil, 0, fmt.Errorf("truncated size")
+		}
+		extra := uint(0)
+		for _, b := range data[off : off+n] {
+			extra = extra<<8 | uint(b)
+		}
+		size = []uint{29, 285, 65821}[n-1] + extra
+		off += n
+	}
+	switch kind {
+	case 7: // map
+		m := map[string]interface{}{}
+		for i := uint(0); i < size; i++ {
+			k, next, err := decodeMMDB(data, off)
+			if err != nil {
+				return nil, 0, err
+			}
+			v, next, err := decodeMMDB(data, next)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, _ := k.(string)
+			m[key] = v
+			off = next
+		}
+		return m, off, nil
+	case 11: // array
+		a := []interface{}{}
+		for i := uint(0); i < size; i++ {
+			v, next, err := decodeMMDB(data, off)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+	case 14: // boolean, the value is the size
+		return size != 0, off, nil
+	}
+	if off+size > uint(len(data)) {
+		return nil, 0, fmt.Errorf("truncated field")
+	}
+	b := data[off : off+size]
+	off += size
+	switch kind {
+	case 2: // UTF-8 string
+		return string(b), off, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, fmt.Errorf("bad double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case 4: // bytes
+		return b, off, nil
+	case 5, 6, 9, 10: // unsigned integers; 128 bit ones keep their low 64 bits
+		n := uint(0)
+		for _, x := range b {
+			n = n<<8 | uint(x)
+		}
+		return n, off, nil
+	case 8: // int32
+		n := int32(0)
+		for _, x := range b {
+			n = n<<8 | int32(x)
+		}
+		return n, off, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, fmt.Errorf("bad float")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), off, nil
+	}
+	return nil, 0, fmt.Errorf("unknown data type %d", kind)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"net"
+	"testing"
+)
+
+// mmdbString and mmdbMap encode MaxMind DB data fields
+func mmdbString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+func mmdbMap(kv ...[]byte) []byte {
+	b := []byte{7<<5 | byte(len(kv)/2)}
+	for _, f := range kv {
+		b = append(b, f...)
+	}
+	return b
+}
+
+func mmdbUint(n int) []byte {
+	return []byte{5<<5 | 2, byte(n >> 8), byte(n)}
+}
+
+// testGeoDB builds a MaxMind DB with 24 bit records mapping each network to a
+// country and continent.
+func testGeoDB(t *testing.T, ipVersion int, networks map[string][2]string) []byte {
+	type node struct{ rec [2]int } // -1 is empty, otherwise a node or data marker
+	nodes := []node{{[2]int{-1, -1}}}
+	var data []byte
+	leaves := []struct{ node, bit, off int }{}
+	for cidr, loc := range networks {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip, offset := n.IP.To16(), 0
+		if n.IP.To4() != nil {
+			ip = n.IP.To4()
+			if ipVersion == 6 {
+				offset = 96 // IPv4 lives at ::/96
+			}
+		} else if ipVersion == 4 {
+			continue
+		}
+		ones, _ := n.Mask.Size()
+		cur := 0
+		for i := 0; i < offset+ones; i++ {
+			bit := 0
+			if i >= offset {
+				j := i - offset
+				bit = int(ip[j/8]>>(7-uint(j%8))) & 1
+			}
+			if i == offset+ones-1 {
+				leaves = append(leaves, struct{ node, bit, off int }{cur, bit, len(data)})
+				break
+			}
+			if nodes[cur].rec[bit] < 0 {
+				nodes = append(nodes, node{[2]int{-1, -1}})
+				nodes[cur].rec[bit] = len(nodes) - 1
+			}
+			cur = nodes[cur].rec[bit]
+		}
+		data = append(data, mmdbMap(
+			mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString(loc[0])),
+			mmdbString("continent"), mmdbMap(mmdbString("code"), mmdbString(loc[1])))...)
+	}
+	count := len(nodes)
+	for _, l := range leaves {
+		nodes[l.node].rec[l.bit] = count + 16 + l.off
+	}
+	var db bytes.Buffer
+	for _, n := range nodes {
+		for _, r := range n.rec {
+			if r < 0 {
+				r = count
+			}
+			db.Write([]byte{byte(r >> 16), byte(r >> 8), byte(r)})
+		}
+	}
+	db.Write(make([]byte, 16))
+	db.Write(data)
+	db.WriteString(mmdbMetadata)
+	db.Write(mmdbMap(
+		mmdbString("node_count"), mmdbUint(count),
+		mmdbString("record_size"), mmdbUint(24),
+		mmdbString("ip_version"), mmdbUint(ipVersion)))
+	return db.Bytes()
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	networks := map[string][2]string{
+		"192.0.2.0/24":    {"US", "NA"},
+		"198.51.100.0/25": {"DE", "EU"},
+		"2001:db8::/32":   {"JP", "AS"},
+	}
+	for _, version := range []int{4, 6} {
+		g, err := parseGeoIP(testGeoDB(t, version, networks))
+		if err != nil {
+			t.Fatalf("parseGeoIP failed: %s", err.Error())
+		}
+		for ip, want := range map[string]geoLocation{
+			"192.0.2.53":     {"US", "NA"},
+			"198.51.100.1":   {"DE", "EU"},
+			"198.51.100.200": {"XX", "XX"},
+			"203.0.113.1":    {"XX", "XX"},
+			"2001:db8::1":    {"JP", "AS"},
+		} {
+			if version == 4 && ip == "2001:db8::1" {
+				want = geoLocation{"XX", "XX"}
+			}
+			if got := g.lookup(net.ParseIP(ip)); got != want {
+				t.Errorf("IPv%d lookup %s: expected %v, got %v", version, ip, want, got)
+			}
+		}
+	}
+
+	if _, err := parseGeoIP([]byte("not a database")); err == nil {
+		t.Errorf("Expected an error for a file without metadata")
+	}
+}
+
+func TestGeoIPCount(t *testing.T) {
+	g, err := parseGeoIP(testGeoDB(t, 6, map[string][2]string{"127.0.0.0/8": {"ZZ", "OC"}}))
+	if err != nil {
+		t.Fatalf("parseGeoIP failed: %s", err.Error())
+	}
+	c := config{stats: statsd.NoopClient{}, geo: g}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if r := testQuery(&c, "abc.com", "abc.com.", dns.TypeA); len(r.Answer) != 1 {
+		t.Errorf("Expected an answer with --geoip, got %v", r)
+	}
+	if loc, ok := g.cache[string(net.ParseIP("127.0.0.1"))]; !ok || loc != (geoLocation{"ZZ", "OC"}) {
+		t.Errorf("Expected the client to be cached as ZZ/OC, got %v", g.cache)
+	}
+	c.geo = nil
+	testQuery(&c, "abc.com", "abc.com.", dns.TypeA) // nil-safe
+}
@@ -0,0 +1,211 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Each zone counts its (qname, qtype) pairs and every hotInterval packs the answers
+// for the --hot most queried ones. Those queries are then answered by copying the
+// packed message and patching the ID, the RD bit and the case of the question name,
+// skipping the record scan, string formatting and packing. Names are counted in
+// lower case, so a 0x20 resolver's randomly cased queries share one answer. Set
+// --hot=0 to disable.
+const hotInterval = 10 * time.Second
+
+type hotKey struct {
+	name  string
+	qtype uint16
+}
+
+type hotCache struct {
+	zone       *zone
+	size       int
+	mu         sync.Mutex
+	counts     map[hotKey]int
+	refreshed  time.Time
+	refreshing bool
+	packed     atomic.Value // map[hotKey][]byte
+}
+
+func newHotCache(z *zone, size int) *hotCache {
+	h := &hotCache{zone: z, size: size, counts: map[hotKey]int{}, refreshed: time.Now()}
+	h.packed.Store(map[hotKey][]byte{})
+	return h
+}
+
+// serve counts req and answers it from the packed answers if it is hot. It
+// returns false when the caller must build the answer itself.
+func (h *hotCache) serve(c *config, w dns.ResponseWriter, req *dns.Msg) bool {
+	if h == nil || req.IsTsig() != nil { // packed answers can't be signed
+		return false
+	}
+	q := req.Question[0]
+	k := hotKey{strings.ToLower(q.Name), q.Qtype}
+	if h.count(k) {
+		go h.refresh(c)
+	}
+	packed, ok := h.packed.Load().(map[hotKey][]byte)[k]
+	if !ok {
+		return false
+	}
+	b := make([]byte, len(packed), len(packed)+optSize)
+	copy(b, packed)
+	if c.udpSize > 0 { // see edns.go
+		if req.IsEdns0() != nil {
+			b = c.appendOPT(b)
+		}
+		if limit := c.replyLimit(w, req); limit > 0 && len(b) > limit {
+			return false // built and fitted instead
+		}
+	}
+	b[0], b[1] = byte(req.Id>>8), byte(req.Id)
+	echoCase(b, q.Name)
+	if req.RecursionDesired {
+		b[2] |= 0x01
+	}
+	if _, err := w.Write(b); err != nil {
+		c.stats.Incr("query.error", 1)
+		return true
+	}
+	if c.debugOn {
+		c.debug(fmt.Sprintf("Query [%s] %s[%s] -> (HOT)", w.RemoteAddr().String(), q.Name, dns.Type(q.Qtype).String()))
+	}
+	c.stats.Incr("query.answer", 1)
+	c.stats.Incr("query.hot", 1)
+	answered := b[6] != 0 || b[7] != 0
+	if answered {
+		c.access.record(c, h.zone.name, q.Name, q.Qtype)
+	}
+	c.clients.observe(c, w, req, answered)
+	return true
+}
+
+// echoCase writes name, as the client cased it, over the question of b, a packed
+// answer for the same name in lower case. Answer records owned by the question name
+// point at it, so they echo the client's case too.
+func echoCase(b []byte, name string) {
+	wire := make([]byte, 256)
+	end, err := dns.PackDomainName(name, wire, 0, nil, false)
+	if err == nil && 12+end <= len(b) {
+		copy(b[12:], wire[:end])
+	}
+}
+
+// isHot reports whether q would be answered from the packed answers.
+func (h *hotCache) isHot(q dns.Question) bool {
+	if h == nil {
+		return false
+	}
+	_, ok := h.packed.Load().(map[hotKey][]byte)[hotKey{strings.ToLower(q.Name), q.Qtype}]
+	return ok
+}
+
+// count records a query, returning true when the caller should start a refresh.
+func (h *hotCache) count(k hotKey) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[k]++
+	if h.refreshing || time.Since(h.refreshed) < hotInterval {
+		return false
+	}
+	h.refreshing = true
+	return true
+}
+
+type hotCount struct {
+	key   hotKey
+	count int
+}
+
+type byCount []hotCount
+
+func (p byCount) Len() int           { return len(p) }
+func (p byCount) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byCount) Less(i, j int) bool { return p[i].count > p[j].count }
+
+// top returns the most queried keys since the last call, resetting the counts.
+func (h *hotCache) top() []hotKey {
+	h.mu.Lock()
+	counts := h.counts
+	h.counts = map[hotKey]int{}
+	h.mu.Unlock()
+	sorted := []hotCount{}
+	for k, n := range counts {
+		sorted = append(sorted, hotCount{k, n})
+	}
+	sort.Sort(byCount(sorted))
+	keys := []hotKey{}
+	for i := 0; i < len(sorted) && i < h.size; i++ {
+		keys = append(keys, sorted[i].key)
+	}
+	return keys
+}
+
+// refresh replaces the packed answers with those for the current hottest queries.
+func (h *hotCache) refresh(c *config) {
+	defer func() {
+		h.mu.Lock()
+		h.refreshed = time.Now()
+		h.refreshing = false
+		h.mu.Unlock()
+	}()
+	h.packed.Store(h.zone.packAnswers(c, h.top()))
+}
+
+// packAnswers packs a reply for each key that can be answered locally and whose
+// answer does not depend on the resolver.
+func (z *zone) packAnswers(c *config, keys []hotKey) map[hotKey][]byte {
+	packed := map[hotKey][]byte{}
+	for _, k := range keys {
+		if z.policy.forwardRule(k.name) != nil || z.policy.qtypeRule(k.qtype) != nil {
+			continue
+		}
+		if k.qtype == dns.TypeA && strings.EqualFold(k.name, dns.Fqdn(z.name)) && z.hasApexCNAME() {
+			continue // flattened, don't ask the resolver just to find that out
+		}
+		q := dns.Question{Name: k.name, Qtype: k.qtype, Qclass: dns.ClassINET}
+		if z.delegationFor(q) != "" {
+			continue // referrals are built, they are cheap and rarely hot
+		}
+		rrs, _, cacheable := z.answer(c, q)
+		if !cacheable || c.overLimit(z, rrs) { // capped answers rotate, see limitAnswers
+			continue
+		}
+		m := new(dns.Msg)
+		m.Response = true
+		m.Authoritative = true
+		m.Compress = true // so owner names point at the question, see echoCase
+		m.Question = []dns.Question{q}
+		m.Answer = rrs
+		dnameOverflow(m)
+		z.authority(m, false)
+		if len(rrs) == 0 {
+			z.negative(m)
+		}
+		b, err := m.Pack()
+		if err != nil {
+			continue
+		}
+		packed[k] = b
+	}
+	if len(keys) > 0 {
+		c.debug(fmt.Sprintf("Precomputed %d hot answers for zone %s", len(packed), z.name))
+	}
+	return packed
+}
+
+func (z *zone) hasApexCNAME() bool {
+	for _, rr := range z.rrs {
+		if rr.Header().Rrtype == dns.TypeCNAME && rr.Header().Name == dns.Fqdn(z.name) {
+			return true
+		}
+	}
+	return false
+}
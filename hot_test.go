@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"testing"
+)
+
+func hotQuery(c *config, n string, name string, qtype uint16, id uint16, rd bool) *testWriter {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.Id = id
+	req.RecursionDesired = rd
+	w := &testWriter{}
+	c.zones[n].zoneHandler(c, w, req)
+	return w
+}
+
+func TestHotAnswers(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, hotSize: 1}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone, "flat.com": flatZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	z := c.zones["abc.com"]
+	for i := 0; i < 3; i++ {
+		hotQuery(&c, "abc.com", "abc.com.", dns.TypeMX, 1, true)
+	}
+	cold := hotQuery(&c, "abc.com", "www.abc.com.", dns.TypeCNAME, 2, false)
+	if cold.raw != nil || cold.msg == nil {
+		t.Fatalf("Expected www.abc.com to be answered normally before a refresh")
+	}
+	coldMX := hotQuery(&c, "abc.com", "abc.com.", dns.TypeMX, 3, true)
+	z.hot.refresh(&c)
+
+	hot := hotQuery(&c, "abc.com", "abc.com.", dns.TypeMX, 4, true)
+	if hot.raw == nil {
+		t.Fatalf("Expected abc.com MX to be answered from the hot cache")
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(hot.raw); err != nil {
+		t.Fatalf("Unpacking hot answer failed: %s", err.Error())
+	}
+	if m.Id != 4 || !m.RecursionDesired || !m.Response || !m.Authoritative {
+		t.Errorf("Expected hot answer header to match the request, got %v", m.MsgHdr)
+	}
+	coldMX.msg.Id = 4
+	if m.String() != coldMX.msg.String() {
+		t.Errorf("Expected hot answer to match the normal answer:\n%s\n%s", m.String(), coldMX.msg.String())
+	}
+	if w := hotQuery(&c, "abc.com", "abc.com.", dns.TypeMX, 5, false); w.raw[2]&0x01 != 0 {
+		t.Errorf("Expected RD bit to follow the request")
+	}
+	mixed := new(dns.Msg)
+	if w := hotQuery(&c, "abc.com", "aBc.CoM.", dns.TypeMX, 8, false); w.raw == nil || mixed.Unpack(w.raw) != nil {
+		t.Errorf("Expected a 0x20 cased query answered from the hot cache")
+	} else if mixed.Question[0].Name != "aBc.CoM." || mixed.Answer[0].Header().Name != "aBc.CoM." {
+		t.Errorf("Expected the hot answer to echo the query's case, got %v", mixed)
+	}
+	if w := hotQuery(&c, "abc.com", "www.abc.com.", dns.TypeCNAME, 6, false); w.raw != nil {
+		t.Errorf("Expected only the top %d query to be hot", c.hotSize)
+	}
+
+	f := c.zones["flat.com"]
+	if packed := f.packAnswers(&c, []hotKey{{"flat.com.", dns.TypeA}}); len(packed) != 0 {
+		t.Errorf("Expected flattened answers never to be precomputed")
+	}
+	c.loadZones(map[string]string{"abc.com": abcZone})
+	if w := hotQuery(&c, "abc.com", "abc.com.", dns.TypeMX, 7, false); w.raw != nil {
+		t.Errorf("Expected reloading a zone to drop its hot answers")
+	}
+}
+
+func benchmarkQueries(b *testing.B, hotSize int) {
+	c := config{stats: statsd.NoopClient{}, hotSize: hotSize}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone}); err != nil {
+		b.Fatalf("loadZones failed: %s", err.Error())
+	}
+	z := c.zones["abc.com"]
+	req := new(dns.Msg)
+	req.SetQuestion("abc.com.", dns.TypeMX)
+	w := &testWriter{}
+	z.zoneHandler(&c, w, req)
+	if z.hot != nil {
+		z.hot.refresh(&c)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		z.zoneHandler(&c, w, req)
+	}
+}
+
+func BenchmarkQueryCold(b *testing.B) { benchmarkQueries(b, 0) }
+func BenchmarkQueryHot(b *testing.B)  { benchmarkQueries(b, 100) }
@@ -0,0 +1,278 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Relative paths in named.conf, and in $INCLUDE lines of its zone files, are
+// resolved as named does, from its directory option, or from the directory of the
+// file naming them before one is set, so imports work from any directory.
+var bindInclude = regexp.MustCompile(`(?im)^(\$INCLUDE[ \t]+"?)([^"\s]+)`)
+
+// bindZone is a master zone declared in a BIND named.conf
+type bindZone struct {
+	name string
+	file string
+	dir  string // relative $INCLUDE files are found here
+}
+
+// bindPaths resolves the relative paths of a named.conf
+type bindPaths struct {
+	directory string // the directory option, once set
+}
+
+// resolve returns file, named in the file from, as named would find it
+func (p *bindPaths) resolve(file, from string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	if len(p.directory) > 0 {
+		return filepath.Join(p.directory, file)
+	}
+	return filepath.Join(filepath.Dir(from), file)
+}
+
+// bindStmt is a single named.conf statement, e.g. zone "abc.com" { ... };
+type bindStmt struct {
+	args  []string
+	block []bindStmt
+}
+
+// importBind uploads every master zone found in a BIND config to the bucket,
+// rewritten with absolute names so it loads regardless of $ORIGIN tricks.
+func (c *config) importBind(putter zonePutter) error {
+	zones, err := readBindConfig(c.bindConfig)
+	if err != nil {
+		return err
+	}
+	if len(zones) < 1 {
+		return fmt.Errorf("No master zones found in %s", c.bindConfig)
+	}
+	for _, z := range zones {
+		f, err := ioutil.ReadFile(z.file)
+		if err != nil {
+			return fmt.Errorf("Error reading zone %s: %s", z.name, err.Error())
+		}
+		normalized, count, err := normalizeZone(z.name, absoluteIncludes(string(f), z.dir), z.file)
+		if err != nil {
+			return err
+		}
+		key := c.prefix + z.name
+		if c.dryRun {
+			log.Printf("Would upload zone %s from %s to %s (%d records)", z.name, z.file, key, count)
+			continue
+		}
+		if err := putter.PutZone(key, normalized); err != nil {
+			return fmt.Errorf("Error uploading zone %s: %s", z.name, err.Error())
+		}
+		log.Printf("Uploaded zone %s from %s to %s (%d records)", z.name, z.file, key, count)
+	}
+	return nil
+}
+
+// normalizeZone parses a zone file and renders it back with one absolute RR per line.
+func normalizeZone(name, contents, file string) (string, int, error) {
+	rrs, err := parseZoneFile(name, contents)
+	if err != nil {
+		return "", 0, err
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "; zone %s imported from %s\n", name, file)
+	for _, rr := range rrs {
+		b.WriteString(rr.String())
+		b.WriteString("\n")
+	}
+	return b.String(), len(rrs), nil
+}
+
+// absoluteIncludes rewrites the relative $INCLUDE paths of a zone file to be under
+// dir, leaving everything else, such as an $INCLUDE's origin, as it is
+func absoluteIncludes(contents, dir string) string {
+	return bindInclude.ReplaceAllStringFunc(contents, func(line string) string {
+		m := bindInclude.FindStringSubmatch(line)
+		if filepath.IsAbs(m[2]) {
+			return line
+		}
+		return m[1] + filepath.Join(dir, m[2])
+	})
+}
+
+// readBindConfig returns the master zones declared in a named.conf, following includes.
+func readBindConfig(path string) ([]bindZone, error) {
+	paths := &bindPaths{}
+	stmts, err := parseBindFile(path, paths, 0)
+	if err != nil {
+		return nil, err
+	}
+	dir := paths.directory
+	if len(dir) < 1 {
+		dir = filepath.Dir(path)
+	}
+	zones := []bindZone{}
+	seen := map[string]bool{}
+	collectBindZones(stmts, dir, seen, &zones)
+	return zones, nil
+}
+
+func collectBindZones(stmts []bindStmt, dir string, seen map[string]bool, zones *[]bindZone) {
+	for _, s := range stmts {
+		if len(s.args) < 1 {
+			continue
+		}
+		switch s.args[0] {
+		case "view":
+			collectBindZones(s.block, dir, seen, zones)
+		case "zone":
+			if len(s.args) < 2 {
+				continue
+			}
+			name := strings.ToLower(s.args[1])
+			if name != "." {
+				name = strings.TrimSuffix(name, ".")
+			}
+			zoneType, file := "", ""
+			for _, o := range s.block {
+				if len(o.args) == 2 && o.args[0] == "type" {
+					zoneType = o.args[1]
+				} else if len(o.args) == 2 && o.args[0] == "file" {
+					file = o.args[1]
+				}
+			}
+			if zoneType != "master" && zoneType != "primary" {
+				log.Printf("Skipping %s zone %s", zoneType, name)
+				continue
+			}
+			if len(file) < 1 {
+				log.Printf("Warning: skipping zone %s with no file", name)
+				continue
+			}
+			if seen[name] {
+				log.Printf("Warning: skipping duplicate zone %s in %s", name, file)
+				continue
+			}
+			seen[name] = true
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(dir, file)
+			}
+			*zones = append(*zones, bindZone{name: name, file: file, dir: dir})
+		}
+	}
+}
+
+func parseBindFile(path string, paths *bindPaths, depth int) ([]bindStmt, error) {
+	if depth > 10 {
+		return nil, fmt.Errorf("Too many nested includes at %s", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	tokens := tokenizeBind(string(b))
+	stmts, _, err := parseBindStmts(tokens, 0, path)
+	if err != nil {
+		return nil, err
+	}
+	out := []bindStmt{}
+	for _, s := range stmts {
+		if len(s.args) > 0 && s.args[0] == "options" {
+			for _, o := range s.block {
+				if len(o.args) == 2 && o.args[0] == "directory" {
+					paths.directory = paths.resolve(o.args[1], path)
+				}
+			}
+		}
+		if len(s.args) == 2 && s.args[0] == "include" {
+			included, err := parseBindFile(paths.resolve(s.args[1], path), paths, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, included...)
+			continue
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func parseBindStmts(tokens []string, i int, path string) ([]bindStmt, int, error) {
+	stmts := []bindStmt{}
+	cur := bindStmt{}
+	for i < len(tokens) {
+		t := tokens[i]
+		i++
+		switch t {
+		case "{":
+			block, next, err := parseBindStmts(tokens, i, path)
+			if err != nil {
+				return nil, i, err
+			}
+			cur.block = block
+			i = next
+		case "}":
+			return stmts, i, nil
+		case ";":
+			if len(cur.args) > 0 || cur.block != nil {
+				stmts = append(stmts, cur)
+			}
+			cur = bindStmt{}
+		default:
+			cur.args = append(cur.args, t)
+		}
+	}
+	if len(cur.args) > 0 {
+		return nil, i, fmt.Errorf("Unterminated statement in %s: %s", path, strings.Join(cur.args, " "))
+	}
+	return stmts, i, nil
+}
+
+// tokenizeBind splits named.conf into words, quoted strings and {};, dropping comments.
+func tokenizeBind(s string) []string {
+	tokens := []string{}
+	for i := 0; i < len(s); {
+		ch := s[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case ch == '#' || strings.HasPrefix(s[i:], "//"):
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(s[i:], "/*"):
+			end := strings.Index(s[i+2:], "*/")
+			if end < 0 {
+				return tokens
+			}
+			i += end + 4
+		case ch == '{' || ch == '}' || ch == ';':
+			tokens = append(tokens, string(ch))
+			i++
+		case ch == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return append(tokens, s[i+1:])
+			}
+			tokens = append(tokens, s[i+1:i+1+end])
+			i += end + 2
+		default:
+			start := i
+			for i < len(s) && !strings.ContainsRune(" \t\r\n{};\"", rune(s[i])) {
+				i++
+			}
+			tokens = append(tokens, s[start:i])
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testPutter struct {
+	uploads map[string]string
+}
+
+func (p testPutter) PutZone(key string, contents string) error {
+	p.uploads[key] = contents
+	return nil
+}
+
+var bindZoneFile = `$TTL 300
+@	IN	SOA	ns1 admin ( 2015111501 10800 1200 864000 7200 )
+	IN	NS	ns1
+ns1	IN	A	127.0.0.3
+www	IN	CNAME	@
+`
+
+func TestImportBind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "neddns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := `// main config
+options {
+	directory "` + dir + `";
+	recursion no; /* authoritative only */
+};
+include "` + filepath.Join(dir, "named.conf.local") + `";
+zone "." { type hint; file "/etc/bind/db.root"; };
+`
+	local := `# local zones
+zone "ghi.com" IN {
+	type master;
+	file "db.ghi.com";
+	allow-transfer { 10.0.0.1; };
+};
+zone "slave.com" { type slave; masters { 10.0.0.2; }; file "db.slave.com"; };
+`
+	files := map[string]string{"named.conf": conf, "named.conf.local": local, "db.ghi.com": bindZoneFile}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := config{bindConfig: filepath.Join(dir, "named.conf"), prefix: "zones/"}
+	putter := testPutter{uploads: map[string]string{}}
+	if err := c.importBind(putter); err != nil {
+		t.Fatalf("importBind failed: %s", err.Error())
+	}
+	if len(putter.uploads) != 1 {
+		t.Errorf("importBind uploaded wrong # of zones (got: %d, wanted: %d)", len(putter.uploads), 1)
+	}
+	z := putter.uploads["zones/ghi.com"]
+	if !strings.Contains(z, "ns1.ghi.com.") || !strings.Contains(z, "www.ghi.com.") {
+		t.Errorf("importBind did not normalize names: %s", z)
+	}
+
+	c.dryRun = true
+	putter = testPutter{uploads: map[string]string{}}
+	if err := c.importBind(putter); err != nil {
+		t.Fatalf("importBind dry run failed: %s", err.Error())
+	}
+	if len(putter.uploads) != 0 {
+		t.Errorf("importBind dry run uploaded %d zones", len(putter.uploads))
+	}
+}
+
+func TestImportBindRelativePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "neddns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"named.conf":                   "include \"named.conf.options\";\ninclude \"local/named.conf.local\";\n",
+		"named.conf.options":           "options { directory \"zones\"; };\n", // found beside named.conf
+		"zones/local/named.conf.local": "zone \"ghi.com\" { type master; file \"db.ghi.com\"; };\n",
+		"zones/db.ghi.com":             bindZoneFile + "$INCLUDE hosts/db.ghi.com.hosts\n",
+		"zones/hosts/db.ghi.com.hosts": "mail\tIN\tA\t127.0.0.4\n",
+		"elsewhere/named.conf.options": "options { directory \"/nonexistent\"; };\n",
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	os.Chdir(filepath.Join(dir, "elsewhere")) // the paths aren't relative to where neddns runs
+
+	c := config{bindConfig: filepath.Join(dir, "named.conf"), prefix: "zones/"}
+	putter := testPutter{uploads: map[string]string{}}
+	if err := c.importBind(putter); err != nil {
+		t.Fatalf("importBind failed: %s", err.Error())
+	}
+	if z := putter.uploads["zones/ghi.com"]; !strings.Contains(z, "mail.ghi.com.") {
+		t.Errorf("importBind did not follow the relative $INCLUDE: %s", z)
+	}
+}
@@ -0,0 +1,323 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const inventoryTTL = 300 // for records without a TTL
+
+// inventoryRecord is one record from a CSV inventory or Terraform state
+type inventoryRecord struct {
+	zone  string // empty if the inventory doesn't say
+	name  string
+	rtype string
+	ttl   uint32
+	value string
+	from  string // where in the inventory, for errors
+}
+
+// importInventory converts the records in a CSV file or Terraform state into zone
+// files and uploads them, refusing to replace existing zones unless asked to.
+func (c *config) importInventory(store zoneStore) error {
+	records, err := readInventory(c.inventory)
+	if err != nil {
+		return err
+	}
+	zones, err := inventoryZones(records, c.genParams.Domain, c.nameservers, c.inventory)
+	if err != nil {
+		return err
+	}
+	params := []zoneParams{}
+	for i := range zones {
+		zones[i].Key = c.prefix + zones[i].Name
+		params = append(params, zoneParams{Domain: zones[i].Name, Overwrite: c.genParams.Overwrite})
+	}
+	if c.dryRun {
+		for _, g := range zones {
+			fmt.Printf("; would upload to %s\n%s", g.Key, g.contents)
+		}
+		return nil
+	}
+	return c.storeZones(store, params, zones, false)
+}
+
+// readInventory reads a Terraform state file, which is JSON, or a CSV file
+func readInventory(path string) ([]inventoryRecord, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		return readTerraformState(b, path)
+	}
+	return readRecordCSV(b, path)
+}
+
+// readRecordCSV reads name,type,ttl,value rows, the way records are kept in a
+// spreadsheet. A header row may name the columns instead, in any order, and add a
+// zone column. Blank TTLs get inventoryTTL and # starts a comment.
+func readRecordCSV(b []byte, path string) ([]inventoryRecord, error) {
+	r := csv.NewReader(bytes.NewReader(b))
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", path, err.Error())
+	}
+	columns := map[string]int{"name": 0, "type": 1, "ttl": 2, "value": 3}
+	start := 0
+	header := map[string]int{}
+	if len(rows) > 0 {
+		for i, h := range rows[0] {
+			header[strings.ToLower(strings.TrimSpace(h))] = i
+		}
+	}
+	if _, ok := header["type"]; ok { // no record has the type "type"
+		columns = header
+		for _, want := range []string{"name", "type", "value"} {
+			if _, ok := columns[want]; !ok {
+				return nil, fmt.Errorf("Error reading %s: no %s column in the header", path, want)
+			}
+		}
+		start = 1
+	}
+	field := func(row []string, col string) string {
+		if i, ok := columns[col]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	records := []inventoryRecord{}
+	for i, row := range rows[start:] {
+		from := fmt.Sprintf("%s row %d", path, start+i+1)
+		rec := inventoryRecord{zone: field(row, "zone"), name: field(row, "name"), rtype: strings.ToUpper(field(row, "type")), value: field(row, "value"), from: from}
+		if len(rec.name) == 0 || len(rec.rtype) == 0 || len(rec.value) == 0 {
+			return nil, fmt.Errorf("Error reading %s: name, type and value are required", from)
+		}
+		if (rec.rtype == "TXT" || rec.rtype == "SPF") && !strings.HasPrefix(rec.value, `"`) {
+			rec.value = txtData(rec.value) // spreadsheets keep the text unquoted
+		}
+		if ttl := field(row, "ttl"); len(ttl) > 0 {
+			n, err := strconv.ParseUint(ttl, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Error reading %s: invalid ttl %q", from, ttl)
+			}
+			rec.ttl = uint32(n)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// tfState is the part of a Terraform state file (format version 4) we read
+type tfState struct {
+	Version   int `json:"version"`
+	Resources []struct {
+		Mode      string `json:"mode"`
+		Type      string `json:"type"`
+		Name      string `json:"name"`
+		Instances []struct {
+			Attributes tfAttributes `json:"attributes"`
+		} `json:"instances"`
+	} `json:"resources"`
+}
+
+// tfAttributes are the attributes of the Route 53 and Google Cloud DNS resources
+type tfAttributes struct {
+	ZoneID      string            `json:"zone_id"` // aws_route53_zone and aws_route53_record
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	TTL         uint32            `json:"ttl"`
+	Records     []string          `json:"records"`
+	Alias       []json.RawMessage `json:"alias"`
+	DNSName     string            `json:"dns_name"`     // google_dns_managed_zone
+	ManagedZone string            `json:"managed_zone"` // google_dns_record_set
+	RRDatas     []string          `json:"rrdatas"`
+}
+
+// readTerraformState reads the records of the aws_route53_record and
+// google_dns_record_set resources in a Terraform state file. Route 53 alias records
+// have no values to serve, so they are skipped.
+func readTerraformState(b []byte, path string) ([]inventoryRecord, error) {
+	var state tfState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("Error reading Terraform state %s: %s", path, err.Error())
+	}
+	if state.Version != 4 {
+		return nil, fmt.Errorf("Error reading Terraform state %s: unsupported version %d, run terraform state pull with Terraform 0.12 or later", path, state.Version)
+	}
+	zones := map[string]string{} // by Route 53 zone ID or Google managed zone name
+	for _, r := range state.Resources {
+		for _, i := range r.Instances {
+			switch {
+			case r.Mode == "managed" && r.Type == "aws_route53_zone":
+				zones[i.Attributes.ZoneID] = i.Attributes.Name
+			case r.Mode == "managed" && r.Type == "google_dns_managed_zone":
+				zones[i.Attributes.Name] = i.Attributes.DNSName
+			}
+		}
+	}
+	records := []inventoryRecord{}
+	for _, r := range state.Resources {
+		if r.Mode != "managed" {
+			continue
+		}
+		for n, i := range r.Instances {
+			a := i.Attributes
+			from := fmt.Sprintf("%s %s.%s[%d]", path, r.Type, r.Name, n)
+			switch r.Type {
+			case "aws_route53_record":
+				if len(a.Alias) > 0 {
+					log.Printf("Skipping alias record %s %s (%s)", a.Name, a.Type, from)
+					continue
+				}
+				for _, v := range a.Records {
+					if a.Type == "TXT" || a.Type == "SPF" { // Route 53 splits long strings with ""
+						v = txtStrings(strings.Split(v, `""`))
+					}
+					records = append(records, inventoryRecord{zone: zones[a.ZoneID], name: dns.Fqdn(a.Name), rtype: a.Type, ttl: a.TTL, value: v, from: from})
+				}
+			case "google_dns_record_set":
+				for _, v := range a.RRDatas {
+					records = append(records, inventoryRecord{zone: zones[a.ManagedZone], name: dns.Fqdn(a.Name), rtype: a.Type, ttl: a.TTL, value: v, from: from})
+				}
+			}
+		}
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("No aws_route53_record or google_dns_record_set resources found in %s", path)
+	}
+	return records, nil
+}
+
+// txtStrings quotes each string of a TXT record
+func txtStrings(s []string) string {
+	quoted := make([]string, len(s))
+	for i, part := range s {
+		quoted[i] = txtData(part)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// inventoryZones assigns records to zones and renders a zone file for each. A
+// record's zone is the one the inventory gives, or domain, or the closest name
+// with an SOA record in the inventory. Zones without an SOA get one like generated
+// zones', and without apex NS records get the nameservers ns.
+func inventoryZones(records []inventoryRecord, domain string, ns []string, source string) ([]generatedZone, error) {
+	if len(domain) > 0 {
+		domain = dns.Fqdn(strings.ToLower(domain))
+	}
+	soas := []string{}
+	for _, rec := range records {
+		if rec.rtype == "SOA" {
+			soas = append(soas, strings.ToLower(absoluteName(rec.name, firstOf(rec.zone, domain))))
+		}
+	}
+	byZone := map[string][]inventoryRecord{}
+	for _, rec := range records {
+		z := strings.ToLower(dns.Fqdn(firstOf(rec.zone, domain)))
+		if z == "." {
+			z = ""
+		}
+		rec.name = absoluteName(rec.name, z)
+		if len(z) == 0 {
+			for _, s := range soas {
+				if dns.IsSubDomain(s, rec.name) && len(s) > len(z) {
+					z = s
+				}
+			}
+		}
+		if len(z) == 0 {
+			return nil, fmt.Errorf("No zone for %s (%s): set --domain, or add a zone column or the zone's SOA record", rec.name, rec.from)
+		}
+		if !dns.IsSubDomain(z, rec.name) {
+			return nil, fmt.Errorf("%s is not in zone %s (%s)", rec.name, z, rec.from)
+		}
+		if _, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", rec.name, inventoryTTL, rec.rtype, rec.value)); err != nil {
+			return nil, fmt.Errorf("Invalid record %s %s %s (%s): %s", rec.name, rec.rtype, rec.value, rec.from, err.Error())
+		}
+		byZone[z] = append(byZone[z], rec)
+	}
+	names := []string{}
+	for z := range byZone {
+		names = append(names, z)
+	}
+	sort.Strings(names)
+	zones := []generatedZone{}
+	for _, z := range names {
+		lines := []string{}
+		hasSOA, apexNS := false, []string{}
+		for _, rec := range byZone[z] {
+			ttl := rec.ttl
+			if ttl == 0 {
+				ttl = inventoryTTL
+			}
+			hasSOA = hasSOA || rec.rtype == "SOA"
+			if rec.rtype == "NS" && strings.EqualFold(rec.name, z) {
+				apexNS = append(apexNS, rec.value)
+			}
+			lines = append(lines, fmt.Sprintf("%s %d IN %s %s", rec.name, ttl, rec.rtype, rec.value))
+		}
+		if len(apexNS) == 0 {
+			if len(ns) < 1 {
+				return nil, fmt.Errorf("%s: no NS records for the zone and --ns is not set", z)
+			}
+			for _, n := range ns {
+				apexNS = append(apexNS, dns.Fqdn(n))
+				lines = append(lines, fmt.Sprintf("%s %d IN NS %s", z, inventoryTTL, dns.Fqdn(n)))
+			}
+		}
+		if !hasSOA {
+			lines = append([]string{fmt.Sprintf("%s %d IN SOA %s hostmaster.%s %s01 10800 1200 864000 %d",
+				z, inventoryTTL, absoluteName(apexNS[0], z), z, time.Now().UTC().Format("20060102"), inventoryTTL)}, lines...)
+		}
+		name := strings.TrimSuffix(z, ".")
+		rrs, err := parseZoneFile(name, strings.Join(lines, "\n")+"\n")
+		if err != nil {
+			return nil, err
+		}
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "; zone %s imported from %s\n", name, source)
+		for _, rr := range rrs {
+			b.WriteString(rr.String() + "\n")
+		}
+		zones = append(zones, generatedZone{Name: name, Records: len(rrs), contents: b.String()})
+	}
+	return zones, nil
+}
+
+// absoluteName makes an inventory name absolute: @ is the zone's apex, and names
+// neither ending in a dot nor in the zone are relative to it
+func absoluteName(name, zone string) string {
+	zone = dns.Fqdn(zone)
+	switch {
+	case name == "@" && zone != ".":
+		return zone
+	case strings.HasSuffix(name, "."), zone == ".":
+		return dns.Fqdn(name)
+	case strings.EqualFold(name+".", zone) || dns.IsSubDomain(zone, name+"."):
+		return name + "."
+	}
+	return name + "." + zone
+}
+
+func firstOf(s ...string) string {
+	for _, v := range s {
+		if len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var recordCSV = `# exported from the DNS spreadsheet
+zone,name,type,ttl,value
+abc.com,@,A,600,10.0.0.1
+abc.com,www,CNAME,,abc.com.
+abc.com,abc.com,MX,,10 mail.abc.com.
+abc.com,@,TXT,,v=spf1 include:_spf.google.com ~all
+def.com,def.com.,NS,3600,ns1.def.com.
+def.com,ns1,A,3600,10.0.0.53
+`
+
+var terraformState = `{
+  "version": 4,
+  "terraform_version": "1.5.7",
+  "resources": [
+    {"mode": "managed", "type": "aws_route53_zone", "name": "main",
+     "instances": [{"attributes": {"zone_id": "Z123", "name": "abc.com"}}]},
+    {"mode": "managed", "type": "aws_route53_record", "name": "www",
+     "instances": [{"attributes": {"zone_id": "Z123", "name": "www.abc.com", "type": "A", "ttl": 60, "records": ["10.0.0.1", "10.0.0.2"], "alias": []}}]},
+    {"mode": "managed", "type": "aws_route53_record", "name": "dkim",
+     "instances": [{"attributes": {"zone_id": "Z123", "name": "k1._domainkey.abc.com", "type": "TXT", "ttl": 300, "records": ["v=DKIM1; p=abc\"\"def"], "alias": []}}]},
+    {"mode": "managed", "type": "aws_route53_record", "name": "cdn",
+     "instances": [{"attributes": {"zone_id": "Z123", "name": "cdn.abc.com", "type": "A", "ttl": 0, "records": null,
+       "alias": [{"name": "d111.cloudfront.net", "zone_id": "Z2FD", "evaluate_target_health": false}]}}]},
+    {"mode": "managed", "type": "google_dns_managed_zone", "name": "def",
+     "instances": [{"attributes": {"name": "def-zone", "dns_name": "def.com."}}]},
+    {"mode": "managed", "type": "google_dns_record_set", "name": "txt",
+     "instances": [{"attributes": {"managed_zone": "def-zone", "name": "def.com.", "type": "TXT", "ttl": 300, "rrdatas": ["\"hello world\""]}}]},
+    {"mode": "data", "type": "aws_route53_zone", "name": "other",
+     "instances": [{"attributes": {"zone_id": "Z999", "name": "other.com"}}]}
+  ]
+}`
+
+// testInventory writes an inventory file, returning its path
+func testInventory(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testZoneRRs parses an imported zone, failing the test if it doesn't load
+func testZoneRRs(t *testing.T, name, contents string) map[string]bool {
+	rrs, err := parseZoneFile(name, contents)
+	if err != nil {
+		t.Fatalf("Imported zone %s doesn't parse: %s\n%s", name, err.Error(), contents)
+	}
+	found := map[string]bool{}
+	for _, rr := range rrs {
+		found[rr.Header().Name+" "+dns.Type(rr.Header().Rrtype).String()] = true
+	}
+	return found
+}
+
+func TestImportCSV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "neddns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := config{inventory: testInventory(t, dir, "records.csv", recordCSV), prefix: "zones/", nameservers: []string{"ns1.host.net"}}
+	store := testStore{zones: map[string]string{}}
+	if err := c.importInventory(store); err != nil {
+		t.Fatalf("importInventory failed: %s", err.Error())
+	}
+	if len(store.zones) != 2 {
+		t.Fatalf("Expected 2 zones, got %v", store.zones)
+	}
+	abc := store.zones["zones/abc.com"]
+	found := testZoneRRs(t, "abc.com", abc)
+	for _, want := range []string{"abc.com. SOA", "abc.com. NS", "abc.com. A", "www.abc.com. CNAME", "abc.com. MX", "abc.com. TXT"} {
+		if !found[want] {
+			t.Errorf("Expected %s in the imported zone: %s", want, abc)
+		}
+	}
+	if !strings.Contains(abc, "abc.com.\t600\tIN\tA\t10.0.0.1") || !strings.Contains(abc, "www.abc.com.\t300\tIN\tCNAME") {
+		t.Errorf("Expected the given TTLs, or 300: %s", abc)
+	}
+	if !strings.Contains(abc, `"v=spf1 include:_spf.google.com ~all"`) {
+		t.Errorf("Expected the TXT record quoted as one string: %s", abc)
+	}
+	def := store.zones["zones/def.com"]
+	if strings.Contains(def, "ns1.host.net") || !strings.Contains(def, "SOA\tns1.def.com.") {
+		t.Errorf("Expected the zone's own nameservers rather than --ns: %s", def)
+	}
+
+	if err := c.importInventory(store); err == nil {
+		t.Errorf("Expected existing zones not to be replaced")
+	}
+	c.genParams.Overwrite = true
+	if err := c.importInventory(store); err != nil {
+		t.Errorf("Expected existing zones to be replaced with --overwrite, got %s", err.Error())
+	}
+
+	// without a zone column, records need --domain or an SOA
+	c = config{inventory: testInventory(t, dir, "plain.csv", "www,A,,10.0.0.1\nghi.com.,NS,,ns1.host.net.\n"), prefix: "zones/"}
+	if err := c.importInventory(testStore{zones: map[string]string{}}); err == nil || !strings.Contains(err.Error(), "--domain") {
+		t.Errorf("Expected an error asking for --domain, got %v", err)
+	}
+	c.genParams.Domain = "ghi.com"
+	store = testStore{zones: map[string]string{}}
+	if err := c.importInventory(store); err != nil {
+		t.Fatalf("importInventory failed: %s", err.Error())
+	}
+	if found := testZoneRRs(t, "ghi.com", store.zones["zones/ghi.com"]); !found["www.ghi.com. A"] {
+		t.Errorf("Expected names relative to --domain, got %v", store.zones)
+	}
+
+	for _, bad := range []string{
+		"www,A,,not-an-ip\n",
+		"www,A,soon,10.0.0.1\n",
+		"www.other.com.,A,,10.0.0.1\n",
+		"name,value\nwww,10.0.0.1\n",
+	} {
+		c.inventory = testInventory(t, dir, "bad.csv", bad)
+		if err := c.importInventory(testStore{zones: map[string]string{}}); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestImportTerraformState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "neddns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := config{inventory: testInventory(t, dir, "terraform.tfstate", terraformState), nameservers: []string{"ns1.host.net", "ns2.host.net"}, dryRun: true}
+	store := testStore{zones: map[string]string{}}
+	if err := c.importInventory(store); err != nil || len(store.zones) != 0 {
+		t.Fatalf("Expected a dry run to upload nothing, got %v %v", err, store.zones)
+	}
+	c.dryRun = false
+	if err := c.importInventory(store); err != nil {
+		t.Fatalf("importInventory failed: %s", err.Error())
+	}
+	abc := store.zones["abc.com"]
+	found := testZoneRRs(t, "abc.com", abc)
+	if !found["www.abc.com. A"] || !found["k1._domainkey.abc.com. TXT"] || found["cdn.abc.com. A"] {
+		t.Errorf("Expected the records without the alias: %s", abc)
+	}
+	if !strings.Contains(abc, `"v=DKIM1; p=abc" "def"`) {
+		t.Errorf("Expected Route 53's split TXT strings: %s", abc)
+	}
+	if !found["abc.com. NS"] || !strings.Contains(abc, "SOA\tns1.host.net.") {
+		t.Errorf("Expected --ns for a zone without NS records: %s", abc)
+	}
+	if found := testZoneRRs(t, "def.com", store.zones["def.com"]); !found["def.com. TXT"] {
+		t.Errorf("Expected the Google Cloud DNS record, got %v", store.zones)
+	}
+	if _, ok := store.zones["other.com"]; ok {
+		t.Errorf("Expected data sources to be skipped")
+	}
+
+	c.inventory = testInventory(t, dir, "old.tfstate", `{"version": 3, "modules": []}`)
+	if err := c.importInventory(store); err == nil || !strings.Contains(err.Error(), "version 3") {
+		t.Errorf("Expected an error for an old state file, got %v", err)
+	}
+}
@@ -0,0 +1,319 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A zone can be loaded and answered for while nobody asks us about it: the domain
+// was moved to another provider, its registration lapsed, or its NS records at the
+// registrar have a typo. With --ns-check, every zone's delegation is checked
+// that often. The zone's parent servers, found through the resolver, are asked for
+// the zone's NS records, and the zone is ours if they include one of --expected-ns,
+// or a nameserver whose address is one of --ns-addrs. The zone's own apex NS
+// records are held to the same test. A zone is then:
+//
+//   - ok: delegated to us, and its NS records name us
+//   - lame: delegated, but not to us
+//   - undelegated: its parent doesn't delegate it at all
+//   - apex: delegated to us, but its own NS records don't name us
+//   - error: the lookups failed, which isn't alerted on
+//
+// A zone turning lame, undelegated or apex is logged and alerted on (kind
+// delegation). Checks are counted by delegation.<status>, the zones that aren't
+// delegated to us are gauged by delegation.bad, and GET /delegations lists the
+// latest results.
+const (
+	delegationTimeout = 3 * time.Second
+	delegationServers = 3 // parent servers tried before giving up
+)
+
+var delegationPort = "53" // of the parent servers, for tests
+
+// delegationStatus is the latest delegation check of a zone
+type delegationStatus struct {
+	Zone    string   `json:"zone"`
+	Status  string   `json:"status"`
+	NS      []string `json:"ns"` // as the parent delegates the zone
+	Error   string   `json:"error,omitempty"`
+	Checked string   `json:"checked"`
+}
+
+type byDelegationZone []delegationStatus
+
+func (d byDelegationZone) Len() int           { return len(d) }
+func (d byDelegationZone) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d byDelegationZone) Less(i, j int) bool { return d[i].Zone < d[j].Zone }
+
+type delegationCheck struct {
+	every    time.Duration
+	expected []string // --expected-ns, lower case FQDNs
+	addrs    []net.IP // --ns-addrs
+	mu       sync.Mutex
+	results  map[string]*delegationStatus
+}
+
+// runDelegationChecks checks every zone's delegation forever
+func (c *config) runDelegationChecks() {
+	for {
+		c.checkDelegations(time.Now())
+		time.Sleep(c.delegations.every)
+	}
+}
+
+// checkDelegations checks the delegation of every zone served
+func (c *config) checkDelegations(now time.Time) {
+	if c.reloads != nil {
+		c.reloads.run.Lock()
+	}
+	zones := map[string][]string{}
+	for n, z := range c.zones {
+		if len(privateUse(n)) == 0 {
+			zones[n] = apexNS(z)
+		}
+	}
+	if c.reloads != nil {
+		c.reloads.run.Unlock()
+	}
+	bad := 0
+	for n, apex := range zones {
+		status, ns, err := c.checkDelegation(n, apex)
+		c.delegationResult(n, status, ns, err, now)
+		if status != "ok" && status != "error" {
+			bad++
+		}
+	}
+	c.stats.Gauge("delegation.bad", int64(bad))
+	c.delegations.mu.Lock()
+	for n := range c.delegations.results {
+		if _, ok := zones[n]; !ok { // no longer served
+			delete(c.delegations.results, n)
+		}
+	}
+	c.delegations.mu.Unlock()
+}
+
+// apexNS returns the names of zone z's apex NS records
+func apexNS(z *zone) []string {
+	names := []string{}
+	for _, rr := range z.rrs {
+		if ns, ok := rr.(*dns.NS); ok && strings.EqualFold(ns.Hdr.Name, dns.Fqdn(z.name)) {
+			names = append(names, strings.ToLower(ns.Ns))
+		}
+	}
+	return names
+}
+
+// checkDelegation checks zone n, whose apex NS records name apex, returning its
+// status and the nameservers its parent delegates it to
+func (c *config) checkDelegation(n string, apex []string) (string, []string, error) {
+	n = dns.Fqdn(strings.ToLower(n))
+	servers, err := c.parentServers(n)
+	if err != nil {
+		return "error", nil, err
+	}
+	var ns []string
+	for i, server := range servers {
+		if i == delegationServers {
+			break
+		}
+		if ns, err = c.askParent(n, server); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return "error", nil, err
+	}
+	if len(ns) == 0 {
+		return "undelegated", ns, fmt.Errorf("the parent zone doesn't delegate %s", n)
+	}
+	ours, err := c.delegatedToUs(ns)
+	if err != nil {
+		return "error", ns, err
+	}
+	if !ours {
+		return "lame", ns, fmt.Errorf("delegated to %s, none of them us", strings.Join(ns, ", "))
+	}
+	if ours, err = c.delegatedToUs(apex); err != nil {
+		return "error", ns, err
+	} else if !ours {
+		return "apex", ns, fmt.Errorf("the zone's NS records (%s) don't name us", strings.Join(apex, ", "))
+	}
+	return "ok", ns, nil
+}
+
+// parentServers returns the nameservers of the closest zone above n, through the
+// resolver
+func (c *config) parentServers(n string) ([]string, error) {
+	labels := dns.Split(n)
+	for i := 1; i <= len(labels); i++ {
+		parent := "."
+		if i < len(labels) {
+			parent = n[labels[i]:]
+		}
+		r, err := c.resolverQuery(parent, dns.TypeNS)
+		if err != nil {
+			return nil, err
+		}
+		servers := []string{}
+		for _, rr := range r.Answer {
+			if ns, ok := rr.(*dns.NS); ok && strings.EqualFold(ns.Hdr.Name, parent) {
+				servers = append(servers, ns.Ns)
+			}
+		}
+		if len(servers) > 0 {
+			return servers, nil
+		}
+	}
+	return nil, fmt.Errorf("no parent zone found for %s", n)
+}
+
+// askParent asks the parent server named server for the delegation of n, returning
+// the delegated nameservers, none if it isn't delegated
+func (c *config) askParent(n, server string) ([]string, error) {
+	addrs, err := c.resolveAddrs(server)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("parent server %s has no address", server)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(n, dns.TypeNS)
+	m.RecursionDesired = false
+	d := &dns.Client{DialTimeout: delegationTimeout, ReadTimeout: delegationTimeout}
+	r, _, err := d.Exchange(m, net.JoinHostPort(addrs[0].String(), delegationPort))
+	if err != nil {
+		return nil, fmt.Errorf("parent server %s: %s", server, err.Error())
+	}
+	if r.Rcode == dns.RcodeNameError {
+		return []string{}, nil
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("parent server %s: %s", server, dns.RcodeToString[r.Rcode])
+	}
+	ns := []string{}
+	for _, rr := range append(r.Answer, r.Ns...) { // a referral, or an answer from a server for both zones
+		if rr, ok := rr.(*dns.NS); ok && strings.EqualFold(rr.Hdr.Name, n) {
+			ns = append(ns, strings.ToLower(rr.Ns))
+		}
+	}
+	sort.Strings(ns)
+	return ns, nil
+}
+
+// delegatedToUs reports whether any of the nameservers ns is one of --expected-ns
+// or has one of the --ns-addrs
+func (c *config) delegatedToUs(ns []string) (bool, error) {
+	d := c.delegations
+	for _, name := range ns {
+		if contains(d.expected, strings.ToLower(dns.Fqdn(name))) {
+			return true, nil
+		}
+	}
+	if len(d.addrs) == 0 {
+		return false, nil
+	}
+	for _, name := range ns {
+		addrs, err := c.resolveAddrs(name)
+		if err != nil {
+			return false, err
+		}
+		for _, a := range addrs {
+			for _, ours := range d.addrs {
+				if a.Equal(ours) {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// resolveAddrs looks up the IPv4 and IPv6 addresses of name through the resolver
+func (c *config) resolveAddrs(name string) ([]net.IP, error) {
+	addrs := []net.IP{}
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		r, err := c.resolverQuery(name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, rr.A)
+			case *dns.AAAA:
+				addrs = append(addrs, rr.AAAA)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// resolverQuery asks the resolver for name, failing on anything but an answer or
+// NXDOMAIN
+func (c *config) resolverQuery(name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = true
+	d := &dns.Client{DialTimeout: delegationTimeout, ReadTimeout: delegationTimeout}
+	r, _, err := d.Exchange(m, c.resolver)
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s %s: %s", name, dns.Type(qtype).String(), dns.RcodeToString[r.Rcode])
+	}
+	return r, nil
+}
+
+// delegationResult records the check of zone n, with metrics, and logs and alerts
+// when it goes bad
+func (c *config) delegationResult(n, status string, ns []string, err error, now time.Time) {
+	c.stats.Incr("delegation."+status, 1)
+	d := c.delegations
+	d.mu.Lock()
+	r, seen := d.results[n]
+	if !seen {
+		r = &delegationStatus{Zone: n, Status: "ok"}
+		d.results[n] = r
+	}
+	was := r.Status
+	r.Status, r.NS, r.Error, r.Checked = status, ns, "", now.UTC().Format(time.RFC3339)
+	if err != nil {
+		r.Error = err.Error()
+	}
+	d.mu.Unlock()
+	switch {
+	case status == "error":
+		c.debug(fmt.Sprintf("Delegation check of zone %s failed: %s", n, err.Error()))
+	case status != "ok" && status != was:
+		msg := fmt.Sprintf("zone %s is %s: %s", n, status, err.Error())
+		log.Printf("Warning: %s", msg)
+		c.alerts.alert(c, alertNS, n, msg)
+	case status == "ok" && was != "ok" && was != "error":
+		log.Printf("Zone %s is delegated to us again", n)
+	}
+}
+
+// report lists the latest delegation checks for the admin API. It is nil-safe.
+func (d *delegationCheck) report() []delegationStatus {
+	results := []delegationStatus{}
+	if d == nil {
+		return results
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, r := range d.results {
+		results = append(results, *r)
+	}
+	sort.Sort(byDelegationZone(results))
+	return results
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDelegationCheck(t *testing.T) {
+	stats := &countingStats{counts: map[string]int64{}}
+	c := config{stats: stats, resolver: "127.0.0.1:25370"}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone, "def.com": defZone, "flat.com": flatZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	// the resolver, and the parent server for com.
+	var mu sync.Mutex // the server reads delegated as the test changes it
+	delegated := map[string]string{"abc.com.": "nsa.abc.com.", "def.com.": "ns1.other.test."}
+	addrs := map[string]string{"ns.parent.test.": "127.0.0.1", "nsa.abc.com.": "192.0.2.1", "ns1.other.test.": "198.51.100.1"}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		switch {
+		case q.Name == "com." && q.Qtype == dns.TypeNS:
+			rr, _ := dns.NewRR("com. 300 IN NS ns.parent.test.")
+			m.Answer = append(m.Answer, rr)
+		case q.Qtype == dns.TypeA && len(addrs[q.Name]) > 0:
+			rr, _ := dns.NewRR(q.Name + " 300 IN A " + addrs[q.Name])
+			m.Answer = append(m.Answer, rr)
+		case q.Qtype == dns.TypeNS && !req.RecursionDesired:
+			mu.Lock()
+			ns, ok := delegated[q.Name]
+			mu.Unlock()
+			if ok {
+				rr, _ := dns.NewRR(q.Name + " 300 IN NS " + ns)
+				m.Ns = append(m.Ns, rr)
+			} else {
+				m.Rcode = dns.RcodeNameError
+			}
+		}
+		w.WriteMsg(m)
+	})
+	started := make(chan bool)
+	server := &dns.Server{Addr: "127.0.0.1:25370", Net: "udp", Handler: handler, NotifyStartedFunc: func() { started <- true }}
+	go server.ListenAndServe()
+	defer server.Shutdown()
+	<-started
+	defer func(port string) { delegationPort = port }(delegationPort)
+	delegationPort = "25370"
+
+	c.delegations = &delegationCheck{addrs: []net.IP{net.ParseIP("192.0.2.1")}, results: map[string]*delegationStatus{}}
+	c.checkDelegations(time.Now())
+	report := c.delegations.report()
+	if len(report) != 3 {
+		t.Fatalf("Expected 3 zones checked, got %+v", report)
+	}
+	for i, want := range []string{"ok", "lame", "undelegated"} {
+		if report[i].Status != want {
+			t.Errorf("Expected zone %s %s, got %+v", report[i].Zone, want, report[i])
+		}
+	}
+	if r := report[1]; len(r.NS) != 1 || r.NS[0] != "ns1.other.test." || len(r.Error) == 0 {
+		t.Errorf("Expected the lame zone's delegation reported, got %+v", r)
+	}
+	if n := stats.get("delegation.lame"); n != 1 {
+		t.Errorf("Expected delegation.lame counted once, got %d", n)
+	}
+
+	// by name, the zone's own NS records have to name us too
+	mu.Lock()
+	delegated["def.com."] = "nsa.abc.com."
+	mu.Unlock()
+	c.delegations = &delegationCheck{expected: []string{"nsa.abc.com."}, results: map[string]*delegationStatus{}}
+	c.checkDelegations(time.Now())
+	if r := c.delegations.report()[1]; r.Zone != "def.com" || r.Status != "apex" {
+		t.Errorf("Expected def.com's NS records found not to name us, got %+v", r)
+	}
+	if r := c.delegations.report()[0]; r.Status != "ok" {
+		t.Errorf("Expected abc.com delegated to the expected nameserver, got %+v", r)
+	}
+}
@@ -0,0 +1,121 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// The local listener (--local) is for sidecars such as caches and health checkers
+// on the same host. It is either a unix socket path, using TCP framing, or a
+// loopback host:port serving TCP and UDP. Queries arriving on it are trusted:
+// use isLocal to exempt them from ACLs and rate limits.
+const localIdleTimeout = 30 * time.Second
+
+func isUnixSocketAddr(addr string) bool {
+	return strings.HasPrefix(addr, "/") || strings.HasPrefix(addr, "unix:")
+}
+
+// validateLocal makes sure a host:port local listener cannot be reached off the host.
+func validateLocal(addr string) error {
+	if isUnixSocketAddr(addr) {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid --local %q: use a unix socket path or a loopback host:port", addr)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("invalid --local %q: must be a loopback address such as 127.0.0.1", addr)
+	}
+	return nil
+}
+
+// startLocal opens the local listener before any chroot or sandbox is applied.
+func (c *config) startLocal() error {
+	if !isUnixSocketAddr(c.localAddr) {
+		conn, err := c.bindUDP(c.localAddr)
+		if err != nil {
+			return err
+		}
+		l, err := c.bindTCP(c.localAddr)
+		if err != nil {
+			return err
+		}
+		go func() {
+			srv := &dns.Server{PacketConn: conn, TsigSecret: c.tsigSecrets()}
+			if err := srv.ActivateAndServe(); err != nil {
+				c.listenerFailed("local udp", err)
+			}
+		}()
+		go func() {
+			srv := &dns.Server{Listener: l, TsigSecret: c.tsigSecrets()}
+			if err := srv.ActivateAndServe(); err != nil {
+				c.listenerFailed("local tcp", err)
+			}
+		}()
+		log.Printf("Local listener running on TCP/UDP %s", c.localAddr)
+		return nil
+	}
+	path := strings.TrimPrefix(c.localAddr, "unix:")
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path) // left behind by a previous run
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	go serveUnix(l, dns.DefaultServeMux)
+	log.Printf("Local listener running on unix socket %s", path)
+	return nil
+}
+
+// isLocal reports whether a query arrived on the trusted local listener.
+func (c *config) isLocal(w dns.ResponseWriter) bool {
+	if len(c.localAddr) == 0 {
+		return false
+	}
+	addr := w.LocalAddr()
+	if addr == nil {
+		return false
+	}
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return isUnixSocketAddr(c.localAddr)
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil || isUnixSocketAddr(c.localAddr) {
+		return false
+	}
+	_, localPort, _ := net.SplitHostPort(c.localAddr)
+	return port == localPort
+}
+
+// serveUnix answers queries on a unix stream socket. The pinned dns package only
+// serves TCP listeners, so the connection handling is our own.
+func serveUnix(l net.Listener, h dns.Handler) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			log.Printf("Error accepting on local socket: %s", err.Error())
+			return
+		}
+		go serveUnixConn(conn, h)
+	}
+}
+
+func serveUnixConn(conn net.Conn, h dns.Handler) {
+	defer conn.Close()
+	serveConn(conn, h, localIdleTimeout, nil) // trusted, so no TSIG keys
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateLocal(t *testing.T) {
+	for _, addr := range []string{"/run/neddns.sock", "unix:/tmp/dns.sock", "127.0.0.1:5353", "[::1]:5353", "localhost:5353"} {
+		if err := validateLocal(addr); err != nil {
+			t.Errorf("Expected %s to be accepted: %s", addr, err.Error())
+		}
+	}
+	for _, addr := range []string{"0.0.0.0:5353", ":5353", "10.0.0.1:53", "dns.sock"} {
+		if err := validateLocal(addr); err == nil {
+			t.Errorf("Expected %s to be rejected", addr)
+		}
+	}
+}
+
+func TestIsLocal(t *testing.T) {
+	w := &testWriter{} // local address 127.0.0.1:53
+	c := config{}
+	if c.isLocal(w) {
+		t.Errorf("Expected no local listener to mean no local queries")
+	}
+	c.localAddr = "127.0.0.1:53"
+	if !c.isLocal(w) {
+		t.Errorf("Expected query on the local port to be local")
+	}
+	c.localAddr = "127.0.0.1:5353"
+	if c.isLocal(w) {
+		t.Errorf("Expected query on another port not to be local")
+	}
+}
+
+func TestServeUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "neddns-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dns.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %s", err.Error())
+	}
+	defer l.Close()
+	c := config{localAddr: path}
+	local := false
+	mux := dns.NewServeMux()
+	mux.HandleFunc("abc.com.", func(w dns.ResponseWriter, req *dns.Msg) {
+		local = c.isLocal(w)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR("abc.com. 300 IN A 1.2.3.4")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	go serveUnix(l, mux)
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 2; i++ { // the connection is reused for several queries
+		req := new(dns.Msg)
+		req.SetQuestion("abc.com.", dns.TypeA)
+		b, _ := req.Pack()
+		frame := make([]byte, 2)
+		binary.BigEndian.PutUint16(frame, uint16(len(b)))
+		conn.Write(append(frame, b...))
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			t.Fatalf("Reading reply length failed: %s", err.Error())
+		}
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("Reading reply failed: %s", err.Error())
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(buf); err != nil {
+			t.Fatalf("Unpacking reply failed: %s", err.Error())
+		}
+		if resp.Id != req.Id || len(resp.Answer) != 1 {
+			t.Errorf("Expected one answer for query %d, got %v", req.Id, resp)
+		}
+	}
+	if !local {
+		t.Errorf("Expected unix socket queries to be local")
+	}
+}
@@ -0,0 +1,77 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// logPriority follows syslog severities, which journald uses as well
+type logPriority int
+
+const (
+	priCrit    logPriority = 2
+	priErr     logPriority = 3
+	priWarning logPriority = 4
+	priInfo    logPriority = 6
+	priDebug   logPriority = 7
+)
+
+// logSink is a non-file log destination that understands priorities
+type logSink interface {
+	send(p logPriority, msg string) error
+}
+
+// isLogURL reports whether a --log value names syslog or journald rather than a file
+func isLogURL(path string) bool {
+	return strings.HasPrefix(path, "syslog://") || strings.HasPrefix(path, "journald://")
+}
+
+// setupLogSink points the standard logger (and debug output) at syslog or journald.
+// Their own timestamps are used, so ours are dropped.
+func (c *config) setupLogSink() error {
+	var sink logSink
+	var err error
+	switch {
+	case strings.HasPrefix(c.logfile, "syslog://"):
+		sink, err = newSyslogSink(strings.TrimPrefix(c.logfile, "syslog://"))
+	case strings.HasPrefix(c.logfile, "journald://"):
+		sink, err = newJournaldSink()
+	default:
+		err = fmt.Errorf("unknown log destination %s", c.logfile)
+	}
+	if err != nil {
+		return err
+	}
+	c.logSink = sink
+	log.SetFlags(0)
+	log.SetOutput(sinkWriter{sink})
+	return nil
+}
+
+// sinkWriter adapts a logSink for log.SetOutput, guessing each line's priority
+type sinkWriter struct {
+	sink logSink
+}
+
+func (w sinkWriter) Write(b []byte) (int, error) {
+	msg := strings.TrimRight(string(b), "\n")
+	if err := w.sink.send(messagePriority(msg), msg); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// messagePriority maps our log message conventions ("Warning: ...", "Error ...") to a priority
+func messagePriority(msg string) logPriority {
+	switch {
+	case strings.HasPrefix(msg, "Warning"):
+		return priWarning
+	case strings.HasPrefix(msg, "Error"), strings.HasPrefix(msg, "Failed"):
+		return priErr
+	case strings.HasPrefix(msg, "Signal"):
+		return priCrit
+	}
+	return priInfo
+}
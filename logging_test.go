@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"testing"
+)
+
+type testSink struct {
+	pris []logPriority
+	msgs []string
+}
+
+func (s *testSink) send(p logPriority, msg string) error {
+	s.pris = append(s.pris, p)
+	s.msgs = append(s.msgs, msg)
+	return nil
+}
+
+func TestLogPriorities(t *testing.T) {
+	sink := &testSink{}
+	l := log.New(sinkWriter{sink}, "", 0)
+	l.Printf("Loaded zone %s", "abc.com")
+	l.Printf("Warning: zone %s is stale", "abc.com")
+	l.Printf("Error updating zones: %s", "denied")
+	c := config{debugOn: true, logSink: sink}
+	c.debug("debug message")
+	want := []logPriority{priInfo, priWarning, priErr, priDebug}
+	if len(sink.pris) != len(want) {
+		t.Fatalf("Expected %d messages, got %d", len(want), len(sink.pris))
+	}
+	for i, p := range want {
+		if sink.pris[i] != p {
+			t.Errorf("Expected priority %d for %q, got %d", p, sink.msgs[i], sink.pris[i])
+		}
+	}
+	if sink.msgs[0] != "Loaded zone abc.com" {
+		t.Errorf("Expected trailing newline to be trimmed, got %q", sink.msgs[0])
+	}
+}
+
+func TestLogURL(t *testing.T) {
+	if absPath("syslog://") != "syslog://" || absPath("journald://") != "journald://" {
+		t.Errorf("Expected log URLs to be left alone by absPath")
+	}
+	c := config{readOnly: true, logfile: "syslog://"}
+	if len(c.writablePaths()) != 0 {
+		t.Errorf("Expected syslog logging to be allowed with --readonly")
+	}
+}
@@ -0,0 +1,75 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/syslog"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+// newSyslogSink logs to the local syslog daemon, or to host:port over UDP
+func newSyslogSink(addr string) (logSink, error) {
+	network := ""
+	if len(addr) > 0 {
+		network = "udp"
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "neddns")
+	if err != nil {
+		return nil, err
+	}
+	return syslogSink{w}, nil
+}
+
+func (s syslogSink) send(p logPriority, msg string) error {
+	switch p {
+	case priCrit:
+		return s.w.Crit(msg)
+	case priErr:
+		return s.w.Err(msg)
+	case priWarning:
+		return s.w.Warning(msg)
+	case priDebug:
+		return s.w.Debug(msg)
+	}
+	return s.w.Info(msg)
+}
+
+type journaldSink struct {
+	conn net.Conn
+}
+
+// newJournaldSink speaks the journald native protocol over its datagram socket
+func newJournaldSink() (logSink, error) {
+	conn, err := net.Dial("unixgram", journaldSocket)
+	if err != nil {
+		return nil, err
+	}
+	return journaldSink{conn}, nil
+}
+
+func (j journaldSink) send(p logPriority, msg string) error {
+	var b bytes.Buffer
+	b.WriteString("PRIORITY=" + strconv.Itoa(int(p)) + "\n")
+	b.WriteString("SYSLOG_IDENTIFIER=neddns\n")
+	if strings.Contains(msg, "\n") { // multi-line values use an explicit length
+		b.WriteString("MESSAGE\n")
+		binary.Write(&b, binary.LittleEndian, uint64(len(msg)))
+		b.WriteString(msg + "\n")
+	} else {
+		b.WriteString("MESSAGE=" + msg + "\n")
+	}
+	_, err := j.conn.Write(b.Bytes())
+	return err
+}
@@ -0,0 +1,14 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+)
+
+func newSyslogSink(addr string) (logSink, error) {
+	return nil, fmt.Errorf("syslog logging is not supported on Windows")
+}
+
+func newJournaldSink() (logSink, error) {
+	return nil, fmt.Errorf("journald logging is not supported on Windows")
+}
@@ -0,0 +1,102 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"time"
+)
+
+// Maintenance records replace every record at their name during a daily window,
+// e.g. to point an app at a static status page:
+//
+//	app  IN  A      10.0.0.1
+//	app  IN  CNAME  status.example.net.  ; maintenance=02:00-03:00 maintenance-days=Sun
+//
+// Windows are in the --tz time zone and may cross midnight; days are the days the
+// window starts on (every day by default). Unlike scheduled records, windows are
+// evaluated at serve time, and answers for those names are never hot cached.
+type maintenanceWindow struct {
+	start, end int     // minutes since midnight
+	days       [7]bool // by time.Weekday, all false for every day
+}
+
+var weekdays = map[string]time.Weekday{"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday,
+	"wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseWindow reads a maintenance=HH:MM-HH:MM annotation
+func parseWindow(spec string) (*maintenanceWindow, error) {
+	w := &maintenanceWindow{}
+	f := strings.SplitN(spec, "-", 2)
+	if len(f) != 2 {
+		return nil, fmt.Errorf("bad maintenance %q, use a daily window like 02:00-03:00", spec)
+	}
+	var err1, err2 error
+	w.start, err1 = parseClock(f[0])
+	w.end, err2 = parseClock(f[1])
+	if err1 != nil || err2 != nil || w.start == w.end {
+		return nil, fmt.Errorf("bad maintenance %q, use a daily window like 02:00-03:00", spec)
+	}
+	return w, nil
+}
+
+// parseDays reads a maintenance-days=Sat,Sun annotation
+func (w *maintenanceWindow) parseDays(spec string) error {
+	for _, d := range strings.Split(spec, ",") {
+		day, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return fmt.Errorf("bad maintenance-days %q, use day names like Sat,Sun", spec)
+		}
+		w.days[day] = true
+	}
+	return nil
+}
+
+// contains reports whether the window is open at t in loc (UTC if nil)
+func (w *maintenanceWindow) contains(t time.Time, loc *time.Location) bool {
+	if loc == nil {
+		loc = time.UTC
+	}
+	t = t.In(loc)
+	now := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.start < w.end {
+		if now < w.start || now >= w.end {
+			return false
+		}
+	} else { // crosses midnight
+		if now >= w.end && now < w.start {
+			return false
+		}
+		if now < w.end {
+			day = (day + 6) % 7 // the window started yesterday
+		}
+	}
+	return w.days == [7]bool{} || w.days[day]
+}
+
+// maintenanceRRs returns the maintenance records for name whose window is open at t,
+// and whether name has maintenance records at all.
+func (z *zone) maintenanceRRs(name string, t time.Time, loc *time.Location) ([]dns.RR, bool) {
+	var open []dns.RR
+	has := false
+	for _, s := range z.scheduled {
+		if s.window == nil || !strings.EqualFold(s.rr.Header().Name, name) || !s.active(t) {
+			continue
+		}
+		has = true
+		if s.window.contains(t, loc) {
+			open = append(open, s.rr)
+		}
+	}
+	return open, has
+}
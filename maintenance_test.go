@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, _ := time.Parse(time.RFC3339, s)
+		return tm
+	}
+	w, err := parseWindow("02:00-03:00")
+	if err != nil {
+		t.Fatalf("parseWindow failed: %s", err.Error())
+	}
+	if !w.contains(at("2015-12-06T02:30:00Z"), nil) || w.contains(at("2015-12-06T03:00:00Z"), nil) {
+		t.Errorf("Expected 02:00-03:00 to contain 02:30 but not 03:00")
+	}
+	denver, err := time.LoadLocation("America/Denver")
+	if err == nil && !w.contains(at("2015-12-06T09:30:00Z"), denver) {
+		t.Errorf("Expected the window in --tz")
+	}
+
+	w, _ = parseWindow("23:00-01:00")
+	if err := w.parseDays("Sat"); err != nil {
+		t.Fatalf("parseDays failed: %s", err.Error())
+	}
+	for tm, want := range map[string]bool{
+		"2015-12-05T23:30:00Z": true,  // Saturday night
+		"2015-12-06T00:30:00Z": true,  // early Sunday, in the window that started Saturday
+		"2015-12-06T23:30:00Z": false, // Sunday night
+		"2015-12-05T12:00:00Z": false,
+	} {
+		if w.contains(at(tm), nil) != want {
+			t.Errorf("23:00-01:00 on Sat at %s: want %v", tm, want)
+		}
+	}
+
+	for _, bad := range []string{"; maintenance=2am", "; maintenance=02:00-02:00", "; maintenance-days=Sat", "; maintenance=02:00-03:00 maintenance-days=Caturday"} {
+		if _, _, err := parseSchedule(bad); err == nil {
+			t.Errorf("parseSchedule accepted %q", bad)
+		}
+	}
+}
+
+func TestMaintenanceRecords(t *testing.T) {
+	now := time.Now().UTC()
+	window := func(from, to time.Duration) string {
+		return now.Add(from).Format("15:04") + "-" + now.Add(to).Format("15:04")
+	}
+	zone := fmt.Sprintf(`$ORIGIN abc.com.
+@	300	IN	SOA	nsa.abc.com. admin.abc.com. ( 2014121700 10800 1200 864000 7200 )
+app	300	IN	A	10.0.0.1
+app	300	IN	CNAME	status.other.net. ; maintenance=%s
+api	300	IN	A	10.0.0.2
+api	300	IN	A	10.0.9.9 ; maintenance=%s
+`, window(-time.Hour, time.Hour), window(2*time.Hour, 3*time.Hour))
+	rrs, err := parseZoneFile("abc.com", zone)
+	if err != nil || len(rrs) != 3 {
+		t.Fatalf("Expected maintenance records left out of parseZoneFile, got %d: %v", len(rrs), err)
+	}
+	c := &config{stats: statsd.NoopClient{}}
+	if err := c.loadZones(map[string]string{"abc.com": zone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	m := testQuery(c, "abc.com", "app.abc.com.", dns.TypeA)
+	if len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Errorf("Expected the maintenance CNAME during the window, got %v", m.Answer)
+	}
+	m = testQuery(c, "abc.com", "api.abc.com.", dns.TypeA)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.0.0.2" {
+		t.Errorf("Expected the regular record outside the window, got %v", m.Answer)
+	}
+	if _, _, cacheable := c.zones["abc.com"].answer(c, dns.Question{Name: "api.abc.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}); cacheable {
+		t.Errorf("Expected names with maintenance records not to be cached")
+	}
+}
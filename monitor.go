@@ -0,0 +1,121 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"net"
+	"strings"
+	"time"
+)
+
+// Monitoring probes, such as load balancer health checks and uptime services asking
+// for the same name every few seconds, are answered like any other query but aren't
+// client traffic. --monitors lists them by source network or address, or by query
+// name, exact or as *.suffix, and their queries are counted under monitorPrefix
+// (monitor.query.answer rather than query.answer, and so on, including the billing
+// counters), left out of the debug log, the stale record report and client
+// classification, so dashboards show real traffic.
+const monitorPrefix = "monitor."
+
+type monitors struct {
+	nets  []*net.IPNet
+	names []string // lower case and fully qualified, *. for a suffix
+}
+
+// parseMonitors parses --monitors, networks, addresses and query names
+func parseMonitors(list string) (*monitors, error) {
+	m := &monitors{}
+	for _, s := range splitList(list) {
+		if strings.ContainsAny(s, ":/") || net.ParseIP(s) != nil {
+			nets, err := parseCIDRs(s)
+			if err != nil {
+				return nil, err
+			}
+			m.nets = append(m.nets, nets...)
+			continue
+		}
+		name := dns.Fqdn(strings.ToLower(s))
+		if _, ok := dns.IsDomainName(strings.TrimPrefix(name, "*.")); !ok {
+			return nil, fmt.Errorf("%s is not a network, address or name", s)
+		}
+		m.names = append(m.names, name)
+	}
+	return m, nil
+}
+
+// matches reports whether req from w is a monitoring probe. It is nil-safe.
+func (m *monitors) matches(w dns.ResponseWriter, req *dns.Msg) bool {
+	if m == nil || len(req.Question) != 1 {
+		return false
+	}
+	if ip := remoteIP(w); ip != nil {
+		for _, n := range m.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	qname := strings.ToLower(req.Question[0].Name)
+	for _, name := range m.names {
+		if name == qname || (strings.HasPrefix(name, "*.") && strings.HasSuffix(qname, name[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// monitorConfig returns a copy of c for answering monitoring probes, counting them
+// under monitorPrefix and keeping them out of the logs and client reports. It is
+// made once, as c.monitor, before the listeners start: copying c for each probe
+// would race with reloads updating it.
+func (c *config) monitorConfig() *config {
+	mc := *c
+	mc.stats = prefixedStats{c.stats, monitorPrefix}
+	mc.debugOn = false
+	mc.access = nil
+	mc.clients = nil
+	mc.dups = nil
+	return &mc
+}
+
+// prefixedStats sends its metrics with a prefix, within the client's own
+type prefixedStats struct {
+	statsd.Statsd
+	prefix string
+}
+
+func (s prefixedStats) Incr(stat string, count int64) error {
+	return s.Statsd.Incr(s.prefix+stat, count)
+}
+func (s prefixedStats) Decr(stat string, count int64) error {
+	return s.Statsd.Decr(s.prefix+stat, count)
+}
+func (s prefixedStats) Timing(stat string, delta int64) error {
+	return s.Statsd.Timing(s.prefix+stat, delta)
+}
+func (s prefixedStats) PrecisionTiming(stat string, delta time.Duration) error {
+	return s.Statsd.PrecisionTiming(s.prefix+stat, delta)
+}
+func (s prefixedStats) Gauge(stat string, value int64) error {
+	return s.Statsd.Gauge(s.prefix+stat, value)
+}
+func (s prefixedStats) GaugeDelta(stat string, value int64) error {
+	return s.Statsd.GaugeDelta(s.prefix+stat, value)
+}
+func (s prefixedStats) Absolute(stat string, value int64) error {
+	return s.Statsd.Absolute(s.prefix+stat, value)
+}
+func (s prefixedStats) Total(stat string, value int64) error {
+	return s.Statsd.Total(s.prefix+stat, value)
+}
+func (s prefixedStats) FGauge(stat string, value float64) error {
+	return s.Statsd.FGauge(s.prefix+stat, value)
+}
+func (s prefixedStats) FGaugeDelta(stat string, value float64) error {
+	return s.Statsd.FGaugeDelta(s.prefix+stat, value)
+}
+func (s prefixedStats) FAbsolute(stat string, value float64) error {
+	return s.Statsd.FAbsolute(s.prefix+stat, value)
+}
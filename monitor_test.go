@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingStats counts the metrics incremented
+type countingStats struct {
+	statsd.NoopClient
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func (s *countingStats) Incr(stat string, count int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[stat] += count
+	return nil
+}
+
+func (s *countingStats) get(stat string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counts[stat]
+}
+
+func TestMonitors(t *testing.T) {
+	stats := &countingStats{counts: map[string]int64{}}
+	c := config{stats: stats, clients: newClientClassifier(time.Minute)}
+	var err error
+	if c.monitors, err = parseMonitors("health.abc.com,*.probe.abc.com"); err != nil {
+		t.Fatalf("parseMonitors failed: %s", err.Error())
+	}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	c.monitor = c.monitorConfig()
+	query := func(name string) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		dns.DefaultServeMux.ServeDNS(&testWriter{}, req)
+	}
+
+	query("health.abc.com.")
+	query("X.Probe.abc.com.")
+	if n := stats.get("query.request"); n != 0 {
+		t.Errorf("Expected monitoring probes left out of query metrics, got %d", n)
+	}
+	if n := stats.get("monitor.query.request"); n != 2 {
+		t.Errorf("Expected 2 monitoring probes counted under monitor., got %d", n)
+	}
+	if len(c.clients.clients) != 0 {
+		t.Errorf("Expected monitoring probes left out of client classification")
+	}
+	query("abc.com.")
+	query("probe.abc.com.") // only names below it
+	if n := stats.get("query.request"); n != 2 || stats.get("usage.abc_com.queries") != 2 || len(c.clients.clients) != 1 {
+		t.Errorf("Expected client queries counted as usual, got %d", n)
+	}
+
+	c.monitors, _ = parseMonitors("127.0.0.0/8") // the test writer's address
+	query("abc.com.")
+	if n := stats.get("monitor.query.request"); n != 3 {
+		t.Errorf("Expected queries from a monitoring network counted under monitor., got %d", n)
+	}
+	if c.stats != stats {
+		t.Errorf("Expected the config's own metrics left alone")
+	}
+
+	for _, bad := range []string{"bad..name", "10.0.0.0/33", "2001:db8::/200"} {
+		if _, err := parseMonitors(bad); err == nil {
+			t.Errorf("Expected an error for --monitors %s", bad)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// checkNames checks the owner names of a zone's records, and the names in their
+// data, against DNS limits. A label longer than 63 bytes or a name longer than 255
+// bytes can't be sent in a reply, so it is an error: the zone isn't loaded, as if
+// it didn't parse, and the version already served stays up. The parser catches
+// most of these, but not relative names that only grow too long with the origin.
+// Characters other than letters, digits, hyphens and underscores, a * label or
+// the / of RFC 2317 reverse zones get a warning, unless escaped as \DDD or \X,
+// since they are usually typos or unencoded international names (use xn-- names).
+func checkNames(rrs []dns.RR) []zoneProblem {
+	problems := []zoneProblem{}
+	seen := map[string]bool{}
+	for _, rr := range rrs {
+		for _, name := range recordNames(rr) {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			labels := nameLabels(name)
+			wire := 1
+			for _, l := range labels {
+				wire += 1 + l.bytes
+				if l.bytes > 63 {
+					problems = append(problems, zoneProblem{"error", name, fmt.Sprintf("label %s is longer than 63 bytes", l.text)})
+				}
+			}
+			if wire > 255 {
+				problems = append(problems, zoneProblem{"error", name, fmt.Sprintf("name is %d bytes long, over 255", wire)})
+			}
+			for _, l := range labels {
+				if c, ok := badLabelChar(l.text); ok {
+					problems = append(problems, zoneProblem{"warning", name, fmt.Sprintf("name has the character %q, escape it or use an xn-- name", c)})
+					break
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// nameLabel is a label of a name in presentation format, and its length on the wire
+type nameLabel struct {
+	text  string
+	bytes int
+}
+
+// nameLabels splits a name in presentation format into labels, counting an escape
+// such as \. or \032 as the single byte it stands for
+func nameLabels(name string) []nameLabel {
+	labels := []nameLabel{}
+	if name == "." {
+		return labels
+	}
+	start, n := 0, 0
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case '\\':
+			if i+3 < len(name) && strings.IndexByte("0123456789", name[i+1]) >= 0 {
+				i += 3
+			} else {
+				i++
+			}
+			n++
+		case '.':
+			labels = append(labels, nameLabel{name[start:i], n})
+			start, n = i+1, 0
+		default:
+			n++
+		}
+	}
+	if start < len(name) {
+		labels = append(labels, nameLabel{name[start:], n})
+	}
+	return labels
+}
+
+// recordNames returns the owner name of rr and the domain names in its data
+func recordNames(rr dns.RR) []string {
+	names := []string{rr.Header().Name}
+	switch rr := rr.(type) {
+	case *dns.NS:
+		names = append(names, rr.Ns)
+	case *dns.CNAME:
+		names = append(names, rr.Target)
+	case *dns.DNAME:
+		names = append(names, rr.Target)
+	case *dns.PTR:
+		names = append(names, rr.Ptr)
+	case *dns.MX:
+		names = append(names, rr.Mx)
+	case *dns.SRV:
+		names = append(names, rr.Target)
+	case *dns.NAPTR:
+		names = append(names, rr.Replacement)
+	case *dns.SOA:
+		names = append(names, rr.Ns, rr.Mbox)
+	}
+	return names
+}
+
+// badLabelChar returns the first character of a label, in presentation format,
+// that isn't usual in a DNS name and isn't escaped
+func badLabelChar(label string) (rune, bool) {
+	if label == "*" {
+		return 0, false
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		switch {
+		case c == '\\':
+			if i+3 < len(label) && strings.IndexByte("0123456789", label[i+1]) >= 0 {
+				i += 3 // \DDD
+			} else {
+				i++ // \X
+			}
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '/':
+		default:
+			r := []rune(label[i:])[0]
+			return r, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"strings"
+	"testing"
+)
+
+func TestCheckNames(t *testing.T) {
+	label := strings.Repeat("b", 63)
+	long := strings.Join([]string{label, label, label, label[:60]}, ".") // too long only with the origin
+
+	rrs, err := parseZoneFile("abc.com", abcZone+`*		IN	A	127.0.0.2
+_dmarc		IN	TXT	"v=DMARC1; p=none"
+0/26		IN	NS	ns.abc.com.
+foo\@bar	IN	A	127.0.0.3
+foo\032bar	IN	A	127.0.0.4
+foo@bar		IN	A	127.0.0.5
+café		IN	MX	10 mail@host.abc.com.
+`)
+	if err != nil {
+		t.Fatalf("parseZoneFile failed: %s", err.Error())
+	}
+	msgs := checkMessages(checkNames(rrs))
+	for _, want := range []string{
+		`warning: foo@bar.abc.com.: name has the character '@'`,
+		`warning: café.abc.com.: name has the character 'é'`,
+		`warning: mail@host.abc.com.: name has the character '@'`,
+	} {
+		if !strings.Contains(msgs, want) {
+			t.Errorf("checkNames missed problem: want: %s, got:\n%s", want, msgs)
+		}
+	}
+	if n := len(strings.Split(msgs, "\n")); n != 3 {
+		t.Errorf("Expected only 3 problems, got:\n%s", msgs)
+	}
+
+	if labels := nameLabels(`a\.b\032c.com.`); len(labels) != 2 || labels[0].bytes != 5 || labels[1].text != "com" {
+		t.Errorf("Expected escapes to count as one byte, got %v", labels)
+	}
+
+	c := config{stats: statsd.NoopClient{}}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	err = c.loadZones(map[string]string{"abc.com": strings.Replace(abcZone, "2014121700", "2014121701", 1) + long + " IN A 127.0.0.6\n"})
+	if err == nil || !strings.Contains(err.Error(), "abc.com") {
+		t.Errorf("Expected a name over 255 bytes to fail the zone, got %v", err)
+	}
+	if c.zones["abc.com"].serial() != 2014121700 {
+		t.Errorf("Expected the old version of the zone to keep serving")
+	}
+	if m := testQuery(&c, "abc.com", "abc.com.", dns.TypeA); len(m.Answer) != 1 {
+		t.Errorf("Expected the old version to answer, got %v", m)
+	}
+}
@@ -2,6 +2,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -12,20 +13,33 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
-	"os/signal"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
-	"syscall"
 	"time"
 )
 
-var version = "0.1.2015111501"
-
 var usage = `neddns: simple authoratative DNS server backed by S3
 
 Usage:
 	neddns [options] <bucket>
+	neddns import-bind [options] --config=<path> <bucket>
+	neddns import-csv [options] [--domain=<name>] <inventory> <bucket>
+	neddns check [options] <zonefile>...
+	neddns encrypt-zone [options] --kms-key=<id> <zonefile>...
+	neddns push [options] [--api-servers=<list>] [--wait=<secs>] <zonefile> <bucket>
+	neddns simulate-diff [options] <old> <new>
+	neddns generate [options] --domain=<name> [--ips=<list>] [--preset=<spec>...] <bucket>
+	neddns caa-report [options] <bucket>
+	neddns audit-amplification [options] [--top=<n>] <bucket>
+	neddns fleet-check [options] --servers=<list> <bucket>
+	neddns gen-testzone [options] --records=<n> [--domain=<name>] [--seed=<n>]
+	neddns install-service [options] <bucket>
+	neddns remove-service
 	neddns -h --help
 	neddns --version
 
@@ -38,37 +52,247 @@ Options:
   -S, --awssecret=<secret>  AWS secret key (or use AWS_SECRET_ACCESS_KEY environemnt variable).
   -R, --region=<region>     AWS region [default: us-east-1].
   -u, --update=<secs>       Frequency to fetch updated zones from S3 in seconds [default: 300].
+  --stale=<secs>            Warn when a zone has not been refreshed from S3 for this many seconds (default: 3x update).
+  --clock-skew=<secs>       Fetch objects again while they were modified within this many seconds of the last fetch, for stores without ETags [default: 60].
   -p, --port=<port>         Listen port [default: 53].
+  --tcp-max=<n>             Maximum concurrent TCP connections [default: 1000].
+  --tcp-per-ip=<n>          Maximum concurrent TCP connections per client address [default: 20].
+  --tcp-idle=<secs>         Close TCP connections idle for this many seconds [default: 10].
+  --upgrade-drain=<secs>    When upgraded in place by a USR2 signal, let open TCP connections finish for this many seconds [default: 30].
+  --fds=<n>                 Open files needed at full load, checked against the limit (default: --tcp-max + 128).
   -f, --prefix=<prefix>     AWS object prefix (such as directory name).
-  -r, --resolver=<host:port>	DNS resolver for CNAME flattening [default: 8.8.8.8:53].
-  -l, --log=<path>          Write to file at this loctation rather than stdout.
+  --as-of=<time>            Serve the versioned bucket as it was at this RFC 3339 time, such as 2015-06-01T14:32:00Z, without writing to it.
+  --tz=<name>               Time zone for maintenance windows, such as America/Denver [default: UTC].
+  --shed-inflight=<n>       Shed load past this many queries in flight, 0 to disable [default: 1000].
+  --shed-latency=<ms>       Shed load past this average query latency in milliseconds, 0 to disable [default: 0].
+  --geoip=<path>            Count queries by client country and continent from this MaxMind DB file.
+  --ecs                     Use the EDNS Client Subnet resolvers send for --geoip and views that allow it.
+  --classify=<secs>         Classify clients as scanners, monitors and so on over windows this long, 0 to disable [default: 60].
+  --dup-window=<ms>         Count queries repeated by a client with the same ID and name within this many milliseconds as duplicates, 0 to disable [default: 0].
+  --dup-log=<n>             Log one in n duplicate queries, 0 for none [default: 0].
+  --monitors=<list>         Count queries from these networks, or for these names (exact or *.suffix), under monitor.* and keep them out of logs and reports, comma separated.
+  --access-sample=<n>       Record one in n answered queries for the stale record report, 0 to disable [default: 100].
+  --hot=<n>                 Precompute packed answers for the n most queried names per zone [default: 100].
+  --outside-zones=<rcode>   Reply to queries for names outside the served zones with REFUSED or SERVFAIL [default: REFUSED].
+  --udp-size=<bytes>        Largest UDP reply to send, and to advertise to EDNS0 clients [default: 1232].
+  --max-answers=<n>         Answer with at most n records of an RRset, rotating through the rest across queries, 0 for all [default: 0].
+  --any=<mode>              Answer ANY queries with every record (full), an RFC 8482 HINFO (hinfo) or one RRset (rrset) [default: full].
+  --cache-file=<path>       Save the flattening and hot answer caches and the secondary zones here on shutdown and restore them at startup.
+  -r, --resolver=<host:port>	DNS resolver for CNAME flattening and SPF checks [default: 8.8.8.8:53].
+  --resolver-conns=<n>      Pipelined TCP connections kept open to the resolver for flattening, 0 for UDP only [default: 2].
+  --flatten-dnssec          Only flatten root CNAMEs to signed targets if the resolver validated them.
+  --resolver-key=<name>     Sign flattening lookups with this one of the --tsig-keys, and only accept replies signed with it.
+  -l, --log=<path>          Write to file at this loctation rather than stdout, or syslog://[host:port] or journald://.
+  --query-log=<url>         Ship a JSON record of each query to s3://bucket/prefix as gzipped objects, or to firehose://<delivery stream>.
+  --query-log-every=<secs>  Ship the query log this often in seconds [default: 60].
+  --query-log-sample=<n>    Log one query in n [default: 1].
   --statsd_server=<host:port>	Statsd server and port - statsd is disabled if empty.
   --statsd_prefix=<prefix>		Prefix to add to statsd metrics [default: neddns].
+  --default-caa=<list>      Serve this CAA policy for zones without one, as CA domains or tag=value.
+  --ns-map=<list>           Replace placeholder nameservers and their glue as zones are served, as placeholder=name, comma separated.
+  --soa-mname=<name>        Serve this primary nameserver in every zone's SOA instead of the zone file's.
+  --soa-rname=<email>       Serve this contact in every zone's SOA, as ops@example.com or ops.example.com.
+  --chaos                   Answer version.bind and version.server CH TXT queries with build info.
+  --dot=<addr>              Also serve DNS over TLS on this host:port, such as :853.
+  --dot-cert=<path>         PEM certificate chain for --dot.
+  --dot-key=<path>          PEM private key for --dot.
+  --dot-min-tls=<version>   Minimum TLS version for --dot, 1.2 or 1.3 [default: 1.2].
+  --dot-client-ca=<path>    Only accept --dot clients with a certificate signed by a CA in this PEM file.
+  --dot-ticket-key=<key>    Session ticket secret shared by a fleet, or an ssm:// or secretsmanager:// reference.
+  --doq=<addr>              Also serve DNS over QUIC on this host:port with the --dot-* settings (experimental).
+  --local=<addr>            Also serve trusted local clients on a unix socket path or loopback host:port.
+  --admin-cidrs=<list>      Networks that get answers from staged zone versions, comma separated.
+  --private-clients=<list>  Networks that get answers from private-use zones such as .internal, comma separated, or any (default: private and loopback addresses).
+  --answer-source           Tell admin networks which zone version and code path answered, on request.
+  --tsig-keys=<list>        TSIG keys for signed queries, views, transfers, NOTIFYs and flattening, as [algorithm:]name=secret, comma separated.
+  --api=<host:port>         Serve the admin HTTP API on this address - disabled if empty.
+  --api-token=<token>       Require this bearer token on the admin API, or an ssm:// or secretsmanager:// reference to it.
+  --plugins=<list>          Load these Go plugins with query hooks, comma separated.
+  --alert-hooks=<list>      Send alerts on critical errors to these webhook URLs, pagerduty://<routing key> or secret references, comma separated.
+  --alert-after=<secs>      Alert when the bucket has been unreachable for this many seconds [default: 900].
+  --webhooks=<list>         POST a JSON summary of each zone reload to these URLs or ssm:// or secretsmanager:// references, comma separated.
+  --secret-refresh=<secs>   Resolve ssm:// and secretsmanager:// secrets again this often in seconds [default: 3600].
+  --allow-notify=<list>     Reload zones on a DNS NOTIFY from these networks, comma separated.
+  --notify-keys=<list>      Only accept a NOTIFY signed with one of these --tsig-keys, comma separated.
+  --also-notify=<list>      Send DNS NOTIFY to these secondaries when a zone's serial changes, as address[:port], comma separated.
+  --secondary=<list>        Also serve zones transferred from primaries, as zone=address[:port] per primary, comma separated. A bucket of - serves only these.
+  --transfer-key=<name>     Sign SOA queries and transfers to --secondary primaries with this one of the --tsig-keys.
+  --self-probe=<list>       Query these public addresses of this server, as host[:port], over UDP and TCP for reachability and latency, comma separated.
+  --probe-names=<list>      Canary names the self-probe asks for A records, comma separated (default: the SOA of the first zone).
+  --probe-every=<secs>      Self-probe this often in seconds [default: 60].
+  --probe-api=<url>         Also have this HTTP service probe the --self-probe addresses from outside.
+  --ns-check=<secs>         Check this often in seconds that each zone is delegated to this deployment, 0 to disable [default: 0].
+  --expected-ns=<list>      Nameservers a zone must be delegated to, one of them at least, for --ns-check, comma separated.
+  --ns-addrs=<list>         Addresses of this deployment; a zone delegated to a nameserver with one of them passes --ns-check, comma separated.
+  --shadow=<addr>           Answer queries mirrored to this UDP address without replying, comparing the answers with --shadow-compare's.
+  --shadow-compare=<host:port>	The legacy nameserver shadow reads are compared with.
+  --zsk-rollover=<days>     Roll DNSSEC zone signing keys over this often, storing them in the bucket, on one instance only - 0 to disable [default: 0].
+  --sign-audit=<mins>       Log DNSSEC signing and validate the zones' own signatures this often in minutes, 0 to disable [default: 0].
+  --sandbox                 Restrict the process after startup (seccomp, pledge/unveil or capsicum).
+  --chroot=<dir>            Chroot to this directory after startup (needs root).
+  --readonly                Never write to the filesystem - startup fails if an option would.
+  --config=<path>           BIND named.conf to read zones from (import-bind).
+  -n, --dry-run             Show what would be uploaded without writing to S3 (import-bind, import-csv).
+  --domain=<name>           Domain to generate a zone for (generate, gen-testzone writes test.example by default), or to import records into (import-csv).
+  --records=<n>             Number of records in the synthetic zone (gen-testzone).
+  --seed=<n>                Random seed, the same seed gives the same zone (gen-testzone) [default: 1].
+  --kms-key=<id>            KMS key ID, ARN or alias to encrypt zones under (encrypt-zone, push).
+  --ips=<list>              Comma separated addresses to serve for the domain (generate).
+  --preset=<spec>           Add provider records, as name:key=value,... e.g. ses:dkim=tok1 tok2 tok3 (generate).
+  --mx=<preset>             Mail provider preset for generated zones: none, google, microsoft [default: none].
+  --ns=<list>               Comma separated nameservers for generated zones (generate, import-csv and API).
+  --overwrite               Replace an existing zone (generate, import-csv).
+  --top=<n>                 Number of questions to report (audit-amplification) [default: 20].
+  --servers=<list>          neddns instances to compare, as host[:port], comma separated (fleet-check).
+  --api-servers=<list>      Admin API URLs of the servers to reload and wait for, comma separated (push).
+  --wait=<secs>             Seconds to wait for --api-servers to serve the pushed serial (push) [default: 60].
   -d, --debug               Enable debugging output.
   -h, --help                Show this screen.
   --version                 Show version.
 `
 
 type zone struct {
-	name string
-	rrs  []dns.RR
+	name   string
+	view   string // for a view of the zone, see selectView
+	source string // bucket key the zone was loaded from
+	rrs    []dns.RR
+	policy *zonePolicy
+	hot    *hotCache // nil when --hot=0
+	pages  *answerPages
+	stale  int32 // 1 once checkStale finds it stale, read atomically
+
+	caaInjected bool // rrs include the --default-caa policy
+
+	base      []dns.RR // records without a schedule, when scheduled is set
+	scheduled []scheduledRR
+
+	keys       *zoneKeys              // DNSSEC keys, when the zone is signed
+	sigs       map[hotKey]signedRRset // by lower cased name, signed or from the zone file
+	sigExpires time.Time
+	nsecs      []*dns.NSEC  // in canonical order, for denial of existence
+	nsec3s     []*dns.NSEC3 // in hash order, instead of nsecs
 }
 
 type config struct {
-	awsKeyId     string
-	awsSecret    string
-	bucket       string
-	port         string
-	logfile      string
-	region       string
-	prefix       string
-	resolver     string
-	debugOn      bool
-	lastUpdate   time.Time
-	update       time.Duration
-	statsdServer string
-	statsdPrefix string
-	stats        statsd.Statsd
+	command       string
+	awsKeyId      string
+	awsSecret     string
+	bucket        string
+	port          string
+	logfile       string
+	region        string
+	prefix        string
+	resolver      string
+	debugOn       bool
+	lastUpdate    time.Time
+	update        time.Duration
+	staleAfter    time.Duration
+	synced        map[string]time.Time
+	fetched       map[string]fetchedObject // by bucket key, see objectChanged
+	pending       map[string]fetchedObject // fetched but not yet loaded, see markLoaded
+	clockSkew     time.Duration
+	staleZones    map[string]bool
+	statsdServer  string
+	statsdPrefix  string
+	apiAddr       string
+	localAddr     string
+	hotSize       int
+	anyAnswers    string // --any, see anyMode
+	outsideFail   bool   // SERVFAIL rather than REFUSED for queries outside the served zones
+	udpSize       int    // EDNS0 payload size, see edns.go
+	maxAnswers    int    // records of an RRset per answer, see answerlimit.go
+	ecs           bool   // use EDNS Client Subnet, see ecs.go
+	listeners     *listenerHealth
+	queryLog      *queryLog    // nil without --query-log
+	dups          *dupDetector // nil without --dup-window
+	tcpMax        int
+	tcpPerIP      int
+	tcpIdle       time.Duration
+	upgradeDrain  time.Duration // see upgrade
+	handoff       *handoff      // listening sockets, see upgrade.go
+	tcp           *tcpConns
+	fds           uint64
+	tz            *time.Location // for maintenance windows
+	shed          *loadShedder
+	access        *accessStats      // nil when --access-sample=0
+	clients       *clientClassifier // nil when --classify=0
+	monitors      *monitors         // nil without --monitors
+	monitor       *config           // answers the probes of monitors, see monitorConfig
+	geo           *geoIP            // nil without --geoip
+	flat          *flatCache
+	cacheFile     string
+	cacheFd       *os.File
+	staging       *stagedZones
+	adminNets     []*net.IPNet  // clients that see staged zones
+	privateNets   []*net.IPNet  // clients that see private-use zones, nil for the defaults
+	resolvers     *resolverPool // nil when --resolver-conns=0
+	flattenDNSSEC bool          // see flatdnssec.go
+	answerSource  bool          // tag replies for admin clients that ask, see answersource.go
+	dotAddr       string
+	doqAddr       string
+	dot           *tls.Config // for DoT and DoQ
+	views         *viewZones
+	tsig          map[string]tsigKey // by key name
+	resolverKey   string             // signs flattening lookups, see tsig.go
+	apiTokenRef   string
+	apiToken      *secret
+	webhookRefs   []string
+	webhooks      []*secret
+	alertRefs     []string
+	alertAfter    time.Duration
+	alerts        *alerter // nil without --alert-hooks
+	pluginPaths   []string
+	plugins       *pluginHooks         // nil without --plugins
+	keyFiles      map[string]string    // DNSSEC key files from the bucket, by key
+	dnssecKeys    map[string]*zoneKeys // by zone
+	zskRollover   time.Duration        // ZSK lifetime, 0 when keys aren't rolled
+	signAudit     *signAudit           // nil without --sign-audit
+	alsoNotify    []string             // secondaries sent a NOTIFY for every zone
+	notifyACL     *transferACL         // who may send a NOTIFY, nil to refuse them all
+	secondaries   *secondaries         // nil without --secondary
+	transferKey   string               // signs transfers from primaries
+	asOf          time.Time            // serve the bucket as of this time, zero for now
+	probe         *selfProbe           // nil without --self-probe
+	delegations   *delegationCheck     // nil without --ns-check
+	shadowAddr    string               // where mirrored queries arrive
+	shadow        *shadowRead          // nil without --shadow
+	doUpdate      chan bool            // reload requests, see triggerReload
+	secrets       []*secret            // references to refresh
+	secretEvery   time.Duration
+	awsEndpoint   string // overrides the AWS JSON API endpoint, for tests
+	dataKeys      *dataKeyCache
+	kmsKey        string // encrypt-zone, push
+	pushServers   []string
+	pushWait      time.Duration
+	reloads       *reloadStatus
+	chaosOn       bool
+	startTime     time.Time
+	backend       zoneStore // for API writes
+	nameservers   []string
+	defaultCAA    []*dns.CAA
+	nsMap         map[string]string // placeholder nameserver to served nameserver
+	soaMname      string            // served in place of each zone's SOA MNAME, if set
+	soaRname      string
+	genParams     zoneParams
+	sandboxOn     bool
+	chrootDir     string
+	readOnly      bool
+	logFile       *os.File
+	logSink       logSink
+	stats         statsd.Statsd
+	zones         map[string]*zone
+	policies      map[string]*zonePolicy // merged from policyLayers, see loadPolicies
+	policyLayers  map[string]string      // policy objects by zone, zone group or *
+	templates     map[string]*zoneTemplate
+	explicit      map[string]bool // zones loaded from their own zone file, see expandTemplates
+	bindConfig    string
+	inventory     string // CSV or Terraform state file, import-csv
+	dryRun        bool
+	auditTop      int      // questions to report, audit-amplification
+	fleetServers  []string // servers to compare, fleet-check
+	testRecords   int      // gen-testzone
+	testSeed      int64
+	zoneFiles     []string
 }
 
 func main() {
@@ -77,13 +301,117 @@ func main() {
 		log.Fatalf("Error parsing arguments: %s", err.Error())
 	}
 
-	if len(c.logfile) > 0 {
+	if isLogURL(c.logfile) {
+		if err := c.setupLogSink(); err != nil {
+			log.Fatalf("Error opening log destination %s: %v", c.logfile, err)
+		}
+	} else if len(c.logfile) > 0 {
 		logfile, err := os.OpenFile(c.logfile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
 		if err != nil {
 			log.Fatalf("Error opening log file %s: %v", c.logfile, err)
 		}
 		defer logfile.Close()
 		log.SetOutput(logfile)
+		c.logFile = logfile
+	}
+	if c.command == "check" {
+		if !c.checkZones() {
+			os.Exit(1)
+		}
+		return
+	}
+	if c.command == "encrypt-zone" {
+		c.stats = statsd.NoopClient{}
+		if err := c.encryptZoneFiles(c.zoneFiles, c.kmsKey); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if c.command == "push" {
+		c.stats = statsd.NoopClient{}
+		if len(c.apiTokenRef) > 0 {
+			if c.apiToken, err = c.newSecret(c.apiTokenRef); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := c.pushCommand(s3getter{region: c.region, bucket: c.bucket, prefix: c.prefix}, c.zoneFiles[0], c.pushServers, c.pushWait); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if c.command == "simulate-diff" {
+		changed, err := c.simulateDiff(c.zoneFiles[0], c.zoneFiles[1])
+		if err != nil {
+			log.Print(err)
+			os.Exit(2)
+		}
+		if changed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if c.command == "generate" {
+		if err := c.generateCommand(s3getter{region: c.region, bucket: c.bucket, prefix: c.prefix}); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if c.command == "caa-report" {
+		c.stats = statsd.NoopClient{}
+		if _, err := c.caaReport(s3getter{region: c.region, bucket: c.bucket, prefix: c.prefix}); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if c.command == "gen-testzone" {
+		if err := genTestZone(os.Stdout, c.genParams.Domain, c.testRecords, c.testSeed); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if c.command == "audit-amplification" {
+		c.stats = statsd.NoopClient{}
+		if _, err := c.auditAmplification(s3getter{region: c.region, bucket: c.bucket, prefix: c.prefix}, c.auditTop); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if c.command == "fleet-check" {
+		c.stats = statsd.NoopClient{}
+		problems, err := c.fleetCheckCommand(s3getter{region: c.region, bucket: c.bucket, prefix: c.prefix}, c.fleetServers)
+		if err != nil {
+			log.Print(err)
+			os.Exit(2)
+		}
+		if problems > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if c.command == "install-service" {
+		if err := installService(serviceArgs(os.Args[1:])); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if c.command == "remove-service" {
+		if err := removeService(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if c.command == "import-bind" {
+		err := c.importBind(s3getter{region: c.region, bucket: c.bucket, prefix: c.prefix})
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if c.command == "import-csv" {
+		if err := c.importInventory(s3getter{region: c.region, bucket: c.bucket, prefix: c.prefix}); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 	if len(c.statsdServer) > 0 {
 		c.stats = statsd.NewStatsdClient(c.statsdServer, c.statsdPrefix)
@@ -94,27 +422,128 @@ func main() {
 		c.stats = statsd.NoopClient{}
 	}
 
-	getter := s3getter{region: c.region, bucket: c.bucket, prefix: c.prefix}
+	if len(c.apiTokenRef) > 0 {
+		if c.apiToken, err = c.newSecret(c.apiTokenRef); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, ref := range c.webhookRefs {
+		hook, err := c.newSecret(ref)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := checkWebhook(hook.get()); err != nil {
+			log.Fatalf("invalid --webhooks: %s", err.Error())
+		}
+		c.webhooks = append(c.webhooks, hook)
+	}
+	if len(c.alertRefs) > 0 {
+		hooks := []*secret{}
+		for _, ref := range c.alertRefs {
+			hook, err := c.newSecret(ref)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := checkAlertHook(hook.get()); err != nil {
+				log.Fatalf("invalid --alert-hooks: %s", err.Error())
+			}
+			hooks = append(hooks, hook)
+		}
+		c.alerts = newAlerter(hooks, c.alertAfter)
+	}
+	if len(c.pluginPaths) > 0 {
+		if c.plugins, err = loadPlugins(c.pluginPaths); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if c.clients != nil {
+		go c.classifyClients()
+	}
+	if len(c.secrets) > 0 {
+		go func() {
+			for range time.Tick(c.secretEvery) {
+				c.refreshSecrets()
+			}
+		}()
+	}
+
+	var getter zoneStore = s3getter{region: c.region, bucket: c.bucket, prefix: c.prefix}
+	if c.bucket == noBucket {
+		getter = emptyBucket{}
+	} else if !c.asOf.IsZero() {
+		getter = newAsOfGetter(s3getter{region: c.region, bucket: c.bucket, prefix: c.prefix}, c.asOf)
+		log.Printf("Serving bucket %s as of %s", c.bucket, c.asOf.Format(asOfLayout))
+	} else {
+		c.backend = getter
+	}
+	if c.handoff, err = inheritHandoff(); err != nil {
+		log.Fatalf("Error taking over listeners: %s", err.Error())
+	}
+	if err := c.preflight(getter); err != nil {
+		log.Fatal(err)
+	}
 	c.debug("Fetching zones...")
 	z, err := c.getZones(getter)
 	if err != nil {
+		c.alerts.alertNow(&c, alertBackend, "bucket", "fetching zones at startup: "+err.Error())
 		log.Fatal(err)
 	}
 	c.stats.Gauge("zones", int64(len(z)))
 	c.debug(fmt.Sprintf("Fetched %d zones...", len(z)))
 
 	c.debug("Loading zones...")
+	c.flat = &flatCache{}
 	err = c.loadZones(z)
 	if err != nil {
+		c.alerts.alertNow(&c, alertZoneLoad, err.Error(), err.Error())
 		log.Fatal(err)
 	}
+	if len(c.cacheFile) > 0 {
+		if err := c.openCache(); err != nil {
+			log.Fatalf("Error opening cache file %s: %v", c.cacheFile, err)
+		}
+	}
 	c.registerVersionHandler()
+	c.doUpdate = make(chan bool, 1) // before the listeners, for NOTIFY
+	if c.monitors != nil {
+		c.monitor = c.monitorConfig()
+	}
 	c.debug("Starting server...")
 	c.startServer()
 	log.Printf("DNS server running on TCP/UDP port %s (v%s)", c.port, version)
+	if len(c.localAddr) > 0 {
+		if err := c.startLocal(); err != nil {
+			c.listenerFailed("local", err)
+		}
+	}
+	if c.shadow != nil {
+		if err := c.startShadow(c.shadowAddr); err != nil {
+			c.listenerFailed("shadow", err)
+		}
+	}
 	c.stats.Incr("started", 1)
 
-	doUpdate := make(chan bool)
+	doUpdate := c.doUpdate
+	c.reloads = &reloadStatus{}
+	go c.refreshSignatures()
+	if c.zskRollover > 0 {
+		go c.rollKeys(getter)
+	}
+	if c.signAudit != nil {
+		go c.auditSignatures()
+	}
+	if c.secondaries != nil {
+		go c.runSecondaries()
+	}
+	if c.probe != nil {
+		go c.runProbes()
+	}
+	if c.delegations != nil {
+		go c.runDelegationChecks()
+	}
+	if c.queryLog != nil {
+		go c.runQueryLog()
+	}
 	go func() {
 		for {
 			select {
@@ -123,59 +552,112 @@ func main() {
 			case <-time.After(c.update):
 				c.debug("Update timeout... fetching updating zones")
 			}
-			z, err := c.getZones(getter)
-			if err != nil {
-				log.Fatal(err)
-			}
-			c.debug(fmt.Sprintf("Fetched %d updated zones", len(z)))
-			if len(z) > 0 {
-				c.stats.Incr("zoneupdates", int64(len(z)))
-				c.debug(fmt.Sprintf("Reloading %d zones now", len(z)))
-				err = c.loadZones(z)
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
-			c.debug("Updated zones successfully")
+			c.reloadZones(getter)
 		}
 	}()
 
-	sig := make(chan os.Signal)
-	signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	if len(c.apiAddr) > 0 {
+		c.startAPI(doUpdate)
+	}
+	if len(c.chrootDir) > 0 {
+		if err := c.chroot(); err != nil {
+			log.Fatalf("Error entering chroot: %s", err.Error())
+		}
+	}
+	if c.sandboxOn {
+		if err := c.sandbox(); err != nil {
+			log.Fatalf("Error enabling sandbox: %s", err.Error())
+		}
+	}
+	c.signalReady()
+	if runService(doUpdate) { // running as a Windows service, returns once stopped
+		c.saveCache()
+		c.queryLog.flush(&c, time.Now())
+		return
+	}
+
+	sig := make(chan os.Signal, 1)
+	notifySignals(sig)
 	for {
 		select {
 		case s := <-sig:
-			if s == syscall.SIGHUP {
-				doUpdate <- true
+			if isReloadSignal(s) {
+				c.triggerReload(doUpdate)
+			} else if isUpgradeSignal(s) {
+				go c.upgrade()
 			} else {
+				c.saveCache()
+				c.queryLog.flush(&c, time.Now())
 				log.Fatalf("Signal (%d) received, stopping", s)
 			}
 		}
 	}
 }
 
+// serviceArgs returns our command line without the install-service command, for
+// the service to start the server with. A relative log path is made absolute since
+// services do not start in the current directory.
+func serviceArgs(args []string) []string {
+	out := []string{}
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "install-service":
+			continue
+		case (a == "-l" || a == "--log") && i+1 < len(args):
+			i++
+			out = append(out, a, absPath(args[i]))
+			continue
+		case strings.HasPrefix(a, "--log="):
+			a = "--log=" + absPath(strings.TrimPrefix(a, "--log="))
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+func absPath(p string) string {
+	if isLogURL(p) {
+		return p
+	}
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+	return p
+}
+
 // type zoneGetter interface abstracts calls to AWS S3
 type zoneGetter interface {
 	ListZones() ([]zoneFile, error)
 	GetZone(string) (io.ReadCloser, error)
 }
 
+// type zonePutter interface abstracts uploads to AWS S3
+type zonePutter interface {
+	PutZone(key string, contents string) error
+}
+
 type zoneFile struct {
 	Key          string
 	LastModified time.Time
+	ETag         string // changes with the contents, empty if the store has none
 }
 
 func (c *config) getZones(getter zoneGetter) (map[string]string, error) {
 	zones := map[string]string{}
+	now := time.Now()
 	resp, err := getter.ListZones()
 	if err != nil {
 		return zones, err
 	}
+	fetched := map[string]fetchedObject{}
+	listed := []string{}
 	for _, k := range resp {
 		if k.Key == c.prefix {
 			continue
 		}
-		if k.LastModified.Before(c.lastUpdate.Add(-1 * time.Minute)) { // accomodate clock skew
+		listed = append(listed, strings.TrimPrefix(k.Key, c.prefix))
+		if !c.objectChanged(k) {
 			continue
 		}
 		zoneData, err := getter.GetZone(k.Key)
@@ -186,138 +668,563 @@ func (c *config) getZones(getter zoneGetter) (map[string]string, error) {
 		if err != nil {
 			return zones, err
 		}
-		zones[strings.TrimPrefix(k.Key, c.prefix)] = string(b)
+		name := strings.TrimPrefix(k.Key, c.prefix)
+		contents := string(b)
+		if isEncryptedZone(b) {
+			if contents, err = c.decryptZone(name, b); err != nil {
+				return zones, err
+			}
+		}
+		zones[name] = contents
+		fetched[k.Key] = fetchedObject{k, now}
 	}
-	c.lastUpdate = time.Now()
+	c.lastUpdate = now
+	c.pending = fetched // marked fetched by loadZones once they load
+	c.markFetched(nil, resp)
+	c.markSynced(listed, c.lastUpdate)
 	return zones, nil
 }
 
 func (c *config) loadZones(zones map[string]string) error {
-	for n, f := range zones {
-		c.debug(fmt.Sprintf("Parsing zone %s", n))
-		z := zone{name: n, rrs: []dns.RR{}}
-		for t := range dns.ParseZone(strings.NewReader(f), n, n) {
-			if t.Error != nil {
-				log.Fatalf("Error parsing zone %s: %s", n, t.Error)
+	before := c.servingZones()
+	sources := c.expandTemplates(zones)
+	changed, failed := c.loadPolicies(zones)
+	keysChanged, keysFailed := c.loadKeys(zones)
+	failed = append(failed, keysFailed...)
+	failed = append(failed, c.loadViews(zones)...)
+	for _, n := range keysChanged {
+		if !contains(changed, n) {
+			changed = append(changed, n)
+		}
+	}
+	for n, p := range c.parseZones(zones) {
+		if p.err != nil {
+			log.Print(p.err)
+			failed = append(failed, n)
+			continue
+		}
+		source, ok := sources[n]
+		if !ok {
+			source = n
+		}
+		z := &zone{name: n, source: source, rrs: p.rrs, base: p.rrs, scheduled: p.scheduled, policy: c.policyFor(n)}
+		if _, serving := c.zones[n]; serving && z.policy != nil && z.policy.Staged {
+			c.stageZone(z)
+			continue
+		}
+		if c.staging.take(n) != nil {
+			c.debug(fmt.Sprintf("Dropped staged version of zone %s, replaced by a new version", n))
+		}
+		c.registerZone(z)
+	}
+	for _, n := range changed { // policy updated without a new zone file
+		c.updateViewPolicies(n)
+		if z, ok := c.zones[n]; ok {
+			updated := *z
+			updated.policy = c.policies[n]
+			if updated.base != nil { // start over from the zone file, the old policy may have dropped records
+				updated.rrs, _ = updated.activeRRs(time.Now())
+				updated.caaInjected = false
 			}
-			z.rrs = append(z.rrs, t.RR)
+			c.registerZone(&updated)
 		}
-		dns.HandleFunc(n, func(w dns.ResponseWriter, req *dns.Msg) {
-			z.zoneHandler(c, w, req)
-		})
-		c.debug(fmt.Sprintf("Registered handler for zone %s", n))
+	}
+	c.notifySecondaries(before)
+	c.markLoaded(failed, sources)
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("Error parsing zones: %s", strings.Join(failed, ", "))
 	}
 	return nil
 }
 
+func (c *config) registerZone(z *zone) {
+	if c.zones == nil {
+		c.zones = map[string]*zone{}
+	}
+	c.zones[z.name] = z
+	if len(z.scheduled) > 0 {
+		c.scheduleZone(z)
+	}
+	c.applyPolicy(z)
+	z.hot = nil
+	z.pages = &answerPages{} // see answerlimit.go
+	if c.hotSize > 0 {
+		z.hot = newHotCache(z, c.hotSize)
+	}
+	private := len(privateUse(z.name)) > 0
+	dns.HandleFunc(z.name, func(w dns.ResponseWriter, req *dns.Msg) {
+		c := c
+		w = c.queryLogWriter(w, z.name, req)
+		if c.badVersion(w, req) {
+			return
+		}
+		ecs := c.clientSubnet(req)
+		if ecs != nil {
+			c.stats.Incr("query.ecs", 1)
+		}
+		w = c.ednsWriter(w, req, ecs)
+		if c.monitor != nil && c.monitors.matches(w, req) {
+			c = c.monitor
+		}
+		c.dups.observe(c, w, req, time.Now())
+		if private && c.refusePrivate(w, req) {
+			return
+		}
+		if !c.checkTSIG(w, req) {
+			return
+		}
+		if key := c.tsigKeyName(w, req); len(key) > 0 {
+			c.stats.Incr("tsig.verified", 1)
+			w = &signingWriter{ResponseWriter: w, key: key, algorithm: c.tsig[key].algorithm}
+		}
+		if name, view := c.selectView(z, w, req, ecs); view != nil {
+			c.stats.Incr("query.view."+name, 1)
+			view.zoneHandler(c, w, req)
+			return
+		}
+		if staged := c.stagedView(z.name, w); staged != nil {
+			c.stats.Incr("query.staged", 1)
+			staged.zoneHandler(c, w, req)
+			return
+		}
+		z.zoneHandler(c, w, req)
+	})
+	c.debug(fmt.Sprintf("Registered handler for zone %s", z.name))
+}
+
+// applyPolicy filters or adds records as the zone policy and defaults say.
+func (c *config) applyPolicy(z *zone) {
+	c.rewriteNS(z)
+	c.rewriteSOA(z) // after rewriteNS, so --soa-mname wins
+	c.clampTTLs(z)
+	if z.policy != nil && z.policy.DelegationOnly {
+		var dropped []dns.RR
+		z.rrs, dropped = delegationOnly(z.name, z.rrs)
+		if len(dropped) > 0 {
+			names := []string{}
+			for i, rr := range dropped {
+				if i == 5 {
+					names = append(names, "...")
+					break
+				}
+				names = append(names, rr.Header().Name+" "+dns.Type(rr.Header().Rrtype).String())
+			}
+			log.Printf("Warning: zone %s is delegation-only, not serving %d records: %s", z.name, len(dropped), strings.Join(names, ", "))
+			c.stats.Incr("zones.delegationonly.dropped", int64(len(dropped)))
+		}
+	} else {
+		c.injectCAA(z)
+	}
+	c.signZone(z) // last, to sign the records as served
+}
+
+func parseZoneFile(name, contents string) ([]dns.RR, error) {
+	rrs, scheduled, err := parseZone(name, contents)
+	for _, s := range scheduled {
+		if s.window == nil { // maintenance records replace others, so they'd look like conflicts
+			rrs = append(rrs, s.rr)
+		}
+	}
+	return rrs, err
+}
+
+// parseZone parses a zone file, separating out records with a schedule annotation.
+func parseZone(name, contents string) ([]dns.RR, []scheduledRR, error) {
+	rrs := []dns.RR{}
+	scheduled := []scheduledRR{}
+	contents, generic, err := expandGenericTypes(contents)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error parsing zone %s: %s", name, err.Error())
+	}
+	tokens := dns.ParseZone(strings.NewReader(contents), name, name)
+	defer func() {
+		for range tokens { // let the parser finish after an early return
+		}
+	}()
+	for t := range tokens {
+		if t.Error != nil {
+			return nil, nil, fmt.Errorf("Error parsing zone %s: %s", name, t.Error)
+		}
+		if r, ok := t.RR.(*dns.RFC3597); ok && r.Hdr.Rrtype == genericPlaceholder && len(generic) > 0 {
+			if t.RR, err = fromGeneric(r, generic[0]); err != nil {
+				return nil, nil, fmt.Errorf("Error parsing zone %s: %s: %s", name, r.Hdr.Name, err.Error())
+			}
+			generic = generic[1:]
+		}
+		s, ok, err := parseSchedule(t.Comment)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error parsing zone %s: %s: %s", name, t.RR.Header().Name, err.Error())
+		}
+		if ok {
+			s.rr = t.RR
+			scheduled = append(scheduled, s)
+			continue
+		}
+		rrs = append(rrs, t.RR)
+	}
+	return rrs, scheduled, nil
+}
+
 func (z *zone) zoneHandler(c *config, w dns.ResponseWriter, req *dns.Msg) {
 	c.stats.Incr("query.request", 1)
+	c.geo.count(c, c.clientIP(w, req))
+	shed, done := c.shedBegin()
+	defer done()
+	if c.isLocal(w) {
+		shed = shedNone // sidecars are trusted and shouldn't be starved
+	}
 	m := new(dns.Msg)
 	m.SetReply(req)
 	m.Authoritative = true
 	m.Answer = []dns.RR{}
 	questions := []string{}
-	answers := []string{}
 	if len(req.Question) != 1 {
 		c.stats.Incr("query.error", 1)
 		log.Printf("Warning: len(req.Question) != 1")
 		return
 	}
+	if req.Opcode == dns.OpcodeNotify {
+		c.notifyHandler(w, req)
+		return
+	}
 	q := req.Question[0]
-	questions = append(questions, fmt.Sprintf("%s[%s]", q.Name, dns.TypeToString[q.Qtype]))
+	questions = append(questions, fmt.Sprintf("%s[%s]", q.Name, dns.Type(q.Qtype).String()))
 	if q.Qclass != uint16(dns.ClassINET) {
 		c.stats.Incr("query.error", 1)
 		log.Printf("Warning: skipping unhandled class: %s", dns.ClassToString[q.Qclass])
 		return
 	}
-	for _, record := range z.rrs {
-		h := record.Header()
-		if q.Name != h.Name {
-			continue
+	c.stats.Incr("usage."+statName(z.name)+".queries", 1) // for billing
+	if isTransfer(q) {
+		z.transfer(c, w, req)
+		return
+	}
+	if !c.isLocal(w) && z.policy.rateLimit().limitQuery(c, w, req, z.name) {
+		return
+	}
+	if q.Qtype == dns.TypeCAA {
+		c.stats.Incr("query.caa", 1)
+		if z.caaInjected {
+			c.stats.Incr("query.caa.default", 1)
 		}
-		txt := record.String()
-		if q.Qtype == dns.TypeA && h.Rrtype == dns.TypeCNAME { // special handling for A queries w/CNAME results
-			if q.Name == dns.Fqdn(z.name) { // flatten root CNAME
-				flat, err := c.flattenCNAME(record.(*dns.CNAME))
-				if err != nil || flat == nil {
-					log.Printf("flattenCNAME error: %s", err.Error())
-				} else {
-					for _, record := range flat {
-						m.Answer = append(m.Answer, record)
-						answers = append(answers, "(FLAT)"+record.String())
-					}
-				}
-				continue
-			} // don't flatten other CNAMEs for now
-		} else if q.Qtype != h.Rrtype && q.Qtype != dns.TypeANY { // skip RRs that don't match
-			continue
+	}
+	if shed >= shedDegraded && q.Qtype == dns.TypeANY {
+		c.shedQuery("any")
+		return
+	}
+	rule := z.policy.qtypeRule(q.Qtype)
+	if rule.refuseQuery(c, w, req) {
+		return
+	}
+	tag := c.answerSourceRequested(w, req)
+	if reply := c.plugins.runPreQuery(c, w, req); reply != nil {
+		w.WriteMsg(reply)
+		return
+	}
+	if f := z.policy.forwardRule(q.Name); f != nil {
+		var resp *dns.Msg
+		var err error
+		if shed >= shedDegraded {
+			c.shedQuery("forward")
+		} else if resp, err = c.forward(f, req); err != nil {
+			c.stats.Incr("query.error", 1)
 		}
-		m.Answer = append(m.Answer, record)
-		answers = append(answers, txt)
+		if resp == nil {
+			m.SetRcode(req, dns.RcodeServerFailure)
+			m.Authoritative = false
+			if shed >= shedDegraded {
+				c.extendedError(req, m, edeOther, "shedding load")
+			} else {
+				c.extendedError(req, m, edeNetworkError, "forwarding failed")
+			}
+			w.WriteMsg(m)
+			return
+		}
+		c.debug(fmt.Sprintf("Query [%s] %s -> (FORWARD %s)", w.RemoteAddr().String(), strings.Join(questions, ","), f.Zone))
+		c.stats.Incr("query.forward", 1)
+		if tag {
+			z.tagAnswerSource(req, resp, "forward")
+		}
+		c.plugins.runPreResponse(c, w, req, resp)
+		w.WriteMsg(resp)
+		return
+	}
+	do := dnssecOK(req)
+	if !tag && !do && !c.plugins.rewrites() && !z.isStale() && z.hot.serve(c, w, req) { // tagged, signed, stale and plugin replies are built, as packed ones can't be changed
+		return
+	}
+	if shed >= shedDrop {
+		c.shedQuery("dropped")
+		return
+	}
+	if shed >= shedDegraded && q.Qtype == dns.TypeA && strings.EqualFold(q.Name, dns.Fqdn(z.name)) && z.hasApexCNAME() {
+		c.shedQuery("flatten")
+		m.SetRcode(req, dns.RcodeServerFailure)
+		m.Authoritative = false
+		c.extendedError(req, m, edeOther, "shedding load")
+		w.WriteMsg(m)
+		return
+	}
+	if cut := z.delegationFor(q); cut != "" {
+		z.referral(m, cut, do)
+		if do {
+			z.addSignatures(c, m)
+		}
+		c.stats.Incr("query.referral", 1)
+		c.clients.observe(c, w, req, false)
+		if tag {
+			z.tagAnswerSource(req, m, "referral")
+		}
+		c.debug(fmt.Sprintf("Query [%s] %s -> (REFERRAL %s)", w.RemoteAddr().String(), strings.Join(questions, ","), cut))
+		c.plugins.runPreResponse(c, w, req, m)
+		w.WriteMsg(m)
+		return
+	}
+	rrs, answers, cacheable := z.answer(c, q)
+	rrs = c.plugins.runPostLookup(c, z.name, q, rrs)
+	if !do {
+		rrs = c.limitAnswers(z, rrs)
+	}
+	m.Answer = append(m.Answer, rrs...)
+	if dnameOverflow(m) {
+		c.stats.Incr("query.yxdomain", 1)
+	}
+	if len(m.Answer) == 0 && cacheable { // a failed flattening shouldn't be cached
+		if z.negative(m) {
+			c.stats.Incr("query.nxdomain", 1)
+		} else {
+			c.stats.Incr("query.nodata", 1)
+		}
+	}
+	if code, failed := flattenEDE(answers); failed {
+		c.extendedError(req, m, code, "root CNAME flattening failed")
+	}
+	if z.isStale() {
+		c.staleEDE(req, m)
+	}
+	z.authority(m, do)
+	rule.limitAnswer(c, w, m)
+	if do {
+		c.stats.Incr("query.dnssec", 1)
+		z.addSignatures(c, m)
+		z.addDenial(c, m)
+	} else if q.Qtype == dns.TypeANY {
+		m.Answer = stripDNSSEC(m.Answer)
+	}
+	if len(rrs) > 0 {
+		c.access.record(c, z.name, q.Name, q.Qtype)
+	}
+	c.clients.observe(c, w, req, len(rrs) > 0)
+	if tag {
+		z.tagAnswerSource(req, m, answerPath(rrs, answers, z.hot.isHot(q)))
 	}
 	//m.Extra = []dns.RR{}
 	//m.Extra = append(m.Extra, &dns.TXT{Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0}, Txt: []string{"DNS rocks"}})
 	c.debug(fmt.Sprintf("Query [%s] %s -> %s ", w.RemoteAddr().String(), strings.Join(questions, ","), strings.Join(answers, ",")))
 	c.stats.Incr("query.answer", 1)
 
+	c.plugins.runPreResponse(c, w, req, m)
 	w.WriteMsg(m)
 }
 
-func (c *config) flattenCNAME(in *dns.CNAME) ([]dns.RR, error) { // TODO: cache CNAME lookups
+// answer finds the local records answering q, or the DNAME above it (see
+// dnameAnswer), following in-zone CNAMEs (see followCNAMEs). ANY queries may be
+// answered minimally (see minimalANY). Answers that depend on the resolver
+// (flattened root CNAMEs) are not cacheable.
+func (z *zone) answer(c *config, q dns.Question) ([]dns.RR, []string, bool) {
+	rrs, answers, redirected := z.dnameAnswer(c, q)
+	cacheable := true
+	if !redirected {
+		rrs, answers, cacheable = z.lookup(c, q)
+	}
+	if q.Qtype == dns.TypeANY {
+		return c.minimalANY(c.anyMode(z), q, rrs), answers, cacheable
+	}
+	return z.followCNAMEs(c, q, rrs, answers, cacheable)
+}
+
+// lookup finds the records of q.Name itself answering q
+func (z *zone) lookup(c *config, q dns.Question) ([]dns.RR, []string, bool) {
+	rrs := []dns.RR{}
+	answers := []string{}
+	cacheable := true
+	name := q.Name
+	q.Name = z.policy.rewriteName(name)
+	if q.Name != name {
+		c.stats.Incr("query.rewrite", 1)
+		answers = append(answers, "(REWRITE "+q.Name+")")
+	}
+	records := z.rrs
+	if open, has := z.maintenanceRRs(q.Name, time.Now(), c.tz); has {
+		cacheable = false
+		if len(open) > 0 {
+			records = open
+			c.stats.Incr("query.maintenance", 1)
+			answers = append(answers, "(MAINTENANCE)")
+		}
+	}
+	owner, wildcard := q.Name, ""
+	if !hasOwner(records, q.Name) {
+		wildcard = z.wildcardFor(q.Name)
+	}
+	if len(wildcard) > 0 {
+		owner = wildcard
+		c.stats.Incr("query.wildcard", 1)
+		answers = append(answers, "(WILDCARD "+wildcard+")")
+	}
+	for _, record := range records {
+		h := record.Header()
+		if !strings.EqualFold(owner, h.Name) {
+			continue
+		}
+		if h.Name != q.Name { // synthesized from a wildcard, or cased differently by a 0x20 resolver
+			record = renamed([]dns.RR{record}, q.Name)[0]
+		}
+		txt := record.String()
+		apex := strings.EqualFold(q.Name, dns.Fqdn(z.name))
+		if q.Qtype == dns.TypeA && h.Rrtype == dns.TypeCNAME && apex { // flatten root CNAME
+			flat, err := c.flattenCNAME(record.(*dns.CNAME))
+			if err != nil {
+				log.Printf("flattenCNAME error: %s", err.Error())
+				answers = append(answers, flattenFailure(err))
+			} else {
+				for _, record := range flat {
+					rrs = append(rrs, record)
+					answers = append(answers, "(FLAT)"+record.String())
+				}
+			}
+			cacheable = false
+			continue
+		}
+		if q.Qtype != h.Rrtype && q.Qtype != dns.TypeANY && (h.Rrtype != dns.TypeCNAME || apex || !cnameApplies(q.Qtype)) { // skip RRs that don't match
+			continue
+		}
+		rrs = append(rrs, record)
+		answers = append(answers, txt)
+	}
+	if r := z.policy.nxRedirect(z.view); r != nil && len(rrs) == 0 && len(wildcard) == 0 && !z.hasName(q.Name) {
+		c.stats.Incr("query.nxredirect", 1)
+		for _, record := range r.redirect(q) {
+			rrs = append(rrs, record)
+			answers = append(answers, "(REDIRECT)"+record.String())
+		}
+	}
+	return z.policy.rewriteAnswers(name, q.Name, rrs), answers, cacheable
+}
+
+func (c *config) flattenCNAME(in *dns.CNAME) ([]dns.RR, error) {
 	h := in.Header()
 	answers := []dns.RR{}
-	m := new(dns.Msg)
-	m.SetQuestion(in.Target, dns.TypeA)
-	m.RecursionDesired = true
-	d := new(dns.Client)
-	record, _, err := d.Exchange(m, c.resolver) // TODO: try multiple resolvers
+	if addrs, ok := c.flat.get(in.Target, time.Now()); ok {
+		c.stats.Incr("flatten.cache.hit", 1)
+		for _, a := range addrs {
+			answers = append(answers, &dns.A{Hdr: dns.RR_Header{Name: h.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: flatTTL}, A: a})
+		}
+		return answers, nil
+	}
+	c.stats.Incr("flatten.cache.miss", 1)
+	record, shared, err := c.flat.resolve(in.Target, func() (*dns.Msg, error) {
+		return c.exchange(c.flattenQuery(in.Target)) // TODO: try multiple resolvers
+	})
+	if shared {
+		c.stats.Incr("flatten.deduplicated", 1)
+	}
 	if err != nil {
-		return nil, err
+		return nil, &edeError{edeNetworkError, err.Error()}
 	}
-	if record == nil || record.Rcode == dns.RcodeNameError || record.Rcode != dns.RcodeSuccess {
-		return nil, fmt.Errorf("Record error code %s: %s", record.Rcode, err.Error())
+	if record.Rcode == dns.RcodeServerFailure {
+		return nil, &edeError{edeNoReachableAuthority, "Record error code SERVFAIL"}
+	} else if record.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("Record error code %s", dns.RcodeToString[record.Rcode])
+	}
+	if err := c.checkFlattenDNSSEC(in.Target, record); err != nil {
+		return nil, err
 	}
+	addrs := []net.IP{}
+	ttl := uint32(flatTTL)
 	for _, a := range record.Answer {
+		if a.Header().Ttl < ttl { // the whole chain expires with its shortest TTL
+			ttl = a.Header().Ttl
+		}
 		if r, ok := a.(*dns.A); ok {
 			out := new(dns.A)
-			out.Hdr = dns.RR_Header{Name: h.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}
+			out.Hdr = dns.RR_Header{Name: h.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: flatTTL}
 			out.A = r.A
 			answers = append(answers, out)
+			addrs = append(addrs, r.A)
 		}
 	}
+	if len(addrs) > 0 {
+		c.flat.put(in.Target, addrs, time.Now().Add(time.Duration(ttl)*time.Second))
+	}
 	return answers, nil
 }
 
 func (c *config) registerVersionHandler() { // special handler for reporting version: dig . @host TXT
 	dns.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		if req.Opcode == dns.OpcodeNotify && len(req.Question) == 1 { // for a zone not served yet
+			if !c.checkTSIG(w, req) {
+				return
+			}
+			if key := c.tsigKeyName(w, req); len(key) > 0 {
+				w = &signingWriter{ResponseWriter: w, key: key, algorithm: c.tsig[key].algorithm}
+			}
+			c.notifyHandler(w, req)
+			return
+		}
+		if len(req.Question) != 1 {
+			c.stats.Incr("query.error", 1)
+			return
+		}
+		if c.badVersion(w, req) {
+			return
+		}
+		w = c.ednsWriter(w, req, c.clientSubnet(req))
 		m := new(dns.Msg)
 		m.SetReply(req)
-		if req.Question[0].Name == "." && req.Question[0].Qtype == dns.TypeTXT {
+		if q := req.Question[0]; q.Name != "." || q.Qtype != dns.TypeTXT { // not ours, don't let resolvers take an empty answer as authoritative
+			c.stats.Incr("query.outside", 1)
+			c.debug(fmt.Sprintf("Query [%s] %s[%s] -> (OUTSIDE)", w.RemoteAddr().String(), q.Name, dns.Type(q.Qtype).String()))
+			m.SetRcode(req, dns.RcodeRefused)
+			if c.outsideFail {
+				m.SetRcode(req, dns.RcodeServerFailure)
+			}
+			c.extendedError(req, m, edeNotAuthoritative, "outside the served zones")
+		} else {
 			m.Authoritative = true
 			m.Answer = []dns.RR{}
-			m.Answer = append(m.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0}, Txt: []string{"v" + version}})
+			m.Answer = append(m.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0}, Txt: c.buildInfo().txt()})
 			m.Extra = []dns.RR{}
 			m.Extra = append(m.Extra, &dns.TXT{Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0}, Txt: []string{"NedDNS"}})
 		}
 		w.WriteMsg(m)
 	})
+	if c.chaosOn {
+		dns.HandleFunc("version.bind.", c.chaosHandler)
+		dns.HandleFunc("version.server.", c.chaosHandler)
+	}
 }
 
 func (c *config) startServer() {
-	go func() {
-		srv := &dns.Server{Addr: ":" + c.port, Net: "udp"}
-		err := srv.ListenAndServe()
+	go c.supervise("udp", func(up func()) error { // see watchdog.go
+		conn, err := c.bindUDP(":" + c.port)
 		if err != nil {
-			log.Fatalf("Failed to set udp listener %s\n", err.Error())
+			return err
 		}
-	}()
-	go func() {
-		srv := &dns.Server{Addr: ":" + c.port, Net: "tcp"}
-		err := srv.ListenAndServe()
-		if err != nil {
-			log.Fatalf("Failed to set tcp listener %s\n", err.Error())
-		}
-	}()
+		defer c.handoff.remove(conn)
+		srv := &dns.Server{PacketConn: conn, UDPSize: c.udpSize, DecorateReader: c.decorateReader, TsigSecret: c.tsigSecrets(), NotifyStartedFunc: up}
+		return srv.ActivateAndServe()
+	})
+	go c.supervise("tcp", func(up func()) error {
+		return c.listenTCP(":"+c.port, up)
+	})
+	if len(c.dotAddr) > 0 {
+		go c.listenDoT()
+	}
+	if len(c.doqAddr) > 0 {
+		go c.listenDoQ()
+	}
 }
 
 func (c *config) sendStats() {
@@ -340,21 +1247,135 @@ func (c *config) sendStats() {
 }
 
 func parseArgs() (config, error) {
-	c := config{}
-	args, err := docopt.Parse(usage, nil, true, version, false)
+	c := config{startTime: time.Now(), dataKeys: &dataKeyCache{}, listeners: &listenerHealth{}}
+	args, err := docopt.Parse(usage, nil, true, versionString(), false)
 	if err != nil {
 		return c, err
 	}
 	c.lastUpdate = time.Unix(0, 0)
-	c.bucket = args["<bucket>"].(string)
+	if args["import-bind"].(bool) {
+		c.command = "import-bind"
+		c.bindConfig = args["--config"].(string)
+	}
+	if args["import-csv"].(bool) {
+		c.command = "import-csv"
+		c.inventory = args["<inventory>"].(string)
+		c.genParams.Overwrite = args["--overwrite"].(bool)
+		if arg, ok := args["--domain"].(string); ok {
+			c.genParams.Domain = arg
+		}
+	}
+	if args["check"].(bool) {
+		c.command = "check"
+		c.zoneFiles = args["<zonefile>"].([]string)
+	}
+	if args["encrypt-zone"].(bool) {
+		c.command = "encrypt-zone"
+		c.zoneFiles = args["<zonefile>"].([]string)
+		c.kmsKey = args["--kms-key"].(string)
+	}
+	if args["push"].(bool) {
+		c.command = "push"
+		c.zoneFiles = args["<zonefile>"].([]string)
+		if arg, ok := args["--kms-key"].(string); ok {
+			c.kmsKey = arg
+		}
+		if arg, ok := args["--api-servers"].(string); ok {
+			for _, s := range splitList(arg) {
+				c.pushServers = append(c.pushServers, strings.TrimSuffix(s, "/"))
+			}
+		}
+		secs, err := strconv.Atoi(args["--wait"].(string))
+		if err != nil || secs < 1 {
+			return c, fmt.Errorf("invalid --wait %q: must be a positive number of seconds", args["--wait"])
+		}
+		c.pushWait = time.Duration(secs) * time.Second
+	}
+	if args["simulate-diff"].(bool) {
+		c.command = "simulate-diff"
+		c.zoneFiles = []string{args["<old>"].(string), args["<new>"].(string)}
+	}
+	if args["generate"].(bool) {
+		c.command = "generate"
+		c.genParams = zoneParams{
+			Domain:    args["--domain"].(string),
+			MX:        args["--mx"].(string),
+			Overwrite: args["--overwrite"].(bool),
+		}
+		if arg, ok := args["--ips"].(string); ok {
+			c.genParams.IPs = splitList(arg)
+		}
+		for _, spec := range args["--preset"].([]string) {
+			p, err := parsePresetSpec(spec)
+			if err != nil {
+				return c, err
+			}
+			c.genParams.Presets = append(c.genParams.Presets, p)
+		}
+	}
+	if arg, ok := args["--ns"].(string); ok {
+		c.nameservers = splitList(arg)
+	}
+	if args["caa-report"].(bool) {
+		c.command = "caa-report"
+	}
+	if args["gen-testzone"].(bool) {
+		c.command = "gen-testzone"
+		c.genParams.Domain = "test.example"
+		if arg, ok := args["--domain"].(string); ok {
+			c.genParams.Domain = arg
+		}
+		if c.testRecords, err = strconv.Atoi(args["--records"].(string)); err != nil || c.testRecords < 1 {
+			return c, fmt.Errorf("invalid --records %q: must be a positive number", args["--records"])
+		}
+		if c.testSeed, err = strconv.ParseInt(args["--seed"].(string), 10, 64); err != nil {
+			return c, fmt.Errorf("invalid --seed %q: must be a number", args["--seed"])
+		}
+	}
+	if args["audit-amplification"].(bool) {
+		c.command = "audit-amplification"
+		if c.auditTop, err = strconv.Atoi(args["--top"].(string)); err != nil || c.auditTop < 1 {
+			return c, fmt.Errorf("invalid --top %q: must be a positive number", args["--top"])
+		}
+	}
+	if args["fleet-check"].(bool) {
+		c.command = "fleet-check"
+		for _, s := range splitList(args["--servers"].(string)) {
+			c.fleetServers = append(c.fleetServers, fleetServer(s))
+		}
+		if len(c.fleetServers) == 0 {
+			return c, fmt.Errorf("invalid --servers %q: must list at least one server", args["--servers"])
+		}
+	}
+	if args["install-service"].(bool) {
+		c.command = "install-service"
+	}
+	if args["remove-service"].(bool) {
+		c.command = "remove-service"
+	}
+	c.dryRun = args["--dry-run"].(bool)
+	if arg, ok := args["<bucket>"].(string); ok {
+		c.bucket = arg
+	}
 	c.port = args["--port"].(string)
 	c.region = args["--region"].(string)
 	c.debugOn = args["--debug"].(bool)
+	c.sandboxOn = args["--sandbox"].(bool)
+	c.chaosOn = args["--chaos"].(bool)
+	c.readOnly = args["--readonly"].(bool)
+	if arg, ok := args["--chroot"].(string); ok {
+		c.chrootDir = arg
+	}
 	if arg, ok := args["--resolver"].(string); ok {
 		c.resolver = arg
 	} else {
 		c.resolver = "8.8.8.8:53"
 	}
+	if n, err := strconv.Atoi(args["--resolver-conns"].(string)); err != nil || n < 0 {
+		return c, fmt.Errorf("invalid --resolver-conns %q: must be a number", args["--resolver-conns"])
+	} else if n > 0 {
+		c.resolvers = newResolverPool(c.resolver, n)
+	}
 	if arg, ok := args["--log"].(string); ok {
 		c.logfile = arg
 	}
@@ -365,6 +1386,111 @@ func parseArgs() (config, error) {
 	if err != nil {
 		return c, err
 	}
+	for _, opt := range []struct {
+		name string
+		v    *int
+	}{{"--tcp-max", &c.tcpMax}, {"--tcp-per-ip", &c.tcpPerIP}} {
+		if *opt.v, err = strconv.Atoi(args[opt.name].(string)); err != nil || *opt.v < 1 {
+			return c, fmt.Errorf("invalid %s %q: must be a positive number", opt.name, args[opt.name])
+		}
+	}
+	if c.tcpIdle, err = time.ParseDuration(args["--tcp-idle"].(string) + "s"); err != nil || c.tcpIdle <= 0 {
+		return c, fmt.Errorf("invalid --tcp-idle %q: must be a positive number of seconds", args["--tcp-idle"])
+	}
+	if c.upgradeDrain, err = time.ParseDuration(args["--upgrade-drain"].(string) + "s"); err != nil || c.upgradeDrain < 0 {
+		return c, fmt.Errorf("invalid --upgrade-drain %q: must be a number of seconds", args["--upgrade-drain"])
+	}
+	if c.tz, err = time.LoadLocation(args["--tz"].(string)); err != nil {
+		return c, fmt.Errorf("invalid --tz %q: %s", args["--tz"], err.Error())
+	}
+	c.shed = &loadShedder{} // set to nil below when both thresholds are disabled
+	if c.shed.maxInflight, err = strconv.ParseInt(args["--shed-inflight"].(string), 10, 64); err != nil || c.shed.maxInflight < 0 {
+		return c, fmt.Errorf("invalid --shed-inflight %q: must be a number", args["--shed-inflight"])
+	}
+	if ms, err := strconv.Atoi(args["--shed-latency"].(string)); err != nil || ms < 0 {
+		return c, fmt.Errorf("invalid --shed-latency %q: must be a number of milliseconds", args["--shed-latency"])
+	} else {
+		c.shed.maxLatency = time.Duration(ms) * time.Millisecond
+	}
+	if c.shed.maxInflight == 0 && c.shed.maxLatency == 0 {
+		c.shed = nil
+	}
+	if arg, ok := args["--fds"].(string); ok {
+		if c.fds, err = strconv.ParseUint(arg, 10, 64); err != nil || c.fds < 1 {
+			return c, fmt.Errorf("invalid --fds %q: must be a positive number", arg)
+		}
+	}
+	if n, err := strconv.Atoi(args["--access-sample"].(string)); err != nil || n < 0 {
+		return c, fmt.Errorf("invalid --access-sample %q: must be a number", args["--access-sample"])
+	} else if n > 0 {
+		c.access = newAccessStats(n)
+	}
+	if secs, err := strconv.Atoi(args["--classify"].(string)); err != nil || secs < 0 {
+		return c, fmt.Errorf("invalid --classify %q: must be a number of seconds", args["--classify"])
+	} else if secs > 0 {
+		c.clients = newClientClassifier(time.Duration(secs) * time.Second)
+	}
+	if path, ok := args["--geoip"].(string); ok {
+		if c.geo, err = openGeoIP(path); err != nil {
+			return c, err
+		}
+	}
+	if c.udpSize, err = strconv.Atoi(args["--udp-size"].(string)); err != nil || c.udpSize < dns.MinMsgSize || c.udpSize > dns.MaxMsgSize {
+		return c, fmt.Errorf("invalid --udp-size %q: must be %d to %d bytes", args["--udp-size"].(string), dns.MinMsgSize, dns.MaxMsgSize)
+	}
+	c.ecs = args["--ecs"].(bool)
+	if c.maxAnswers, err = strconv.Atoi(args["--max-answers"].(string)); err != nil || c.maxAnswers < 0 {
+		return c, fmt.Errorf("invalid --max-answers %q: must be 0 or more", args["--max-answers"].(string))
+	}
+	if ms, err := strconv.Atoi(args["--dup-window"].(string)); err != nil || ms < 0 {
+		return c, fmt.Errorf("invalid --dup-window %q: must be 0 or more milliseconds", args["--dup-window"].(string))
+	} else if ms > 0 {
+		logOne, err := strconv.Atoi(args["--dup-log"].(string))
+		if err != nil || logOne < 0 {
+			return c, fmt.Errorf("invalid --dup-log %q: must be 0 or more", args["--dup-log"].(string))
+		}
+		c.dups = newDupDetector(time.Duration(ms)*time.Millisecond, logOne)
+	}
+	if arg, ok := args["--query-log"].(string); ok {
+		secs, err := strconv.Atoi(args["--query-log-every"].(string))
+		if err != nil || secs < 1 {
+			return c, fmt.Errorf("invalid --query-log-every %q: must be a positive number of seconds", args["--query-log-every"].(string))
+		}
+		sample, err := strconv.Atoi(args["--query-log-sample"].(string))
+		if err != nil || sample < 1 {
+			return c, fmt.Errorf("invalid --query-log-sample %q: must be 1 or more", args["--query-log-sample"].(string))
+		}
+		if c.queryLog, err = newQueryLog(arg, time.Duration(secs)*time.Second, sample); err != nil {
+			return c, fmt.Errorf("invalid --query-log %q: %s", arg, err.Error())
+		}
+	}
+	switch arg := strings.ToUpper(args["--outside-zones"].(string)); arg {
+	case "REFUSED":
+	case "SERVFAIL":
+		c.outsideFail = true
+	default:
+		return c, fmt.Errorf("invalid --outside-zones %q: must be REFUSED or SERVFAIL", arg)
+	}
+	if c.anyAnswers = args["--any"].(string); !anyModes[c.anyAnswers] {
+		return c, fmt.Errorf("invalid --any %q: must be full, hinfo or rrset", c.anyAnswers)
+	}
+	c.hotSize, err = strconv.Atoi(args["--hot"].(string))
+	if err != nil {
+		return c, fmt.Errorf("invalid --hot %q: must be a number", args["--hot"])
+	}
+	if secs, err := strconv.Atoi(args["--clock-skew"].(string)); err != nil || secs < 0 {
+		return c, fmt.Errorf("invalid --clock-skew %q: must be 0 or more seconds", args["--clock-skew"].(string))
+	} else {
+		c.clockSkew = time.Duration(secs) * time.Second
+	}
+	if arg, ok := args["--stale"].(string); ok {
+		c.staleAfter, err = time.ParseDuration(arg + "s")
+		if err != nil {
+			return c, err
+		}
+	} else {
+		c.staleAfter = 3 * c.update
+	}
 	if arg, ok := args["--awskey"].(string); ok {
 		c.awsKeyId = arg
 	} else {
@@ -375,12 +1501,247 @@ func parseArgs() (config, error) {
 	} else {
 		c.awsSecret = os.Getenv("AWS_SECRET_ACCESS_KEY")
 	}
-	if len(c.awsKeyId) < 1 || len(c.awsSecret) < 1 {
+	needsAWS := c.command == "" || c.command == "import-bind" || c.command == "import-csv" || c.command == "install-service" || c.command == "generate" || c.command == "caa-report" || c.command == "audit-amplification" || c.command == "fleet-check" || c.command == "encrypt-zone" || c.command == "push"
+	if c.command == "simulate-diff" {
+		needsAWS = strings.HasPrefix(c.zoneFiles[0], "s3://") || strings.HasPrefix(c.zoneFiles[1], "s3://")
+	}
+	if (len(c.awsKeyId) < 1 || len(c.awsSecret) < 1) && needsAWS {
 		return c, fmt.Errorf("Must use -K and -S options or set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.")
 	}
 	if arg, ok := args["--statsd_server"].(string); ok {
 		c.statsdServer = arg
 	}
+	if arg, ok := args["--api"].(string); ok {
+		c.apiAddr = arg
+	}
+	if arg, ok := args["--api-token"].(string); ok {
+		c.apiTokenRef = arg
+	}
+	if arg, ok := args["--plugins"].(string); ok {
+		c.pluginPaths = splitList(arg)
+	}
+	if arg, ok := args["--alert-hooks"].(string); ok {
+		for _, hook := range splitList(arg) {
+			if err := checkAlertHook(hook); err != nil && !isSecretRef(hook) {
+				return c, fmt.Errorf("invalid --alert-hooks: %s", err.Error())
+			}
+			c.alertRefs = append(c.alertRefs, hook)
+		}
+	}
+	if secs, err := strconv.Atoi(args["--alert-after"].(string)); err != nil || secs < 0 {
+		return c, fmt.Errorf("invalid --alert-after %q: must be a number of seconds", args["--alert-after"])
+	} else {
+		c.alertAfter = time.Duration(secs) * time.Second
+	}
+	if arg, ok := args["--webhooks"].(string); ok {
+		for _, hook := range splitList(arg) {
+			if err := checkWebhook(hook); err != nil && !isSecretRef(hook) {
+				return c, fmt.Errorf("invalid --webhooks: %s", err.Error())
+			}
+			c.webhookRefs = append(c.webhookRefs, hook)
+		}
+	}
+	if secs, err := strconv.Atoi(args["--secret-refresh"].(string)); err != nil || secs < 1 {
+		return c, fmt.Errorf("invalid --secret-refresh %q: must be a positive number of seconds", args["--secret-refresh"])
+	} else {
+		c.secretEvery = time.Duration(secs) * time.Second
+	}
+	if days, err := strconv.Atoi(args["--zsk-rollover"].(string)); err != nil || days < 0 {
+		return c, fmt.Errorf("invalid --zsk-rollover %q: must be a number of days", args["--zsk-rollover"])
+	} else {
+		c.zskRollover = time.Duration(days) * 24 * time.Hour
+	}
+	if arg, ok := args["--also-notify"].(string); ok {
+		for _, t := range splitList(arg) {
+			target, err := serverAddr(t)
+			if err != nil {
+				return c, fmt.Errorf("invalid --also-notify: %s", err.Error())
+			}
+			c.alsoNotify = append(c.alsoNotify, target)
+		}
+	}
+	if mins, err := strconv.Atoi(args["--sign-audit"].(string)); err != nil || mins < 0 {
+		return c, fmt.Errorf("invalid --sign-audit %q: must be a number of minutes", args["--sign-audit"])
+	} else if mins > 0 {
+		c.signAudit = newSignAudit(time.Duration(mins) * time.Minute)
+	}
+	if arg, ok := args["--local"].(string); ok {
+		c.localAddr = arg
+	}
+	c.dotAddr, _ = args["--dot"].(string)
+	if arg, ok := args["--doq"].(string); ok {
+		if !doqSupported {
+			return c, fmt.Errorf("invalid --doq: this build has no DoQ support, rebuild with -tags doq")
+		}
+		c.doqAddr = arg
+	}
+	if len(c.dotAddr) > 0 || len(c.doqAddr) > 0 {
+		o := dotOptions{minVersion: args["--dot-min-tls"].(string)}
+		o.cert, _ = args["--dot-cert"].(string)
+		o.key, _ = args["--dot-key"].(string)
+		o.clientCA, _ = args["--dot-client-ca"].(string)
+		o.ticketKey, _ = args["--dot-ticket-key"].(string)
+		if c.dot, err = c.dotConfig(o); err != nil {
+			return c, err
+		}
+	}
+	c.staging = &stagedZones{} // before any handler can look at it
+	if arg, ok := args["--monitors"].(string); ok {
+		if c.monitors, err = parseMonitors(arg); err != nil {
+			return c, fmt.Errorf("invalid --monitors %q: %s", arg, err.Error())
+		}
+	}
+	if arg, ok := args["--private-clients"].(string); ok {
+		if c.privateNets, err = parsePrivateClients(arg); err != nil {
+			return c, fmt.Errorf("invalid --private-clients %q: %s", arg, err.Error())
+		}
+	}
+	if arg, ok := args["--admin-cidrs"].(string); ok {
+		if c.adminNets, err = parseCIDRs(arg); err != nil {
+			return c, fmt.Errorf("invalid --admin-cidrs %q: %s", arg, err.Error())
+		}
+	}
+	c.answerSource = args["--answer-source"].(bool)
+	c.flattenDNSSEC = args["--flatten-dnssec"].(bool)
+	if arg, ok := args["--tsig-keys"].(string); ok {
+		if c.tsig, err = c.parseTSIGKeys(arg); err != nil {
+			return c, err
+		}
+	}
+	if arg, ok := args["--resolver-key"].(string); ok {
+		c.resolverKey = dns.Fqdn(strings.ToLower(arg))
+		if _, ok := c.tsig[c.resolverKey]; !ok {
+			return c, fmt.Errorf("invalid --resolver-key %q: it isn't one of the --tsig-keys", arg)
+		}
+	}
+	if arg, ok := args["--secondary"].(string); ok {
+		if c.secondaries, err = parseSecondaries(arg); err != nil {
+			return c, err
+		}
+	}
+	if arg, ok := args["--transfer-key"].(string); ok {
+		c.transferKey = dns.Fqdn(strings.ToLower(arg))
+		if _, ok := c.tsig[c.transferKey]; !ok {
+			return c, fmt.Errorf("invalid --transfer-key %q: it isn't one of the --tsig-keys", arg)
+		}
+	}
+	if arg, ok := args["--self-probe"].(string); ok {
+		targets, err := parseProbeTargets(arg, c.port)
+		if err != nil {
+			return c, fmt.Errorf("invalid --self-probe %q: %s", arg, err.Error())
+		}
+		c.probe = &selfProbe{targets: targets, results: map[string]*probeResult{}}
+		if secs, err := strconv.Atoi(args["--probe-every"].(string)); err != nil || secs < 1 {
+			return c, fmt.Errorf("invalid --probe-every %q: must be a positive number of seconds", args["--probe-every"])
+		} else {
+			c.probe.every = time.Duration(secs) * time.Second
+		}
+		if arg, ok := args["--probe-names"].(string); ok {
+			for _, n := range splitList(arg) {
+				if _, ok := dns.IsDomainName(n); !ok {
+					return c, fmt.Errorf("invalid --probe-names %q: %s is not a name", arg, n)
+				}
+				c.probe.names = append(c.probe.names, dns.Fqdn(strings.ToLower(n)))
+			}
+		}
+		if arg, ok := args["--probe-api"].(string); ok {
+			if err := checkWebhook(arg); err != nil {
+				return c, fmt.Errorf("invalid --probe-api: %s", err.Error())
+			}
+			c.probe.api = arg
+		}
+	} else if _, ok := args["--probe-api"].(string); ok {
+		return c, fmt.Errorf("invalid --probe-api: it needs --self-probe")
+	}
+	if secs, err := strconv.Atoi(args["--ns-check"].(string)); err != nil || secs < 0 {
+		return c, fmt.Errorf("invalid --ns-check %q: must be 0 or more seconds", args["--ns-check"].(string))
+	} else if secs > 0 {
+		c.delegations = &delegationCheck{every: time.Duration(secs) * time.Second, results: map[string]*delegationStatus{}}
+		if arg, ok := args["--expected-ns"].(string); ok {
+			for _, n := range splitList(arg) {
+				if _, ok := dns.IsDomainName(n); !ok {
+					return c, fmt.Errorf("invalid --expected-ns %q: %s is not a name", arg, n)
+				}
+				c.delegations.expected = append(c.delegations.expected, dns.Fqdn(strings.ToLower(n)))
+			}
+		}
+		if arg, ok := args["--ns-addrs"].(string); ok {
+			for _, a := range splitList(arg) {
+				ip := net.ParseIP(a)
+				if ip == nil {
+					return c, fmt.Errorf("invalid --ns-addrs %q: %s is not an address", arg, a)
+				}
+				c.delegations.addrs = append(c.delegations.addrs, ip)
+			}
+		}
+		if len(c.delegations.expected) == 0 && len(c.delegations.addrs) == 0 {
+			return c, fmt.Errorf("invalid --ns-check: it needs --expected-ns or --ns-addrs")
+		}
+	}
+	shadowAddr, _ := args["--shadow"].(string)
+	shadowCompare, _ := args["--shadow-compare"].(string)
+	if len(shadowAddr) > 0 || len(shadowCompare) > 0 {
+		if len(shadowAddr) == 0 || len(shadowCompare) == 0 {
+			return c, fmt.Errorf("invalid --shadow: --shadow and --shadow-compare go together")
+		}
+		if _, _, err := net.SplitHostPort(shadowCompare); err != nil {
+			return c, fmt.Errorf("invalid --shadow-compare %q: use host:port", shadowCompare)
+		}
+		c.shadowAddr = shadowAddr
+		c.shadow = newShadowRead(shadowCompare)
+	}
+	if arg, ok := args["--as-of"].(string); ok {
+		if c.asOf, err = parseAsOf(arg, time.Now()); err != nil {
+			return c, err
+		}
+		if c.bucket == noBucket {
+			return c, fmt.Errorf("invalid --as-of: a bucket of %s has no versions", noBucket)
+		}
+		if c.zskRollover > 0 {
+			return c, fmt.Errorf("invalid --as-of: --zsk-rollover would write to the bucket")
+		}
+	}
+	if c.bucket == noBucket && c.command == "" && c.secondaries == nil {
+		return c, fmt.Errorf("a bucket of %s needs --secondary zones to serve", noBucket)
+	}
+	allowNotify, _ := args["--allow-notify"].(string)
+	notifyKeys, _ := args["--notify-keys"].(string)
+	if len(allowNotify) > 0 || len(notifyKeys) > 0 {
+		c.notifyACL = &transferACL{}
+		if c.notifyACL.nets, err = parseCIDRs(allowNotify); err != nil {
+			return c, fmt.Errorf("invalid --allow-notify %q: %s", allowNotify, err.Error())
+		}
+		for _, k := range splitList(notifyKeys) {
+			k = dns.Fqdn(strings.ToLower(k))
+			if _, ok := c.tsig[k]; !ok {
+				return c, fmt.Errorf("invalid --notify-keys: %s isn't one of the --tsig-keys", k)
+			}
+			c.notifyACL.TSIGKeys = append(c.notifyACL.TSIGKeys, k)
+		}
+	}
+	if arg, ok := args["--cache-file"].(string); ok {
+		c.cacheFile = arg
+	}
+	if arg, ok := args["--ns-map"].(string); ok {
+		if c.nsMap, err = parseNSMap(arg); err != nil {
+			return c, err
+		}
+	}
+	if arg, ok := args["--soa-mname"].(string); ok {
+		if c.soaMname, err = parseSOAName("soa-mname", arg, false); err != nil {
+			return c, err
+		}
+	}
+	if arg, ok := args["--soa-rname"].(string); ok {
+		if c.soaRname, err = parseSOAName("soa-rname", arg, true); err != nil {
+			return c, err
+		}
+	}
+	if arg, ok := args["--default-caa"].(string); ok {
+		if c.defaultCAA, err = parseDefaultCAA(arg); err != nil {
+			return c, err
+		}
+	}
 	if arg, ok := args["--statsd_prefix"].(string); ok {
 		c.statsdPrefix = arg
 		if !strings.HasSuffix(c.statsdPrefix, ".") {
@@ -389,11 +1750,26 @@ func parseArgs() (config, error) {
 	} else {
 		c.statsdPrefix = "neddns."
 	}
-	return c, nil
+	return c, c.validate()
+}
+
+// splitList splits a comma separated flag value, dropping empty entries
+func splitList(s string) []string {
+	out := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			out = append(out, v)
+		}
+	}
+	return out
 }
 
 func (c *config) debug(m string) {
 	if c.debugOn {
+		if c.logSink != nil {
+			c.logSink.send(priDebug, m)
+			return
+		}
 		log.Println(m)
 	}
 }
@@ -422,7 +1798,11 @@ func (s s3getter) ListZones() ([]zoneFile, error) {
 		return zones, fmt.Errorf("No zones found")
 	}
 	for _, k := range resp.Contents {
-		zones = append(zones, zoneFile{Key: *k.Key, LastModified: *k.LastModified})
+		f := zoneFile{Key: *k.Key, LastModified: *k.LastModified}
+		if k.ETag != nil {
+			f.ETag = *k.ETag
+		}
+		zones = append(zones, f)
 	}
 	return zones, nil
 }
@@ -439,3 +1819,21 @@ func (s s3getter) GetZone(zoneName string) (io.ReadCloser, error) {
 	}
 	return o.Body, nil
 }
+
+func (s s3getter) PutZone(key string, contents string) error {
+	connection := s3.New(&aws.Config{Region: aws.String(s.region)})
+	q := s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        strings.NewReader(contents),
+		ContentType: aws.String("text/dns"),
+	}
+	_, err := connection.PutObject(&q)
+	return err
+}
+
+func (s s3getter) CheckBucket() error {
+	connection := s3.New(&aws.Config{Region: aws.String(s.region)})
+	_, err := connection.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	return err
+}
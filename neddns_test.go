@@ -1,8 +1,11 @@
 package main
 
 import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
 	"io"
 	"io/ioutil"
+	"net"
 	"os/exec"
 	"strings"
 	"testing"
@@ -32,8 +35,36 @@ func (s testGetter) GetZone(zoneName string) (io.ReadCloser, error) {
 	return ioutil.NopCloser(r), nil
 }
 
+// testWriter is a dns.ResponseWriter that keeps the reply for inspection
+type testWriter struct {
+	msg *dns.Msg
+	raw []byte
+}
+
+func (w *testWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+}
+func (w *testWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}
+}
+func (w *testWriter) WriteMsg(m *dns.Msg) error   { w.msg = m; return nil }
+func (w *testWriter) Write(b []byte) (int, error) { w.raw = b; return len(b), nil }
+func (w *testWriter) Close() error                { return nil }
+func (w *testWriter) TsigStatus() error           { return nil }
+func (w *testWriter) TsigTimersOnly(bool)         {}
+func (w *testWriter) Hijack()                     {}
+
+// testQuery runs a single question through the handler for zone n
+func testQuery(c *config, n string, name string, qtype uint16) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	w := &testWriter{}
+	c.zones[n].zoneHandler(c, w, req)
+	return w.msg
+}
+
 func TestGet(t *testing.T) {
-	c := config{}
+	c := config{stats: statsd.NoopClient{}}
 	getter := testGetter{testZones: map[string]testZone{
 		"abc.com":    testZone{LastModified: time.Now().AddDate(-1, 0, 0), Contents: abcZone},
 		"def.com":    testZone{LastModified: time.Now().AddDate(0, 0, -1), Contents: defZone},
@@ -53,6 +84,9 @@ func TestGet(t *testing.T) {
 	if strings.Contains(z["abc.com"], "nsa.def.com.") {
 		t.Errorf("getZones returned wrong zone contents (%s has %s)", "abc.com", "nsa.def.com.")
 	}
+	if err := c.loadZones(z); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
 
 	recent := getter.testZones["recent.com"]
 	recent.LastModified = time.Now()
@@ -100,7 +134,7 @@ www		IN	CNAME	flat.com.
 `
 
 func TestServe(t *testing.T) {
-	c := config{resolver: "127.0.0.1:" + testPort}
+	c := config{stats: statsd.NoopClient{}, resolver: "127.0.0.1:" + testPort, port: testPort, tcpMax: 10, tcpPerIP: 10, tcpIdle: time.Second}
 	getter := testGetter{testZones: map[string]testZone{
 		"abc.com":  testZone{LastModified: time.Now().AddDate(-1, 0, 0), Contents: abcZone},
 		"def.com":  testZone{LastModified: time.Now().AddDate(0, 0, -1), Contents: defZone},
@@ -113,7 +147,8 @@ func TestServe(t *testing.T) {
 	if err := c.loadZones(z); err != nil {
 		t.Errorf("loadZones failed: %s", err.Error())
 	}
-	startServer(testPort)
+	c.registerVersionHandler()
+	c.startServer()
 
 	cmd := exec.Command("dig", "-p", testPort, "@localhost", "abc.com")
 	out, _ := cmd.CombinedOutput()
@@ -125,10 +160,15 @@ func TestServe(t *testing.T) {
 	if !strings.Contains(string(out), "127.0.0.2") {
 		t.Errorf("basic dig failed: want: %s, got: %v", "127.0.0.2", string(out))
 	}
+	cmd = exec.Command("dig", "+tcp", "-p", testPort, "@localhost", "def.com")
+	out, _ = cmd.CombinedOutput()
+	if !strings.Contains(string(out), "127.0.0.2") {
+		t.Errorf("tcp dig failed: want: %s, got: %v", "127.0.0.2", string(out))
+	}
 	cmd = exec.Command("dig", "-p", testPort, "@localhost", "jkl.com")
 	out, _ = cmd.CombinedOutput()
-	if !strings.Contains(string(out), "QUERY: 1, ANSWER: 0, AUTHORITY: 0, ADDITIONAL: 0") {
-		t.Errorf("invalid dig failed: want: %s, got: %v", "QUERY: 1, ANSWER: 0, AUTHORITY: 0, ADDITIONAL: 0", string(out))
+	if !strings.Contains(string(out), "QUERY: 1, ANSWER: 0, AUTHORITY: 0, ADDITIONAL: 0") || !strings.Contains(string(out), "status: REFUSED") {
+		t.Errorf("invalid dig failed: want: %s, got: %v", "status: REFUSED", string(out))
 	}
 	cmd = exec.Command("dig", "-p", testPort, "@localhost", ".", "TXT")
 	out, _ = cmd.CombinedOutput()
@@ -151,3 +191,23 @@ func TestServe(t *testing.T) {
 	}
 
 }
+
+func TestMixedCaseQuery(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone + "*.wild IN TXT \"any\"\n"}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	m := testQuery(&c, "abc.com", "wWw.AbC.cOm.", dns.TypeA)
+	if len(m.Answer) != 2 || m.Answer[0].Header().Name != "wWw.AbC.cOm." || m.Answer[1].(*dns.A).A.String() != "127.0.0.1" {
+		t.Errorf("Expected a 0x20 cased query answered in its own case, got %v", m.Answer)
+	}
+	if m.Question[0].Name != "wWw.AbC.cOm." {
+		t.Errorf("Expected the question echoed as asked, got %s", m.Question[0].Name)
+	}
+	if m := testQuery(&c, "abc.com", "ABC.COM.", dns.TypeMX); len(m.Answer) != 1 || m.Answer[0].Header().Name != "ABC.COM." {
+		t.Errorf("Expected the apex matched in upper case, got %v", m.Answer)
+	}
+	if m := testQuery(&c, "abc.com", "X.Wild.abc.com.", dns.TypeTXT); len(m.Answer) != 1 || m.Answer[0].Header().Name != "X.Wild.abc.com." {
+		t.Errorf("Expected a wildcard matched whatever the case, got %v", m.Answer)
+	}
+}
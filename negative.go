@@ -0,0 +1,47 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// An empty answer tells resolvers why it is empty, with the zone's SOA in the
+// authority section so they cache the negative answer (RFC 2308): a name the zone
+// doesn't have, neither as records, as an empty non-terminal above other names, nor
+// through a wildcard, gets NXDOMAIN, and a name that exists without records of the
+// type asked for gets NOERROR (NODATA). The SOA is served with the lesser of its own
+// TTL and its minimum field, the negative caching TTL. negative adds the SOA to m,
+// an empty answer, making it an NXDOMAIN if its name doesn't exist, and returns
+// whether it did.
+func (z *zone) negative(m *dns.Msg) bool {
+	if len(m.Question) != 1 {
+		return false
+	}
+	m.Ns = append(m.Ns, z.negativeSOA()...)
+	if z.nameExists(m.Question[0].Name) {
+		return false
+	}
+	m.Rcode = dns.RcodeNameError
+	return true
+}
+
+// nameExists reports whether name exists in the zone, itself or through a wildcard
+func (z *zone) nameExists(name string) bool {
+	return z.hasName(name) || len(z.wildcardFor(name)) > 0
+}
+
+// negativeSOA returns the zone's SOA with its TTL capped at the negative caching
+// TTL (RFC 2308 section 5)
+func (z *zone) negativeSOA() []dns.RR {
+	for _, rr := range z.rrs {
+		if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, dns.Fqdn(z.name)) {
+			soa = dns.Copy(soa).(*dns.SOA)
+			if soa.Minttl < soa.Hdr.Ttl {
+				soa.Hdr.Ttl = soa.Minttl
+			}
+			return []dns.RR{soa}
+		}
+	}
+	return nil
+}
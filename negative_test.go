@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"strings"
+	"testing"
+)
+
+func TestNXDOMAIN(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, hotSize: 10}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone + "a.b IN A 10.1.1.2\n"}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	m := testQuery(&c, "abc.com", "nothere.abc.com.", dns.TypeA)
+	if m.Rcode != dns.RcodeNameError || !m.Authoritative || len(m.Answer) != 0 || len(m.Ns) != 1 {
+		t.Fatalf("Expected NXDOMAIN with the SOA, got %v", m)
+	}
+	if soa, ok := m.Ns[0].(*dns.SOA); !ok || soa.Hdr.Name != "abc.com." || soa.Hdr.Ttl != 7200 {
+		t.Errorf("Expected the SOA with the negative caching TTL of 7200, got %v", m.Ns[0])
+	}
+	if soa := c.zones["abc.com"].rrs[0].(*dns.SOA); soa.Hdr.Ttl != 86400 {
+		t.Errorf("Expected the zone's own SOA to keep its TTL, got %v", soa)
+	}
+	for _, name := range []string{"abc.com.", "b.abc.com.", "www.abc.com."} { // records, an empty non-terminal, a CNAME
+		if m := testQuery(&c, "abc.com", name, dns.TypeTXT); m.Rcode != dns.RcodeSuccess {
+			t.Errorf("Expected NOERROR for %s, which exists, got %v", name, m)
+		}
+	}
+
+	// a SOA TTL under the minimum field is kept
+	if err := c.loadZones(map[string]string{"def.com": defZone + "$TTL 60\n"}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	c.zones["def.com"].rrs[0].Header().Ttl = 60
+	if m := testQuery(&c, "def.com", "nothere.def.com.", dns.TypeA); len(m.Ns) != 1 || m.Ns[0].Header().Ttl != 60 {
+		t.Errorf("Expected the SOA's own TTL of 60, got %v", m)
+	}
+
+	// precomputed answers are negative too
+	z := c.zones["abc.com"]
+	z.hot.packed.Store(z.packAnswers(&c, []hotKey{{"nothere.abc.com.", dns.TypeA}}))
+	req := new(dns.Msg)
+	req.SetQuestion("nothere.abc.com.", dns.TypeA)
+	w := &testWriter{}
+	z.zoneHandler(&c, w, req)
+	hot := new(dns.Msg)
+	if w.raw == nil || hot.Unpack(w.raw) != nil || hot.Rcode != dns.RcodeNameError || len(hot.Ns) != 1 {
+		t.Errorf("Expected a packed NXDOMAIN with the SOA, got %v", hot)
+	}
+}
+
+func TestNODATA(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, flat: &flatCache{}, resolver: "127.0.0.1:25362"} // nothing answers
+	if err := c.loadZones(map[string]string{
+		"abc.com":  abcZone + "a.b IN A 10.1.1.2\n",
+		"flat.com": strings.Replace(strings.Replace(abcZone, "abc.com", "flat.com", -1), "\t\tIN\tA\t127.0.0.1", "@ IN CNAME target.example.com.", 1),
+	}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"abc.com.", dns.TypeAAAA},
+		{"a.b.abc.com.", dns.TypeTXT},
+		{"b.abc.com.", dns.TypeA}, // an empty non-terminal
+	} {
+		m := testQuery(&c, "abc.com", q.name, q.qtype)
+		if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 || len(m.Ns) != 1 || m.Ns[0].Header().Rrtype != dns.TypeSOA || m.Ns[0].Header().Ttl != 7200 {
+			t.Errorf("Expected NODATA with the SOA for %s %s, got %v", q.name, dns.Type(q.qtype).String(), m)
+		}
+	}
+	if m := testQuery(&c, "flat.com", "flat.com.", dns.TypeA); len(m.Answer) != 0 || len(m.Ns) != 0 {
+		t.Errorf("Expected no SOA for a failed flattening, so it isn't cached, got %v", m)
+	}
+}
@@ -0,0 +1,143 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Secondaries listed in --also-notify, or in "also_notify" in a zone's policy, are
+// sent a DNS NOTIFY (RFC 1996) each time a zone is loaded with a new serial, so they
+// transfer it at once instead of waiting for their refresh timer:
+//
+//	{"allow_transfer": {"cidrs": ["192.0.2.53"]}, "also_notify": ["192.0.2.53"]}
+//
+// The NOTIFY carries the new SOA, and is signed with the first of the zone's
+// allow_transfer tsig_keys when it has any. It is sent in the background and
+// retransmitted, waiting twice as long each time, until the secondary answers or
+// notifyRetries tries have gone unanswered; results are counted by notify.sent and
+// notify.error.
+const (
+	notifyTimeout = 2 * time.Second
+	notifyRetries = 5
+)
+
+// notifyTargets returns the secondaries told about new serials of zone n
+func (c *config) notifyTargets(n string) []string {
+	targets := append([]string{}, c.alsoNotify...)
+	if p := c.policies[n]; p != nil {
+		for _, t := range p.AlsoNotify {
+			if !contains(targets, t) {
+				targets = append(targets, t)
+			}
+		}
+	}
+	return targets
+}
+
+// notifySecondaries sends a NOTIFY for each zone whose serial changed since before
+// was taken, or that is new, returning the zones notified
+func (c *config) notifySecondaries(before map[string]*zone) []string {
+	notified := []string{}
+	for n, z := range c.zones {
+		if old, ok := before[n]; ok && old.serial() == z.serial() {
+			continue
+		}
+		targets := c.notifyTargets(n)
+		if len(targets) == 0 {
+			continue
+		}
+		var soa *dns.SOA
+		for _, rr := range z.rrs {
+			if s, ok := rr.(*dns.SOA); ok && strings.EqualFold(s.Hdr.Name, dns.Fqdn(n)) {
+				soa = s
+			}
+		}
+		if soa == nil {
+			continue
+		}
+		key := ""
+		if acl := z.policy.allowTransfer(); acl != nil && len(acl.TSIGKeys) > 0 {
+			key = acl.TSIGKeys[0]
+		}
+		for _, target := range targets {
+			go c.sendNotify(soa, key, target)
+		}
+		notified = append(notified, n)
+	}
+	sort.Strings(notified)
+	return notified
+}
+
+// sendNotify tells target about the zone of soa, signing with key if it isn't ""
+func (c *config) sendNotify(soa *dns.SOA, key, target string) error {
+	m := new(dns.Msg)
+	m.SetNotify(soa.Hdr.Name)
+	m.Answer = []dns.RR{soa}
+	client := &dns.Client{ReadTimeout: notifyTimeout}
+	if k, ok := c.tsig[key]; ok {
+		m.SetTsig(key, k.algorithm, 300, time.Now().Unix())
+		client.TsigSecret = c.tsigSecrets()
+	}
+	var err error
+	for i := 0; i < notifyRetries; i++ {
+		var resp *dns.Msg
+		if resp, _, err = client.Exchange(m, target); err == nil {
+			if resp.Rcode != dns.RcodeSuccess {
+				err = fmt.Errorf("answered %s", dns.RcodeToString[resp.Rcode])
+				break // it won't change its mind
+			}
+			c.stats.Incr("notify.sent", 1)
+			c.debug(fmt.Sprintf("Notified %s of zone %s serial %d", target, soa.Hdr.Name, soa.Serial))
+			return nil
+		}
+		client.ReadTimeout *= 2
+	}
+	c.stats.Incr("notify.error", 1)
+	log.Printf("Warning: NOTIFY of zone %s serial %d to %s failed: %s", soa.Hdr.Name, soa.Serial, target, err.Error())
+	return err
+}
+
+// A NOTIFY sent to neddns, such as by a pipeline that has just written a zone to the
+// bucket, queues a reload like a HUP signal, so the new version is served right away.
+// Only NOTIFYs from --allow-notify networks, signed with one of --notify-keys when
+// that is set, are accepted; with neither, NOTIFY isn't implemented. A NOTIFY for a
+// --secondary zone from one of its primaries is always accepted, and only checks
+// that zone (see secondary.go). The reload
+// fetches every zone changed in the bucket, and NOTIFYs that arrive while one is
+// pending are folded into it. They are counted by notify.received and
+// notify.refused.
+func (c *config) notifyHandler(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	n := req.Question[0].Name
+	switch {
+	case c.secondaryNotify(w, req): // from a primary of a --secondary zone
+		c.stats.Incr("notify.received", 1)
+		m.SetReply(req)
+		m.Authoritative = true
+		c.debug(fmt.Sprintf("NOTIFY for secondary zone %s from %s, checking its primaries", n, w.RemoteAddr().String()))
+	case c.notifyACL == nil:
+		m.SetRcode(req, dns.RcodeNotImplemented)
+	case req.Question[0].Qtype != dns.TypeSOA:
+		m.SetRcode(req, dns.RcodeFormatError)
+	case !c.notifyACL.allows(c, w, req):
+		c.stats.Incr("notify.refused", 1)
+		log.Printf("Refused NOTIFY for zone %s from %s", n, w.RemoteAddr().String())
+		m.SetRcode(req, dns.RcodeRefused)
+	default:
+		c.stats.Incr("notify.received", 1)
+		m.SetReply(req)
+		m.Authoritative = true
+		if c.triggerReload(c.doUpdate) {
+			log.Printf("NOTIFY for zone %s from %s, reloading", n, w.RemoteAddr().String())
+		} else {
+			c.debug(fmt.Sprintf("NOTIFY for zone %s from %s, reload already pending", n, w.RemoteAddr().String()))
+		}
+	}
+	m.Opcode = dns.OpcodeNotify
+	w.WriteMsg(m)
+}
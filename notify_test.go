@@ -0,0 +1,147 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	notifies := make(chan *dns.Msg, 10)
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.IsTsig() != nil {
+			if w.TsigStatus() != nil {
+				m.SetRcode(req, dns.RcodeRefused)
+			} else {
+				m.SetTsig(req.Extra[len(req.Extra)-1].(*dns.TSIG).Hdr.Name, dns.HmacSHA256, 300, time.Now().Unix())
+			}
+		}
+		notifies <- req
+		w.WriteMsg(m)
+	})
+	started := make(chan bool)
+	server := &dns.Server{Addr: "127.0.0.1:25361", Net: "udp", Handler: mux, TsigSecret: map[string]string{"xfr.": "c2VjcmV0"},
+		NotifyStartedFunc: func() { started <- true }}
+	go server.ListenAndServe()
+	<-started
+	defer server.Shutdown()
+	received := func(wait time.Duration) *dns.Msg {
+		select {
+		case m := <-notifies:
+			return m
+		case <-time.After(wait):
+			return nil
+		}
+	}
+
+	c := config{stats: statsd.NoopClient{}, alsoNotify: []string{"127.0.0.1:25361"}}
+	var err error
+	if c.tsig, err = c.parseTSIGKeys("xfr=c2VjcmV0"); err != nil {
+		t.Fatalf("parseTSIGKeys failed: %s", err.Error())
+	}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	m := received(5 * time.Second)
+	if m == nil || m.Opcode != dns.OpcodeNotify || m.Question[0].Name != "abc.com." || len(m.Answer) != 1 || m.Answer[0].(*dns.SOA).Serial != 2014121700 {
+		t.Fatalf("Expected a NOTIFY for the new zone, got %v", m)
+	}
+
+	// no NOTIFY without a new serial
+	if notified := c.notifySecondaries(c.servingZones()); len(notified) != 0 {
+		t.Errorf("Expected no NOTIFY for an unchanged zone, got %v", notified)
+	}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+
+	// a new serial, signed with the zone's transfer key
+	err = c.loadZones(map[string]string{
+		"abc.com":        strings.Replace(abcZone, "2014121700", "2014121701", 1),
+		"abc.com.policy": `{"allow_transfer": {"tsig_keys": ["xfr"]}, "also_notify": ["127.0.0.1:25361"]}`,
+	})
+	if err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	m = received(5 * time.Second)
+	if m == nil || m.Answer[0].(*dns.SOA).Serial != 2014121701 || m.IsTsig() == nil {
+		t.Fatalf("Expected a signed NOTIFY for the new serial, got %v", m)
+	}
+	if m := received(500 * time.Millisecond); m != nil {
+		t.Errorf("Expected one NOTIFY for a secondary listed twice, got %v", m)
+	}
+
+	if err := c.sendNotify(&dns.SOA{Hdr: dns.RR_Header{Name: "abc.com."}}, "", "127.0.0.1:25362"); err == nil {
+		t.Errorf("Expected an error when the secondary doesn't answer")
+	}
+
+	for _, policy := range []string{
+		`{"also_notify": ["ns1.example.com"]}`,
+		`{"also_notify": ["192.0.2.1:x:y"]}`,
+	} {
+		if _, err := parsePolicy("abc.com", policy); err == nil {
+			t.Errorf("Expected an error for policy %s", policy)
+		}
+	}
+}
+
+func TestNotifyReceived(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, doUpdate: make(chan bool, 1)}
+	var err error
+	if c.tsig, err = c.parseTSIGKeys("xfr=c2VjcmV0"); err != nil {
+		t.Fatalf("parseTSIGKeys failed: %s", err.Error())
+	}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	notify := func(name string, key string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetNotify(name)
+		if len(key) > 0 {
+			req.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		w := &testWriter{}
+		c.zones["abc.com"].zoneHandler(&c, w, req)
+		return w.msg
+	}
+	reloads := func() int {
+		select {
+		case <-c.doUpdate:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	if m := notify("abc.com.", ""); m.Rcode != dns.RcodeNotImplemented || m.Opcode != dns.OpcodeNotify || reloads() != 0 {
+		t.Errorf("Expected NOTIFY not to be implemented without --allow-notify, got %v", m)
+	}
+
+	c.notifyACL = &transferACL{}
+	c.notifyACL.nets, _ = parseCIDRs("10.0.0.0/8")
+	if m := notify("abc.com.", ""); m.Rcode != dns.RcodeRefused || reloads() != 0 {
+		t.Errorf("Expected a NOTIFY from outside --allow-notify to be refused, got %v", m)
+	}
+	c.notifyACL.nets, _ = parseCIDRs("127.0.0.1")
+	if m := notify("abc.com.", ""); m.Rcode != dns.RcodeSuccess || !m.Response || !m.Authoritative || m.Opcode != dns.OpcodeNotify || reloads() != 1 {
+		t.Errorf("Expected a NOTIFY to queue a reload, got %v", m)
+	}
+	notify("abc.com.", "")
+	notify("abc.com.", "")
+	if reloads() != 1 || reloads() != 0 {
+		t.Errorf("Expected NOTIFYs to coalesce into one pending reload")
+	}
+
+	c.notifyACL.TSIGKeys = []string{"xfr."}
+	if m := notify("abc.com.", ""); m.Rcode != dns.RcodeRefused || reloads() != 0 {
+		t.Errorf("Expected an unsigned NOTIFY to be refused with --notify-keys, got %v", m)
+	}
+	if m := notify("abc.com.", "xfr."); m.Rcode != dns.RcodeSuccess || reloads() != 1 {
+		t.Errorf("Expected a signed NOTIFY to queue a reload, got %v", m)
+	}
+}
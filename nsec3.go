@@ -0,0 +1,149 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+)
+
+// nsec3Config is a zone policy's "nsec3", which has zones signed by neddns deny
+// names with hashed NSEC3 records (RFC 5155) instead of NSEC, so the zone can't be
+// walked:
+//
+//	{"nsec3": {"iterations": 0, "salt": ""}}
+//
+// RFC 9276 recommends no extra iterations and no salt, the defaults; validators may
+// treat more than maxNSEC3Iterations as insecure, so more aren't allowed. The salt
+// is in hex. Zones signed before they were uploaded keep the NSEC3 chain in their
+// zone file, whatever their policy says.
+type nsec3Config struct {
+	Iterations uint16 `json:"iterations"`
+	Salt       string `json:"salt"`
+}
+
+const maxNSEC3Iterations = 100
+
+func (p *nsec3Config) compile(n string) error {
+	if p.Iterations > maxNSEC3Iterations {
+		return fmt.Errorf("Error in policy for zone %s: nsec3 iterations must be at most %d", n, maxNSEC3Iterations)
+	}
+	p.Salt = strings.ToUpper(strings.TrimPrefix(p.Salt, "-"))
+	if salt, err := hex.DecodeString(p.Salt); err != nil || len(salt) > 255 {
+		return fmt.Errorf("Error in policy for zone %s: nsec3 salt must be up to 255 bytes in hex", n)
+	}
+	return nil
+}
+
+// nsec3 returns the zone's NSEC3 settings, or nil to use NSEC. It is nil-safe.
+func (p *zonePolicy) nsec3() *nsec3Config {
+	if p == nil {
+		return nil
+	}
+	return p.NSEC3
+}
+
+// nsec3Chain hashes the authoritative names of a zone, and the empty non-terminals
+// above them, linking them in hash order (RFC 5155 section 7.1). Names only holding
+// an unsigned delegation don't get RRSIG in their type bitmap.
+func nsec3Chain(apex string, names map[string]map[uint16]bool, cuts map[string]bool, p *nsec3Config, ttl uint32) []*dns.NSEC3 {
+	byHash := map[string]map[uint16]bool{}
+	for name, types := range names {
+		h := dns.HashName(name, dns.SHA1, p.Iterations, p.Salt)
+		if byHash[h] == nil {
+			byHash[h] = map[uint16]bool{}
+		}
+		for t := range types {
+			byHash[h][t] = true
+		}
+		if !cuts[strings.ToLower(name)] || types[dns.TypeDS] {
+			byHash[h][dns.TypeRRSIG] = true
+		}
+		for _, i := range dns.Split(name)[1:] { // empty non-terminals
+			if dns.CountLabel(name[i:]) <= dns.CountLabel(apex) {
+				break
+			}
+			if h := dns.HashName(name[i:], dns.SHA1, p.Iterations, p.Salt); byHash[h] == nil {
+				byHash[h] = map[uint16]bool{}
+			}
+		}
+	}
+	hashes := []string{}
+	for h := range byHash {
+		hashes = append(hashes, h)
+	}
+	sort.Strings(hashes)
+	chain := []*dns.NSEC3{}
+	for i, h := range hashes {
+		types := []uint16{}
+		for t := range byHash[h] {
+			types = append(types, t)
+		}
+		sort.Sort(byType(types))
+		chain = append(chain, &dns.NSEC3{Hdr: dns.RR_Header{Name: strings.ToLower(h) + "." + apex, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: ttl},
+			Hash: dns.SHA1, Iterations: p.Iterations, SaltLength: uint8(len(p.Salt) / 2), Salt: p.Salt,
+			HashLength: 20, NextDomain: hashes[(i+1)%len(hashes)], TypeBitMap: types})
+	}
+	return chain
+}
+
+// nsec3Param returns the NSEC3PARAM record published at the apex with an NSEC3 chain
+func nsec3Param(apex string, p *nsec3Config) *dns.NSEC3PARAM {
+	return &dns.NSEC3PARAM{Hdr: dns.RR_Header{Name: apex, Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET, Ttl: 0},
+		Hash: dns.SHA1, Iterations: p.Iterations, SaltLength: uint8(len(p.Salt) / 2), Salt: p.Salt}
+}
+
+// nsec3Hash returns the hash an NSEC3 record is owned by, in upper case
+func nsec3Hash(rr *dns.NSEC3) string {
+	return strings.ToUpper(strings.SplitN(rr.Hdr.Name, ".", 2)[0])
+}
+
+type byNSEC3Hash []*dns.NSEC3
+
+func (s byNSEC3Hash) Len() int           { return len(s) }
+func (s byNSEC3Hash) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byNSEC3Hash) Less(i, j int) bool { return nsec3Hash(s[i]) < nsec3Hash(s[j]) }
+
+// findNSEC3 returns the NSEC3 matching name, or the one covering its hash, and
+// whether it matches
+func (z *zone) findNSEC3(name string) (*dns.NSEC3, bool) {
+	first := z.nsec3s[0]
+	h := dns.HashName(name, first.Hash, first.Iterations, first.Salt)
+	i := sort.Search(len(z.nsec3s), func(i int) bool { return nsec3Hash(z.nsec3s[i]) > h })
+	if i == 0 {
+		i = len(z.nsec3s) // before the first hash, so covered by the last
+	}
+	return z.nsec3s[i-1], nsec3Hash(z.nsec3s[i-1]) == h
+}
+
+// nsec3Proof returns the NSEC3 records proving an empty answer for name (RFC 5155
+// section 7.2): the one matching the name if it exists, otherwise the closest
+// encloser proof and the one covering the wildcard that could have matched it.
+func (z *zone) nsec3Proof(name string, exists bool) []dns.RR {
+	proof := []dns.RR{}
+	add := func(rr *dns.NSEC3) {
+		for _, p := range proof {
+			if p == dns.RR(rr) {
+				return
+			}
+		}
+		proof = append(proof, rr)
+	}
+	if exists {
+		if rr, match := z.findNSEC3(name); match {
+			add(rr)
+		}
+		return proof
+	}
+	ce := z.closestEncloser(name)
+	if rr, match := z.findNSEC3(ce); match {
+		add(rr)
+	}
+	rr, _ := z.findNSEC3(nextCloser(name, ce))
+	add(rr)
+	rr, _ = z.findNSEC3("*." + ce)
+	add(rr)
+	return proof
+}
@@ -0,0 +1,75 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// --ns-map lets zone files name placeholder nameservers, such as ns1.nameserver.invalid,
+// that are replaced by the deployment's own nameservers as the zone is served. NS
+// targets, SOA MNAMEs and address records owned by a placeholder (its glue) are
+// rewritten, so the same zone files work for every environment or white-label brand.
+
+// parseNSMap reads --ns-map, a comma separated list of placeholder=nameserver.
+func parseNSMap(list string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, entry := range splitList(list) {
+		f := strings.SplitN(entry, "=", 2)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("invalid --ns-map entry %q: use placeholder=nameserver", entry)
+		}
+		from, to := dns.Fqdn(strings.ToLower(f[0])), dns.Fqdn(strings.ToLower(f[1]))
+		for _, n := range []string{from, to} {
+			if _, ok := dns.IsDomainName(n); !ok || n == "." || strings.Contains(n, " ") {
+				return nil, fmt.Errorf("invalid --ns-map entry %q: %s is not a domain name", entry, n)
+			}
+		}
+		m[from] = to
+	}
+	return m, nil
+}
+
+// rewriteNS replaces placeholder nameservers in the zone's records. Rewritten records
+// are copies, as z.rrs may share records with the zone as loaded.
+func (c *config) rewriteNS(z *zone) {
+	if len(c.nsMap) == 0 {
+		return
+	}
+	rrs := make([]dns.RR, len(z.rrs))
+	copy(rrs, z.rrs)
+	rewritten := 0
+	for i, rr := range rrs {
+		var name string
+		switch r := rr.(type) {
+		case *dns.NS:
+			name = r.Ns
+		case *dns.SOA:
+			name = r.Ns
+		case *dns.A, *dns.AAAA: // glue
+			name = r.Header().Name
+		default:
+			continue
+		}
+		to, ok := c.nsMap[strings.ToLower(name)]
+		if !ok {
+			continue
+		}
+		rr = dns.Copy(rr)
+		switch r := rr.(type) {
+		case *dns.NS:
+			r.Ns = to
+		case *dns.SOA:
+			r.Ns = to
+		default:
+			r.Header().Name = to
+		}
+		rrs[i] = rr
+		rewritten++
+	}
+	z.rrs = rrs
+	if rewritten > 0 {
+		c.debug(fmt.Sprintf("Substituted nameservers in %d records of zone %s", rewritten, z.name))
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"testing"
+)
+
+func TestNSMap(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}}
+	var err error
+	if c.nsMap, err = parseNSMap("nsa.abc.com=ns1.example.net,NSB.abc.com.=ns2.example.net"); err != nil || len(c.nsMap) != 2 {
+		t.Fatalf("parseNSMap: %v %v", c.nsMap, err)
+	}
+	for _, bad := range []string{"nsa.abc.com", "nsa.abc.com=bad name"} {
+		if _, err := parseNSMap(bad); err == nil {
+			t.Errorf("Expected --ns-map %q to be refused", bad)
+		}
+	}
+	zone := abcZone + "nsa 300 IN A 192.0.2.53\n"
+	if err := c.loadZones(map[string]string{"abc.com": zone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	r := testQuery(&c, "abc.com", "abc.com.", dns.TypeNS)
+	got := map[string]bool{}
+	for _, rr := range r.Answer {
+		got[rr.(*dns.NS).Ns] = true
+	}
+	if len(got) != 2 || !got["ns1.example.net."] || !got["ns2.example.net."] {
+		t.Errorf("Expected the placeholder nameservers to be replaced, got %v", r.Answer)
+	}
+	if r := testQuery(&c, "abc.com", "abc.com.", dns.TypeSOA); r.Answer[0].(*dns.SOA).Ns != "ns1.example.net." {
+		t.Errorf("Expected the SOA MNAME to be replaced, got %v", r.Answer)
+	}
+	if r := testQuery(&c, "abc.com", "nsa.abc.com.", dns.TypeA); len(r.Answer) != 0 {
+		t.Errorf("Expected the placeholder glue to move to the served name, got %v", r.Answer)
+	}
+	c.soaMname = "primary.example.net."
+	c.registerZone(c.zones["abc.com"])
+	if r := testQuery(&c, "abc.com", "abc.com.", dns.TypeSOA); r.Answer[0].(*dns.SOA).Ns != "primary.example.net." {
+		t.Errorf("Expected --soa-mname to win over --ns-map, got %v", r.Answer)
+	}
+}
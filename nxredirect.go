@@ -0,0 +1,108 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+// Some internal deployments want names that don't exist in a zone to resolve to a
+// captive portal or search page. A view opts in with "nxdomain_redirect" in its rule:
+//
+//	{"views": [{"name": "office", "cidrs": ["10.0.0.0/8"],
+//	            "nxdomain_redirect": {"a": ["10.0.0.80"], "ttl": 30}}]}
+//
+// Queries in that view for a name with no records, at or below it, get the configured
+// A or AAAA records, or with "cname" a CNAME for every query type. Clients outside the
+// view still get an empty answer.
+type nxRedirect struct {
+	A     []string `json:"a"`
+	AAAA  []string `json:"aaaa"`
+	CNAME string   `json:"cname"`
+	TTL   uint32   `json:"ttl"`
+
+	a, aaaa []net.IP
+}
+
+const nxRedirectTTL = 60
+
+func (r *nxRedirect) compile(zoneName, view string) error {
+	for _, s := range r.A {
+		ip := net.ParseIP(s)
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("Error in policy for zone %s: view %s redirects to %q, not an IPv4 address", zoneName, view, s)
+		}
+		r.a = append(r.a, ip.To4())
+	}
+	for _, s := range r.AAAA {
+		ip := net.ParseIP(s)
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("Error in policy for zone %s: view %s redirects to %q, not an IPv6 address", zoneName, view, s)
+		}
+		r.aaaa = append(r.aaaa, ip)
+	}
+	if len(r.CNAME) > 0 {
+		if len(r.a) > 0 || len(r.aaaa) > 0 {
+			return fmt.Errorf("Error in policy for zone %s: view %s redirects to both a CNAME and addresses", zoneName, view)
+		}
+		r.CNAME = dns.Fqdn(r.CNAME)
+		if _, ok := dns.IsDomainName(r.CNAME); !ok {
+			return fmt.Errorf("Error in policy for zone %s: view %s redirects to %q, not a domain name", zoneName, view, r.CNAME)
+		}
+	} else if len(r.a) == 0 && len(r.aaaa) == 0 {
+		return fmt.Errorf("Error in policy for zone %s: view %s has an empty nxdomain_redirect", zoneName, view)
+	}
+	if r.TTL == 0 {
+		r.TTL = nxRedirectTTL
+	}
+	return nil
+}
+
+// nxRedirect returns the redirect configured for a view of the zone, if any.
+func (p *zonePolicy) nxRedirect(view string) *nxRedirect {
+	if p == nil || len(view) == 0 {
+		return nil
+	}
+	for _, v := range p.Views {
+		if v.Name == view {
+			return v.NXDomain
+		}
+	}
+	return nil
+}
+
+// redirect synthesizes the answer to q for a name that doesn't exist.
+func (r *nxRedirect) redirect(q dns.Question) []dns.RR {
+	h := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: r.TTL}
+	rrs := []dns.RR{}
+	if len(r.CNAME) > 0 {
+		h.Rrtype = dns.TypeCNAME
+		return append(rrs, &dns.CNAME{Hdr: h, Target: r.CNAME})
+	}
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+		h.Rrtype = dns.TypeA
+		for _, ip := range r.a {
+			rrs = append(rrs, &dns.A{Hdr: h, A: ip})
+		}
+	}
+	if q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY {
+		h.Rrtype = dns.TypeAAAA
+		for _, ip := range r.aaaa {
+			rrs = append(rrs, &dns.AAAA{Hdr: h, AAAA: ip})
+		}
+	}
+	return rrs
+}
+
+// hasName reports whether the zone has records at name or below it, so name exists.
+func (z *zone) hasName(name string) bool {
+	name = strings.ToLower(name)
+	for _, rr := range z.rrs {
+		if dns.IsSubDomain(name, strings.ToLower(rr.Header().Name)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"testing"
+)
+
+func TestNXRedirect(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}}
+	policy := `{"views": [{"name": "office", "cidrs": ["127.0.0.0/8"], "nxdomain_redirect": {"a": ["10.0.0.80"], "aaaa": ["fd00::80"]}}]}`
+	if err := c.loadZones(map[string]string{"abc.com": abcZone + "a.b IN TXT \"x\"\n", "abc.com.policy": policy, "abc.com@office": abcZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	office := c.views.get("abc.com", "office")
+	query := func(z *zone, name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		w := &testWriter{}
+		z.zoneHandler(&c, w, req)
+		return w.msg
+	}
+	if r := query(office, "nope.abc.com.", dns.TypeA); len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "10.0.0.80" || r.Answer[0].Header().Ttl != nxRedirectTTL {
+		t.Errorf("Expected a redirect for a missing name, got %v", r.Answer)
+	}
+	if r := query(office, "nope.abc.com.", dns.TypeAAAA); len(r.Answer) != 1 || r.Answer[0].(*dns.AAAA).AAAA.String() != "fd00::80" {
+		t.Errorf("Expected an AAAA redirect for a missing name, got %v", r.Answer)
+	}
+	if r := query(office, "nope.abc.com.", dns.TypeMX); len(r.Answer) != 0 {
+		t.Errorf("Expected no redirect for other types, got %v", r.Answer)
+	}
+	if r := query(office, "abc.com.", dns.TypeAAAA); len(r.Answer) != 0 {
+		t.Errorf("Expected no redirect for a name that exists, got %v", r.Answer)
+	}
+	if r := query(c.zones["abc.com"], "nope.abc.com.", dns.TypeA); len(r.Answer) != 0 {
+		t.Errorf("Expected no redirect outside the view, got %v", r.Answer)
+	}
+	if c.zones["abc.com"].hasName("nope.abc.com.") || !c.zones["abc.com"].hasName("B.abc.com.") {
+		t.Errorf("Expected an empty non-terminal to exist")
+	}
+
+	cname := `{"views": [{"name": "office", "cidrs": ["127.0.0.0/8"], "nxdomain_redirect": {"cname": "search.example.net"}}]}`
+	if err := c.loadZones(map[string]string{"abc.com.policy": cname}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if r := query(c.views.get("abc.com", "office"), "nope.abc.com.", dns.TypeMX); len(r.Answer) != 1 || r.Answer[0].(*dns.CNAME).Target != "search.example.net." {
+		t.Errorf("Expected a CNAME redirect after the policy changed, got %v", r.Answer)
+	}
+	for _, bad := range []string{`{"a": ["fd00::1"]}`, `{"cname": "x.net", "a": ["10.0.0.1"]}`, `{}`} {
+		if _, err := parsePolicy("abc.com", `{"views": [{"name": "v", "cidrs": ["10.0.0.0/8"], "nxdomain_redirect": `+bad+`}]}`); err == nil {
+			t.Errorf("Expected redirect %s to be refused", bad)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"strings"
+)
+
+// Parked zones are generated from a pair of bucket objects sharing a base name:
+// <set>.template is a zone file using only relative names (@, www, mail...) and
+// <set>.domains lists the domains to serve from it, one per line. Every listed
+// domain gets its own copy of the template with $ORIGIN set to the domain, so
+// thousands of identical zones only need two objects in S3. A zone with its own
+// zone file, fetched now or earlier, wins over the template, and dropping it from
+// the list leaves it served.
+const (
+	templateSuffix = ".template"
+	domainsSuffix  = ".domains"
+)
+
+type zoneTemplate struct {
+	template string
+	domains  []string
+}
+
+// expandTemplates replaces any template or domain list objects in zones with
+// the zones they expand to. Templates are remembered across updates, so a
+// changed domain list re-expands against the last fetched template and vice versa.
+// It returns the template key each expanded zone came from.
+func (c *config) expandTemplates(zones map[string]string) map[string]string {
+	if c.templates == nil {
+		c.templates = map[string]*zoneTemplate{}
+		c.explicit = map[string]bool{}
+	}
+	sources := map[string]string{}
+	changed := map[string][]string{} // set name -> domains served before this update
+	for key, contents := range zones {
+		var set string
+		switch {
+		case strings.HasSuffix(key, templateSuffix):
+			set = strings.TrimSuffix(key, templateSuffix)
+		case strings.HasSuffix(key, domainsSuffix):
+			set = strings.TrimSuffix(key, domainsSuffix)
+		default:
+			continue
+		}
+		t, ok := c.templates[set]
+		if !ok {
+			t = &zoneTemplate{}
+			c.templates[set] = t
+		}
+		if _, ok := changed[set]; !ok {
+			changed[set] = t.domains
+		}
+		if strings.HasSuffix(key, templateSuffix) {
+			t.template = contents
+		} else {
+			t.domains = parseDomainList(key, contents)
+		}
+		delete(zones, key)
+	}
+	for n := range zones { // the zone files left
+		c.explicit[n] = true
+	}
+
+	for set, previous := range changed {
+		t := c.templates[set]
+		if len(t.template) < 1 {
+			log.Printf("Warning: domain list %s has no matching %s%s, skipping", set+domainsSuffix, set, templateSuffix)
+			continue
+		}
+		current := map[string]bool{}
+		for _, d := range t.domains {
+			current[d] = true
+			if c.explicitZone(d, zones) {
+				continue
+			}
+			zones[d] = t.template
+			sources[d] = set + templateSuffix
+		}
+		for _, d := range previous {
+			if !current[d] && !c.explicitZone(d, zones) {
+				dns.HandleRemove(d)
+				delete(c.zones, d)
+				c.debug(fmt.Sprintf("Removed parked zone %s", d))
+			}
+		}
+		c.debug(fmt.Sprintf("Expanded template %s to %d zones", set, len(t.domains)))
+	}
+	return sources
+}
+
+// explicitZone reports whether zone d has its own zone file, in this update's
+// zones or loaded by an earlier one, rather than a template's
+func (c *config) explicitZone(d string, zones map[string]string) bool {
+	if _, ok := zones[d]; ok {
+		return true
+	}
+	return c.explicit[d]
+}
+
+func parseDomainList(key, contents string) []string {
+	domains := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	for scanner.Scan() {
+		d := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if i := strings.Index(d, "#"); i >= 0 {
+			d = strings.TrimSpace(d[:i])
+		}
+		d = strings.TrimSuffix(d, ".")
+		if len(d) < 1 {
+			continue
+		}
+		if _, ok := dns.IsDomainName(d); !ok || strings.ContainsAny(d, " \t") {
+			log.Printf("Warning: skipping invalid domain %q in %s", d, key)
+			continue
+		}
+		domains = append(domains, d)
+	}
+	return domains
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/quipo/statsd"
+	"testing"
+)
+
+var parkedTemplate = `$TTL    300
+@		86400	IN	SOA	ns1.parking.net. admin.parking.net. ( 2015111501 10800 1200 864000 7200 )
+		IN	NS	ns1.parking.net.
+		IN	MX	10 mail.parking.net.
+		IN	TXT	"v=spf1 -all"
+		IN	A	127.0.0.9
+www		IN	CNAME	@
+`
+
+func TestExpandTemplates(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}}
+	zones := map[string]string{
+		"abc.com":         abcZone,
+		"parked.template": parkedTemplate,
+		"parked.domains":  "# parked domains\nghi.com\nJKL.com.\n\nabc.com\nnot a domain\n",
+	}
+	c.expandTemplates(zones)
+	if len(zones) != 3 {
+		t.Errorf("expandTemplates returned wrong # of zones (got: %d, wanted: %d)", len(zones), 3)
+	}
+	for _, n := range []string{"ghi.com", "jkl.com"} {
+		if zones[n] != parkedTemplate {
+			t.Errorf("expandTemplates did not expand %s", n)
+		}
+	}
+	if zones["abc.com"] != abcZone {
+		t.Errorf("expandTemplates replaced explicit zone %s", "abc.com")
+	}
+	zones = map[string]string{"abc.com": abcZone, "parked.domains": "ghi.com\njkl.com\nabc.com\n"} // as fetched
+	if err := c.loadZones(zones); err != nil {
+		t.Errorf("loadZones failed: %s", err.Error())
+	}
+
+	zones = map[string]string{"parked.domains": "ghi.com\nmno.com\n"}
+	c.expandTemplates(zones)
+	if len(zones) != 2 || zones["mno.com"] != parkedTemplate {
+		t.Errorf("expandTemplates did not re-expand stored template: %v", zones)
+	}
+
+	// zones with their own file, loaded earlier, are neither replaced nor removed
+	if err := c.loadZones(map[string]string{"def.com": defZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	zones = map[string]string{"parked.domains": "ghi.com\njkl.com\nabc.com\ndef.com\n"}
+	if err := c.loadZones(zones); err != nil {
+		t.Errorf("loadZones failed: %s", err.Error())
+	}
+	if _, ok := zones["def.com"]; ok || zones["jkl.com"] != parkedTemplate {
+		t.Errorf("expandTemplates replaced explicit zone def.com: %v", zones)
+	}
+	c.loadZones(map[string]string{"parked.domains": "ghi.com\n"})
+	for n, explicit := range map[string]bool{"abc.com": true, "def.com": true, "jkl.com": false} {
+		if c.explicitZone(n, nil) != explicit {
+			t.Errorf("Expected zone %s explicit %v after leaving the domain list", n, explicit)
+		}
+	}
+
+	zones = map[string]string{"orphan.domains": "pqr.com\n"}
+	c.expandTemplates(zones)
+	if len(zones) != 0 {
+		t.Errorf("expandTemplates expanded domains without a template: %v", zones)
+	}
+}
@@ -0,0 +1,84 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+type parsedZone struct {
+	rrs       []dns.RR
+	scheduled []scheduledRR
+	err       error
+}
+
+// parseZones parses zone files on up to one goroutine per CPU, so a single huge
+// zone no longer holds up the rest of a reload. Each zone's parse time is sent
+// as the zoneparse.<zone> timer, and the whole batch as zoneparse.
+func (c *config) parseZones(zones map[string]string) map[string]parsedZone {
+	start := time.Now()
+	names := make(chan string)
+	results := map[string]parsedZone{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	workers := runtime.NumCPU()
+	if workers > len(zones) {
+		workers = len(zones)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range names {
+				t := time.Now()
+				rrs, scheduled, err := parseZone(n, zones[n])
+				if err == nil {
+					err = c.checkZoneNames(n, rrs, scheduled)
+				}
+				if err == nil {
+					rrs, err = c.checkPrivateZone(n, rrs)
+				}
+				elapsed := time.Since(t)
+				c.stats.Timing("zoneparse."+statName(n), int64(elapsed/time.Millisecond))
+				c.debug(fmt.Sprintf("Parsed zone %s (%d records) in %s", n, len(rrs)+len(scheduled), elapsed))
+				mu.Lock()
+				results[n] = parsedZone{rrs, scheduled, err}
+				mu.Unlock()
+			}
+		}()
+	}
+	for n := range zones {
+		names <- n
+	}
+	close(names)
+	wg.Wait()
+	c.stats.Timing("zoneparse", int64(time.Since(start)/time.Millisecond))
+	return results
+}
+
+// statName makes a zone name usable as a single statsd path element
+func statName(n string) string {
+	return strings.Replace(strings.TrimSuffix(n, "."), ".", "_", -1)
+}
+
+// checkZoneNames logs the name warnings of a parsed zone, counted by
+// zoneparse.warning, and returns its first name error
+func (c *config) checkZoneNames(n string, rrs []dns.RR, scheduled []scheduledRR) error {
+	all := append([]dns.RR{}, rrs...)
+	for _, s := range scheduled {
+		all = append(all, s.rr)
+	}
+	for _, p := range append(checkNames(all), checkDNAMEs(all)...) {
+		if p.severity == "error" {
+			return fmt.Errorf("Error parsing zone %s: %s: %s", n, p.name, p.msg)
+		}
+		c.stats.Incr("zoneparse.warning", 1)
+		log.Printf("Warning: zone %s: %s: %s", n, p.name, p.msg)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/quipo/statsd"
+	"strings"
+	"testing"
+)
+
+func TestParseZones(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}}
+	zones := map[string]string{
+		"abc.com":  abcZone,
+		"def.com":  defZone,
+		"flat.com": flatZone,
+		"bad.com":  "@ IN BOGUS 1.2.3.4\n",
+	}
+	parsed := c.parseZones(zones)
+	if len(parsed) != len(zones) {
+		t.Fatalf("parseZones returned wrong # of zones (got: %d, wanted: %d)", len(parsed), len(zones))
+	}
+	if parsed["abc.com"].err != nil || len(parsed["abc.com"].rrs) != 6 {
+		t.Errorf("Expected abc.com to parse with 6 records, got %d (%v)", len(parsed["abc.com"].rrs), parsed["abc.com"].err)
+	}
+	if parsed["bad.com"].err == nil {
+		t.Errorf("Expected bad.com to fail to parse")
+	}
+
+	err := c.loadZones(zones)
+	if err == nil || !strings.Contains(err.Error(), "bad.com") {
+		t.Errorf("Expected loadZones to report bad.com, got %v", err)
+	}
+	if _, ok := c.zones["def.com"]; !ok {
+		t.Errorf("Expected good zones to load despite bad.com")
+	}
+	if _, ok := c.zones["bad.com"]; ok {
+		t.Errorf("Expected bad.com not to be registered")
+	}
+}
+
+func TestStatName(t *testing.T) {
+	if n := statName("abc.example.com."); n != "abc_example_com" {
+		t.Errorf("Expected abc_example_com, got %s", n)
+	}
+}
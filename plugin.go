@@ -0,0 +1,135 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"plugin"
+)
+
+// --plugins loads Go plugins (go build -buildmode=plugin) for site-specific logic,
+// such as custom steering or billing counters, without forking neddns. A plugin
+// exports any of these functions, which are called for every query to a zone:
+//
+//	// PreQuery runs before the query is answered. A non-nil reply is sent instead
+//	// of looking the query up.
+//	func PreQuery(client net.Addr, req *dns.Msg) *dns.Msg
+//
+//	// PostLookup can change the records found for a question.
+//	func PostLookup(zone string, q dns.Question, answer []dns.RR) []dns.RR
+//
+//	// PreResponse can change the reply just before it is sent.
+//	func PreResponse(client net.Addr, req, resp *dns.Msg)
+//
+// Plugins must be built with the same Go version and github.com/miekg/dns as
+// neddns, and only load on Linux, FreeBSD and macOS. Hooks run in the order the
+// plugins are listed. A hook that panics is counted by plugin.error and skipped for
+// that query; it is called again for the next one.
+type pluginHooks struct {
+	preQuery    []func(net.Addr, *dns.Msg) *dns.Msg
+	postLookup  []func(string, dns.Question, []dns.RR) []dns.RR
+	preResponse []func(net.Addr, *dns.Msg, *dns.Msg)
+}
+
+// loadPlugins opens each plugin, before any chroot or sandbox is applied.
+func loadPlugins(paths []string) (*pluginHooks, error) {
+	h := &pluginHooks{}
+	for _, path := range paths {
+		p, err := plugin.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading plugin %s: %s", path, err.Error())
+		}
+		found := 0
+		if sym, err := p.Lookup("PreQuery"); err == nil {
+			f, ok := sym.(func(net.Addr, *dns.Msg) *dns.Msg)
+			if !ok {
+				return nil, fmt.Errorf("Error loading plugin %s: PreQuery has the wrong signature", path)
+			}
+			h.preQuery = append(h.preQuery, f)
+			found++
+		}
+		if sym, err := p.Lookup("PostLookup"); err == nil {
+			f, ok := sym.(func(string, dns.Question, []dns.RR) []dns.RR)
+			if !ok {
+				return nil, fmt.Errorf("Error loading plugin %s: PostLookup has the wrong signature", path)
+			}
+			h.postLookup = append(h.postLookup, f)
+			found++
+		}
+		if sym, err := p.Lookup("PreResponse"); err == nil {
+			f, ok := sym.(func(net.Addr, *dns.Msg, *dns.Msg))
+			if !ok {
+				return nil, fmt.Errorf("Error loading plugin %s: PreResponse has the wrong signature", path)
+			}
+			h.preResponse = append(h.preResponse, f)
+			found++
+		}
+		if found == 0 {
+			return nil, fmt.Errorf("Error loading plugin %s: it exports no PreQuery, PostLookup or PreResponse hook", path)
+		}
+		log.Printf("Loaded plugin %s with %d hooks", path, found)
+	}
+	return h, nil
+}
+
+// rewrites reports whether hooks change answers, so packed hot answers can't be used.
+// It is nil-safe.
+func (h *pluginHooks) rewrites() bool {
+	return h != nil && (len(h.postLookup) > 0 || len(h.preResponse) > 0)
+}
+
+// recoverHook counts and logs a panicking hook
+func recoverHook(c *config, hook string) {
+	if r := recover(); r != nil {
+		c.stats.Incr("plugin.error", 1)
+		log.Printf("Warning: plugin %s hook failed: %v", hook, r)
+	}
+}
+
+// runPreQuery returns the first reply a PreQuery hook gives, if any. It is nil-safe.
+func (h *pluginHooks) runPreQuery(c *config, w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
+	if h == nil {
+		return nil
+	}
+	for _, f := range h.preQuery {
+		var reply *dns.Msg
+		func() {
+			defer recoverHook(c, "PreQuery")
+			reply = f(w.RemoteAddr(), req)
+		}()
+		if reply != nil {
+			c.stats.Incr("plugin.answered", 1)
+			return reply
+		}
+	}
+	return nil
+}
+
+// runPostLookup passes the records found for q through each PostLookup hook. It is nil-safe.
+func (h *pluginHooks) runPostLookup(c *config, zone string, q dns.Question, rrs []dns.RR) []dns.RR {
+	if h == nil {
+		return rrs
+	}
+	for _, f := range h.postLookup {
+		func() {
+			defer recoverHook(c, "PostLookup")
+			rrs = f(zone, q, rrs)
+		}()
+	}
+	return rrs
+}
+
+// runPreResponse lets each PreResponse hook change the reply. It is nil-safe.
+func (h *pluginHooks) runPreResponse(c *config, w dns.ResponseWriter, req, resp *dns.Msg) {
+	if h == nil {
+		return
+	}
+	for _, f := range h.preResponse {
+		func() {
+			defer recoverHook(c, "PreResponse")
+			f(w.RemoteAddr(), req, resp)
+		}()
+	}
+}
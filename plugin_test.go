@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"net"
+	"testing"
+)
+
+func TestPluginHooks(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, hotSize: 10}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	c.plugins = &pluginHooks{
+		preQuery: []func(net.Addr, *dns.Msg) *dns.Msg{
+			func(client net.Addr, req *dns.Msg) *dns.Msg {
+				if req.Question[0].Name != "blocked.abc.com." {
+					return nil
+				}
+				m := new(dns.Msg)
+				m.SetRcode(req, dns.RcodeRefused)
+				return m
+			},
+		},
+		postLookup: []func(string, dns.Question, []dns.RR) []dns.RR{
+			func(zone string, q dns.Question, answer []dns.RR) []dns.RR {
+				if q.Qtype == dns.TypeA && zone == "abc.com" {
+					return append(answer, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("10.5.5.5")})
+				}
+				return answer
+			},
+			func(zone string, q dns.Question, answer []dns.RR) []dns.RR {
+				panic("broken plugin")
+			},
+		},
+		preResponse: []func(net.Addr, *dns.Msg, *dns.Msg){
+			func(client net.Addr, req, resp *dns.Msg) {
+				resp.Authoritative = false
+			},
+		},
+	}
+	if r := testQuery(&c, "abc.com", "blocked.abc.com.", dns.TypeA); r == nil || r.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected PreQuery to refuse, got %v", r)
+	}
+	for i := 0; i < 2; i++ { // the second time would be hot without plugins
+		r := testQuery(&c, "abc.com", "abc.com.", dns.TypeA)
+		if r == nil || len(r.Answer) != 2 || r.Authoritative {
+			t.Errorf("Expected PostLookup to add a record and PreResponse to clear AA, got %v", r)
+		}
+		c.zones["abc.com"].hot.refresh(&c)
+	}
+
+	if _, err := loadPlugins([]string{"/nonexistent/plugin.so"}); err == nil {
+		t.Errorf("Expected an error loading a missing plugin")
+	}
+}
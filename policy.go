@@ -0,0 +1,350 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Per-zone behavior lives in an optional JSON policy object stored next to the
+// zone in the bucket as <zone>.policy, e.g. abc.com.policy:
+//
+//	{"forward": [{"zone": "corp.abc.com", "servers": ["10.0.0.53"]}]}
+//
+// Settings shared by many zones can be set once in layers the zone policies
+// inherit: *.policy applies to every zone, and a zone group policy such as
+// *.example.com.policy to every zone below example.com. A zone's policy is its
+// layers merged from the global one down through the groups to its own, the most
+// specific layer setting each top-level field as a whole, so a zone's rate_limit
+// replaces the group's rather than changing part of it. Forward rules only make
+// sense for one zone, so layers can't have them.
+//
+// The fields of zonePolicy are the policy schema. Its version is policyVersion,
+// which a policy may state as "version"; a policy with a newer version, or with a
+// field the schema doesn't have, such as a misspelled one, fails to load rather
+// than being silently half applied.
+const (
+	policySuffix  = ".policy"
+	globalPolicy  = "*" // the layer every zone inherits
+	policyVersion = 1
+)
+
+type zonePolicy struct {
+	Version        int            `json:"version"`
+	Forward        []forwardRule  `json:"forward"`
+	Rewrite        []rewriteRule  `json:"rewrite"`
+	DelegationOnly bool           `json:"delegation_only"` // serve only delegations and glue, see delegationOnly
+	AnswerGlue     bool           `json:"answer_glue"`     // answer names below delegations rather than refer, see delegationFor
+	Staged         bool           `json:"staged"`          // deploy new versions through a staging view, see stageZone
+	Views          []viewRule     `json:"views"`           // who gets which <zone>@<view> zone file, see selectView
+	QTypes         []qtypeRule    `json:"qtypes"`          // per query type handling, see qtypeRule
+	Webhooks       []string       `json:"webhooks"`        // told about each reload of the zone, see notifyReload
+	RateLimit      *zoneRateLimit `json:"rate_limit"`      // queries per second the zone answers, see zoneRateLimit
+	NSEC3          *nsec3Config   `json:"nsec3"`           // deny names with NSEC3 when signing, see nsec3Config
+	AllowTransfer  *transferACL   `json:"allow_transfer"`  // who may AXFR the zone, see transferACL
+	AlsoNotify     []string       `json:"also_notify"`     // secondaries sent a NOTIFY on new serials, see notifySecondaries
+	TTL            *ttlClamp      `json:"ttl"`             // bounds on the zone's record TTLs, see clampTTLs
+	MaxAnswers     int            `json:"max_answers"`     // records of an RRset per answer, see limitAnswers
+}
+
+// ttlClamp bounds the TTLs a zone's records are served with, whatever its file says
+type ttlClamp struct {
+	Min uint32 `json:"min"`
+	Max uint32 `json:"max"` // 0 for no maximum
+}
+
+// forwardRule sends queries at or below Zone to Servers instead of answering locally
+type forwardRule struct {
+	Zone    string   `json:"zone"`
+	Servers []string `json:"servers"`
+}
+
+// loadPolicies removes policy objects from zones, storing them on the config.
+// It returns the names of already-loaded zones whose policy changed but whose
+// zone file did not, so the caller can re-register them with the new policy, and
+// the keys of policy objects that failed to parse, which keep their previous
+// version like a zone file that fails.
+func (c *config) loadPolicies(zones map[string]string) ([]string, []string) {
+	if c.policies == nil {
+		c.policies = map[string]*zonePolicy{}
+		c.policyLayers = map[string]string{}
+	}
+	layers, failed := []string{}, []string{}
+	for key, contents := range zones {
+		if !strings.HasSuffix(key, policySuffix) {
+			continue
+		}
+		delete(zones, key)
+		layer := strings.TrimSuffix(key, policySuffix)
+		if err := checkPolicyLayer(layer, contents); err != nil {
+			log.Print(err)
+			failed = append(failed, key)
+			continue
+		}
+		c.policyLayers[layer] = contents
+		c.debug(fmt.Sprintf("Loaded policy for zone %s", layer))
+		layers = append(layers, layer)
+	}
+	names := map[string]bool{}
+	for n := range c.zones {
+		names[n] = true
+	}
+	for n := range c.policies {
+		names[n] = true
+	}
+	for _, layer := range layers {
+		if !isPolicyLayer(layer) {
+			names[layer] = true
+		}
+	}
+	changed := []string{}
+	for n := range names {
+		if !inheritsAny(n, layers) {
+			continue
+		}
+		p, err := c.mergePolicy(n)
+		if err != nil { // the layers were checked above, so this shouldn't happen
+			log.Printf("Warning: %s", err.Error())
+			continue
+		}
+		c.policies[n] = p
+		if _, ok := zones[n]; !ok {
+			changed = append(changed, n)
+		}
+	}
+	sort.Strings(changed)
+	return changed, failed
+}
+
+// policyFor returns the policy of zone n, merging its layers the first time
+func (c *config) policyFor(n string) *zonePolicy {
+	if p, ok := c.policies[n]; ok || len(c.policyLayers) == 0 {
+		return p
+	}
+	p, err := c.mergePolicy(n)
+	if err != nil { // the layers were checked as they loaded, so this shouldn't happen
+		log.Printf("Warning: %s", err.Error())
+		return nil
+	}
+	if c.policies == nil {
+		c.policies = map[string]*zonePolicy{}
+	}
+	c.policies[n] = p
+	return p
+}
+
+// mergePolicy merges the policy layers of zone n, returning nil if it has none
+func (c *config) mergePolicy(n string) (*zonePolicy, error) {
+	merged := map[string]json.RawMessage{}
+	found := false
+	for _, layer := range policyLayers(n) {
+		contents, ok := c.policyLayers[layer]
+		if !ok {
+			continue
+		}
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal([]byte(contents), &fields); err != nil {
+			return nil, fmt.Errorf("Error parsing policy for zone %s: %s", layer, err.Error())
+		}
+		for k, v := range fields {
+			merged[k] = v
+		}
+		found = true
+	}
+	if !found {
+		return nil, nil
+	}
+	b, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	return parsePolicy(n, string(b))
+}
+
+// policyLayers returns the policy layers zone n inherits, from the global layer
+// down through the zone groups above it to its own
+func policyLayers(n string) []string {
+	n = strings.TrimSuffix(n, ".")
+	layers := []string{globalPolicy}
+	labels := dns.Split(n)
+	for i := len(labels) - 1; i > 0; i-- {
+		layers = append(layers, "*."+n[labels[i]:])
+	}
+	return append(layers, n)
+}
+
+// isPolicyLayer reports whether a policy is a global or zone group layer rather
+// than a zone's own
+func isPolicyLayer(name string) bool {
+	return name == globalPolicy || strings.HasPrefix(name, "*.")
+}
+
+// inheritsAny reports whether zone n has any of the policy layers
+func inheritsAny(n string, layers []string) bool {
+	for _, l := range policyLayers(n) {
+		if contains(layers, l) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPolicyLayer checks a policy object, of a zone or a layer zones inherit
+func checkPolicyLayer(name, contents string) error {
+	if isPolicyLayer(name) {
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal([]byte(contents), &fields); err != nil {
+			return fmt.Errorf("Error parsing policy for zone %s: %s", name, err.Error())
+		}
+		if _, ok := fields["forward"]; ok {
+			return fmt.Errorf("Error in policy for zone %s: forward rules can only be set in a zone's own policy", name)
+		}
+	}
+	_, err := parsePolicy(name, contents)
+	return err
+}
+
+func parsePolicy(n, contents string) (*zonePolicy, error) {
+	p := zonePolicy{}
+	d := json.NewDecoder(strings.NewReader(contents))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&p); err != nil {
+		return nil, fmt.Errorf("Error parsing policy for zone %s: %s", n, err.Error())
+	}
+	if p.Version < 0 || p.Version > policyVersion {
+		return nil, fmt.Errorf("Error in policy for zone %s: version %d is not supported, this neddns understands up to %d", n, p.Version, policyVersion)
+	}
+	if p.MaxAnswers < 0 {
+		return nil, fmt.Errorf("Error in policy for zone %s: max_answers must not be negative", n)
+	}
+	if p.TTL != nil && p.TTL.Max > 0 && p.TTL.Min > p.TTL.Max {
+		return nil, fmt.Errorf("Error in policy for zone %s: ttl min %d is above max %d", n, p.TTL.Min, p.TTL.Max)
+	}
+	for i, f := range p.Forward {
+		f.Zone = dns.Fqdn(strings.ToLower(f.Zone))
+		if !dns.IsSubDomain(dns.Fqdn(n), f.Zone) {
+			return nil, fmt.Errorf("Error in policy for zone %s: forward zone %s is outside the zone", n, f.Zone)
+		}
+		if len(f.Servers) < 1 {
+			return nil, fmt.Errorf("Error in policy for zone %s: forward zone %s has no servers", n, f.Zone)
+		}
+		for j, s := range f.Servers {
+			if _, _, err := net.SplitHostPort(s); err != nil {
+				f.Servers[j] = net.JoinHostPort(s, "53")
+			}
+		}
+		p.Forward[i] = f
+	}
+	for i := range p.Rewrite {
+		if err := p.Rewrite[i].compile(n); err != nil {
+			return nil, err
+		}
+	}
+	for i := range p.QTypes {
+		if err := p.QTypes[i].compile(n); err != nil {
+			return nil, err
+		}
+	}
+	for i := range p.Views {
+		if err := p.Views[i].compile(n); err != nil {
+			return nil, err
+		}
+	}
+	if p.NSEC3 != nil {
+		if err := p.NSEC3.compile(n); err != nil {
+			return nil, err
+		}
+	}
+	if p.RateLimit != nil {
+		if err := p.RateLimit.compile(n); err != nil {
+			return nil, err
+		}
+	}
+	if p.AllowTransfer != nil {
+		if err := p.AllowTransfer.compile(n); err != nil {
+			return nil, err
+		}
+	}
+	for i, t := range p.AlsoNotify {
+		target, err := serverAddr(t)
+		if err != nil {
+			return nil, fmt.Errorf("Error in policy for zone %s: also_notify: %s", n, err.Error())
+		}
+		p.AlsoNotify[i] = target
+	}
+	for _, hook := range p.Webhooks {
+		if err := checkWebhook(hook); err != nil {
+			return nil, fmt.Errorf("Error in policy for zone %s: webhook %s", n, err.Error())
+		}
+	}
+	return &p, nil
+}
+
+// clampTTLs serves the zone's records with TTLs within the policy's bounds
+func (c *config) clampTTLs(z *zone) {
+	if z.policy == nil || z.policy.TTL == nil {
+		return
+	}
+	clamp := z.policy.TTL
+	rrs := make([]dns.RR, len(z.rrs))
+	copy(rrs, z.rrs)
+	clamped := 0
+	for i, rr := range rrs {
+		ttl := rr.Header().Ttl
+		switch {
+		case ttl < clamp.Min:
+			ttl = clamp.Min
+		case clamp.Max > 0 && ttl > clamp.Max:
+			ttl = clamp.Max
+		default:
+			continue
+		}
+		rrs[i] = dns.Copy(rr)
+		rrs[i].Header().Ttl = ttl
+		clamped++
+	}
+	if clamped > 0 {
+		c.debug(fmt.Sprintf("Clamped the TTLs of %d records of zone %s", clamped, z.name))
+	}
+	z.rrs = rrs
+}
+
+// forwardRule returns the most specific forwarding rule covering name, if any.
+func (p *zonePolicy) forwardRule(name string) *forwardRule {
+	if p == nil {
+		return nil
+	}
+	var match *forwardRule
+	for i, f := range p.Forward {
+		if dns.IsSubDomain(f.Zone, strings.ToLower(name)) {
+			if match == nil || dns.CountLabel(f.Zone) > dns.CountLabel(match.Zone) {
+				match = &p.Forward[i]
+			}
+		}
+	}
+	return match
+}
+
+// forward relays req to the rule's servers in order, returning the first answer.
+func (c *config) forward(f *forwardRule, req *dns.Msg) (*dns.Msg, error) {
+	var err error
+	for _, server := range f.Servers {
+		var resp *dns.Msg
+		d := new(dns.Client)
+		resp, _, err = d.Exchange(req, server)
+		if err == nil && resp.Truncated {
+			d.Net = "tcp"
+			resp, _, err = d.Exchange(req, server)
+		}
+		if err == nil {
+			return resp, nil
+		}
+		log.Printf("Warning: forwarding %s to %s failed: %s", req.Question[0].Name, server, err.Error())
+	}
+	return nil, err
+}
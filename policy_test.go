@@ -0,0 +1,136 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestForwardPolicy(t *testing.T) {
+	started := make(chan bool)
+	upstream := &dns.Server{Addr: "127.0.0.1:25354", Net: "udp", NotifyStartedFunc: func() { started <- true }}
+	upstream.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if len(req.Question) != 1 { // Shutdown() pokes the listener with an empty message
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("10.9.9.9")})
+		w.WriteMsg(m)
+	})
+	go upstream.ListenAndServe()
+	<-started
+	defer upstream.Shutdown()
+
+	c := config{stats: statsd.NoopClient{}}
+	err := c.loadZones(map[string]string{
+		"abc.com":        abcZone,
+		"abc.com.policy": `{"forward": [{"zone": "corp.abc.com", "servers": ["127.0.0.1:25354"]}]}`,
+	})
+	if err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	m := testQuery(&c, "abc.com", "host.corp.abc.com.", dns.TypeA)
+	if m == nil || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.9.9.9" {
+		t.Errorf("forwarded query failed: want: %s, got: %v", "10.9.9.9", m)
+	}
+	m = testQuery(&c, "abc.com", "abc.com.", dns.TypeA)
+	if m == nil || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+		t.Errorf("local query failed: want: %s, got: %v", "127.0.0.1", m)
+	}
+
+	err = c.loadZones(map[string]string{"abc.com.policy": `{"forward": [{"zone": "corp.abc.com", "servers": ["127.0.0.1:25355"]}]}`})
+	if err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	m = testQuery(&c, "abc.com", "host.corp.abc.com.", dns.TypeA)
+	if m == nil || m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("forward to dead server should SERVFAIL, got: %v", m)
+	}
+
+	if _, err := parsePolicy("abc.com", `{"forward": [{"zone": "corp.def.com", "servers": ["10.0.0.1"]}]}`); err == nil {
+		t.Errorf("parsePolicy accepted a forward zone outside the zone")
+	}
+}
+
+func TestPolicyLayers(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}}
+	cust := strings.Replace(abcZone, "abc.com", "cust.example.com", -1)
+	err := c.loadZones(map[string]string{
+		"abc.com":                 abcZone,
+		"cust.example.com":        cust,
+		"example.com":             strings.Replace(abcZone, "abc.com", "example.com", -1),
+		"*.policy":                `{"also_notify": ["192.0.2.1"], "rate_limit": {"qps": 100}}`,
+		"*.example.com.policy":    `{"rate_limit": {"qps": 10, "action": "slip", "slip": 2}, "staged": true}`,
+		"cust.example.com.policy": `{"staged": false}`,
+	})
+	if err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	abc, custPolicy, example := c.zones["abc.com"].policy, c.zones["cust.example.com"].policy, c.zones["example.com"].policy
+	if abc == nil || abc.RateLimit.QPS != 100 || len(abc.AlsoNotify) != 1 {
+		t.Errorf("Expected abc.com to inherit the global policy, got %+v", abc)
+	}
+	if custPolicy == nil || custPolicy.RateLimit.QPS != 10 || custPolicy.RateLimit.Slip != 2 || custPolicy.Staged || len(custPolicy.AlsoNotify) != 1 {
+		t.Errorf("Expected cust.example.com to inherit the global and group policies and override staged, got %+v", custPolicy)
+	}
+	if example == nil || example.RateLimit.QPS != 100 || example.Staged {
+		t.Errorf("Expected the group policy to apply only below example.com, got %+v", example)
+	}
+
+	// a layer changing alone updates every zone inheriting it
+	if err := c.loadZones(map[string]string{"*.policy": `{"rate_limit": {"qps": 50}}`}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if p := c.zones["abc.com"].policy; p == nil || p.RateLimit.QPS != 50 || len(p.AlsoNotify) != 0 {
+		t.Errorf("Expected abc.com to get the new global policy, got %+v", p)
+	}
+	if p := c.zones["cust.example.com"].policy; p == nil || p.RateLimit.QPS != 10 {
+		t.Errorf("Expected the group's rate_limit to still win, got %+v", p)
+	}
+	if targets := c.notifyTargets("abc.com"); len(targets) != 0 {
+		t.Errorf("Expected no NOTIFY targets left, got %v", targets)
+	}
+
+	// zones loaded later inherit the layers too
+	if err := c.loadZones(map[string]string{"new.example.com": strings.Replace(abcZone, "abc.com", "new.example.com", -1)}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if p := c.zones["new.example.com"].policy; p == nil || !p.Staged || p.RateLimit.QPS != 10 {
+		t.Errorf("Expected a new zone to inherit its group's policy, got %+v", p)
+	}
+
+	if err := c.loadZones(map[string]string{"*.policy": `{"forward": [{"zone": "corp.abc.com", "servers": ["10.0.0.1"]}]}`}); err == nil {
+		t.Errorf("Expected forward rules to be refused in a layer")
+	}
+	if layers := policyLayers("a.b.example.com"); strings.Join(layers, " ") != "* *.com *.example.com *.b.example.com a.b.example.com" {
+		t.Errorf("Unexpected policy layers %v", layers)
+	}
+}
+
+func TestPolicySchema(t *testing.T) {
+	for _, policy := range []string{`{"stagged": true}`, `{"rate_limit": {"qps": 5, "bust": 10}}`, `{"version": 2}`, `{"ttl": {"min": 600, "max": 60}}`} {
+		if _, err := parsePolicy("abc.com", policy); err == nil {
+			t.Errorf("Expected policy %s to fail validation", policy)
+		}
+	}
+	if p, err := parsePolicy("abc.com", `{"version": 1, "staged": true}`); err != nil || !p.Staged {
+		t.Errorf("Expected a version 1 policy to load, got %v %v", p, err)
+	}
+
+	c := config{stats: statsd.NoopClient{}}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone, "abc.com.policy": `{"ttl": {"min": 600, "max": 3600}}`}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if m := testQuery(&c, "abc.com", "abc.com.", dns.TypeA); len(m.Answer) != 1 || m.Answer[0].Header().Ttl != 600 {
+		t.Errorf("Expected the A record's TTL raised to 600, got %v", m.Answer)
+	}
+	if m := testQuery(&c, "abc.com", "abc.com.", dns.TypeSOA); len(m.Answer) != 1 || m.Answer[0].Header().Ttl != 3600 {
+		t.Errorf("Expected the SOA's TTL lowered to 3600, got %v", m.Answer)
+	}
+	if c.zones["abc.com"].base[0].Header().Ttl != 86400 {
+		t.Errorf("Expected the zone file's records left as they were")
+	}
+}
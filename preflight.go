@@ -0,0 +1,172 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// type bucketChecker is implemented by zoneGetters that can cheaply verify access
+type bucketChecker interface {
+	CheckBucket() error
+}
+
+// validate checks flag values for mistakes we can catch before touching the network.
+func (c *config) validate() error {
+	problems := []string{}
+	if p, err := strconv.Atoi(c.port); err != nil || p < 1 || p > 65535 {
+		problems = append(problems, fmt.Sprintf("invalid --port %q: must be a number from 1 to 65535", c.port))
+	}
+	if c.update < time.Second {
+		problems = append(problems, "invalid --update: must be at least 1 second")
+	}
+	if c.hotSize < 0 {
+		problems = append(problems, "invalid --hot: must not be negative")
+	}
+	if c.staleAfter < 0 {
+		problems = append(problems, "invalid --stale: must not be negative")
+	}
+	if _, _, err := net.SplitHostPort(c.resolver); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid --resolver %q: use host:port, e.g. 8.8.8.8:53", c.resolver))
+	}
+	if len(c.statsdServer) > 0 {
+		if _, _, err := net.SplitHostPort(c.statsdServer); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid --statsd_server %q: use host:port, e.g. localhost:8125", c.statsdServer))
+		}
+	}
+	if len(c.region) < 1 {
+		problems = append(problems, "invalid --region: must not be empty")
+	}
+	if len(c.localAddr) > 0 {
+		if err := validateLocal(c.localAddr); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if c.readOnly {
+		for _, w := range c.writablePaths() {
+			problems = append(problems, "--readonly is set but "+w)
+		}
+	}
+	if len(c.chrootDir) > 0 {
+		if fi, err := os.Stat(c.chrootDir); err != nil || !fi.IsDir() {
+			problems = append(problems, fmt.Sprintf("invalid --chroot %q: not a directory", c.chrootDir))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// writablePaths describes every option that will write to the filesystem, for the
+// --readonly self-check. Options that add file output must be listed here.
+func (c *config) writablePaths() []string {
+	paths := []string{}
+	if len(c.logfile) > 0 && !isLogURL(c.logfile) {
+		paths = append(paths, fmt.Sprintf("--log writes to %s (log to stdout, syslog:// or journald:// instead)", c.logfile))
+	}
+	if isUnixSocketAddr(c.localAddr) {
+		paths = append(paths, fmt.Sprintf("--local creates the socket %s (use a loopback host:port instead)", c.localAddr))
+	}
+	if len(c.cacheFile) > 0 {
+		paths = append(paths, fmt.Sprintf("--cache-file writes to %s (leave it unset)", c.cacheFile))
+	}
+	return paths
+}
+
+// preflight verifies bucket access, the flattening resolver, the open file limit and
+// the listen port, unless an upgrade hands it over, at startup, logging an actionable message for each failure.
+// Resolver and file limit failures are only warnings since the server may run fine.
+func (c *config) preflight(getter zoneGetter) error {
+	failed := false
+	if checker, ok := getter.(bucketChecker); ok {
+		if err := checker.CheckBucket(); err != nil {
+			log.Printf("Error: cannot access bucket %s: %s", c.bucket, bucketHint(err))
+			failed = true
+		}
+	}
+	if err := checkResolver(c.resolver); err != nil {
+		log.Printf("Warning: resolver %s did not answer (%s); root CNAME flattening will fail until it does. Use -r/--resolver to pick another.", c.resolver, err.Error())
+	}
+	c.checkFileLimit()
+	if c.handoff.inheriting() {
+		c.debug("Taking over the listeners of the previous process, not checking the port")
+	} else if err := checkPort(c.port); err != nil {
+		log.Printf("Error: cannot listen on port %s: %s", c.port, err.Error())
+		failed = true
+	}
+	if failed {
+		return fmt.Errorf("Startup checks failed, see errors above")
+	}
+	c.debug("Startup checks passed")
+	return nil
+}
+
+func bucketHint(err error) string {
+	msg := err.Error()
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "NotFound", "NoSuchBucket":
+			return msg + " - check the bucket name"
+		case "Forbidden", "AccessDenied":
+			return msg + " - check the IAM policy grants s3:ListBucket and s3:GetObject (see sample_iam_policy.json)"
+		case "NoCredentialProviders":
+			return msg + " - use -K and -S or set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY"
+		case "PermanentRedirect", "AuthorizationHeaderMalformed", "BadRequest":
+			return msg + " - the bucket may be in another region, check -R/--region"
+		}
+	}
+	return msg
+}
+
+func checkResolver(resolver string) error {
+	m := new(dns.Msg)
+	m.SetQuestion(".", dns.TypeNS)
+	m.RecursionDesired = true
+	d := &dns.Client{DialTimeout: 2 * time.Second, ReadTimeout: 2 * time.Second}
+	r, _, err := d.Exchange(m, resolver)
+	if err != nil {
+		return err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("got %s", dns.RcodeToString[r.Rcode])
+	}
+	return nil
+}
+
+// checkPort makes sure we can bind both the UDP and TCP listeners before loading zones.
+func checkPort(port string) error {
+	u, err := net.ListenPacket("udp", ":"+port)
+	if err != nil {
+		return portHint(err)
+	}
+	u.Close()
+	t, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return portHint(err)
+	}
+	t.Close()
+	return nil
+}
+
+func portHint(err error) error {
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+			switch sysErr.Err {
+			case syscall.EACCES:
+				return fmt.Errorf("%s - ports below 1024 need root or CAP_NET_BIND_SERVICE, or use -p for a higher port", err.Error())
+			case syscall.EADDRINUSE:
+				return fmt.Errorf("%s - another process (bind, dnsmasq, systemd-resolved?) is using the port", err.Error())
+			}
+		}
+	}
+	return err
+}
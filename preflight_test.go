@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	c := config{port: "53", update: 300 * time.Second, resolver: "8.8.8.8:53", region: "us-east-1"}
+	if err := c.validate(); err != nil {
+		t.Errorf("validate rejected good flags: %s", err.Error())
+	}
+	c = config{port: "99999", update: 0, resolver: "8.8.8.8", region: "us-east-1", statsdServer: "localhost"}
+	err := c.validate()
+	if err == nil {
+		t.Fatalf("validate accepted bad flags")
+	}
+	for _, want := range []string{"--port", "--update", "--resolver", "--statsd_server"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("validate missed bad flag: want: %s, got: %s", want, err.Error())
+		}
+	}
+}
+
+func TestValidateReadOnly(t *testing.T) {
+	c := config{port: "53", update: 300 * time.Second, resolver: "8.8.8.8:53", region: "us-east-1", readOnly: true}
+	if err := c.validate(); err != nil {
+		t.Errorf("validate rejected read-only mode without file output: %s", err.Error())
+	}
+	c.logfile = "/var/log/neddns.log"
+	if err := c.validate(); err == nil || !strings.Contains(err.Error(), "--log") {
+		t.Errorf("validate should reject --log in read-only mode, got: %v", err)
+	}
+}
+
+func TestCheckPort(t *testing.T) {
+	l, err := net.Listen("tcp", ":0") // a free port, not testPort, which TestServe holds
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+	if err := checkPort(port); err != nil {
+		t.Errorf("checkPort failed on a free port: %s", err.Error())
+	}
+	l, err = net.Listen("tcp", ":"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	err = checkPort(port)
+	if err == nil || !strings.Contains(err.Error(), "another process") {
+		t.Errorf("checkPort should explain a port in use, got: %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// recordPreset generates the records a SaaS provider asks customers to add, so
+// onboarding doesn't depend on copy-pasting them from provider docs. Presets are
+// applied by name with their values, e.g. from the API:
+//
+//	"presets": [{"name": "google-workspace", "values": {"verification": "rXOxyZounnZasA8Z7oaD3c14JdjS9aKSWvsR1EbUSIQ"}}]
+type recordPreset struct {
+	Description string   `json:"description"`
+	Required    []string `json:"required"`
+	Optional    []string `json:"optional"`
+	labels      []string // values used in names, as space separated labels
+	build       func(domain string, v map[string]string) presetRecords
+}
+
+// presetRecords are records relative to the domain ("<owner> <type> <data>", @ for
+// the apex) plus SPF mechanisms, which are merged into a single SPF record since a
+// domain with more than one is invalid.
+type presetRecords struct {
+	records []string
+	spf     []string
+}
+
+type presetParams struct {
+	Name   string            `json:"name"`
+	Values map[string]string `json:"values"`
+}
+
+var recordPresets = map[string]recordPreset{
+	"google-workspace": {
+		Description: "Google Workspace mail, site verification and DKIM",
+		Required:    []string{"verification"},
+		Optional:    []string{"dkim"},
+		build: func(domain string, v map[string]string) presetRecords {
+			r := presetRecords{spf: []string{"include:_spf.google.com"}}
+			for _, mx := range mxPresets["google"](domain) {
+				r.records = append(r.records, "@ MX "+mx)
+			}
+			r.records = append(r.records, "@ TXT "+txtData("google-site-verification="+v["verification"]))
+			if len(v["dkim"]) > 0 {
+				r.records = append(r.records, "google._domainkey TXT "+txtData("v=DKIM1; k=rsa; p="+v["dkim"]))
+			}
+			return r
+		},
+	},
+	"microsoft-365": {
+		Description: "Microsoft 365 mail, autodiscover, domain verification and DKIM",
+		Required:    []string{"verification", "tenant"},
+		labels:      []string{"tenant"},
+		build: func(domain string, v map[string]string) presetRecords {
+			dashed := strings.Replace(strings.TrimSuffix(domain, "."), ".", "-", -1)
+			tenant := strings.TrimSuffix(v["tenant"], ".onmicrosoft.com")
+			r := presetRecords{spf: []string{"include:spf.protection.outlook.com"}}
+			for _, mx := range mxPresets["microsoft"](domain) {
+				r.records = append(r.records, "@ MX "+mx)
+			}
+			r.records = append(r.records,
+				"@ TXT "+txtData(v["verification"]),
+				"autodiscover CNAME autodiscover.outlook.com.",
+				"selector1._domainkey CNAME selector1-"+dashed+"._domainkey."+tenant+".onmicrosoft.com.",
+				"selector2._domainkey CNAME selector2-"+dashed+"._domainkey."+tenant+".onmicrosoft.com.")
+			return r
+		},
+	},
+	"ses": {
+		Description: "Amazon SES sending with Easy DKIM and domain verification",
+		Required:    []string{"dkim"},
+		Optional:    []string{"verification"},
+		labels:      []string{"dkim"},
+		build: func(domain string, v map[string]string) presetRecords {
+			r := presetRecords{spf: []string{"include:amazonses.com"}}
+			for _, token := range strings.Fields(v["dkim"]) {
+				r.records = append(r.records, token+"._domainkey CNAME "+token+".dkim.amazonses.com.")
+			}
+			if len(v["verification"]) > 0 {
+				r.records = append(r.records, "_amazonses TXT "+txtData(v["verification"]))
+			}
+			return r
+		},
+	},
+	"github-pages": {
+		Description: "GitHub Pages apex addresses, www and domain verification",
+		Required:    []string{"user"},
+		Optional:    []string{"challenge"},
+		labels:      []string{"user"},
+		build: func(domain string, v map[string]string) presetRecords {
+			r := presetRecords{}
+			for i := 8; i <= 11; i++ {
+				r.records = append(r.records,
+					fmt.Sprintf("@ A 185.199.%d.153", 100+i),
+					fmt.Sprintf("@ AAAA 2606:50c0:800%d::153", i-8))
+			}
+			r.records = append(r.records, "www CNAME "+v["user"]+".github.io.")
+			if len(v["challenge"]) > 0 {
+				r.records = append(r.records, "_github-pages-challenge-"+v["user"]+" TXT "+txtData(v["challenge"]))
+			}
+			return r
+		},
+	},
+}
+
+// applyPresets returns the absolute record lines (without TTL and class) and the
+// merged SPF mechanisms for a zone's presets.
+func applyPresets(domain string, presets []presetParams) ([][3]string, []string, error) {
+	records := [][3]string{}
+	spf := []string{}
+	seen := map[string]bool{}
+	for _, p := range presets {
+		preset, ok := recordPresets[p.Name]
+		if !ok {
+			return nil, nil, fmt.Errorf("%s: unknown preset %q (available: %s)", domain, p.Name, strings.Join(presetNames(), ", "))
+		}
+		if seen[p.Name] {
+			return nil, nil, fmt.Errorf("%s: preset %s given twice", domain, p.Name)
+		}
+		seen[p.Name] = true
+		for _, k := range preset.Required {
+			if len(strings.TrimSpace(p.Values[k])) == 0 {
+				return nil, nil, fmt.Errorf("%s: preset %s needs a value for %s", domain, p.Name, k)
+			}
+		}
+		for k, v := range p.Values {
+			if !contains(preset.Required, k) && !contains(preset.Optional, k) {
+				return nil, nil, fmt.Errorf("%s: preset %s has no value %s", domain, p.Name, k)
+			}
+			if !validPresetValue(v, contains(preset.labels, k)) {
+				return nil, nil, fmt.Errorf("%s: preset %s value %s contains invalid characters", domain, p.Name, k)
+			}
+		}
+		r := preset.build(domain, p.Values)
+		for _, rec := range r.records {
+			f := strings.SplitN(rec, " ", 3)
+			owner := domain
+			if f[0] != "@" {
+				owner = f[0] + "." + domain
+			}
+			records = append(records, [3]string{owner, f[1], f[2]})
+		}
+		spf = append(spf, r.spf...)
+	}
+	return records, spf, nil
+}
+
+// txtData quotes a TXT value, splitting it into the 255 byte strings DNS allows
+func txtData(s string) string {
+	parts := []string{}
+	for len(s) > 0 {
+		n := len(s)
+		if n > 255 {
+			n = 255
+		}
+		chunk := strings.Replace(strings.Replace(s[:n], "\\", "\\\\", -1), "\"", "\\\"", -1)
+		parts = append(parts, "\""+chunk+"\"")
+		s = s[n:]
+	}
+	if len(parts) == 0 {
+		return "\"\""
+	}
+	return strings.Join(parts, " ")
+}
+
+var presetLabel = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+// validPresetValue rejects values that could break out of the record they go in
+func validPresetValue(v string, label bool) bool {
+	if strings.IndexFunc(v, unicode.IsControl) >= 0 {
+		return false
+	}
+	if !label {
+		return true
+	}
+	for _, f := range strings.Fields(v) {
+		if !presetLabel.MatchString(f) {
+			return false
+		}
+	}
+	return true
+}
+
+// parsePresetSpec reads a preset from the command line, as name:key=value,key=value
+func parsePresetSpec(spec string) (presetParams, error) {
+	p := presetParams{Values: map[string]string{}}
+	parts := strings.SplitN(spec, ":", 2)
+	p.Name = parts[0]
+	if len(parts) == 1 {
+		return p, nil
+	}
+	for _, kv := range strings.Split(parts[1], ",") {
+		f := strings.SplitN(kv, "=", 2)
+		if len(f) != 2 {
+			return p, fmt.Errorf("invalid --preset %q: use name:key=value,key=value", spec)
+		}
+		p.Values[strings.TrimSpace(f[0])] = f[1]
+	}
+	return p, nil
+}
+
+func presetNames() []string {
+	names := []string{}
+	for n := range recordPresets {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"strings"
+	"testing"
+)
+
+func TestPresets(t *testing.T) {
+	longKey := strings.Repeat("MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEA", 10)
+	g, err := generateZone(zoneParams{Domain: "abc.com", IPs: []string{"10.0.0.1"}, Presets: []presetParams{
+		{Name: "google-workspace", Values: map[string]string{"verification": "abc123", "dkim": longKey}},
+		{Name: "ses", Values: map[string]string{"dkim": "tok1 tok2 tok3", "verification": "sesabc"}},
+	}}, []string{"ns1.host.net"})
+	if err != nil {
+		t.Fatalf("generateZone failed: %s", err.Error())
+	}
+	rrs, err := parseZoneFile(g.Name, g.contents)
+	if err != nil {
+		t.Fatalf("generated zone does not parse: %s", err.Error())
+	}
+	for _, p := range checkZone(g.Name, rrs) {
+		t.Errorf("generated zone has problem: %s", p)
+	}
+	spf := 0
+	for _, rr := range rrs {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		joined := strings.Join(txt.Txt, "")
+		switch {
+		case strings.HasPrefix(joined, "v=spf1"):
+			spf++
+			if joined != "v=spf1 include:_spf.google.com include:amazonses.com ~all" {
+				t.Errorf("Unexpected merged SPF record %q", joined)
+			}
+		case txt.Hdr.Name == "google._domainkey.abc.com.":
+			if len(txt.Txt) < 2 || joined != "v=DKIM1; k=rsa; p="+longKey {
+				t.Errorf("Expected the DKIM key split into several strings, got %d", len(txt.Txt))
+			}
+		}
+	}
+	if spf != 1 {
+		t.Errorf("Expected exactly one SPF record, got %d", spf)
+	}
+	if !strings.Contains(g.contents, "tok2._domainkey.abc.com.\t300\tIN\tCNAME\ttok2.dkim.amazonses.com.") {
+		t.Errorf("Expected SES DKIM CNAMEs, got:\n%s", g.contents)
+	}
+
+	g, err = generateZone(zoneParams{Domain: "abc.com", Presets: []presetParams{
+		{Name: "github-pages", Values: map[string]string{"user": "octocat"}},
+		{Name: "microsoft-365", Values: map[string]string{"verification": "MS=ms12345678", "tenant": "contoso.onmicrosoft.com"}},
+	}}, []string{"ns1.host.net"})
+	if err != nil {
+		t.Fatalf("generateZone failed: %s", err.Error())
+	}
+	for _, want := range []string{"www.abc.com.\t300\tIN\tCNAME\toctocat.github.io.", "185.199.111.153", "selector1-abc-com._domainkey.contoso.onmicrosoft.com."} {
+		if !strings.Contains(g.contents, want) {
+			t.Errorf("Expected %s in generated zone:\n%s", want, g.contents)
+		}
+	}
+	if strings.Contains(g.contents, "www.abc.com.\t300\tIN\tCNAME\tabc.com.") {
+		t.Errorf("Expected the preset's www to replace the default")
+	}
+
+	for _, p := range []zoneParams{
+		{Domain: "abc.com", IPs: []string{"10.0.0.1"}, Presets: []presetParams{{Name: "mailchimp"}}},
+		{Domain: "abc.com", IPs: []string{"10.0.0.1"}, Presets: []presetParams{{Name: "ses"}}},
+		{Domain: "abc.com", IPs: []string{"10.0.0.1"}, Presets: []presetParams{{Name: "ses", Values: map[string]string{"dkim": "a", "color": "b"}}}},
+		{Domain: "abc.com", IPs: []string{"10.0.0.1"}, Presets: []presetParams{{Name: "github-pages", Values: map[string]string{"user": "x.github.io.\nevil"}}}},
+		{Domain: "abc.com", IPs: []string{"10.0.0.1"}, Presets: []presetParams{{Name: "github-pages", Values: map[string]string{"user": "octocat"}}}},
+		{Domain: "abc.com", IPs: []string{"10.0.0.1"}, MX: "google", Presets: []presetParams{{Name: "google-workspace", Values: map[string]string{"verification": "x"}}}},
+	} {
+		if _, err := generateZone(p, []string{"ns1.host.net"}); err == nil {
+			t.Errorf("generateZone accepted %+v", p)
+		}
+	}
+}
+
+func TestParsePresetSpec(t *testing.T) {
+	p, err := parsePresetSpec("ses:dkim=tok1 tok2 tok3,verification=abc=")
+	if err != nil || p.Name != "ses" || p.Values["dkim"] != "tok1 tok2 tok3" || p.Values["verification"] != "abc=" {
+		t.Errorf("parsePresetSpec failed: %+v %v", p, err)
+	}
+	if _, err := parsePresetSpec("ses:dkim"); err == nil {
+		t.Errorf("parsePresetSpec accepted a value without =")
+	}
+}
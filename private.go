@@ -0,0 +1,158 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// Internal deployments often serve zones under names that aren't delegated from the
+// public root: the .internal TLD ICANN reserved for private use, home.arpa (RFC
+// 8375), the de facto .lan, .home, .corp, .private and .intranet (RFC 6762 appendix
+// G), .local, which clashes with mDNS, and the reverse zones of the RFC 1918 and
+// unique local addresses. neddns only answers queries for these private-use zones
+// from clients in --private-clients, private and loopback addresses by default, and
+// refuses the rest, so a server reachable from the internet doesn't leak internal
+// names. Names that must never be served by an authoritative server, .onion (RFC
+// 7686), .localhost and .invalid (RFC 6761), are refused as zones load.
+//
+// Private-use zones are often written by hand without an SOA or NS records, so
+// neddns synthesizes them: the SOA names the first nameserver and hostmaster at the
+// zone, with the time of loading as its serial, and the NS records are --ns.
+var privateUseNames = []string{"internal.", "home.arpa.", "lan.", "home.", "corp.", "private.", "intranet.", "local.",
+	"10.in-addr.arpa.", "168.192.in-addr.arpa.", "d.f.ip6.arpa."}
+
+var forbiddenZoneNames = []string{"onion.", "localhost.", "invalid."}
+
+// defaultPrivateClients are who may query private-use zones without --private-clients
+var defaultPrivateClients, _ = parseCIDRs("10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,100.64.0.0/10,127.0.0.0/8,169.254.0.0/16,fc00::/7,fe80::/10,::1")
+
+const (
+	privateTTL     = 300
+	privateRefresh = 3600
+	privateRetry   = 600
+	privateExpire  = 604800
+)
+
+func init() {
+	for i := 16; i < 32; i++ {
+		privateUseNames = append(privateUseNames, fmt.Sprintf("%d.172.in-addr.arpa.", i))
+	}
+}
+
+// privateUse returns the private-use name zone n is at or below, or ""
+func privateUse(n string) string {
+	return underAny(dns.Fqdn(strings.ToLower(n)), privateUseNames)
+}
+
+func underAny(n string, parents []string) string {
+	for _, p := range parents {
+		if dns.IsSubDomain(p, n) {
+			return p
+		}
+	}
+	return ""
+}
+
+// checkPrivateZone refuses zones under names that must never be served and fills in
+// the SOA and NS records private-use zones lack
+func (c *config) checkPrivateZone(n string, rrs []dns.RR) ([]dns.RR, error) {
+	if p := underAny(dns.Fqdn(strings.ToLower(n)), forbiddenZoneNames); len(p) > 0 {
+		return rrs, fmt.Errorf("Error in zone %s: %s names must never be served by a DNS server", n, strings.TrimSuffix(p, "."))
+	}
+	switch privateUse(n) {
+	case "":
+		return rrs, nil
+	case "local.":
+		log.Printf("Warning: zone %s is under .local, which clients may resolve with mDNS instead", n)
+	}
+	return c.synthesizePrivate(n, rrs, time.Now()), nil
+}
+
+// synthesizePrivate adds an SOA and NS records to a private-use zone without them
+func (c *config) synthesizePrivate(n string, rrs []dns.RR, now time.Time) []dns.RR {
+	apex := dns.Fqdn(strings.ToLower(n))
+	var soa *dns.SOA
+	ns := []string{}
+	for _, rr := range rrs {
+		if !strings.EqualFold(rr.Header().Name, apex) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			soa = rr
+		case *dns.NS:
+			ns = append(ns, rr.Ns)
+		}
+	}
+	if len(ns) == 0 {
+		for _, name := range c.nameservers {
+			name = dns.Fqdn(name)
+			rrs = append(rrs, &dns.NS{Hdr: dns.RR_Header{Name: apex, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: privateTTL}, Ns: name})
+			ns = append(ns, name)
+		}
+		if len(ns) > 0 {
+			c.stats.Incr("zones.private.ns", 1)
+			c.debug(fmt.Sprintf("Synthesized NS records for private-use zone %s", n))
+		} else {
+			log.Printf("Warning: private-use zone %s has no NS records and --ns isn't set", n)
+		}
+	}
+	if soa == nil {
+		mname := "localhost."
+		if len(ns) > 0 {
+			mname = ns[0]
+		}
+		soa = &dns.SOA{Hdr: dns.RR_Header{Name: apex, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: privateTTL},
+			Ns: mname, Mbox: "hostmaster." + apex, Serial: uint32(now.Unix()),
+			Refresh: privateRefresh, Retry: privateRetry, Expire: privateExpire, Minttl: privateTTL}
+		rrs = append([]dns.RR{soa}, rrs...)
+		c.stats.Incr("zones.private.soa", 1)
+		c.debug(fmt.Sprintf("Synthesized SOA for private-use zone %s", n))
+	}
+	return rrs
+}
+
+// privateClient reports whether a query may see private-use zones
+func (c *config) privateClient(w dns.ResponseWriter) bool {
+	if c.isLocal(w) {
+		return true
+	}
+	nets := c.privateNets
+	if nets == nil {
+		nets = defaultPrivateClients
+	}
+	ip := remoteIP(w)
+	for _, n := range nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// refusePrivate refuses queries for private-use zones from other clients
+func (c *config) refusePrivate(w dns.ResponseWriter, req *dns.Msg) bool {
+	if c.privateClient(w) {
+		return false
+	}
+	c.stats.Incr("query.private.refused", 1)
+	c.debug(fmt.Sprintf("Refused query [%s] for a private-use zone", w.RemoteAddr().String()))
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeRefused)
+	c.extendedError(req, m, edeProhibited, "private-use zone")
+	w.WriteMsg(m)
+	return true
+}
+
+// parsePrivateClients reads --private-clients, where any allows every client
+func parsePrivateClients(arg string) ([]*net.IPNet, error) {
+	if strings.TrimSpace(arg) == "any" {
+		return parseCIDRs("0.0.0.0/0,::/0")
+	}
+	return parseCIDRs(arg)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"net"
+	"testing"
+	"time"
+)
+
+// publicWriter is a testWriter for a query from the internet
+type publicWriter struct {
+	testWriter
+}
+
+func (w *publicWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("203.0.113.9"), Port: 5353}
+}
+
+func TestPrivateZone(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, nameservers: []string{"ns1.corp.internal", "ns2.corp.internal"}}
+	if _, err := c.checkPrivateZone("hidden.onion", nil); err == nil {
+		t.Errorf("Expected a zone under .onion refused")
+	}
+	if rrs, err := c.checkPrivateZone("abc.com", nil); err != nil || len(rrs) != 0 {
+		t.Errorf("Expected a public zone left alone, got %v %v", rrs, err)
+	}
+	if privateUse("Corp.Internal") != "internal." || privateUse("1.20.172.in-addr.arpa") != "20.172.in-addr.arpa." || privateUse("internal.com") != "" {
+		t.Errorf("Expected private-use names matched by label")
+	}
+
+	a, _ := dns.NewRR("www.corp.internal. 300 IN A 10.0.0.1")
+	rrs := []dns.RR{a}
+	now := time.Unix(1700000000, 0)
+	rrs = c.synthesizePrivate("corp.internal", rrs, now)
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok || soa.Ns != "ns1.corp.internal." || soa.Mbox != "hostmaster.corp.internal." || soa.Serial != 1700000000 {
+		t.Fatalf("Expected a synthesized SOA first, got %v", rrs)
+	}
+	if countType(rrs, dns.TypeNS) != 2 {
+		t.Errorf("Expected NS records for --ns, got %v", rrs)
+	}
+	if again := c.synthesizePrivate("corp.internal", rrs, now); len(again) != len(rrs) {
+		t.Errorf("Expected a zone with an SOA and NS records left alone, got %v", again)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.corp.internal.", dns.TypeA)
+	w := &publicWriter{}
+	if !c.refusePrivate(w, req) || w.msg.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected a public client refused, got %v", w.msg)
+	}
+	if c.refusePrivate(&testWriter{}, req) {
+		t.Errorf("Expected a loopback client answered")
+	}
+	c.privateNets, _ = parsePrivateClients("any")
+	if c.refusePrivate(&publicWriter{}, req) {
+		t.Errorf("Expected every client answered with --private-clients=any")
+	}
+}
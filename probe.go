@@ -0,0 +1,274 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A process can be up and answering on localhost while its public addresses are
+// unreachable, behind a security group or firewall change or a failed anycast route.
+// The self-probe queries the --self-probe addresses every --probe-every seconds over
+// UDP and TCP for the --probe-names canaries, or the SOA of the first zone served
+// without any, and counts each answer by probe.<target>.<udp|tcp>.ok or .fail with
+// its round trip time as probe.<target>.<udp|tcp>.rtt. A reply must be authoritative
+// and NOERROR to count. With --probe-api, the addresses are also probed from
+// elsewhere by a small HTTP service, asked GET <url>?server=<addr>&name=<name>&type=<type>
+// and answering {"ok": true, "rtt_ms": 12.5} or {"ok": false, "error": "timeout"},
+// counted as probe.<target>.external. A target failing is logged and alerted on
+// (kind probe), and recovering is logged; GET /probes lists the latest results.
+const (
+	probeTimeout    = 2 * time.Second
+	probeAPITimeout = 10 * time.Second
+)
+
+// probeResult is the latest probe of a target over one path
+type probeResult struct {
+	Target  string  `json:"target"`
+	Path    string  `json:"path"` // udp, tcp or external
+	Up      bool    `json:"up"`
+	RTT     float64 `json:"rtt_ms"`
+	Error   string  `json:"error,omitempty"`
+	Checked string  `json:"checked"`
+	Since   string  `json:"since"` // when Up last changed
+}
+
+type byProbeTarget []probeResult
+
+func (p byProbeTarget) Len() int      { return len(p) }
+func (p byProbeTarget) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byProbeTarget) Less(i, j int) bool {
+	if p[i].Target != p[j].Target {
+		return p[i].Target < p[j].Target
+	}
+	return p[i].Path < p[j].Path
+}
+
+type selfProbe struct {
+	targets []string // host:port
+	names   []string
+	every   time.Duration
+	api     string // --probe-api, "" for none
+	mu      sync.Mutex
+	results map[string]*probeResult // by target and path
+}
+
+// parseProbeTargets parses --self-probe addresses, host[:port] with port defaulting
+// to the listen port
+func parseProbeTargets(list, port string) ([]string, error) {
+	targets := []string{}
+	for _, s := range splitList(list) {
+		host, p, err := net.SplitHostPort(s)
+		if err != nil {
+			host, p = strings.Trim(s, "[]"), port
+		}
+		if len(host) == 0 {
+			return nil, fmt.Errorf("%s has no address", s)
+		}
+		targets = append(targets, net.JoinHostPort(host, p))
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no addresses")
+	}
+	return targets, nil
+}
+
+// runProbes probes the targets forever
+func (c *config) runProbes() {
+	for {
+		c.probeOnce(time.Now())
+		time.Sleep(c.probe.every)
+	}
+}
+
+// probeOnce probes every target over every path, in parallel
+func (c *config) probeOnce(now time.Time) {
+	questions := c.probeQuestions()
+	if len(questions) == 0 {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, target := range c.probe.targets {
+		for _, path := range []string{"udp", "tcp", "external"} {
+			if path == "external" && len(c.probe.api) == 0 {
+				continue
+			}
+			wg.Add(1)
+			go func(target, path string) {
+				defer wg.Done()
+				rtt, err := c.probeTarget(target, path, questions)
+				c.probeResult(target, path, rtt, err, now)
+			}(target, path)
+		}
+	}
+	wg.Wait()
+}
+
+// probeQuestions returns the canary questions
+func (c *config) probeQuestions() []dns.Question {
+	questions := []dns.Question{}
+	for _, n := range c.probe.names {
+		questions = append(questions, dns.Question{Name: n, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	}
+	if len(questions) > 0 {
+		return questions
+	}
+	if c.reloads != nil {
+		c.reloads.run.Lock()
+		defer c.reloads.run.Unlock()
+	}
+	zones := []string{}
+	for n := range c.zones {
+		zones = append(zones, n)
+	}
+	if len(zones) == 0 {
+		return questions
+	}
+	sort.Strings(zones)
+	return []dns.Question{{Name: dns.Fqdn(zones[0]), Qtype: dns.TypeSOA, Qclass: dns.ClassINET}}
+}
+
+// probeTarget asks target every question over path, returning the slowest round
+// trip time or the first failure
+func (c *config) probeTarget(target, path string, questions []dns.Question) (time.Duration, error) {
+	var slowest time.Duration
+	for _, q := range questions {
+		var rtt time.Duration
+		var err error
+		if path == "external" {
+			rtt, err = c.probe.external(target, q)
+		} else {
+			rtt, err = probeQuery(target, path, q)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s %s: %s", q.Name, dns.Type(q.Qtype).String(), err.Error())
+		}
+		if rtt > slowest {
+			slowest = rtt
+		}
+	}
+	return slowest, nil
+}
+
+// probeQuery asks server q over network, expecting an authoritative NOERROR reply
+func probeQuery(server, network string, q dns.Question) (time.Duration, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(q.Name, q.Qtype)
+	req.RecursionDesired = false
+	d := &dns.Client{Net: network, DialTimeout: probeTimeout, ReadTimeout: probeTimeout, WriteTimeout: probeTimeout}
+	start := time.Now()
+	r, _, err := d.Exchange(req, server)
+	rtt := time.Since(start) // the client's own leaves out dialing, and TCP
+	if err != nil {
+		return 0, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return 0, fmt.Errorf("got %s", dns.RcodeToString[r.Rcode])
+	}
+	if !r.Authoritative {
+		return 0, fmt.Errorf("not authoritative")
+	}
+	return rtt, nil
+}
+
+// probeAPIReply is what a --probe-api service answers
+type probeAPIReply struct {
+	OK    bool    `json:"ok"`
+	RTT   float64 `json:"rtt_ms"`
+	Error string  `json:"error"`
+}
+
+// external asks the --probe-api service to probe server for q
+func (p *selfProbe) external(server string, q dns.Question) (time.Duration, error) {
+	sep := "?"
+	if strings.Contains(p.api, "?") {
+		sep = "&"
+	}
+	u := p.api + sep + url.Values{"server": {server}, "name": {q.Name}, "type": {dns.Type(q.Qtype).String()}}.Encode()
+	client := &http.Client{Timeout: probeAPITimeout}
+	resp, err := client.Get(u)
+	if err != nil {
+		return 0, fmt.Errorf("probe API: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("probe API: %s", resp.Status)
+	}
+	reply := probeAPIReply{}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return 0, fmt.Errorf("probe API: %s", err.Error())
+	}
+	if !reply.OK {
+		if len(reply.Error) == 0 {
+			reply.Error = "failed"
+		}
+		return 0, fmt.Errorf("%s", reply.Error)
+	}
+	return time.Duration(reply.RTT * float64(time.Millisecond)), nil
+}
+
+// probeResult records a probe of target over path, with metrics, and logs and
+// alerts when it starts failing
+func (c *config) probeResult(target, path string, rtt time.Duration, err error, now time.Time) {
+	stat := "probe." + probeStatName(target) + "." + path
+	if err == nil {
+		c.stats.Incr(stat+".ok", 1)
+		c.stats.PrecisionTiming(stat+".rtt", rtt)
+	} else {
+		c.stats.Incr(stat+".fail", 1)
+	}
+	p := c.probe
+	p.mu.Lock()
+	key := target + " " + path
+	r, seen := p.results[key]
+	if !seen {
+		r = &probeResult{Target: target, Path: path, Up: true, Since: now.UTC().Format(time.RFC3339)}
+		p.results[key] = r
+	}
+	wasUp := r.Up
+	r.Up, r.RTT, r.Error, r.Checked = err == nil, float64(rtt)/float64(time.Millisecond), "", now.UTC().Format(time.RFC3339)
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if r.Up != wasUp {
+		r.Since = r.Checked
+	}
+	p.mu.Unlock()
+	switch {
+	case err != nil && wasUp:
+		msg := fmt.Sprintf("self-probe of %s over %s failing: %s", target, path, err.Error())
+		log.Printf("Warning: %s", msg)
+		c.alerts.alert(c, alertProbe, key, msg)
+	case err == nil && !wasUp:
+		log.Printf("Self-probe of %s over %s recovered (%.1fms)", target, path, r.RTT)
+	}
+}
+
+// probeStatName makes an address usable in a metric name
+func probeStatName(target string) string {
+	return strings.NewReplacer(".", "_", ":", "_", "[", "", "]", "").Replace(target)
+}
+
+// report lists the latest probe results for the admin API. It is nil-safe.
+func (p *selfProbe) report() []probeResult {
+	results := []probeResult{}
+	if p == nil {
+		return results
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, r := range p.results {
+		results = append(results, *r)
+	}
+	sort.Sort(byProbeTarget(results))
+	return results
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSelfProbe(t *testing.T) {
+	stats := &countingStats{counts: map[string]int64{}}
+	c := config{stats: stats}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	for _, network := range []string{"udp", "tcp"} {
+		started := make(chan bool)
+		server := &dns.Server{Addr: "127.0.0.1:25366", Net: network, NotifyStartedFunc: func() { started <- true }}
+		go server.ListenAndServe()
+		defer server.Shutdown()
+		<-started
+	}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("server") == "127.0.0.1:25366" && r.URL.Query().Get("type") == "SOA" {
+			fmt.Fprint(w, `{"ok": true, "rtt_ms": 12.5}`)
+			return
+		}
+		fmt.Fprint(w, `{"ok": false, "error": "timeout"}`)
+	}))
+	defer api.Close()
+
+	targets, err := parseProbeTargets("127.0.0.1:25366, 127.0.0.1:25362", "53")
+	if err != nil {
+		t.Fatalf("parseProbeTargets failed: %s", err.Error())
+	}
+	c.probe = &selfProbe{targets: targets, api: api.URL + "/probe", results: map[string]*probeResult{}}
+	c.probeOnce(time.Now())
+	for _, path := range []string{"udp", "tcp", "external"} {
+		if n := stats.get("probe.127_0_0_1_25366." + path + ".ok"); n != 1 {
+			t.Errorf("Expected the listening address up over %s, got %d", path, n)
+		}
+		if n := stats.get("probe.127_0_0_1_25362." + path + ".fail"); n != 1 {
+			t.Errorf("Expected the closed address down over %s, got %d", path, n)
+		}
+	}
+	report := c.probe.report()
+	if len(report) != 6 || report[0].Target != "127.0.0.1:25362" || report[0].Up || len(report[0].Error) == 0 {
+		t.Fatalf("Expected 6 results starting with the closed address down, got %+v", report)
+	}
+	if r := report[4]; r.Path != "tcp" || !r.Up || r.RTT <= 0 {
+		t.Errorf("Expected the listening address up over tcp with a round trip time, got %+v", r)
+	}
+	if r := report[3]; r.Path != "external" || r.RTT != 12.5 {
+		t.Errorf("Expected the probe API's round trip time, got %+v", r)
+	}
+
+	c.probe.names = []string{"nothere.abc.com."}
+	c.probeOnce(time.Now())
+	if n := stats.get("probe.127_0_0_1_25366.udp.fail"); n != 1 {
+		t.Errorf("Expected a probe answered NXDOMAIN to fail, got %d", n)
+	}
+
+	if targets, err := parseProbeTargets("192.0.2.1,[2001:db8::1]:5353", "53"); err != nil || targets[0] != "192.0.2.1:53" || targets[1] != "[2001:db8::1]:5353" {
+		t.Errorf("Expected the listen port by default, got %v %v", targets, err)
+	}
+	if _, err := parseProbeTargets(":53", "53"); err == nil {
+		t.Errorf("Expected an address without a host refused")
+	}
+}
@@ -0,0 +1,222 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// neddns push validates a local zone file and uploads it in one step. It refuses a
+// file with the errors neddns check reports, and one whose SOA serial is behind the
+// bucket's copy. If the serial is the same as the bucket's but the file changed, the
+// serial is bumped (see nextSerial) in the file and the uploaded text, leaving the
+// rest of the file as written. With --kms-key the zone is encrypted (see
+// encryptZone) before it is uploaded. The key is the file name under --prefix, like
+// every bucket key.
+//
+// With --api-servers, push asks each server's admin API to reload and waits up to
+// --wait seconds for GET /zones/<zone> to report the pushed serial, so a deploy
+// pipeline knows the change is live. --api-token is sent to the servers.
+const pushPoll = time.Second
+
+var soaToken = regexp.MustCompile(`(?i)\sSOA\s`)
+
+// zoneStatus is the response of GET /zones/<zone> on the admin API
+type zoneStatus struct {
+	Zone   string `json:"zone"`
+	Serial uint32 `json:"serial"`
+}
+
+// zoneStatusHandler reports the serial a zone is served with
+func (c *config) zoneStatusHandler(w http.ResponseWriter, r *http.Request, n string) {
+	if r.Method != "GET" {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use GET"})
+		return
+	}
+	n = strings.ToLower(strings.TrimSuffix(n, "."))
+	if c.reloads != nil { // registerZone writes c.zones on reloads
+		c.reloads.run.Lock()
+	}
+	var serial uint32
+	z, ok := c.zones[n]
+	if ok {
+		serial = z.serial()
+	}
+	if c.reloads != nil {
+		c.reloads.run.Unlock()
+	}
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no zone " + n})
+		return
+	}
+	writeJSON(w, http.StatusOK, zoneStatus{Zone: n, Serial: serial})
+}
+
+// pushCommand pushes a zone file and waits for the servers to load it
+func (c *config) pushCommand(store zoneStore, file string, servers []string, wait time.Duration) error {
+	name, serial, err := c.pushZone(store, file, time.Now())
+	if err != nil {
+		return err
+	}
+	if len(servers) == 0 {
+		return nil
+	}
+	return c.waitForServers(servers, name, serial, wait)
+}
+
+// pushZone validates file and uploads it, returning the zone's name and the serial
+// uploaded
+func (c *config) pushZone(store zoneStore, file string, now time.Time) (string, uint32, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", 0, err
+	}
+	name, text := filepath.Base(file), string(b)
+	if problems := validateZone(name, text, nil); len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Printf("%s: %s\n", file, p)
+		}
+		return "", 0, fmt.Errorf("zone %s has %d errors, not pushed", name, len(problems))
+	}
+	serial, ok := textSerial(name, text)
+	if !ok {
+		return "", 0, fmt.Errorf("zone %s has no SOA record, not pushed", name)
+	}
+	key := c.prefix + name
+	if old, ok := c.storedZone(store, key, name); ok {
+		oldSerial, _ := textSerial(name, old)
+		switch {
+		case old == text:
+			fmt.Printf("%s: zone %s is unchanged at serial %d\n", file, name, serial)
+			return name, serial, nil
+		case serial == oldSerial:
+			bumped := nextSerial(serial, now)
+			if text, err = bumpSerial(name, text, serial, bumped); err != nil {
+				return "", 0, err
+			}
+			if err := ioutil.WriteFile(file, []byte(text), 0644); err != nil {
+				return "", 0, err
+			}
+			fmt.Printf("%s: bumped the serial of zone %s from %d to %d\n", file, name, serial, bumped)
+			serial = bumped
+		case !serialNewer(serial, oldSerial):
+			return "", 0, fmt.Errorf("zone %s has serial %d, behind the bucket's %d, not pushed", name, serial, oldSerial)
+		}
+	}
+	upload := text
+	if len(c.kmsKey) > 0 {
+		if upload, err = c.encryptZone(name, text, c.kmsKey); err != nil {
+			return "", 0, err
+		}
+	}
+	if err := store.PutZone(key, upload); err != nil {
+		return "", 0, fmt.Errorf("Error uploading zone %s: %s", name, err.Error())
+	}
+	fmt.Printf("%s: pushed zone %s serial %d to %s\n", file, name, serial, key)
+	return name, serial, nil
+}
+
+// storedZone returns the bucket's copy of zone n, decrypted, if there is one
+func (c *config) storedZone(store zoneGetter, key, n string) (string, bool) {
+	r, err := store.GetZone(key)
+	if err != nil {
+		return "", false
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", false
+	}
+	if !isEncryptedZone(b) {
+		return string(b), true
+	}
+	text, err := c.decryptZone(n, b)
+	return text, err == nil
+}
+
+// textSerial returns the serial of the SOA of zone n's file
+func textSerial(n, text string) (uint32, bool) {
+	rrs, _, err := parseZone(n, text)
+	if err != nil {
+		return 0, false
+	}
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, true
+		}
+	}
+	return 0, false
+}
+
+// bumpSerial replaces the serial old, the first number of that value after the SOA
+// type, with serial in a zone file, keeping its layout and comments
+func bumpSerial(n, text string, old, serial uint32) (string, error) {
+	loc := soaToken.FindStringIndex(text)
+	if loc != nil {
+		number := regexp.MustCompile(`\b` + strconv.FormatUint(uint64(old), 10) + `\b`)
+		if m := number.FindStringIndex(text[loc[1]:]); m != nil {
+			bumped := text[:loc[1]+m[0]] + strconv.FormatUint(uint64(serial), 10) + text[loc[1]+m[1]:]
+			if got, ok := textSerial(n, bumped); ok && got == serial {
+				return bumped, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("could not bump the serial %d of zone %s, bump it in the file", old, n)
+}
+
+// waitForServers asks each server to reload and waits until they all serve zone n
+// with serial, or wait passes
+func (c *config) waitForServers(servers []string, n string, serial uint32, wait time.Duration) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	call := func(method, url string) (*http.Response, error) {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if c.apiToken != nil {
+			req.Header.Set("Authorization", "Bearer "+c.apiToken.get())
+		}
+		return client.Do(req)
+	}
+	for _, s := range servers {
+		if resp, err := call("POST", s+"/reload"); err != nil {
+			fmt.Printf("%s: reload failed: %s\n", s, err.Error())
+		} else {
+			resp.Body.Close()
+		}
+	}
+	waiting := append([]string{}, servers...)
+	deadline := time.Now().Add(wait)
+	for {
+		pending := []string{}
+		for _, s := range waiting {
+			var status zoneStatus
+			resp, err := call("GET", s+"/zones/"+n)
+			if err == nil {
+				err = json.NewDecoder(resp.Body).Decode(&status)
+				resp.Body.Close()
+			}
+			if err == nil && resp.StatusCode == http.StatusOK && !serialNewer(serial, status.Serial) {
+				fmt.Printf("%s: serving zone %s serial %d\n", s, n, status.Serial)
+				continue
+			}
+			pending = append(pending, s)
+		}
+		waiting = pending
+		if len(waiting) == 0 {
+			return nil
+		}
+		if !time.Now().Add(pushPoll).Before(deadline) {
+			return fmt.Errorf("not serving zone %s serial %d after %s: %s", n, serial, wait, strings.Join(waiting, ", "))
+		}
+		time.Sleep(pushPoll)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/quipo/statsd"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "neddns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "good.com")
+	zone := "; kept as written\n" + goodZone // passes neddns check
+	ioutil.WriteFile(file, []byte(zone), 0644)
+	store := testStore{zones: map[string]string{}}
+	c := config{stats: statsd.NoopClient{}, prefix: "zones/"}
+	now := time.Date(2020, 5, 17, 12, 0, 0, 0, time.UTC)
+
+	if n, serial, err := c.pushZone(store, file, now); err != nil || n != "good.com" || serial != 2014121700 || store.zones["zones/good.com"] != zone {
+		t.Fatalf("Expected the zone uploaded as is, got %s %d %v", n, serial, err)
+	}
+	ioutil.WriteFile(file, []byte(zone+"mail IN A 10.0.0.1\n"), 0644)
+	if _, serial, err := c.pushZone(store, file, now); err != nil || serial != 2020051700 {
+		t.Fatalf("Expected an unchanged serial bumped, got %d %v", serial, err)
+	}
+	stored := store.zones["zones/good.com"]
+	if !strings.HasPrefix(stored, "; kept as written\n") || !strings.Contains(stored, "( 2020051700 10800") {
+		t.Errorf("Expected only the serial changed, got %s", stored)
+	}
+	if local, _ := ioutil.ReadFile(file); string(local) != stored {
+		t.Errorf("Expected the bumped serial written to the file too")
+	}
+	if _, _, err := c.pushZone(store, file, now); err != nil {
+		t.Errorf("Expected pushing an unchanged zone to succeed, got %v", err)
+	}
+
+	ioutil.WriteFile(file, []byte(zone), 0644)
+	if _, _, err := c.pushZone(store, file, now); err == nil || store.zones["zones/good.com"] != stored {
+		t.Errorf("Expected a serial behind the bucket's refused")
+	}
+	ioutil.WriteFile(file, []byte(goodZone+"www IN A 10.0.0.1\n"), 0644)
+	if _, _, err := c.pushZone(store, file, now); err == nil || store.zones["zones/good.com"] != stored {
+		t.Errorf("Expected an invalid zone refused")
+	}
+}
+
+func TestPushWait(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, reloads: &reloadStatus{}}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	doUpdate := make(chan bool, 1)
+	srv := httptest.NewServer(c.apiHandler(doUpdate))
+	defer srv.Close()
+	if err := c.waitForServers([]string{srv.URL}, "abc.com", 2014121700, time.Second); err != nil {
+		t.Errorf("Expected the server to serve the serial, got %s", err.Error())
+	}
+	if len(doUpdate) != 1 {
+		t.Errorf("Expected the server asked to reload")
+	}
+	if err := c.waitForServers([]string{srv.URL}, "abc.com", 2014121701, time.Second); err == nil {
+		t.Errorf("Expected waiting for a newer serial to time out")
+	}
+}
@@ -0,0 +1,136 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// qtypeRule is one entry in a zone policy's "qtypes" list, changing how queries of a
+// type are answered:
+//
+//	{"qtypes": [
+//	  {"type": "ANY", "action": "refuse"},
+//	  {"type": "MAILA", "action": "notimp"},
+//	  {"type": "TXT", "action": "truncate", "max_bytes": 512}
+//	]}
+//
+// "refuse" and "notimp" reply REFUSED and NOTIMP, and "drop" doesn't reply at all.
+// "truncate" empties UDP replies larger than max_bytes (512 by default) and sets TC,
+// sending clients to TCP where they get every record, and "minimal" answers with
+// only the first record. ANY queries can also be answered with an RFC 8482 HINFO,
+// "hinfo", or one RRset, "rrset" (see anyMode).
+type qtypeRule struct {
+	Type     string `json:"type"`
+	Action   string `json:"action"`
+	MaxBytes int    `json:"max_bytes"`
+	qtype    uint16
+}
+
+const defaultTruncateBytes = 512
+
+var qtypeActions = map[string]bool{"refuse": true, "notimp": true, "drop": true, "truncate": true, "minimal": true, "hinfo": true, "rrset": true}
+
+func (r *qtypeRule) compile(n string) error {
+	qtype, ok := parseQType(r.Type)
+	if !ok {
+		return fmt.Errorf("Error in policy for zone %s: unknown qtype %q", n, r.Type)
+	}
+	r.qtype = qtype
+	if !qtypeActions[r.Action] {
+		return fmt.Errorf("Error in policy for zone %s: qtype %s action must be refuse, notimp, drop, truncate, minimal, hinfo or rrset", n, r.Type)
+	}
+	if (r.Action == "hinfo" || r.Action == "rrset") && qtype != dns.TypeANY {
+		return fmt.Errorf("Error in policy for zone %s: qtype %s action %s only applies to ANY", n, r.Type, r.Action)
+	}
+	if r.MaxBytes < 0 || (r.MaxBytes > 0 && r.Action != "truncate") {
+		return fmt.Errorf("Error in policy for zone %s: qtype %s max_bytes only applies to truncate", n, r.Type)
+	}
+	if r.Action == "truncate" && r.MaxBytes == 0 {
+		r.MaxBytes = defaultTruncateBytes
+	}
+	return nil
+}
+
+// queryOnlyTypes are query types the dns package has no name for
+var queryOnlyTypes = map[string]uint16{"MAILA": dns.TypeMAILA, "MAILB": dns.TypeMAILB}
+
+// parseQType reads a query type by name, or in TYPEnnn form
+func parseQType(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	if t, ok := dns.StringToType[s]; ok {
+		return t, true
+	}
+	if t, ok := queryOnlyTypes[s]; ok {
+		return t, true
+	}
+	if strings.HasPrefix(s, "TYPE") {
+		n, err := strconv.ParseUint(s[4:], 10, 16)
+		return uint16(n), err == nil
+	}
+	return 0, false
+}
+
+// qtypeRule returns the rule for qtype, if any
+func (p *zonePolicy) qtypeRule(qtype uint16) *qtypeRule {
+	if p == nil {
+		return nil
+	}
+	for i, r := range p.QTypes {
+		if r.qtype == qtype {
+			return &p.QTypes[i]
+		}
+	}
+	return nil
+}
+
+// refuseQuery applies refuse, notimp and drop rules before a query is answered,
+// returning true if it was handled.
+func (r *qtypeRule) refuseQuery(c *config, w dns.ResponseWriter, req *dns.Msg) bool {
+	if r == nil {
+		return false
+	}
+	m := new(dns.Msg)
+	switch r.Action {
+	case "refuse":
+		m.SetRcode(req, dns.RcodeRefused)
+		c.extendedError(req, m, edeProhibited, "query type refused by zone policy")
+	case "notimp":
+		m.SetRcode(req, dns.RcodeNotImplemented)
+		c.extendedError(req, m, edeNotSupported, "query type not supported by zone policy")
+	case "drop":
+	default:
+		return false
+	}
+	c.stats.Incr("query.qtype."+r.Action, 1)
+	if r.Action != "drop" {
+		w.WriteMsg(m)
+	}
+	return true
+}
+
+// limitAnswer applies truncate and minimal rules to a reply.
+func (r *qtypeRule) limitAnswer(c *config, w dns.ResponseWriter, m *dns.Msg) {
+	if r == nil || len(m.Answer) == 0 {
+		return
+	}
+	switch r.Action {
+	case "minimal":
+		if len(m.Answer) > 1 {
+			m.Answer = m.Answer[:1]
+			c.stats.Incr("query.qtype.minimal", 1)
+		}
+	case "truncate":
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); !udp {
+			return
+		}
+		if m.Len() > r.MaxBytes {
+			m.Answer, m.Ns, m.Extra = []dns.RR{}, nil, nil
+			m.Truncated = true
+			c.stats.Incr("query.qtype.truncate", 1)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"strings"
+	"testing"
+)
+
+func TestQTypePolicy(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, hotSize: 10}
+	policy := `{"qtypes": [{"type": "any", "action": "refuse"}, {"type": "MAILA", "action": "notimp"}, {"type": "MAILB", "action": "drop"},
+		{"type": "TXT", "action": "truncate", "max_bytes": 300}, {"type": "NS", "action": "minimal"}]}`
+	zone := abcZone + "big IN TXT \"" + strings.Repeat("x", 250) + "\" \"" + strings.Repeat("y", 250) + "\"\nsmall IN TXT \"ok\"\n"
+	if err := c.loadZones(map[string]string{"abc.com": zone, "abc.com.policy": policy}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if r := testQuery(&c, "abc.com", "abc.com.", dns.TypeANY); r.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected ANY to be refused, got %v", r)
+	}
+	if r := testQuery(&c, "abc.com", "abc.com.", dns.TypeMAILA); r.Rcode != dns.RcodeNotImplemented {
+		t.Errorf("Expected MAILA to get NOTIMP, got %v", r)
+	}
+	if r := testQuery(&c, "abc.com", "abc.com.", dns.TypeMAILB); r != nil {
+		t.Errorf("Expected MAILB to be dropped, got %v", r)
+	}
+	if r := testQuery(&c, "abc.com", "big.abc.com.", dns.TypeTXT); !r.Truncated || len(r.Answer) != 0 {
+		t.Errorf("Expected the big TXT set to be truncated over UDP, got %v", r)
+	}
+	if r := testQuery(&c, "abc.com", "small.abc.com.", dns.TypeTXT); r.Truncated || len(r.Answer) != 1 {
+		t.Errorf("Expected a small TXT set to be answered, got %v", r)
+	}
+	if r := testQuery(&c, "abc.com", "abc.com.", dns.TypeNS); len(r.Answer) != 1 {
+		t.Errorf("Expected a minimal NS answer, got %v", r)
+	}
+	if r := testQuery(&c, "abc.com", "abc.com.", dns.TypeMX); len(r.Answer) != 1 {
+		t.Errorf("Expected other types to be answered as usual, got %v", r)
+	}
+	if packed := c.zones["abc.com"].packAnswers(&c, []hotKey{{"abc.com.", dns.TypeNS}, {"abc.com.", dns.TypeMX}}); len(packed) != 1 {
+		t.Errorf("Expected answers with a qtype rule never to be precomputed, got %d", len(packed))
+	}
+	for _, bad := range []string{`{"type": "BOGUS", "action": "refuse"}`, `{"type": "TXT", "action": "shrink"}`, `{"type": "TXT", "action": "refuse", "max_bytes": 10}`} {
+		if _, err := parsePolicy("abc.com", `{"qtypes": [`+bad+`]}`); err == nil {
+			t.Errorf("Expected %s to be refused", bad)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --query-log ships a record of every query to a zone, one JSON object per line,
+// for analytics with Athena or anything else that reads S3. Records are buffered
+// and shipped every --query-log-every seconds, or early once queryLogBatch of them
+// are waiting, either as a gzipped object under an s3://bucket/prefix, in Hive
+// style dt=<day>/hour=<hour> partitions, or to a Kinesis Data Firehose delivery
+// stream with firehose://<stream>. --query-log-sample=n logs one query in n. A
+// batch that fails to ship is dropped rather than retried, so a long outage can't
+// eat the server's memory, and records are dropped while queryLogMax are waiting.
+const (
+	queryLogBatch    = 10000  // records that are shipped without waiting
+	queryLogMax      = 100000 // records buffered before dropping them
+	firehoseRecords  = 500    // per PutRecordBatch, the API's limits
+	firehoseBytes    = 4 << 20
+	queryLogS3Scheme = "s3://"
+	queryLogFirehose = "firehose://"
+)
+
+// queryRecord is a line of the query log
+type queryRecord struct {
+	Time    string `json:"time"`
+	Zone    string `json:"zone"`
+	Client  string `json:"client"`
+	Subnet  string `json:"subnet,omitempty"` // EDNS Client Subnet, with --ecs
+	Proto   string `json:"proto"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Rcode   string `json:"rcode"`
+	Answers int    `json:"answers"`
+	Size    int    `json:"size"`
+	TC      bool   `json:"tc"`
+	Latency int64  `json:"latency_us"`
+}
+
+type queryLog struct {
+	dest    string // s3://bucket/prefix or firehose://stream
+	every   time.Duration
+	sample  uint64
+	host    string
+	queries uint64 // counted atomically, for sampling
+	mu      sync.Mutex
+	lines   [][]byte
+	full    chan bool
+	ship    sync.Mutex // one shipment at a time
+}
+
+// newQueryLog returns a query log shipping to dest, checking its scheme
+func newQueryLog(dest string, every time.Duration, sample int) (*queryLog, error) {
+	switch {
+	case strings.HasPrefix(dest, queryLogS3Scheme) && len(strings.SplitN(strings.TrimPrefix(dest, queryLogS3Scheme), "/", 2)[0]) > 0:
+	case strings.HasPrefix(dest, queryLogFirehose) && len(strings.TrimPrefix(dest, queryLogFirehose)) > 0:
+	default:
+		return nil, fmt.Errorf("use s3://bucket/prefix or firehose://<delivery stream>")
+	}
+	host, _ := os.Hostname()
+	return &queryLog{dest: dest, every: every, sample: uint64(sample), host: host, full: make(chan bool, 1)}, nil
+}
+
+// queryLogWriter wraps w to log the reply to req, a query to zone, or returns w
+// without --query-log or when the query isn't sampled
+func (c *config) queryLogWriter(w dns.ResponseWriter, zone string, req *dns.Msg) dns.ResponseWriter {
+	l := c.queryLog
+	if l == nil || len(req.Question) == 0 || atomic.AddUint64(&l.queries, 1)%l.sample != 0 {
+		return w
+	}
+	return &logWriter{ResponseWriter: w, c: c, zone: zone, req: req, start: time.Now()}
+}
+
+// logWriter logs the reply to a query as it is written
+type logWriter struct {
+	dns.ResponseWriter
+	c     *config
+	zone  string
+	req   *dns.Msg
+	start time.Time
+}
+
+func (w *logWriter) WriteMsg(m *dns.Msg) error {
+	w.c.queryLog.record(w.c, w, m.Rcode, len(m.Answer), m.Len(), m.Truncated)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// Write logs a packed reply from its header
+func (w *logWriter) Write(b []byte) (int, error) {
+	if len(b) >= 12 {
+		w.c.queryLog.record(w.c, w, int(b[3]&0x0f), int(binary.BigEndian.Uint16(b[6:])), len(b), b[2]&0x02 != 0)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// record buffers the log line of a reply, asking for a shipment once a batch is
+// waiting
+func (l *queryLog) record(c *config, w *logWriter, rcode, answers, size int, tc bool) {
+	now := time.Now()
+	q := w.req.Question[0]
+	r := queryRecord{
+		Time:    now.UTC().Format(time.RFC3339Nano),
+		Zone:    w.zone,
+		Proto:   "udp",
+		Name:    strings.ToLower(q.Name),
+		Type:    dns.Type(q.Qtype).String(),
+		Rcode:   dns.RcodeToString[rcode],
+		Answers: answers,
+		Size:    size,
+		TC:      tc,
+		Latency: int64(now.Sub(w.start) / time.Microsecond),
+	}
+	if ip := remoteIP(w); ip != nil {
+		r.Client = ip.String()
+	}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); !ok {
+		r.Proto = "tcp"
+	}
+	if ecs := c.clientSubnet(w.req); ecs != nil {
+		r.Subnet = fmt.Sprintf("%s/%d", ecs.Address.String(), ecs.SourceNetmask)
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	if len(l.lines) >= queryLogMax {
+		l.mu.Unlock()
+		c.stats.Incr("querylog.dropped", 1)
+		return
+	}
+	l.lines = append(l.lines, append(line, '\n'))
+	n := len(l.lines)
+	l.mu.Unlock()
+	if n == queryLogBatch {
+		select {
+		case l.full <- true:
+		default:
+		}
+	}
+}
+
+// runQueryLog ships the query log forever
+func (c *config) runQueryLog() {
+	for {
+		select {
+		case <-time.After(c.queryLog.every):
+		case <-c.queryLog.full:
+		}
+		c.queryLog.flush(c, time.Now())
+	}
+}
+
+// flush ships the records waiting, as on shutdown. It is nil-safe.
+func (l *queryLog) flush(c *config, now time.Time) {
+	if l == nil {
+		return
+	}
+	l.ship.Lock()
+	defer l.ship.Unlock()
+	l.mu.Lock()
+	lines := l.lines
+	l.lines = nil
+	l.mu.Unlock()
+	if len(lines) == 0 {
+		return
+	}
+	var shipped int
+	var err error
+	if strings.HasPrefix(l.dest, queryLogFirehose) {
+		shipped, err = c.putFirehose(strings.TrimPrefix(l.dest, queryLogFirehose), lines)
+	} else if err = c.putQueryLog(l.dest, l.objectKey(now), lines); err == nil {
+		shipped = len(lines)
+	}
+	c.stats.Incr("querylog.shipped", int64(shipped))
+	if shipped < len(lines) {
+		c.stats.Incr("querylog.dropped", int64(len(lines)-shipped))
+	}
+	if err != nil {
+		log.Printf("Warning: shipping %d query log records to %s failed: %s", len(lines)-shipped, l.dest, err.Error())
+		c.stats.Incr("querylog.error", 1)
+	}
+}
+
+// objectKey returns the key, under the s3:// destination's prefix, of the log
+// object shipped at now
+func (l *queryLog) objectKey(now time.Time) string {
+	now = now.UTC()
+	return fmt.Sprintf("dt=%s/hour=%s/%s-%s.json.gz", now.Format("2006-01-02"), now.Format("15"), l.host, now.Format("20060102T150405.000000000Z"))
+}
+
+// putQueryLog stores lines gzipped under key in the s3://bucket/prefix dest
+func (c *config) putQueryLog(dest, key string, lines [][]byte) error {
+	parts := strings.SplitN(strings.TrimPrefix(dest, queryLogS3Scheme), "/", 2)
+	if len(parts) == 2 && len(strings.Trim(parts[1], "/")) > 0 {
+		key = strings.Trim(parts[1], "/") + "/" + key
+	}
+	body := &bytes.Buffer{}
+	gz := gzip.NewWriter(body)
+	for _, line := range lines {
+		gz.Write(line)
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	connection := s3.New(&aws.Config{Region: aws.String(c.region)})
+	_, err := connection.PutObject(&s3.PutObjectInput{
+		Bucket:          aws.String(parts[0]),
+		Key:             aws.String(key),
+		Body:            bytes.NewReader(body.Bytes()),
+		ContentType:     aws.String("application/x-ndjson"),
+		ContentEncoding: aws.String("gzip"),
+	})
+	return err
+}
+
+// putFirehose sends lines to the delivery stream, a record each, in as few
+// PutRecordBatch calls as the API's limits allow, returning how many it took.
+// Records the stream fails to take are given up on.
+func (c *config) putFirehose(stream string, lines [][]byte) (int, error) {
+	type record struct {
+		Data []byte
+	}
+	shipped := 0
+	for len(lines) > 0 {
+		batch := []record{}
+		size := 0
+		for len(lines) > 0 && len(batch) < firehoseRecords && (len(batch) == 0 || size+len(lines[0]) <= firehoseBytes) {
+			batch = append(batch, record{lines[0]})
+			size += len(lines[0])
+			lines = lines[1:]
+		}
+		var out struct {
+			FailedPutCount int
+		}
+		in := map[string]interface{}{"DeliveryStreamName": stream, "Records": batch}
+		if err := c.callAWS("firehose", "Firehose_20150804.PutRecordBatch", in, &out); err != nil {
+			return shipped, err
+		}
+		shipped += len(batch) - out.FailedPutCount
+	}
+	return shipped, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryLog(t *testing.T) {
+	for _, dest := range []string{"s3://", "s3:///logs", "firehose://", "https://example.com/"} {
+		if _, err := newQueryLog(dest, time.Minute, 1); err == nil {
+			t.Errorf("Expected --query-log %s to be refused", dest)
+		}
+	}
+	l, err := newQueryLog("s3://logs/dns", time.Minute, 2)
+	if err != nil {
+		t.Fatalf("newQueryLog failed: %s", err.Error())
+	}
+	l.host = "ns1"
+	if key := l.objectKey(time.Date(2026, 10, 16, 9, 30, 0, 5, time.UTC)); key != "dt=2026-10-16/hour=09/ns1-20261016T093000.000000005Z.json.gz" {
+		t.Errorf("Unexpected object key %s", key)
+	}
+
+	var batches [][]queryRecord
+	failed := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			DeliveryStreamName string
+			Records            []struct{ Data []byte }
+		}
+		if r.Header.Get("X-Amz-Target") != "Firehose_20150804.PutRecordBatch" || json.NewDecoder(r.Body).Decode(&in) != nil || in.DeliveryStreamName != "dns-logs" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		batch := []queryRecord{}
+		for _, rec := range in.Records {
+			var q queryRecord
+			if !strings.HasSuffix(string(rec.Data), "\n") || json.Unmarshal(rec.Data, &q) != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			batch = append(batch, q)
+		}
+		batches = append(batches, batch)
+		json.NewEncoder(w).Encode(map[string]int{"FailedPutCount": failed})
+	}))
+	defer srv.Close()
+
+	stats := &countingStats{counts: map[string]int64{}}
+	c := config{stats: stats, region: "us-east-1", awsKeyId: "AKID", awsSecret: "secret", awsEndpoint: srv.URL}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if c.queryLog, err = newQueryLog("firehose://dns-logs", time.Minute, 1); err != nil {
+		t.Fatalf("newQueryLog failed: %s", err.Error())
+	}
+	for _, name := range []string{"WWW.abc.com.", "nothere.abc.com."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		dns.DefaultServeMux.ServeDNS(&testWriter{}, req)
+	}
+	c.queryLog.flush(&c, time.Now())
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatalf("Expected a batch of 2 records, got %+v", batches)
+	}
+	if r := batches[0][0]; r.Zone != "abc.com" || r.Name != "www.abc.com." || r.Type != "A" || r.Rcode != "NOERROR" || r.Answers != 2 || r.Client != "127.0.0.1" || r.Proto != "udp" || r.Size == 0 {
+		t.Errorf("Unexpected record %+v", r)
+	}
+	if r := batches[0][1]; r.Rcode != "NXDOMAIN" || r.Answers != 0 {
+		t.Errorf("Expected the NXDOMAIN logged, got %+v", r)
+	}
+	if n := stats.get("querylog.shipped"); n != 2 {
+		t.Errorf("Expected 2 records shipped, got %d", n)
+	}
+
+	// sampled, and the records the stream refuses are dropped
+	c.queryLog.sample, failed = 3, 1
+	for i := 0; i < 6; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("abc.com.", dns.TypeA)
+		dns.DefaultServeMux.ServeDNS(&testWriter{}, req)
+	}
+	c.queryLog.flush(&c, time.Now())
+	if len(batches) != 2 || len(batches[1]) != 2 {
+		t.Fatalf("Expected one query in 3 logged, got %+v", batches)
+	}
+	if shipped, dropped := stats.get("querylog.shipped"), stats.get("querylog.dropped"); shipped != 3 || dropped != 1 {
+		t.Errorf("Expected 3 records shipped and 1 dropped, got %d and %d", shipped, dropped)
+	}
+	c.queryLog.flush(&c, time.Now())
+	if len(batches) != 2 {
+		t.Errorf("Expected nothing shipped without records, got %d batches", len(batches))
+	}
+}
@@ -0,0 +1,124 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// zoneRateLimit is a zone policy's "rate_limit", capping the queries per second the
+// zone answers, such as for a customer on a cheap plan:
+//
+//	{"rate_limit": {"qps": 50, "burst": 100, "action": "slip", "slip": 2}}
+//
+// Up to burst queries (qps, and at least 1, by default) are answered at once, and
+// the allowance refills at qps per second. Past it, "refuse" replies REFUSED, and
+// "slip" drops queries but sends every slip-th one (2 by default) an empty truncated
+// reply, so real resolvers retry over TCP, which slip doesn't limit as it can't be
+// spoofed.
+// The cap applies to the zone as a whole, across views, and starts again when the
+// policy is reloaded.
+type zoneRateLimit struct {
+	QPS    float64 `json:"qps"`
+	Burst  float64 `json:"burst"`
+	Action string  `json:"action"`
+	Slip   int     `json:"slip"`
+
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	limited int // queries over the cap, for slip
+}
+
+const defaultSlip = 2
+
+func (l *zoneRateLimit) compile(n string) error {
+	if l.QPS <= 0 {
+		return fmt.Errorf("Error in policy for zone %s: rate_limit qps must be positive", n)
+	}
+	if l.Burst == 0 {
+		l.Burst = math.Max(l.QPS, 1)
+	}
+	if l.Burst < 1 {
+		return fmt.Errorf("Error in policy for zone %s: rate_limit burst must be at least 1", n)
+	}
+	if len(l.Action) == 0 {
+		l.Action = "refuse"
+	}
+	if l.Action != "refuse" && l.Action != "slip" {
+		return fmt.Errorf("Error in policy for zone %s: rate_limit action must be refuse or slip", n)
+	}
+	if l.Slip < 0 || (l.Slip > 0 && l.Action != "slip") {
+		return fmt.Errorf("Error in policy for zone %s: rate_limit slip only applies to the slip action", n)
+	}
+	if l.Action == "slip" && l.Slip == 0 {
+		l.Slip = defaultSlip
+	}
+	return nil
+}
+
+// rateLimit returns the zone's rate limit, if any
+func (p *zonePolicy) rateLimit() *zoneRateLimit {
+	if p == nil {
+		return nil
+	}
+	return p.RateLimit
+}
+
+// take takes one query from the allowance. Past the cap it returns the number of
+// queries over it so far, otherwise 0.
+func (l *zoneRateLimit) take(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last.IsZero() {
+		l.tokens = l.Burst
+	} else if elapsed := now.Sub(l.last).Seconds(); elapsed > 0 {
+		l.tokens += elapsed * l.QPS
+		if l.tokens > l.Burst {
+			l.tokens = l.Burst
+		}
+	}
+	l.last = now
+	if l.tokens < 1 {
+		l.limited++
+		return l.limited
+	}
+	l.tokens--
+	return 0
+}
+
+// limitQuery answers a query to zone n if the zone is over its cap, returning true
+// if it was handled. It is nil-safe.
+func (l *zoneRateLimit) limitQuery(c *config, w dns.ResponseWriter, req *dns.Msg, n string) bool {
+	if l == nil {
+		return false
+	}
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); l.Action == "slip" && !udp {
+		return false
+	}
+	over := l.take(time.Now())
+	if over == 0 {
+		return false
+	}
+	c.stats.Incr("usage."+statName(n)+".limited", 1)
+	m := new(dns.Msg)
+	switch {
+	case l.Action == "refuse":
+		m.SetRcode(req, dns.RcodeRefused)
+		c.extendedError(req, m, edeProhibited, "rate limited")
+		c.stats.Incr("query.ratelimit.refuse", 1)
+	case over%l.Slip == 0:
+		m.SetReply(req)
+		m.Truncated = true
+		c.stats.Incr("query.ratelimit.slip", 1)
+	default:
+		c.stats.Incr("query.ratelimit.drop", 1)
+		return true
+	}
+	w.WriteMsg(m)
+	return true
+}
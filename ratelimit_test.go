@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}}
+	err := c.loadZones(map[string]string{
+		"abc.com":        abcZone,
+		"abc.com.policy": `{"rate_limit": {"qps": 0.001, "burst": 2}}`,
+		"def.com":        defZone,
+		"def.com.policy": `{"rate_limit": {"qps": 0.001, "action": "slip", "slip": 2}}`,
+	})
+	if err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	for i := 0; i < 2; i++ {
+		if m := testQuery(&c, "abc.com", "abc.com.", dns.TypeA); m == nil || len(m.Answer) != 1 {
+			t.Errorf("Expected query %d within the burst to be answered, got %v", i, m)
+		}
+	}
+	if m := testQuery(&c, "abc.com", "abc.com.", dns.TypeA); m == nil || m.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected REFUSED past the cap, got %v", m)
+	}
+	if m := testQuery(&c, "def.com", "def.com.", dns.TypeA); m == nil || len(m.Answer) != 1 {
+		t.Errorf("Expected the first query to be answered, got %v", m)
+	}
+	if m := testQuery(&c, "def.com", "def.com.", dns.TypeA); m != nil {
+		t.Errorf("Expected the first query past the cap to be dropped, got %v", m)
+	}
+	if m := testQuery(&c, "def.com", "def.com.", dns.TypeA); m == nil || !m.Truncated || len(m.Answer) != 0 {
+		t.Errorf("Expected the second query past the cap to slip, got %v", m)
+	}
+
+	l := &zoneRateLimit{QPS: 10}
+	if err := l.compile("abc.com"); err != nil || l.Burst != 10 || l.Action != "refuse" {
+		t.Fatalf("Expected a burst of qps and refuse by default, got %+v %v", l, err)
+	}
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		l.take(now)
+	}
+	if l.take(now) == 0 {
+		t.Errorf("Expected the allowance to be used up")
+	}
+	if l.take(now.Add(200*time.Millisecond)) != 0 || l.take(now.Add(200*time.Millisecond)) != 0 || l.take(now.Add(200*time.Millisecond)) == 0 {
+		t.Errorf("Expected 2 queries to be allowed after 200ms at 10 qps")
+	}
+
+	for _, policy := range []string{
+		`{"rate_limit": {"qps": 0}}`,
+		`{"rate_limit": {"qps": 10, "burst": 0.5}}`,
+		`{"rate_limit": {"qps": 10, "action": "truncate"}}`,
+		`{"rate_limit": {"qps": 10, "slip": 3}}`,
+	} {
+		if _, err := parsePolicy("abc.com", policy); err == nil {
+			t.Errorf("Expected an error for policy %s", policy)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The record API edits the RRsets of zone files in the bucket, for tools such as a
+// Terraform provider:
+//
+//	GET    /zones/<zone>/records               every RRset of the zone
+//	GET    /zones/<zone>/records/<name>/<type> one RRset
+//	PUT    /zones/<zone>/records/<name>/<type> create or replace it
+//	DELETE /zones/<zone>/records/<name>/<type> delete it
+//
+// An RRset's ID is its name and type, such as www.abc.com/A, so it stays the same
+// for as long as the RRset exists, on every instance. Its ETag changes with its
+// records; If-Match on a PUT or DELETE fails with 412 if someone else changed the
+// RRset since it was read, and If-None-Match: * fails a PUT if the RRset exists.
+// PUTs are idempotent: replacing an RRset with the same records writes nothing.
+// Writes read the zone file from the bucket under the reload lock, bump the SOA
+// serial and serve the new version at once. S3 can't refuse a write that races
+// another instance's, so send API writes to one instance.
+const recordTTL = 300 // for PUTs without a TTL
+
+// recordSet is an RRset as the record API reads and writes it
+type recordSet struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	TTL    uint32   `json:"ttl"`
+	Values []string `json:"values"`
+	ETag   string   `json:"etag"`
+}
+
+// recordError is an error with the HTTP status the record API replies with
+type recordError struct {
+	status int
+	msg    string
+}
+
+func (e recordError) Error() string { return e.msg }
+
+// fieldError is one problem with the records of a write API request: the index of
+// the value in a PUT, or of the zone in a POST /zones, the name and the reason
+type fieldError struct {
+	Index  *int   `json:"index,omitempty"`
+	Field  string `json:"field,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// validationError refuses a write whose records are invalid or would break a zone.
+// The record API replies 400 with each problem in "errors".
+type validationError struct {
+	errors []fieldError
+}
+
+func (e validationError) Error() string {
+	msgs := []string{}
+	for _, f := range e.errors {
+		if len(f.Name) > 0 {
+			msgs = append(msgs, f.Name+": "+f.Reason)
+		} else {
+			msgs = append(msgs, f.Reason)
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func fieldIndex(i int) *int { return &i }
+
+// recordsHandler serves /zones/<zone>/records and /zones/<zone>/records/<name>/<type>
+func (c *config) recordsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/zones/"), "/"), "/")
+	if (len(parts) != 2 && len(parts) != 4) || parts[1] != "records" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "use /zones/<zone>/records[/<name>/<type>]"})
+		return
+	}
+	if c.backend == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no zone backend"})
+		return
+	}
+	n := strings.ToLower(strings.TrimSuffix(parts[0], "."))
+	if len(parts) == 2 {
+		if r.Method != "GET" {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use GET"})
+			return
+		}
+		sets, err := c.listRecords(n)
+		if err != nil {
+			writeRecordError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"records": sets})
+		return
+	}
+	name, rtype, err := recordKey(n, parts[2], parts[3])
+	if err != nil {
+		writeRecordError(w, err)
+		return
+	}
+	var set *recordSet
+	status := http.StatusOK
+	switch r.Method {
+	case "GET":
+		set, err = c.getRecords(n, name, rtype)
+	case "PUT":
+		var body struct {
+			TTL    uint32   `json:"ttl"`
+			Values []string `json:"values"`
+		}
+		b, readErr := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if readErr == nil {
+			readErr = json.Unmarshal(b, &body)
+		}
+		if readErr != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON: " + readErr.Error()})
+			return
+		}
+		var created bool
+		set, created, err = c.putRecords(n, name, rtype, body.TTL, body.Values, r.Header.Get("If-Match"), r.Header.Get("If-None-Match"))
+		if created {
+			status = http.StatusCreated
+		}
+	case "DELETE":
+		if err = c.deleteRecords(n, name, rtype, r.Header.Get("If-Match")); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use GET, PUT or DELETE"})
+		return
+	}
+	if err != nil {
+		writeRecordError(w, err)
+		return
+	}
+	w.Header().Set("ETag", set.ETag)
+	writeJSON(w, status, set)
+}
+
+func writeRecordError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch e := err.(type) {
+	case recordError:
+		status = e.status
+	case validationError:
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": e.Error(), "errors": e.errors})
+		return
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// recordKey checks the name and type of an RRset in zone n, returning the name
+// absolute and lower cased. @ is the apex.
+func recordKey(n, name, rtype string) (string, uint16, error) {
+	apex := dns.Fqdn(n)
+	name = strings.ToLower(name)
+	if name == "@" {
+		name = apex
+	}
+	name = dns.Fqdn(name)
+	if _, ok := dns.IsDomainName(name); !ok || !dns.IsSubDomain(apex, name) {
+		return "", 0, recordError{http.StatusBadRequest, fmt.Sprintf("%s is not a name in zone %s", name, n)}
+	}
+	t, ok := dns.StringToType[strings.ToUpper(rtype)]
+	if !ok {
+		return "", 0, recordError{http.StatusBadRequest, fmt.Sprintf("unknown record type %s", rtype)}
+	}
+	if t == dns.TypeSOA || dnssecTypes[t] {
+		return "", 0, recordError{http.StatusBadRequest, fmt.Sprintf("%s records are managed by neddns", dns.Type(t).String())}
+	}
+	return name, t, nil
+}
+
+// readZoneRecords reads zone n's file from the bucket. Zones expanded from a
+// template and zones with scheduled records can't be edited record by record.
+// Callers hold the reload lock, as it reads c.zones.
+func (c *config) readZoneRecords(n string) ([]dns.RR, error) {
+	z, ok := c.zones[n]
+	if !ok {
+		return nil, recordError{http.StatusNotFound, "no zone " + n}
+	}
+	if z.source != n {
+		return nil, recordError{http.StatusConflict, fmt.Sprintf("zone %s is generated from %s", n, z.source)}
+	}
+	f, err := c.backend.GetZone(c.prefix + n)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading zone %s: %s", n, err.Error())
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading zone %s: %s", n, err.Error())
+	}
+	if isEncryptedZone(b) { // edits would be stored in plaintext
+		return nil, recordError{http.StatusConflict, fmt.Sprintf("zone %s is encrypted, edit its zone file instead", n)}
+	}
+	rrs, scheduled, err := parseZone(n, string(b))
+	if err != nil {
+		return nil, err
+	}
+	if len(scheduled) > 0 {
+		return nil, recordError{http.StatusConflict, fmt.Sprintf("zone %s has scheduled records, edit its zone file instead", n)}
+	}
+	return rrs, nil
+}
+
+// recordSets groups rrs into RRsets, in name and type order
+func recordSets(rrs []dns.RR) []*recordSet {
+	byKey := map[hotKey][]dns.RR{}
+	keys := []hotKey{}
+	for _, rr := range rrs {
+		k := hotKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		if _, ok := byKey[k]; !ok {
+			keys = append(keys, k)
+		}
+		byKey[k] = append(byKey[k], rr)
+	}
+	sort.Sort(byHotKey(keys))
+	sets := []*recordSet{}
+	for _, k := range keys {
+		sets = append(sets, newRecordSet(byKey[k]))
+	}
+	return sets
+}
+
+type byHotKey []hotKey
+
+func (p byHotKey) Len() int      { return len(p) }
+func (p byHotKey) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byHotKey) Less(i, j int) bool {
+	if p[i].name != p[j].name {
+		return canonicalLess(p[i].name, p[j].name)
+	}
+	return p[i].qtype < p[j].qtype
+}
+
+// newRecordSet describes an RRset for the API
+func newRecordSet(rrset []dns.RR) *recordSet {
+	h := rrset[0].Header()
+	name := strings.ToLower(strings.TrimSuffix(h.Name, "."))
+	set := &recordSet{ID: name + "/" + dns.Type(h.Rrtype).String(), Name: name, Type: dns.Type(h.Rrtype).String(), TTL: h.Ttl, Values: []string{}}
+	for _, rr := range rrset {
+		set.Values = append(set.Values, strings.TrimPrefix(rr.String(), rr.Header().String()))
+	}
+	sum := sha256.Sum256([]byte(rrsetContents(rrset)))
+	set.ETag = `"` + hex.EncodeToString(sum[:8]) + `"`
+	return set
+}
+
+// findRecords returns the records of rrs in the RRset name, t and the rest
+func findRecords(rrs []dns.RR, name string, t uint16) ([]dns.RR, []dns.RR) {
+	found, rest := []dns.RR{}, []dns.RR{}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == t && strings.EqualFold(rr.Header().Name, name) {
+			found = append(found, rr)
+		} else {
+			rest = append(rest, rr)
+		}
+	}
+	return found, rest
+}
+
+func (c *config) listRecords(n string) ([]*recordSet, error) {
+	if c.reloads != nil {
+		c.reloads.run.Lock()
+		defer c.reloads.run.Unlock()
+	}
+	rrs, err := c.readZoneRecords(n)
+	if err != nil {
+		return nil, err
+	}
+	return recordSets(rrs), nil
+}
+
+func (c *config) getRecords(n, name string, t uint16) (*recordSet, error) {
+	if c.reloads != nil {
+		c.reloads.run.Lock()
+		defer c.reloads.run.Unlock()
+	}
+	rrs, err := c.readZoneRecords(n)
+	if err != nil {
+		return nil, err
+	}
+	found, _ := findRecords(rrs, name, t)
+	if len(found) == 0 {
+		return nil, recordError{http.StatusNotFound, fmt.Sprintf("no %s records at %s", dns.Type(t).String(), name)}
+	}
+	return newRecordSet(found), nil
+}
+
+// checkPreconditions applies If-Match and If-None-Match to the current RRset
+func checkPreconditions(current []dns.RR, ifMatch, ifNoneMatch string) error {
+	etag := ""
+	if len(current) > 0 {
+		etag = newRecordSet(current).ETag
+	}
+	if len(ifMatch) > 0 && (len(etag) == 0 || (ifMatch != "*" && !contains(splitList(ifMatch), etag))) {
+		return recordError{http.StatusPreconditionFailed, "the records have changed since they were read"}
+	}
+	if ifNoneMatch == "*" && len(etag) > 0 {
+		return recordError{http.StatusPreconditionFailed, "the records already exist"}
+	}
+	return nil
+}
+
+// putRecords replaces the RRset name, t of zone n with values, returning it and
+// whether it is new
+func (c *config) putRecords(n, name string, t uint16, ttl uint32, values []string, ifMatch, ifNoneMatch string) (*recordSet, bool, error) {
+	if len(values) == 0 {
+		return nil, false, recordError{http.StatusBadRequest, "values are required, DELETE the records instead"}
+	}
+	if ttl == 0 {
+		ttl = recordTTL
+	}
+	rrset := []dns.RR{}
+	invalid := validationError{}
+	for i, v := range values {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, ttl, dns.Type(t).String(), v))
+		if err != nil || rr == nil {
+			invalid.errors = append(invalid.errors, fieldError{fieldIndex(i), "values", name, fmt.Sprintf("invalid %s value %q", dns.Type(t).String(), v)})
+			continue
+		}
+		rrset = append(rrset, rr)
+	}
+	if len(invalid.errors) > 0 {
+		return nil, false, invalid
+	}
+	if c.reloads != nil { // keep the update loop from reloading underneath us
+		c.reloads.run.Lock()
+		defer c.reloads.run.Unlock()
+	}
+	rrs, err := c.readZoneRecords(n)
+	if err != nil {
+		return nil, false, err
+	}
+	current, rest := findRecords(rrs, name, t)
+	if err := checkPreconditions(current, ifMatch, ifNoneMatch); err != nil {
+		return nil, false, err
+	}
+	if len(current) > 0 && rrsetContents(current) == rrsetContents(rrset) {
+		return newRecordSet(current), false, nil // nothing to change
+	}
+	if err := c.storeRecords(n, rrs, append(rest, rrset...), rrset); err != nil {
+		return nil, false, err
+	}
+	return newRecordSet(rrset), len(current) == 0, nil
+}
+
+// deleteRecords removes the RRset name, t from zone n
+func (c *config) deleteRecords(n, name string, t uint16, ifMatch string) error {
+	if c.reloads != nil {
+		c.reloads.run.Lock()
+		defer c.reloads.run.Unlock()
+	}
+	rrs, err := c.readZoneRecords(n)
+	if err != nil {
+		return err
+	}
+	current, rest := findRecords(rrs, name, t)
+	if len(current) == 0 {
+		return recordError{http.StatusNotFound, fmt.Sprintf("no %s records at %s", dns.Type(t).String(), name)}
+	}
+	if err := checkPreconditions(current, ifMatch, ""); err != nil {
+		return err
+	}
+	return c.storeRecords(n, rrs, rest, nil)
+}
+
+// storeRecords writes zone n with the records rrs, previously old, bumping its
+// serial, and serves it. Changes that would break the zone are refused, with each
+// problem pointing at the record of put, the RRset written, it concerns.
+func (c *config) storeRecords(n string, old, rrs, put []dns.RR) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "; zone %s edited through the admin API\n", n)
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			soa = dns.Copy(soa).(*dns.SOA)
+			soa.Serial = nextSerial(soa.Serial, time.Now())
+			rr = soa
+		}
+		b.WriteString(rr.String() + "\n")
+	}
+	if problems := validateZone(n, b.String(), old); len(problems) > 0 {
+		invalid := validationError{}
+		for _, p := range problems {
+			f := fieldError{Name: p.name, Reason: p.msg}
+		records:
+			for i, rr := range put {
+				for _, name := range recordNames(rr) {
+					if strings.EqualFold(name, p.name) {
+						f.Index, f.Field = fieldIndex(i), "values"
+						break records
+					}
+				}
+			}
+			invalid.errors = append(invalid.errors, f)
+		}
+		return invalid
+	}
+	key := c.prefix + n
+	if err := c.backend.PutZone(key, b.String()); err != nil {
+		return fmt.Errorf("Error uploading zone %s: %s", n, err.Error())
+	}
+	if err := c.loadZones(map[string]string{n: b.String()}); err != nil {
+		return err
+	}
+	c.markSynced([]string{n}, time.Now())
+	c.stats.Incr("api.records.updated", 1)
+	return nil
+}
+
+// validateZone runs the checks of neddns check, and those made as a zone loads, on
+// the text about to be written for zone n, returning the errors that old, the
+// records it replaces, didn't already have. SPF includes outside the zone aren't
+// looked up, to keep writes fast and independent of other domains.
+func validateZone(n, text string, old []dns.RR) []zoneProblem {
+	rrs, _, err := parseZone(n, text)
+	if err != nil {
+		return []zoneProblem{{"error", dns.Fqdn(n), err.Error()}}
+	}
+	check := func(rrs []dns.RR) []zoneProblem {
+		return append(checkZone(n, rrs), checkEmailAuth(n, rrs, noLookup)...)
+	}
+	before := map[string]bool{}
+	for _, p := range check(old) {
+		before[p.String()] = true
+	}
+	problems := []zoneProblem{}
+	for _, p := range check(rrs) {
+		if p.severity == "error" && !before[p.String()] {
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+func noLookup(name string) ([]string, error) {
+	return nil, fmt.Errorf("not looked up")
+}
+
+// nextSerial returns the serial after old: today's date serial (YYYYMMDDnn) if old
+// is an earlier one, otherwise old + 1
+func nextSerial(old uint32, now time.Time) uint32 {
+	y, m, d := now.UTC().Date()
+	today := uint32(y*1000000 + int(m)*10000 + d*100)
+	if old >= 1970010100 && old < today {
+		return today
+	}
+	return old + 1
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRecordRequest sends a record API request, returning the response and the
+// decoded RRset, if any
+func testRecordRequest(handler http.Handler, method, path, body string, headers map[string]string) (*httptest.ResponseRecorder, recordSet) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var set recordSet
+	json.Unmarshal(w.Body.Bytes(), &set)
+	return w, set
+}
+
+func TestRecordAPI(t *testing.T) {
+	store := testStore{zones: map[string]string{"abc.com": abcZone}}
+	c := config{stats: statsd.NoopClient{}, backend: store, reloads: &reloadStatus{}}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	handler := c.apiHandler(make(chan bool, 1))
+	serial := c.zones["abc.com"].serial()
+
+	w, set := testRecordRequest(handler, "PUT", "/zones/abc.com/records/api.abc.com/A", `{"ttl": 60, "values": ["10.0.0.1", "10.0.0.2"]}`, map[string]string{"If-None-Match": "*"})
+	if w.Code != http.StatusCreated || set.ID != "api.abc.com/A" || len(set.Values) != 2 || w.Header().Get("ETag") != set.ETag {
+		t.Fatalf("Expected the RRset to be created, got %d %s", w.Code, w.Body.String())
+	}
+	if m := testQuery(&c, "abc.com", "api.abc.com.", dns.TypeA); m == nil || len(m.Answer) != 2 {
+		t.Errorf("Expected the new records to be served at once, got %v", m)
+	}
+	if !strings.Contains(store.zones["abc.com"], "api.abc.com.\t60\tIN\tA\t10.0.0.2") || c.zones["abc.com"].serial() <= serial {
+		t.Errorf("Expected the zone file to be stored with a new serial: %s", store.zones["abc.com"])
+	}
+	etag := set.ETag
+
+	// the same PUT again changes nothing
+	stored := store.zones["abc.com"]
+	w, set = testRecordRequest(handler, "PUT", "/zones/abc.com/records/api.abc.com/A", `{"ttl": 60, "values": ["10.0.0.2", "10.0.0.1"]}`, nil)
+	if w.Code != http.StatusOK || set.ETag != etag || store.zones["abc.com"] != stored {
+		t.Errorf("Expected an idempotent PUT, got %d %s", w.Code, w.Body.String())
+	}
+	if w, _ := testRecordRequest(handler, "PUT", "/zones/abc.com/records/api.abc.com/A", `{"values": ["10.0.0.3"]}`, map[string]string{"If-None-Match": "*"}); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected If-None-Match: * to fail for an existing RRset, got %d", w.Code)
+	}
+
+	w, set = testRecordRequest(handler, "PUT", "/zones/abc.com/records/api.abc.com/A", `{"values": ["10.0.0.3"]}`, map[string]string{"If-Match": etag})
+	if w.Code != http.StatusOK || set.ETag == etag || set.TTL != recordTTL {
+		t.Fatalf("Expected the RRset to be replaced, got %d %s", w.Code, w.Body.String())
+	}
+	if w, _ := testRecordRequest(handler, "PUT", "/zones/abc.com/records/api.abc.com/A", `{"values": ["10.0.0.4"]}`, map[string]string{"If-Match": etag}); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected a stale If-Match to fail, got %d", w.Code)
+	}
+	if w, got := testRecordRequest(handler, "GET", "/zones/abc.com/records/API.abc.com./a", "", nil); w.Code != http.StatusOK || got.ETag != set.ETag || got.Values[0] != "10.0.0.3" {
+		t.Errorf("Expected GET to return the RRset, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/zones/abc.com/records", nil))
+	var list struct{ Records []recordSet }
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Records) < 4 || list.Records[0].ID != "abc.com/A" {
+		t.Errorf("Expected the zone's RRsets in name order, got %s", w.Body.String())
+	}
+
+	if w, _ := testRecordRequest(handler, "DELETE", "/zones/abc.com/records/api.abc.com/A", "", map[string]string{"If-Match": etag}); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected a stale If-Match to fail a DELETE, got %d", w.Code)
+	}
+	if w, _ := testRecordRequest(handler, "DELETE", "/zones/abc.com/records/api.abc.com/A", "", map[string]string{"If-Match": set.ETag}); w.Code != http.StatusNoContent {
+		t.Errorf("Expected the RRset to be deleted, got %d %s", w.Code, w.Body.String())
+	}
+	if w, _ := testRecordRequest(handler, "GET", "/zones/abc.com/records/api.abc.com/A", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a deleted RRset to be gone, got %d", w.Code)
+	}
+
+	for _, bad := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{"PUT", "/zones/abc.com/records/api.abc.com/A", `{"values": ["not-an-ip"]}`, http.StatusBadRequest},
+		{"PUT", "/zones/abc.com/records/api.def.com/A", `{"values": ["10.0.0.1"]}`, http.StatusBadRequest},
+		{"PUT", "/zones/abc.com/records/abc.com/SOA", `{"values": ["ns1.abc.com. admin.abc.com. 1 2 3 4 5"]}`, http.StatusBadRequest},
+		{"PUT", "/zones/abc.com/records/www.abc.com/A", `{"values": ["10.0.0.1"]}`, http.StatusBadRequest}, // www is a CNAME
+		{"PUT", "/zones/abc.com/records/api.abc.com/A", `{"values": []}`, http.StatusBadRequest},
+		{"PUT", "/zones/ghi.com/records/ghi.com/A", `{"values": ["10.0.0.1"]}`, http.StatusNotFound},
+		{"POST", "/zones/abc.com/records/api.abc.com/A", `{}`, http.StatusMethodNotAllowed},
+	} {
+		if w, _ := testRecordRequest(handler, bad.method, bad.path, bad.body, nil); w.Code != bad.status {
+			t.Errorf("%s %s %s: want %d, got %d %s", bad.method, bad.path, bad.body, bad.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRecordValidation(t *testing.T) {
+	store := testStore{zones: map[string]string{"abc.com": abcZone}}
+	c := config{stats: statsd.NoopClient{}, backend: store, reloads: &reloadStatus{}}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	handler := c.apiHandler(make(chan bool, 1))
+	refused := func(method, path, body string) []fieldError {
+		w, _ := testRecordRequest(handler, method, path, body, nil)
+		var resp struct {
+			Error  string
+			Errors []fieldError
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusBadRequest || len(resp.Error) == 0 {
+			t.Errorf("%s %s %s: expected 400 with errors, got %d %s", method, path, body, w.Code, w.Body.String())
+		}
+		return resp.Errors
+	}
+	index := func(f fieldError) int {
+		if f.Index == nil {
+			return -1
+		}
+		return *f.Index
+	}
+
+	if errs := refused("PUT", "/zones/abc.com/records/abc.com/MX", `{"values": ["10 mx.abc.com.", "bogus", "20"]}`); len(errs) != 2 || index(errs[0]) != 1 || index(errs[1]) != 2 || errs[0].Field != "values" {
+		t.Errorf("Expected each invalid value by index, got %+v", errs)
+	}
+	if errs := refused("PUT", "/zones/abc.com/records/abc.com/MX", `{"values": ["10 mx.abc.com.", "20 www.abc.com."]}`); len(errs) != 2 || index(errs[0])+index(errs[1]) != 1 {
+		t.Errorf("Expected both MX targets to be refused by index, got %+v", errs)
+	}
+	if errs := refused("PUT", "/zones/abc.com/records/abc.com/TXT", `{"values": ["\"v=spf1 -all\"", "\"v=spf1 ~all\""]}`); len(errs) != 1 || errs[0].Name != "abc.com." || index(errs[0]) != 0 {
+		t.Errorf("Expected two SPF records to be refused, got %+v", errs)
+	}
+
+	for _, put := range []struct {
+		path, body string
+		status     int
+	}{
+		{"/zones/abc.com/records/mx.abc.com/A", `{"values": ["10.0.0.1"]}`, http.StatusCreated},
+		{"/zones/abc.com/records/abc.com/MX", `{"values": ["10 mx.abc.com."]}`, http.StatusOK},
+	} {
+		if w, _ := testRecordRequest(handler, "PUT", put.path, put.body, nil); w.Code != put.status {
+			t.Fatalf("PUT %s: want %d, got %d %s", put.path, put.status, w.Code, w.Body.String())
+		}
+	}
+	if errs := refused("DELETE", "/zones/abc.com/records/mx.abc.com/A", ""); len(errs) != 1 || errs[0].Name != "mx.abc.com." || errs[0].Index != nil {
+		t.Errorf("Expected deleting the MX target's address to be refused, got %+v", errs)
+	}
+	if m := testQuery(&c, "abc.com", "mx.abc.com.", dns.TypeA); len(m.Answer) != 1 {
+		t.Errorf("Expected the refused DELETE to change nothing, got %v", m)
+	}
+}
+
+func TestNextSerial(t *testing.T) {
+	now := time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC)
+	for old, want := range map[uint32]uint32{
+		2014121700: 2024030500,
+		2024030500: 2024030501,
+		2024030599: 2024030600,
+		7:          8,
+	} {
+		if got := nextSerial(old, now); got != want {
+			t.Errorf("nextSerial(%d): want %d, got %d", old, want, got)
+		}
+	}
+}
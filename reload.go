@@ -0,0 +1,133 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// reloadStatus serializes zone reloads and records their progress for metrics and
+// the admin API. Reload requests (HUP, the API, the Windows service) are sent on a
+// channel with room for one, so any that arrive during a reload coalesce into a
+// single follow-up reload.
+type reloadStatus struct {
+	run       sync.Mutex // held for the duration of a reload
+	mu        sync.Mutex // guards the fields below
+	running   bool
+	started   time.Time
+	finished  time.Time
+	duration  time.Duration
+	lastError string
+	coalesced int64
+}
+
+// requestReload queues a reload without blocking, returning false if one was
+// already pending.
+func requestReload(doUpdate chan bool) bool {
+	select {
+	case doUpdate <- true:
+		return true
+	default:
+		return false
+	}
+}
+
+// triggerReload queues a reload, counting requests folded into a pending one.
+func (c *config) triggerReload(doUpdate chan bool) bool {
+	if requestReload(doUpdate) {
+		return true
+	}
+	c.stats.Incr("reload.coalesced", 1)
+	if c.reloads != nil {
+		c.reloads.mu.Lock()
+		c.reloads.coalesced++
+		c.reloads.mu.Unlock()
+	}
+	c.debug("Reload already pending, coalescing")
+	return false
+}
+
+// reloadZones fetches and loads updated zones. Errors leave the current zones
+// serving; checkStale will flag them if this persists.
+func (c *config) reloadZones(getter zoneGetter) error {
+	r := c.reloads
+	r.run.Lock()
+	defer r.run.Unlock()
+	start := time.Now()
+	r.mu.Lock()
+	r.running = true
+	r.started = start
+	r.mu.Unlock()
+	c.stats.Gauge("reload.inprogress", 1)
+
+	before := c.servingZones()
+	err := c.updateZones(getter)
+	c.checkStale() // under the lock, as scheduled record changes also replace zones
+
+	elapsed := time.Since(start)
+	r.mu.Lock()
+	r.running = false
+	r.finished = time.Now()
+	r.duration = elapsed
+	r.lastError = ""
+	if err != nil {
+		r.lastError = err.Error()
+	}
+	r.mu.Unlock()
+	c.stats.Gauge("reload.inprogress", 0)
+	c.stats.Timing("reload", int64(elapsed/time.Millisecond))
+	c.notifyReload(before, elapsed)
+	if elapsed > c.update {
+		log.Printf("Warning: reload took %s, longer than the update interval of %s", elapsed, c.update)
+	}
+	return err
+}
+
+func (c *config) updateZones(getter zoneGetter) error {
+	z, err := c.getZones(getter)
+	if err != nil {
+		c.stats.Incr("zoneupdates.error", 1)
+		log.Printf("Error fetching updated zones: %s", err.Error())
+		c.alerts.backendFailed(c, err, time.Now())
+		return err
+	}
+	c.alerts.backendWorked()
+	c.debug(fmt.Sprintf("Fetched %d updated zones", len(z)))
+	if len(z) > 0 {
+		c.stats.Incr("zoneupdates", int64(len(z)))
+		c.debug(fmt.Sprintf("Reloading %d zones now", len(z)))
+		err = c.loadZones(z)
+	}
+	if err != nil {
+		c.stats.Incr("zoneupdates.error", 1)
+		log.Printf("Error loading updated zones: %s", err.Error())
+		c.alerts.alert(c, alertZoneLoad, err.Error(), err.Error())
+		return err
+	}
+	c.debug("Updated zones successfully")
+	return nil
+}
+
+// status describes the current or last reload for the admin API.
+func (r *reloadStatus) status() map[string]interface{} {
+	s := map[string]interface{}{"in_progress": false}
+	if r == nil {
+		return s
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s["in_progress"] = r.running
+	s["coalesced"] = r.coalesced
+	if r.running {
+		s["started"] = r.started.Format(time.RFC3339)
+		s["running_ms"] = int64(time.Since(r.started) / time.Millisecond)
+	}
+	if !r.finished.IsZero() {
+		s["last_finished"] = r.finished.Format(time.RFC3339)
+		s["last_duration_ms"] = int64(r.duration / time.Millisecond)
+		s["last_error"] = r.lastError
+	}
+	return s
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"github.com/quipo/statsd"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowGetter blocks ListZones until released, counting calls
+type slowGetter struct {
+	testGetter
+	mu      sync.Mutex
+	calls   int
+	active  int
+	overlap bool
+	release chan bool
+}
+
+func (g *slowGetter) ListZones() ([]zoneFile, error) {
+	g.mu.Lock()
+	g.calls++
+	g.active++
+	if g.active > 1 {
+		g.overlap = true
+	}
+	g.mu.Unlock()
+	<-g.release
+	g.mu.Lock()
+	g.active--
+	g.mu.Unlock()
+	return nil, fmt.Errorf("no zones")
+}
+
+func TestReloadSerialized(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, update: time.Minute, reloads: &reloadStatus{}}
+	g := &slowGetter{release: make(chan bool)}
+	done := make(chan bool)
+	for i := 0; i < 2; i++ {
+		go func() {
+			c.reloadZones(g)
+			done <- true
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if s := c.reloads.status(); s["in_progress"] != true {
+		t.Errorf("Expected a reload to be in progress, got %v", s)
+	}
+	g.release <- true
+	g.release <- true
+	<-done
+	<-done
+	if g.overlap || g.calls != 2 {
+		t.Errorf("Expected 2 serialized reloads, got %d (overlap: %v)", g.calls, g.overlap)
+	}
+	s := c.reloads.status()
+	if s["in_progress"] != false || s["last_error"] != "no zones" {
+		t.Errorf("Expected the last reload's error in the status, got %v", s)
+	}
+}
+
+func TestRequestReloadCoalesces(t *testing.T) {
+	doUpdate := make(chan bool, 1)
+	if !requestReload(doUpdate) {
+		t.Errorf("Expected the first reload request to be queued")
+	}
+	if requestReload(doUpdate) {
+		t.Errorf("Expected a second reload request to coalesce")
+	}
+}
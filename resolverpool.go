@@ -0,0 +1,189 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Flattening lookups go over --resolver-conns TCP connections kept open to the
+// resolver, rather than a new UDP socket per query. Queries are pipelined (RFC 7766):
+// many can be outstanding on one connection, and replies are matched to them by
+// message ID, so a slow answer doesn't hold up the others. Connections are dialed
+// when first needed and again after the resolver closes them, and if TCP fails the
+// query is sent over UDP as before, counted by flatten.pool.fallback. With
+// --resolver-key, queries are signed either way (see tsig.go).
+const resolverTimeout = 2 * time.Second
+
+type resolverPool struct {
+	addr  string
+	mu    sync.Mutex
+	conns []*pipelinedConn
+	next  int
+}
+
+// pipelinedConn is one TCP connection with its outstanding queries
+type pipelinedConn struct {
+	conn    net.Conn
+	wmu     sync.Mutex // serializes writes
+	mu      sync.Mutex
+	pending map[uint16]chan []byte // replies, still packed
+	closed  bool
+}
+
+func newResolverPool(addr string, size int) *resolverPool {
+	return &resolverPool{addr: addr, conns: make([]*pipelinedConn, size)}
+}
+
+// exchange sends m to the resolver, over the pool if there is one and UDP otherwise.
+func (c *config) exchange(m *dns.Msg) (*dns.Msg, error) {
+	if c.resolvers != nil {
+		r, err := c.resolvers.exchange(c, m)
+		if err == nil {
+			return r, nil
+		}
+		c.stats.Incr("flatten.pool.fallback", 1)
+		c.debug(fmt.Sprintf("Resolver pool error, falling back to UDP: %s", err.Error()))
+	}
+	d := &dns.Client{DialTimeout: resolverTimeout, ReadTimeout: resolverTimeout}
+	if k, ok := c.tsig[c.resolverKey]; ok {
+		m = m.Copy()
+		m.SetTsig(c.resolverKey, k.algorithm, 300, time.Now().Unix())
+		d.TsigSecret = map[string]string{c.resolverKey: k.secret} // verifies signed replies
+	}
+	r, _, err := d.Exchange(m, c.resolver)
+	if err == nil {
+		err = c.verifyReply(r, nil, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// conn returns the next connection in the pool, dialing it if needed
+func (p *resolverPool) conn(c *config) (*pipelinedConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := p.next
+	p.next = (p.next + 1) % len(p.conns)
+	if pc := p.conns[i]; pc != nil && !pc.isClosed() {
+		return pc, nil
+	}
+	conn, err := net.DialTimeout("tcp", p.addr, resolverTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetKeepAlive(true)
+	}
+	c.stats.Incr("flatten.pool.dial", 1)
+	pc := &pipelinedConn{conn: conn, pending: map[uint16]chan []byte{}}
+	p.conns[i] = pc
+	go pc.readReplies()
+	return pc, nil
+}
+
+func (p *resolverPool) exchange(c *config, m *dns.Msg) (*dns.Msg, error) {
+	pc, err := p.conn(c)
+	if err != nil {
+		return nil, err
+	}
+	m = m.Copy() // the ID is ours to pick
+	ch := make(chan []byte, 1)
+	pc.mu.Lock()
+	if pc.closed {
+		pc.mu.Unlock()
+		return nil, fmt.Errorf("connection closed")
+	}
+	for {
+		m.Id = dns.Id()
+		if _, taken := pc.pending[m.Id]; !taken {
+			break
+		}
+	}
+	pc.pending[m.Id] = ch
+	pc.mu.Unlock()
+	defer pc.forget(m.Id)
+
+	b, mac, err := c.packQuery(m)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, 2, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	pc.wmu.Lock()
+	pc.conn.SetWriteDeadline(time.Now().Add(resolverTimeout))
+	_, err = pc.conn.Write(append(frame, b...))
+	pc.wmu.Unlock()
+	if err != nil {
+		pc.close()
+		return nil, err
+	}
+	select {
+	case buf := <-ch:
+		if buf == nil {
+			return nil, fmt.Errorf("connection closed")
+		}
+		return c.unpackReply(buf, mac)
+	case <-time.After(resolverTimeout):
+		return nil, fmt.Errorf("timeout")
+	}
+}
+
+// readReplies hands replies to the queries waiting for them until the connection fails
+func (pc *pipelinedConn) readReplies() {
+	defer pc.close()
+	for {
+		var length uint16
+		if err := binary.Read(pc.conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(pc.conn, buf); err != nil {
+			return
+		}
+		if len(buf) < 12 { // shorter than a header
+			continue
+		}
+		id := binary.BigEndian.Uint16(buf)
+		pc.mu.Lock()
+		if ch, ok := pc.pending[id]; ok {
+			ch <- buf
+			delete(pc.pending, id)
+		}
+		pc.mu.Unlock()
+	}
+}
+
+func (pc *pipelinedConn) forget(id uint16) {
+	pc.mu.Lock()
+	delete(pc.pending, id)
+	pc.mu.Unlock()
+}
+
+func (pc *pipelinedConn) isClosed() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.closed
+}
+
+// close closes the connection, failing its outstanding queries
+func (pc *pipelinedConn) close() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.closed {
+		return
+	}
+	pc.closed = true
+	pc.conn.Close()
+	for id, ch := range pc.pending {
+		close(ch)
+		delete(pc.pending, id)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestResolverPoolPipelining(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var dials int32
+	go func() { // answers each pair of queries in reverse order
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&dials, 1)
+			go func() {
+				defer conn.Close()
+				for {
+					reqs := []*dns.Msg{}
+					for len(reqs) < 2 {
+						var length uint16
+						if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+							return
+						}
+						buf := make([]byte, length)
+						if _, err := io.ReadFull(conn, buf); err != nil {
+							return
+						}
+						req := new(dns.Msg)
+						req.Unpack(buf)
+						reqs = append(reqs, req)
+					}
+					for i := len(reqs) - 1; i >= 0; i-- {
+						m := new(dns.Msg)
+						m.SetReply(reqs[i])
+						m.Answer = append(m.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: reqs[i].Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60}, Txt: []string{reqs[i].Question[0].Name}})
+						b, _ := m.Pack()
+						binary.Write(conn, binary.BigEndian, uint16(len(b)))
+						conn.Write(b)
+					}
+				}
+			}()
+		}
+	}()
+
+	c := config{stats: statsd.NoopClient{}, resolver: l.Addr().String(), resolvers: newResolverPool(l.Addr().String(), 1)}
+	for round := 0; round < 2; round++ {
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				m := new(dns.Msg)
+				m.SetQuestion(name, dns.TypeTXT)
+				r, err := c.resolvers.exchange(&c, m)
+				if err != nil || len(r.Answer) != 1 || r.Answer[0].Header().Name != name {
+					t.Errorf("Expected the reply for %s, got %v %v", name, r, err)
+				}
+			}(fmt.Sprintf("q%d-%d.example.", round, i))
+		}
+		wg.Wait()
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("Expected one connection to be reused, got %d dials", n)
+	}
+}
+
+func TestResolverPoolFallback(t *testing.T) {
+	started := make(chan bool)
+	resolver := &dns.Server{Addr: "127.0.0.1:25357", Net: "udp", NotifyStartedFunc: func() { started <- true }}
+	resolver.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if len(req.Question) != 1 {
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("10.6.6.6")})
+		w.WriteMsg(m)
+	})
+	go resolver.ListenAndServe()
+	<-started
+	defer resolver.Shutdown()
+
+	// nothing listens on TCP, so the pool fails and the query goes over UDP
+	c := config{stats: statsd.NoopClient{}, resolver: "127.0.0.1:25357", resolvers: newResolverPool("127.0.0.1:25357", 2)}
+	cname := &dns.CNAME{Hdr: dns.RR_Header{Name: "abc.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: "target.example."}
+	flat, err := c.flattenCNAME(cname)
+	if err != nil || len(flat) != 1 || flat[0].(*dns.A).A.String() != "10.6.6.6" {
+		t.Errorf("Expected flattening over UDP after the pool failed, got %v %v", flat, err)
+	}
+}
+
+func TestResolverTSIG(t *testing.T) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.IsTsig() == nil || w.TsigStatus() != nil {
+			m.SetRcode(req, dns.RcodeNotAuth)
+			w.WriteMsg(m)
+			return
+		}
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("10.6.6.6")})
+		if req.Question[0].Name != "unsigned.example." {
+			m.SetTsig("flatten.", dns.HmacSHA256, 300, int64(req.IsTsig().TimeSigned))
+		}
+		w.WriteMsg(m)
+	})
+	for _, network := range []string{"udp", "tcp"} {
+		started := make(chan bool)
+		resolver := &dns.Server{Addr: "127.0.0.1:25363", Net: network, Handler: handler, TsigSecret: map[string]string{"flatten.": "c2VjcmV0"},
+			NotifyStartedFunc: func() { started <- true }}
+		go resolver.ListenAndServe()
+		<-started
+		defer resolver.Shutdown()
+	}
+
+	c := config{stats: statsd.NoopClient{}, resolver: "127.0.0.1:25363", resolverKey: "flatten."}
+	var err error
+	if c.tsig, err = c.parseTSIGKeys("flatten=c2VjcmV0,other=b3RoZXI="); err != nil {
+		t.Fatalf("parseTSIGKeys failed: %s", err.Error())
+	}
+	lookup := func(name string) (*dns.Msg, error) {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		if c.resolvers != nil { // no UDP fallback
+			return c.resolvers.exchange(&c, m)
+		}
+		return c.exchange(m)
+	}
+	for _, pool := range []*resolverPool{nil, newResolverPool(c.resolver, 1)} {
+		c.resolvers = pool
+		c.resolverKey = "flatten."
+		if r, err := lookup("target.example."); err != nil || len(r.Answer) != 1 {
+			t.Errorf("Expected a signed lookup (pool %v), got %v %v", pool != nil, r, err)
+		}
+		if r, err := lookup("unsigned.example."); err == nil {
+			t.Errorf("Expected an unsigned reply to be refused (pool %v), got %v", pool != nil, r)
+		}
+		c.resolverKey = "other."
+		if r, err := lookup("target.example."); err == nil {
+			t.Errorf("Expected a lookup with a key the resolver doesn't know to fail (pool %v), got %v", pool != nil, r)
+		}
+	}
+}
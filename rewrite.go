@@ -0,0 +1,136 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// rewriteRule is one entry in a zone policy's "rewrite" list. A rule matches query
+// names by regular expression (name) or suffix, or matches every query if neither
+// is set, and then applies any of its actions:
+//
+//	{"rewrite": [
+//	  {"suffix": "old.abc.com", "to": "new.abc.com"},
+//	  {"name": "^db-(\\d+)\\.abc\\.com\\.$", "to": "db$1.abc.com."},
+//	  {"answer": "10.0.0.1", "with": "10.0.1.1"},
+//	  {"suffix": "test.abc.com", "ttl": 5}
+//	]}
+//
+// "to" looks up a different name in the zone and answers as the original name; only
+// the first matching "to" applies. "answer"/"with" substitutes an address in A and
+// AAAA answers, and "ttl" sets the TTL of every answer. Rules run after the query
+// has been routed to the zone, so rewritten names are looked up in the same zone.
+type rewriteRule struct {
+	Name   string  `json:"name"`
+	Suffix string  `json:"suffix"`
+	To     string  `json:"to"`
+	Answer string  `json:"answer"`
+	With   string  `json:"with"`
+	TTL    *uint32 `json:"ttl"`
+	re     *regexp.Regexp
+	from   net.IP
+	to     net.IP
+}
+
+func (r *rewriteRule) compile(n string) error {
+	if len(r.Name) > 0 && len(r.Suffix) > 0 {
+		return fmt.Errorf("Error in policy for zone %s: rewrite rule cannot have both name and suffix", n)
+	}
+	if len(r.To) == 0 && len(r.Answer) == 0 && r.TTL == nil {
+		return fmt.Errorf("Error in policy for zone %s: rewrite rule needs to, answer or ttl", n)
+	}
+	if len(r.To) > 0 && len(r.Name) == 0 && len(r.Suffix) == 0 {
+		return fmt.Errorf("Error in policy for zone %s: rewrite to %s needs a name or suffix to match", n, r.To)
+	}
+	if len(r.Name) > 0 {
+		re, err := regexp.Compile("(?i)" + r.Name)
+		if err != nil {
+			return fmt.Errorf("Error in policy for zone %s: bad rewrite name %q: %s", n, r.Name, err.Error())
+		}
+		r.re = re
+	}
+	if len(r.Suffix) > 0 {
+		r.Suffix = dns.Fqdn(strings.ToLower(r.Suffix))
+		if len(r.To) > 0 {
+			r.To = dns.Fqdn(strings.ToLower(r.To))
+		}
+	}
+	if len(r.Answer) > 0 || len(r.With) > 0 {
+		r.from, r.to = net.ParseIP(r.Answer), net.ParseIP(r.With)
+		if r.from == nil || r.to == nil || (r.from.To4() == nil) != (r.to.To4() == nil) {
+			return fmt.Errorf("Error in policy for zone %s: rewrite answer %q with %q needs two addresses of the same family", n, r.Answer, r.With)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the rule applies to a query name
+func (r *rewriteRule) matches(name string) bool {
+	switch {
+	case r.re != nil:
+		return r.re.MatchString(name)
+	case len(r.Suffix) > 0:
+		return dns.IsSubDomain(r.Suffix, strings.ToLower(name))
+	}
+	return true
+}
+
+// rewriteName returns the name to look up for a query, which is the query name
+// unless a "to" rule matches it.
+func (p *zonePolicy) rewriteName(name string) string {
+	if p == nil {
+		return name
+	}
+	for _, r := range p.Rewrite {
+		if len(r.To) == 0 || !r.matches(name) {
+			continue
+		}
+		if r.re != nil {
+			return dns.Fqdn(r.re.ReplaceAllString(name, r.To))
+		}
+		lower := strings.ToLower(name)
+		return strings.TrimSuffix(lower, r.Suffix) + r.To
+	}
+	return name
+}
+
+// rewriteAnswers applies the answer rules for a query name to copies of rrs,
+// renaming records for the looked up name back to the query name.
+func (p *zonePolicy) rewriteAnswers(name, lookup string, rrs []dns.RR) []dns.RR {
+	if p == nil || len(p.Rewrite) == 0 {
+		return rrs
+	}
+	out := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		if name != lookup && rr.Header().Name == lookup {
+			rr.Header().Name = name
+		}
+		for _, r := range p.Rewrite {
+			if !r.matches(name) {
+				continue
+			}
+			if r.from != nil {
+				switch a := rr.(type) {
+				case *dns.A:
+					if a.A.Equal(r.from) {
+						a.A = r.to
+					}
+				case *dns.AAAA:
+					if a.AAAA.Equal(r.from) {
+						a.AAAA = r.to
+					}
+				}
+			}
+			if r.TTL != nil {
+				rr.Header().Ttl = *r.TTL
+			}
+		}
+		out = append(out, rr)
+	}
+	return out
+}
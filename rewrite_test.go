@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"testing"
+)
+
+var rewriteZone = `$TTL    300
+$ORIGIN .
+abc.com 	86400    IN      SOA     nsa.abc.com. admin.abc.com. ( 2014121700 10800 1200 864000 7200 )
+        	IN      NS      nsa.abc.com.
+$ORIGIN abc.com.
+		IN	A	127.0.0.1
+new		IN	A	10.0.0.1
+db2		IN	A	10.0.0.2
+test		IN	A	10.0.0.3
+`
+
+func TestRewriteRules(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}}
+	err := c.loadZones(map[string]string{
+		"abc.com": rewriteZone,
+		"abc.com.policy": `{"rewrite": [
+			{"suffix": "old.abc.com", "to": "new.abc.com"},
+			{"name": "^db-(\\d+)\\.abc\\.com\\.$", "to": "db$1.abc.com."},
+			{"answer": "10.0.0.1", "with": "192.168.0.1"},
+			{"suffix": "test.abc.com", "ttl": 5}
+		]}`,
+	})
+	if err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	tests := []struct {
+		qname string
+		want  string
+	}{
+		{"old.abc.com.", "old.abc.com.\t300\tIN\tA\t192.168.0.1"},
+		{"OLD.abc.com.", "OLD.abc.com.\t300\tIN\tA\t192.168.0.1"},
+		{"db-2.abc.com.", "db-2.abc.com.\t300\tIN\tA\t10.0.0.2"},
+		{"test.abc.com.", "test.abc.com.\t5\tIN\tA\t10.0.0.3"},
+		{"new.abc.com.", "new.abc.com.\t300\tIN\tA\t192.168.0.1"},
+	}
+	for _, tc := range tests {
+		m := testQuery(&c, "abc.com", tc.qname, dns.TypeA)
+		if m == nil || len(m.Answer) != 1 || m.Answer[0].String() != tc.want {
+			t.Errorf("rewrite %s: want: %s, got: %v", tc.qname, tc.want, m)
+		}
+	}
+	for _, rr := range c.zones["abc.com"].rrs {
+		if a, ok := rr.(*dns.A); ok && a.A.String() == "192.168.0.1" {
+			t.Errorf("rewrite modified the zone's records")
+		}
+	}
+}
+
+func TestRewriteRulesInvalid(t *testing.T) {
+	for _, policy := range []string{
+		`{"rewrite": [{"name": "x", "suffix": "abc.com", "ttl": 5}]}`,
+		`{"rewrite": [{"suffix": "abc.com"}]}`,
+		`{"rewrite": [{"to": "abc.com"}]}`,
+		`{"rewrite": [{"name": "(", "to": "abc.com"}]}`,
+		`{"rewrite": [{"answer": "10.0.0.1", "with": "::1"}]}`,
+		`{"rewrite": [{"answer": "10.0.0.1"}]}`,
+	} {
+		if _, err := parsePolicy("abc.com", policy); err == nil {
+			t.Errorf("parsePolicy accepted %s", policy)
+		}
+	}
+}
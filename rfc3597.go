@@ -0,0 +1,108 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/miekg/dns"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Records of types the dns package doesn't know are parsed from the RFC 3597 generic
+// form ("TYPE1234 \# 4 0a000001") and served byte-exact. The parser rejects the
+// generic form for types it does know, so a zone hosting a new type would stop
+// loading once the dns package learns it. To keep such zones loading, known types
+// in generic form are parsed as the reserved placeholder type and converted back.
+const genericPlaceholder = 65535
+
+var genericType = regexp.MustCompile(`(^|[\s(])([A-Za-z][A-Za-z0-9-]*)(\s+\(?\s*\\#\s)`)
+
+// expandGenericTypes replaces known types in generic form with the placeholder type,
+// returning the real types in the order their records appear. Quoted strings and
+// comments are left alone.
+func expandGenericTypes(contents string) (string, []uint16, error) {
+	if !strings.Contains(contents, "\\#") {
+		return contents, nil, nil
+	}
+	types := []uint16{}
+	var err error
+	replace := func(text string) string {
+		return genericType.ReplaceAllStringFunc(text, func(m string) string {
+			p := genericType.FindStringSubmatch(m)
+			t, known := knownType(p[2])
+			if t == genericPlaceholder {
+				err = fmt.Errorf("type %s is reserved", p[2])
+			}
+			if !known {
+				return m
+			}
+			types = append(types, t)
+			return p[1] + "TYPE" + strconv.Itoa(genericPlaceholder) + p[3]
+		})
+	}
+	var out bytes.Buffer
+	start := 0
+	for i := 0; i < len(contents); i++ {
+		if contents[i] != '"' && contents[i] != ';' {
+			continue
+		}
+		out.WriteString(replace(contents[start:i]))
+		start = skipQuoted(contents, i)
+		out.WriteString(contents[i:start])
+		i = start - 1
+	}
+	out.WriteString(replace(contents[start:]))
+	return out.String(), types, err
+}
+
+// skipQuoted returns the end of the quoted string or comment starting at i
+func skipQuoted(s string, i int) int {
+	if s[i] == ';' {
+		if n := strings.IndexByte(s[i:], '\n'); n >= 0 {
+			return i + n
+		}
+		return len(s)
+	}
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '"':
+			return j + 1
+		}
+	}
+	return len(s)
+}
+
+// knownType reports whether s names a type the dns package parses natively
+func knownType(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	if strings.HasPrefix(s, "TYPE") {
+		n, err := strconv.ParseUint(s[4:], 10, 16)
+		if err != nil {
+			return 0, false
+		}
+		_, known := dns.TypeToString[uint16(n)]
+		return uint16(n), known && uint16(n) != dns.TypeANY
+	}
+	t, known := dns.StringToType[s]
+	return t, known && t != dns.TypeANY
+}
+
+// fromGeneric converts a placeholder record to its real type through the wire format.
+func fromGeneric(r *dns.RFC3597, t uint16) (dns.RR, error) {
+	generic := *r
+	generic.Hdr.Rrtype = t
+	buf := make([]byte, dns.MaxMsgSize)
+	off, err := dns.PackRR(&generic, buf, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	rr, _, err := dns.UnpackRR(buf[:off], 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s data %s", dns.Type(t).String(), r.Rdata)
+	}
+	return rr, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"testing"
+)
+
+var genericZone = `$ORIGIN abc.com.
+@	300	IN	SOA	nsa.abc.com. admin.abc.com. ( 2014121700 10800 1200 864000 7200 )
+new	300	IN	TYPE65400	\# 6 0A0000010203
+new	300	IN	TYPE65400	\# 0
+www	300	IN	A	\# 4 0a000001
+www	300	IN	TYPE28	( \# 16 20010db8000000000000000000000001 )
+txt	300	IN	TXT	"A \# 4 0a000001" ; A \# 4 0a000001
+`
+
+func TestGenericRecords(t *testing.T) {
+	rrs, err := parseZoneFile("abc.com", genericZone)
+	if err != nil {
+		t.Fatalf("parseZoneFile failed: %s", err.Error())
+	}
+	if len(rrs) != 6 {
+		t.Fatalf("Expected 6 records, got %d", len(rrs))
+	}
+	if a, ok := rrs[3].(*dns.A); !ok || a.A.String() != "10.0.0.1" {
+		t.Errorf("Expected a generic A record to parse as A, got %s", rrs[3])
+	}
+	if aaaa, ok := rrs[4].(*dns.AAAA); !ok || aaaa.AAAA.String() != "2001:db8::1" {
+		t.Errorf("Expected a generic TYPE28 record to parse as AAAA, got %s", rrs[4])
+	}
+	if txt := rrs[5].(*dns.TXT); txt.Txt[0] != "A \\# 4 0a000001" {
+		t.Errorf("Generic form was rewritten inside a TXT string: %s", rrs[5])
+	}
+
+	c := &config{stats: statsd.NoopClient{}}
+	if err := c.loadZones(map[string]string{"abc.com": genericZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	m := testQuery(c, "abc.com", "new.abc.com.", 65400)
+	if len(m.Answer) != 2 {
+		t.Fatalf("Expected 2 TYPE65400 answers, got %v", m.Answer)
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Pack failed: %s", err.Error())
+	}
+	if !bytes.Contains(b, []byte{0xff, 0x78, 0, 1, 0, 0, 1, 0x2c, 0, 6, 0x0a, 0, 0, 1, 2, 3}) {
+		t.Errorf("Expected the TYPE65400 rdata byte-exact in %x", b)
+	}
+	if !bytes.HasSuffix(b, []byte{0xff, 0x78, 0, 1, 0, 0, 1, 0x2c, 0, 0}) {
+		t.Errorf("Expected an empty TYPE65400 rdata in %x", b)
+	}
+
+	for _, bad := range []string{
+		"www.abc.com. 300 IN A \\# 3 0a0000\n",
+		"www.abc.com. 300 IN TYPE65535 \\# 1 00\n",
+		"www.abc.com. 300 IN TYPE65400 \\# 2 00\n",
+	} {
+		if _, err := parseZoneFile("abc.com", bad); err == nil {
+			t.Errorf("parseZoneFile accepted %q", bad)
+		}
+	}
+}
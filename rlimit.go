@@ -0,0 +1,49 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// fdOverhead covers the open files needed besides TCP clients: stdio and logs, the
+// UDP and TCP listeners, S3, resolver and forwarding connections, statsd, the admin
+// API and the local listener.
+const fdOverhead = 128
+
+// fdsNeeded estimates the open files needed at full load, or --fds if set.
+func (c *config) fdsNeeded() uint64 {
+	if c.fds > 0 {
+		return c.fds
+	}
+	return uint64(c.tcpMax) + fdOverhead
+}
+
+// checkFileLimit makes sure the open file limit covers fdsNeeded, raising the soft
+// limit as far as the hard limit allows and warning if that is not enough, so load
+// doesn't end in "too many open files".
+func (c *config) checkFileLimit() {
+	need := c.fdsNeeded()
+	cur, max, err := getFileLimit()
+	if err != nil {
+		c.debug(fmt.Sprintf("Not checking the open file limit: %s", err.Error()))
+		return
+	}
+	if cur < need && cur < max {
+		target := need
+		if max < target {
+			target = max
+		}
+		if err := setFileLimit(target); err != nil {
+			log.Printf("Warning: could not raise the open file limit from %d to %d: %s", cur, target, err.Error())
+		} else {
+			log.Printf("Raised the open file limit from %d to %d", cur, target)
+			cur = target
+		}
+	}
+	if cur < need {
+		log.Printf("Warning: the open file limit is %d but up to %d open files are needed (--tcp-max=%d); raise it with ulimit -n or LimitNOFILE=, or lower --tcp-max", cur, need, c.tcpMax)
+	}
+	c.stats.Gauge("fdlimit", int64(cur))
+	c.debug(fmt.Sprintf("Open file limit %d, need %d", cur, need))
+}
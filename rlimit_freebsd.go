@@ -0,0 +1,25 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"syscall"
+)
+
+// FreeBSD's rlimits are signed
+
+func getFileLimit() (uint64, uint64, error) {
+	var r syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &r); err != nil {
+		return 0, 0, err
+	}
+	return uint64(r.Cur), uint64(r.Max), nil
+}
+
+func setFileLimit(n uint64) error {
+	var r syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &r); err != nil {
+		return err
+	}
+	r.Cur = int64(n)
+	return syscall.Setrlimit(syscall.RLIMIT_NOFILE, &r)
+}
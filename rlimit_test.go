@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/quipo/statsd"
+	"testing"
+)
+
+func TestCheckFileLimit(t *testing.T) {
+	cur, max, err := getFileLimit()
+	if err != nil {
+		t.Skipf("no file limit: %s", err.Error())
+	}
+	c := &config{stats: statsd.NoopClient{}, tcpMax: 1000}
+	if n := c.fdsNeeded(); n != 1000+fdOverhead {
+		t.Errorf("Expected --tcp-max plus overhead, got %d", n)
+	}
+	c.fds = cur
+	c.checkFileLimit()
+	if now, _, _ := getFileLimit(); now != cur {
+		t.Errorf("Expected the limit left at %d, got %d", cur, now)
+	}
+	if cur >= max {
+		return
+	}
+	c.fds = cur + 1 // raising the soft limit for the test process is harmless
+	c.checkFileLimit()
+	if now, _, _ := getFileLimit(); now != cur+1 {
+		t.Errorf("Expected the limit raised to %d, got %d", cur+1, now)
+	}
+	if max > 1<<20 { // unlimited
+		return
+	}
+	c.fds = max + 1
+	c.checkFileLimit()
+	if now, _, _ := getFileLimit(); now != max {
+		t.Errorf("Expected the limit raised to the hard limit %d, got %d", max, now)
+	}
+}
@@ -0,0 +1,26 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+//go:build !windows && !freebsd
+// +build !windows,!freebsd
+
+package main
+
+import (
+	"syscall"
+)
+
+func getFileLimit() (uint64, uint64, error) {
+	var r syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &r); err != nil {
+		return 0, 0, err
+	}
+	return r.Cur, r.Max, nil
+}
+
+func setFileLimit(n uint64) error {
+	var r syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &r); err != nil {
+		return err
+	}
+	r.Cur = n
+	return syscall.Setrlimit(syscall.RLIMIT_NOFILE, &r)
+}
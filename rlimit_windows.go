@@ -0,0 +1,16 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+)
+
+// Windows has no open file limit to speak of
+
+func getFileLimit() (uint64, uint64, error) {
+	return 0, 0, fmt.Errorf("not supported on Windows")
+}
+
+func setFileLimit(n uint64) error {
+	return fmt.Errorf("not supported on Windows")
+}
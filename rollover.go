@@ -0,0 +1,183 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"sort"
+	"time"
+)
+
+// With --zsk-rollover, neddns rolls each signed zone's ZSK over on a schedule by
+// pre-publishing (RFC 6781 section 4.1.1.1): a new key is generated and published in
+// the DNSKEY set while the old one still signs, the new one starts signing once the
+// DNSKEY set has expired from caches, and the old one is withdrawn once the
+// signatures it made have too. Keys and state are stored in the bucket, so every
+// instance signs with the same keys and a restart picks up where it left off:
+//
+//	abc.com.zsk-<key tag>.key, .private   generated ZSKs, never changed
+//	abc.com.keystate                      which key signs, and the keys being rolled
+//
+// The key state is written after the keys it names. Only one instance should roll
+// keys. The KSK isn't rolled; its CDS and CDNSKEY are published for the parent.
+const (
+	keyStateSuffix = ".keystate"
+	rolloverCheck  = time.Hour
+	rolloverMargin = time.Hour // on top of the zone's largest TTL, for propagation
+)
+
+// keyState is a zone's .keystate object. Keys are named by their files without the
+// .key or .private suffix, such as abc.com.zsk-12345, or abc.com.zsk for the key the
+// zone was first signed with.
+type keyState struct {
+	ZSK          string    `json:"zsk"`
+	ZSKSince     time.Time `json:"zsk_since"`
+	Next         string    `json:"next,omitempty"` // published, to sign next
+	NextSince    time.Time `json:"next_since"`
+	Retired      string    `json:"retired,omitempty"` // published until its signatures expire
+	RetiredSince time.Time `json:"retired_since"`
+}
+
+// rollKeys rolls ZSKs over every rolloverCheck until the process exits, reloading
+// the zones whose keys changed.
+func (c *config) rollKeys(store zoneStore) {
+	for range time.Tick(rolloverCheck) {
+		if c.rollZSKs(store, time.Now()) > 0 {
+			c.reloadZones(store)
+		}
+	}
+}
+
+// rollZSKs takes each signed zone a step through its ZSK rollover if one is due,
+// storing new keys and key state. It returns the number of zones whose state changed.
+func (c *config) rollZSKs(store zonePutter, now time.Time) int {
+	if c.reloads != nil { // keep the update loop from reloading underneath us
+		c.reloads.run.Lock()
+		defer c.reloads.run.Unlock()
+	}
+	names := []string{}
+	for n := range c.dnssecKeys {
+		if _, ok := c.zones[n]; ok {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	changed := 0
+	for _, n := range names {
+		updated, err := c.rollZSK(store, n, now)
+		if err != nil {
+			log.Printf("Error rolling over the ZSK of zone %s: %s", n, err.Error())
+			c.stats.Incr("dnssec.rollover.error", 1)
+			c.alerts.alert(c, alertSigning, n, "rolling over the ZSK: "+err.Error())
+			continue
+		}
+		if updated {
+			changed++
+		}
+	}
+	return changed
+}
+
+// rollZSK takes zone n a step through its ZSK rollover, returning whether its state
+// changed
+func (c *config) rollZSK(store zonePutter, n string, now time.Time) (bool, error) {
+	var state keyState
+	if contents, ok := c.keyFiles[n+keyStateSuffix]; ok {
+		if err := json.Unmarshal([]byte(contents), &state); err != nil {
+			return false, err
+		}
+	}
+	before := state
+	if len(state.ZSK) == 0 { // first rollover, start from the key the zone is signed with
+		state.ZSK, state.ZSKSince = n+".zsk", now
+		if _, ok := c.keyFiles[n+".zsk.key"]; !ok {
+			state.ZSK = n + ".ksk"
+		}
+	}
+	wait := maxTTL(c.zones[n].rrs) + rolloverMargin
+	if len(state.Retired) > 0 && now.Sub(state.RetiredSince) >= wait {
+		c.debug(fmt.Sprintf("Withdrew DNSKEY %s from zone %s", state.Retired, n))
+		state.Retired, state.RetiredSince = "", time.Time{}
+	}
+	if len(state.Next) == 0 && now.Sub(state.ZSKSince) >= c.zskRollover-wait {
+		base, err := c.newZSK(store, n)
+		if err != nil {
+			return false, err
+		}
+		state.Next, state.NextSince = base, now
+		log.Printf("Published new ZSK %s for zone %s", base, n)
+		c.stats.Incr("dnssec.rollover.published", 1)
+	}
+	if len(state.Next) > 0 && len(state.Retired) == 0 && now.Sub(state.NextSince) >= wait && now.Sub(state.ZSKSince) >= c.zskRollover {
+		state.Retired, state.RetiredSince = state.ZSK, now
+		state.ZSK, state.ZSKSince = state.Next, now
+		state.Next, state.NextSince = "", time.Time{}
+		log.Printf("Zone %s is now signed with ZSK %s", n, state.ZSK)
+		c.stats.Incr("dnssec.rollover.rolled", 1)
+	}
+	if state == before {
+		return false, nil
+	}
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	if err := store.PutZone(c.prefix+n+keyStateSuffix, string(b)+"\n"); err != nil {
+		return false, fmt.Errorf("storing key state: %s", err.Error())
+	}
+	return true, nil
+}
+
+// newZSK generates a ZSK for zone n like its current one, stores its files and
+// returns their name without the suffix
+func (c *config) newZSK(store zonePutter, n string) (string, error) {
+	keys := c.dnssecKeys[n]
+	var bits int
+	switch s := keys.zsk.signer.(type) {
+	case *rsa.PrivateKey:
+		bits = s.N.BitLen()
+	case *ecdsa.PrivateKey:
+		bits = s.Curve.Params().BitSize
+	default:
+		return "", fmt.Errorf("can't generate keys like the current ZSK")
+	}
+	taken := map[uint16]bool{}
+	for _, k := range append([]*dnssecKey{keys.ksk, keys.zsk}, keys.published...) {
+		taken[k.dnskey.KeyTag()] = true
+	}
+	for tries := 0; tries < 10; tries++ {
+		dnskey := &dns.DNSKEY{Hdr: dns.RR_Header{Name: dns.Fqdn(n), Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: keys.zsk.dnskey.Hdr.Ttl},
+			Flags: dns.ZONE, Protocol: 3, Algorithm: keys.zsk.dnskey.Algorithm}
+		priv, err := dnskey.Generate(bits)
+		if err != nil {
+			return "", err
+		}
+		if taken[dnskey.KeyTag()] {
+			continue // validators would have to try both keys
+		}
+		base := fmt.Sprintf("%s.zsk-%d", n, dnskey.KeyTag())
+		if err := store.PutZone(c.prefix+base+".private", dnskey.PrivateKeyString(priv)); err != nil {
+			return "", fmt.Errorf("storing %s.private: %s", base, err.Error())
+		}
+		if err := store.PutZone(c.prefix+base+".key", dnskey.String()+"\n"); err != nil {
+			return "", fmt.Errorf("storing %s.key: %s", base, err.Error())
+		}
+		return base, nil
+	}
+	return "", fmt.Errorf("no key without a key tag collision")
+}
+
+// maxTTL returns the largest TTL of rrs
+func maxTTL(rrs []dns.RR) time.Duration {
+	max := uint32(0)
+	for _, rr := range rrs {
+		if ttl := rr.Header().Ttl; ttl > max {
+			max = ttl
+		}
+	}
+	return time.Duration(max) * time.Second
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"testing"
+	"time"
+)
+
+// testSigningKey returns the key tag of the signature on the answer to a DO query
+func testSigningKey(t *testing.T, c *config, name string, qtype uint16) uint16 {
+	m := testDOQuery(c, "abc.com", name, qtype)
+	for _, rr := range m.Answer {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			return sig.KeyTag
+		}
+	}
+	t.Fatalf("Expected a signature on %s %s, got %v", name, dns.Type(qtype).String(), m)
+	return 0
+}
+
+func TestZSKRollover(t *testing.T) {
+	store := testStore{zones: testSignedZones(t)}
+	c := config{stats: statsd.NoopClient{}, zskRollover: 30 * 24 * time.Hour}
+	reload := func() {
+		zones := map[string]string{}
+		for k, v := range store.zones {
+			zones[k] = v
+		}
+		if err := c.loadZones(zones); err != nil {
+			t.Fatalf("loadZones failed: %s", err.Error())
+		}
+	}
+	reload()
+	keys := c.dnssecKeys["abc.com"]
+	ksk, zsk := keys.ksk.dnskey.KeyTag(), keys.zsk.dnskey.KeyTag()
+	wait := maxTTL(c.zones["abc.com"].rrs) + rolloverMargin
+
+	start := time.Now()
+	if n := c.rollZSKs(store, start); n != 1 || len(store.zones["abc.com.keystate"]) == 0 {
+		t.Fatalf("Expected the zone's key state to be stored, got %d %v", n, store.zones["abc.com.keystate"])
+	}
+	reload()
+	if n := c.rollZSKs(store, start.Add(time.Hour)); n != 0 {
+		t.Errorf("Expected no change before the new key is due, got %d", n)
+	}
+
+	published := start.Add(c.zskRollover - wait)
+	if n := c.rollZSKs(store, published); n != 1 {
+		t.Fatalf("Expected a new key to be published, got %d", n)
+	}
+	reload()
+	m := testDOQuery(&c, "abc.com", "abc.com.", dns.TypeDNSKEY)
+	if countType(m.Answer, dns.TypeDNSKEY) != 3 {
+		t.Errorf("Expected the new key to be published alongside the KSK and ZSK, got %v", m)
+	}
+	if tag := testSigningKey(t, &c, "abc.com.", dns.TypeA); tag != zsk {
+		t.Errorf("Expected the old ZSK to sign until the new one has propagated, got %d", tag)
+	}
+	if n := c.rollZSKs(store, start.Add(c.zskRollover-time.Second)); n != 0 {
+		t.Errorf("Expected no change before the ZSK's lifetime is up, got %d", n)
+	}
+
+	if n := c.rollZSKs(store, start.Add(c.zskRollover)); n != 1 {
+		t.Fatalf("Expected the new ZSK to take over, got %d", n)
+	}
+	reload()
+	next := testSigningKey(t, &c, "abc.com.", dns.TypeA)
+	if next == zsk || next == ksk {
+		t.Errorf("Expected the new ZSK to sign, got %d", next)
+	}
+	m = testDOQuery(&c, "abc.com", "abc.com.", dns.TypeDNSKEY)
+	if countType(m.Answer, dns.TypeDNSKEY) != 3 {
+		t.Errorf("Expected the old ZSK to stay published while its signatures are cached, got %v", m)
+	}
+	verifyAnswer(t, testDOQuery(&c, "abc.com", "abc.com.", dns.TypeA), withoutType(m.Answer, dns.TypeRRSIG))
+
+	if n := c.rollZSKs(store, start.Add(c.zskRollover+wait)); n != 1 {
+		t.Fatalf("Expected the old ZSK to be withdrawn, got %d", n)
+	}
+	reload()
+	m = testDOQuery(&c, "abc.com", "abc.com.", dns.TypeDNSKEY)
+	if countType(m.Answer, dns.TypeDNSKEY) != 2 {
+		t.Errorf("Expected the KSK and new ZSK only, got %v", m)
+	}
+	if tag := testSigningKey(t, &c, "abc.com.", dns.TypeDNSKEY); tag != ksk {
+		t.Errorf("Expected the KSK to sign the DNSKEY set, got %d", tag)
+	}
+
+	// a restart signs with the stored keys
+	restarted := config{stats: statsd.NoopClient{}}
+	if err := restarted.loadZones(store.zones); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if tag := testSigningKey(t, &restarted, "abc.com.", dns.TypeA); tag != next {
+		t.Errorf("Expected the rolled ZSK to sign after a restart, got %d", tag)
+	}
+
+	broken := testSignedZones(t)
+	broken["abc.com.keystate"] = `{"zsk": "abc.com.zsk-1"}`
+	bad := config{stats: statsd.NoopClient{}}
+	if err := bad.loadZones(broken); err == nil || bad.dnssecKeys["abc.com"] != nil {
+		t.Errorf("Expected a key state naming a missing key to fail")
+	}
+}
+
+func TestCDS(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}}
+	if err := c.loadZones(testSignedZones(t)); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	ksk := c.dnssecKeys["abc.com"].ksk.dnskey
+	m := testDOQuery(&c, "abc.com", "abc.com.", dns.TypeCDS)
+	if len(m.Answer) != 2 {
+		t.Fatalf("Expected a signed CDS record, got %v", m)
+	}
+	if cds, ok := m.Answer[0].(*dns.CDS); !ok || cds.KeyTag != ksk.KeyTag() || cds.DigestType != dns.SHA256 || cds.Digest != ksk.ToDS(dns.SHA256).Digest {
+		t.Errorf("Expected the CDS of the KSK, got %v", m.Answer[0])
+	}
+	verifyAnswer(t, m, []dns.RR{ksk})
+	m = testDOQuery(&c, "abc.com", "abc.com.", dns.TypeCDNSKEY)
+	if cdnskey, ok := m.Answer[0].(*dns.CDNSKEY); !ok || cdnskey.PublicKey != ksk.PublicKey || cdnskey.Flags != 257 {
+		t.Errorf("Expected the CDNSKEY of the KSK, got %v", m.Answer[0])
+	}
+	verifyAnswer(t, m, []dns.RR{ksk})
+}
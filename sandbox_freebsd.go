@@ -0,0 +1,36 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// sandbox limits stdio and the log file to writing with capsicum. Full capability
+// mode (cap_enter) is not used because it forbids connecting to S3, the flattening
+// resolver and forwarders by address.
+func (c *config) sandbox() error {
+	rights, err := unix.CapRightsInit([]uint64{unix.CAP_WRITE, unix.CAP_SEEK, unix.CAP_FSTAT, unix.CAP_FCNTL})
+	if err != nil {
+		return err
+	}
+	files := []*os.File{os.Stdout, os.Stderr}
+	if c.logFile != nil {
+		files = append(files, c.logFile)
+	}
+	for _, f := range files {
+		if err := unix.CapRightsLimit(f.Fd(), rights); err != nil {
+			return fmt.Errorf("cap_rights_limit %s: %s", f.Name(), err.Error())
+		}
+	}
+	none, err := unix.CapRightsInit([]uint64{})
+	if err != nil {
+		return err
+	}
+	if err := unix.CapRightsLimit(os.Stdin.Fd(), none); err != nil {
+		return fmt.Errorf("cap_rights_limit stdin: %s", err.Error())
+	}
+	c.debug("capsicum sandbox enabled")
+	return nil
+}
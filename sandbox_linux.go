@@ -0,0 +1,82 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"runtime"
+	"unsafe"
+)
+
+// seccomp-bpf constants from linux/seccomp.h and linux/filter.h
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetKill         = 0x00000000
+	seccompRetErrno        = 0x00050000
+	seccompRetAllow        = 0x7fff0000
+	bpfLdWAbs              = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfJeqK                = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJsetK               = 0x45 // BPF_JMP | BPF_JSET | BPF_K
+	bpfRetK                = 0x06 // BPF_RET | BPF_K
+	seccompDataArch        = 4
+	seccompDataNr          = 0
+	seccompDataArg2        = 32 // low word of args[2] (little endian)
+)
+
+var auditArch = map[string]uint32{
+	"amd64": 0xc000003e,
+	"arm64": 0xc00000b7,
+	"386":   0x40000003,
+	"arm":   0x40000028,
+}
+
+// sandboxDenied are syscalls a DNS server never needs after startup
+var sandboxDenied = []uintptr{
+	unix.SYS_EXECVE, unix.SYS_EXECVEAT, unix.SYS_PTRACE, unix.SYS_PROCESS_VM_READV, unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_MOUNT, unix.SYS_UMOUNT2, unix.SYS_PIVOT_ROOT, unix.SYS_CHROOT, unix.SYS_UNSHARE, unix.SYS_SETNS,
+	unix.SYS_INIT_MODULE, unix.SYS_FINIT_MODULE, unix.SYS_DELETE_MODULE, unix.SYS_KEXEC_LOAD, unix.SYS_REBOOT,
+	unix.SYS_SETUID, unix.SYS_SETGID, unix.SYS_SETREUID, unix.SYS_SETREGID, unix.SYS_SETRESUID, unix.SYS_SETRESGID,
+	unix.SYS_UNLINKAT, unix.SYS_RENAMEAT, unix.SYS_MKDIRAT, unix.SYS_LINKAT, unix.SYS_SYMLINKAT,
+	unix.SYS_FCHMODAT, unix.SYS_FCHOWNAT,
+}
+
+// sandbox installs a seccomp filter on every thread that denies process, mount and
+// privilege changes, filesystem modification and opening files for writing. Already
+// open descriptors (the log file, listeners) and new network sockets keep working.
+func (c *config) sandbox() error {
+	arch, ok := auditArch[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("seccomp sandbox is not supported on %s", runtime.GOARCH)
+	}
+	deny := uint32(seccompRetErrno | uint32(unix.EPERM))
+	prog := []unix.SockFilter{
+		{Code: bpfLdWAbs, K: seccompDataArch},
+		{Code: bpfJeqK, Jt: 1, Jf: 0, K: arch},
+		{Code: bpfRetK, K: seccompRetKill},
+		{Code: bpfLdWAbs, K: seccompDataNr},
+	}
+	for _, nr := range sandboxDenied {
+		prog = append(prog,
+			unix.SockFilter{Code: bpfJeqK, Jt: 0, Jf: 1, K: uint32(nr)},
+			unix.SockFilter{Code: bpfRetK, K: deny})
+	}
+	writeFlags := uint32(unix.O_WRONLY | unix.O_RDWR | unix.O_CREAT | unix.O_TRUNC)
+	prog = append(prog,
+		unix.SockFilter{Code: bpfJeqK, Jt: 0, Jf: 3, K: unix.SYS_OPENAT},
+		unix.SockFilter{Code: bpfLdWAbs, K: seccompDataArg2},
+		unix.SockFilter{Code: bpfJsetK, Jt: 0, Jf: 1, K: writeFlags},
+		unix.SockFilter{Code: bpfRetK, K: uint32(seccompRetErrno | uint32(unix.EACCES))},
+		unix.SockFilter{Code: bpfRetK, K: seccompRetAllow})
+
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("prctl(PR_SET_NO_NEW_PRIVS): %s", err.Error())
+	}
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&fprog)))
+	if errno != 0 {
+		return fmt.Errorf("seccomp: %s", errno.Error())
+	}
+	c.debug(fmt.Sprintf("seccomp sandbox enabled (%d instructions)", len(prog)))
+	return nil
+}
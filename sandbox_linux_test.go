@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSandbox re-runs the test binary so the seccomp filter does not stick to the test process
+func TestSandbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "neddns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if os.Getenv("NEDDNS_SANDBOX_DIR") != "" {
+		dir = os.Getenv("NEDDNS_SANDBOX_DIR")
+		c := config{}
+		if err := c.sandbox(); err != nil {
+			os.Stdout.WriteString("sandbox failed: " + err.Error() + "\n")
+			os.Exit(1)
+		}
+		if _, err := ioutil.ReadFile(filepath.Join(dir, "readable")); err != nil {
+			os.Stdout.WriteString("read denied\n")
+		}
+		if _, err := os.Create(filepath.Join(dir, "created")); err == nil {
+			os.Stdout.WriteString("create allowed\n")
+		}
+		if err := exec.Command("/bin/true").Run(); err == nil {
+			os.Stdout.WriteString("exec allowed\n")
+		}
+		os.Stdout.WriteString("done\n")
+		os.Exit(0)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "readable"), []byte("ok"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=TestSandbox")
+	cmd.Env = append(os.Environ(), "NEDDNS_SANDBOX_DIR="+dir)
+	out, _ := cmd.CombinedOutput()
+	if !strings.Contains(string(out), "done") || strings.Contains(string(out), "denied") || strings.Contains(string(out), "allowed") {
+		t.Errorf("sandbox did not restrict the process as expected: %s", string(out))
+	}
+}
@@ -0,0 +1,28 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+)
+
+// sandboxReadable are the only paths left visible: CA certificates for S3 and the
+// resolver configuration. The log file is already open so it needs no path.
+var sandboxReadable = []string{"/etc/ssl", "/etc/resolv.conf", "/etc/hosts"}
+
+// sandbox hides the filesystem with unveil and pledges to network use only.
+func (c *config) sandbox() error {
+	for _, p := range sandboxReadable {
+		if err := unix.Unveil(p, "r"); err != nil {
+			return fmt.Errorf("unveil %s: %s", p, err.Error())
+		}
+	}
+	if err := unix.UnveilBlock(); err != nil {
+		return fmt.Errorf("unveil: %s", err.Error())
+	}
+	if err := unix.PledgePromises("stdio rpath inet dns"); err != nil {
+		return fmt.Errorf("pledge: %s", err.Error())
+	}
+	c.debug("pledge/unveil sandbox enabled")
+	return nil
+}
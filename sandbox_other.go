@@ -0,0 +1,14 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+//go:build !linux && !openbsd && !freebsd
+// +build !linux,!openbsd,!freebsd
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func (c *config) sandbox() error {
+	return fmt.Errorf("sandboxing is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,100 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"time"
+)
+
+const (
+	maxQuerySize    = 4096 // queries are small, even with EDNS options and TSIG
+	maxQueryRecords = 8    // answer, authority and additional records in a query
+	minRecordSize   = 11   // root owner name, type, class, TTL and rdlength
+)
+
+// checkQuery applies cheap sanity checks to a raw query before it is unpacked, so
+// crafted packets (huge record counts, compression pointers in the question,
+// overlong names) are dropped without allocating for them.
+func checkQuery(m []byte) error {
+	if len(m) < 12 {
+		return fmt.Errorf("short header")
+	}
+	if len(m) > maxQuerySize {
+		return fmt.Errorf("query of %d bytes", len(m))
+	}
+	if m[2]&0x80 != 0 {
+		return fmt.Errorf("response sent as a query")
+	}
+	if qd := binary.BigEndian.Uint16(m[4:]); qd != 1 {
+		return fmt.Errorf("%d questions", qd)
+	}
+	records := int(binary.BigEndian.Uint16(m[6:])) + int(binary.BigEndian.Uint16(m[8:])) + int(binary.BigEndian.Uint16(m[10:]))
+	if records > maxQueryRecords {
+		return fmt.Errorf("%d records", records)
+	}
+	// the question holds the first name in the message, so it can't be compressed
+	off, n := 12, 0
+	for {
+		if off >= len(m) {
+			return fmt.Errorf("truncated question")
+		}
+		l := int(m[off])
+		if l == 0 {
+			off++
+			break
+		}
+		if l&0xC0 != 0 {
+			return fmt.Errorf("compressed question name")
+		}
+		if n += l + 1; n > 254 {
+			return fmt.Errorf("question name too long")
+		}
+		off += l + 1
+	}
+	if off+4 > len(m) {
+		return fmt.Errorf("truncated question")
+	}
+	if len(m)-off-4 < records*minRecordSize {
+		return fmt.Errorf("%d records in %d bytes", records, len(m)-off-4)
+	}
+	return nil
+}
+
+// queryReader drops malformed queries before the dns package unpacks them. A
+// malformed query on TCP closes the connection.
+type queryReader struct {
+	dns.Reader
+	c *config
+}
+
+func (c *config) decorateReader(r dns.Reader) dns.Reader {
+	return queryReader{r, c}
+}
+
+func (r queryReader) ReadTCP(conn *net.TCPConn, timeout time.Duration) ([]byte, error) {
+	m, err := r.Reader.ReadTCP(conn, timeout)
+	if err == nil {
+		err = r.c.saneQuery(m, conn.RemoteAddr())
+	}
+	return m, err
+}
+
+func (r queryReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	m, s, err := r.Reader.ReadUDP(conn, timeout)
+	if err == nil {
+		err = r.c.saneQuery(m, s.RemoteAddr())
+	}
+	return m, s, err
+}
+
+func (c *config) saneQuery(m []byte, from net.Addr) error {
+	err := checkQuery(m)
+	if err != nil {
+		c.stats.Incr("query.malformed", 1)
+		c.debug(fmt.Sprintf("Dropped malformed query from %s: %s", from, err.Error()))
+	}
+	return err
+}
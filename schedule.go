@@ -0,0 +1,125 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"strings"
+	"time"
+)
+
+// Records can be scheduled with a comment annotation on the same line, so cutover
+// records can be uploaded ahead of time:
+//
+//	www  IN  A  10.0.0.1  ; valid-until=2015-12-01T06:00:00Z
+//	www  IN  A  10.0.1.1  ; valid-from=2015-12-01T06:00:00Z
+//
+// Times are RFC 3339. A scheduled record is served from valid-from (inclusive)
+// until valid-until (exclusive), and the zone switches over at those moments
+// rather than on the next update. Records with a maintenance window are kept here
+// too, but are served by answer rather than swapped in by the schedule.
+type scheduledRR struct {
+	rr     dns.RR
+	from   time.Time
+	until  time.Time
+	window *maintenanceWindow
+}
+
+func (s scheduledRR) active(t time.Time) bool {
+	return (s.from.IsZero() || !t.Before(s.from)) && (s.until.IsZero() || t.Before(s.until))
+}
+
+// parseSchedule reads valid-from, valid-until and maintenance annotations from a
+// record comment. ok is false for comments without annotations.
+func parseSchedule(comment string) (s scheduledRR, ok bool, err error) {
+	days := ""
+	for _, f := range strings.Fields(strings.TrimLeft(comment, "; ")) {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "maintenance":
+			if s.window, err = parseWindow(kv[1]); err != nil {
+				return s, false, err
+			}
+			ok = true
+			continue
+		case "maintenance-days":
+			days = kv[1]
+			continue
+		case "valid-from", "valid-until":
+		default:
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, kv[1])
+		if err != nil {
+			return s, false, fmt.Errorf("bad %s %q, use RFC 3339 like 2015-12-01T06:00:00Z", kv[0], kv[1])
+		}
+		if kv[0] == "valid-from" {
+			s.from = t
+		} else {
+			s.until = t
+		}
+		ok = true
+	}
+	if len(days) > 0 {
+		if s.window == nil {
+			return s, false, fmt.Errorf("maintenance-days without a maintenance window")
+		}
+		if err := s.window.parseDays(days); err != nil {
+			return s, false, err
+		}
+	}
+	if ok && !s.from.IsZero() && !s.until.IsZero() && !s.from.Before(s.until) {
+		return s, false, fmt.Errorf("valid-from %s is not before valid-until %s", s.from.Format(time.RFC3339), s.until.Format(time.RFC3339))
+	}
+	return s, ok, nil
+}
+
+// activeRRs returns the zone's records at t, and the next time that changes.
+func (z *zone) activeRRs(t time.Time) ([]dns.RR, time.Time) {
+	rrs := make([]dns.RR, 0, len(z.base)+len(z.scheduled))
+	rrs = append(rrs, z.base...)
+	var next time.Time
+	for _, s := range z.scheduled {
+		if s.window != nil { // served by answer
+			continue
+		}
+		if s.active(t) {
+			rrs = append(rrs, s.rr)
+		}
+		for _, b := range []time.Time{s.from, s.until} {
+			if b.After(t) && (next.IsZero() || b.Before(next)) {
+				next = b
+			}
+		}
+	}
+	return rrs, next
+}
+
+// scheduleZone serves the records active now and arranges to re-register the zone
+// at its next scheduled change, unless it has been reloaded by then.
+func (c *config) scheduleZone(z *zone) {
+	now := time.Now()
+	rrs, next := z.activeRRs(now)
+	z.rrs = rrs
+	if next.IsZero() {
+		return
+	}
+	c.debug(fmt.Sprintf("Zone %s has scheduled records, next change at %s", z.name, next.Format(time.RFC3339)))
+	time.AfterFunc(next.Sub(now), func() {
+		if c.reloads != nil { // don't race a reload replacing the zone
+			c.reloads.run.Lock()
+			defer c.reloads.run.Unlock()
+		}
+		if c.zones[z.name] != z {
+			return
+		}
+		updated := *z
+		c.registerZone(&updated)
+		c.stats.Incr("zones.scheduled", 1)
+		log.Printf("Zone %s scheduled records changed, now serving %d records", z.name, len(updated.rrs))
+	})
+}
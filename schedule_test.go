@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	s, ok, err := parseSchedule("; cutover valid-from=2015-12-01T06:00:00Z valid-until=2015-12-02T06:00:00Z")
+	if err != nil || !ok || s.from.Day() != 1 || s.until.Day() != 2 {
+		t.Errorf("parseSchedule failed: %v %v %v", s, ok, err)
+	}
+	if _, ok, err := parseSchedule("; just a comment"); ok || err != nil {
+		t.Errorf("Expected a plain comment not to be a schedule")
+	}
+	for _, bad := range []string{";valid-from=tomorrow", ";valid-from=2015-12-02T06:00:00Z valid-until=2015-12-01T06:00:00Z"} {
+		if _, _, err := parseSchedule(bad); err == nil {
+			t.Errorf("parseSchedule accepted %s", bad)
+		}
+	}
+	if _, err := parseZoneFile("abc.com", "abc.com. 300 IN A 10.0.0.1 ; valid-until=soon\n"); err == nil {
+		t.Errorf("parseZoneFile accepted a bad schedule")
+	}
+}
+
+func TestScheduledRecords(t *testing.T) {
+	now := time.Now()
+	cutover := now.Add(200 * time.Millisecond).Format(time.RFC3339Nano)
+	zone := fmt.Sprintf(`$ORIGIN abc.com.
+@	300	IN	SOA	nsa.abc.com. admin.abc.com. ( 2014121700 10800 1200 864000 7200 )
+@	300	IN	NS	nsa.abc.com.
+www	300	IN	A	10.0.0.1 ; valid-until=%s
+www	300	IN	A	10.0.1.1 ; valid-from=%s
+old	300	IN	A	10.0.0.9 ; valid-until=%s
+`, cutover, cutover, now.Add(-time.Hour).Format(time.RFC3339))
+	rrs, err := parseZoneFile("abc.com", zone)
+	if err != nil || len(rrs) != 5 {
+		t.Fatalf("parseZoneFile should return all records, got %d (%v)", len(rrs), err)
+	}
+
+	c := config{stats: statsd.NoopClient{}, reloads: &reloadStatus{}}
+	c.reloads.run.Lock() // held like a reload, the cutover timer takes it too
+	if err := c.loadZones(map[string]string{"abc.com": zone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	m := testQuery(&c, "abc.com", "www.abc.com.", dns.TypeA)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Errorf("Expected the pre-cutover record, got %v", m.Answer)
+	}
+	if m := testQuery(&c, "abc.com", "old.abc.com.", dns.TypeA); len(m.Answer) != 0 {
+		t.Errorf("Expected the expired record not to be served, got %v", m.Answer)
+	}
+	c.reloads.run.Unlock()
+	time.Sleep(400 * time.Millisecond)
+	c.reloads.run.Lock()
+	m = testQuery(&c, "abc.com", "www.abc.com.", dns.TypeA)
+	c.reloads.run.Unlock()
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.0.1.1" {
+		t.Errorf("Expected the post-cutover record, got %v", m.Answer)
+	}
+}
@@ -0,0 +1,477 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With --secondary, neddns also serves zones it transfers by AXFR from primaries, as
+// a secondary of them, alongside the zones in the bucket, or alone with a bucket of
+// -. The list has a zone=primary entry per primary, an address with an optional
+// port, tried in the order given:
+//
+//	--secondary=abc.com=192.0.2.1,abc.com=198.51.100.7:5353,def.com=192.0.2.1
+//
+// The zone is transferred at startup, and its SOA timers are honored from then on:
+// every refresh interval the primaries' serials are checked, in order, and the zone
+// is transferred again from the first with a newer one. A NOTIFY for the zone from
+// one of its primaries checks at once. When no primary answers, they are tried
+// again every retry interval, and once none has for the expire interval the zone
+// stops being served until a transfer succeeds. Intervals are at least
+// secondaryMinInterval, and up to a secondaryJitter-th of the refresh and retry
+// intervals is taken off at random, so zones loaded together, and secondaries
+// started together, don't all ask their primaries at the same moment. SOA queries
+// and transfers are signed with --transfer-key if it is set, and a NOTIFY must then
+// be too. Keep secondary zones out of the bucket, or each reload of the bucket's
+// version replaces the transferred one.
+//
+// With --cache-file, each zone as transferred and its timers are saved on shutdown
+// and restored at startup (see restoreSecondaries), so a restart serves the zones
+// at once, checks them when they were due anyway rather than transferring them all
+// again, and doesn't restart the expire interval of a zone whose primaries are
+// down.
+const (
+	secondaryMinInterval = 30 * time.Second
+	secondaryTimeout     = 5 * time.Second
+	secondaryJitter      = 10
+	noBucket             = "-"
+)
+
+// emptyBucket stands in for the bucket when there is none
+type emptyBucket struct{}
+
+func (emptyBucket) ListZones() ([]zoneFile, error)            { return nil, nil }
+func (emptyBucket) GetZone(string) (io.ReadCloser, error)     { return nil, fmt.Errorf("no bucket") }
+func (emptyBucket) PutZone(key string, contents string) error { return fmt.Errorf("no bucket") }
+
+// secondaryZone is a zone served from its primaries rather than the bucket
+type secondaryZone struct {
+	name      string
+	primaries []string // address:port
+	loaded    bool     // served, with serial
+	serial    uint32
+	refresh   time.Duration
+	retry     time.Duration
+	expire    time.Duration
+	checked   time.Time // last time a primary answered
+	next      time.Time // when to check the primaries again
+	expires   time.Time // when to stop serving the zone if none answers
+	lastError string
+	text      string // the zone file as transferred, saved with --cache-file
+}
+
+type secondaries struct {
+	mu     sync.Mutex // guards the zones' fields and jitter
+	zones  map[string]*secondaryZone
+	wake   chan bool
+	random *rand.Rand
+}
+
+// savedSecondary is a secondary zone in the --cache-file
+type savedSecondary struct {
+	Serial  uint32        `json:"serial"`
+	Refresh time.Duration `json:"refresh"`
+	Retry   time.Duration `json:"retry"`
+	Expire  time.Duration `json:"expire"`
+	Checked time.Time     `json:"checked"`
+	Next    time.Time     `json:"next"`
+	Expires time.Time     `json:"expires"`
+	Zone    string        `json:"zone"`
+}
+
+// parseSecondaries reads --secondary
+func parseSecondaries(list string) (*secondaries, error) {
+	s := &secondaries{zones: map[string]*secondaryZone{}, wake: make(chan bool, 1), random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	for _, spec := range splitList(list) {
+		f := strings.SplitN(spec, "=", 2)
+		if len(f) != 2 || len(f[0]) == 0 || len(f[1]) == 0 {
+			return nil, fmt.Errorf("invalid --secondary entry %q: use zone=primary", spec)
+		}
+		n := strings.ToLower(strings.TrimSuffix(f[0], "."))
+		if _, ok := dns.IsDomainName(n); !ok {
+			return nil, fmt.Errorf("invalid --secondary entry %q: %s isn't a zone name", spec, f[0])
+		}
+		addr, err := serverAddr(f[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid --secondary entry %q: %s", spec, err.Error())
+		}
+		z, ok := s.zones[n]
+		if !ok {
+			z = &secondaryZone{name: n}
+			s.zones[n] = z
+		}
+		if !contains(z.primaries, addr) {
+			z.primaries = append(z.primaries, addr)
+		}
+	}
+	return s, nil
+}
+
+// serverAddr parses the address of another DNS server, an IP address with an
+// optional port, 53 by default
+func serverAddr(s string) (string, error) {
+	host, port := s, "53"
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		host, port = h, p
+	}
+	host = strings.Trim(host, "[]")
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("%s must be an IP address, with an optional port", s)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// serialNewer compares SOA serials with serial number arithmetic (RFC 1982)
+func serialNewer(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// jitter returns the interval d with up to a secondaryJitter-th of it taken off at
+// random. The caller holds s.mu.
+func (s *secondaries) jitter(d time.Duration) time.Duration {
+	return d - time.Duration(s.random.Int63n(int64(d)/secondaryJitter+1))
+}
+
+// isSecondary returns whether zone n is transferred from primaries
+func (s *secondaries) isSecondary(n string) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.zones[n]
+	return ok
+}
+
+// due returns the zones to check at now, and when the next one is due after that
+func (s *secondaries) due(now time.Time) ([]*secondaryZone, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	zones := []*secondaryZone{}
+	next := now.Add(secondaryMinInterval)
+	for _, z := range s.zones {
+		if !z.next.After(now) {
+			zones = append(zones, z)
+		} else if z.next.Before(next) {
+			next = z.next
+		}
+	}
+	sort.Sort(bySecondaryName(zones))
+	return zones, next
+}
+
+type bySecondaryName []*secondaryZone
+
+func (p bySecondaryName) Len() int           { return len(p) }
+func (p bySecondaryName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p bySecondaryName) Less(i, j int) bool { return p[i].name < p[j].name }
+
+// notified handles a NOTIFY for zone n from addr, returning false if it isn't one
+// of the zone's primaries
+func (s *secondaries) notified(n string, addr net.Addr) bool {
+	if s == nil {
+		return false
+	}
+	z, ok := s.zones[n]
+	if !ok {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, p := range z.primaries {
+		h, _, _ := net.SplitHostPort(p)
+		if ip != nil && ip.Equal(net.ParseIP(h)) {
+			s.mu.Lock()
+			z.next = time.Time{}
+			s.mu.Unlock()
+			select {
+			case s.wake <- true:
+			default:
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// secondaryNotify handles a NOTIFY from a primary of a secondary zone, signed with
+// --transfer-key if it is set, returning false for any other
+func (c *config) secondaryNotify(w dns.ResponseWriter, req *dns.Msg) bool {
+	if c.secondaries == nil || req.Question[0].Qtype != dns.TypeSOA {
+		return false
+	}
+	if len(c.transferKey) > 0 && c.tsigKeyName(w, req) != c.transferKey {
+		return false
+	}
+	n := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
+	return c.secondaries.notified(n, w.RemoteAddr())
+}
+
+// runSecondaries keeps the secondary zones up to date
+func (c *config) runSecondaries() {
+	for {
+		zones, next := c.secondaries.due(time.Now())
+		for _, z := range zones {
+			c.refreshSecondary(z, time.Now())
+		}
+		if len(zones) > 0 {
+			continue // recompute, checks take time
+		}
+		select {
+		case <-time.After(next.Sub(time.Now())):
+		case <-c.secondaries.wake:
+		}
+	}
+}
+
+// refreshSecondary checks the primaries of z, transferring and loading the zone if
+// one has a newer serial
+func (c *config) refreshSecondary(z *secondaryZone, now time.Time) error {
+	c.secondaries.mu.Lock()
+	loaded, serial := z.loaded, z.serial
+	c.secondaries.mu.Unlock()
+	var err error
+	for _, primary := range z.primaries {
+		var soa *dns.SOA
+		if soa, err = c.primarySerial(z.name, primary); err != nil {
+			continue
+		}
+		if loaded && !serialNewer(soa.Serial, serial) {
+			c.secondaryChecked(z, soa, now)
+			c.debug(fmt.Sprintf("Zone %s serial %d is current with %s", z.name, serial, primary))
+			return nil
+		}
+		var text string
+		if text, soa, err = c.transferZone(z.name, primary); err != nil {
+			continue
+		}
+		if err = c.loadSecondary(z.name, text); err != nil {
+			continue
+		}
+		c.secondaries.mu.Lock()
+		z.text = text
+		c.secondaries.mu.Unlock()
+		c.stats.Incr("secondary.transfer", 1)
+		log.Printf("Transferred zone %s serial %d from %s", z.name, soa.Serial, primary)
+		c.secondaryChecked(z, soa, now)
+		return nil
+	}
+	if err == nil {
+		err = fmt.Errorf("no primaries")
+	}
+	c.stats.Incr("secondary.error", 1)
+	log.Printf("Warning: refreshing secondary zone %s failed: %s", z.name, err.Error())
+	c.secondaries.mu.Lock()
+	z.lastError = err.Error()
+	retry := z.retry
+	if retry < secondaryMinInterval {
+		retry = secondaryMinInterval
+	}
+	z.next = now.Add(c.secondaries.jitter(retry))
+	expired := z.loaded && !now.Before(z.expires)
+	if expired {
+		z.loaded = false
+	}
+	c.secondaries.mu.Unlock()
+	if expired {
+		c.expireSecondary(z.name)
+	}
+	return err
+}
+
+// secondaryChecked records that a primary answered with soa at now
+func (c *config) secondaryChecked(z *secondaryZone, soa *dns.SOA, now time.Time) {
+	timer := func(secs uint32) time.Duration {
+		d := time.Duration(secs) * time.Second
+		if d < secondaryMinInterval {
+			d = secondaryMinInterval
+		}
+		return d
+	}
+	c.secondaries.mu.Lock()
+	defer c.secondaries.mu.Unlock()
+	z.loaded, z.serial = true, soa.Serial
+	z.refresh, z.retry, z.expire = timer(soa.Refresh), timer(soa.Retry), timer(soa.Expire)
+	z.checked, z.next, z.expires = now, now.Add(c.secondaries.jitter(z.refresh)), now.Add(z.expire)
+	z.lastError = ""
+}
+
+// primarySerial queries primary for the SOA of zone n
+func (c *config) primarySerial(n, primary string) (*dns.SOA, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(n), dns.TypeSOA)
+	client := &dns.Client{DialTimeout: secondaryTimeout, ReadTimeout: secondaryTimeout}
+	if k, ok := c.tsig[c.transferKey]; ok {
+		m.SetTsig(c.transferKey, k.algorithm, 300, time.Now().Unix())
+		client.TsigSecret = map[string]string{c.transferKey: k.secret}
+	}
+	r, _, err := client.Exchange(m, primary)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", primary, err.Error())
+	}
+	if r.Rcode != dns.RcodeSuccess || !r.Authoritative {
+		return nil, fmt.Errorf("%s isn't authoritative for %s (%s)", primary, n, dns.RcodeToString[r.Rcode])
+	}
+	for _, rr := range r.Answer {
+		if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, dns.Fqdn(n)) {
+			return soa, nil
+		}
+	}
+	return nil, fmt.Errorf("%s sent no SOA for %s", primary, n)
+}
+
+// transferZone transfers zone n from primary, returning it as a zone file and its SOA
+func (c *config) transferZone(n, primary string) (string, *dns.SOA, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(dns.Fqdn(n))
+	tr := &dns.Transfer{DialTimeout: secondaryTimeout, ReadTimeout: secondaryTimeout}
+	if k, ok := c.tsig[c.transferKey]; ok {
+		m.SetTsig(c.transferKey, k.algorithm, 300, time.Now().Unix())
+		tr.TsigSecret = map[string]string{c.transferKey: k.secret}
+	}
+	env, err := tr.In(m, primary)
+	if err != nil {
+		return "", nil, fmt.Errorf("AXFR from %s: %s", primary, err.Error())
+	}
+	rrs := []dns.RR{}
+	for e := range env {
+		if e.Error != nil {
+			err = e.Error
+			continue // drain the channel
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("AXFR from %s: %s", primary, err.Error())
+	}
+	if len(rrs) < 2 {
+		return "", nil, fmt.Errorf("AXFR from %s: empty transfer", primary)
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return "", nil, fmt.Errorf("AXFR from %s: doesn't start with the SOA", primary)
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "; zone %s transferred from %s\n", n, primary)
+	for _, rr := range rrs[:len(rrs)-1] { // it ends with the SOA again
+		b.WriteString(rr.String() + "\n")
+	}
+	return b.String(), soa, nil
+}
+
+// loadSecondary serves a transferred zone
+func (c *config) loadSecondary(n, text string) error {
+	if c.reloads != nil { // keep the update loop from reloading underneath us
+		c.reloads.run.Lock()
+		defer c.reloads.run.Unlock()
+	}
+	if err := c.loadZones(map[string]string{n: text}); err != nil {
+		return err
+	}
+	if _, ok := c.zones[n]; !ok {
+		return fmt.Errorf("zone %s didn't load", n)
+	}
+	return nil
+}
+
+// expireSecondary stops serving a zone no primary has answered for within its
+// expire interval
+func (c *config) expireSecondary(n string) {
+	if c.reloads != nil {
+		c.reloads.run.Lock()
+		defer c.reloads.run.Unlock()
+	}
+	if _, ok := c.zones[n]; !ok {
+		return
+	}
+	dns.HandleRemove(n)
+	delete(c.zones, n)
+	c.stats.Incr("secondary.expired", 1)
+	log.Printf("Warning: secondary zone %s expired, no primary answered for its expire interval", n)
+}
+
+// save returns the loaded zones and their timers for the --cache-file
+func (s *secondaries) save() map[string]savedSecondary {
+	saved := map[string]savedSecondary{}
+	if s == nil {
+		return saved
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for n, z := range s.zones {
+		if z.loaded && len(z.text) > 0 {
+			saved[n] = savedSecondary{Serial: z.serial, Refresh: z.refresh, Retry: z.retry, Expire: z.expire,
+				Checked: z.checked, Next: z.next, Expires: z.expires, Zone: z.text}
+		}
+	}
+	return saved
+}
+
+// restoreSecondaries serves the saved secondary zones that are still configured and
+// haven't expired at now, with the timers they had, returning how many it loaded.
+// The others are transferred at startup as usual.
+func (c *config) restoreSecondaries(saved map[string]savedSecondary, now time.Time) int {
+	if c.secondaries == nil {
+		return 0
+	}
+	restored := 0
+	for n, state := range saved {
+		z, ok := c.secondaries.zones[n]
+		if !ok || !now.Before(state.Expires) {
+			continue
+		}
+		if err := c.loadSecondary(n, state.Zone); err != nil {
+			log.Printf("Warning: could not restore secondary zone %s from the cache file, transferring it: %s", n, err.Error())
+			continue
+		}
+		c.secondaries.mu.Lock()
+		z.loaded, z.serial, z.text = true, state.Serial, state.Zone
+		z.refresh, z.retry, z.expire = state.Refresh, state.Retry, state.Expire
+		z.checked, z.next, z.expires = state.Checked, state.Next, state.Expires
+		c.secondaries.mu.Unlock()
+		restored++
+	}
+	return restored
+}
+
+// report describes the secondary zones for the admin API
+func (s *secondaries) report() []map[string]interface{} {
+	zones := []map[string]interface{}{}
+	if s == nil {
+		return zones
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := []*secondaryZone{}
+	for _, z := range s.zones {
+		all = append(all, z)
+	}
+	sort.Sort(bySecondaryName(all))
+	for _, z := range all {
+		r := map[string]interface{}{"zone": z.name, "primaries": z.primaries, "loaded": z.loaded}
+		if z.loaded {
+			r["serial"] = z.serial
+			r["checked"] = z.checked.UTC().Format(time.RFC3339)
+			r["expires"] = z.expires.UTC().Format(time.RFC3339)
+		}
+		if !z.next.IsZero() {
+			r["next_check"] = z.next.UTC().Format(time.RFC3339)
+		}
+		if len(z.lastError) > 0 {
+			r["error"] = z.lastError
+		}
+		zones = append(zones, r)
+	}
+	return zones
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// jittered reports whether next is interval d after from, less the jitter
+func jittered(next, from time.Time, d time.Duration) bool {
+	return !next.After(from.Add(d)) && !next.Before(from.Add(d-d/secondaryJitter))
+}
+
+func TestSecondary(t *testing.T) {
+	secZone := strings.Replace(abcZone, "abc.com", "sec.com", -1)
+	primary := config{stats: statsd.NoopClient{}}
+	var err error
+	if primary.tsig, err = primary.parseTSIGKeys("xfr=c2VjcmV0"); err != nil {
+		t.Fatalf("parseTSIGKeys failed: %s", err.Error())
+	}
+	policy := `{"allow_transfer": {"cidrs": ["127.0.0.1"], "tsig_keys": ["xfr"]}}`
+	if err := primary.loadZones(map[string]string{"sec.com": secZone, "sec.com.policy": policy}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	var transfers int32
+	var mu sync.Mutex                                                     // the primary changes the zone while serving it
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) { // the secondary registers sec.com on the default mux
+		if len(req.Question) != 1 {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if req.Question[0].Qtype == dns.TypeAXFR {
+			atomic.AddInt32(&transfers, 1)
+		}
+		if key := primary.tsigKeyName(w, req); len(key) > 0 {
+			w = &signingWriter{ResponseWriter: w, key: key, algorithm: primary.tsig[key].algorithm}
+		}
+		primary.zones["sec.com"].zoneHandler(&primary, w, req)
+	})
+	for _, network := range []string{"udp", "tcp"} {
+		started := make(chan bool)
+		server := &dns.Server{Addr: "127.0.0.1:25364", Net: network, Handler: handler, TsigSecret: primary.tsigSecrets(),
+			NotifyStartedFunc: func() { started <- true }}
+		go server.ListenAndServe()
+		<-started
+		defer server.Shutdown()
+	}
+
+	c := config{stats: statsd.NoopClient{}, transferKey: "xfr."}
+	c.tsig = primary.tsig
+	if c.secondaries, err = parseSecondaries("sec.com=127.0.0.1:25364"); err != nil {
+		t.Fatalf("parseSecondaries failed: %s", err.Error())
+	}
+	z := c.secondaries.zones["sec.com"]
+	now := time.Now()
+	if err := c.refreshSecondary(z, now); err != nil {
+		t.Fatalf("refreshSecondary failed: %s", err.Error())
+	}
+	if s, ok := c.zones["sec.com"]; !ok || s.serial() != 2014121700 || len(s.rrs) != len(primary.zones["sec.com"].rrs) {
+		t.Fatalf("Expected the zone to be transferred, got %v", c.zones["sec.com"])
+	}
+	if m := testQuery(&c, "sec.com", "sec.com.", dns.TypeMX); len(m.Answer) != 1 || !m.Authoritative {
+		t.Errorf("Expected the secondary to answer for the zone, got %v", m)
+	}
+	if !jittered(z.next, now, 10800*time.Second) || !z.expires.Equal(now.Add(864000*time.Second)) {
+		t.Errorf("Expected the SOA refresh and expire timers, got next %s expires %s", z.next, z.expires)
+	}
+
+	// the same serial isn't transferred again, a new one is
+	if err := c.refreshSecondary(z, now); err != nil || atomic.LoadInt32(&transfers) != 1 {
+		t.Errorf("Expected no transfer for the same serial, got %d transfers: %v", atomic.LoadInt32(&transfers), err)
+	}
+	mu.Lock()
+	err = primary.loadZones(map[string]string{"sec.com": strings.Replace(secZone, "2014121700", "2014121701", 1) + "new IN A 10.0.0.1\n"})
+	mu.Unlock()
+	if err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if err := c.refreshSecondary(z, now); err != nil || c.zones["sec.com"].serial() != 2014121701 {
+		t.Errorf("Expected the new serial to be transferred: %v", err)
+	}
+	if m := testQuery(&c, "sec.com", "new.sec.com.", dns.TypeA); len(m.Answer) != 1 {
+		t.Errorf("Expected the new record to be served, got %v", m)
+	}
+
+	// a restart with --cache-file serves the zone at once, with the same timers
+	b, err := json.Marshal(c.secondaries.save())
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err.Error())
+	}
+	saved := map[string]savedSecondary{}
+	if err := json.Unmarshal(b, &saved); err != nil {
+		t.Fatalf("Unmarshal failed: %s", err.Error())
+	}
+	restarted := config{stats: statsd.NoopClient{}}
+	restarted.secondaries, _ = parseSecondaries("sec.com=127.0.0.1:25364,other.com=127.0.0.1:25364")
+	if n := restarted.restoreSecondaries(saved, now.Add(time.Hour)); n != 1 || restarted.zones["sec.com"].serial() != 2014121701 {
+		t.Errorf("Expected the saved zone to be restored, got %d", n)
+	}
+	if r := restarted.secondaries.zones["sec.com"]; !r.loaded || !r.next.Equal(z.next) || !r.expires.Equal(z.expires) || r.refresh != z.refresh {
+		t.Errorf("Expected the saved timers to be restored, got next %s expires %s", r.next, r.expires)
+	}
+	if due, _ := restarted.secondaries.due(now.Add(time.Hour)); len(due) != 1 || due[0].name != "other.com" {
+		t.Errorf("Expected only the zone that wasn't saved to be due, got %v", due)
+	}
+	if n := (&config{stats: statsd.NoopClient{}, secondaries: restarted.secondaries}).restoreSecondaries(saved, z.expires); n != 0 {
+		t.Errorf("Expected a zone that expired while down not to be restored")
+	}
+
+	// a NOTIFY from the primary, signed with the transfer key, checks at once
+	notify := func(key string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetNotify("sec.com.")
+		if len(key) > 0 {
+			req.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		w := &testWriter{}
+		c.zones["sec.com"].zoneHandler(&c, w, req)
+		return w.msg
+	}
+	if m := notify(""); m.Rcode != dns.RcodeNotImplemented || z.next.IsZero() {
+		t.Errorf("Expected an unsigned NOTIFY to be ignored with --transfer-key, got %v", m)
+	}
+	if m := notify("xfr."); m.Rcode != dns.RcodeSuccess || !z.next.IsZero() {
+		t.Errorf("Expected a NOTIFY from the primary to schedule a check, got %v", m)
+	}
+	if due, _ := c.secondaries.due(now); len(due) != 1 {
+		t.Errorf("Expected the zone to be due after a NOTIFY")
+	}
+
+	// without an answer for the expire interval the zone stops being served
+	z.primaries = []string{"127.0.0.1:25362"}
+	if err := c.refreshSecondary(z, now); err == nil || c.zones["sec.com"] == nil || !jittered(z.next, now, 1200*time.Second) {
+		t.Errorf("Expected a failed check to retry after the SOA retry interval and keep serving, got %v next %s", err, z.next)
+	}
+	if err := c.refreshSecondary(z, z.expires); err == nil || c.zones["sec.com"] != nil || z.loaded {
+		t.Errorf("Expected the zone to expire")
+	}
+
+	for _, bad := range []string{"sec.com", "sec.com=ns1.example.com", "=192.0.2.1", "bad..name=192.0.2.1"} {
+		if _, err := parseSecondaries(bad); err == nil {
+			t.Errorf("Expected an error for --secondary %s", bad)
+		}
+	}
+	if s, err := parseSecondaries("a.com=192.0.2.1,a.com=[2001:db8::1]:5353,b.com=192.0.2.1"); err != nil || len(s.zones) != 2 || len(s.zones["a.com"].primaries) != 2 {
+		t.Errorf("Expected primaries grouped by zone, got %v %v", s, err)
+	}
+	if addr, err := serverAddr("[2001:db8::1]"); err != nil || addr != "[2001:db8::1]:53" {
+		t.Errorf("Expected the default port, got %s %v", addr, err)
+	}
+	if !serialNewer(1, 4294967295) || serialNewer(2014121700, 2014121700) || serialNewer(5, 6) {
+		t.Errorf("Expected serial number arithmetic")
+	}
+}
@@ -0,0 +1,214 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secret options (such as --api-token) take the value itself, or a reference that is
+// resolved at startup and every --secret-refresh seconds, keeping the secret out of
+// flags and environment dumps:
+//
+//	ssm:///neddns/api-token              SSM Parameter Store, decrypting SecureStrings
+//	secretsmanager://neddns-api          Secrets Manager, the secret string
+//	secretsmanager://neddns-api#token    a key of a JSON secret string
+//
+// Both are called with the -K/-S credentials in --region. A failed refresh keeps the
+// last value.
+type secret struct {
+	ref   string
+	mu    sync.RWMutex
+	value string
+}
+
+func isSecretRef(ref string) bool {
+	return strings.HasPrefix(ref, "ssm://") || strings.HasPrefix(ref, "secretsmanager://")
+}
+
+// newSecret resolves ref, registering it for refreshes if it is a reference.
+func (c *config) newSecret(ref string) (*secret, error) {
+	s := &secret{ref: ref, value: ref}
+	if !isSecretRef(ref) {
+		return s, nil
+	}
+	value, err := c.resolveSecret(ref)
+	if err != nil {
+		return nil, fmt.Errorf("Error resolving secret %s: %s", ref, err.Error())
+	}
+	s.value = value
+	c.secrets = append(c.secrets, s)
+	return s, nil
+}
+
+func (s *secret) get() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.value
+}
+
+// refreshSecrets resolves every secret reference again
+func (c *config) refreshSecrets() {
+	for _, s := range c.secrets {
+		value, err := c.resolveSecret(s.ref)
+		if err != nil {
+			c.stats.Incr("secrets.error", 1)
+			log.Printf("Warning: could not refresh secret %s, keeping the current value: %s", s.ref, err.Error())
+			continue
+		}
+		s.mu.Lock()
+		changed := s.value != value
+		s.value = value
+		s.mu.Unlock()
+		if changed {
+			c.stats.Incr("secrets.changed", 1)
+			log.Printf("Secret %s changed", s.ref)
+		}
+	}
+}
+
+// resolveSecret fetches the non-empty value of a reference.
+func (c *config) resolveSecret(ref string) (string, error) {
+	value, err := c.fetchSecret(ref)
+	if err == nil && len(value) == 0 {
+		err = fmt.Errorf("secret is empty")
+	}
+	return value, err
+}
+
+// fetchSecret fetches the value of a reference. Names are taken as is rather than
+// parsed as URLs, since secret ARNs contain colons.
+func (c *config) fetchSecret(ref string) (string, error) {
+	if name := strings.TrimPrefix(ref, "ssm://"); name != ref { // ssm:///path/name or ssm://name
+		var resp struct {
+			Parameter struct{ Value string }
+		}
+		err := c.callAWS("ssm", "AmazonSSM.GetParameter", map[string]interface{}{"Name": name, "WithDecryption": true}, &resp)
+		return resp.Parameter.Value, err
+	}
+	if id := strings.TrimPrefix(ref, "secretsmanager://"); id != ref {
+		key := ""
+		if i := strings.LastIndex(id, "#"); i >= 0 {
+			id, key = id[:i], id[i+1:]
+		}
+		var resp struct{ SecretString string }
+		if err := c.callAWS("secretsmanager", "secretsmanager.GetSecretValue", map[string]string{"SecretId": id}, &resp); err != nil {
+			return "", err
+		}
+		if len(key) == 0 {
+			return resp.SecretString, nil
+		}
+		values := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(resp.SecretString), &values); err != nil {
+			return "", fmt.Errorf("secret %s is not a JSON object: %s", id, err.Error())
+		}
+		value, ok := values[key].(string)
+		if !ok {
+			return "", fmt.Errorf("secret %s has no string key %q", id, key)
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("unsupported secret reference %s", ref)
+}
+
+// callAWS makes a JSON API call, such as SSM's, signed with the configured keys
+func (c *config) callAWS(service, target string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	endpoint := c.awsEndpoint
+	if len(endpoint) == 0 {
+		endpoint = fmt.Sprintf("https://%s.%s.amazonaws.com/", service, c.region)
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+	if token := os.Getenv("AWS_SESSION_TOKEN"); len(token) > 0 {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	signV4(req, body, service, c.region, c.awsKeyId, c.awsSecret, time.Now())
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string
+		}
+		json.Unmarshal(b, &e)
+		return fmt.Errorf("%s %s: %s %s", target, resp.Status, e.Type, e.Message)
+	}
+	return json.Unmarshal(b, out)
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header covering the host and
+// every header already set on req.
+func signV4(req *http.Request, body []byte, service, region, keyID, secretKey string, now time.Time) {
+	stamp := now.UTC().Format("20060102T150405Z")
+	day := stamp[:8]
+	req.Header.Set("X-Amz-Date", stamp)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := []string{}
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signed := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if len(path) == 0 {
+		path = "/"
+	}
+	canonical := strings.Join([]string{req.Method, path, req.URL.Query().Encode(), canonicalHeaders, signed, sha256Hex(body)}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+	key := []byte("AWS4" + secretKey)
+	for _, s := range []string{day, region, service, "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		keyID, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/quipo/statsd"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignV4(t *testing.T) {
+	// get-vanilla from the AWS Signature Version 4 test suite
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	signV4(req, nil, "service", "us-east-1", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("signV4:\nwant: %s\ngot:  %s", want, got)
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	values := map[string]string{"/neddns/token": "ssm-token", "neddns-api": `{"token": "sm-token"}`}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		in := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&in)
+		switch r.Header.Get("X-Amz-Target") {
+		case "AmazonSSM.GetParameter":
+			if v, ok := values[in["Name"].(string)]; ok && in["WithDecryption"] == true {
+				json.NewEncoder(w).Encode(map[string]interface{}{"Parameter": map[string]string{"Value": v}})
+				return
+			}
+		case "secretsmanager.GetSecretValue":
+			if v, ok := values[in["SecretId"].(string)]; ok {
+				json.NewEncoder(w).Encode(map[string]string{"SecretString": v})
+				return
+			}
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type": "ResourceNotFoundException", "message": "not found"}`))
+	}))
+	defer srv.Close()
+	c := config{stats: statsd.NoopClient{}, region: "us-east-1", awsKeyId: "AKID", awsSecret: "secret", awsEndpoint: srv.URL}
+
+	for ref, want := range map[string]string{
+		"plain-token":                       "plain-token",
+		"ssm:///neddns/token":               "ssm-token",
+		"secretsmanager://neddns-api#token": "sm-token",
+		"secretsmanager://neddns-api":       `{"token": "sm-token"}`,
+	} {
+		s, err := c.newSecret(ref)
+		if err != nil || s.get() != want {
+			t.Errorf("newSecret(%s): want: %s, got: %v %v", ref, want, s, err)
+		}
+	}
+	if len(c.secrets) != 3 {
+		t.Fatalf("Expected the three references to be refreshed, got %d", len(c.secrets))
+	}
+	refs := map[string]*secret{}
+	for _, s := range c.secrets {
+		refs[s.ref] = s
+	}
+	for _, ref := range []string{"ssm://missing", "secretsmanager://neddns-api#missing"} {
+		if _, err := c.newSecret(ref); err == nil {
+			t.Errorf("Expected %s to fail", ref)
+		}
+	}
+
+	values["/neddns/token"] = "rotated"
+	delete(values, "neddns-api")
+	c.refreshSecrets()
+	if v := refs["ssm:///neddns/token"].get(); v != "rotated" {
+		t.Errorf("Expected the SSM secret to be refreshed, got %s", v)
+	}
+	if v := refs["secretsmanager://neddns-api#token"].get(); v != "sm-token" {
+		t.Errorf("Expected a failed refresh to keep the old value, got %s", v)
+	}
+
+	c.apiToken = refs["ssm:///neddns/token"]
+	handler := c.apiHandler(nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /version without a token: want: %d, got: %d", http.StatusUnauthorized, w.Code)
+	}
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/version", nil)
+	r.Header.Set("Authorization", "Bearer rotated")
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("GET /version with the token: want: %d, got: %d", http.StatusOK, w.Code)
+	}
+}
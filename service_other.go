@@ -0,0 +1,21 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+)
+
+func runService(doUpdate chan bool) bool {
+	return false
+}
+
+func installService(args []string) error {
+	return fmt.Errorf("install-service is only supported on Windows")
+}
+
+func removeService() error {
+	return fmt.Errorf("remove-service is only supported on Windows")
+}
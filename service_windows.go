@@ -0,0 +1,96 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+	"log"
+	"os"
+)
+
+const serviceName = "neddns"
+
+// windowsService answers the service control manager while main serves DNS
+type windowsService struct {
+	doUpdate chan bool
+}
+
+func (s *windowsService) Execute(args []string, r <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange}
+	for req := range r {
+		switch req.Cmd {
+		case svc.Interrogate:
+			status <- req.CurrentStatus
+		case svc.ParamChange: // sc.exe control neddns paramchange
+			requestReload(s.doUpdate)
+		case svc.Stop, svc.Shutdown:
+			log.Printf("Service stop requested, stopping")
+			status <- svc.Status{State: svc.StopPending}
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+// runService blocks until the service is stopped when started by the service
+// control manager, and returns false straight away when run from a console.
+func runService(doUpdate chan bool) bool {
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		log.Fatalf("Error detecting service session: %s", err.Error())
+	}
+	if interactive {
+		return false
+	}
+	if err := svc.Run(serviceName, &windowsService{doUpdate: doUpdate}); err != nil {
+		log.Fatalf("Service failed: %s", err.Error())
+	}
+	return true
+}
+
+// installService registers this executable as an automatic service started with args
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("Service %s already exists, run remove-service first", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "NedDNS",
+		Description: "Authoritative DNS server backed by S3",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	log.Printf("Installed service %s: %s %v", serviceName, exe, args)
+	return nil
+}
+
+func removeService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("Service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	log.Printf("Removed service %s", serviceName)
+	return nil
+}
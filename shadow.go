@@ -0,0 +1,296 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Before a zone's NS records move to neddns, shadow reads check that it answers like
+// the provider it replaces. Production queries mirrored to the --shadow address, by
+// a tee such as iptables' TEE target or a port mirror relayed over UDP, are answered
+// by neddns without the answer being sent anywhere, and sent on to --shadow-compare,
+// the legacy provider's nameserver. The rcodes and answer records of the two replies
+// are compared regardless of order and case, with differences only in TTLs told
+// apart; the authority and additional sections are not, since SOA serials and glue
+// legitimately differ. Results are counted by shadow.match, shadow.mismatch and
+// shadow.error, logged every shadowReport, and listed by zone with the latest
+// mismatches by GET /shadow. Replies in the feed are ignored, and queries arriving
+// faster than the legacy provider answers are dropped (shadow.dropped) rather than
+// queued. Mirrored queries are answered like any other, so the query metrics count
+// them too.
+const (
+	shadowWorkers = 16
+	shadowQueue   = 1000
+	shadowSamples = 20 // latest mismatches kept per zone
+	shadowReport  = 5 * time.Minute
+	shadowTimeout = 2 * time.Second
+)
+
+// shadowQuery is a mirrored query and the client that sent it
+type shadowQuery struct {
+	req  *dns.Msg
+	from net.Addr
+}
+
+// shadowStats are the comparisons for one zone
+type shadowStats struct {
+	Queries    int64            `json:"queries"`
+	Matched    int64            `json:"matched"`
+	Mismatched map[string]int64 `json:"mismatched"` // by kind: rcode, answer, ttl or noreply
+	Errors     int64            `json:"errors"`     // the legacy provider didn't answer
+	Latest     []shadowMismatch `json:"latest"`
+}
+
+// shadowMismatch is a query the two replies differed for
+type shadowMismatch struct {
+	Time   string   `json:"time"`
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Kind   string   `json:"kind"`
+	Ours   []string `json:"ours"`
+	Theirs []string `json:"theirs"`
+}
+
+type shadowRead struct {
+	compare string // the legacy nameserver
+	queries chan shadowQuery
+	mu      sync.Mutex // guards the fields below
+	zones   map[string]*shadowStats
+	total   int64 // compared at the last report
+	differ  int64 // mismatched at the last report
+}
+
+func newShadowRead(compare string) *shadowRead {
+	return &shadowRead{compare: compare, queries: make(chan shadowQuery, shadowQueue), zones: map[string]*shadowStats{}}
+}
+
+// shadowWriter keeps our reply to a mirrored query, from the client that sent it
+type shadowWriter struct {
+	captureWriter
+	from net.Addr
+}
+
+func (w *shadowWriter) RemoteAddr() net.Addr { return w.from }
+
+// startShadow listens for mirrored queries on addr
+func (c *config) startShadow(addr string) error {
+	conn, err := c.bindUDP(addr)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < shadowWorkers; i++ {
+		go func() {
+			for q := range c.shadow.queries {
+				c.shadowCompare(q.req, q.from, time.Now())
+			}
+		}()
+	}
+	go c.readShadow(conn)
+	go func() {
+		for range time.Tick(shadowReport) {
+			c.shadow.logReport()
+		}
+	}()
+	log.Printf("Shadow reads from UDP %s compared with %s", conn.LocalAddr().String(), c.shadow.compare)
+	return nil
+}
+
+// readShadow queues the mirrored queries read from conn
+func (c *config) readShadow(conn net.PacketConn) {
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			c.listenerFailed("shadow", err)
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(buf[:n]); err != nil || req.Response || req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+			continue // replies in the feed, and queries we wouldn't answer either
+		}
+		select {
+		case c.shadow.queries <- shadowQuery{req, from}:
+		default:
+			c.stats.Incr("shadow.dropped", 1)
+		}
+	}
+}
+
+// shadowCompare answers req as if from the client from, asks the legacy provider,
+// and records whether the replies match, returning the kind of mismatch, "" if they
+// do and "error" if the legacy provider didn't answer
+func (c *config) shadowCompare(req *dns.Msg, from net.Addr, now time.Time) string {
+	w := &shadowWriter{from: from}
+	dns.DefaultServeMux.ServeDNS(w, req.Copy())
+	theirs, err := c.shadow.exchange(req)
+	q := req.Question[0]
+	s := c.shadow.stats(c.shadowZone(q.Name))
+	c.shadow.mu.Lock()
+	defer c.shadow.mu.Unlock()
+	s.Queries++
+	if err != nil {
+		s.Errors++
+		c.stats.Incr("shadow.error", 1)
+		c.debug(fmt.Sprintf("Shadow read of %s %s: %s didn't answer: %s", q.Name, dns.Type(q.Qtype).String(), c.shadow.compare, err.Error()))
+		return "error"
+	}
+	kind := compareReplies(w.msg, theirs)
+	if len(kind) == 0 {
+		s.Matched++
+		c.stats.Incr("shadow.match", 1)
+		return ""
+	}
+	s.Mismatched[kind]++
+	c.stats.Incr("shadow.mismatch", 1)
+	s.Latest = append(s.Latest, shadowMismatch{Time: now.UTC().Format(time.RFC3339), Name: q.Name, Type: dns.Type(q.Qtype).String(),
+		Kind: kind, Ours: describeReply(w.msg), Theirs: describeReply(theirs)})
+	if len(s.Latest) > shadowSamples {
+		s.Latest = s.Latest[len(s.Latest)-shadowSamples:]
+	}
+	return kind
+}
+
+// exchange sends a mirrored query to the legacy provider, over TCP if the UDP reply
+// is truncated
+func (s *shadowRead) exchange(req *dns.Msg) (*dns.Msg, error) {
+	m := req.Copy()
+	m.Id = dns.Id()
+	client := &dns.Client{DialTimeout: shadowTimeout, ReadTimeout: shadowTimeout}
+	r, _, err := client.Exchange(m, s.compare)
+	if err == nil && r.Truncated {
+		client.Net = "tcp"
+		r, _, err = client.Exchange(m, s.compare)
+	}
+	return r, err
+}
+
+// shadowZone returns the zone a name is in, "" if we don't serve it
+func (c *config) shadowZone(name string) string {
+	if c.reloads != nil {
+		c.reloads.run.Lock()
+		defer c.reloads.run.Unlock()
+	}
+	match := ""
+	for n := range c.zones {
+		if dns.IsSubDomain(dns.Fqdn(n), name) && len(n) > len(match) {
+			match = n
+		}
+	}
+	return match
+}
+
+// stats returns the comparisons for zone n
+func (s *shadowRead) stats(n string) *shadowStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.zones[n]
+	if !ok {
+		st = &shadowStats{Mismatched: map[string]int64{}, Latest: []shadowMismatch{}}
+		s.zones[n] = st
+	}
+	return st
+}
+
+// compareReplies returns how our reply to a query differs from theirs, "" if it
+// doesn't
+func compareReplies(ours, theirs *dns.Msg) string {
+	if ours == nil {
+		return "noreply"
+	}
+	if ours.Rcode != theirs.Rcode {
+		return "rcode"
+	}
+	if fmt.Sprint(answerSet(ours, false)) != fmt.Sprint(answerSet(theirs, false)) {
+		return "answer"
+	}
+	if fmt.Sprint(answerSet(ours, true)) != fmt.Sprint(answerSet(theirs, true)) {
+		return "ttl"
+	}
+	return ""
+}
+
+// answerSet returns the answer records of m in a canonical order, lower cased,
+// with or without their TTLs
+func answerSet(m *dns.Msg, ttl bool) []string {
+	set := []string{}
+	for _, rr := range m.Answer {
+		rr = dns.Copy(rr)
+		if !ttl {
+			rr.Header().Ttl = 0
+		}
+		set = append(set, strings.ToLower(rr.String()))
+	}
+	sort.Strings(set)
+	return set
+}
+
+// describeReply describes a reply as its rcode followed by the answer records
+func describeReply(m *dns.Msg) []string {
+	if m == nil {
+		return []string{"(NO REPLY)"}
+	}
+	out := []string{dns.RcodeToString[m.Rcode]}
+	for _, rr := range m.Answer {
+		out = append(out, rr.String())
+	}
+	return out
+}
+
+// report describes the comparisons so far for the admin API
+func (s *shadowRead) report() map[string]interface{} {
+	if s == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	zones := map[string]shadowStats{}
+	var compared, mismatched int64
+	for n, st := range s.zones {
+		if len(n) == 0 {
+			n = "(not served)"
+		}
+		copied := *st
+		copied.Mismatched = map[string]int64{}
+		for k, v := range st.Mismatched {
+			copied.Mismatched[k] = v
+			mismatched += v
+		}
+		copied.Latest = append([]shadowMismatch{}, st.Latest...)
+		zones[n] = copied
+		compared += st.Queries - st.Errors
+	}
+	return map[string]interface{}{"enabled": true, "compare": s.compare, "compared": compared, "mismatched": mismatched,
+		"mismatch_rate": shadowRate(mismatched, compared), "zones": zones}
+}
+
+// logReport logs the mismatch rate since the last report
+func (s *shadowRead) logReport() {
+	s.mu.Lock()
+	var total, differ int64
+	for _, st := range s.zones {
+		total += st.Queries - st.Errors
+		for _, v := range st.Mismatched {
+			differ += v
+		}
+	}
+	compared, mismatched := total-s.total, differ-s.differ
+	s.total, s.differ = total, differ
+	s.mu.Unlock()
+	if compared > 0 {
+		log.Printf("Shadow reads: %d of %d queries answered differently from %s (%.2f%%)", mismatched, compared, s.compare, 100*shadowRate(mismatched, compared))
+	}
+}
+
+func shadowRate(n, of int64) float64 {
+	if of == 0 {
+		return 0
+	}
+	return float64(n) / float64(of)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShadowRead(t *testing.T) {
+	legacy := config{stats: statsd.NoopClient{}}
+	err := legacy.loadZones(map[string]string{"abc.com": abcZone + "api IN A 10.0.0.9\nftp IN A 10.0.0.2\nttl 60 IN A 10.0.0.3\n"})
+	if err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	legacyZone := legacy.zones["abc.com"]
+	c := config{stats: statsd.NoopClient{}, shadow: newShadowRead("127.0.0.1:25365")}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone + "ftp IN A 10.0.0.1\nttl IN A 10.0.0.3\n"}); err != nil { // the default mux now routes to ours
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	started := make(chan bool)
+	server := &dns.Server{Addr: "127.0.0.1:25365", Net: "udp", NotifyStartedFunc: func() { started <- true },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			if len(req.Question) != 1 {
+				return
+			}
+			if req.Question[0].Name == "down.abc.com." {
+				m := new(dns.Msg)
+				w.WriteMsg(m.SetRcode(req, dns.RcodeServerFailure))
+				return
+			}
+			legacyZone.zoneHandler(&legacy, w, req)
+		})}
+	go server.ListenAndServe()
+	<-started
+	defer server.Shutdown()
+
+	from := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	for _, q := range []struct {
+		name string
+		kind string
+	}{
+		{"abc.com.", ""},
+		{"WWW.abc.com.", ""},
+		{"api.abc.com.", "rcode"}, // NXDOMAIN here
+		{"down.abc.com.", "rcode"},
+		{"ftp.abc.com.", "answer"},
+		{"ttl.abc.com.", "ttl"},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(q.name, dns.TypeA)
+		if kind := c.shadowCompare(req, from, time.Now()); kind != q.kind {
+			t.Errorf("Shadow read of %s: want %q, got %q", q.name, q.kind, kind)
+		}
+	}
+	report := c.shadow.report()
+	zones := report["zones"].(map[string]shadowStats)
+	s := zones["abc.com"]
+	if report["compared"].(int64) != 6 || report["mismatched"].(int64) != 4 || s.Matched != 2 || s.Mismatched["rcode"] != 2 || len(s.Latest) != 4 {
+		t.Errorf("Expected 4 of 6 queries to mismatch, got %v", report)
+	}
+	if m := s.Latest[2]; m.Name != "ftp.abc.com." || m.Kind != "answer" || len(m.Ours) != 2 || len(m.Theirs) != 2 {
+		t.Errorf("Expected the mismatched answers to be kept, got %+v", m)
+	}
+
+	c.shadow.compare = "127.0.0.1:25362" // nothing answers
+	req := new(dns.Msg)
+	req.SetQuestion("abc.com.", dns.TypeA)
+	if kind := c.shadowCompare(req, from, time.Now()); kind != "error" || c.shadow.report()["compared"].(int64) != 6 {
+		t.Errorf("Expected an unanswered query to count as an error only, got %q", kind)
+	}
+	req.SetQuestion("abc.org.", dns.TypeA)
+	c.shadowCompare(req, from, time.Now())
+	if _, ok := c.shadow.report()["zones"].(map[string]shadowStats)["(not served)"]; !ok {
+		t.Errorf("Expected queries for zones we don't serve to be reported apart")
+	}
+}
@@ -0,0 +1,62 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Under overload we shed load in steps rather than degrading unpredictably:
+//
+//   - shedDegraded: past --shed-inflight queries in flight or --shed-latency average
+//     latency, stop the expensive work (root CNAME flattening and forwarding get
+//     SERVFAIL, and ANY queries are dropped).
+//   - shedDrop: past twice either threshold, also drop every query that can't be
+//     answered from the hot cache.
+const (
+	shedNone = iota
+	shedDegraded
+	shedDrop
+)
+
+// loadShedder tracks in-flight queries and their average latency
+type loadShedder struct {
+	inflight    int64
+	latency     int64 // moving average, in nanoseconds
+	level       int32
+	maxInflight int64         // 0 to disable
+	maxLatency  time.Duration // 0 to disable
+}
+
+// shedBegin counts a query in flight, returning the shedding level to apply to it and a
+// func to call when it is done. It is nil-safe.
+func (c *config) shedBegin() (int, func()) {
+	s := c.shed
+	if s == nil {
+		return shedNone, func() {}
+	}
+	n := atomic.AddInt64(&s.inflight, 1)
+	level := shedNone
+	avg := time.Duration(atomic.LoadInt64(&s.latency))
+	switch {
+	case (s.maxInflight > 0 && n > 2*s.maxInflight) || (s.maxLatency > 0 && avg > 2*s.maxLatency):
+		level = shedDrop
+	case (s.maxInflight > 0 && n > s.maxInflight) || (s.maxLatency > 0 && avg > s.maxLatency):
+		level = shedDegraded
+	}
+	if old := atomic.SwapInt32(&s.level, int32(level)); int(old) != level {
+		c.stats.Gauge("shed.level", int64(level))
+	}
+	start := time.Now()
+	return level, func() {
+		atomic.AddInt64(&s.inflight, -1)
+		// lossy under contention, which is fine for an average
+		old := atomic.LoadInt64(&s.latency)
+		atomic.StoreInt64(&s.latency, old-old/16+int64(time.Since(start))/16)
+	}
+}
+
+// shedQuery counts a query dropped or failed by load shedding
+func (c *config) shedQuery(reason string) {
+	c.stats.Incr("shed."+reason, 1)
+}
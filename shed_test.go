@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"testing"
+	"time"
+)
+
+func TestShedLevels(t *testing.T) {
+	c := &config{stats: statsd.NoopClient{}}
+	if level, done := c.shedBegin(); level != shedNone {
+		t.Errorf("Expected no shedding without a shedder, got %d", level)
+	} else {
+		done()
+	}
+
+	c.shed = &loadShedder{maxInflight: 2}
+	levels := []int{}
+	dones := []func(){}
+	for i := 0; i < 5; i++ {
+		level, done := c.shedBegin()
+		levels = append(levels, level)
+		dones = append(dones, done)
+	}
+	want := []int{shedNone, shedNone, shedDegraded, shedDegraded, shedDrop}
+	for i := range want {
+		if levels[i] != want[i] {
+			t.Errorf("Expected levels %v, got %v", want, levels)
+			break
+		}
+	}
+	for _, done := range dones {
+		done()
+	}
+	if level, done := c.shedBegin(); level != shedNone {
+		t.Errorf("Expected shedding to stop once queries finish, got %d", level)
+	} else {
+		done()
+	}
+
+	c.shed = &loadShedder{maxLatency: 10 * time.Millisecond, latency: int64(15 * time.Millisecond)}
+	if level, done := c.shedBegin(); level != shedDegraded {
+		t.Errorf("Expected shedding on latency, got %d", level)
+	} else {
+		done()
+	}
+	c.shed.latency = int64(25 * time.Millisecond)
+	if level, done := c.shedBegin(); level != shedDrop {
+		t.Errorf("Expected dropping on latency, got %d", level)
+	} else {
+		done()
+	}
+}
+
+func TestShedQueries(t *testing.T) {
+	c := &config{stats: statsd.NoopClient{}}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone, "flat.com": flatZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	c.shed = &loadShedder{maxInflight: 1, inflight: 1} // every query is the second in flight
+	if r := testQuery(c, "abc.com", "abc.com.", dns.TypeANY); r != nil {
+		t.Errorf("Expected ANY to be dropped, got %s", r)
+	}
+	if r := testQuery(c, "abc.com", "abc.com.", dns.TypeMX); r == nil || len(r.Answer) != 1 {
+		t.Errorf("Expected MX to be answered, got %s", r)
+	}
+	if r := testQuery(c, "flat.com", "flat.com.", dns.TypeA); r == nil || r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected SERVFAIL instead of flattening, got %s", r)
+	}
+
+	c.shed.inflight = 2
+	if r := testQuery(c, "abc.com", "abc.com.", dns.TypeMX); r != nil {
+		t.Errorf("Expected MX to be dropped, got %s", r)
+	}
+	if c.shed.inflight != 2 {
+		t.Errorf("Expected in-flight queries to be released, got %d", c.shed.inflight)
+	}
+}
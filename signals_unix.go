@@ -0,0 +1,24 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifySignals relays the reload (HUP), upgrade (USR2) and stop signals to sig
+func notifySignals(sig chan os.Signal) {
+	signal.Notify(sig, syscall.SIGHUP, syscall.SIGUSR2, syscall.SIGINT, syscall.SIGTERM)
+}
+
+func isReloadSignal(s os.Signal) bool {
+	return s == syscall.SIGHUP
+}
+
+func isUpgradeSignal(s os.Signal) bool {
+	return s == syscall.SIGUSR2
+}
@@ -0,0 +1,23 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"os"
+	"os/signal"
+)
+
+// notifySignals relays Ctrl-C to sig. Windows has no SIGHUP, so reload through
+// the admin API (POST /reload) or the service "paramchange" control instead.
+func notifySignals(sig chan os.Signal) {
+	signal.Notify(sig, os.Interrupt)
+}
+
+func isReloadSignal(s os.Signal) bool {
+	return false
+}
+
+// isUpgradeSignal is always false, as Windows can't pass sockets to a new process
+// the way upgrade does; restart the service instead.
+func isUpgradeSignal(s os.Signal) bool {
+	return false
+}
@@ -0,0 +1,299 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signing is always counted: dnssec.signatures.ksk and dnssec.signatures.zsk for
+// signatures made signing a zone, dnssec.online for those made as answers are served
+// and dnssec.sign.error for failures. With --sign-audit=<mins> it is audited too:
+// each signing of a zone is logged with its serial, keys and signature count, the
+// signatures each key made are kept by zone, and that often every zone serving
+// signatures is validated the way a resolver would, against the DNSKEYs it serves.
+// A signature that doesn't validate, has expired or covers records that are no
+// longer served, or a ZSK that can no longer sign, fails the self-check: it is
+// logged, counted by dnssec.selfcheck.failed and sent to the --alert-hooks, so a
+// broken key is found before resolvers start answering SERVFAIL. GET /dnssec on the
+// admin API reports the key usage and the last self-check of each zone.
+type signAudit struct {
+	every time.Duration
+
+	mu     sync.Mutex
+	keys   map[string]*keyUsage  // by zone and key tag
+	checks map[string]*selfCheck // by zone, or zone and view
+}
+
+// keyUsage is the signatures one key of a zone made since startup
+type keyUsage struct {
+	Zone       string    `json:"zone"`
+	KeyTag     uint16    `json:"key_tag"`
+	Role       string    `json:"role"` // ksk, zsk, or csk for a zone with one key pair
+	Algorithm  string    `json:"algorithm"`
+	Signatures int64     `json:"signatures"` // signing the zone
+	Online     int64     `json:"online"`     // as answers were served
+	Errors     int64     `json:"errors"`
+	LastUsed   time.Time `json:"last_used"`
+}
+
+// selfCheck is the result of validating the signatures a zone serves
+type selfCheck struct {
+	Zone     string    `json:"zone"`
+	View     string    `json:"view,omitempty"`
+	Serial   uint32    `json:"serial"`
+	Checked  time.Time `json:"checked"`
+	RRsets   int       `json:"rrsets"`
+	Failures []string  `json:"failures,omitempty"`
+}
+
+// selfCheckLimit caps the failures kept and logged for a zone
+const selfCheckLimit = 10
+
+func newSignAudit(every time.Duration) *signAudit {
+	return &signAudit{every: every, keys: map[string]*keyUsage{}, checks: map[string]*selfCheck{}}
+}
+
+// role returns what k signs in the zone
+func (keys *zoneKeys) role(k *dnssecKey) string {
+	switch {
+	case keys.ksk == keys.zsk:
+		return "csk"
+	case k == keys.ksk:
+		return "ksk"
+	}
+	return "zsk"
+}
+
+// used records signatures made by key k of zone n. It is nil-safe.
+func (a *signAudit) used(n string, keys *zoneKeys, k *dnssecKey, signatures, online, errors int64, now time.Time) {
+	if a == nil {
+		return
+	}
+	tag := k.dnskey.KeyTag()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	id := fmt.Sprintf("%s/%d", n, tag)
+	u := a.keys[id]
+	if u == nil {
+		u = &keyUsage{Zone: n, KeyTag: tag, Role: keys.role(k), Algorithm: dns.AlgorithmToString[k.dnskey.Algorithm]}
+		a.keys[id] = u
+	}
+	u.Signatures += signatures
+	u.Online += online
+	u.Errors += errors
+	u.LastUsed = now
+}
+
+// auditSigned counts the signatures made signing z, and logs them with --sign-audit
+func (c *config) auditSigned(z *zone) {
+	ksk, zsk := int64(0), int64(0)
+	for k := range z.sigs {
+		if kskTypes[k.qtype] && z.keys.ksk != z.keys.zsk {
+			ksk++
+		} else {
+			zsk++
+		}
+	}
+	c.stats.Incr("dnssec.signatures.ksk", ksk)
+	c.stats.Incr("dnssec.signatures.zsk", zsk)
+	if c.signAudit == nil {
+		return
+	}
+	now := time.Now()
+	if ksk > 0 {
+		c.signAudit.used(z.name, z.keys, z.keys.ksk, ksk, 0, 0, now)
+	}
+	c.signAudit.used(z.name, z.keys, z.keys.zsk, zsk, 0, 0, now)
+	log.Printf("Signing audit: zone %s%s serial %d signed with KSK %d and ZSK %d (%s), %d signatures valid until %s",
+		z.name, viewSuffix(z.view), z.serial(), z.keys.ksk.dnskey.KeyTag(), z.keys.zsk.dnskey.KeyTag(),
+		dns.AlgorithmToString[z.keys.zsk.dnskey.Algorithm], ksk+zsk, z.sigExpires.UTC().Format(time.RFC3339))
+}
+
+// viewSuffix names a view in log messages
+func viewSuffix(view string) string {
+	if len(view) == 0 {
+		return ""
+	}
+	return " view " + view
+}
+
+// checkSignatures validates the signatures z serves at now, returning the number of
+// RRsets checked and what failed
+func (z *zone) checkSignatures(now time.Time) (int, []string) {
+	apex := dns.Fqdn(z.name)
+	dnskeys := map[uint16]*dns.DNSKEY{}
+	sets := map[hotKey][]dns.RR{}
+	for _, rr := range z.rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG {
+			continue
+		}
+		if k, ok := rr.(*dns.DNSKEY); ok && strings.EqualFold(h.Name, apex) {
+			dnskeys[k.KeyTag()] = k
+		}
+		k := hotKey{strings.ToLower(h.Name), h.Rrtype}
+		sets[k] = append(sets[k], rr)
+	}
+	failures := []string{}
+	order := []hotKey{}
+	for k := range z.sigs {
+		order = append(order, k)
+	}
+	sort.Sort(byHotKey(order))
+	checked := 0
+	for _, k := range order {
+		name := k.name + " " + dns.Type(k.qtype).String()
+		set, ok := sets[k]
+		if !ok || rrsetContents(set) != z.sigs[k].contents {
+			if z.keys != nil {
+				failures = append(failures, name+": signed records are no longer served")
+			}
+			continue // pre-signed RRsets changed as they are served go unsigned
+		}
+		checked++
+		for _, rr := range z.sigs[k].sigs {
+			sig := rr.(*dns.RRSIG)
+			key := dnskeys[sig.KeyTag]
+			switch {
+			case key == nil:
+				failures = append(failures, fmt.Sprintf("%s: signed with key %d, which isn't in the DNSKEY set", name, sig.KeyTag))
+			case !sig.ValidityPeriod(now):
+				failures = append(failures, fmt.Sprintf("%s: signature by key %d is valid from %s until %s", name, sig.KeyTag,
+					dns.TimeToString(sig.Inception), dns.TimeToString(sig.Expiration)))
+			default:
+				if err := sig.Verify(key, set); err != nil {
+					failures = append(failures, fmt.Sprintf("%s: signature by key %d doesn't validate: %s", name, sig.KeyTag, err.Error()))
+				}
+			}
+		}
+	}
+	if z.keys != nil {
+		// answers outside the zone file are signed with the ZSK as they are served
+		soa := sets[hotKey{strings.ToLower(apex), dns.TypeSOA}]
+		sig, err := z.keys.zsk.sign(soa, now.Add(-sigBackdate), now.Add(sigValidity), apex)
+		if err == nil {
+			err = sig.Verify(z.keys.zsk.dnskey, soa)
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("ZSK %d can't sign answers: %s", z.keys.zsk.dnskey.KeyTag(), err.Error()))
+		}
+		if left := z.sigExpires.Sub(now); left < sigRefresh-2*rolloverCheck {
+			failures = append(failures, fmt.Sprintf("signatures weren't refreshed and expire in %s", left))
+		}
+	}
+	return checked, failures
+}
+
+// auditSignatures validates the zones' signatures every --sign-audit, until the
+// process exits
+func (c *config) auditSignatures() {
+	for range time.Tick(c.signAudit.every) {
+		c.selfCheckSignatures(time.Now())
+	}
+}
+
+// selfCheckSignatures validates the signatures of every zone and view serving any,
+// returning the number of zones that failed
+func (c *config) selfCheckSignatures(now time.Time) int {
+	zones := []*zone{}
+	func() {
+		if c.reloads != nil {
+			c.reloads.run.Lock()
+			defer c.reloads.run.Unlock()
+		}
+		for _, z := range c.zones {
+			if z.sigs != nil {
+				zones = append(zones, z)
+			}
+		}
+		if c.views != nil {
+			c.views.mu.RLock()
+			defer c.views.mu.RUnlock()
+			for _, byView := range c.views.zones {
+				for _, z := range byView {
+					if z.sigs != nil {
+						zones = append(zones, z)
+					}
+				}
+			}
+		}
+	}()
+	failed := 0
+	for _, z := range zones {
+		rrsets, failures := z.checkSignatures(now)
+		check := &selfCheck{Zone: z.name, View: z.view, Serial: z.serial(), Checked: now, RRsets: rrsets}
+		if len(failures) > selfCheckLimit {
+			failures = append(failures[:selfCheckLimit], fmt.Sprintf("and %d more", len(failures)-selfCheckLimit))
+		}
+		if len(failures) == 0 {
+			c.stats.Incr("dnssec.selfcheck.ok", 1)
+			c.debug(fmt.Sprintf("DNSSEC self-check of zone %s%s: %d RRsets validate", z.name, viewSuffix(z.view), rrsets))
+		} else {
+			failed++
+			check.Failures = failures
+			c.stats.Incr("dnssec.selfcheck.failed", 1)
+			for _, f := range failures {
+				log.Printf("DNSSEC self-check of zone %s%s failed: %s", z.name, viewSuffix(z.view), f)
+			}
+			c.alerts.alert(c, alertSigning, z.name, fmt.Sprintf("DNSSEC self-check of zone %s failed: %s", z.name, failures[0]))
+		}
+		if c.signAudit != nil {
+			c.signAudit.mu.Lock()
+			c.signAudit.checks[z.name+viewSuffix(z.view)] = check
+			c.signAudit.mu.Unlock()
+		}
+	}
+	if c.signAudit != nil {
+		c.signAudit.mu.Lock()
+		for _, u := range c.signAudit.keys {
+			log.Printf("Signing audit: zone %s %s %d (%s) made %d signatures, %d online, %d errors", u.Zone, strings.ToUpper(u.Role), u.KeyTag, u.Algorithm, u.Signatures, u.Online, u.Errors)
+		}
+		c.signAudit.mu.Unlock()
+	}
+	return failed
+}
+
+// report returns the key usage and last self-checks, sorted by zone
+func (a *signAudit) report() map[string]interface{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	keys := []*keyUsage{}
+	for _, u := range a.keys {
+		keys = append(keys, u)
+	}
+	sort.Sort(byKeyUsage(keys))
+	checks := []*selfCheck{}
+	for _, s := range a.checks {
+		checks = append(checks, s)
+	}
+	sort.Sort(bySelfCheck(checks))
+	return map[string]interface{}{"keys": keys, "self_checks": checks}
+}
+
+type byKeyUsage []*keyUsage
+
+func (u byKeyUsage) Len() int      { return len(u) }
+func (u byKeyUsage) Swap(i, j int) { u[i], u[j] = u[j], u[i] }
+func (u byKeyUsage) Less(i, j int) bool {
+	if u[i].Zone != u[j].Zone {
+		return u[i].Zone < u[j].Zone
+	}
+	return u[i].KeyTag < u[j].KeyTag
+}
+
+type bySelfCheck []*selfCheck
+
+func (s bySelfCheck) Len() int      { return len(s) }
+func (s bySelfCheck) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s bySelfCheck) Less(i, j int) bool {
+	if s[i].Zone != s[j].Zone {
+		return s[i].Zone < s[j].Zone
+	}
+	return s[i].View < s[j].View
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignAudit(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, signAudit: newSignAudit(time.Hour)}
+	if err := c.loadZones(testSignedZones(t)); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	now := time.Now()
+	if n := c.selfCheckSignatures(now); n != 0 {
+		t.Fatalf("Expected the signed zone to validate, got %v", c.signAudit.checks["abc.com"])
+	}
+	if check := c.signAudit.checks["abc.com"]; check == nil || check.RRsets < 5 || check.Serial != c.zones["abc.com"].serial() {
+		t.Errorf("Expected a self-check of the zone, got %v", check)
+	}
+
+	z := c.zones["abc.com"]
+	m := new(dns.Msg)
+	m.SetQuestion("new.abc.com.", dns.TypeA)
+	rr, _ := dns.NewRR("new.abc.com. 300 IN A 10.0.0.1")
+	m.Answer = []dns.RR{rr}
+	z.addSignatures(&c, m)
+	report := c.signAudit.report()
+	keys := report["keys"].([]*keyUsage)
+	if len(keys) != 2 {
+		t.Fatalf("Expected usage of the KSK and ZSK, got %v", keys)
+	}
+	for _, u := range keys {
+		switch {
+		case u.Role == "ksk" && (u.KeyTag != z.keys.ksk.dnskey.KeyTag() || u.Signatures != 3 || u.Online != 0):
+			t.Errorf("Expected the KSK to sign the DNSKEY, CDS and CDNSKEY sets, got %+v", u)
+		case u.Role == "zsk" && (u.KeyTag != z.keys.zsk.dnskey.KeyTag() || u.Signatures < 5 || u.Online != 1 || u.Algorithm != "ECDSAP256SHA256"):
+			t.Errorf("Expected the ZSK to sign the rest and the online answer, got %+v", u)
+		}
+	}
+
+	// a signature that no longer validates
+	broken := *z
+	broken.sigs = map[hotKey]signedRRset{}
+	for k, s := range z.sigs {
+		broken.sigs[k] = s
+	}
+	k := hotKey{"www.abc.com.", dns.TypeCNAME}
+	sig := *broken.sigs[k].sigs[0].(*dns.RRSIG)
+	sig.Signature = strings.Repeat("A", len(sig.Signature)-4) + "AAA="
+	broken.sigs[k] = signedRRset{contents: broken.sigs[k].contents, sigs: []dns.RR{&sig}}
+	if _, failures := broken.checkSignatures(now); len(failures) != 1 || !strings.Contains(failures[0], "www.abc.com. CNAME: signature by key") {
+		t.Errorf("Expected the bad signature to fail the self-check, got %v", failures)
+	}
+
+	// signatures that were never refreshed
+	if _, failures := z.checkSignatures(now.Add(sigValidity + time.Hour)); len(failures) < 2 || !strings.Contains(failures[len(failures)-1], "weren't refreshed") {
+		t.Errorf("Expected expired signatures to fail the self-check, got %v", failures)
+	}
+	c.zones["abc.com"] = &broken
+	if n := c.selfCheckSignatures(now); n != 1 || len(c.signAudit.checks["abc.com"].Failures) != 1 {
+		t.Errorf("Expected the self-check failure to be recorded, got %v", c.signAudit.checks["abc.com"])
+	}
+
+	// a zone signed before it was uploaded is validated against its own DNSKEYs
+	signed := []string{}
+	for _, rr := range z.rrs {
+		signed = append(signed, rr.String())
+	}
+	presigned := config{stats: statsd.NoopClient{}, signAudit: newSignAudit(time.Hour)}
+	if err := presigned.loadZones(map[string]string{"abc.com": strings.Join(signed, "\n") + "\n"}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if n := presigned.selfCheckSignatures(now); n != 0 || presigned.signAudit.checks["abc.com"].RRsets < 5 {
+		t.Errorf("Expected the pre-signed zone to validate, got %v", presigned.signAudit.checks["abc.com"])
+	}
+}
@@ -0,0 +1,170 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// answerChange is one (qname, qtype) whose answer differs between zone versions
+type answerChange struct {
+	name    string
+	qtype   uint16
+	removed []string
+	added   []string
+}
+
+type byQuestion []answerChange
+
+func (p byQuestion) Len() int      { return len(p) }
+func (p byQuestion) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byQuestion) Less(i, j int) bool {
+	if p[i].name != p[j].name {
+		return p[i].name < p[j].name
+	}
+	return p[i].qtype < p[j].qtype
+}
+
+// simulateDiff compares the answers served by two versions of a zone, each a local
+// file or s3://bucket/key[?versionId=id], printing every changed answer. It returns
+// the number of changes.
+func (c *config) simulateDiff(oldSrc, newSrc string) (int, error) {
+	name := sourceZoneName(newSrc)
+	oldZone, err := c.loadSource(name, oldSrc)
+	if err != nil {
+		return 0, err
+	}
+	newZone, err := c.loadSource(name, newSrc)
+	if err != nil {
+		return 0, err
+	}
+	changes := diffAnswers(c, oldZone, newZone)
+	for _, ch := range changes {
+		fmt.Printf("%s %s\n", ch.name, dns.Type(ch.qtype).String())
+		for _, rr := range ch.removed {
+			fmt.Printf("  - %s\n", rr)
+		}
+		for _, rr := range ch.added {
+			fmt.Printf("  + %s\n", rr)
+		}
+	}
+	fmt.Printf("%d answers changed in zone %s\n", len(changes), name)
+	return len(changes), nil
+}
+
+// sourceZoneName names the zone after the file or object, like bucket keys.
+func sourceZoneName(src string) string {
+	if u, err := url.Parse(src); err == nil && u.Scheme == "s3" {
+		return path.Base(u.Path)
+	}
+	return path.Base(strings.Replace(src, "\\", "/", -1))
+}
+
+func (c *config) loadSource(name, src string) (*zone, error) {
+	var r io.ReadCloser
+	var err error
+	if u, perr := url.Parse(src); perr == nil && u.Scheme == "s3" {
+		r, err = s3getter{region: c.region, bucket: u.Host}.GetZoneVersion(strings.TrimPrefix(u.Path, "/"), u.Query().Get("versionId"))
+	} else {
+		f, ferr := os.Open(src)
+		r, err = f, ferr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", src, err.Error())
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", src, err.Error())
+	}
+	rrs, scheduled, err := parseZone(name, string(b))
+	if err != nil {
+		return nil, err
+	}
+	z := &zone{name: name, base: rrs, scheduled: scheduled}
+	z.rrs, _ = z.activeRRs(time.Now())
+	return z, nil
+}
+
+// diffAnswers queries both zones for every name and type either contains. Flattened
+// root CNAMEs are compared by their CNAME rather than asking the resolver.
+func diffAnswers(c *config, oldZone, newZone *zone) []answerChange {
+	questions := map[hotKey]bool{}
+	for _, z := range []*zone{oldZone, newZone} {
+		for _, rr := range z.rrs {
+			h := rr.Header()
+			questions[hotKey{h.Name, h.Rrtype}] = true
+			if h.Rrtype == dns.TypeCNAME { // CNAMEs are also returned for A queries
+				questions[hotKey{h.Name, dns.TypeA}] = true
+			}
+		}
+	}
+	changes := []answerChange{}
+	for q := range questions {
+		before := simulatedAnswer(c, oldZone, q)
+		after := simulatedAnswer(c, newZone, q)
+		ch := answerChange{name: q.name, qtype: q.qtype}
+		for rr := range before {
+			if !after[rr] {
+				ch.removed = append(ch.removed, rr)
+			}
+		}
+		for rr := range after {
+			if !before[rr] {
+				ch.added = append(ch.added, rr)
+			}
+		}
+		if len(ch.removed) > 0 || len(ch.added) > 0 {
+			sort.Strings(ch.removed)
+			sort.Strings(ch.added)
+			changes = append(changes, ch)
+		}
+	}
+	sort.Sort(byQuestion(changes))
+	return changes
+}
+
+func simulatedAnswer(c *config, z *zone, q hotKey) map[string]bool {
+	answers := map[string]bool{}
+	if q.qtype == dns.TypeA && q.name == dns.Fqdn(z.name) && z.hasApexCNAME() {
+		for _, rr := range z.rrs {
+			if rr.Header().Rrtype == dns.TypeCNAME && rr.Header().Name == q.name {
+				answers["(FLAT) "+rr.String()] = true
+			}
+		}
+		return answers
+	}
+	rrs, _, _ := z.answer(c, dns.Question{Name: q.name, Qtype: q.qtype, Qclass: dns.ClassINET})
+	for _, rr := range rrs {
+		answers[rr.String()] = true
+	}
+	return answers
+}
+
+// GetZoneVersion fetches a specific version of an object from a versioned bucket,
+// or the current version if version is empty.
+func (s s3getter) GetZoneVersion(key, version string) (io.ReadCloser, error) {
+	connection := s3.New(&aws.Config{Region: aws.String(s.region)})
+	q := s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if len(version) > 0 {
+		q.VersionId = aws.String(version)
+	}
+	o, err := connection.GetObject(&q)
+	if err != nil {
+		return nil, err
+	}
+	return o.Body, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSimulateDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "neddns-simulate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldFile := filepath.Join(dir, "old", "abc.com")
+	newFile := filepath.Join(dir, "abc.com")
+	os.Mkdir(filepath.Dir(oldFile), 0755)
+	ioutil.WriteFile(oldFile, []byte(abcZone), 0644)
+	changed := strings.Replace(abcZone, "127.0.0.1", "127.0.0.2", 1) + "ftp\t\tIN\tCNAME\twww.abc.com.\n"
+	changed = strings.Replace(changed, "        \tIN      NS      nsb.abc.com.\n", "", 1)
+	ioutil.WriteFile(newFile, []byte(changed), 0644)
+
+	c := config{stats: statsd.NoopClient{}}
+	oldZone, err := c.loadSource(sourceZoneName(newFile), oldFile)
+	if err != nil {
+		t.Fatalf("loadSource failed: %s", err.Error())
+	}
+	newZone, err := c.loadSource(sourceZoneName(newFile), newFile)
+	if err != nil {
+		t.Fatalf("loadSource failed: %s", err.Error())
+	}
+	changes := diffAnswers(&c, oldZone, newZone)
+	want := []hotKey{
+		{"abc.com.", dns.TypeA},
+		{"abc.com.", dns.TypeNS},
+		{"ftp.abc.com.", dns.TypeA},
+		{"ftp.abc.com.", dns.TypeCNAME},
+		{"www.abc.com.", dns.TypeA}, // its CNAME is followed to the apex
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("Expected %d changes, got %d: %v", len(want), len(changes), changes)
+	}
+	for i, w := range want {
+		if changes[i].name != w.name || changes[i].qtype != w.qtype {
+			t.Errorf("Expected change %d to be %s %s, got %s %s", i, w.name, dns.TypeToString[w.qtype], changes[i].name, dns.TypeToString[changes[i].qtype])
+		}
+	}
+	if a := changes[0]; len(a.removed) != 1 || len(a.added) != 1 || !strings.HasSuffix(a.added[0], "127.0.0.2") {
+		t.Errorf("Expected abc.com A to change to 127.0.0.2, got %v", a)
+	}
+	if ns := changes[1]; len(ns.removed) != 1 || len(ns.added) != 0 {
+		t.Errorf("Expected one NS record removed, got %v", ns)
+	}
+	if ftp := changes[2]; len(ftp.added) != 3 || !strings.HasSuffix(ftp.added[0], "127.0.0.2") {
+		t.Errorf("Expected ftp.abc.com A to follow its CNAME chain to the apex, got %v", ftp)
+	}
+	if n, err := c.simulateDiff(newFile, newFile); err != nil || n != 0 {
+		t.Errorf("Expected no changes between identical files, got %d (%v)", n, err)
+	}
+}
+
+func TestSourceZoneName(t *testing.T) {
+	for src, want := range map[string]string{
+		"zones/abc.com":                          "abc.com",
+		"s3://bucket/prefix/abc.com?versionId=3": "abc.com",
+		"s3://bucket/abc.com":                    "abc.com",
+	} {
+		if got := sourceZoneName(src); got != want {
+			t.Errorf("sourceZoneName(%s): want: %s, got: %s", src, want, got)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// --soa-mname and --soa-rname replace the primary nameserver and contact of every
+// zone's SOA as it is served, so zones imported from another provider point at this
+// deployment without editing each zone file.
+
+// parseSOAName reads --soa-mname or --soa-rname. The contact may be given as an
+// email address, ops@abc.com, which becomes the mailbox name ops.abc.com.
+func parseSOAName(flag, arg string, mailbox bool) (string, error) {
+	name := arg
+	if i := strings.LastIndex(arg, "@"); mailbox && i >= 0 {
+		name = strings.Replace(arg[:i], ".", "\\.", -1) + "." + arg[i+1:]
+	}
+	name = dns.Fqdn(strings.ToLower(name))
+	if _, ok := dns.IsDomainName(name); !ok || strings.ContainsAny(name, " @") || name == "." {
+		return "", fmt.Errorf("invalid --%s %q: not a domain name", flag, arg)
+	}
+	return name, nil
+}
+
+// rewriteSOA replaces the zone's SOA MNAME and RNAME with the configured ones. The
+// SOA is copied, as z.rrs may share records with the zone as loaded.
+func (c *config) rewriteSOA(z *zone) {
+	if len(c.soaMname) == 0 && len(c.soaRname) == 0 {
+		return
+	}
+	rrs := make([]dns.RR, len(z.rrs))
+	copy(rrs, z.rrs)
+	for i, rr := range rrs {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		soa = dns.Copy(soa).(*dns.SOA)
+		if len(c.soaMname) > 0 {
+			soa.Ns = c.soaMname
+		}
+		if len(c.soaRname) > 0 {
+			soa.Mbox = c.soaRname
+		}
+		rrs[i] = soa
+	}
+	z.rrs = rrs
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"testing"
+)
+
+func TestParseSOAName(t *testing.T) {
+	for _, tc := range []struct {
+		arg     string
+		mailbox bool
+		want    string
+	}{
+		{"ns1.example.net", false, "ns1.example.net."},
+		{"hostmaster.example.net.", true, "hostmaster.example.net."},
+		{"Ops@Example.net", true, "ops.example.net."},
+		{"dns.ops@example.net", true, "dns\\.ops.example.net."},
+	} {
+		if got, err := parseSOAName("soa-rname", tc.arg, tc.mailbox); err != nil || got != tc.want {
+			t.Errorf("parseSOAName(%s): want: %s, got: %s %v", tc.arg, tc.want, got, err)
+		}
+	}
+	for _, bad := range []string{"ops@example.net", "bad name", "."} {
+		if _, err := parseSOAName("soa-mname", bad, false); err == nil {
+			t.Errorf("Expected --soa-mname %q to be refused", bad)
+		}
+	}
+}
+
+func TestRewriteSOA(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, soaMname: "ns1.example.net.", soaRname: "ops.example.net."}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	r := testQuery(&c, "abc.com", "abc.com.", dns.TypeSOA)
+	if len(r.Answer) != 1 {
+		t.Fatalf("Expected an SOA answer, got %v", r)
+	}
+	if soa := r.Answer[0].(*dns.SOA); soa.Ns != "ns1.example.net." || soa.Mbox != "ops.example.net." || soa.Serial != 2014121700 {
+		t.Errorf("Expected the SOA names to be rewritten, got %s", soa)
+	}
+	for _, rr := range c.zones["abc.com"].base {
+		if soa, ok := rr.(*dns.SOA); ok && soa.Ns != "nsa.abc.com." {
+			t.Errorf("Expected the zone as loaded to keep its SOA, got %s", soa)
+		}
+	}
+}
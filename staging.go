@@ -0,0 +1,251 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Zones whose policy sets "staged": true deploy in two phases. A new version from
+// the bucket is loaded into a staging view instead of going live; clients in
+// --admin-cidrs get answers from it while everyone else keeps the production
+// version. Once it checks out (with dig from an admin network or the admin API's
+// verify call), promoting it swaps it into production. A zone's first load, such as
+// at startup, always goes live since there is nothing to protect.
+type stagedZone struct {
+	zone   zone  // as loaded, registered as is on promotion
+	view   *zone // with scheduled records and policy applied, for serving
+	staged time.Time
+}
+
+// stagedZones holds the staging views; handlers read it while reloads replace views.
+type stagedZones struct {
+	mu    sync.RWMutex
+	zones map[string]*stagedZone
+}
+
+func (s *stagedZones) get(name string) *stagedZone {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.zones[name]
+}
+
+// take removes and returns a zone's staging view, if any
+func (s *stagedZones) take(name string) *stagedZone {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sz := s.zones[name]
+	delete(s.zones, name)
+	return sz
+}
+
+// stageZone loads z into its staging view, replacing any version staged before.
+func (c *config) stageZone(z *zone) {
+	if c.staging == nil {
+		c.staging = &stagedZones{}
+	}
+	view := *z
+	if len(view.scheduled) > 0 {
+		view.rrs, _ = view.activeRRs(time.Now())
+	}
+	c.applyPolicy(&view)
+	c.staging.mu.Lock()
+	if c.staging.zones == nil {
+		c.staging.zones = map[string]*stagedZone{}
+	}
+	c.staging.zones[z.name] = &stagedZone{zone: *z, view: &view, staged: time.Now()}
+	c.staging.mu.Unlock()
+	c.stats.Incr("staging.staged", 1)
+	log.Printf("Zone %s staged with %d records, promote it with the admin API", z.name, len(view.rrs))
+}
+
+// promoteZone puts a zone's staging view into production.
+func (c *config) promoteZone(name string) error {
+	if c.reloads != nil {
+		c.reloads.run.Lock()
+		defer c.reloads.run.Unlock()
+	}
+	sz := c.staging.take(name)
+	if sz == nil {
+		return fmt.Errorf("zone %s has no staged version", name)
+	}
+	z := sz.zone
+	c.registerZone(&z)
+	c.stats.Incr("staging.promoted", 1)
+	log.Printf("Zone %s promoted from staging, now serving %d records", name, len(z.rrs))
+	return nil
+}
+
+// discardZone drops a zone's staging view, returning false if it had none.
+func (c *config) discardZone(name string) bool {
+	if c.staging.take(name) == nil {
+		return false
+	}
+	c.stats.Incr("staging.discarded", 1)
+	log.Printf("Zone %s staged version discarded", name)
+	return true
+}
+
+// stagedView returns the staging view of a zone if the client may see it.
+func (c *config) stagedView(name string, w dns.ResponseWriter) *zone {
+	if len(c.adminNets) == 0 {
+		return nil
+	}
+	sz := c.staging.get(name)
+	if sz == nil || !c.isAdmin(w) {
+		return nil
+	}
+	return sz.view
+}
+
+// isAdmin reports whether a query comes from --admin-cidrs.
+func (c *config) isAdmin(w dns.ResponseWriter) bool {
+	ip := remoteIP(w)
+	for _, n := range c.adminNets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs reads a comma separated list of networks or addresses, such as --admin-cidrs.
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, s := range splitList(list) {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a network or address", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// stagingStatus describes a staged zone for the admin API
+type stagingStatus struct {
+	Zone       string `json:"zone"`
+	Staged     string `json:"staged"`
+	Records    int    `json:"records"`
+	Production int    `json:"production_records"`
+}
+
+func (c *config) stagingList() []stagingStatus {
+	if c.reloads != nil {
+		c.reloads.run.Lock()
+		defer c.reloads.run.Unlock()
+	}
+	list := []stagingStatus{}
+	if c.staging == nil {
+		return list
+	}
+	c.staging.mu.RLock()
+	defer c.staging.mu.RUnlock()
+	for name, sz := range c.staging.zones {
+		s := stagingStatus{Zone: name, Staged: sz.staged.Format(time.RFC3339), Records: len(sz.view.rrs)}
+		if z, ok := c.zones[name]; ok {
+			s.Production = len(z.rrs)
+		}
+		list = append(list, s)
+	}
+	sort.Sort(byStagedZone(list))
+	return list
+}
+
+type byStagedZone []stagingStatus
+
+func (p byStagedZone) Len() int           { return len(p) }
+func (p byStagedZone) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byStagedZone) Less(i, j int) bool { return p[i].Zone < p[j].Zone }
+
+// stagedQuery is a query for the verify call, with its answers from both versions
+type stagedQuery struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Staged     []string `json:"staged"`
+	Production []string `json:"production"`
+	Changed    bool     `json:"changed"`
+}
+
+// verifyStaged runs queries through the query handler of both versions of a zone,
+// as a client would see them, and diffs every answer either version holds.
+func (c *config) verifyStaged(name string, queries []stagedQuery) (map[string]interface{}, error) {
+	if c.reloads != nil {
+		c.reloads.run.Lock()
+		defer c.reloads.run.Unlock()
+	}
+	sz := c.staging.get(name)
+	prod, ok := c.zones[name]
+	if sz == nil || !ok {
+		return nil, fmt.Errorf("zone %s has no staged version", name)
+	}
+	for i, q := range queries {
+		qtype, ok := dns.StringToType[q.Type]
+		if !ok {
+			return nil, fmt.Errorf("query %s: unknown type %q", q.Name, q.Type)
+		}
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(q.Name), qtype)
+		queries[i].Name = req.Question[0].Name
+		queries[i].Staged = captureAnswer(c, sz.view, req)
+		queries[i].Production = captureAnswer(c, prod, req)
+		queries[i].Changed = fmt.Sprint(queries[i].Staged) != fmt.Sprint(queries[i].Production)
+	}
+	changes := []map[string]interface{}{}
+	for _, ch := range diffAnswers(c, prod, sz.view) {
+		changes = append(changes, map[string]interface{}{"name": ch.name, "type": dns.Type(ch.qtype).String(), "removed": ch.removed, "added": ch.added})
+	}
+	c.stats.Incr("staging.verified", 1)
+	return map[string]interface{}{"zone": name, "queries": queries, "changes": changes}, nil
+}
+
+// captureAnswer answers req from z as the handler would, describing the reply as
+// its rcode followed by the answer records.
+func captureAnswer(c *config, z *zone, req *dns.Msg) []string {
+	w := &captureWriter{}
+	z.zoneHandler(c, w, req)
+	if w.msg == nil {
+		return []string{"(NO REPLY)"}
+	}
+	out := []string{dns.RcodeToString[w.msg.Rcode]}
+	for _, rr := range w.msg.Answer {
+		out = append(out, rr.String())
+	}
+	return out
+}
+
+// captureWriter keeps the reply to a query run from the admin API
+type captureWriter struct {
+	msg *dns.Msg
+}
+
+func (w *captureWriter) LocalAddr() net.Addr       { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (w *captureWriter) RemoteAddr() net.Addr      { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (w *captureWriter) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+func (w *captureWriter) Close() error              { return nil }
+func (w *captureWriter) TsigStatus() error         { return nil }
+func (w *captureWriter) TsigTimersOnly(bool)       {}
+func (w *captureWriter) Hijack()                   {}
+func (w *captureWriter) Write(b []byte) (int, error) { // hot answers are written packed
+	w.msg = new(dns.Msg)
+	return len(b), w.msg.Unpack(b)
+}
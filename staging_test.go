@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func stagedQueryA(name string) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	w := &testWriter{}
+	dns.DefaultServeMux.ServeDNS(w, req)
+	return w.msg
+}
+
+func TestStaging(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, reloads: &reloadStatus{}, staging: &stagedZones{}}
+	staged := `{"staged": true}`
+	if err := c.loadZones(map[string]string{"abc.com": abcZone, "abc.com.policy": staged}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if len(c.stagingList()) != 0 {
+		t.Fatalf("Expected the first load of a staged zone to go live")
+	}
+	if err := c.loadZones(map[string]string{"abc.com": strings.Replace(abcZone, "127.0.0.1", "127.0.0.9", 1)}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if list := c.stagingList(); len(list) != 1 || list[0].Zone != "abc.com" {
+		t.Fatalf("Expected abc.com to be staged, got %v", list)
+	}
+
+	if r := stagedQueryA("abc.com."); r == nil || r.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+		t.Errorf("Expected production answers without --admin-cidrs, got %v", r)
+	}
+	if c.adminNets, _ = parseCIDRs("10.0.0.0/8,127.0.0.1"); len(c.adminNets) != 2 {
+		t.Fatalf("Expected two admin networks, got %v", c.adminNets)
+	}
+	if r := stagedQueryA("abc.com."); r == nil || r.Answer[0].(*dns.A).A.String() != "127.0.0.9" {
+		t.Errorf("Expected staged answers for an admin client, got %v", r)
+	}
+	c.adminNets, _ = parseCIDRs("10.0.0.0/8")
+	if r := stagedQueryA("abc.com."); r == nil || r.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+		t.Errorf("Expected production answers for other clients, got %v", r)
+	}
+	if _, err := parseCIDRs("10.0.0.0/33"); err == nil {
+		t.Errorf("Expected an invalid network to be refused")
+	}
+
+	handler := c.apiHandler(nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/staging/abc.com/verify", strings.NewReader(`[{"name": "abc.com", "type": "A"}, {"name": "abc.com", "type": "MX"}]`)))
+	result := struct {
+		Queries []stagedQuery            `json:"queries"`
+		Changes []map[string]interface{} `json:"changes"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("POST /staging/abc.com/verify: want: %d with JSON, got: %d %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if len(result.Queries) != 2 || !result.Queries[0].Changed || result.Queries[1].Changed {
+		t.Errorf("Expected only the A answer to change, got %v", result.Queries)
+	}
+	if len(result.Changes) != 2 || result.Changes[0]["name"] != "abc.com." || result.Changes[1]["name"] != "www.abc.com." || result.Changes[1]["type"] != "A" {
+		t.Errorf("Expected the apex A answer to change, and www's through its CNAME, got %v", result.Changes)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/staging/abc.com/verify", strings.NewReader(`[{"name": "abc.com", "type": "BOGUS"}]`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown type to be refused, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/staging/abc.com/promote", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /staging/abc.com/promote: want: %d, got: %d %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	c.adminNets = nil
+	if r := stagedQueryA("abc.com."); r == nil || r.Answer[0].(*dns.A).A.String() != "127.0.0.9" {
+		t.Errorf("Expected the promoted version in production, got %v", r)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/staging/abc.com/promote", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected promoting twice to fail, got %d", w.Code)
+	}
+
+	c.loadZones(map[string]string{"abc.com": abcZone})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("DELETE", "/staging/abc.com", nil))
+	if w.Code != http.StatusOK || len(c.stagingList()) != 0 {
+		t.Errorf("DELETE /staging/abc.com: want: %d, got: %d %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if r := stagedQueryA("abc.com."); r == nil || r.Answer[0].(*dns.A).A.String() != "127.0.0.9" {
+		t.Errorf("Expected a discarded version never to go live, got %v", r)
+	}
+}
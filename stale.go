@@ -0,0 +1,141 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// fetchedObject is the version of a bucket object last fetched, and when
+type fetchedObject struct {
+	zoneFile
+	at time.Time
+}
+
+// objectChanged reports whether the listed object f has to be fetched: it is new,
+// or its ETag or LastModified differs from the version last fetched. Without ETags,
+// an object modified within --clock-skew of the last fetch is fetched again, as it
+// could have been overwritten within the same second, or by a writer whose clock
+// is behind ours, without its LastModified changing.
+func (c *config) objectChanged(f zoneFile) bool {
+	seen, ok := c.fetched[f.Key]
+	switch {
+	case !ok:
+		return true
+	case len(f.ETag) > 0 && len(seen.ETag) > 0:
+		return f.ETag != seen.ETag
+	case !f.LastModified.Equal(seen.LastModified):
+		return true
+	}
+	return !f.LastModified.Before(seen.at.Add(-c.clockSkew))
+}
+
+// markFetched records the objects fetched and loaded by an update, and forgets
+// those no longer listed, so they are fetched if they come back
+func (c *config) markFetched(fetched map[string]fetchedObject, listed []zoneFile) {
+	if c.fetched == nil {
+		c.fetched = map[string]fetchedObject{}
+	}
+	for k, f := range fetched {
+		c.fetched[k] = f
+	}
+	keys := map[string]bool{}
+	for _, f := range listed {
+		keys[f.Key] = true
+	}
+	for k := range c.fetched {
+		if !keys[k] {
+			delete(c.fetched, k)
+		}
+	}
+}
+
+// markLoaded marks the objects the last getZones fetched once loadZones has loaded
+// them. Objects that failed to load, and the template and key files of zones that
+// failed, are left out so the next update fetches them again.
+func (c *config) markLoaded(failed []string, sources map[string]string) {
+	loaded := map[string]fetchedObject{}
+	for key, f := range c.pending {
+		n := strings.TrimPrefix(key, c.prefix)
+		ok := true
+		for _, bad := range failed {
+			if n == bad || n == sources[bad] || strings.HasPrefix(n, bad+".") {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			loaded[key] = f
+		}
+	}
+	c.pending = nil
+	if c.fetched == nil {
+		c.fetched = map[string]fetchedObject{}
+	}
+	for k, f := range loaded {
+		c.fetched[k] = f
+	}
+}
+
+// markSynced records that the listed bucket keys were confirmed current at t.
+func (c *config) markSynced(keys []string, t time.Time) {
+	if c.synced == nil {
+		c.synced = map[string]time.Time{}
+	}
+	for _, k := range keys {
+		c.synced[k] = t
+	}
+}
+
+// checkStale warns about zones whose bucket object has not been confirmed current
+// within c.staleAfter - either because updates keep failing or because the object
+// was removed from the bucket while we still serve it. It returns the stale count.
+func (c *config) checkStale() int {
+	if c.staleAfter <= 0 {
+		return 0
+	}
+	if c.staleZones == nil {
+		c.staleZones = map[string]bool{}
+	}
+	now := time.Now()
+	stale := 0
+	var oldest time.Duration
+	for n, z := range c.zones {
+		if c.secondaries.isSecondary(n) { // they expire instead, see secondary.go
+			continue
+		}
+		synced, ok := c.synced[z.source]
+		age := now.Sub(synced)
+		if ok && age > oldest {
+			oldest = age
+		}
+		if age <= c.staleAfter {
+			atomic.StoreInt32(&z.stale, 0)
+			if c.staleZones[n] {
+				log.Printf("Zone %s is no longer stale", n)
+				delete(c.staleZones, n)
+			}
+			continue
+		}
+		stale++
+		atomic.StoreInt32(&z.stale, 1) // answers say so, see ede.go
+		if !c.staleZones[n] {
+			if ok {
+				log.Printf("Warning: zone %s is stale, last refreshed from S3 at %s (%s ago)", n, synced.Format(time.RFC3339), age/time.Second*time.Second)
+			} else {
+				log.Printf("Warning: zone %s is stale, %s was never refreshed from S3", n, z.source)
+			}
+			c.staleZones[n] = true
+		}
+	}
+	for n := range c.staleZones {
+		if _, ok := c.zones[n]; !ok {
+			delete(c.staleZones, n)
+		}
+	}
+	c.stats.Gauge("zones.stale", int64(stale))
+	c.stats.Gauge("zones.oldest", int64(oldest/time.Second))
+	return stale
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"github.com/quipo/statsd"
+	"testing"
+	"time"
+)
+
+func TestCheckStale(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}, staleAfter: time.Hour}
+	getter := testGetter{testZones: map[string]testZone{
+		"abc.com":         testZone{LastModified: time.Now(), Contents: abcZone},
+		"parked.template": testZone{LastModified: time.Now(), Contents: parkedTemplate},
+		"parked.domains":  testZone{LastModified: time.Now(), Contents: "ghi.com\n"},
+	}}
+	z, err := c.getZones(getter)
+	if err != nil {
+		t.Fatalf("getZones failed: %s", err.Error())
+	}
+	if err := c.loadZones(z); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if n := c.checkStale(); n != 0 {
+		t.Errorf("checkStale found %d stale zones after a fresh sync", n)
+	}
+
+	c.synced["abc.com"] = time.Now().Add(-2 * time.Hour)
+	if n := c.checkStale(); n != 1 || !c.staleZones["abc.com"] {
+		t.Errorf("checkStale missed stale zone: got %d stale %v", n, c.staleZones)
+	}
+
+	delete(getter.testZones, "parked.template") // removed from the bucket but still served
+	c.synced["parked.template"] = time.Now().Add(-2 * time.Hour)
+	if _, err := c.getZones(getter); err != nil {
+		t.Fatalf("getZones failed: %s", err.Error())
+	}
+	if n := c.checkStale(); n != 1 || !c.staleZones["ghi.com"] || c.staleZones["abc.com"] {
+		t.Errorf("checkStale wrong after resync: got %d stale %v", n, c.staleZones)
+	}
+}
+
+func TestFailedObjectsFetchedAgain(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}}
+	modified := time.Now().Add(-time.Hour)
+	getter := testGetter{testZones: map[string]testZone{
+		"abc.com":        testZone{LastModified: modified, Contents: abcZone},
+		"def.com":        testZone{LastModified: modified, Contents: defZone},
+		"abc.com.policy": testZone{LastModified: modified, Contents: `{"stagged": true}`},
+	}}
+	z, err := c.getZones(getter)
+	if err != nil {
+		t.Fatalf("getZones failed: %s", err.Error())
+	}
+	if err := c.loadZones(z); err == nil {
+		t.Errorf("Expected a bad policy to fail the load")
+	}
+	if c.zones["abc.com"] == nil || c.zones["def.com"] == nil {
+		t.Fatalf("Expected the zones loaded alongside a bad policy, got %v", c.servingZones())
+	}
+	if z, _ = c.getZones(getter); len(z) != 1 || len(z["abc.com.policy"]) == 0 {
+		t.Errorf("Expected only the bad policy fetched again, got %d objects", len(z))
+	}
+	if err := c.loadZones(z); err == nil {
+		t.Errorf("Expected the bad policy to fail again")
+	}
+	getter.testZones["abc.com.policy"] = testZone{LastModified: time.Now(), Contents: `{"staged": true}`}
+	if z, _ = c.getZones(getter); len(z) != 1 {
+		t.Fatalf("Expected the fixed policy fetched, got %d objects", len(z))
+	}
+	if err := c.loadZones(z); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if p := c.zones["abc.com"].policy; p == nil || !p.Staged {
+		t.Errorf("Expected the fixed policy applied, got %+v", p)
+	}
+	if z, _ = c.getZones(getter); len(z) != 0 {
+		t.Errorf("Expected nothing fetched once everything loaded, got %d objects", len(z))
+	}
+}
+
+func TestObjectChanged(t *testing.T) {
+	c := config{clockSkew: time.Minute}
+	fetchedAt := time.Now()
+	old := fetchedAt.Add(-time.Hour)
+	c.markFetched(map[string]fetchedObject{
+		"abc.com":  fetchedObject{zoneFile{Key: "abc.com", LastModified: old, ETag: `"1"`}, fetchedAt},
+		"def.com":  fetchedObject{zoneFile{Key: "def.com", LastModified: old}, fetchedAt},
+		"new.com":  fetchedObject{zoneFile{Key: "new.com", LastModified: fetchedAt.Add(-time.Second)}, fetchedAt},
+		"gone.com": fetchedObject{zoneFile{Key: "gone.com", LastModified: old}, fetchedAt},
+	}, []zoneFile{{Key: "abc.com"}, {Key: "def.com"}, {Key: "new.com"}})
+	if _, ok := c.fetched["gone.com"]; ok {
+		t.Errorf("Expected an object no longer listed forgotten")
+	}
+	for _, tc := range []struct {
+		f    zoneFile
+		want bool
+	}{
+		{zoneFile{Key: "abc.com", LastModified: old, ETag: `"1"`}, false},
+		{zoneFile{Key: "abc.com", LastModified: fetchedAt, ETag: `"1"`}, false},          // touched, same contents
+		{zoneFile{Key: "abc.com", LastModified: old.Add(-time.Hour), ETag: `"2"`}, true}, // written by a clock behind ours
+		{zoneFile{Key: "def.com", LastModified: old}, false},
+		{zoneFile{Key: "def.com", LastModified: old.Add(time.Second)}, true},
+		{zoneFile{Key: "new.com", LastModified: fetchedAt.Add(-time.Second)}, true}, // within the skew of the fetch
+		{zoneFile{Key: "gone.com", LastModified: old}, true},
+	} {
+		if got := c.objectChanged(tc.f); got != tc.want {
+			t.Errorf("objectChanged(%+v): want %v, got %v", tc.f, tc.want, got)
+		}
+	}
+	c.clockSkew = 0
+	if c.objectChanged(zoneFile{Key: "new.com", LastModified: fetchedAt.Add(-time.Second)}) {
+		t.Errorf("Expected an object modified before the fetch unchanged without a skew window")
+	}
+}
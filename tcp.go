@@ -0,0 +1,219 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// TCP is served by our own accept loop rather than the dns package, which reads each
+// connection's first query in its accept loop and has no connection limits, so one
+// client holding sockets open could stall or exhaust the server. Connections are
+// capped in total (--tcp-max) and per client address (--tcp-per-ip), and reaped
+// when idle for --tcp-idle.
+const maxConnQueries = 128 // close a connection after this many queries, like the dns package
+
+// tcpConns tracks open TCP connections against the limits
+type tcpConns struct {
+	mu    sync.Mutex
+	total int
+	byIP  map[string]int
+}
+
+// acquire admits a connection from ip, returning the open connections or the stat
+// name of the limit it hit.
+func (t *tcpConns) acquire(ip string, max, perIP int) (int, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.total >= max {
+		return t.total, "tcp.rejected.max"
+	}
+	if t.byIP[ip] >= perIP {
+		return t.total, "tcp.rejected.perip"
+	}
+	if t.byIP == nil {
+		t.byIP = map[string]int{}
+	}
+	t.total++
+	t.byIP[ip]++
+	return t.total, ""
+}
+
+func (t *tcpConns) release(ip string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total--
+	if t.byIP[ip]--; t.byIP[ip] <= 0 {
+		delete(t.byIP, ip)
+	}
+	return t.total
+}
+
+// open returns the number of open connections. It is nil-safe.
+func (t *tcpConns) open() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.total
+}
+
+// serveTCP accepts connections on l until it is closed
+func (c *config) serveTCP(l *net.TCPListener, h dns.Handler) error {
+	return c.acceptStream(l, h, nil)
+}
+
+// acceptStream accepts connections on l until it is closed, serving each within the
+// connection limits. If wrap is set, it sets up each connection first, such as for
+// TLS, and the connection is closed if it fails.
+func (c *config) acceptStream(l *net.TCPListener, h dns.Handler, wrap func(net.Conn) (net.Conn, error)) error {
+	if c.tcp == nil {
+		c.tcp = &tcpConns{}
+	}
+	for {
+		conn, err := l.AcceptTCP()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				c.stats.Incr("tcp.accept.error", 1) // such as running out of file descriptors
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		ip := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+		open, limit := c.tcp.acquire(ip, c.tcpMax, c.tcpPerIP)
+		if len(limit) > 0 {
+			c.stats.Incr(limit, 1)
+			c.debug(fmt.Sprintf("Refused TCP connection from %s: %s", ip, limit))
+			conn.Close()
+			continue
+		}
+		c.stats.Gauge("tcp.connections", int64(open))
+		go func() {
+			var stream net.Conn = conn
+			defer func() {
+				stream.Close()
+				c.stats.Gauge("tcp.connections", int64(c.tcp.release(ip)))
+			}()
+			if wrap != nil {
+				wrapped, err := wrap(conn)
+				if err != nil {
+					return
+				}
+				stream = wrapped
+			}
+			if err := serveConn(stream, h, c.tcpIdle, c.tsigSecrets()); err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					c.stats.Incr("tcp.reaped", 1)
+				}
+			}
+		}()
+	}
+}
+
+// serveConn answers length-prefixed queries on a stream connection until the client
+// closes it, sends a malformed query or is idle for longer than idle. TSIG signed
+// queries are verified with secrets, like the dns package does. It returns the
+// error that ended the connection.
+func serveConn(conn net.Conn, h dns.Handler, idle time.Duration, secrets map[string]string) error {
+	for n := 0; n < maxConnQueries; n++ {
+		conn.SetReadDeadline(time.Now().Add(idle))
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return err
+		}
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if err := checkQuery(buf); err != nil {
+			return err
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil {
+			return err
+		}
+		w := &connWriter{conn: conn, timeout: idle, secrets: secrets}
+		if t := req.IsTsig(); t != nil {
+			w.tsigStatus = dns.ErrKeyAlg
+			if secret, ok := secrets[t.Hdr.Name]; ok {
+				w.tsigStatus = dns.TsigVerify(buf, secret, "", false)
+			}
+			w.requestMAC = t.MAC
+		}
+		h.ServeDNS(w, req)
+		if w.closed || w.hijacked {
+			return nil
+		}
+	}
+	return nil
+}
+
+// connWriter is the dns.ResponseWriter for stream connections
+type connWriter struct {
+	conn       net.Conn
+	timeout    time.Duration
+	closed     bool
+	hijacked   bool
+	secrets    map[string]string
+	tsigStatus error
+	requestMAC string
+}
+
+func (w *connWriter) LocalAddr() net.Addr  { return w.conn.LocalAddr() }
+func (w *connWriter) RemoteAddr() net.Addr { return w.conn.RemoteAddr() }
+
+func (w *connWriter) WriteMsg(m *dns.Msg) error {
+	var b []byte
+	var err error
+	if t := m.IsTsig(); t != nil {
+		b, _, err = dns.TsigGenerate(m, w.secrets[t.Hdr.Name], w.requestMAC, false)
+	} else {
+		b, err = m.Pack()
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (w *connWriter) Write(b []byte) (int, error) {
+	if len(b) > dns.MaxMsgSize {
+		return 0, fmt.Errorf("message too large")
+	}
+	l := make([]byte, 2, 2+len(b))
+	binary.BigEndian.PutUint16(l, uint16(len(b)))
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout)) // don't let a client that stops reading hold us
+	if _, err := w.conn.Write(append(l, b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *connWriter) Close() error {
+	w.closed = true
+	return w.conn.Close()
+}
+
+func (w *connWriter) TsigStatus() error   { return w.tsigStatus }
+func (w *connWriter) TsigTimersOnly(bool) {}
+func (w *connWriter) Hijack()             { w.hijacked = true }
+
+// listenTCP runs the TCP listener, calling up once it is listening, until it
+// fails like the dns package's does.
+func (c *config) listenTCP(addr string, up func()) error {
+	l, err := c.bindTCP(addr)
+	if err != nil {
+		return err
+	}
+	defer c.handoff.remove(l)
+	up()
+	return c.serveTCP(l, dns.DefaultServeMux)
+}
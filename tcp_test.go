@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPLimits(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c := &config{stats: statsd.NoopClient{}, tcpMax: 3, tcpPerIP: 2, tcpIdle: 300 * time.Millisecond}
+	mux := dns.NewServeMux()
+	mux.HandleFunc("abc.com.", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR("abc.com. 300 IN A 1.2.3.4")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	go c.serveTCP(l, mux)
+	addr := l.Addr().String()
+
+	req := new(dns.Msg)
+	req.SetQuestion("abc.com.", dns.TypeA)
+	r, _, err := (&dns.Client{Net: "tcp"}).Exchange(req, addr)
+	if err != nil || len(r.Answer) != 1 {
+		t.Fatalf("TCP query failed: %v %v", r, err)
+	}
+
+	openConns := func() int {
+		c.tcp.mu.Lock()
+		defer c.tcp.mu.Unlock()
+		return c.tcp.total
+	}
+	for i := 0; i < 20 && openConns() > 0; i++ { // the client closes its connection after the query
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	open := []net.Conn{}
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		open = append(open, conn)
+	}
+	closed := func(conn net.Conn, within time.Duration) bool {
+		conn.SetReadDeadline(time.Now().Add(within))
+		_, err := conn.Read(make([]byte, 1))
+		ne, ok := err.(net.Error)
+		return err != nil && !(ok && ne.Timeout())
+	}
+	if closed(open[0], 50*time.Millisecond) || closed(open[1], 50*time.Millisecond) {
+		t.Errorf("Expected two connections from one address to stay open")
+	}
+	if !closed(open[2], 100*time.Millisecond) {
+		t.Errorf("Expected the third connection from one address to be refused")
+	}
+	if !closed(open[0], time.Second) {
+		t.Errorf("Expected an idle connection to be reaped")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if total := openConns(); total != 0 {
+		t.Errorf("Expected no open connections after reaping, got %d", total)
+	}
+
+	if n, limit := c.tcp.acquire("10.0.0.1", 1, 1); n != 1 || len(limit) > 0 {
+		t.Errorf("acquire refused a connection: %d %s", n, limit)
+	}
+	if _, limit := c.tcp.acquire("10.0.0.2", 1, 1); limit != "tcp.rejected.max" {
+		t.Errorf("Expected the total limit, got %q", limit)
+	}
+	c.tcp.release("10.0.0.1")
+}
@@ -0,0 +1,102 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+)
+
+// gen-testzone writes a synthetic zone for load testing and benchmarks. The mix of
+// record types roughly follows real zones: mostly A and CNAME, some AAAA, TXT and
+// MX, a few SRV, CAA, delegations with glue and wildcards, and now and then a very
+// long name. The same --seed always gives the same zone.
+
+var testZoneWords = []string{"api", "app", "auth", "blog", "cdn", "dev", "docs", "edge", "img", "lb",
+	"mail", "media", "origin", "portal", "prod", "shop", "stage", "static", "status", "vpn", "web", "www"}
+
+// testZoneMix is the relative weight of each kind of record
+var testZoneMix = []struct {
+	kind   string
+	weight int
+}{
+	{"A", 40}, {"CNAME", 20}, {"AAAA", 12}, {"TXT", 10}, {"MX", 5}, {"SRV", 4}, {"CAA", 2},
+	{"NS", 2}, {"wildcard", 3}, {"long", 2},
+}
+
+// genTestZone writes a zone for domain with about records records to out.
+func genTestZone(out io.Writer, domain string, records int, seed int64) error {
+	r := rand.New(rand.NewSource(seed))
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "$TTL 300\n$ORIGIN %s.\n", domain)
+	fmt.Fprintf(&b, "@ 3600 IN SOA ns1.%s. hostmaster.%s. ( 1 10800 1200 864000 300 )\n", domain, domain)
+	fmt.Fprintf(&b, "@ IN NS ns1.%s.\n@ IN NS ns2.%s.\n", domain, domain)
+	fmt.Fprintf(&b, "ns1 IN A 192.0.2.1\nns2 IN A 192.0.2.2\nsip IN A 192.0.2.5\n")
+	for i := 0; i < 4; i++ {
+		fmt.Fprintf(&b, "mail%d IN A 192.0.2.%d\n", i, 10+i)
+	}
+	total := 0
+	for _, m := range testZoneMix {
+		total += m.weight
+	}
+	used := map[string]bool{"ns1": true, "ns2": true, "sip": true, "mail0": true, "mail1": true, "mail2": true, "mail3": true}
+	name := func() string {
+		for {
+			n := testZoneWords[r.Intn(len(testZoneWords))]
+			if r.Intn(2) == 0 {
+				n = fmt.Sprintf("%s%d", n, r.Intn(records+1))
+			}
+			if r.Intn(4) == 0 {
+				n += "." + testZoneWords[r.Intn(len(testZoneWords))]
+			}
+			if !used[n] {
+				used[n] = true
+				return n
+			}
+		}
+	}
+	for i := 10; i < records; i++ {
+		pick := r.Intn(total)
+		kind := ""
+		for _, m := range testZoneMix {
+			if pick < m.weight {
+				kind = m.kind
+				break
+			}
+			pick -= m.weight
+		}
+		switch kind {
+		case "A":
+			fmt.Fprintf(&b, "%s IN A 10.%d.%d.%d\n", name(), r.Intn(256), r.Intn(256), 1+r.Intn(254))
+		case "AAAA":
+			fmt.Fprintf(&b, "%s IN AAAA 2001:db8:%x::%x\n", name(), r.Intn(65536), 1+r.Intn(65535))
+		case "CNAME":
+			fmt.Fprintf(&b, "%s IN CNAME %s\n", name(), testZoneWords[r.Intn(len(testZoneWords))]+".cdn.example.net.")
+		case "TXT":
+			fmt.Fprintf(&b, "%s IN TXT \"v=test1 k=%x\"\n", name(), r.Int63())
+		case "MX":
+			fmt.Fprintf(&b, "%s IN MX %d mail%d.%s.\n", name(), 10*(1+r.Intn(3)), r.Intn(4), domain)
+		case "SRV":
+			fmt.Fprintf(&b, "_sip._tcp.%s IN SRV 10 %d 5060 sip.%s.\n", name(), r.Intn(100), domain)
+		case "CAA":
+			fmt.Fprintf(&b, "%s IN CAA 0 issue \"letsencrypt.org\"\n", name())
+		case "NS":
+			sub := fmt.Sprintf("dept%d", i) // unique, so no other record falls under the delegation
+			fmt.Fprintf(&b, "%s IN NS ns.%s\nns.%s IN A 198.51.100.%d\n", sub, sub, sub, 1+r.Intn(254))
+			i++
+		case "wildcard":
+			fmt.Fprintf(&b, "*.%s IN A 10.255.%d.%d\n", name(), r.Intn(256), 1+r.Intn(254))
+		case "long":
+			labels := []string{}
+			for l := 0; l < 3; l++ {
+				labels = append(labels, strings.Repeat(testZoneWords[r.Intn(len(testZoneWords))], 7)[:5+r.Intn(9)]+fmt.Sprintf("-%d", r.Intn(records+1)))
+			}
+			fmt.Fprintf(&b, "%s.%s.%s IN TXT \"long\"\n", strings.Repeat("x", 63), strings.Join(labels, "."), name())
+		}
+	}
+	_, err := out.Write(b.Bytes())
+	return err
+}
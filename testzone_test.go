@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"github.com/miekg/dns"
+	"strings"
+	"testing"
+)
+
+func TestGenTestZone(t *testing.T) {
+	var b bytes.Buffer
+	if err := genTestZone(&b, "test.example", 2000, 1); err != nil {
+		t.Fatalf("genTestZone failed: %s", err.Error())
+	}
+	rrs, scheduled, err := parseZone("test.example", b.String())
+	if err != nil {
+		t.Fatalf("Generated zone doesn't parse: %s", err.Error())
+	}
+	if n := len(rrs) + len(scheduled); n < 1990 || n > 2000 {
+		t.Errorf("Expected about 2000 records, got %d", n)
+	}
+	types := map[string]int{}
+	longest := 0
+	for _, rr := range rrs {
+		h := rr.Header()
+		types[dns.Type(h.Rrtype).String()]++
+		if strings.HasPrefix(h.Name, "*.") {
+			types["wildcard"]++
+		}
+		if len(h.Name) > longest {
+			longest = len(h.Name)
+		}
+	}
+	for _, want := range []string{"A", "AAAA", "CNAME", "TXT", "MX", "SRV", "CAA", "NS", "wildcard"} {
+		if types[want] == 0 {
+			t.Errorf("Expected %s records in the generated zone, got %v", want, types)
+		}
+	}
+	if longest < 100 {
+		t.Errorf("Expected some long names, the longest is %d", longest)
+	}
+	if problems := checkZone("test.example", rrs); len(problems) > 0 {
+		t.Errorf("Expected a clean zone, got %v", problems[0])
+	}
+
+	var again bytes.Buffer
+	genTestZone(&again, "test.example", 2000, 1)
+	if again.String() != b.String() {
+		t.Errorf("Expected the same seed to generate the same zone")
+	}
+}
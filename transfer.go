@@ -0,0 +1,158 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// transferACL is a zone policy's "allow_transfer", which lets secondaries such as
+// BIND or NSD transfer the zone with AXFR:
+//
+//	{"allow_transfer": {"cidrs": ["192.0.2.53", "198.51.100.0/24"], "tsig_keys": ["xfr"]}}
+//
+// With cidrs the client must be in one of the networks, and with tsig_keys the
+// request must be signed with one of the --tsig-keys; with both, it needs both.
+// Zones without the policy refuse transfers. Views and staged versions are
+// transferred to the clients they are served to.
+type transferACL struct {
+	CIDRs    []string `json:"cidrs"`
+	TSIGKeys []string `json:"tsig_keys"`
+
+	nets []*net.IPNet
+}
+
+// transferMsgSize is the size past which records go in the next message of a
+// transfer, well under the 64k TCP limit
+const transferMsgSize = 16384
+
+func (a *transferACL) compile(n string) error {
+	if len(a.CIDRs) == 0 && len(a.TSIGKeys) == 0 {
+		return fmt.Errorf("Error in policy for zone %s: allow_transfer has no cidrs or tsig_keys", n)
+	}
+	nets, err := parseCIDRs(strings.Join(a.CIDRs, ","))
+	if err != nil {
+		return fmt.Errorf("Error in policy for zone %s: allow_transfer: %s", n, err.Error())
+	}
+	a.nets = nets
+	for i, k := range a.TSIGKeys {
+		a.TSIGKeys[i] = dns.Fqdn(strings.ToLower(k))
+	}
+	return nil
+}
+
+// allowTransfer returns who may transfer the zone, nil for nobody. It is nil-safe.
+func (p *zonePolicy) allowTransfer() *transferACL {
+	if p == nil {
+		return nil
+	}
+	return p.AllowTransfer
+}
+
+// allows returns whether the ACL lets the client transfer the zone. It is nil-safe.
+func (a *transferACL) allows(c *config, w dns.ResponseWriter, req *dns.Msg) bool {
+	if a == nil {
+		return false
+	}
+	if len(a.nets) > 0 {
+		ip, in := remoteIP(w), false
+		for _, n := range a.nets {
+			if ip != nil && n.Contains(ip) {
+				in = true
+				break
+			}
+		}
+		if !in {
+			return false
+		}
+	}
+	if len(a.TSIGKeys) > 0 {
+		return contains(a.TSIGKeys, c.tsigKeyName(w, req))
+	}
+	return true
+}
+
+// isTransfer returns whether q asks for a zone transfer
+func isTransfer(q dns.Question) bool {
+	return q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR
+}
+
+// transfer answers an AXFR or IXFR query for z. IXFR gets the whole zone too, as
+// RFC 1995 allows, or over UDP just the SOA so the secondary retries over TCP.
+func (z *zone) transfer(c *config, w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	m := new(dns.Msg)
+	if !strings.EqualFold(q.Name, dns.Fqdn(z.name)) {
+		c.stats.Incr("transfer.notauth", 1)
+		m.SetRcode(req, dns.RcodeNotAuth)
+		c.extendedError(req, m, edeNotAuthoritative, "not a zone apex")
+		w.WriteMsg(m)
+		return
+	}
+	if !z.policy.allowTransfer().allows(c, w, req) {
+		c.stats.Incr("transfer.refused", 1)
+		log.Printf("Refused transfer of zone %s to %s", z.name, w.RemoteAddr().String())
+		m.SetRcode(req, dns.RcodeRefused)
+		c.extendedError(req, m, edeProhibited, "transfer not allowed")
+		w.WriteMsg(m)
+		return
+	}
+	var soa *dns.SOA
+	rrs := []dns.RR{}
+	for _, rr := range z.rrs {
+		if s, ok := rr.(*dns.SOA); ok && strings.EqualFold(s.Hdr.Name, q.Name) {
+			soa = s
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	if soa == nil {
+		c.stats.Incr("transfer.error", 1)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		c.extendedError(req, m, edeInvalidData, "zone has no SOA")
+		w.WriteMsg(m)
+		return
+	}
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+		m.SetReply(req)
+		m.Authoritative = true
+		if q.Qtype == dns.TypeIXFR {
+			m.Answer = []dns.RR{soa}
+		} else {
+			m.Rcode = dns.RcodeRefused // AXFR is TCP only (RFC 5936 section 4.2)
+			c.extendedError(req, m, edeNotSupported, "AXFR over UDP")
+		}
+		w.WriteMsg(m)
+		return
+	}
+	start := time.Now()
+	rrs = append(append([]dns.RR{soa}, rrs...), soa)
+	m.SetReply(req)
+	m.Authoritative = true
+	sent := 0
+	for i, rr := range rrs {
+		m.Answer = append(m.Answer, rr)
+		if i < len(rrs)-1 && m.Len() < transferMsgSize {
+			continue
+		}
+		if sent > 0 {
+			w.TsigTimersOnly(true) // later messages chain the MAC of the first (RFC 2845 section 4.4)
+		}
+		if err := w.WriteMsg(m); err != nil {
+			c.stats.Incr("transfer.error", 1)
+			log.Printf("Error transferring zone %s to %s: %s", z.name, w.RemoteAddr().String(), err.Error())
+			return
+		}
+		sent++
+		m = new(dns.Msg)
+		m.SetReply(req)
+		m.Authoritative = true
+	}
+	c.stats.Incr("transfer.axfr", 1)
+	c.stats.Timing("transfer", int64(time.Since(start)/time.Millisecond))
+	log.Printf("Transferred zone %s serial %d to %s (%d records, %d messages)", z.name, soa.Serial, w.RemoteAddr().String(), len(rrs), sent)
+}
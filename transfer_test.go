@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTransfer runs an AXFR of zone n from addr, returning the records received
+func testTransfer(addr, n, key string) ([]dns.RR, error) {
+	req := new(dns.Msg)
+	req.SetAxfr(dns.Fqdn(n))
+	tr := &dns.Transfer{}
+	if len(key) > 0 {
+		req.SetTsig(dns.Fqdn(key), dns.HmacSHA256, 300, time.Now().Unix())
+		tr.TsigSecret = map[string]string{dns.Fqdn(key): "c2VjcmV0"}
+	}
+	env, err := tr.In(req, addr)
+	if err != nil {
+		return nil, err
+	}
+	rrs := []dns.RR{}
+	for e := range env {
+		if e.Error != nil {
+			return rrs, e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	return rrs, nil
+}
+
+func TestZoneTransfer(t *testing.T) {
+	big := abcZone
+	for i := 0; i < 500; i++ {
+		big += fmt.Sprintf("txt%d IN TXT \"record %d of a zone too big for one message\"\n", i, i)
+	}
+	c := config{stats: statsd.NoopClient{}}
+	var err error
+	if c.tsig, err = c.parseTSIGKeys("xfr=c2VjcmV0"); err != nil {
+		t.Fatalf("parseTSIGKeys failed: %s", err.Error())
+	}
+	err = c.loadZones(map[string]string{
+		"abc.com":        big,
+		"abc.com.policy": `{"allow_transfer": {"cidrs": ["127.0.0.0/8"]}}`,
+		"def.com":        strings.Replace(big, "abc.com", "def.com", -1),
+		"def.com.policy": `{"allow_transfer": {"cidrs": ["127.0.0.1"], "tsig_keys": ["xfr"]}}`,
+		"ghi.com":        strings.Replace(defZone, "def.com", "ghi.com", -1),
+	})
+	if err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	started := make(chan bool)
+	server := &dns.Server{Addr: "127.0.0.1:25360", Net: "tcp", TsigSecret: c.tsigSecrets(), NotifyStartedFunc: func() { started <- true }}
+	go server.ListenAndServe()
+	<-started
+	defer server.Shutdown()
+
+	rrs, err := testTransfer("127.0.0.1:25360", "abc.com", "")
+	if err != nil {
+		t.Fatalf("AXFR failed: %s", err.Error())
+	}
+	if len(rrs) != len(c.zones["abc.com"].rrs)+1 || rrs[0].Header().Rrtype != dns.TypeSOA || rrs[len(rrs)-1].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("Expected the zone between SOA records, got %d records", len(rrs))
+	}
+
+	if _, err := testTransfer("127.0.0.1:25360", "def.com", ""); err == nil {
+		t.Errorf("Expected an unsigned transfer to be refused when the policy needs TSIG")
+	}
+	rrs, err = testTransfer("127.0.0.1:25360", "def.com", "xfr")
+	if err != nil || len(rrs) != len(c.zones["def.com"].rrs)+1 {
+		t.Errorf("Expected a signed transfer, got %d records: %v", len(rrs), err)
+	}
+	if _, err := testTransfer("127.0.0.1:25360", "ghi.com", ""); err == nil {
+		t.Errorf("Expected a zone without allow_transfer to refuse transfers")
+	}
+
+	// over UDP, AXFR is refused and IXFR gets the SOA
+	if m := testQuery(&c, "abc.com", "abc.com.", dns.TypeAXFR); m == nil || m.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected AXFR over UDP to be refused, got %v", m)
+	}
+	if m := testQuery(&c, "abc.com", "abc.com.", dns.TypeIXFR); m == nil || len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("Expected the SOA for IXFR over UDP, got %v", m)
+	}
+	if m := testQuery(&c, "abc.com", "www.abc.com.", dns.TypeAXFR); m == nil || m.Rcode != dns.RcodeNotAuth {
+		t.Errorf("Expected NOTAUTH for a name below the apex, got %v", m)
+	}
+
+	for _, policy := range []string{
+		`{"allow_transfer": {}}`,
+		`{"allow_transfer": {"cidrs": ["10.0.0.0/33"]}}`,
+	} {
+		if _, err := parsePolicy("abc.com", policy); err == nil {
+			t.Errorf("Expected an error for policy %s", policy)
+		}
+	}
+}
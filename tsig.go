@@ -0,0 +1,160 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"time"
+)
+
+// TSIG keys are given with --tsig-keys as [algorithm:]name=secret, the secret in
+// base64 or an ssm:// or secretsmanager:// reference (resolved once at startup).
+// The algorithm defaults to hmac-sha256. Signed queries are verified by the
+// listeners; a query with a valid signature gets a signed reply and can select a
+// view (see views.go). Outbound, NOTIFYs are signed with a zone's transfer key, and
+// flattening lookups with --resolver-key, whose replies must then be signed too.
+var tsigAlgorithms = map[string]string{
+	"hmac-md5":    dns.HmacMD5,
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+type tsigKey struct {
+	algorithm string
+	secret    string // base64
+}
+
+// parseTSIGKeys reads --tsig-keys, resolving secret references
+func (c *config) parseTSIGKeys(list string) (map[string]tsigKey, error) {
+	keys := map[string]tsigKey{}
+	for _, spec := range splitList(list) {
+		f := strings.SplitN(spec, "=", 2)
+		if len(f) != 2 || len(f[0]) == 0 || len(f[1]) == 0 {
+			return nil, fmt.Errorf("invalid --tsig-keys entry %q: use [algorithm:]name=secret", spec)
+		}
+		alg, name := "hmac-sha256", f[0]
+		if i := strings.Index(name, ":"); i >= 0 {
+			alg, name = strings.ToLower(name[:i]), name[i+1:]
+		}
+		k := tsigKey{algorithm: tsigAlgorithms[alg], secret: f[1]}
+		if len(k.algorithm) == 0 {
+			return nil, fmt.Errorf("invalid --tsig-keys entry for %s: unknown algorithm %s", name, alg)
+		}
+		if isSecretRef(k.secret) {
+			secret, err := c.resolveSecret(k.secret)
+			if err != nil {
+				return nil, fmt.Errorf("Error resolving secret %s: %s", k.secret, err.Error())
+			}
+			k.secret = secret
+		}
+		if _, err := base64.StdEncoding.DecodeString(k.secret); err != nil {
+			return nil, fmt.Errorf("invalid --tsig-keys entry for %s: the secret is not base64", name)
+		}
+		keys[dns.Fqdn(strings.ToLower(name))] = k
+	}
+	return keys, nil
+}
+
+// tsigSecrets returns the secrets by key name for the listeners, nil without keys
+func (c *config) tsigSecrets() map[string]string {
+	if len(c.tsig) == 0 {
+		return nil
+	}
+	secrets := map[string]string{}
+	for name, k := range c.tsig {
+		secrets[name] = k.secret
+	}
+	return secrets
+}
+
+// tsigKeyName returns the key a query was signed with if its signature was verified,
+// or "" for unsigned or unverified queries.
+func (c *config) tsigKeyName(w dns.ResponseWriter, req *dns.Msg) string {
+	t := req.IsTsig()
+	if t == nil {
+		return ""
+	}
+	name := strings.ToLower(t.Hdr.Name)
+	if _, ok := c.tsig[name]; !ok || w.TsigStatus() != nil {
+		return ""
+	}
+	return name
+}
+
+// checkTSIG refuses signed queries whose signature doesn't verify with NOTAUTH, as
+// RFC 2845 asks, returning false if it did.
+func (c *config) checkTSIG(w dns.ResponseWriter, req *dns.Msg) bool {
+	if req.IsTsig() == nil || len(c.tsigKeyName(w, req)) > 0 {
+		return true
+	}
+	c.stats.Incr("tsig.failed", 1)
+	c.debug(fmt.Sprintf("Refused query [%s] with a bad TSIG signature: %v", w.RemoteAddr().String(), w.TsigStatus()))
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeNotAuth)
+	w.WriteMsg(m)
+	return false
+}
+
+// signingWriter signs replies to a verified TSIG query with the same key
+type signingWriter struct {
+	dns.ResponseWriter
+	key       string
+	algorithm string
+}
+
+func (w *signingWriter) WriteMsg(m *dns.Msg) error {
+	if m.IsTsig() == nil {
+		m.SetTsig(w.key, w.algorithm, 300, time.Now().Unix())
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// packQuery packs a query to the resolver, signed with --resolver-key if it is set,
+// returning the MAC the reply is signed over
+func (c *config) packQuery(m *dns.Msg) ([]byte, string, error) {
+	k, ok := c.tsig[c.resolverKey]
+	if !ok {
+		b, err := m.Pack()
+		return b, "", err
+	}
+	m = m.Copy()
+	m.SetTsig(c.resolverKey, k.algorithm, 300, time.Now().Unix())
+	return dns.TsigGenerate(m, k.secret, "", false)
+}
+
+// unpackReply unpacks the resolver's reply to a query packed by packQuery, which
+// must be signed with the same key if the query was
+func (c *config) unpackReply(buf []byte, mac string) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	if err := r.Unpack(buf); err != nil {
+		return nil, err
+	}
+	if err := c.verifyReply(r, buf, mac); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// verifyReply checks the signature of the resolver's reply r, packed as buf, when
+// --resolver-key is set
+func (c *config) verifyReply(r *dns.Msg, buf []byte, mac string) error {
+	k, ok := c.tsig[c.resolverKey]
+	if !ok {
+		return nil
+	}
+	var err error
+	if t := r.IsTsig(); t == nil {
+		err = fmt.Errorf("reply isn't signed with TSIG key %s", c.resolverKey)
+	} else if !strings.EqualFold(t.Hdr.Name, c.resolverKey) {
+		err = fmt.Errorf("reply is signed with TSIG key %s, not %s", t.Hdr.Name, c.resolverKey)
+	} else if buf != nil {
+		err = dns.TsigVerify(buf, k.secret, mac, false)
+	}
+	if err != nil {
+		c.stats.Incr("flatten.tsig.failed", 1)
+	}
+	return err
+}
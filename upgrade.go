@@ -0,0 +1,319 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A USR2 signal upgrades neddns in place without dropping queries: the running
+// process starts its executable again, which may since have been replaced by a new
+// version, with the same arguments, handing over its listening sockets as inherited
+// file descriptors named in NEDDNS_LISTENERS. The new process serves on them once
+// its zones are loaded, then says it is ready over a pipe it also inherits, and the
+// old process stops accepting, lets its open TCP connections finish for up to
+// --upgrade-drain seconds and exits. If the new process fails to start, exits or
+// isn't ready within upgradeTimeout, the old one carries on serving. Both processes
+// share the same sockets, so nothing is ever unbound.
+const (
+	upgradeEnv     = "NEDDNS_LISTENERS"
+	upgradeReady   = "ready"         // names the readiness pipe in upgradeEnv
+	upgradeTimeout = 5 * time.Minute // for the new process to load its zones
+)
+
+// handoffSocket is a listening socket that can be passed on
+type handoffSocket interface {
+	File() (*os.File, error)
+	Close() error
+}
+
+// handoff tracks our listening sockets, to pass them to the process upgrading us
+// or take them over from the one we upgrade
+type handoff struct {
+	mu        sync.Mutex
+	inherited map[string]*os.File // by network and address, such as "udp :53"
+	ready     *os.File            // the readiness pipe, nil unless we're an upgrade
+	keys      []string
+	sockets   []handoffSocket
+	upgrading bool
+	draining  bool
+}
+
+// inheritHandoff picks up the sockets passed on by the process we upgrade, if any
+func inheritHandoff() (*handoff, error) {
+	h := &handoff{inherited: map[string]*os.File{}}
+	names := os.Getenv(upgradeEnv)
+	if len(names) == 0 {
+		return h, nil
+	}
+	os.Unsetenv(upgradeEnv) // not for our own upgrades
+	for i, key := range strings.Split(names, ",") {
+		f := os.NewFile(uintptr(3+i), key) // after stdin, stdout and stderr
+		if f == nil {
+			return nil, fmt.Errorf("inherited listener %s is missing", key)
+		}
+		if key == upgradeReady {
+			h.ready = f
+		} else {
+			h.inherited[key] = f
+		}
+	}
+	if h.ready == nil {
+		return nil, fmt.Errorf("%s has no readiness pipe", upgradeEnv)
+	}
+	return h, nil
+}
+
+// inheriting reports whether we're taking over another process's sockets
+func (h *handoff) inheriting() bool {
+	return h != nil && h.ready != nil
+}
+
+// take returns the inherited socket for key, or nil to listen afresh
+func (h *handoff) take(key string) *os.File {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f := h.inherited[key]
+	delete(h.inherited, key)
+	return f
+}
+
+// add records a socket we listen on, to hand it over on an upgrade
+func (h *handoff) add(key string, s handoffSocket) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.keys = append(h.keys, key)
+	h.sockets = append(h.sockets, s)
+}
+
+// remove closes a socket we stopped listening on, so it isn't handed over
+func (h *handoff) remove(s handoffSocket) {
+	s.Close()
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := range h.sockets {
+		if h.sockets[i] == s {
+			h.keys = append(h.keys[:i:i], h.keys[i+1:]...)
+			h.sockets = append(h.sockets[:i:i], h.sockets[i+1:]...)
+			return
+		}
+	}
+}
+
+// bindUDP listens on UDP addr, or takes the socket over from the process we upgrade
+func (c *config) bindUDP(addr string) (*net.UDPConn, error) {
+	key := "udp " + addr
+	var conn net.PacketConn
+	var err error
+	if f := c.handoff.take(key); f != nil {
+		conn, err = net.FilePacketConn(f)
+		f.Close()
+	} else {
+		conn, err = net.ListenPacket("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("inherited %s isn't a UDP socket", key)
+	}
+	c.handoff.add(key, udp)
+	return udp, nil
+}
+
+// bindTCP listens on TCP addr, or takes the socket over from the process we upgrade
+func (c *config) bindTCP(addr string) (*net.TCPListener, error) {
+	key := "tcp " + addr
+	var l net.Listener
+	var err error
+	if f := c.handoff.take(key); f != nil {
+		l, err = net.FileListener(f)
+		f.Close()
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tcp, ok := l.(*net.TCPListener)
+	if !ok {
+		l.Close()
+		return nil, fmt.Errorf("inherited %s isn't a TCP socket", key)
+	}
+	c.handoff.add(key, tcp)
+	return tcp, nil
+}
+
+// signalReady tells the process we upgrade that we're serving, so it can stop.
+// Sockets it passed on that we no longer listen on are closed.
+func (c *config) signalReady() {
+	h := c.handoff
+	if !h.inheriting() {
+		return
+	}
+	h.mu.Lock()
+	for key, f := range h.inherited {
+		c.debug(fmt.Sprintf("Closing inherited listener %s, no longer configured", key))
+		f.Close()
+	}
+	h.inherited = map[string]*os.File{}
+	h.mu.Unlock()
+	if _, err := h.ready.Write([]byte{1}); err != nil {
+		log.Printf("Warning: could not tell the previous process we're ready: %s", err.Error())
+	}
+	h.ready.Close()
+	h.ready = nil
+	c.stats.Incr("upgrade.inherited", 1)
+	log.Printf("Took over the listeners of the previous process")
+}
+
+// isDraining reports whether we've handed our sockets over and are exiting, when
+// listener errors are expected
+func (h *handoff) isDraining() bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.draining
+}
+
+// upgrade starts a new process on our sockets and, once it is ready, drains and
+// exits. It returns if the upgrade fails, leaving us serving.
+func (c *config) upgrade() {
+	if len(c.chrootDir) > 0 || c.sandboxOn || len(c.doqAddr) > 0 {
+		log.Printf("Warning: can't upgrade in place with --chroot, --sandbox or --doq, restart instead")
+		return
+	}
+	h := c.handoff
+	h.mu.Lock()
+	if h.upgrading {
+		h.mu.Unlock()
+		log.Printf("Warning: an upgrade is already running")
+		return
+	}
+	h.upgrading = true
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		h.upgrading = false
+		h.mu.Unlock()
+	}()
+	c.stats.Incr("upgrade.started", 1)
+	c.saveCache() // for the new process to warm up from
+	cmd, ready, err := h.start()
+	if err != nil {
+		c.stats.Incr("upgrade.failed", 1)
+		log.Printf("Error: upgrade failed: %s", err.Error())
+		return
+	}
+	log.Printf("Upgrading: started process %d, waiting for it to load zones", cmd.Process.Pid)
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeTimeout):
+		cmd.Process.Kill()
+		err = fmt.Errorf("not ready after %s, killed it", upgradeTimeout)
+	}
+	if err != nil {
+		c.stats.Incr("upgrade.failed", 1)
+		log.Printf("Error: upgrade failed: process %d %s, still serving", cmd.Process.Pid, err.Error())
+		return
+	}
+	c.stats.Incr("upgrade.handedoff", 1)
+	log.Printf("Upgraded: process %d is serving, draining", cmd.Process.Pid)
+	c.drain()
+	c.queryLog.flush(c, time.Now())
+	os.Exit(0)
+}
+
+// start runs our executable again with our sockets, returning it and a channel
+// that gets nil once it is ready or an error if it exits first
+func (h *handoff) start() (*exec.Cmd, <-chan error, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+	h.mu.Lock()
+	keys := append([]string{}, h.keys...)
+	files := []*os.File{}
+	for _, s := range h.sockets {
+		f, err := s.File() // a duplicate, the socket stays ours too
+		if err != nil {
+			h.mu.Unlock()
+			closeFiles(files)
+			return nil, nil, err
+		}
+		files = append(files, f)
+	}
+	h.mu.Unlock()
+	r, w, err := os.Pipe()
+	if err != nil {
+		closeFiles(files)
+		return nil, nil, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), upgradeEnv+"="+strings.Join(append(keys, upgradeReady), ","))
+	cmd.ExtraFiles = append(files, w)
+	err = cmd.Start()
+	closeFiles(cmd.ExtraFiles) // the child has its own copies
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	ready := make(chan error, 1)
+	go func() {
+		defer r.Close()
+		if _, err := r.Read(make([]byte, 1)); err != nil { // EOF when it exits first
+			ready <- fmt.Errorf("exited before it was ready")
+			return
+		}
+		ready <- nil
+	}()
+	go cmd.Wait() // reap it if it fails
+	return cmd, ready, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// drain stops accepting queries, leaving them to the new process, and waits up to
+// --upgrade-drain for open TCP connections to finish
+func (c *config) drain() {
+	h := c.handoff
+	h.mu.Lock()
+	h.draining = true
+	sockets := h.sockets
+	h.sockets, h.keys = nil, nil
+	h.mu.Unlock()
+	for _, s := range sockets {
+		s.Close() // only our descriptor, the new process keeps the socket
+	}
+	deadline := time.Now().Add(c.upgradeDrain)
+	for c.tcp.open() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if open := c.tcp.open(); open > 0 {
+		log.Printf("Warning: closing %d TCP connections still open after draining", open)
+	}
+}
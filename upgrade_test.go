@@ -0,0 +1,99 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHandoff(t *testing.T) {
+	old := &config{stats: statsd.NoopClient{}, handoff: &handoff{inherited: map[string]*os.File{}}}
+	conn, err := old.bindUDP("127.0.0.1:25367")
+	if err != nil {
+		t.Fatalf("bindUDP failed: %s", err.Error())
+	}
+	l, err := old.bindTCP("127.0.0.1:25367")
+	if err != nil {
+		t.Fatalf("bindTCP failed: %s", err.Error())
+	}
+	if len(old.handoff.keys) != 2 || old.handoff.keys[0] != "udp 127.0.0.1:25367" || old.handoff.keys[1] != "tcp 127.0.0.1:25367" {
+		t.Fatalf("Expected both sockets recorded, got %v", old.handoff.keys)
+	}
+
+	// the new process takes the same sockets over rather than binding them again
+	udpFile, _ := conn.File()
+	tcpFile, _ := l.File()
+	r, w, _ := os.Pipe()
+	defer r.Close()
+	c := &config{stats: statsd.NoopClient{}, handoff: &handoff{ready: w, inherited: map[string]*os.File{
+		"udp 127.0.0.1:25367": udpFile, "tcp 127.0.0.1:25367": tcpFile, "tcp 127.0.0.1:25368": mustFile(t),
+	}}}
+	if !c.handoff.inheriting() {
+		t.Fatalf("Expected to be taking over sockets")
+	}
+	newConn, err := c.bindUDP("127.0.0.1:25367")
+	if err != nil {
+		t.Fatalf("bindUDP of an inherited socket failed: %s", err.Error())
+	}
+	newL, err := c.bindTCP("127.0.0.1:25367")
+	if err != nil {
+		t.Fatalf("bindTCP of an inherited socket failed: %s", err.Error())
+	}
+	defer newConn.Close()
+	defer newL.Close()
+	c.signalReady()
+	if n, err := r.Read(make([]byte, 1)); n != 1 || err != nil {
+		t.Errorf("Expected the previous process told we're ready, got %d %v", n, err)
+	}
+	if len(c.handoff.inherited) != 0 || c.handoff.inheriting() {
+		t.Errorf("Expected unused inherited sockets closed, got %v", c.handoff.inherited)
+	}
+
+	// the old process drains, and the sockets keep answering in the new one
+	old.upgradeDrain = time.Second
+	old.drain()
+	if !old.handoff.isDraining() {
+		t.Errorf("Expected the old process draining")
+	}
+	old.listenerFailed("udp", fmt.Errorf("use of closed network connection")) // doesn't exit while draining
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+	go (&dns.Server{PacketConn: newConn, Handler: handler}).ActivateAndServe()
+	go (&dns.Server{Listener: newL, Handler: handler}).ActivateAndServe()
+	for _, network := range []string{"udp", "tcp"} {
+		req := new(dns.Msg)
+		req.SetQuestion("abc.com.", dns.TypeA)
+		d := &dns.Client{Net: network, ReadTimeout: time.Second}
+		if _, _, err := d.Exchange(req, "127.0.0.1:25367"); err != nil {
+			t.Errorf("Expected the handed over %s socket to answer, got %s", network, err.Error())
+		}
+	}
+
+	if h, err := inheritHandoff(); err != nil || h.inheriting() {
+		t.Errorf("Expected nothing inherited without %s, got %v %v", upgradeEnv, h, err)
+	}
+}
+
+// mustFile returns a listening socket's file, standing in for one no longer configured
+func mustFile(t *testing.T) *os.File {
+	l, err := net.Listen("tcp", "127.0.0.1:25368")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err.Error())
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File failed: %s", err.Error())
+	}
+	return f
+}
@@ -0,0 +1,190 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A zone can serve different answers to different clients. Each view is a full zone
+// file stored next to the zone as <zone>@<view>, e.g. abc.com@internal, and the
+// zone's policy says who gets it:
+//
+//	{"views": [{"name": "internal", "cidrs": ["10.0.0.0/8"], "tsig_keys": ["internal-key"]}]}
+//
+// The first rule matching the client's address or the TSIG key its query was
+// verified with wins; everyone else gets the zone itself. With --ecs, a rule with
+// "ecs": true matches the client subnet resolvers send instead (see ecs.go).
+const viewSeparator = "@"
+
+type viewRule struct {
+	Name     string      `json:"name"`
+	CIDRs    []string    `json:"cidrs"`
+	TSIGKeys []string    `json:"tsig_keys"`
+	NXDomain *nxRedirect `json:"nxdomain_redirect"` // see nxredirect.go
+	ECS      bool        `json:"ecs"`               // match cidrs against the client subnet, see ecs.go
+
+	nets []*net.IPNet
+}
+
+func (v *viewRule) compile(zoneName string) error {
+	if len(v.Name) == 0 || strings.ContainsAny(v.Name, viewSeparator+"/") {
+		return fmt.Errorf("Error in policy for zone %s: view name %q is invalid", zoneName, v.Name)
+	}
+	if len(v.CIDRs) == 0 && len(v.TSIGKeys) == 0 {
+		return fmt.Errorf("Error in policy for zone %s: view %s has no cidrs or tsig_keys", zoneName, v.Name)
+	}
+	nets, err := parseCIDRs(strings.Join(v.CIDRs, ","))
+	if err != nil {
+		return fmt.Errorf("Error in policy for zone %s: view %s: %s", zoneName, v.Name, err.Error())
+	}
+	v.nets = nets
+	if v.ECS && len(nets) == 0 {
+		return fmt.Errorf("Error in policy for zone %s: view %s has ecs but no cidrs", zoneName, v.Name)
+	}
+	for i, k := range v.TSIGKeys {
+		v.TSIGKeys[i] = dns.Fqdn(strings.ToLower(k))
+	}
+	if v.NXDomain != nil {
+		return v.NXDomain.compile(zoneName, v.Name)
+	}
+	return nil
+}
+
+// viewZones holds every zone's views; handlers read it while reloads replace views.
+type viewZones struct {
+	mu    sync.RWMutex
+	zones map[string]map[string]*zone
+}
+
+func (v *viewZones) get(name, view string) *zone {
+	if v == nil {
+		return nil
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.zones[name][view]
+}
+
+func (v *viewZones) put(z *zone, view string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.zones == nil {
+		v.zones = map[string]map[string]*zone{}
+	}
+	if v.zones[z.name] == nil {
+		v.zones[z.name] = map[string]*zone{}
+	}
+	v.zones[z.name][view] = z
+}
+
+// loadViews removes view zone files from zones and loads them, keeping a view's
+// previous version if the new one doesn't parse.
+func (c *config) loadViews(zones map[string]string) []string {
+	if c.views == nil {
+		c.views = &viewZones{}
+	}
+	failed := []string{}
+	for key, contents := range zones {
+		i := strings.Index(key, viewSeparator)
+		if i < 0 {
+			continue
+		}
+		delete(zones, key)
+		n, view := key[:i], key[i+1:]
+		rrs, scheduled, err := parseZone(n, contents)
+		if err != nil {
+			log.Print(err)
+			failed = append(failed, key)
+			continue
+		}
+		c.putView(&zone{name: n, view: view, source: key, base: rrs, scheduled: scheduled, policy: c.policyFor(n)})
+		c.debug(fmt.Sprintf("Loaded view %s of zone %s (%d records)", view, n, len(rrs)))
+	}
+	return failed
+}
+
+// putView serves a view from its zone file records in z.base.
+func (c *config) putView(z *zone) {
+	z.rrs, _ = z.activeRRs(time.Now())
+	c.applyPolicy(z)
+	z.hot = nil
+	if c.hotSize > 0 {
+		z.hot = newHotCache(z, c.hotSize)
+	}
+	c.views.put(z, z.view)
+}
+
+// updateViewPolicies serves a zone's views with its current policy, after the policy
+// changed without new view files.
+func (c *config) updateViewPolicies(name string) {
+	c.views.mu.RLock()
+	views := []*zone{}
+	for _, z := range c.views.zones[name] {
+		views = append(views, z)
+	}
+	c.views.mu.RUnlock()
+	for _, z := range views {
+		updated := *z
+		updated.policy = c.policies[name]
+		updated.caaInjected = false
+		c.putView(&updated)
+	}
+}
+
+// selectView returns the name and zone of the view of z a query should be answered
+// from, or nil for z itself. If a rule matched against the client subnet ecs, the
+// reply's scope is set to its source prefix.
+func (c *config) selectView(z *zone, w dns.ResponseWriter, req *dns.Msg, ecs *dns.EDNS0_SUBNET) (string, *zone) {
+	if z.policy == nil || len(z.policy.Views) == 0 {
+		return "", nil
+	}
+	key := c.tsigKeyName(w, req)
+	ip := remoteIP(w)
+	for _, rule := range z.policy.Views {
+		addr := ip
+		if rule.ECS && ecs != nil && len(rule.nets) > 0 {
+			addr = subnetIP(ecs, ip)
+			ecs.SourceScope = ecs.SourceNetmask
+		}
+		if !rule.matches(key, addr) {
+			continue
+		}
+		if view := c.views.get(z.name, rule.Name); view != nil {
+			return rule.Name, view
+		}
+		c.debug(fmt.Sprintf("View %s of zone %s matched but isn't loaded", rule.Name, z.name))
+		return "", nil
+	}
+	return "", nil
+}
+
+func (v *viewRule) matches(key string, ip net.IP) bool {
+	for _, k := range v.TSIGKeys {
+		if len(key) > 0 && k == key {
+			return true
+		}
+	}
+	for _, n := range v.nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the client address of a query, or nil for a unix socket.
+func remoteIP(w dns.ResponseWriter) net.IP {
+	switch a := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
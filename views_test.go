@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestViews(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c := config{stats: statsd.NoopClient{}, tcpMax: 10, tcpPerIP: 10, tcpIdle: time.Second}
+	if c.tsig, err = c.parseTSIGKeys("partner-key=c2VjcmV0,hmac-sha1:other=b3RoZXI="); err != nil || len(c.tsig) != 2 {
+		t.Fatalf("parseTSIGKeys: %v %v", c.tsig, err)
+	}
+	for _, bad := range []string{"partner-key", "hmac-sha3:k=c2VjcmV0", "k=not base64"} {
+		if _, err := c.parseTSIGKeys(bad); err == nil {
+			t.Errorf("Expected --tsig-keys %q to be refused", bad)
+		}
+	}
+	policy := `{"views": [{"name": "partner", "tsig_keys": ["partner-key"]}, {"name": "internal", "cidrs": ["127.0.0.0/8"]}]}`
+	if err := c.loadZones(map[string]string{
+		"abc.com":          abcZone,
+		"abc.com.policy":   policy,
+		"abc.com@internal": strings.Replace(abcZone, "127.0.0.1", "10.0.0.1", 1),
+		"abc.com@partner":  strings.Replace(abcZone, "127.0.0.1", "192.0.2.1", 1),
+	}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	if _, ok := c.zones["abc.com@internal"]; ok {
+		t.Errorf("Expected view files not to be loaded as zones")
+	}
+	if _, err := parsePolicy("abc.com", `{"views": [{"name": "empty"}]}`); err == nil {
+		t.Errorf("Expected a view without cidrs or tsig_keys to be refused")
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("abc.com.", dns.TypeA)
+	w := &testWriter{}
+	dns.DefaultServeMux.ServeDNS(w, req)
+	if w.msg == nil || w.msg.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Errorf("Expected the internal view for a local client, got %v", w.msg)
+	}
+
+	go c.serveTCP(l, dns.DefaultServeMux)
+	client := &dns.Client{Net: "tcp", TsigSecret: map[string]string{"partner-key.": "c2VjcmV0"}}
+	req.SetTsig("partner-key.", dns.HmacSHA256, 300, time.Now().Unix())
+	r, _, err := client.Exchange(req, l.Addr().String())
+	if err != nil || r.IsTsig() == nil || r.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("Expected a signed answer from the partner view, got %v %v", r, err)
+	}
+
+	client.TsigSecret["partner-key."] = "d3Jvbmc="
+	req.SetTsig("partner-key.", dns.HmacSHA256, 300, time.Now().Unix())
+	r, _, err = client.Exchange(req, l.Addr().String())
+	if err != nil || r.Rcode != dns.RcodeNotAuth {
+		t.Errorf("Expected NOTAUTH for a bad signature, got %v %v", r, err)
+	}
+}
@@ -0,0 +1,146 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// The UDP and TCP listeners run under a watchdog. When one stops, on fd exhaustion
+// for example, it is marked down, alerted on and bound again after listenerBackoff,
+// doubling up to listenerMaxBackoff while binding keeps failing, say because the
+// previous process still holds the port after a restart. neddns keeps serving on
+// its other listeners meanwhile, and GET /ready on the admin API answers 503 until
+// every listener is up again, so a load balancer or orchestrator can route around
+// the instance or replace it.
+const (
+	listenerBackoff    = time.Second
+	listenerMaxBackoff = time.Minute
+)
+
+// listenerState is the health of one listener
+type listenerState struct {
+	Up       bool      `json:"up"`
+	Since    time.Time `json:"since"`
+	Restarts int       `json:"restarts"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// listenerHealth tracks the listeners run by the watchdog; a nil one tracks
+// nothing
+type listenerHealth struct {
+	mu     sync.Mutex
+	states map[string]*listenerState
+}
+
+func (l *listenerHealth) state(name string) *listenerState {
+	if l.states == nil {
+		l.states = map[string]*listenerState{}
+	}
+	if _, ok := l.states[name]; !ok {
+		l.states[name] = &listenerState{}
+	}
+	return l.states[name]
+}
+
+// watch notes listener name is starting, so it isn't ready until it is up
+func (l *listenerHealth) watch(name string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.state(name)
+}
+
+// up notes listener name is serving, reporting whether it was restarted
+func (l *listenerHealth) up(name string, now time.Time) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.state(name)
+	restarted := !s.Since.IsZero() && !s.Up
+	if restarted {
+		s.Restarts++
+	}
+	s.Up, s.Since, s.Error = true, now, ""
+	return restarted
+}
+
+// down notes listener name stopped with err
+func (l *listenerHealth) down(name string, err error, now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.state(name)
+	if s.Up {
+		s.Since = now
+	}
+	s.Up, s.Error = false, err.Error()
+}
+
+// ready reports whether every listener is up
+func (l *listenerHealth) ready() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range l.states {
+		if !s.Up {
+			return false
+		}
+	}
+	return true
+}
+
+// report copies the state of each listener
+func (l *listenerHealth) report() map[string]listenerState {
+	r := map[string]listenerState{}
+	if l == nil {
+		return r
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for name, s := range l.states {
+		r[name] = *s
+	}
+	return r
+}
+
+// supervise runs listener name until we drain, restarting it with backoff whenever
+// it stops. run binds the listener, calls up once it is serving and returns when
+// it stops serving, closing its socket.
+func (c *config) supervise(name string, run func(up func()) error) {
+	c.listeners.watch(name)
+	backoff := listenerBackoff
+	for {
+		err := run(func() {
+			if c.listeners.up(name, time.Now()) {
+				c.stats.Incr("listener."+name+".restarted", 1)
+				log.Printf("%s listener restarted", name)
+			}
+			backoff = listenerBackoff
+		})
+		if c.handoff.isDraining() { // we closed it, see drain
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("stopped serving")
+		}
+		c.listeners.down(name, err, time.Now())
+		c.stats.Incr("listener."+name+".down", 1)
+		log.Printf("Error: %s listener failed: %s, restarting in %s", name, err.Error(), backoff)
+		c.alerts.alert(c, alertListener, name, fmt.Sprintf("%s listener failed: %s", name, err.Error()))
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > listenerMaxBackoff {
+			backoff = listenerMaxBackoff
+		}
+	}
+}
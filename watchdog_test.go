@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/quipo/statsd"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	c := &config{stats: statsd.NoopClient{}, handoff: &handoff{inherited: map[string]*os.File{}}, listeners: &listenerHealth{}}
+	taken, err := net.Listen("tcp", "127.0.0.1:25369") // another process holds the port
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err.Error())
+	}
+	go c.supervise("tcp", func(up func()) error {
+		return c.listenTCP("127.0.0.1:25369", up)
+	})
+	ready := func() int {
+		w := httptest.NewRecorder()
+		c.apiHandler(nil).ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+		return w.Code
+	}
+	waitFor := func(what string, f func() bool) {
+		for deadline := time.Now().Add(5 * time.Second); !f(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s: %+v", what, c.listeners.report())
+			}
+		}
+	}
+	waitFor("the bind to fail", func() bool { return len(c.listeners.report()["tcp"].Error) > 0 })
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected not ready while the listener is down, got %d", code)
+	}
+
+	taken.Close()
+	waitFor("the listener to come up", func() bool { return c.listeners.ready() })
+	if code, s := ready(), c.listeners.report()["tcp"]; code != http.StatusOK || s.Restarts != 0 {
+		t.Errorf("Expected ready without a restart, got %d %+v", code, s)
+	}
+
+	c.handoff.mu.Lock()
+	l := c.handoff.sockets[0]
+	c.handoff.mu.Unlock()
+	l.Close() // the listener dies
+	waitFor("the listener to restart", func() bool { return c.listeners.report()["tcp"].Restarts == 1 })
+	if s := c.listeners.report()["tcp"]; !s.Up || len(c.handoff.sockets) != 1 || c.handoff.sockets[0] == l {
+		t.Errorf("Expected the listener bound again in place of the dead one, got %+v %v", s, c.handoff.sockets)
+	}
+	if conn, err := net.Dial("tcp", "127.0.0.1:25369"); err != nil {
+		t.Errorf("Expected the restarted listener to accept, got %s", err.Error())
+	} else {
+		conn.Close()
+	}
+
+	c.drain() // stops the watchdog
+}
@@ -0,0 +1,153 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// After each reload, every zone that was loaded again is summarized in a JSON POST to
+// the --webhooks URLs and to the "webhooks" in the zone's policy:
+//
+//	{"event": "zone.reload", "zone": "abc.com", "old_serial": 2014121700,
+//	 "new_serial": 2014121701, "records": 12, "added": 2, "removed": 1,
+//	 "duration_ms": 180, "time": "2015-06-01T12:00:00Z",
+//	 "text": "abc.com reloaded: serial 2014121700 -> 2014121701, 2 added, 1 removed"}
+//
+// The text field is what Slack and Teams incoming webhooks display. Hooks are called
+// in the background and never hold up a reload; failures are logged and counted by
+// webhook.error.
+const webhookTimeout = 10 * time.Second
+
+type reloadSummary struct {
+	Event      string `json:"event"`
+	Zone       string `json:"zone"`
+	OldSerial  uint32 `json:"old_serial"`
+	NewSerial  uint32 `json:"new_serial"`
+	NewZone    bool   `json:"new_zone,omitempty"`
+	Records    int    `json:"records"`
+	Added      int    `json:"added"`
+	Removed    int    `json:"removed"`
+	DurationMs int64  `json:"duration_ms"`
+	Time       string `json:"time"`
+	Text       string `json:"text"`
+}
+
+// checkWebhook checks a hook is an http or https URL
+func checkWebhook(hook string) error {
+	u, err := url.Parse(hook)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("must be an http or https URL")
+	}
+	return nil
+}
+
+// servingZones returns a copy of the zones being served, to compare after a reload
+func (c *config) servingZones() map[string]*zone {
+	zones := map[string]*zone{}
+	for n, z := range c.zones {
+		zones[n] = z
+	}
+	return zones
+}
+
+// zoneWebhooks returns the hooks told about reloads of zone n
+func (c *config) zoneWebhooks(n string) []string {
+	hooks := []string{}
+	for _, h := range c.webhooks {
+		hooks = append(hooks, h.get())
+	}
+	if p := c.policies[n]; p != nil {
+		hooks = append(hooks, p.Webhooks...)
+	}
+	return hooks
+}
+
+// reloadSummaries describes each zone with webhooks that was loaded since before was taken
+func (c *config) reloadSummaries(before map[string]*zone, elapsed time.Duration, now time.Time) []reloadSummary {
+	summaries := []reloadSummary{}
+	for n, z := range c.zones {
+		old, ok := before[n]
+		if (ok && old == z) || len(c.zoneWebhooks(n)) == 0 {
+			continue
+		}
+		s := reloadSummary{Event: "zone.reload", Zone: n, NewSerial: z.serial(), NewZone: !ok, Records: len(z.rrs),
+			DurationMs: int64(elapsed / time.Millisecond), Time: now.UTC().Format(time.RFC3339)}
+		records := map[string]bool{}
+		if ok {
+			s.OldSerial = old.serial()
+			for _, rr := range old.rrs {
+				records[rr.String()] = true
+			}
+		}
+		for _, rr := range z.rrs {
+			if records[rr.String()] {
+				delete(records, rr.String())
+			} else {
+				s.Added++
+			}
+		}
+		s.Removed = len(records)
+		if s.NewZone {
+			s.Text = fmt.Sprintf("%s loaded: serial %d, %d records", n, s.NewSerial, s.Records)
+		} else {
+			s.Text = fmt.Sprintf("%s reloaded: serial %d -> %d, %d added, %d removed", n, s.OldSerial, s.NewSerial, s.Added, s.Removed)
+		}
+		summaries = append(summaries, s)
+	}
+	sort.Sort(bySummaryZone(summaries))
+	return summaries
+}
+
+type bySummaryZone []reloadSummary
+
+func (s bySummaryZone) Len() int           { return len(s) }
+func (s bySummaryZone) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySummaryZone) Less(i, j int) bool { return s[i].Zone < s[j].Zone }
+
+// notifyReload sends the summary of each reloaded zone to its webhooks.
+func (c *config) notifyReload(before map[string]*zone, elapsed time.Duration) {
+	for _, s := range c.reloadSummaries(before, elapsed, time.Now()) {
+		body, err := json.Marshal(s)
+		if err != nil {
+			log.Printf("Error encoding webhook for zone %s: %s", s.Zone, err.Error())
+			continue
+		}
+		for _, hook := range c.zoneWebhooks(s.Zone) {
+			go c.postJSON(hook, body, "webhook")
+		}
+	}
+}
+
+// postJSON POSTs a JSON body to hook, counting the result as <metric>.sent or
+// <metric>.error.
+func (c *config) postJSON(hook string, body []byte, metric string) error {
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(hook, "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("status %s", resp.Status)
+		}
+	}
+	if err != nil {
+		c.stats.Incr(metric+".error", 1)
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err // without the URL, whose path may hold a token
+		}
+		host := metric
+		if u, perr := url.Parse(hook); perr == nil {
+			host = u.Host
+		}
+		log.Printf("Warning: %s to %s failed: %s", metric, host, err.Error())
+		return err
+	}
+	c.stats.Incr(metric+".sent", 1)
+	return nil
+}
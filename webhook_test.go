@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/quipo/statsd"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadWebhooks(t *testing.T) {
+	posts := make(chan reloadSummary, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var s reloadSummary
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			t.Errorf("Bad webhook body: %s", err.Error())
+		}
+		posts <- s
+	}))
+	defer hook.Close()
+
+	c := config{stats: statsd.NoopClient{}, update: time.Minute, reloads: &reloadStatus{}}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone, "def.com": defZone}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	newer := strings.Replace(abcZone, "2014121700", "2014121701", 1) + "new IN A 127.0.0.9\n"
+	getter := testGetter{testZones: map[string]testZone{
+		"abc.com":        testZone{LastModified: time.Now(), Contents: newer},
+		"abc.com.policy": testZone{LastModified: time.Now(), Contents: `{"webhooks": ["` + hook.URL + `/abc"]}`},
+		"def.com":        testZone{LastModified: time.Now(), Contents: defZone},
+	}}
+	if err := c.reloadZones(getter); err != nil {
+		t.Fatalf("reloadZones failed: %s", err.Error())
+	}
+	select {
+	case s := <-posts:
+		if s.Event != "zone.reload" || s.Zone != "abc.com" || s.OldSerial != 2014121700 || s.NewSerial != 2014121701 ||
+			s.Added != 2 || s.Removed != 1 || !strings.Contains(s.Text, "2014121700 -> 2014121701") {
+			t.Errorf("Unexpected reload summary: %+v", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a webhook for abc.com")
+	}
+	select {
+	case s := <-posts:
+		t.Errorf("Expected no webhook for def.com, which has none, got %+v", s)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := parsePolicy("abc.com", `{"webhooks": ["ftp://example.com/hook"]}`); err == nil {
+		t.Errorf("parsePolicy accepted a webhook that isn't http or https")
+	}
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	if err := c.postJSON(failing.URL, []byte("{}"), "webhook"); err == nil || strings.Contains(err.Error(), failing.URL) {
+		t.Errorf("Expected an error without the URL from a failing webhook, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+// Licensed under terms of MIT license, Copyright (c) 2015, ned@appliedtrust.com
+package main
+
+import (
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// Wildcard records, such as *.abc.com, answer for names that don't exist in the zone
+// (RFC 1034 section 4.3.3, clarified by RFC 4592). Only the wildcard at the closest
+// encloser, the longest existing name above the query name, is a source of
+// synthesis: with *.abc.com and host.abc.com, foo.bar.abc.com is answered from
+// *.abc.com but foo.host.abc.com isn't, and a name that exists, even with no records
+// of its own (an empty non-terminal), never is. Synthesized records are owned by the
+// query name. Names below a delegation are referred rather than synthesized. In
+// DNSSEC zones the wildcard's signatures are served with the NSEC or NSEC3 proving
+// the query name doesn't exist, and a wildcard without the type asked for proves a
+// NODATA rather than an NXDOMAIN. wildcardFor returns the owner name of the wildcard
+// records that answer for name, as written in the zone file, or "" if name exists
+// or there is no such wildcard.
+func (z *zone) wildcardFor(name string) string {
+	if z.hasName(name) {
+		return ""
+	}
+	wild := "*." + z.closestEncloser(name)
+	for _, rr := range z.rrs {
+		if strings.EqualFold(rr.Header().Name, wild) {
+			return rr.Header().Name
+		}
+	}
+	return ""
+}
+
+// hasOwner reports whether any of rrs is owned by name, as a quick check before
+// looking for a wildcard
+func hasOwner(rrs []dns.RR, name string) bool {
+	for _, rr := range rrs {
+		if strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardProof returns the NSEC or NSEC3 records proving that name, answered from
+// a wildcard, doesn't exist itself: the NSEC covering it, or the NSEC3 covering the
+// next closer name (RFC 4035 section 3.1.3.3, RFC 5155 section 7.2.6)
+func (z *zone) wildcardProof(name string) []dns.RR {
+	if len(z.nsec3s) > 0 {
+		rr, _ := z.findNSEC3(nextCloser(name, z.closestEncloser(name)))
+		return []dns.RR{rr}
+	}
+	if len(z.nsecs) > 0 {
+		return []dns.RR{z.coveringNSEC(name)}
+	}
+	return nil
+}
+
+// wildcardSigs returns the signatures of the wildcard records that rrset, owned by
+// name, was synthesized from, owned by name, and whether there are any
+func (z *zone) wildcardSigs(name string, t uint16, rrset []dns.RR) ([]dns.RR, bool) {
+	wild := z.wildcardFor(name)
+	if len(wild) == 0 {
+		return nil, false
+	}
+	s, ok := z.sigs[hotKey{strings.ToLower(wild), t}]
+	if !ok || s.contents != rrsetContents(renamed(rrset, wild)) {
+		return nil, false
+	}
+	return renamed(s.sigs, name), true
+}
+
+// nextCloser returns the name one label longer than its closest encloser ce
+func nextCloser(name, ce string) string {
+	labels := dns.Split(name)
+	return name[labels[len(labels)-dns.CountLabel(ce)-1]:]
+}
+
+// renamed returns copies of rrs owned by name
+func renamed(rrs []dns.RR, name string) []dns.RR {
+	out := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		out[i] = dns.Copy(rr)
+		out[i].Header().Name = name
+	}
+	return out
+}
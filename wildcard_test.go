@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/quipo/statsd"
+	"strings"
+	"testing"
+)
+
+const wildRecords = `*		IN	A	10.9.9.9
+*		IN	MX	10 mail.abc.com.
+host		IN	A	10.0.0.1
+*.deep		IN	TXT	"deep"
+a.b		IN	A	10.1.1.2
+`
+
+func TestWildcards(t *testing.T) {
+	c := config{stats: statsd.NoopClient{}}
+	if err := c.loadZones(map[string]string{"abc.com": abcZone + wildRecords}); err != nil {
+		t.Fatalf("loadZones failed: %s", err.Error())
+	}
+	for _, q := range []struct {
+		name   string
+		qtype  uint16
+		answer string
+	}{
+		{"foo.abc.com.", dns.TypeA, "10.9.9.9"},
+		{"x.y.abc.com.", dns.TypeA, "10.9.9.9"},      // the closest encloser is the apex
+		{"*.abc.com.", dns.TypeA, "10.9.9.9"},        // the wildcard itself
+		{"x.deep.abc.com.", dns.TypeTXT, "\"deep\""}, // deeper wildcards too
+		{"foo.abc.com.", dns.TypeAAAA, ""},
+		{"host.abc.com.", dns.TypeMX, ""},    // the name exists
+		{"foo.host.abc.com.", dns.TypeA, ""}, // no *.host.abc.com
+		{"b.abc.com.", dns.TypeA, ""},        // an empty non-terminal exists
+		{"deep.abc.com.", dns.TypeTXT, ""},   // and so does the wildcard's parent
+		{"x.a.b.abc.com.", dns.TypeA, ""},    // no *.a.b.abc.com
+	} {
+		m := testQuery(&c, "abc.com", q.name, q.qtype)
+		if len(q.answer) == 0 {
+			rcode := dns.RcodeSuccess
+			if strings.HasPrefix(q.name, "foo.host") || strings.HasPrefix(q.name, "x.a.b") {
+				rcode = dns.RcodeNameError
+			}
+			if len(m.Answer) != 0 || m.Rcode != rcode {
+				t.Errorf("Expected no answer for %s %s, got %v", q.name, dns.Type(q.qtype).String(), m)
+			}
+			continue
+		}
+		if len(m.Answer) != 1 || m.Answer[0].Header().Name != q.name || !dnsContains(m.Answer[0], q.answer) {
+			t.Errorf("Expected %s for %s %s, got %v", q.answer, q.name, dns.Type(q.qtype).String(), m)
+		}
+	}
+	if m := testQuery(&c, "abc.com", "foo.abc.com.", dns.TypeANY); len(m.Answer) != 2 {
+		t.Errorf("Expected the wildcard's A and MX for ANY, got %v", m)
+	}
+	for _, rr := range c.zones["abc.com"].rrs {
+		if rr.Header().Name == "foo.abc.com." {
+			t.Errorf("Expected the zone's records to stay owned by the wildcard, got %v", rr)
+		}
+	}
+
+	// signed answers carry the wildcard's signatures and prove the name doesn't exist
+	for _, policy := range []string{"", `{"nsec3": {"iterations": 1, "salt": "ab12"}}`} {
+		zones := testSignedZones(t)
+		zones["abc.com"] += wildRecords
+		if len(policy) > 0 {
+			zones["abc.com.policy"] = policy
+		}
+		c := config{stats: statsd.NoopClient{}}
+		if err := c.loadZones(zones); err != nil {
+			t.Fatalf("loadZones failed: %s", err.Error())
+		}
+		dnskeys := withoutType(testDOQuery(&c, "abc.com", "abc.com.", dns.TypeDNSKEY).Answer, dns.TypeRRSIG)
+		m := testDOQuery(&c, "abc.com", "foo.abc.com.", dns.TypeA)
+		verifyAnswer(t, m, dnskeys)
+		verifyRRs(t, m.Ns, dnskeys)
+		if sig := withoutType(m.Answer, dns.TypeA); len(sig) != 1 || sig[0].(*dns.RRSIG).Labels != 2 {
+			t.Errorf("Expected the wildcard's signature, got %v", m)
+		}
+		proven := false
+		for _, rr := range m.Ns {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				proven = proven || (canonicalLess(rr.Hdr.Name, "foo.abc.com.") && canonicalLess("foo.abc.com.", rr.NextDomain))
+			case *dns.NSEC3:
+				_, cover := nsec3Covers(rr, "foo.abc.com.")
+				proven = proven || cover
+			}
+		}
+		if !proven {
+			t.Errorf("Expected a proof that foo.abc.com doesn't exist (policy %s), got %v", policy, m)
+		}
+		if m := testDOQuery(&c, "abc.com", "foo.abc.com.", dns.TypeAAAA); m.Rcode != dns.RcodeSuccess || len(m.Ns) == 0 {
+			t.Errorf("Expected NODATA for a type the wildcard lacks (policy %s), got %v", policy, m)
+		}
+		if m := testDOQuery(&c, "abc.com", "foo.sub.abc.com.", dns.TypeA); len(m.Answer) != 0 || countType(m.Ns, dns.TypeNS) != 1 {
+			t.Errorf("Expected a referral below the delegation, not the wildcard, got %v", m)
+		}
+	}
+}
+
+// dnsContains reports whether the presentation format of rr ends with data
+func dnsContains(rr dns.RR, data string) bool {
+	s := rr.String()
+	return len(s) >= len(data) && s[len(s)-len(data):] == data
+}